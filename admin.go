@@ -0,0 +1,379 @@
+package caddypaseto
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/certmagic"
+)
+
+func init() {
+	caddy.RegisterModule(AdminAPI{})
+}
+
+// AdminAPI is a module that serves PASETO authentication endpoints on the
+// Caddy admin API.
+type AdminAPI struct {
+	storage certmagic.Storage
+}
+
+var (
+	_ caddy.AdminRouter = (*AdminAPI)(nil)
+	_ caddy.Provisioner = (*AdminAPI)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (AdminAPI) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "admin.api.paseto",
+		New: func() caddy.Module { return new(AdminAPI) },
+	}
+}
+
+// Provision sets up the module.
+func (a *AdminAPI) Provision(ctx caddy.Context) error {
+	a.storage = ctx.Storage()
+	return nil
+}
+
+// sessionStores returns the stores of tracked sessions: the in-memory store
+// shared by all handlers, and the one in the Caddy storage, if available.
+func (a *AdminAPI) sessionStores() []sessionStore {
+	stores := []sessionStore{sharedSessions}
+	if a.storage != nil {
+		stores = append(stores, newStorageSessionStore(a.storage))
+	}
+	return stores
+}
+
+// Routes returns the admin routes of the module.
+func (a *AdminAPI) Routes() []caddy.AdminRoute {
+	return []caddy.AdminRoute{
+		{
+			Pattern: "/paseto/maintenance",
+			Handler: caddy.AdminHandlerFunc(a.handleMaintenance),
+		},
+		{
+			Pattern: "/paseto/denylist",
+			Handler: caddy.AdminHandlerFunc(a.handleDenylist),
+		},
+		{
+			Pattern: "/paseto/keys",
+			Handler: caddy.AdminHandlerFunc(a.handleKeys),
+		},
+		{
+			Pattern: "/paseto/sessions",
+			Handler: caddy.AdminHandlerFunc(a.handleSessions),
+		},
+		{
+			Pattern: "/paseto/sessions/revoke",
+			Handler: caddy.AdminHandlerFunc(a.handleSessionsRevoke),
+		},
+		{
+			Pattern: "/paseto/tenants",
+			Handler: caddy.AdminHandlerFunc(a.handleTenants),
+		},
+	}
+}
+
+type maintenanceState struct {
+	Enabled bool `json:"enabled"`
+}
+
+// handleMaintenance returns the maintenance mode state on GET requests, and
+// sets it on POST and PUT requests.
+func (a *AdminAPI) handleMaintenance(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut:
+		var state maintenanceState
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("failed decoding request body: %w", err),
+			}
+		}
+		maintenanceToggle.Store(state.Enabled)
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	return writeJSON(w, maintenanceState{Enabled: maintenanceToggle.Load()})
+}
+
+type denylistRequest struct {
+	Fingerprints []string `json:"fingerprints"`
+	Tokens       []string `json:"tokens"`
+}
+
+type denylistState struct {
+	Fingerprints []string `json:"fingerprints"`
+}
+
+// handleDenylist returns the denied token fingerprints on GET requests, adds
+// fingerprints on POST requests, and removes them on DELETE requests. Tokens
+// can be specified instead of fingerprints, in which case their fingerprints
+// are computed.
+func (a *AdminAPI) handleDenylist(w http.ResponseWriter, r *http.Request) error {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodDelete:
+		var req denylistRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("failed decoding request body: %w", err),
+			}
+		}
+
+		fps := make([]string, 0, len(req.Fingerprints)+len(req.Tokens))
+		for _, fp := range req.Fingerprints {
+			parsed, err := parseFingerprint(fp)
+			if err != nil {
+				return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+			}
+			fps = append(fps, parsed)
+		}
+		for _, token := range req.Tokens {
+			fps = append(fps, tokenFingerprint(normToken(token)))
+		}
+		if len(fps) == 0 {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("fingerprints or tokens are required"),
+			}
+		}
+
+		if r.Method == http.MethodPost {
+			sharedDenylist.add(fps...)
+		} else {
+			sharedDenylist.remove(fps...)
+		}
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	return writeJSON(w, denylistState{Fingerprints: sharedDenylist.list()})
+}
+
+type keysRequest struct {
+	Version paseto.Version `json:"version"`
+	Purpose paseto.Purpose `json:"purpose"`
+	Keys    []string       `json:"keys"`
+	IDs     []string       `json:"ids"`
+	// Storage is the KeyStorage name of the keys in the Caddy storage to
+	// update, instead of the keys in memory.
+	Storage string `json:"storage"`
+}
+
+type keysState struct {
+	Version paseto.Version `json:"version"`
+	Purpose paseto.Purpose `json:"purpose"`
+	IDs     []string       `json:"ids"`
+	Replace bool           `json:"replace"`
+}
+
+// handleKeys returns the IDs of the keys managed via the admin API on GET
+// requests, adds keys on POST requests, replaces the configured keys on PUT
+// requests, and removes keys on DELETE requests. Keys are removed by value or
+// by ID, and all keys of the version and purpose are removed if neither is
+// specified. The keys of a KeyStorage are managed instead if the storage name
+// is specified, in the "storage" query parameter of GET requests, and in the
+// body of the other requests.
+func (a *AdminAPI) handleKeys(w http.ResponseWriter, r *http.Request) error {
+	storage := r.URL.Query().Get("storage")
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPut, http.MethodDelete:
+		var req keysRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return caddy.APIError{
+				HTTPStatus: http.StatusBadRequest,
+				Err:        fmt.Errorf("failed decoding request body: %w", err),
+			}
+		}
+		if err := a.updateKeys(r.Context(), r.Method, req); err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusBadRequest, Err: err}
+		}
+		storage = req.Storage
+	default:
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	if storage != "" {
+		states, err := a.storedKeysStates(r.Context(), storage)
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		return writeJSON(w, states)
+	}
+
+	states := make([]keysState, 0)
+	var listErr error
+	sharedAdminKeys.list(func(ver paseto.Version, purpose paseto.Purpose, set adminKeySet) {
+		ids, err := adminKeyIDs(ver, purpose, set.keys)
+		if err != nil {
+			listErr = err
+			return
+		}
+		states = append(states, keysState{Version: ver, Purpose: purpose, IDs: ids, Replace: set.replace})
+	})
+	if listErr != nil {
+		return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: listErr}
+	}
+
+	return writeJSON(w, states)
+}
+
+// updateKeys applies the keys request to the admin API keys, or to the keys of
+// the KeyStorage of the request.
+func (a *AdminAPI) updateKeys(ctx context.Context, method string, req keysRequest) error {
+	if req.Version == "" {
+		req.Version = paseto.Version4
+	} else if !slices.Contains([]paseto.Version{paseto.Version2, paseto.Version3, paseto.Version4}, req.Version) {
+		return fmt.Errorf("invalid version: '%s'", req.Version)
+	}
+	if req.Purpose == "" {
+		req.Purpose = paseto.Public
+	} else if !slices.Contains([]paseto.Purpose{paseto.Local, paseto.Public}, req.Purpose) {
+		return fmt.Errorf("invalid purpose: '%s'", req.Purpose)
+	}
+	if method != http.MethodDelete && len(req.Keys) == 0 {
+		return fmt.Errorf("keys are required")
+	}
+
+	keys, err := normalizeAdminKeys(req.Version, req.Purpose, req.Keys)
+	if err != nil {
+		return err
+	}
+	if req.Storage != "" {
+		return a.updateStorageKeys(ctx, method, req, keys)
+	}
+
+	switch method {
+	case http.MethodPost:
+		sharedAdminKeys.add(req.Version, req.Purpose, keys)
+	case http.MethodPut:
+		sharedAdminKeys.replace(req.Version, req.Purpose, keys)
+	case http.MethodDelete:
+		if len(req.IDs) > 0 {
+			set, _ := sharedAdminKeys.get(req.Version, req.Purpose)
+			ids, idsErr := adminKeyIDs(req.Version, req.Purpose, set.keys)
+			if idsErr != nil {
+				return idsErr
+			}
+			for i, id := range ids {
+				if slices.Contains(req.IDs, id) {
+					keys = append(keys, set.keys[i])
+				}
+			}
+			if len(keys) == 0 {
+				return fmt.Errorf("no key matches the IDs")
+			}
+		}
+		sharedAdminKeys.remove(req.Version, req.Purpose, keys)
+	}
+
+	return nil
+}
+
+// handleSessions returns the tracked sessions, optionally filtered by the
+// "subject", "jti" and "issuer" query parameters.
+func (a *AdminAPI) handleSessions(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	query := r.URL.Query()
+	filter := sessionFilter{Subject: query.Get("subject"), ID: query.Get("jti"), Issuer: query.Get("issuer")}
+
+	sessions := make([]Session, 0)
+	for _, store := range a.sessionStores() {
+		storeSessions, err := store.List(r.Context(), filter, time.Now())
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		sessions = append(sessions, storeSessions...)
+	}
+	sortSessions(sessions)
+
+	return writeJSON(w, sessions)
+}
+
+// handleSessionsRevoke revokes all tracked sessions that match the filter in
+// the request body.
+func (a *AdminAPI) handleSessionsRevoke(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodPost {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	var filter sessionFilter
+	if err := json.NewDecoder(r.Body).Decode(&filter); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("failed decoding request body: %w", err),
+		}
+	}
+	if filter.empty() {
+		return caddy.APIError{
+			HTTPStatus: http.StatusBadRequest,
+			Err:        fmt.Errorf("subject or jti is required"),
+		}
+	}
+
+	var count int
+	for _, store := range a.sessionStores() {
+		n, err := store.Revoke(r.Context(), filter, time.Now())
+		if err != nil {
+			return caddy.APIError{HTTPStatus: http.StatusInternalServerError, Err: err}
+		}
+		count += n
+	}
+
+	return writeJSON(w, map[string]int{"revoked": count})
+}
+
+// handleTenants returns the authentication stats of the tenants, optionally
+// filtered by the "tenant" query parameter.
+func (a *AdminAPI) handleTenants(w http.ResponseWriter, r *http.Request) error {
+	if r.Method != http.MethodGet {
+		return caddy.APIError{
+			HTTPStatus: http.StatusMethodNotAllowed,
+			Err:        fmt.Errorf("method not allowed: %s", r.Method),
+		}
+	}
+
+	return writeJSON(w, sharedTenantStats.list(r.URL.Query().Get("tenant")))
+}
+
+func writeJSON(w http.ResponseWriter, v any) error {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		return caddy.APIError{
+			HTTPStatus: http.StatusInternalServerError,
+			Err:        fmt.Errorf("failed encoding response: %w", err),
+		}
+	}
+	return nil
+}
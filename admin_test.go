@@ -0,0 +1,290 @@
+package caddypaseto
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestAdminAPI_Maintenance(t *testing.T) {
+	t.Cleanup(func() { maintenanceToggle.Store(false) })
+
+	api := &AdminAPI{}
+	tests := []struct {
+		name      string
+		method    string
+		body      string
+		expBody   string
+		expToggle bool
+		expErr    string
+	}{
+		{
+			name:    "ok/get",
+			method:  http.MethodGet,
+			expBody: `{"enabled":false}`,
+		},
+		{
+			name:      "ok/enable",
+			method:    http.MethodPost,
+			body:      `{"enabled":true}`,
+			expBody:   `{"enabled":true}`,
+			expToggle: true,
+		},
+		{
+			name:    "ok/disable",
+			method:  http.MethodPut,
+			body:    `{"enabled":false}`,
+			expBody: `{"enabled":false}`,
+		},
+		{
+			name:   "err/invalid_body",
+			method: http.MethodPost,
+			body:   `{"enabled":`,
+			expErr: "failed decoding request body",
+		},
+		{
+			name:   "err/invalid_method",
+			method: http.MethodDelete,
+			expErr: "method not allowed: DELETE",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(tt.method, "/paseto/maintenance", strings.NewReader(tt.body))
+			err := api.handleMaintenance(w, req)
+
+			if tt.expErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expErr)
+				return
+			}
+
+			require.NoError(t, err)
+			assert.JSONEq(t, tt.expBody, w.Body.String())
+			assert.Equal(t, tt.expToggle, maintenanceToggle.Load())
+		})
+	}
+}
+
+func TestAdminAPI_Sessions(t *testing.T) {
+	store := newMemorySessionStore()
+	origSessions := sharedSessions
+	sharedSessions = store
+	t.Cleanup(func() { sharedSessions = origSessions })
+
+	exp := time.Now().Add(time.Hour)
+	_, err := store.Seen(context.Background(), Session{ID: "a", Subject: "alice", ExpiresAt: exp}, time.Now(), 0)
+	require.NoError(t, err)
+	_, err = store.Seen(context.Background(), Session{ID: "b", Subject: "bob", ExpiresAt: exp}, time.Now(), 0)
+	require.NoError(t, err)
+
+	api := &AdminAPI{}
+
+	listSessions := func(query string) []Session {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/paseto/sessions"+query, nil)
+		require.NoError(t, api.handleSessions(w, req))
+		var sessions []Session
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &sessions))
+		return sessions
+	}
+
+	assert.Len(t, listSessions(""), 2)
+	sessions := listSessions("?subject=bob")
+	require.Len(t, sessions, 1)
+	assert.Equal(t, "b", sessions[0].ID)
+	assert.False(t, sessions[0].Revoked)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPost, "/paseto/sessions/revoke", strings.NewReader(`{"subject":"bob"}`))
+	require.NoError(t, api.handleSessionsRevoke(w, req))
+	assert.JSONEq(t, `{"revoked":1}`, w.Body.String())
+
+	sessions = listSessions("?jti=b")
+	require.Len(t, sessions, 1)
+	assert.True(t, sessions[0].Revoked)
+
+	req = httptest.NewRequest(http.MethodPost, "/paseto/sessions/revoke", strings.NewReader(`{}`))
+	err = api.handleSessionsRevoke(httptest.NewRecorder(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "subject or jti is required")
+
+	req = httptest.NewRequest(http.MethodGet, "/paseto/sessions/revoke", nil)
+	err = api.handleSessionsRevoke(httptest.NewRecorder(), req)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "method not allowed: GET")
+}
+
+func TestAdminAPI_Denylist(t *testing.T) {
+	origDenylist := sharedDenylist
+	sharedDenylist = newFingerprintSet()
+	t.Cleanup(func() { sharedDenylist = origDenylist })
+
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+	fp := tokenFingerprint(tokenStr)
+
+	auth := &PasetoAuth{
+		Key:       v4PrivateKey.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	authenticate := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	api := &AdminAPI{}
+	denylist := func(method, body string) (string, error) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/paseto/denylist", strings.NewReader(body))
+		err := api.handleDenylist(w, req)
+		return w.Body.String(), err
+	}
+
+	require.True(t, authenticate())
+
+	body, err := denylist(http.MethodPost, `{"tokens":["Bearer `+tokenStr+`"]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"fingerprints":["`+fp+`"]}`, body)
+	assert.False(t, authenticate())
+
+	body, err = denylist(http.MethodDelete, `{"fingerprints":["`+strings.ToUpper(fp)+`"]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"fingerprints":[]}`, body)
+	assert.True(t, authenticate())
+
+	_, err = denylist(http.MethodPost, `{"fingerprints":["abc"]}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "invalid fingerprint 'abc'")
+
+	_, err = denylist(http.MethodPost, `{}`)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "fingerprints or tokens are required")
+
+	auth = &PasetoAuth{
+		Key:              v4PrivateKey.Public().ExportHex(),
+		FromQuery:        []string{"token"},
+		DenyFingerprints: []string{fp},
+		logger:           slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	assert.False(t, authenticate())
+}
+
+func TestAdminAPI_Keys(t *testing.T) {
+	origAdminKeys := sharedAdminKeys
+	sharedAdminKeys = newAdminKeyStore()
+	t.Cleanup(func() { sharedAdminKeys = origAdminKeys })
+
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+	newKID := testKeyID(t, newKey.Public().ExportHex())
+	signToken := func(key paseto.V4AsymmetricSecretKey) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		return token.V4Sign(key, nil)
+	}
+	oldToken, newToken := signToken(oldKey), signToken(newKey)
+
+	auth := &PasetoAuth{
+		Key:       oldKey.Public().ExportHex(),
+		AdminKeys: true,
+		FromQuery: []string{"token"},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	authenticate := func(tokenStr string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	api := &AdminAPI{}
+	keys := func(method, body string) (string, error) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/paseto/keys", strings.NewReader(body))
+		err := api.handleKeys(w, req)
+		return w.Body.String(), err
+	}
+
+	assert.True(t, authenticate(oldToken))
+	assert.False(t, authenticate(newToken))
+
+	// Added keys are tried along with the configured keys.
+	body, err := keys(http.MethodPost, `{"keys":["`+newKey.Public().ExportHex()+`"]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"version":"v4","purpose":"public","ids":["`+newKID+`"],"replace":false}]`, body)
+	assert.True(t, authenticate(oldToken))
+	assert.True(t, authenticate(newToken))
+
+	// Replacing keys stops the configured keys from being accepted.
+	body, err = keys(http.MethodPut, `{"version":"v4","keys":["`+newKey.Public().ExportHex()+`"]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"version":"v4","purpose":"public","ids":["`+newKID+`"],"replace":true}]`, body)
+	assert.False(t, authenticate(oldToken))
+	assert.True(t, authenticate(newToken))
+
+	body, err = keys(http.MethodGet, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"version":"v4","purpose":"public","ids":["`+newKID+`"],"replace":true}]`, body)
+
+	// The configured keys are used again once the keys are removed.
+	body, err = keys(http.MethodDelete, `{"ids":["`+newKID+`"]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[]`, body)
+	assert.True(t, authenticate(oldToken))
+	assert.False(t, authenticate(newToken))
+
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		expErr string
+	}{
+		{name: "err/no_keys", method: http.MethodPost, body: `{}`, expErr: "keys are required"},
+		{name: "err/invalid_key", method: http.MethodPut, body: `{"keys":["abc"]}`, expErr: "invalid keys[0]"},
+		{
+			name:   "err/invalid_version",
+			method: http.MethodPost,
+			body:   `{"version":"v1","keys":["abc"]}`,
+			expErr: "invalid version: 'v1'",
+		},
+		{name: "err/unknown_id", method: http.MethodDelete, body: `{"ids":["k4.pid.abc"]}`, expErr: "no key matches"},
+		{name: "err/invalid_body", method: http.MethodPost, body: `{"keys":`, expErr: "failed decoding request body"},
+		{name: "err/invalid_method", method: http.MethodPatch, expErr: "method not allowed: PATCH"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := keys(tt.method, tt.body)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expErr)
+		})
+	}
+}
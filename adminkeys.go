@@ -0,0 +1,256 @@
+package caddypaseto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"aidanwoods.dev/go-paseto"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// adminKeySet is the set of keys of a version and purpose that were added via
+// the admin API.
+type adminKeySet struct {
+	keys []string
+	// replace makes the keys replace the configured keys, rather than being
+	// tried before them.
+	replace bool
+}
+
+// adminKeyStore holds the keys added via the admin API, by version and
+// purpose. Each change increments the generation, so that providers can cheaply
+// detect that their key set must be rebuilt.
+type adminKeyStore struct {
+	gen atomic.Uint64
+
+	mu   sync.RWMutex
+	sets map[string]adminKeySet
+}
+
+func newAdminKeyStore() *adminKeyStore {
+	return &adminKeyStore{sets: make(map[string]adminKeySet)}
+}
+
+// sharedAdminKeys is the store of keys managed via the admin API, and shared by
+// all module instances that enable them. It's not persisted.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var sharedAdminKeys = newAdminKeyStore()
+
+func adminKeySetName(ver paseto.Version, purpose paseto.Purpose) string {
+	return string(ver) + "." + string(purpose)
+}
+
+// generation returns the amount of changes made to the store.
+func (s *adminKeyStore) generation() uint64 {
+	return s.gen.Load()
+}
+
+// get returns the keys of the version and purpose, and the generation of the
+// store they were read at.
+func (s *adminKeyStore) get(ver paseto.Version, purpose paseto.Purpose) (adminKeySet, uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.sets[adminKeySetName(ver, purpose)], s.gen.Load()
+}
+
+// add adds the keys that aren't in the set of the version and purpose yet.
+func (s *adminKeyStore) add(ver paseto.Version, purpose paseto.Purpose, keys []string) {
+	s.update(ver, purpose, func(set *adminKeySet) {
+		for _, key := range keys {
+			if !slices.Contains(set.keys, key) {
+				set.keys = append(set.keys, key)
+			}
+		}
+	})
+}
+
+// replace sets the keys of the version and purpose, which replace the
+// configured keys.
+func (s *adminKeyStore) replace(ver paseto.Version, purpose paseto.Purpose, keys []string) {
+	s.update(ver, purpose, func(set *adminKeySet) {
+		set.keys, set.replace = slices.Clone(keys), true
+	})
+}
+
+// remove removes the keys from the set of the version and purpose, or the whole
+// set if no keys are specified. The configured keys are used again once the
+// set is empty.
+func (s *adminKeyStore) remove(ver paseto.Version, purpose paseto.Purpose, keys []string) {
+	s.update(ver, purpose, func(set *adminKeySet) {
+		if len(keys) == 0 {
+			set.keys = nil
+			return
+		}
+		set.keys = slices.DeleteFunc(set.keys, func(key string) bool { return slices.Contains(keys, key) })
+	})
+}
+
+func (s *adminKeyStore) update(ver paseto.Version, purpose paseto.Purpose, update func(*adminKeySet)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	name := adminKeySetName(ver, purpose)
+	set := s.sets[name]
+	set.keys = slices.Clone(set.keys)
+	update(&set)
+	if len(set.keys) == 0 {
+		delete(s.sets, name)
+	} else {
+		s.sets[name] = set
+	}
+	s.gen.Add(1)
+}
+
+// list calls fn with each non-empty set, ordered by version and purpose.
+func (s *adminKeyStore) list(fn func(ver paseto.Version, purpose paseto.Purpose, set adminKeySet)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, ver := range []paseto.Version{paseto.Version2, paseto.Version3, paseto.Version4} {
+		for _, purpose := range []paseto.Purpose{paseto.Local, paseto.Public} {
+			if set, ok := s.sets[adminKeySetName(ver, purpose)]; ok {
+				fn(ver, purpose, set)
+			}
+		}
+	}
+}
+
+// verificationKeyType returns the type of the keys that verify or decrypt the
+// tokens of the purpose.
+func verificationKeyType(purpose paseto.Purpose) xpaseto.KeyType {
+	if purpose == paseto.Local {
+		return xpaseto.KeyTypeSymmetric
+	}
+	return xpaseto.KeyTypePublic
+}
+
+// refreshAdminKeys rebuilds the key set with the current admin API keys. The
+// generation is recorded even if the keys are invalid, so that they're not
+// reloaded on every request.
+func (p *PasetoAuth) refreshAdminKeys() {
+	set, gen := p.adminKeys.get(p.Version, p.Purpose)
+	err := p.updateKeys(func(s *keySources) { s.admin = set })
+	p.keys.adminGen.Store(gen)
+	if err != nil {
+		p.logger.Warn(err.Error())
+		return
+	}
+	p.logger.Info("reloaded keys from the admin API", "keys", len(set.keys), "replace", set.replace)
+}
+
+// normalizeAdminKeys loads the keys passed to the admin API, and returns them
+// hex encoded, so that the same key in different encodings is stored once.
+func normalizeAdminKeys(ver paseto.Version, purpose paseto.Purpose, keys []string) ([]string, error) {
+	normalized := make([]string, 0, len(keys))
+	for i, data := range keys {
+		key, err := loadKey(data, "", ver, purpose, verificationKeyType(purpose))
+		if err != nil {
+			return nil, fmt.Errorf("invalid keys[%d]: %w", i, err)
+		}
+		normalized = append(normalized, key.ExportHex())
+	}
+
+	return normalized, nil
+}
+
+// adminKeyIDs returns the PASERK IDs of the stored keys, in the same order.
+func adminKeyIDs(ver paseto.Version, purpose paseto.Purpose, keys []string) ([]string, error) {
+	ids := make([]string, 0, len(keys))
+	for _, data := range keys {
+		key, err := loadKey(data, "", ver, purpose, verificationKeyType(purpose))
+		if err != nil {
+			return nil, err
+		}
+		id, err := paserkID(key, ver, purpose)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
+// updateStorageKeys applies the keys request to the keys of the KeyStorage of
+// the request, which are shared by all instances that use the same storage.
+// The keys are added on POST requests, replaced on PUT requests, and removed on
+// DELETE requests.
+func (a *AdminAPI) updateStorageKeys(ctx context.Context, method string, req keysRequest, keys []string) error {
+	if a.storage == nil {
+		return errors.New("storage is not available")
+	}
+	if strings.ContainsAny(req.Storage, `/\`) {
+		return fmt.Errorf("invalid storage: '%s'", req.Storage)
+	}
+
+	_, err := updateStoredKeys(ctx, a.storage, req.Storage, req.Version, req.Purpose,
+		func(stored []string) ([]string, error) {
+			switch method {
+			case http.MethodPost:
+				for _, key := range keys {
+					if !slices.Contains(stored, key) {
+						stored = append(stored, key)
+					}
+				}
+			case http.MethodPut:
+				stored = keys
+			case http.MethodDelete:
+				if len(req.IDs) > 0 {
+					ids, err := adminKeyIDs(req.Version, req.Purpose, stored)
+					if err != nil {
+						return nil, err
+					}
+					for i, id := range ids {
+						if slices.Contains(req.IDs, id) {
+							keys = append(keys, stored[i])
+						}
+					}
+					if len(keys) == 0 {
+						return nil, errors.New("no key matches the IDs")
+					}
+				}
+				if len(keys) == 0 {
+					return nil, nil
+				}
+				stored = slices.DeleteFunc(stored, func(key string) bool { return slices.Contains(keys, key) })
+			}
+			return stored, nil
+		})
+
+	return err
+}
+
+// storedKeysStates returns the PASERK IDs of the keys of the KeyStorage name,
+// by version and purpose.
+func (a *AdminAPI) storedKeysStates(ctx context.Context, name string) ([]keysState, error) {
+	if a.storage == nil {
+		return nil, errors.New("storage is not available")
+	}
+
+	states := make([]keysState, 0)
+	for _, ver := range []paseto.Version{paseto.Version2, paseto.Version3, paseto.Version4} {
+		for _, purpose := range []paseto.Purpose{paseto.Local, paseto.Public} {
+			keys, _, err := loadStoredKeys(ctx, a.storage, storedKeysPath(name, ver, purpose))
+			if err != nil {
+				return nil, err
+			}
+			if len(keys) == 0 {
+				continue
+			}
+			ids, err := adminKeyIDs(ver, purpose, keys)
+			if err != nil {
+				return nil, err
+			}
+			states = append(states, keysState{Version: ver, Purpose: purpose, IDs: ids})
+		}
+	}
+
+	return states, nil
+}
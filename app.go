@@ -0,0 +1,384 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+func init() {
+	caddy.RegisterModule(App{})
+	httpcaddyfile.RegisterGlobalOption(appName, parseAppCaddyfile)
+}
+
+// appName is the name of the paseto app.
+const appName = "paseto"
+
+// App is a Caddy app that owns the state shared by multiple pasetoauth
+// providers, so that sites using the same issuer load its keys once, and share
+// a single key refresh loop, instead of one per site. Providers reference an
+// issuer by name with PasetoAuth.Issuer.
+//
+// The denylist, the in-memory sessions, the rate limit counters and the
+// metrics are shared by all providers in the process, with or without the app.
+type App struct {
+	// Issuers maps issuer names to the keys used to verify or decrypt their
+	// tokens.
+	Issuers map[string]*Issuer `json:"issuers,omitempty"`
+
+	providers map[string]*PasetoAuth
+}
+
+// Issuer configures the keys of a token issuer. The fields work like the
+// fields of PasetoAuth with the same names.
+//
+// AllowAudiences, AllowIssuers, TimeSkewTolerance and MaxTokenAge are shared
+// settings: providers that reference the issuer use them, unless they set
+// their own. They can't be used in PasetoAuth.IssuerKeys.
+type Issuer struct {
+	Key             string               `json:"key,omitempty"`
+	Keys            []string             `json:"keys,omitempty"`
+	KeyPassword     string               `json:"key_password,omitempty"`
+	KeyPassphrase   *KeyPassphrase       `json:"key_passphrase,omitempty"`
+	KeyMaster       *KeyMaster           `json:"key_master,omitempty"`
+	KeyFile         string               `json:"key_file,omitempty"`
+	KeyCredential   string               `json:"key_credential,omitempty"`
+	KeyFileInterval time.Duration        `json:"key_file_interval,omitempty"`
+	KeyFileCheck    string               `json:"key_file_check,omitempty"`
+	KeyFileSOPS     *KeyFileSOPS         `json:"key_file_sops,omitempty"`
+	KeyURL          string               `json:"key_url,omitempty"`
+	KeyURLInterval  time.Duration        `json:"key_url_interval,omitempty"`
+	KeyURLTimeout   time.Duration        `json:"key_url_timeout,omitempty"`
+	KeyURLOutage    string               `json:"key_url_outage,omitempty"`
+	KeyURLPins      []string             `json:"key_url_pins,omitempty"`
+	KeyURLSignature *KeyURLSignature     `json:"key_url_signature,omitempty"`
+	KeyRotation     *KeyRotation         `json:"key_rotation,omitempty"`
+	KeyStorage      *KeyStorage          `json:"key_storage,omitempty"`
+	KeyAWS          *KeyAWS              `json:"key_aws,omitempty"`
+	KeyGCP          *KeyGCP              `json:"key_gcp,omitempty"`
+	AdminKeys       bool                 `json:"admin_keys,omitempty"`
+	KeyFailover     []string             `json:"key_failover,omitempty"`
+	KeyNotAfter     map[string]time.Time `json:"key_not_after,omitempty"`
+	StaleKeys       string               `json:"stale_keys,omitempty"`
+	Version         paseto.Version       `json:"version,omitempty"`
+	Purpose         paseto.Purpose       `json:"purpose,omitempty"`
+	CircuitBreaker  *CircuitBreaker      `json:"circuit_breaker,omitempty"`
+
+	AllowAudiences    []string      `json:"allow_audiences,omitempty"`
+	AllowIssuers      []string      `json:"allow_issuers,omitempty"`
+	TimeSkewTolerance time.Duration `json:"time_skew_tolerance,omitempty"`
+	MaxTokenAge       time.Duration `json:"max_token_age,omitempty"`
+}
+
+var (
+	_ caddy.App         = (*App)(nil)
+	_ caddy.Provisioner = (*App)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (App) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  appName,
+		New: func() caddy.Module { return new(App) },
+	}
+}
+
+// Provision loads the keys of all issuers, and starts refreshing them.
+func (a *App) Provision(ctx caddy.Context) error {
+	a.providers = make(map[string]*PasetoAuth, len(a.Issuers))
+	for name, iss := range a.Issuers {
+		p := iss.provider()
+		if err := p.Provision(ctx); err != nil {
+			return fmt.Errorf("invalid issuer '%s': %w", name, err)
+		}
+		p.logger = p.logger.With("issuer", name)
+		if err := p.Validate(); err != nil {
+			return fmt.Errorf("invalid issuer '%s': %w", name, err)
+		}
+		a.providers[name] = p
+	}
+
+	return nil
+}
+
+// Start implements caddy.App. The keys are refreshed on demand by the
+// providers that use them, so there's nothing to start.
+func (a *App) Start() error {
+	return nil
+}
+
+// Stop implements caddy.App. Background key fetches are stopped when the
+// module context is canceled.
+func (a *App) Stop() error {
+	for _, p := range a.providers {
+		p.releaseKeySource()
+	}
+	return nil
+}
+
+// provider returns the provider that owns the keys of the issuer.
+func (iss *Issuer) provider() *PasetoAuth {
+	return &PasetoAuth{
+		Key:             iss.Key,
+		Keys:            iss.Keys,
+		KeyPassword:     iss.KeyPassword,
+		KeyPassphrase:   iss.KeyPassphrase,
+		KeyMaster:       iss.KeyMaster,
+		KeyFile:         iss.KeyFile,
+		KeyCredential:   iss.KeyCredential,
+		KeyFileInterval: iss.KeyFileInterval,
+		KeyFileCheck:    iss.KeyFileCheck,
+		KeyFileSOPS:     iss.KeyFileSOPS,
+		KeyURL:          iss.KeyURL,
+		KeyURLInterval:  iss.KeyURLInterval,
+		KeyURLTimeout:   iss.KeyURLTimeout,
+		KeyURLOutage:    iss.KeyURLOutage,
+		KeyURLPins:      iss.KeyURLPins,
+		KeyURLSignature: iss.KeyURLSignature,
+		KeyRotation:     iss.KeyRotation,
+		KeyStorage:      iss.KeyStorage,
+		KeyAWS:          iss.KeyAWS,
+		KeyGCP:          iss.KeyGCP,
+		AdminKeys:       iss.AdminKeys,
+		KeyFailover:     iss.KeyFailover,
+		KeyNotAfter:     iss.KeyNotAfter,
+		StaleKeys:       iss.StaleKeys,
+		Version:         iss.Version,
+		Purpose:         iss.Purpose,
+		CircuitBreaker:  iss.CircuitBreaker,
+
+		AllowAudiences:    iss.AllowAudiences,
+		AllowIssuers:      iss.AllowIssuers,
+		TimeSkewTolerance: iss.TimeSkewTolerance,
+		MaxTokenAge:       iss.MaxTokenAge,
+	}
+}
+
+// sharesSettings returns true if any of the shared settings of the issuer is
+// set.
+func (iss *Issuer) sharesSettings() bool {
+	return len(iss.AllowAudiences) > 0 || len(iss.AllowIssuers) > 0 ||
+		iss.TimeSkewTolerance != 0 || iss.MaxTokenAge != 0
+}
+
+// loadIssuer looks up the issuer of the provider in the paseto app.
+func (p *PasetoAuth) loadIssuer(ctx caddy.Context) error {
+	if p.Issuer == "" {
+		return nil
+	}
+
+	mod, err := ctx.AppIfConfigured(appName)
+	if err != nil {
+		return fmt.Errorf("failed loading issuer '%s': %w", p.Issuer, err)
+	}
+	app, ok := mod.(*App)
+	if !ok {
+		return fmt.Errorf("failed loading issuer '%s': unexpected app type %T", p.Issuer, mod)
+	}
+	iss, ok := app.providers[p.Issuer]
+	if !ok {
+		return fmt.Errorf("unknown issuer '%s'", p.Issuer)
+	}
+	p.issuer = iss
+
+	return nil
+}
+
+// useIssuerSettings makes the provider use the shared settings of its issuer
+// that it doesn't set itself. The issuer provider is validated before, so its
+// TimeSkewTolerance is never 0, and replaces the default of the provider.
+func (p *PasetoAuth) useIssuerSettings() {
+	if p.issuer == nil {
+		return
+	}
+	if len(p.AllowAudiences) == 0 {
+		p.AllowAudiences = p.issuer.AllowAudiences
+	}
+	if len(p.AllowIssuers) == 0 {
+		p.AllowIssuers = p.issuer.AllowIssuers
+	}
+	if p.TimeSkewTolerance == 0 {
+		p.TimeSkewTolerance = p.issuer.TimeSkewTolerance
+	}
+	if p.MaxTokenAge == 0 {
+		p.MaxTokenAge = p.issuer.MaxTokenAge
+	}
+}
+
+// useIssuerKeys makes the provider use the keys, version and purpose of its
+// issuer.
+func (p *PasetoAuth) useIssuerKeys() error {
+	if p.issuer == nil {
+		return fmt.Errorf("unknown issuer '%s'", p.Issuer)
+	}
+	p.Version, p.Purpose = p.issuer.Version, p.issuer.Purpose
+	p.keys = p.issuer.keys
+
+	return nil
+}
+
+// parseAppCaddyfile sets up the paseto app from the global options of the
+// Caddyfile. Syntax:
+//
+//	paseto {
+//		issuer <name> {
+//			key <key>
+//			keys <key>...
+//			key_password <password>
+//			key_passphrase <passphrase> <salt> {
+//				time <passes>
+//				memory <KiB>
+//				threads <count>
+//			}
+//			key_master env|file <name or path>
+//			key_file <path> [<interval>]
+//			key_credential <name> [<interval>]
+//			key_file_check mtime|content
+//			key_url <url> [<interval>]
+//			key_url_timeout <duration>
+//			key_url_outage keep|reject
+//			key_url_pins <key ID or key>...
+//			key_url_signature <root key> [<signature url>]
+//			key_rotation [<name>] {
+//				interval <duration>
+//				overlap <duration>
+//				check_interval <duration>
+//			}
+//			key_storage [<name>] [<check interval>]
+//			admin_keys
+//			key_failover <source>...
+//			key_not_after <key ID or key> <time>
+//			stale_keys warn|reject
+//			version <protocol version>
+//			purpose <protocol purpose>
+//			circuit_breaker {
+//				threshold <count>
+//				cooldown <duration>
+//			}
+//			allow_audiences <audience name>...
+//			allow_issuers <issuer name>...
+//			time_skew_tolerance <duration>
+//			max_token_age <duration>
+//		}
+//	}
+func parseAppCaddyfile(d *caddyfile.Dispenser, _ any) (any, error) {
+	h := httpcaddyfile.Helper{Dispenser: d}
+	app := &App{Issuers: make(map[string]*Issuer)}
+
+	for h.Next() {
+		for h.NextBlock(0) {
+			opt := h.Val()
+			switch opt {
+			case "issuer":
+				if !h.NextArg() {
+					return nil, h.Errf("invalid issuer: expected a name")
+				}
+				name := h.Val()
+				if _, ok := app.Issuers[name]; ok {
+					return nil, h.Errf("invalid issuer: duplicate name: %s", name)
+				}
+				iss, err := parseIssuer(h)
+				if err != nil {
+					return nil, err
+				}
+				app.Issuers[name] = iss
+
+			default:
+				return nil, h.Errf("unrecognized paseto option: %s", opt)
+			}
+		}
+	}
+
+	return httpcaddyfile.App{
+		Name:  appName,
+		Value: caddyconfig.JSON(app, nil),
+	}, nil
+}
+
+func parseIssuer(h httpcaddyfile.Helper) (*Issuer, error) {
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
+
+	var p PasetoAuth
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		switch opt {
+		case "circuit_breaker":
+			cb, err := parseCircuitBreaker(h)
+			if err != nil {
+				return nil, err
+			}
+			p.CircuitBreaker = cb
+			continue
+
+		case "allow_audiences":
+			p.AllowAudiences = append(p.AllowAudiences, listArgs(h)...)
+			continue
+
+		case "allow_issuers":
+			p.AllowIssuers = append(p.AllowIssuers, listArgs(h)...)
+			continue
+
+		case "time_skew_tolerance", "max_token_age":
+			target := &p.TimeSkewTolerance
+			if opt == "max_token_age" {
+				target = &p.MaxTokenAge
+			}
+			var dur string
+			if !h.AllArgs(&dur) {
+				return nil, h.Errf("invalid %s: %q", opt, dur)
+			}
+			var err error
+			if *target, err = time.ParseDuration(dur); err != nil {
+				return nil, h.Errf("invalid %s: %q", opt, dur)
+			}
+			continue
+		}
+		if ok, err := parseKeyOption(h, opt, &p); err != nil {
+			return nil, err
+		} else if !ok {
+			return nil, h.Errf("unrecognized issuer option: %s", opt)
+		}
+	}
+
+	return &Issuer{
+		Key:             p.Key,
+		Keys:            p.Keys,
+		KeyPassword:     p.KeyPassword,
+		KeyPassphrase:   p.KeyPassphrase,
+		KeyMaster:       p.KeyMaster,
+		KeyFile:         p.KeyFile,
+		KeyCredential:   p.KeyCredential,
+		KeyFileInterval: p.KeyFileInterval,
+		KeyFileCheck:    p.KeyFileCheck,
+		KeyFileSOPS:     p.KeyFileSOPS,
+		KeyURL:          p.KeyURL,
+		KeyURLInterval:  p.KeyURLInterval,
+		KeyURLTimeout:   p.KeyURLTimeout,
+		KeyURLOutage:    p.KeyURLOutage,
+		KeyURLPins:      p.KeyURLPins,
+		KeyURLSignature: p.KeyURLSignature,
+		KeyRotation:     p.KeyRotation,
+		KeyStorage:      p.KeyStorage,
+		KeyAWS:          p.KeyAWS,
+		KeyGCP:          p.KeyGCP,
+		AdminKeys:       p.AdminKeys,
+		KeyFailover:     p.KeyFailover,
+		KeyNotAfter:     p.KeyNotAfter,
+		StaleKeys:       p.StaleKeys,
+		Version:         p.Version,
+		Purpose:         p.Purpose,
+		CircuitBreaker:  p.CircuitBreaker,
+
+		AllowAudiences:    p.AllowAudiences,
+		AllowIssuers:      p.AllowIssuers,
+		TimeSkewTolerance: p.TimeSkewTolerance,
+		MaxTokenAge:       p.MaxTokenAge,
+	}, nil
+}
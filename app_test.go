@@ -0,0 +1,219 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestParseAppCaddyfile(t *testing.T) {
+	d := caddyfile.NewTestDispenser(`
+	paseto {
+		issuer main {
+			key_file /etc/caddy/paseto.key 1m
+			keys k4.public.old, k4.public.older
+			version 4
+			circuit_breaker {
+				threshold 3
+			}
+			allow_issuers https://id.example.com
+			max_token_age 1h
+		}
+		issuer partner {
+			key_credential partner.key 5m
+			key_url https://partner.example.com/keys
+			purpose public
+		}
+	}
+	`)
+
+	val, err := parseAppCaddyfile(d, nil)
+	require.NoError(t, err)
+	assert.Equal(t, httpcaddyfile.App{
+		Name: appName,
+		Value: caddyconfig.JSON(&App{Issuers: map[string]*Issuer{
+			"main": {
+				KeyFile:         "/etc/caddy/paseto.key",
+				KeyFileInterval: time.Minute,
+				Keys:            []string{"k4.public.old", "k4.public.older"},
+				Version:         paseto.Version4,
+				CircuitBreaker:  &CircuitBreaker{Threshold: 3},
+				AllowIssuers:    []string{"https://id.example.com"},
+				MaxTokenAge:     time.Hour,
+			},
+			"partner": {
+				KeyCredential:   "partner.key",
+				KeyFileInterval: 5 * time.Minute,
+				KeyURL:          "https://partner.example.com/keys",
+				Purpose:         paseto.Public,
+			},
+		}}, nil),
+	}, val)
+
+	tests := []struct {
+		name      string
+		caddyfile string
+		expErr    string
+	}{
+		{
+			name:      "duplicate_issuer",
+			caddyfile: "paseto {\n issuer main {\n key abc\n }\n issuer main\n }",
+			expErr:    "invalid issuer: duplicate name: main",
+		},
+		{
+			name:      "unknown_issuer_option",
+			caddyfile: "paseto {\n issuer main {\n from_query token\n }\n }",
+			expErr:    "unrecognized issuer option: from_query",
+		},
+		{
+			name:      "unknown_option",
+			caddyfile: "paseto {\n keys abc\n }",
+			expErr:    "unrecognized paseto option: keys",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseAppCaddyfile(caddyfile.NewTestDispenser(tt.caddyfile), nil)
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.expErr)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateIssuer(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+
+	keyPath := filepath.Join(t.TempDir(), "paseto.key")
+	modTime := time.Now()
+	writeKey := func(key paseto.V4AsymmetricSecretKey) {
+		require.NoError(t, os.WriteFile(keyPath, []byte(key.Public().ExportHex()), 0o600))
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+	}
+	writeKey(oldKey)
+
+	logHandler := testutil.NewTestLogHandler()
+	issuer := (&Issuer{KeyFile: keyPath, KeyFileInterval: time.Nanosecond}).provider()
+	issuer.logger = slog.New(logHandler)
+	require.NoError(t, issuer.Validate())
+
+	newSite := func() *PasetoAuth {
+		site := &PasetoAuth{
+			Issuer:    "main",
+			FromQuery: []string{"token"},
+			issuer:    issuer,
+			logger:    slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, site.Validate())
+		return site
+	}
+	siteA, siteB := newSite(), newSite()
+	assert.Same(t, issuer.keys, siteA.keys)
+	assert.Same(t, issuer.keys, siteB.keys)
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	authenticate := func(site *PasetoAuth, key paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := site.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	assert.True(t, authenticate(siteA, oldKey))
+	assert.True(t, authenticate(siteB, oldKey))
+
+	// A key file change picked up by one site applies to all of them.
+	writeKey(newKey)
+	assert.True(t, authenticate(siteA, newKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "reloaded key file"))
+	assert.True(t, authenticate(siteB, newKey))
+	assert.False(t, authenticate(siteB, oldKey))
+}
+
+func TestPasetoAuth_ValidateIssuer(t *testing.T) {
+	issuer := (&Issuer{Key: paseto.NewV4SymmetricKey().ExportHex(), Purpose: paseto.Local}).provider()
+	issuer.logger = slog.New(testutil.NewTestLogHandler())
+	require.NoError(t, issuer.Validate())
+
+	site := &PasetoAuth{Issuer: "main", issuer: issuer}
+	require.NoError(t, site.Validate())
+	assert.Equal(t, paseto.Version4, site.Version)
+	assert.Equal(t, paseto.Local, site.Purpose)
+
+	site = &PasetoAuth{Issuer: "main", Key: "abc", issuer: issuer}
+	require.ErrorContains(t, site.Validate(), "issuer can't be used with key options, version or purpose")
+
+	site = &PasetoAuth{Issuer: "unknown"}
+	require.ErrorContains(t, site.Validate(), "unknown issuer 'unknown'")
+}
+
+func TestPasetoAuth_ValidateIssuerSettings(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	issuer := (&Issuer{
+		Key:               key.Public().ExportHex(),
+		AllowAudiences:    []string{"https://api.example.com"},
+		AllowIssuers:      []string{"https://id.example.com"},
+		TimeSkewTolerance: time.Minute,
+		MaxTokenAge:       time.Hour,
+	}).provider()
+	issuer.logger = slog.New(testutil.NewTestLogHandler())
+	require.NoError(t, issuer.Validate())
+
+	site := &PasetoAuth{Issuer: "main", issuer: issuer}
+	require.NoError(t, site.Validate())
+	assert.Equal(t, []string{"https://api.example.com"}, site.AllowAudiences)
+	assert.Equal(t, []string{"https://id.example.com"}, site.AllowIssuers)
+	assert.Equal(t, time.Minute, site.TimeSkewTolerance)
+	assert.Equal(t, time.Hour, site.MaxTokenAge)
+
+	site = &PasetoAuth{
+		Issuer:         "main",
+		AllowAudiences: []string{"https://learn.example.com"},
+		MaxTokenAge:    10 * time.Minute,
+		FromQuery:      []string{"token"},
+		issuer:         issuer,
+		logger:         slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, site.Validate())
+	assert.Equal(t, []string{"https://learn.example.com"}, site.AllowAudiences)
+	assert.Equal(t, []string{"https://id.example.com"}, site.AllowIssuers)
+	assert.Equal(t, time.Minute, site.TimeSkewTolerance)
+	assert.Equal(t, 10*time.Minute, site.MaxTokenAge)
+
+	authenticate := func(iss, aud string) bool {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		token.SetIssuer(iss)
+		token.SetAudience(aud)
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := site.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+	assert.True(t, authenticate("https://id.example.com", "https://learn.example.com"))
+	assert.False(t, authenticate("https://id.example.com", "https://api.example.com"))
+	assert.False(t, authenticate("https://evil.example.com", "https://learn.example.com"))
+}
@@ -0,0 +1,77 @@
+package caddypaseto
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+)
+
+func init() {
+	caddy.RegisterModule(PasetoAuthHandler{})
+}
+
+// PasetoAuthHandler is the HTTP handler of the pasetoauth directive. It works
+// like Caddy's authentication handler, except that requests the provider
+// rejected with a response of its own, e.g. the 429 of a rate limit, the 503
+// of the maintenance mode, or a challenge page, don't also fail with the
+// handler's 401 error. The response is already written then, so the error
+// would make Caddy write the status again, and run the error routes.
+type PasetoAuthHandler struct {
+	caddyauth.Authentication
+}
+
+var (
+	_ caddy.Provisioner           = (*PasetoAuthHandler)(nil)
+	_ caddyhttp.MiddlewareHandler = (*PasetoAuthHandler)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (PasetoAuthHandler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.paseto_auth",
+		New: func() caddy.Module { return new(PasetoAuthHandler) },
+	}
+}
+
+// ServeHTTP authenticates the request with the providers, and calls the next
+// handler if it's authenticated.
+func (h *PasetoAuthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	rec := &rejectionRecorder{ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}}
+	var authenticated bool
+	err := h.Authentication.ServeHTTP(rec, r, caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+		authenticated = true
+		//nolint:wrapcheck // handler errors are propagated as is
+		return next.ServeHTTP(w, r)
+	}))
+	if !authenticated && rec.wroteHeader {
+		return nil
+	}
+
+	//nolint:wrapcheck // handler errors are propagated as is
+	return err
+}
+
+// rejectionRecorder records whether the authentication providers wrote a
+// response.
+type rejectionRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	wroteHeader bool
+}
+
+// WriteHeader writes the header, and records that the response was written.
+// Informational responses aren't recorded.
+func (rec *rejectionRecorder) WriteHeader(status int) {
+	if status >= http.StatusOK {
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriterWrapper.WriteHeader(status)
+}
+
+// Write writes the data, and records that the response was written.
+func (rec *rejectionRecorder) Write(data []byte) (int, error) {
+	rec.wroteHeader = true
+	//nolint:wrapcheck // errors of the client connection are propagated as is
+	return rec.ResponseWriterWrapper.Write(data)
+}
@@ -0,0 +1,91 @@
+package caddypaseto
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuthHandler_ServeHTTP(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	require.NoError(t, token.Set("rpm", 1))
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	auth := &PasetoAuth{
+		Key:       v4PrivateKey.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		RateLimit: &RateLimit{Claim: "rpm"},
+		counters:  newMemoryCounterStore(),
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	h := &PasetoAuthHandler{Authentication: caddyauth.Authentication{
+		Providers: map[string]caddyauth.Authenticator{"paseto": auth},
+	}}
+
+	nextErr := errors.New("next handler failed")
+	tests := []struct {
+		name      string
+		query     string
+		next      error
+		expStatus int
+		expErr    int
+	}{
+		{name: "ok/authenticated", query: "?token=" + tokenStr, expStatus: http.StatusOK},
+		// The rate limit already wrote the 429, so it isn't followed by a
+		// 401 error.
+		{name: "ok/rate_limited", query: "?token=" + tokenStr, expStatus: http.StatusTooManyRequests},
+		{name: "err/not_authenticated", expErr: http.StatusUnauthorized},
+		// The errors of the next handler are returned, even if it wrote a
+		// response.
+		{name: "err/next", query: "?token=" + tokenStr, next: nextErr, expErr: http.StatusBadGateway},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.next != nil {
+				// Reset the counters, so that the token isn't rate limited.
+				auth.counters = newMemoryCounterStore()
+			}
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+			req = req.WithContext(context.WithValue(req.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, req, caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+				if tt.next != nil {
+					w.WriteHeader(http.StatusBadGateway)
+					return caddyhttp.Error(http.StatusBadGateway, tt.next)
+				}
+				w.WriteHeader(http.StatusOK)
+				return nil
+			}))
+
+			if tt.expErr != 0 {
+				var handlerErr caddyhttp.HandlerError
+				require.ErrorAs(t, err, &handlerErr)
+				assert.Equal(t, tt.expErr, handlerErr.StatusCode)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expStatus, w.Code)
+		})
+	}
+}
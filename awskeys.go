@@ -0,0 +1,589 @@
+package caddypaseto
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyAWS configures verification keys that are fetched from AWS Secrets
+// Manager, or decrypted with AWS KMS, so that the config doesn't contain the
+// keys in plaintext. The key document, which is a single key, or a JSON object
+// with a "keys" array, as with KeyURL, is fetched when the module is
+// provisioned, which fails if it can't be fetched, and then in the background
+// every RefreshInterval. The requests are signed with AWS Signature Version 4,
+// with the credentials of the $AWS_ACCESS_KEY_ID and $AWS_SECRET_ACCESS_KEY
+// environment variables, of the ECS or EKS Pod Identity container credentials
+// endpoint, or of the EC2 instance profile, in that order.
+type KeyAWS struct {
+	// Region is the AWS region of the secret or KMS key, e.g. "eu-west-1". The
+	// default is $AWS_REGION, or else $AWS_DEFAULT_REGION.
+	Region string `json:"region,omitempty"`
+
+	// SecretID is the name or ARN of the Secrets Manager secret whose
+	// SecretString or SecretBinary is the key document.
+	SecretID string `json:"secret_id,omitempty"`
+
+	// VersionStage is the staging label of the secret version, e.g.
+	// "AWSPREVIOUS". The default is "AWSCURRENT", so that rotated secrets are
+	// picked up by the next refresh.
+	VersionStage string `json:"version_stage,omitempty"`
+
+	// VersionID pins the secret version by its ID, instead of VersionStage.
+	VersionID string `json:"version_id,omitempty"`
+
+	// Ciphertext is a base64 encoded KMS ciphertext blob of the key document,
+	// e.g. the output of `aws kms encrypt`, which is decrypted with the KMS
+	// Decrypt API, instead of fetching the document from a secret.
+	Ciphertext string `json:"ciphertext,omitempty"`
+
+	// KMSKeyID is the ID, alias or ARN of the KMS key that Ciphertext must be
+	// encrypted with. By default, the key recorded in the ciphertext is used.
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	// EncryptionContext is the encryption context that Ciphertext was
+	// encrypted with.
+	EncryptionContext map[string]string `json:"encryption_context,omitempty"`
+
+	// Endpoint is the URL of the Secrets Manager or KMS API, e.g. of a VPC
+	// endpoint. It must be an HTTPS URL, or an HTTP URL of a loopback host. The
+	// default is the public endpoint of the service in Region.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// RefreshInterval is how often the key document is fetched. The default
+	// is 5m.
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"`
+
+	// Timeout is the timeout of a refresh, including the requests of the
+	// credentials. The default is 10s.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// awsRegionPattern matches the AWS region names, e.g. "us-gov-west-1".
+const awsRegionPattern = `^[a-z]{2}(-[a-z]+)+-[0-9]+$`
+
+// Environment variables of the AWS configuration and credentials, as used by
+// the AWS SDKs.
+const (
+	awsRegionEnv             = "AWS_REGION"
+	awsDefaultRegionEnv      = "AWS_DEFAULT_REGION"
+	awsAccessKeyIDEnv        = "AWS_ACCESS_KEY_ID"
+	awsSecretAccessKeyEnv    = "AWS_SECRET_ACCESS_KEY"
+	awsSessionTokenEnv       = "AWS_SESSION_TOKEN"
+	awsContainerRelativeEnv  = "AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"
+	awsContainerFullEnv      = "AWS_CONTAINER_CREDENTIALS_FULL_URI"
+	awsContainerTokenEnv     = "AWS_CONTAINER_AUTHORIZATION_TOKEN"
+	awsContainerTokenFileEnv = "AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"
+	awsMetadataEndpointEnv   = "AWS_EC2_METADATA_SERVICE_ENDPOINT"
+	awsMetadataDisabledEnv   = "AWS_EC2_METADATA_DISABLED"
+)
+
+// Default endpoints of the ECS container credentials and the EC2 instance
+// metadata service.
+const (
+	awsContainerEndpoint = "http://169.254.170.2"
+	awsMetadataEndpoint  = "http://169.254.169.254"
+)
+
+func (ka *KeyAWS) provision() error {
+	if ka.Region == "" {
+		ka.Region = os.Getenv(awsRegionEnv)
+	}
+	if ka.Region == "" {
+		ka.Region = os.Getenv(awsDefaultRegionEnv)
+	}
+	var errs []error
+	if ka.Region == "" {
+		errs = append(errs, fmt.Errorf("invalid key_aws: no region, set region or $%s", awsRegionEnv))
+	} else if !regexp.MustCompile(awsRegionPattern).MatchString(ka.Region) {
+		errs = append(errs, fmt.Errorf("invalid key_aws region: '%s'", ka.Region))
+	}
+
+	switch {
+	case (ka.SecretID == "") == (ka.Ciphertext == ""):
+		errs = append(errs, errors.New("invalid key_aws: expected either secret_id or ciphertext"))
+	case ka.SecretID != "":
+		if ka.VersionStage != "" && ka.VersionID != "" {
+			errs = append(errs, errors.New("invalid key_aws: version_stage can't be used with version_id"))
+		}
+		if ka.KMSKeyID != "" || len(ka.EncryptionContext) > 0 {
+			errs = append(errs, errors.New("invalid key_aws: kms_key_id and encryption_context require ciphertext"))
+		}
+	default:
+		if ka.VersionStage != "" || ka.VersionID != "" {
+			errs = append(errs, errors.New("invalid key_aws: version_stage and version_id require secret_id"))
+		}
+		if _, err := base64.StdEncoding.DecodeString(ka.Ciphertext); err != nil {
+			errs = append(errs, fmt.Errorf("invalid key_aws ciphertext: %w", err))
+		}
+	}
+
+	if ka.RefreshInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid key_aws refresh_interval: '%s'", ka.RefreshInterval))
+	} else if ka.RefreshInterval == 0 {
+		ka.RefreshInterval = 5 * time.Minute
+	}
+	if ka.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid key_aws timeout: '%s'", ka.Timeout))
+	} else if ka.Timeout == 0 {
+		ka.Timeout = 10 * time.Second
+	}
+
+	return errors.Join(errs...)
+}
+
+// service returns the name of the AWS service of the key document.
+func (ka *KeyAWS) service() string {
+	if ka.SecretID != "" {
+		return "secretsmanager"
+	}
+	return "kms"
+}
+
+// resource returns the secret or KMS key of the key document, for logs.
+func (ka *KeyAWS) resource() string {
+	switch {
+	case ka.SecretID != "":
+		return ka.SecretID
+	case ka.KMSKeyID != "":
+		return ka.KMSKeyID
+	default:
+		return "ciphertext"
+	}
+}
+
+// newSecretKeys returns the key document of the secret or ciphertext.
+func (ka *KeyAWS) newSecretKeys() (*secretKeys, error) {
+	if err := ka.provision(); err != nil {
+		return nil, err
+	}
+	endpoint := ka.Endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s.%s.amazonaws.com/", ka.service(), ka.Region)
+		if strings.HasPrefix(ka.Region, "cn-") {
+			endpoint = strings.TrimSuffix(endpoint, "/") + ".cn/"
+		}
+	}
+	u, err := parseSecretEndpoint(keySourceAWS, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &awsClient{
+		endpoint: u.String(),
+		region:   ka.Region,
+		service:  ka.service(),
+		client:   &http.Client{},
+		creds:    &awsCredentialProvider{client: &http.Client{}},
+	}
+	get := func(ctx context.Context) ([]byte, error) { return ka.getSecretValue(ctx, client) }
+	if ka.Ciphertext != "" {
+		get = func(ctx context.Context) ([]byte, error) { return ka.decrypt(ctx, client) }
+	}
+
+	return &secretKeys{desc: keySourceAWS, interval: ka.RefreshInterval, timeout: ka.Timeout, get: get}, nil
+}
+
+func (p *PasetoAuth) refreshKeyAWS() {
+	keys, changed, err := p.keys.aws.fetch(p.moduleContext())
+	if err == nil && changed {
+		err = p.updateKeys(func(s *keySources) {
+			s.aws = keys
+			s.setFailed(keySourceAWS, false)
+		})
+		if err != nil {
+			p.keys.aws.reset()
+		}
+	}
+	if err != nil {
+		p.logger.Warn(err.Error(), "key_aws", p.KeyAWS.resource())
+		if !errors.Is(err, context.Canceled) {
+			p.keySourceFailed(keySourceAWS)
+		}
+		return
+	}
+	if !changed {
+		return
+	}
+	p.logger.Info("reloaded key_aws keys", "key_aws", p.KeyAWS.resource(), "keys", len(keys))
+}
+
+// getSecretValue returns the key document of the secret, with the Secrets
+// Manager GetSecretValue API.
+func (ka *KeyAWS) getSecretValue(ctx context.Context, client *awsClient) ([]byte, error) {
+	in := struct {
+		SecretID     string `json:"SecretId"`
+		VersionID    string `json:"VersionId,omitempty"`
+		VersionStage string `json:"VersionStage,omitempty"`
+	}{ka.SecretID, ka.VersionID, ka.VersionStage}
+	var out struct {
+		SecretString *string `json:"SecretString"`
+		SecretBinary []byte  `json:"SecretBinary"`
+	}
+	if err := client.call(ctx, "secretsmanager.GetSecretValue", in, &out); err != nil {
+		return nil, err
+	}
+	if out.SecretString != nil {
+		return []byte(*out.SecretString), nil
+	}
+
+	return out.SecretBinary, nil
+}
+
+// decrypt returns the key document of the ciphertext, with the KMS Decrypt
+// API.
+func (ka *KeyAWS) decrypt(ctx context.Context, client *awsClient) ([]byte, error) {
+	in := struct {
+		CiphertextBlob    string            `json:"CiphertextBlob"`
+		KeyID             string            `json:"KeyId,omitempty"`
+		EncryptionContext map[string]string `json:"EncryptionContext,omitempty"`
+	}{ka.Ciphertext, ka.KMSKeyID, ka.EncryptionContext}
+	var out struct {
+		Plaintext []byte `json:"Plaintext"`
+	}
+	if err := client.call(ctx, "TrentService.Decrypt", in, &out); err != nil {
+		return nil, err
+	}
+
+	return out.Plaintext, nil
+}
+
+// awsClient calls the JSON API of an AWS service.
+type awsClient struct {
+	endpoint string
+	region   string
+	service  string
+	client   *http.Client
+	creds    *awsCredentialProvider
+}
+
+// call calls the operation of the API, e.g. "secretsmanager.GetSecretValue",
+// with the input, and decodes the result into out.
+func (c *awsClient) call(ctx context.Context, target string, in, out any) error {
+	body, err := json.Marshal(in)
+	if err != nil {
+		return fmt.Errorf("failed encoding request: %w", err)
+	}
+	creds, err := c.creds.get(ctx)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed creating request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", target)
+	signAWSRequest(req, body, creds, c.region, c.service, time.Now())
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed calling %s: %w", target, err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := readSecretResponse(resp, func(status int, body []byte) error {
+		return fmt.Errorf("failed calling %s: %w", target, awsAPIError(status, body))
+	})
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(data, out); err != nil {
+		return fmt.Errorf("invalid %s response: %w", target, err)
+	}
+
+	return nil
+}
+
+// awsAPIError returns the error of an AWS JSON API error response, e.g.
+// `{"__type":"ResourceNotFoundException","message":"..."}`.
+func awsAPIError(status int, body []byte) error {
+	var apiErr struct {
+		Type    string `json:"__type"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &apiErr) != nil || apiErr.Type == "" {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	// The type can be qualified, e.g. "com.amazonaws.kms#AccessDeniedException".
+	typ := apiErr.Type[strings.LastIndex(apiErr.Type, "#")+1:]
+	if apiErr.Message == "" {
+		return fmt.Errorf("unexpected status %d: %s", status, typ)
+	}
+
+	return fmt.Errorf("unexpected status %d: %s: %s", status, typ, apiErr.Message)
+}
+
+// signAWSRequest signs the request with AWS Signature Version 4, i.e. sets its
+// X-Amz-Date, X-Amz-Security-Token and Authorization headers. The host,
+// Content-Type and X-Amz-* headers are signed.
+func signAWSRequest(req *http.Request, body []byte, creds awsCredentials, region, service string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	if creds.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.SessionToken)
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, vals := range req.Header {
+		name = strings.ToLower(name)
+		if name != "content-type" && !strings.HasPrefix(name, "x-amz-") {
+			continue
+		}
+		trimmed := make([]string, len(vals))
+		for i, val := range vals {
+			trimmed[i] = strings.Join(strings.Fields(val), " ")
+		}
+		headers[name] = strings.Join(trimmed, ",")
+	}
+	names := slices.Sorted(maps.Keys(headers))
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	payloadHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, uri, awsCanonicalQuery(req.URL.Query()), canonicalHeaders.String(), signedHeaders,
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		creds.AccessKeyID, scope, signedHeaders, signature))
+}
+
+// awsCanonicalQuery returns the canonical query string of Signature Version 4,
+// i.e. the URI encoded parameters, sorted by name and value.
+func awsCanonicalQuery(query url.Values) string {
+	escape := func(s string) string { return strings.ReplaceAll(url.QueryEscape(s), "+", "%20") }
+	var params []string
+	for _, name := range slices.Sorted(maps.Keys(query)) {
+		for _, val := range slices.Sorted(slices.Values(query[name])) {
+			params = append(params, escape(name)+"="+escape(val))
+		}
+	}
+
+	return strings.Join(params, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsCredentials are the credentials that AWS requests are signed with. The
+// JSON fields are those of the container and instance metadata credentials.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	SessionToken    string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsCredentialsExpiryWindow is how long before they expire temporary
+// credentials are renewed.
+const awsCredentialsExpiryWindow = 5 * time.Minute
+
+// awsCredentialProvider returns the credentials of the environment, and caches
+// the temporary credentials of the container or the instance until shortly
+// before they expire.
+type awsCredentialProvider struct {
+	client *http.Client
+
+	mu     sync.Mutex
+	cached awsCredentials
+}
+
+// get returns the credentials of the environment variables, of the container
+// credentials endpoint, if $AWS_CONTAINER_CREDENTIALS_RELATIVE_URI or
+// $AWS_CONTAINER_CREDENTIALS_FULL_URI is set, or else of the instance
+// metadata service, with IMDSv2.
+func (cp *awsCredentialProvider) get(ctx context.Context) (awsCredentials, error) {
+	if id, secret := os.Getenv(awsAccessKeyIDEnv), os.Getenv(awsSecretAccessKeyEnv); id != "" && secret != "" {
+		return awsCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv(awsSessionTokenEnv)}, nil
+	}
+
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.cached.AccessKeyID != "" && time.Now().Add(awsCredentialsExpiryWindow).Before(cp.cached.Expiration) {
+		return cp.cached, nil
+	}
+
+	var (
+		creds awsCredentials
+		err   error
+	)
+	if os.Getenv(awsContainerRelativeEnv) != "" || os.Getenv(awsContainerFullEnv) != "" {
+		creds, err = cp.container(ctx)
+	} else {
+		creds, err = cp.instance(ctx)
+	}
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed getting AWS credentials: %w", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return awsCredentials{}, errors.New("failed getting AWS credentials: credentials are incomplete")
+	}
+	cp.cached = creds
+
+	return creds, nil
+}
+
+// container returns the credentials of the ECS or EKS Pod Identity container
+// credentials endpoint.
+func (cp *awsCredentialProvider) container(ctx context.Context) (awsCredentials, error) {
+	endpoint := os.Getenv(awsContainerFullEnv)
+	if rel := os.Getenv(awsContainerRelativeEnv); rel != "" {
+		endpoint = awsContainerEndpoint + rel
+	} else if u, err := url.Parse(endpoint); err != nil || !awsContainerHost(u) {
+		return awsCredentials{}, fmt.Errorf("invalid $%s: '%s': must be an HTTPS URL, or an HTTP URL of a "+
+			"loopback or container credentials host", awsContainerFullEnv, endpoint)
+	}
+
+	header := http.Header{}
+	token := os.Getenv(awsContainerTokenEnv)
+	if path := os.Getenv(awsContainerTokenFileEnv); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return awsCredentials{}, fmt.Errorf("failed reading container authorization token: %w", err)
+		}
+		token = strings.TrimSpace(string(data))
+	}
+	if token != "" {
+		header.Set("Authorization", token)
+	}
+
+	data, err := cp.request(ctx, http.MethodGet, endpoint, header)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed fetching container credentials: %w", err)
+	}
+	var creds awsCredentials
+	if err = json.Unmarshal(data, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid container credentials: %w", err)
+	}
+
+	return creds, nil
+}
+
+// awsContainerHost reports whether the container credentials can be fetched
+// from the host of the URL, which is restricted as in the AWS SDKs, so that the
+// credentials aren't sent in plaintext elsewhere.
+func awsContainerHost(u *url.URL) bool {
+	switch {
+	case u.Scheme == "https":
+		return u.Host != ""
+	case u.Scheme != "http":
+		return false
+	}
+	host := u.Hostname()
+	return isLoopback(host) || host == "169.254.170.2" || host == "169.254.170.23" || host == "fd00:ec2::23"
+}
+
+// instance returns the credentials of the instance profile, from the instance
+// metadata service.
+func (cp *awsCredentialProvider) instance(ctx context.Context) (awsCredentials, error) {
+	if strings.EqualFold(os.Getenv(awsMetadataDisabledEnv), "true") {
+		return awsCredentials{}, errors.New("no credentials found, and the instance metadata service is disabled")
+	}
+	endpoint := strings.TrimSuffix(os.Getenv(awsMetadataEndpointEnv), "/")
+	if endpoint == "" {
+		endpoint = awsMetadataEndpoint
+	}
+
+	token, err := cp.request(ctx, http.MethodPut, endpoint+"/latest/api/token",
+		http.Header{"X-Aws-Ec2-Metadata-Token-Ttl-Seconds": {"21600"}})
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed fetching instance metadata token: %w", err)
+	}
+	header := http.Header{"X-Aws-Ec2-Metadata-Token": {string(token)}}
+	credsURL := endpoint + "/latest/meta-data/iam/security-credentials/"
+	roles, err := cp.request(ctx, http.MethodGet, credsURL, header)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed fetching instance profile: %w", err)
+	}
+	// The first line is the name of the role of the instance profile.
+	scanner := bufio.NewScanner(bytes.NewReader(roles))
+	if !scanner.Scan() || strings.TrimSpace(scanner.Text()) == "" {
+		return awsCredentials{}, errors.New("the instance has no instance profile")
+	}
+
+	data, err := cp.request(ctx, http.MethodGet, credsURL+url.PathEscape(strings.TrimSpace(scanner.Text())), header)
+	if err != nil {
+		return awsCredentials{}, fmt.Errorf("failed fetching instance credentials: %w", err)
+	}
+	var creds awsCredentials
+	if err = json.Unmarshal(data, &creds); err != nil {
+		return awsCredentials{}, fmt.Errorf("invalid instance credentials: %w", err)
+	}
+
+	return creds, nil
+}
+
+// request makes a credentials request, and returns the response body.
+func (cp *awsCredentialProvider) request(
+	ctx context.Context, method, target string, header http.Header,
+) ([]byte, error) {
+	const maxSize = 1 << 16
+
+	req, err := http.NewRequestWithContext(ctx, method, target, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating request: %w", err)
+	}
+	maps.Copy(req.Header, header)
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		return nil, err //nolint:wrapcheck // the error is wrapped by the caller
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading response: %w", err)
+	}
+	if len(body) > maxSize {
+		return nil, errors.New("response is too large")
+	}
+
+	return bytes.TrimSpace(body), nil
+}
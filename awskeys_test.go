@@ -0,0 +1,438 @@
+package caddypaseto
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// The get-vanilla and post-vanilla cases of the AWS Signature Version 4 test
+	// suite.
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	req := httptest.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	req.Header = http.Header{}
+	signAWSRequest(req, nil, creds, "us-east-1", "service", now)
+	assert.Equal(t, "20150830T123600Z", req.Header.Get("X-Amz-Date"))
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		req.Header.Get("Authorization"))
+
+	req = httptest.NewRequest(http.MethodPost, "https://example.amazonaws.com/", nil)
+	req.Header = http.Header{}
+	signAWSRequest(req, nil, creds, "us-east-1", "service", now)
+	assert.Equal(t, "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, "+
+		"SignedHeaders=host;x-amz-date, "+
+		"Signature=5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b",
+		req.Header.Get("Authorization"))
+
+	// Session tokens are signed.
+	creds.SessionToken = "session"
+	req = httptest.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	req.Header = http.Header{}
+	signAWSRequest(req, nil, creds, "us-east-1", "service", now)
+	assert.Equal(t, "session", req.Header.Get("X-Amz-Security-Token"))
+	assert.Contains(t, req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,")
+}
+
+// newFakeAWS returns a fake AWS JSON API of the service, which checks the
+// signatures of the requests with the credentials, and responds with the
+// status and output of handle.
+func newFakeAWS(
+	t *testing.T, service string, creds awsCredentials, handle func(target string, in map[string]any) (int, any),
+) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		date, err := time.Parse("20060102T150405Z", r.Header.Get("X-Amz-Date"))
+		require.NoError(t, err)
+
+		req := httptest.NewRequest(r.Method, "http://"+r.Host+r.URL.RequestURI(), nil)
+		req.Header = http.Header{"Content-Type": r.Header["Content-Type"], "X-Amz-Target": r.Header["X-Amz-Target"]}
+		signAWSRequest(req, body, creds, "eu-west-1", service, date)
+
+		status, out := http.StatusBadRequest, any(map[string]string{
+			"__type":  "com.amazonaws.common#InvalidSignatureException",
+			"message": "The request signature we calculated does not match the signature you provided.",
+		})
+		if req.Header.Get("Authorization") == r.Header.Get("Authorization") {
+			var in map[string]any
+			require.NoError(t, json.Unmarshal(body, &in))
+			status, out = handle(r.Header.Get("X-Amz-Target"), in)
+		}
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		w.WriteHeader(status)
+		require.NoError(t, json.NewEncoder(w).Encode(out))
+	}))
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+// setAWSCredentials sets the credentials of the AWS environment variables, and
+// unsets the other AWS credential sources.
+func setAWSCredentials(t *testing.T, creds awsCredentials) {
+	t.Helper()
+	t.Setenv(awsAccessKeyIDEnv, creds.AccessKeyID)
+	t.Setenv(awsSecretAccessKeyEnv, creds.SecretAccessKey)
+	t.Setenv(awsSessionTokenEnv, creds.SessionToken)
+	t.Setenv(awsContainerRelativeEnv, "")
+	t.Setenv(awsContainerFullEnv, "")
+	t.Setenv(awsMetadataDisabledEnv, "true")
+}
+
+func TestPasetoAuth_AuthenticateKeyAWS(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"}
+	setAWSCredentials(t, creds)
+
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+	var secret atomic.Pointer[string]
+	setSecret := func(doc string) { secret.Store(&doc) }
+	setSecret(oldKey.Public().ExportHex())
+	srv := newFakeAWS(t, "secretsmanager", creds, func(target string, in map[string]any) (int, any) {
+		assert.Equal(t, "secretsmanager.GetSecretValue", target)
+		assert.Equal(t, map[string]any{"SecretId": "paseto/key", "VersionStage": "AWSCURRENT"}, in)
+		return http.StatusOK, map[string]any{"Name": "paseto/key", "SecretString": *secret.Load()}
+	})
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		KeyAWS: &KeyAWS{
+			Region: "eu-west-1", SecretID: "paseto/key", VersionStage: "AWSCURRENT",
+			Endpoint: srv.URL, RefreshInterval: time.Millisecond,
+		},
+		FromQuery: []string{"token"},
+		logger:    slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	authenticate := func(key paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+	assert.True(t, authenticate(oldKey))
+	assert.False(t, authenticate(newKey))
+
+	// The rotated secret is picked up by a refresh.
+	setSecret(`{"keys": ["` + newKey.Public().ExportHex() + `"]}`)
+	assert.Eventually(t, func() bool { return authenticate(newKey) }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, authenticate(oldKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "reloaded key_aws keys"))
+
+	// Invalid keys are ignored, and the previous keys are kept.
+	setSecret("k4.public.invalid")
+	assert.Eventually(t, func() bool {
+		return logHandler.HasRecord(slog.LevelWarn, "invalid key_aws keys[0]: failed loading key data: "+
+			"failed reading key data: key length incorrect (5), expected 32")
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, authenticate(newKey))
+}
+
+func TestPasetoAuth_AuthenticateKeyAWSKMS(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+	setAWSCredentials(t, creds)
+
+	key := paseto.NewV4SymmetricKey()
+	ciphertext := base64.StdEncoding.EncodeToString([]byte("ciphertext"))
+	srv := newFakeAWS(t, "kms", creds, func(target string, in map[string]any) (int, any) {
+		assert.Equal(t, "TrentService.Decrypt", target)
+		if in["CiphertextBlob"] != ciphertext {
+			return http.StatusBadRequest, map[string]string{"__type": "InvalidCiphertextException"}
+		}
+		assert.Equal(t, "alias/paseto", in["KeyId"])
+		assert.Equal(t, map[string]any{"purpose": "paseto"}, in["EncryptionContext"])
+		return http.StatusOK, map[string]any{"Plaintext": []byte(key.ExportHex())}
+	})
+
+	newAuth := func(ciphertext string) *PasetoAuth {
+		return &PasetoAuth{
+			KeyAWS: &KeyAWS{
+				Region: "eu-west-1", Ciphertext: ciphertext, KMSKeyID: "alias/paseto",
+				EncryptionContext: map[string]string{"purpose": "paseto"}, Endpoint: srv.URL,
+			},
+			Purpose:   paseto.Local,
+			FromQuery: []string{"token"},
+			logger:    slog.New(testutil.NewTestLogHandler()),
+		}
+	}
+	auth := newAuth(ciphertext)
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Encrypt(key, nil), nil)
+	_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+
+	err = newAuth(base64.StdEncoding.EncodeToString([]byte("other"))).Validate()
+	require.ErrorContains(t, err, "failed fetching key_aws keys: failed calling TrentService.Decrypt: "+
+		"unexpected status 400: InvalidCiphertextException")
+}
+
+func TestAWSCredentialProvider(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	instanceCreds := awsCredentials{
+		AccessKeyID: "ASIAINSTANCE", SecretAccessKey: "instance-secret", SessionToken: "instance-token",
+		Expiration: expiration,
+	}
+	containerCreds := awsCredentials{
+		AccessKeyID: "ASIACONTAINER", SecretAccessKey: "container-secret", SessionToken: "container-token",
+		Expiration: expiration,
+	}
+	var requests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		token := r.Header.Get("X-Aws-Ec2-Metadata-Token")
+		switch {
+		case r.Method == http.MethodPut && r.URL.Path == "/latest/api/token":
+			assert.Equal(t, "21600", r.Header.Get("X-Aws-Ec2-Metadata-Token-Ttl-Seconds"))
+			_, _ = io.WriteString(w, "imds-token")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/" && token == "imds-token":
+			_, _ = io.WriteString(w, "paseto-role\n")
+		case r.URL.Path == "/latest/meta-data/iam/security-credentials/paseto-role" && token == "imds-token":
+			_ = json.NewEncoder(w).Encode(instanceCreds)
+		case r.URL.Path == "/creds" && r.Header.Get("Authorization") == "container-token":
+			_ = json.NewEncoder(w).Encode(containerCreds)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	t.Cleanup(srv.Close)
+
+	tokenPath := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenPath, []byte("container-token\n"), 0o600))
+
+	tests := []struct {
+		name     string
+		env      map[string]string
+		expCreds awsCredentials
+		expErr   string
+	}{
+		{
+			name: "ok/env",
+			env: map[string]string{
+				awsAccessKeyIDEnv: "AKIDEXAMPLE", awsSecretAccessKeyEnv: "secret", awsSessionTokenEnv: "session",
+				awsContainerFullEnv: srv.URL + "/creds",
+			},
+			expCreds: awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret", SessionToken: "session"},
+		},
+		{
+			name:     "ok/container_token",
+			env:      map[string]string{awsContainerFullEnv: srv.URL + "/creds", awsContainerTokenEnv: "container-token"},
+			expCreds: containerCreds,
+		},
+		{
+			name:     "ok/container_token_file",
+			env:      map[string]string{awsContainerFullEnv: srv.URL + "/creds", awsContainerTokenFileEnv: tokenPath},
+			expCreds: containerCreds,
+		},
+		{
+			name:     "ok/instance",
+			env:      map[string]string{awsMetadataEndpointEnv: srv.URL},
+			expCreds: instanceCreds,
+		},
+		{
+			name:   "err/container_unauthorized",
+			env:    map[string]string{awsContainerFullEnv: srv.URL + "/creds"},
+			expErr: "failed getting AWS credentials: failed fetching container credentials: unexpected status 401",
+		},
+		{
+			name: "err/container_host",
+			env:  map[string]string{awsContainerFullEnv: "http://creds.example.com/creds"},
+			expErr: "failed getting AWS credentials: invalid $AWS_CONTAINER_CREDENTIALS_FULL_URI: " +
+				"'http://creds.example.com/creds': must be an HTTPS URL, or an HTTP URL of a loopback or " +
+				"container credentials host",
+		},
+		{
+			name: "err/instance_disabled",
+			env:  map[string]string{awsMetadataDisabledEnv: "true"},
+			expErr: "failed getting AWS credentials: no credentials found, and the instance metadata service " +
+				"is disabled",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, name := range []string{
+				awsAccessKeyIDEnv, awsSecretAccessKeyEnv, awsSessionTokenEnv, awsContainerRelativeEnv,
+				awsContainerFullEnv, awsContainerTokenEnv, awsContainerTokenFileEnv, awsMetadataEndpointEnv,
+				awsMetadataDisabledEnv,
+			} {
+				t.Setenv(name, tt.env[name])
+			}
+
+			cp := &awsCredentialProvider{client: &http.Client{}}
+			creds, err := cp.get(t.Context())
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expCreds.AccessKeyID, creds.AccessKeyID)
+			assert.Equal(t, tt.expCreds.SecretAccessKey, creds.SecretAccessKey)
+			assert.Equal(t, tt.expCreds.SessionToken, creds.SessionToken)
+			assert.True(t, tt.expCreds.Expiration.Equal(creds.Expiration))
+
+			// Temporary credentials are cached until shortly before they
+			// expire.
+			count := requests.Load()
+			_, err = cp.get(t.Context())
+			require.NoError(t, err)
+			assert.Equal(t, count, requests.Load())
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateKeyAWS(t *testing.T) {
+	creds := awsCredentials{AccessKeyID: "AKIDEXAMPLE", SecretAccessKey: "secret"}
+	setAWSCredentials(t, creds)
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	srv := newFakeAWS(t, "secretsmanager", creds, func(_ string, in map[string]any) (int, any) {
+		if in["SecretId"] != "paseto/key" {
+			return http.StatusBadRequest, map[string]string{
+				"__type":  "ResourceNotFoundException",
+				"Message": "Secrets Manager can't find the specified secret.",
+			}
+		}
+		return http.StatusOK, map[string]any{"SecretString": key}
+	})
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		env    map[string]string
+		expErr string
+	}{
+		{
+			name:   "ok/region_env",
+			config: PasetoAuth{KeyAWS: &KeyAWS{SecretID: "paseto/key", Endpoint: srv.URL}},
+			env:    map[string]string{awsRegionEnv: "eu-west-1"},
+		},
+		{
+			name: "ok/failover",
+			config: PasetoAuth{
+				KeyAWS:      &KeyAWS{Region: "eu-west-1", SecretID: "paseto/missing", Endpoint: srv.URL},
+				Keys:        []string{key},
+				KeyFailover: []string{keySourceAWS, keySourceKeys},
+			},
+		},
+		{
+			name:   "err/missing_secret",
+			config: PasetoAuth{KeyAWS: &KeyAWS{Region: "eu-west-1", SecretID: "paseto/missing", Endpoint: srv.URL}},
+			expErr: "failed fetching key_aws keys: failed calling secretsmanager.GetSecretValue: unexpected status 400: " +
+				"ResourceNotFoundException: Secrets Manager can't find the specified secret.",
+		},
+		{
+			name:   "err/no_region",
+			config: PasetoAuth{KeyAWS: &KeyAWS{SecretID: "paseto/key"}},
+			expErr: "invalid key_aws: no region, set region or $AWS_REGION",
+		},
+		{
+			name:   "err/invalid_region",
+			config: PasetoAuth{KeyAWS: &KeyAWS{Region: "europe", SecretID: "paseto/key"}},
+			expErr: "invalid key_aws region: 'europe'",
+		},
+		{
+			name:   "err/no_secret",
+			config: PasetoAuth{KeyAWS: &KeyAWS{Region: "eu-west-1"}},
+			expErr: "invalid key_aws: expected either secret_id or ciphertext",
+		},
+		{
+			name: "err/secret_and_ciphertext",
+			config: PasetoAuth{KeyAWS: &KeyAWS{
+				Region: "eu-west-1", SecretID: "paseto/key", Ciphertext: "Y2lwaGVydGV4dA==",
+			}},
+			expErr: "invalid key_aws: expected either secret_id or ciphertext",
+		},
+		{
+			name: "err/version_stage_and_id",
+			config: PasetoAuth{KeyAWS: &KeyAWS{
+				Region: "eu-west-1", SecretID: "paseto/key", VersionStage: "AWSCURRENT", VersionID: "v1",
+			}},
+			expErr: "invalid key_aws: version_stage can't be used with version_id",
+		},
+		{
+			name: "err/version_without_secret",
+			config: PasetoAuth{KeyAWS: &KeyAWS{
+				Region: "eu-west-1", Ciphertext: "Y2lwaGVydGV4dA==", VersionID: "v1",
+			}},
+			expErr: "invalid key_aws: version_stage and version_id require secret_id",
+		},
+		{
+			name: "err/kms_key_without_ciphertext",
+			config: PasetoAuth{KeyAWS: &KeyAWS{
+				Region: "eu-west-1", SecretID: "paseto/key", KMSKeyID: "alias/paseto",
+			}},
+			expErr: "invalid key_aws: kms_key_id and encryption_context require ciphertext",
+		},
+		{
+			name:   "err/invalid_ciphertext",
+			config: PasetoAuth{KeyAWS: &KeyAWS{Region: "eu-west-1", Ciphertext: "not base64"}},
+			expErr: "invalid key_aws ciphertext: illegal base64 data at input byte 3",
+		},
+		{
+			name: "err/negative_refresh_interval",
+			config: PasetoAuth{KeyAWS: &KeyAWS{
+				Region: "eu-west-1", SecretID: "paseto/key", RefreshInterval: -time.Second,
+			}},
+			expErr: "invalid key_aws refresh_interval: '-1s'",
+		},
+		{
+			name:   "err/http_endpoint",
+			config: PasetoAuth{KeyAWS: &KeyAWS{Region: "eu-west-1", SecretID: "paseto/key", Endpoint: "http://aws.example"}},
+			expErr: "invalid key_aws endpoint 'http://aws.example': must be an HTTPS URL, or an HTTP URL of a loopback host",
+		},
+		{
+			name: "err/issuer",
+			config: PasetoAuth{
+				Issuer: "idp",
+				KeyAWS: &KeyAWS{Region: "eu-west-1", SecretID: "paseto/key", Endpoint: srv.URL},
+			},
+			expErr: "issuer can't be used with key options, version or purpose",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(awsRegionEnv, tt.env[awsRegionEnv])
+			t.Setenv(awsDefaultRegionEnv, "")
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
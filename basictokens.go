@@ -0,0 +1,23 @@
+package caddypaseto
+
+import (
+	"net/http"
+	"slices"
+)
+
+// basicAuthAnyUser is the FromBasicAuth user name that matches any user name.
+const basicAuthAnyUser = "*"
+
+// basicAuthTokens returns the password of the HTTP Basic Authorization header
+// of the request, if its user name is one of names.
+func basicAuthTokens(r *http.Request, names []string) []string {
+	tokens := make([]string, 0)
+	user, password, ok := r.BasicAuth()
+	if !ok || password == "" {
+		return tokens
+	}
+	if slices.Contains(names, basicAuthAnyUser) || slices.Contains(names, user) {
+		tokens = append(tokens, password)
+	}
+	return tokens
+}
@@ -0,0 +1,58 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateFromBasicAuth(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(key, nil)
+
+	tests := []struct {
+		name     string
+		names    []string
+		user     string
+		password string
+		expAuth  bool
+	}{
+		{name: "ok/user", names: []string{"token"}, user: "token", password: tokenStr, expAuth: true},
+		{name: "ok/any_user", names: []string{"*"}, user: "ci-bot", password: tokenStr, expAuth: true},
+		{name: "err/other_user", names: []string{"token"}, user: "ci-bot", password: tokenStr},
+		{name: "err/token_as_user", names: []string{"*"}, user: tokenStr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:           key.Public().ExportHex(),
+				FromBasicAuth: tt.names,
+				logger:        slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.SetBasicAuth(tt.user, tt.password)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package caddypaseto
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+)
+
+// SessionBinding binds tokens to a session cookie. The client receives a
+// random, opaque session cookie, which should be HttpOnly, along with a token
+// that carries the digest of the cookie value in a claim. Requests must send
+// both the token and the cookie, so that a token stolen from the page, e.g.
+// via XSS, can't be used without the cookie, which scripts can't read.
+type SessionBinding struct {
+	// Cookie is the name of the session cookie. It can't be a token source.
+	Cookie string `json:"cookie"`
+
+	// Claim is the name of the token claim that contains the base64url encoded
+	// SHA-256 digest of the session cookie value, without padding. The default
+	// is "session_hash".
+	Claim string `json:"claim,omitempty"`
+}
+
+func (sb *SessionBinding) provision(fromCookies []string) error {
+	if sb.Cookie == "" {
+		return errors.New("invalid session_binding: cookie name is empty")
+	}
+	if slices.Contains(fromCookies, sb.Cookie) {
+		return fmt.Errorf("invalid session_binding: cookie '%s' can't be a token source", sb.Cookie)
+	}
+	if sb.Claim == "" {
+		sb.Claim = "session_hash"
+	}
+
+	return nil
+}
+
+// verify checks that the request has the session cookie the token is bound to.
+func (sb *SessionBinding) verify(r *http.Request, claims map[string]any) error {
+	want, _ := claims[sb.Claim].(string)
+	if want == "" {
+		return fmt.Errorf("token is not bound to a session: missing %s claim", sb.Claim)
+	}
+	cookie, err := r.Cookie(sb.Cookie)
+	if err != nil || cookie.Value == "" {
+		return errors.New("session cookie is missing")
+	}
+
+	digest := sha256.Sum256([]byte(cookie.Value))
+	got := base64.RawURLEncoding.EncodeToString(digest[:])
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return errors.New("session cookie doesn't match the token")
+	}
+
+	return nil
+}
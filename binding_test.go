@@ -0,0 +1,122 @@
+package caddypaseto
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateSessionBinding(t *testing.T) {
+	privateKey := paseto.NewV4AsymmetricSecretKey()
+
+	const sessionID = "3q2-7wE5n0ZlTjXc9hUa4g"
+	digest := sha256.Sum256([]byte(sessionID))
+
+	newToken := func(sessionHash string) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		if sessionHash != "" {
+			token.SetString("session_hash", sessionHash)
+		}
+		return token.V4Sign(privateKey, nil)
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		cookie  string
+		expAuth bool
+		expLog  string
+	}{
+		{
+			name:    "ok",
+			token:   newToken(base64.RawURLEncoding.EncodeToString(digest[:])),
+			cookie:  sessionID,
+			expAuth: true,
+		},
+		{
+			name:   "err/missing_cookie",
+			token:  newToken(base64.RawURLEncoding.EncodeToString(digest[:])),
+			expLog: "session cookie is missing",
+		},
+		{
+			name:   "err/other_cookie",
+			token:  newToken(base64.RawURLEncoding.EncodeToString(digest[:])),
+			cookie: "stolen-elsewhere",
+			expLog: "session cookie doesn't match the token",
+		},
+		{
+			name:   "err/unbound_token",
+			token:  newToken(""),
+			cookie: sessionID,
+			expLog: "token is not bound to a session: missing session_hash claim",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler := testutil.NewTestLogHandler()
+			auth := &PasetoAuth{
+				Key:            privateKey.Public().ExportHex(),
+				SessionBinding: &SessionBinding{Cookie: "sid"},
+				logger:         slog.New(logHandler),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "sid", Value: tt.cookie})
+			}
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+			if tt.expLog != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expLog))
+			}
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateSessionBinding(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/empty_cookie",
+			config: PasetoAuth{Key: key, SessionBinding: &SessionBinding{}},
+			expErr: "invalid session_binding: cookie name is empty",
+		},
+		{
+			name:   "err/token_cookie",
+			config: PasetoAuth{Key: key, FromCookies: []string{"sid"}, SessionBinding: &SessionBinding{Cookie: "sid"}},
+			expErr: "invalid session_binding: cookie 'sid' can't be a token source",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorContains(t, tt.config.Validate(), tt.expErr)
+		})
+	}
+}
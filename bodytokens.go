@@ -0,0 +1,50 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// defaultFromBodyMaxSize is the default maximum size of JSON bodies that are
+// read for tokens.
+const defaultFromBodyMaxSize = 1 << 20
+
+// bodyTokens returns the string values at the paths of the JSON request body,
+// in the order of the paths. Nested values can be queried with dot notation,
+// e.g. "auth.token". Only the bodies of POST, PUT and PATCH requests with the
+// application/json content type, or a "+json" suffixed one, are read, and at
+// most FromBodyMaxSize bytes of them. The body is restored afterwards, so
+// that the next handlers still see all of it.
+func (p *PasetoAuth) bodyTokens(r *http.Request, paths []string) []string {
+	tokens := make([]string, 0)
+	if len(paths) == 0 || !hasTokenBody(r) {
+		return tokens
+	}
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json")) {
+		return tokens
+	}
+
+	body, err := readRestoredBody(r, p.FromBodyMaxSize)
+	if err != nil {
+		p.logger.Warn("ignoring JSON body token fields", "error", err.Error(),
+			"from_body_max_size", p.FromBodyMaxSize)
+		return tokens
+	}
+
+	var doc map[string]any
+	if err = json.Unmarshal(body, &doc); err != nil {
+		p.logger.Warn("ignoring JSON body token fields", "error", "invalid JSON object: "+err.Error())
+		return tokens
+	}
+	for _, path := range paths {
+		val, _ := getClaim(doc, path)
+		if token, ok := val.(string); ok && token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens
+}
@@ -0,0 +1,113 @@
+package caddypaseto
+
+import (
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateFromBody(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(key, nil)
+
+	auth := &PasetoAuth{
+		Key:             key.Public().ExportHex(),
+		FromBody:        []string{"auth.token", "access_token"},
+		FromBodyMaxSize: 1 << 10,
+		logger:          slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		expAuth     bool
+	}{
+		{
+			name:        "ok/nested",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"auth": {"token": "` + tokenStr + `"}, "query": "hello"}`,
+			expAuth:     true,
+		},
+		{
+			name:        "ok/top_level",
+			method:      http.MethodPut,
+			contentType: "application/merge-patch+json; charset=utf-8",
+			body:        `{"access_token": "` + tokenStr + `"}`,
+			expAuth:     true,
+		},
+		{
+			name:        "err/not_a_string",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"auth": {"token": ["` + tokenStr + `"]}}`,
+		},
+		{
+			name:        "err/not_an_object",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `["` + tokenStr + `"]`,
+		},
+		{
+			name:        "err/form",
+			method:      http.MethodPost,
+			contentType: "application/x-www-form-urlencoded",
+			body:        `{"access_token": "` + tokenStr + `"}`,
+		},
+		{
+			name:        "err/get",
+			method:      http.MethodGet,
+			contentType: "application/json",
+			body:        `{"access_token": "` + tokenStr + `"}`,
+		},
+		{
+			name:        "err/too_large",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        `{"access_token": "` + tokenStr + `", "padding": "` + strings.Repeat("a", 1<<10) + `"}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+
+			// The next handlers still see the whole body.
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+
+	a := &PasetoAuth{
+		Key:             key.Public().ExportHex(),
+		FromBodyMaxSize: 1 << 10,
+		logger:          slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, a.Validate(), "from_body_max_size requires from_body")
+}
@@ -0,0 +1,140 @@
+package caddypaseto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Remote backend names, used in logs and metric labels.
+const (
+	backendKeyURL         = "key_url"
+	backendSessionStorage = "session_storage"
+)
+
+// errBreakerOpen is returned instead of calling a backend whose circuit
+// breaker is open.
+var errBreakerOpen = errors.New("circuit breaker is open")
+
+// CircuitBreaker configures the circuit breakers of remote backends, i.e. the
+// key URL and the session storage. After Threshold consecutive failures, the
+// breaker of a backend opens, and calls to it fail immediately, instead of
+// waiting for a timeout on every request. Once Cooldown has elapsed, a single
+// trial call is allowed, which closes the breaker if it succeeds.
+type CircuitBreaker struct {
+	// Threshold is the amount of consecutive failures after which the breaker
+	// opens. The default is 5.
+	Threshold int `json:"threshold,omitempty"`
+
+	// Cooldown is the duration for which the breaker stays open, before a
+	// trial call is allowed. The default is 30s.
+	Cooldown time.Duration `json:"cooldown,omitempty"`
+
+	// FailOpen allows requests whose session can't be tracked, because the
+	// session storage failed or its breaker is open, as if session tracking
+	// was disabled. By default, such requests fail with an error. Failures of
+	// the key URL are handled according to the key_url_outage option instead.
+	FailOpen bool `json:"fail_open,omitempty"`
+}
+
+func (cb *CircuitBreaker) provision() error {
+	if cb.Threshold < 0 {
+		return fmt.Errorf("invalid circuit_breaker: negative threshold: %d", cb.Threshold)
+	} else if cb.Threshold == 0 {
+		cb.Threshold = 5
+	}
+	if cb.Cooldown < 0 {
+		return fmt.Errorf("invalid circuit_breaker: negative cooldown: '%s'", cb.Cooldown)
+	} else if cb.Cooldown == 0 {
+		cb.Cooldown = 30 * time.Second
+	}
+
+	return nil
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// breaker is the circuit breaker of a single backend. A nil breaker allows all
+// calls.
+type breaker struct {
+	backend   string
+	threshold int
+	cooldown  time.Duration
+	metrics   *metrics
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newBreaker(backend string, cfg *CircuitBreaker, m *metrics) *breaker {
+	return &breaker{backend: backend, threshold: cfg.Threshold, cooldown: cfg.Cooldown, metrics: m}
+}
+
+// allow reports whether the backend should be called. If the breaker is open,
+// and the cooldown has elapsed, it allows a single trial call, whose result
+// must be recorded.
+func (b *breaker) allow(now time.Time) bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerClosed:
+		return true
+	case breakerOpen:
+		if now.Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = breakerHalfOpen
+		return true
+	case breakerHalfOpen:
+		// A trial call is in progress.
+		return false
+	}
+
+	return false
+}
+
+// record records the result of a backend call. Canceled calls aren't counted
+// as failures, since they're usually caused by the client, not the backend.
+func (b *breaker) record(err error, now time.Time) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case err == nil:
+		if b.state != breakerClosed {
+			b.metrics.setBreakerOpen(b.backend, false)
+		}
+		b.state, b.failures = breakerClosed, 0
+	case errors.Is(err, context.Canceled):
+		if b.state == breakerHalfOpen {
+			b.state = breakerOpen
+		}
+	case b.state == breakerHalfOpen:
+		b.state, b.openedAt = breakerOpen, now
+		b.metrics.incBreakerTrips(b.backend)
+	default:
+		b.failures++
+		if b.state == breakerClosed && b.failures >= b.threshold {
+			b.state, b.openedAt = breakerOpen, now
+			b.metrics.setBreakerOpen(b.backend, true)
+			b.metrics.incBreakerTrips(b.backend)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package caddypaseto
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestBreaker(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m, err := newMetrics(reg)
+	require.NoError(t, err)
+
+	cfg := &CircuitBreaker{Threshold: 2, Cooldown: time.Minute}
+	require.NoError(t, cfg.provision())
+	b := newBreaker(backendSessionStorage, cfg, m)
+
+	errBackend := errors.New("backend failed")
+	now := time.Now()
+
+	// Canceled calls and failures below the threshold keep the breaker closed.
+	b.record(errBackend, now)
+	b.record(context.Canceled, now)
+	assert.True(t, b.allow(now))
+	b.record(errBackend, now)
+	assert.False(t, b.allow(now))
+	assert.Equal(t, 1.0, gatherValue(t, reg, "caddy_paseto_circuit_breakers_open"))
+	assert.Equal(t, 1.0, gatherValue(t, reg, "caddy_paseto_circuit_breaker_trips_total"))
+
+	// After the cooldown, only a single trial call is allowed.
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(now))
+	assert.False(t, b.allow(now))
+
+	// A failed trial call opens the breaker again.
+	b.record(errBackend, now)
+	assert.False(t, b.allow(now.Add(time.Second)))
+	assert.Equal(t, 2.0, gatherValue(t, reg, "caddy_paseto_circuit_breaker_trips_total"))
+
+	// A successful trial call closes it.
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(now))
+	b.record(nil, now)
+	assert.True(t, b.allow(now))
+	assert.True(t, b.allow(now))
+	assert.Equal(t, 0.0, gatherValue(t, reg, "caddy_paseto_circuit_breakers_open"))
+
+	// A nil breaker allows all calls.
+	var nilBreaker *breaker
+	assert.True(t, nilBreaker.allow(now))
+	nilBreaker.record(errBackend, now)
+}
+
+// failingSessionStore is a session store whose operations always fail, and
+// which counts the calls it receives.
+type failingSessionStore struct {
+	sessionStore
+	calls int
+}
+
+func (s *failingSessionStore) Seen(context.Context, Session, time.Time, time.Duration) (Session, error) {
+	s.calls++
+	return Session{}, errors.New("storage is unavailable")
+}
+
+func TestPasetoAuth_AuthenticateCircuitBreaker(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetJti("session123")
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	tests := []struct {
+		name     string
+		failOpen bool
+	}{
+		{name: "fail_closed"},
+		{name: "fail_open", failOpen: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := &failingSessionStore{}
+			auth := &PasetoAuth{
+				Key:            v4PrivateKey.Public().ExportHex(),
+				FromQuery:      []string{"token"},
+				TrackSessions:  true,
+				CircuitBreaker: &CircuitBreaker{Threshold: 2, FailOpen: tt.failOpen},
+				sessions:       store,
+				logger:         slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			for i := range 4 {
+				req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+				_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+				if tt.failOpen {
+					require.NoError(t, err)
+					assert.True(t, authenticated)
+					continue
+				}
+				require.Error(t, err)
+				assert.False(t, authenticated)
+				if i >= 2 {
+					require.ErrorIs(t, err, errBreakerOpen)
+				}
+			}
+
+			// The storage isn't called once the breaker is open.
+			assert.Equal(t, 2, store.calls)
+		})
+	}
+}
+
+func gatherValue(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			require.Len(t, family.GetMetric(), 1)
+			metric := family.GetMetric()[0]
+			if metric.GetCounter() != nil {
+				return metric.GetCounter().GetValue()
+			}
+			return metric.GetGauge().GetValue()
+		}
+	}
+	require.Failf(t, "metric not found", "metric %s not found", name)
+
+	return 0
+}
@@ -2,6 +2,9 @@ package caddypaseto
 
 import (
 	"fmt"
+	"math"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -11,27 +14,178 @@ import (
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
 	httpcaddyfile.RegisterHandlerDirective("pasetoauth", parseCaddyfile)
+	httpcaddyfile.RegisterHandlerDirective("paseto_sign", parseSignCaddyfile)
+	httpcaddyfile.RegisterHandlerDirective("paseto_claims", parseClaimsCaddyfile)
+	httpcaddyfile.RegisterHandlerDirective("paseto_well_known", parseWellKnownCaddyfile)
+	httpcaddyfile.RegisterHandlerDirective("paseto_keys", parsePasetoKeysCaddyfile)
+	httpcaddyfile.RegisterHandlerDirective("paseto_logout", parseLogoutCaddyfile)
 }
 
-// parseCaddyfile sets up the handler from Caddyfile. Syntax:
+// parseCaddyfile sets up the handler from Caddyfile. List options can be
+// repeated, which appends to the list, and their values can be separated by
+// commas or whitespace. Syntax:
 //
 //	pasetoauth [<matcher>] {
+//		issuer <name>
+//		issuer_key <issuer name> {
+//			key <key>
+//			version <protocol version>
+//			purpose <protocol purpose>
+//		}
+//		version_key <protocol version> {
+//			key <key>
+//			purpose <protocol purpose>
+//		}
+//		purpose_key <protocol purpose> {
+//			key <key>
+//			version <protocol version>
+//		}
 //		key <key>
+//		keys <key>...
+//		key_password <password>
+//		key_passphrase <passphrase> <salt> {
+//			time <passes>
+//			memory <KiB>
+//			threads <count>
+//		}
+//		key_master env|file <name or path>
+//		key_file <path> [<interval>]
+//		key_credential <name> [<interval>]
+//		key_file_check mtime|content
+//		key_file_sops {
+//			extract <path>
+//			command <path>
+//			timeout <duration>
+//		}
+//		key_url <url> [<interval>]
+//		key_url_timeout <duration>
+//		key_url_outage keep|reject
+//		key_url_pins <key ID or key>...
+//		key_url_signature <root key> [<signature url>]
+//		key_rotation [<name>] {
+//			interval <duration>
+//			overlap <duration>
+//			check_interval <duration>
+//		}
+//		key_storage [<name>] [<check interval>]
+//		admin_keys
+//		key_failover <source>...
+//		key_not_after <key ID or key> <time>
+//		stale_keys warn|reject
+//		require_kid
 //		version <protocol version>
 //		purpose <protocol purpose>
 //		time_skew_tolerance <duration>
+//		max_token_age <duration>
+//		issuer_policy <issuer> {
+//			time_skew_tolerance <duration>
+//			max_token_age <duration>
+//		}
 //		from_query <query string name>...
 //		from_header <header name>...
 //		from_cookies <cookie name>...
-//		user_claims <claim name>...
+//		from_form <field name>...
+//		from_form_max_size <size>
+//		from_body <JSON path>...
+//		from_body_max_size <size>
+//		from_path <path pattern>...
+//		strip_path_token
+//		strip_token
+//		from_websocket_protocol <subprotocol>...
+//		from_basic_auth <user name>...
+//		from_forwarded_authorization [<proxy ranges>...]
+//		token_sources <query|header|cookie|form|body|path>...
+//		token_extraction all|first
+//		max_candidates <count>
+//		max_token_length <size>
+//		disable_implicit_authorization
+//		strict_bearer
+//		authorization_schemes <scheme>...
+//		require_authorization_scheme
+//		source_networks <query|header|cookie|form|body|path> <name> <ranges...>
+//		user_claims <claim name[:transform]>...
 //		meta_claims <claim name or transform rule>...
+//		route_claim <claim name> [required]
+//		claim_mapper <module name> [<args>...] {
+//			<module options>
+//		}
+//		cache_key_claims <claim name>...
+//		log_claim_changes <claim name>...
+//		redact_claims <claim name>...
+//		redact_mode hash|mask
 //		allow_audiences <audience name>...
+//		audience_from_host
+//		audience_match <any|all>
 //		allow_issuers <issuer name>...
 //		allow_users <user name>...
+//		deny_users <user name>...
+//		deny_audiences <audience name>...
+//		deny_issuers <issuer name>...
+//		token_type <type> [<claim name>]
+//		claim_values <claim name> <value>...
+//		forbid_claims <claim name>...
+//		require_claim <claim name> <value>...
+//		allow_roles <role>...
+//		deny_roles <role>...
+//		roles_claim <claim name>
+//		require_scopes <method>[,<method>...]|* <scope>...
+//		path_requirements {
+//			<path> [=>] scope <scope>...
+//			<path> [=>] claim <claim name> <value>...
+//		}
+//		deny_fingerprints <fingerprint>...
+//		list_file allow_users|allow_audiences|allow_issuers|deny_users|deny_audiences|deny_issuers|deny_fingerprints <path>
+//		list_files_interval <duration>
+//		track_sessions
+//		idle_timeout <duration>
+//		session_storage [<timeout>]
+//		circuit_breaker {
+//			threshold <count>
+//			cooldown <duration>
+//			fail_open
+//		}
+//		rate_limit <claim name> {
+//			window <duration>
+//			default <limit>
+//			tier <tier name> <limit>
+//		}
+//		verify_pool {
+//			workers <count>
+//			queue_depth <count>
+//		}
+//		verify_budget {
+//			max_time <duration>
+//			max_operations <count>
+//		}
+//		replay_verifications unsafe {
+//			max_tokens <count>
+//		}
+//		session_binding <cookie name> [<claim name>]
+//		signed_url [path|method|query...]
+//		http_signatures {
+//			key_claim <claim name>
+//			label <signature label>
+//			components <component>...
+//			max_age <duration>
+//			max_body_size <size>
+//		}
+//		preflight [<origin>...]
+//		well_known [<path>]
+//		publish_keys [<path>]
+//		cors_origins <origin>...
+//		enforce on|off
+//		maintenance [<enabled>] {
+//			bypass_claim <claim name> [<claim value>]
+//			status <status code>
+//			body <response body>
+//			content_type <content type>
+//		}
+//		challenge_pages <directory>
 //	}
 //
 //nolint:funlen,gocognit // the length and complexity are acceptable
@@ -43,34 +197,279 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 			opt := h.Val()
 			switch opt {
 			case "allow_audiences":
-				p.AllowAudiences = h.RemainingArgs()
+				p.AllowAudiences = append(p.AllowAudiences, listArgs(h)...)
+
+			case "audience_from_host":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.AudienceFromHost = true
+
+			case "audience_match":
+				if !h.AllArgs(&p.AudienceMatch) {
+					return nil, h.Errf("invalid audience_match: expected a single value")
+				}
 
 			case "allow_issuers":
-				p.AllowIssuers = h.RemainingArgs()
+				p.AllowIssuers = append(p.AllowIssuers, listArgs(h)...)
 
 			case "allow_users":
-				p.AllowUsers = h.RemainingArgs()
+				p.AllowUsers = append(p.AllowUsers, listArgs(h)...)
+
+			case "deny_fingerprints":
+				p.DenyFingerprints = append(p.DenyFingerprints, listArgs(h)...)
+
+			case "deny_users":
+				p.DenyUsers = append(p.DenyUsers, listArgs(h)...)
+
+			case "deny_audiences":
+				p.DenyAudiences = append(p.DenyAudiences, listArgs(h)...)
+
+			case "deny_issuers":
+				p.DenyIssuers = append(p.DenyIssuers, listArgs(h)...)
+
+			case "list_file":
+				var list, path string
+				if !h.AllArgs(&list, &path) {
+					return nil, h.Errf("invalid list_file: expected a list name and a path")
+				}
+				if p.ListFiles == nil {
+					p.ListFiles = make(map[string]string)
+				}
+				p.ListFiles[list] = path
+
+			case "list_files_interval":
+				var interval string
+				if !h.AllArgs(&interval) {
+					return nil, h.Errf("invalid list_files_interval: %q", interval)
+				}
+				var err error
+				if p.ListFilesInterval, err = time.ParseDuration(interval); err != nil {
+					return nil, h.Errf("invalid list_files_interval: %q", interval)
+				}
+
+			case "issuer":
+				if !h.AllArgs(&p.Issuer) {
+					return nil, h.Errf("invalid issuer: expected a single name")
+				}
+
+			case "issuer_key":
+				if !h.NextArg() {
+					return nil, h.Errf("invalid issuer_key: expected an issuer name")
+				}
+				iss := h.Val()
+				if _, ok := p.IssuerKeys[iss]; ok {
+					return nil, h.Errf("invalid issuer_key: duplicate issuer: %s", iss)
+				}
+				cfg, err := parseIssuer(h)
+				if err != nil {
+					return nil, err
+				}
+				if p.IssuerKeys == nil {
+					p.IssuerKeys = make(map[string]*Issuer)
+				}
+				p.IssuerKeys[iss] = cfg
+
+			case "version_key":
+				if !h.NextArg() {
+					return nil, h.Errf("invalid version_key: expected a protocol version")
+				}
+				ver := h.Val()
+				if !strings.HasPrefix(ver, "v") {
+					ver = fmt.Sprintf("v%s", ver)
+				}
+				if _, ok := p.VersionKeys[paseto.Version(ver)]; ok {
+					return nil, h.Errf("invalid version_key: duplicate version: %s", ver)
+				}
+				cfg, err := parseIssuer(h)
+				if err != nil {
+					return nil, err
+				}
+				if p.VersionKeys == nil {
+					p.VersionKeys = make(map[paseto.Version]*Issuer)
+				}
+				p.VersionKeys[paseto.Version(ver)] = cfg
+
+			case "purpose_key":
+				if !h.NextArg() {
+					return nil, h.Errf("invalid purpose_key: expected a protocol purpose")
+				}
+				purpose := paseto.Purpose(h.Val())
+				if _, ok := p.PurposeKeys[purpose]; ok {
+					return nil, h.Errf("invalid purpose_key: duplicate purpose: %s", purpose)
+				}
+				cfg, err := parseIssuer(h)
+				if err != nil {
+					return nil, err
+				}
+				if p.PurposeKeys == nil {
+					p.PurposeKeys = make(map[paseto.Purpose]*Issuer)
+				}
+				p.PurposeKeys[purpose] = cfg
 
 			case "from_query":
-				p.FromQuery = h.RemainingArgs()
+				p.FromQuery = append(p.FromQuery, listArgs(h)...)
 
 			case "from_header":
-				p.FromHeader = h.RemainingArgs()
+				p.FromHeader = append(p.FromHeader, listArgs(h)...)
 
 			case "from_cookies":
-				p.FromCookies = h.RemainingArgs()
+				p.FromCookies = append(p.FromCookies, listArgs(h)...)
 
-			case "key":
-				if !h.AllArgs(&p.Key) {
-					return nil, h.Errf("key is empty")
+			case "from_form":
+				p.FromForm = append(p.FromForm, listArgs(h)...)
+
+			case "from_form_max_size":
+				var err error
+				if p.FromFormMaxSize, err = parseMaxSize(h, opt); err != nil {
+					return nil, err
 				}
 
-			case "purpose":
-				var purp string
-				if !h.AllArgs(&purp) {
-					return nil, h.Errf("invalid purpose: %q", purp)
+			case "from_body":
+				p.FromBody = append(p.FromBody, listArgs(h)...)
+
+			case "from_path":
+				p.FromPath = append(p.FromPath, listArgs(h)...)
+
+			case "strip_path_token":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.StripPathToken = true
+
+			case "strip_token":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.StripToken = true
+
+			case "from_websocket_protocol":
+				p.FromWebSocketProtocol = append(p.FromWebSocketProtocol, listArgs(h)...)
+
+			case "from_basic_auth":
+				p.FromBasicAuth = append(p.FromBasicAuth, listArgs(h)...)
+
+			case "from_forwarded_authorization":
+				p.FromForwardedAuthorization = true
+				p.ForwardedAuthorizationProxies = append(p.ForwardedAuthorizationProxies, listArgs(h)...)
+
+			case "token_sources":
+				p.TokenSources = append(p.TokenSources, listArgs(h)...)
+
+			case "token_extraction":
+				if !h.AllArgs(&p.TokenExtraction) {
+					return nil, h.Errf("invalid token_extraction: expected all or first")
+				}
+
+			case "max_candidates":
+				var count string
+				if !h.AllArgs(&count) {
+					return nil, h.Errf("invalid max_candidates: %q", count)
+				}
+				var err error
+				if p.MaxCandidates, err = strconv.Atoi(count); err != nil {
+					return nil, h.Errf("invalid max_candidates: %q", count)
+				}
+
+			case "max_token_length":
+				var err error
+				if p.MaxTokenLength, err = parseMaxSize(h, opt); err != nil {
+					return nil, err
+				}
+
+			case "disable_implicit_authorization":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.DisableImplicitAuthorization = true
+
+			case "from_body_max_size":
+				var err error
+				if p.FromBodyMaxSize, err = parseMaxSize(h, opt); err != nil {
+					return nil, err
+				}
+
+			case "strict_bearer":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.StrictBearer = true
+
+			case "authorization_schemes":
+				p.AuthorizationSchemes = append(p.AuthorizationSchemes, listArgs(h)...)
+
+			case "require_authorization_scheme":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.RequireAuthorizationScheme = true
+
+			case "require_kid":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.RequireKID = true
+
+			case "circuit_breaker":
+				cb, err := parseCircuitBreaker(h)
+				if err != nil {
+					return nil, err
+				}
+				p.CircuitBreaker = cb
+
+			case "claim_mapper":
+				raw, err := parseClaimMapper(h)
+				if err != nil {
+					return nil, err
+				}
+				p.ClaimMapperRaw = raw
+
+			case "rate_limit":
+				rl, err := parseRateLimit(h)
+				if err != nil {
+					return nil, err
+				}
+				p.RateLimit = rl
+
+			case "verify_pool":
+				vp, err := parseVerifyPool(h)
+				if err != nil {
+					return nil, err
 				}
-				p.Purpose = paseto.Purpose(purp)
+				p.VerifyPool = vp
+
+			case "verify_budget":
+				vb, err := parseVerifyBudget(h)
+				if err != nil {
+					return nil, err
+				}
+				p.VerifyBudget = vb
+
+			case "replay_verifications":
+				rv, err := parseReplayVerifications(h)
+				if err != nil {
+					return nil, err
+				}
+				p.ReplayVerifications = rv
+
+			case "source_networks":
+				args := h.RemainingArgs()
+				if len(args) < 3 {
+					return nil, h.Errf("invalid source_networks: expected a source type, name and networks")
+				}
+				if p.SourceNetworks == nil {
+					p.SourceNetworks = make(map[string][]string)
+				}
+				source := args[0] + ":" + args[1]
+				p.SourceNetworks[source] = append(p.SourceNetworks[source], args[2:]...)
+
+			case "route_claim":
+				args := h.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 || (len(args) == 2 && args[1] != "required") {
+					return nil, h.Errf("invalid route_claim: expected a claim name and optional 'required'")
+				}
+				p.RouteClaim = args[0]
+				p.RouteClaimRequired = len(args) == 2
 
 			case "time_skew_tolerance":
 				var tst string
@@ -82,12 +481,222 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 					return nil, h.Errf("invalid time skew tolerance: %q", tst)
 				}
 
+			case "max_token_age":
+				var age string
+				if !h.AllArgs(&age) {
+					return nil, h.Errf("invalid max token age: %q", age)
+				}
+				var err error
+				if p.MaxTokenAge, err = time.ParseDuration(age); err != nil {
+					return nil, h.Errf("invalid max token age: %q", age)
+				}
+
+			case "issuer_policy":
+				iss, policy, err := parseIssuerPolicy(h)
+				if err != nil {
+					return nil, err
+				}
+				if p.IssuerPolicies == nil {
+					p.IssuerPolicies = make(map[string]*IssuerPolicy)
+				}
+				if _, ok := p.IssuerPolicies[iss]; ok {
+					return nil, h.Errf("invalid issuer_policy: duplicate issuer: %s", iss)
+				}
+				p.IssuerPolicies[iss] = policy
+
+			case "idle_timeout":
+				var idle string
+				if !h.AllArgs(&idle) {
+					return nil, h.Errf("invalid idle timeout: %q", idle)
+				}
+				var err error
+				if p.IdleTimeout, err = time.ParseDuration(idle); err != nil {
+					return nil, h.Errf("invalid idle timeout: %q", idle)
+				}
+
+			case "session_storage":
+				args := h.RemainingArgs()
+				if len(args) > 1 {
+					return nil, h.ArgErr()
+				}
+				p.SessionStorage = true
+				if len(args) == 1 {
+					var err error
+					if p.SessionStorageTimeout, err = time.ParseDuration(args[0]); err != nil {
+						return nil, h.Errf("invalid session_storage timeout: %q", args[0])
+					}
+				}
+
+			case "token_type":
+				args := h.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, h.Errf("invalid token_type: expected a type and optional claim name")
+				}
+				p.TokenType = args[0]
+				if len(args) == 2 {
+					p.TokenTypeClaim = args[1]
+				}
+
+			case "claim_values":
+				args := h.RemainingArgs()
+				if len(args) < 2 {
+					return nil, h.Errf("invalid claim_values: expected a claim name and values")
+				}
+				if p.ClaimValues == nil {
+					p.ClaimValues = make(map[string][]string)
+				}
+				p.ClaimValues[args[0]] = append(p.ClaimValues[args[0]], args[1:]...)
+
+			case "require_claim":
+				args := h.RemainingArgs()
+				if len(args) < 2 {
+					return nil, h.Errf("invalid require_claim: expected a claim name and values")
+				}
+				if p.RequireClaims == nil {
+					p.RequireClaims = make(map[string][]string)
+				}
+				p.RequireClaims[args[0]] = append(p.RequireClaims[args[0]], args[1:]...)
+
+			case "allow_roles":
+				p.AllowRoles = append(p.AllowRoles, listArgs(h)...)
+
+			case "deny_roles":
+				p.DenyRoles = append(p.DenyRoles, listArgs(h)...)
+
+			case "roles_claim":
+				if !h.AllArgs(&p.RolesClaim) {
+					return nil, h.Errf("invalid roles_claim: expected a single value")
+				}
+
+			case "require_scopes":
+				args := h.RemainingArgs()
+				if len(args) < 2 {
+					return nil, h.Errf("invalid require_scopes: expected methods and scopes")
+				}
+				if p.RequireScopes == nil {
+					p.RequireScopes = make(map[string][]string)
+				}
+				for _, method := range strings.Split(args[0], ",") {
+					method = strings.ToUpper(method)
+					p.RequireScopes[method] = append(p.RequireScopes[method], args[1:]...)
+				}
+
+			case "path_requirements":
+				if err := parsePathRequirements(h, &p); err != nil {
+					return nil, err
+				}
+
+			case "forbid_claims":
+				p.ForbidClaims = append(p.ForbidClaims, listArgs(h)...)
+
+			case "track_sessions":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				p.TrackSessions = true
+
 			case "user_claims":
-				p.UserClaims = h.RemainingArgs()
+				p.UserClaims = append(p.UserClaims, listArgs(h)...)
+
+			case "cache_key_claims":
+				claims := listArgs(h)
+				if len(claims) == 0 {
+					return nil, h.Errf("invalid cache_key_claims: expected at least one claim name")
+				}
+				p.CacheKeyClaims = append(p.CacheKeyClaims, claims...)
+
+			case "log_claim_changes":
+				claims := listArgs(h)
+				if len(claims) == 0 {
+					return nil, h.Errf("invalid log_claim_changes: expected at least one claim name")
+				}
+				p.LogClaimChanges = append(p.LogClaimChanges, claims...)
+
+			case "redact_claims":
+				claims := listArgs(h)
+				if len(claims) == 0 {
+					return nil, h.Errf("invalid redact_claims: expected at least one claim name")
+				}
+				p.RedactClaims = append(p.RedactClaims, claims...)
+
+			case "redact_mode":
+				if !h.AllArgs(&p.RedactMode) {
+					return nil, h.Errf("invalid redact_mode: expected hash or mask")
+				}
+
+			case "http_signatures":
+				hs, err := parseHTTPSignatures(h)
+				if err != nil {
+					return nil, err
+				}
+				p.HTTPSignatures = hs
+
+			case "session_binding":
+				args := h.RemainingArgs()
+				if len(args) == 0 || len(args) > 2 {
+					return nil, h.Errf("invalid session_binding: expected a cookie name and optional claim name")
+				}
+				p.SessionBinding = &SessionBinding{Cookie: args[0]}
+				if len(args) == 2 {
+					p.SessionBinding.Claim = args[1]
+				}
+
+			case "signed_url":
+				p.SignedURL = &SignedURL{Bind: listArgs(h)}
+
+			case "maintenance":
+				m, err := parseMaintenance(h)
+				if err != nil {
+					return nil, err
+				}
+				p.Maintenance = m
+
+			case "challenge_pages":
+				var root string
+				if !h.AllArgs(&root) {
+					return nil, h.Errf("invalid challenge_pages: expected a single directory")
+				}
+				p.ChallengePages = &ChallengePages{Root: root}
+
+			case "enforce":
+				var enforce string
+				if !h.AllArgs(&enforce) || (enforce != "on" && enforce != "off") {
+					return nil, h.Errf("invalid enforce: expected on or off")
+				}
+				p.MonitorOnly = enforce == "off"
+
+			case "cors_origins":
+				p.CORSOrigins = append(p.CORSOrigins, listArgs(h)...)
+
+			case "preflight":
+				if p.Preflight == nil {
+					p.Preflight = &Preflight{}
+				}
+				p.Preflight.Origins = append(p.Preflight.Origins, listArgs(h)...)
+
+			case "well_known":
+				p.WellKnown = defaultWellKnownPath
+				if h.NextArg() {
+					p.WellKnown = h.Val()
+				}
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+
+			case "publish_keys":
+				p.PublishKeys = defaultPublishKeysPath
+				if h.NextArg() {
+					p.PublishKeys = h.Val()
+				}
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
 
 			case "meta_claims":
-				p.MetaClaims = make(map[string]string)
-				for _, metaClaim := range h.RemainingArgs() {
+				if p.MetaClaims == nil {
+					p.MetaClaims = make(map[string]string)
+				}
+				for _, metaClaim := range listArgs(h) {
 					claim, placeholder, err := parseMetaClaim(metaClaim)
 					if err != nil {
 						return nil, h.Errf("invalid meta_claims: %w", err)
@@ -98,25 +707,1145 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 					p.MetaClaims[claim] = placeholder
 				}
 
-			case "version":
-				var ver string
-				if !h.AllArgs(&ver) {
-					return nil, h.Errf("invalid version: %q", ver)
-				}
-				if !strings.HasPrefix(ver, "v") {
-					ver = fmt.Sprintf("v%s", ver)
-				}
-				p.Version = paseto.Version(ver)
-
 			default:
-				return nil, h.Errf("unrecognized option: %s", opt)
+				if ok, err := parseKeyOption(h, opt, &p); err != nil {
+					return nil, err
+				} else if !ok {
+					return nil, h.Errf("unrecognized option: %s", opt)
+				}
 			}
 		}
 	}
 
-	return caddyauth.Authentication{
+	return &PasetoAuthHandler{Authentication: caddyauth.Authentication{
 		ProvidersRaw: caddy.ModuleMap{
 			"paseto": caddyconfig.JSON(p, nil),
 		},
-	}, nil
+	}}, nil
+}
+
+// parseKeyOption parses the options that configure the keys, which are shared
+// by pasetoauth and the issuers of the paseto app. It returns false if the
+// option isn't a key option.
+//
+//nolint:funlen // the length is acceptable
+func parseKeyOption(h httpcaddyfile.Helper, opt string, p *PasetoAuth) (bool, error) {
+	switch opt {
+	case "key":
+		if !h.AllArgs(&p.Key) {
+			return true, h.Errf("key is empty")
+		}
+
+	case "key_password":
+		if !h.AllArgs(&p.KeyPassword) {
+			return true, h.Errf("key password is empty")
+		}
+
+	case "key_passphrase":
+		kp, err := parseKeyPassphrase(h)
+		if err != nil {
+			return true, err
+		}
+		p.KeyPassphrase = kp
+
+	case "key_master":
+		var src, val string
+		if !h.AllArgs(&src, &val) {
+			return true, h.Errf("invalid key_master: expected env or file, and a value")
+		}
+		switch src {
+		case "env":
+			p.KeyMaster = &KeyMaster{Env: val}
+		case "file":
+			p.KeyMaster = &KeyMaster{File: val}
+		default:
+			return true, h.Errf("invalid key_master: expected env or file, got %q", src)
+		}
+
+	case "key_file":
+		args := h.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, h.Errf("invalid key_file: expected a path and optional interval")
+		}
+		p.KeyFile = args[0]
+		if len(args) == 2 {
+			var err error
+			if p.KeyFileInterval, err = time.ParseDuration(args[1]); err != nil {
+				return true, h.Errf("invalid key_file interval: %q", args[1])
+			}
+		}
+
+	case "key_credential":
+		args := h.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, h.Errf("invalid key_credential: expected a name and optional interval")
+		}
+		p.KeyCredential = args[0]
+		if len(args) == 2 {
+			var err error
+			if p.KeyFileInterval, err = time.ParseDuration(args[1]); err != nil {
+				return true, h.Errf("invalid key_credential interval: %q", args[1])
+			}
+		}
+
+	case "key_file_check":
+		if !h.AllArgs(&p.KeyFileCheck) {
+			return true, h.Errf("invalid key_file_check: expected mtime or content")
+		}
+
+	case "key_file_sops":
+		ks, err := parseKeyFileSOPS(h)
+		if err != nil {
+			return true, err
+		}
+		p.KeyFileSOPS = ks
+
+	case "key_url":
+		args := h.RemainingArgs()
+		if len(args) == 0 || len(args) > 2 {
+			return true, h.Errf("invalid key_url: expected a URL and optional interval")
+		}
+		p.KeyURL = args[0]
+		if len(args) == 2 {
+			var err error
+			if p.KeyURLInterval, err = time.ParseDuration(args[1]); err != nil {
+				return true, h.Errf("invalid key_url interval: %q", args[1])
+			}
+		}
+
+	case "key_url_timeout":
+		var timeout string
+		if !h.AllArgs(&timeout) {
+			return true, h.Errf("invalid key_url_timeout: %q", timeout)
+		}
+		var err error
+		if p.KeyURLTimeout, err = time.ParseDuration(timeout); err != nil {
+			return true, h.Errf("invalid key_url_timeout: %q", timeout)
+		}
+
+	case "key_url_outage":
+		if !h.AllArgs(&p.KeyURLOutage) {
+			return true, h.Errf("invalid key_url_outage: expected keep or reject")
+		}
+
+	case "key_url_pins":
+		p.KeyURLPins = append(p.KeyURLPins, listArgs(h)...)
+		if len(p.KeyURLPins) == 0 {
+			return true, h.Errf("invalid key_url_pins: expected key IDs or keys")
+		}
+
+	case "key_url_signature":
+		args := h.RemainingArgs()
+		if len(args) < 1 || len(args) > 2 {
+			return true, h.Errf("invalid key_url_signature: expected a root key and optional signature URL")
+		}
+		p.KeyURLSignature = &KeyURLSignature{RootKey: args[0]}
+		if len(args) == 2 {
+			p.KeyURLSignature.URL = args[1]
+		}
+
+	case "key_rotation":
+		kr, err := parseKeyRotation(h)
+		if err != nil {
+			return true, err
+		}
+		p.KeyRotation = kr
+
+	case "key_storage":
+		ks, err := parseKeyStorage(h)
+		if err != nil {
+			return true, err
+		}
+		p.KeyStorage = ks
+
+	case "key_aws":
+		ka, err := parseKeyAWS(h)
+		if err != nil {
+			return true, err
+		}
+		p.KeyAWS = ka
+
+	case "key_gcp":
+		kg, err := parseKeyGCP(h)
+		if err != nil {
+			return true, err
+		}
+		p.KeyGCP = kg
+
+	case "admin_keys":
+		if h.NextArg() {
+			return true, h.ArgErr()
+		}
+		p.AdminKeys = true
+
+	case "key_failover":
+		p.KeyFailover = listArgs(h)
+		if len(p.KeyFailover) == 0 {
+			return true, h.Errf("invalid key_failover: expected key sources")
+		}
+
+	case "key_not_after":
+		var ref, notAfter string
+		if !h.AllArgs(&ref, &notAfter) {
+			return true, h.Errf("invalid key_not_after: expected a key ID or key, and a time")
+		}
+		t, err := parseNotAfter(notAfter)
+		if err != nil {
+			return true, h.Errf("invalid key_not_after time: %q", notAfter)
+		}
+		if p.KeyNotAfter == nil {
+			p.KeyNotAfter = make(map[string]time.Time)
+		}
+		if _, ok := p.KeyNotAfter[ref]; ok {
+			return true, h.Errf("invalid key_not_after: duplicate key: %s", ref)
+		}
+		p.KeyNotAfter[ref] = t
+
+	case "stale_keys":
+		if !h.AllArgs(&p.StaleKeys) {
+			return true, h.Errf("invalid stale_keys: expected warn or reject")
+		}
+
+	case "keys":
+		keys := listArgs(h)
+		if len(keys) == 0 {
+			return true, h.Errf("keys are empty")
+		}
+		p.Keys = append(p.Keys, keys...)
+
+	case "purpose":
+		var purp string
+		if !h.AllArgs(&purp) {
+			return true, h.Errf("invalid purpose: %q", purp)
+		}
+		p.Purpose = paseto.Purpose(purp)
+
+	case "version":
+		var ver string
+		if !h.AllArgs(&ver) {
+			return true, h.Errf("invalid version: %q", ver)
+		}
+		if !strings.HasPrefix(ver, "v") {
+			ver = fmt.Sprintf("v%s", ver)
+		}
+		p.Version = paseto.Version(ver)
+
+	default:
+		return false, nil
+	}
+
+	return true, nil
+}
+
+func parseKeyStorage(h httpcaddyfile.Helper) (*KeyStorage, error) {
+	ks := &KeyStorage{}
+	args := h.RemainingArgs()
+	if len(args) > 2 {
+		return nil, h.Errf("invalid key_storage: expected an optional name and check interval")
+	}
+	if len(args) > 0 {
+		ks.Name = args[0]
+	}
+	if len(args) == 2 {
+		var err error
+		if ks.CheckInterval, err = time.ParseDuration(args[1]); err != nil {
+			return nil, h.Errf("invalid key_storage check interval: %q", args[1])
+		}
+	}
+
+	return ks, nil
+}
+
+func parseKeyAWS(h httpcaddyfile.Helper) (*KeyAWS, error) {
+	ka := &KeyAWS{}
+	args := h.RemainingArgs()
+	if len(args) > 1 {
+		return nil, h.Errf("invalid key_aws: expected an optional secret ID")
+	} else if len(args) == 1 {
+		ka.SecretID = args[0]
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		var (
+			str *string
+			dur *time.Duration
+		)
+		switch opt {
+		case "region":
+			str = &ka.Region
+		case "secret_id":
+			str = &ka.SecretID
+		case "version_stage":
+			str = &ka.VersionStage
+		case "version_id":
+			str = &ka.VersionID
+		case "ciphertext":
+			str = &ka.Ciphertext
+		case "kms_key_id":
+			str = &ka.KMSKeyID
+		case "endpoint":
+			str = &ka.Endpoint
+		case "refresh_interval":
+			dur = &ka.RefreshInterval
+		case "timeout":
+			dur = &ka.Timeout
+		case "encryption_context":
+			var name, val string
+			if !h.AllArgs(&name, &val) {
+				return nil, h.Errf("invalid key_aws encryption_context: expected a name and a value")
+			}
+			if ka.EncryptionContext == nil {
+				ka.EncryptionContext = make(map[string]string)
+			}
+			ka.EncryptionContext[name] = val
+			continue
+		default:
+			return nil, h.Errf("unrecognized key_aws option: %s", opt)
+		}
+
+		var val string
+		if !h.AllArgs(&val) {
+			return nil, h.Errf("invalid key_aws %s: %q", opt, val)
+		}
+		if str != nil {
+			*str = val
+			continue
+		}
+		var err error
+		if *dur, err = time.ParseDuration(val); err != nil {
+			return nil, h.Errf("invalid key_aws %s: %q", opt, val)
+		}
+	}
+
+	return ka, nil
+}
+
+func parseKeyGCP(h httpcaddyfile.Helper) (*KeyGCP, error) {
+	kg := &KeyGCP{}
+	args := h.RemainingArgs()
+	if len(args) > 1 {
+		return nil, h.Errf("invalid key_gcp: expected an optional secret")
+	} else if len(args) == 1 {
+		kg.Secret = args[0]
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		var (
+			str *string
+			dur *time.Duration
+		)
+		switch opt {
+		case "project":
+			str = &kg.Project
+		case "location":
+			str = &kg.Location
+		case "secret":
+			str = &kg.Secret
+		case "version":
+			str = &kg.Version
+		case "endpoint":
+			str = &kg.Endpoint
+		case "refresh_interval":
+			dur = &kg.RefreshInterval
+		case "timeout":
+			dur = &kg.Timeout
+		default:
+			return nil, h.Errf("unrecognized key_gcp option: %s", opt)
+		}
+
+		var val string
+		if !h.AllArgs(&val) {
+			return nil, h.Errf("invalid key_gcp %s: %q", opt, val)
+		}
+		if str != nil {
+			*str = val
+			continue
+		}
+		var err error
+		if *dur, err = time.ParseDuration(val); err != nil {
+			return nil, h.Errf("invalid key_gcp %s: %q", opt, val)
+		}
+	}
+
+	return kg, nil
+}
+
+func parseKeyRotation(h httpcaddyfile.Helper) (*KeyRotation, error) {
+	kr := &KeyRotation{}
+	args := h.RemainingArgs()
+	if len(args) > 1 {
+		return nil, h.Errf("invalid key_rotation: expected an optional name")
+	} else if len(args) == 1 {
+		kr.Name = args[0]
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		var dst *time.Duration
+		switch opt {
+		case "interval":
+			dst = &kr.Interval
+		case "overlap":
+			dst = &kr.Overlap
+		case "check_interval":
+			dst = &kr.CheckInterval
+		default:
+			return nil, h.Errf("unrecognized key_rotation option: %s", opt)
+		}
+		var val string
+		if !h.AllArgs(&val) {
+			return nil, h.Errf("invalid key_rotation %s: %q", opt, val)
+		}
+		var err error
+		if *dst, err = time.ParseDuration(val); err != nil {
+			return nil, h.Errf("invalid key_rotation %s: %q", opt, val)
+		}
+	}
+
+	return kr, nil
+}
+
+// parseNotAfter parses a key_not_after time, which is either an RFC 3339 time,
+// or a date, i.e. midnight UTC.
+func parseNotAfter(val string) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, val); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(time.RFC3339, val)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed parsing time: %w", err)
+	}
+	return t.UTC(), nil
+}
+
+// listArgs returns the remaining arguments of a list option, split on commas,
+// e.g. "a,b c" and "a, b, c" are both parsed as [a b c].
+func listArgs(h httpcaddyfile.Helper) []string {
+	var vals []string
+	for _, arg := range h.RemainingArgs() {
+		for val := range strings.SplitSeq(arg, ",") {
+			if val = strings.TrimSpace(val); val != "" {
+				vals = append(vals, val)
+			}
+		}
+	}
+
+	return vals
+}
+
+// parseMaxSize parses the single size argument of a maximum size option, e.g.
+// "64KiB".
+func parseMaxSize(h httpcaddyfile.Helper, opt string) (int64, error) {
+	var size string
+	if !h.AllArgs(&size) {
+		return 0, h.Errf("invalid %s: %q", opt, size)
+	}
+	n, err := humanize.ParseBytes(size)
+	if err != nil || n > math.MaxInt64 {
+		return 0, h.Errf("invalid %s: %q", opt, size)
+	}
+
+	return int64(n), nil
+}
+
+func parseCircuitBreaker(h httpcaddyfile.Helper) (*CircuitBreaker, error) {
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
+
+	cb := &CircuitBreaker{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		switch opt {
+		case "threshold":
+			var threshold string
+			if !h.AllArgs(&threshold) {
+				return nil, h.Errf("invalid circuit_breaker threshold: %q", threshold)
+			}
+			var err error
+			if cb.Threshold, err = strconv.Atoi(threshold); err != nil {
+				return nil, h.Errf("invalid circuit_breaker threshold: %q", threshold)
+			}
+
+		case "cooldown":
+			var cooldown string
+			if !h.AllArgs(&cooldown) {
+				return nil, h.Errf("invalid circuit_breaker cooldown: %q", cooldown)
+			}
+			var err error
+			if cb.Cooldown, err = time.ParseDuration(cooldown); err != nil {
+				return nil, h.Errf("invalid circuit_breaker cooldown: %q", cooldown)
+			}
+
+		case "fail_open":
+			if h.NextArg() {
+				return nil, h.ArgErr()
+			}
+			cb.FailOpen = true
+
+		default:
+			return nil, h.Errf("unrecognized circuit_breaker option: %s", opt)
+		}
+	}
+
+	return cb, nil
+}
+
+func parseRateLimit(h httpcaddyfile.Helper) (*RateLimit, error) {
+	rl := &RateLimit{}
+	if !h.AllArgs(&rl.Claim) {
+		return nil, h.Errf("invalid rate_limit: expected a single claim name")
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		switch opt {
+		case "window":
+			var window string
+			if !h.AllArgs(&window) {
+				return nil, h.Errf("invalid rate_limit window: %q", window)
+			}
+			var err error
+			if rl.Window, err = time.ParseDuration(window); err != nil {
+				return nil, h.Errf("invalid rate_limit window: %q", window)
+			}
+
+		case "default":
+			var limit string
+			if !h.AllArgs(&limit) {
+				return nil, h.Errf("invalid rate_limit default: %q", limit)
+			}
+			var err error
+			if rl.Default, err = strconv.Atoi(limit); err != nil {
+				return nil, h.Errf("invalid rate_limit default: %q", limit)
+			}
+
+		case "tier":
+			var name, limit string
+			if !h.AllArgs(&name, &limit) {
+				return nil, h.Errf("invalid rate_limit tier: expected a tier name and limit")
+			}
+			n, err := strconv.Atoi(limit)
+			if err != nil {
+				return nil, h.Errf("invalid rate_limit tier limit: %q", limit)
+			}
+			if rl.Tiers == nil {
+				rl.Tiers = make(map[string]int)
+			}
+			rl.Tiers[name] = n
+
+		default:
+			return nil, h.Errf("unrecognized rate_limit option: %s", opt)
+		}
+	}
+
+	return rl, nil
+}
+
+func parseVerifyPool(h httpcaddyfile.Helper) (*VerifyPool, error) {
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
+
+	vp := &VerifyPool{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		var val string
+		if !h.AllArgs(&val) {
+			return nil, h.Errf("invalid verify_pool %s: %q", opt, val)
+		}
+		count, err := strconv.Atoi(val)
+		if err != nil {
+			return nil, h.Errf("invalid verify_pool %s: %q", opt, val)
+		}
+
+		switch opt {
+		case "workers":
+			vp.Workers = count
+
+		case "queue_depth":
+			vp.QueueDepth = count
+
+		default:
+			return nil, h.Errf("unrecognized verify_pool option: %s", opt)
+		}
+	}
+
+	return vp, nil
+}
+
+func parseReplayVerifications(h httpcaddyfile.Helper) (*ReplayVerifications, error) {
+	var ack string
+	if !h.AllArgs(&ack) || ack != "unsafe" {
+		return nil, h.Errf("invalid replay_verifications: expected the 'unsafe' argument")
+	}
+
+	rv := &ReplayVerifications{Unsafe: true}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		if opt != "max_tokens" {
+			return nil, h.Errf("unrecognized replay_verifications option: %s", opt)
+		}
+		var val string
+		if !h.AllArgs(&val) {
+			return nil, h.Errf("invalid replay_verifications %s: %q", opt, val)
+		}
+		var err error
+		if rv.MaxTokens, err = strconv.Atoi(val); err != nil {
+			return nil, h.Errf("invalid replay_verifications %s: %q", opt, val)
+		}
+	}
+
+	return rv, nil
+}
+
+func parseKeyPassphrase(h httpcaddyfile.Helper) (*KeyPassphrase, error) {
+	kp := &KeyPassphrase{}
+	if !h.AllArgs(&kp.Passphrase, &kp.Salt) {
+		return nil, h.Errf("invalid key_passphrase: expected a passphrase and a salt")
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		var val string
+		if !h.AllArgs(&val) {
+			return nil, h.Errf("invalid key_passphrase %s: %q", opt, val)
+		}
+
+		var (
+			n   uint64
+			err error
+		)
+		switch opt {
+		case "time":
+			n, err = strconv.ParseUint(val, 10, 32)
+			//nolint:gosec // ParseUint checks that the value fits
+			kp.Time = uint32(n)
+
+		case "memory":
+			n, err = strconv.ParseUint(val, 10, 32)
+			//nolint:gosec // ParseUint checks that the value fits
+			kp.Memory = uint32(n)
+
+		case "threads":
+			n, err = strconv.ParseUint(val, 10, 8)
+			//nolint:gosec // ParseUint checks that the value fits
+			kp.Threads = uint8(n)
+
+		default:
+			return nil, h.Errf("unrecognized key_passphrase option: %s", opt)
+		}
+		if err != nil {
+			return nil, h.Errf("invalid key_passphrase %s: %q", opt, val)
+		}
+	}
+
+	return kp, nil
+}
+
+func parseVerifyBudget(h httpcaddyfile.Helper) (*VerifyBudget, error) {
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
+
+	vb := &VerifyBudget{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		var val string
+		if !h.AllArgs(&val) {
+			return nil, h.Errf("invalid verify_budget %s: %q", opt, val)
+		}
+
+		var err error
+		switch opt {
+		case "max_time":
+			vb.MaxTime, err = time.ParseDuration(val)
+
+		case "max_operations":
+			vb.MaxOperations, err = strconv.Atoi(val)
+
+		default:
+			return nil, h.Errf("unrecognized verify_budget option: %s", opt)
+		}
+		if err != nil {
+			return nil, h.Errf("invalid verify_budget %s: %q", opt, val)
+		}
+	}
+
+	return vb, nil
+}
+
+func parseIssuerPolicy(h httpcaddyfile.Helper) (string, *IssuerPolicy, error) {
+	var iss string
+	if !h.AllArgs(&iss) {
+		return "", nil, h.Errf("invalid issuer_policy: expected a single issuer")
+	}
+
+	policy := &IssuerPolicy{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		var target *time.Duration
+		switch opt {
+		case "time_skew_tolerance":
+			target = &policy.TimeSkewTolerance
+		case "max_token_age":
+			target = &policy.MaxTokenAge
+		default:
+			return "", nil, h.Errf("unrecognized issuer_policy option: %s", opt)
+		}
+
+		var dur string
+		if !h.AllArgs(&dur) {
+			return "", nil, h.Errf("invalid issuer_policy %s: %q", opt, dur)
+		}
+		var err error
+		if *target, err = time.ParseDuration(dur); err != nil {
+			return "", nil, h.Errf("invalid issuer_policy %s: %q", opt, dur)
+		}
+	}
+
+	return iss, policy, nil
+}
+
+// parsePathRequirements parses the lines of a path_requirements block, e.g.
+// "/admin/* => scope admin". The requirements of lines with the same path are
+// merged.
+func parsePathRequirements(h httpcaddyfile.Helper, p *PasetoAuth) error {
+	if h.NextArg() {
+		return h.ArgErr()
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		path := h.Val()
+		args := h.RemainingArgs()
+		if len(args) > 0 && args[0] == "=>" {
+			args = args[1:]
+		}
+		if len(args) < 2 {
+			return h.Errf("invalid path_requirements %s: expected scope or claim requirements", path)
+		}
+
+		idx := slices.IndexFunc(p.PathRequirements, func(pr *PathRequirement) bool { return pr.Path == path })
+		if idx == -1 {
+			p.PathRequirements = append(p.PathRequirements, &PathRequirement{Path: path})
+			idx = len(p.PathRequirements) - 1
+		}
+		pr := p.PathRequirements[idx]
+		switch args[0] {
+		case "scope":
+			pr.Scopes = append(pr.Scopes, args[1:]...)
+		case "claim":
+			if len(args) < 3 {
+				return h.Errf("invalid path_requirements %s: expected a claim name and values", path)
+			}
+			if pr.Claims == nil {
+				pr.Claims = make(map[string][]string)
+			}
+			pr.Claims[args[1]] = append(pr.Claims[args[1]], args[2:]...)
+		default:
+			return h.Errf("invalid path_requirements %s: unrecognized requirement: %s", path, args[0])
+		}
+	}
+
+	return nil
+}
+
+func parseHTTPSignatures(h httpcaddyfile.Helper) (*HTTPSignatures, error) {
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
+
+	hs := &HTTPSignatures{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		switch opt {
+		case "key_claim":
+			if !h.AllArgs(&hs.KeyClaim) {
+				return nil, h.Errf("invalid http_signatures key_claim: expected a single value")
+			}
+
+		case "label":
+			if !h.AllArgs(&hs.Label) {
+				return nil, h.Errf("invalid http_signatures label: expected a single value")
+			}
+
+		case "components":
+			components := listArgs(h)
+			if len(components) == 0 {
+				return nil, h.Errf("invalid http_signatures components: expected at least one component")
+			}
+			hs.Components = append(hs.Components, components...)
+
+		case "max_age":
+			var age string
+			if !h.AllArgs(&age) {
+				return nil, h.Errf("invalid http_signatures max_age: %q", age)
+			}
+			var err error
+			if hs.MaxAge, err = time.ParseDuration(age); err != nil {
+				return nil, h.Errf("invalid http_signatures max_age: %q", age)
+			}
+
+		case "max_body_size":
+			var size string
+			if !h.AllArgs(&size) {
+				return nil, h.Errf("invalid http_signatures max_body_size: %q", size)
+			}
+			n, err := humanize.ParseBytes(size)
+			if err != nil || n > math.MaxInt64 {
+				return nil, h.Errf("invalid http_signatures max_body_size: %q", size)
+			}
+			hs.MaxBodySize = int64(n)
+
+		default:
+			return nil, h.Errf("unrecognized http_signatures option: %s", opt)
+		}
+	}
+
+	return hs, nil
+}
+
+func parseKeyFileSOPS(h httpcaddyfile.Helper) (*KeyFileSOPS, error) {
+	if h.NextArg() {
+		return nil, h.ArgErr()
+	}
+
+	ks := &KeyFileSOPS{}
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		switch opt {
+		case "extract":
+			if !h.AllArgs(&ks.Extract) {
+				return nil, h.Errf("invalid key_file_sops extract: expected a single path")
+			}
+
+		case "command":
+			if !h.AllArgs(&ks.Command) {
+				return nil, h.Errf("invalid key_file_sops command: expected a single path")
+			}
+
+		case "timeout":
+			var timeout string
+			if !h.AllArgs(&timeout) {
+				return nil, h.Errf("invalid key_file_sops timeout: %q", timeout)
+			}
+			var err error
+			if ks.Timeout, err = time.ParseDuration(timeout); err != nil {
+				return nil, h.Errf("invalid key_file_sops timeout: %q", timeout)
+			}
+
+		default:
+			return nil, h.Errf("unrecognized key_file_sops option: %s", opt)
+		}
+	}
+
+	return ks, nil
+}
+
+func parseMaintenance(h httpcaddyfile.Helper) (*Maintenance, error) {
+	m := &Maintenance{}
+	args := h.RemainingArgs()
+	switch len(args) {
+	case 0:
+	case 1:
+		m.Enabled = args[0]
+	default:
+		return nil, h.Errf("invalid maintenance: expected at most one flag value")
+	}
+
+	for nesting := h.Nesting(); h.NextBlock(nesting); {
+		opt := h.Val()
+		switch opt {
+		case "bypass_claim":
+			args := h.RemainingArgs()
+			if len(args) == 0 || len(args) > 2 {
+				return nil, h.Errf("invalid maintenance bypass_claim: expected a claim name and optional value")
+			}
+			m.BypassClaim = args[0]
+			if len(args) == 2 {
+				m.BypassValue = args[1]
+			}
+
+		case "status":
+			var status string
+			if !h.AllArgs(&status) {
+				return nil, h.Errf("invalid maintenance status: %q", status)
+			}
+			var err error
+			if m.StatusCode, err = strconv.Atoi(status); err != nil {
+				return nil, h.Errf("invalid maintenance status: %q", status)
+			}
+
+		case "body":
+			if !h.AllArgs(&m.Body) {
+				return nil, h.Errf("invalid maintenance body: expected a single value")
+			}
+
+		case "content_type":
+			if !h.AllArgs(&m.ContentType) {
+				return nil, h.Errf("invalid maintenance content_type: expected a single value")
+			}
+
+		default:
+			return nil, h.Errf("unrecognized maintenance option: %s", opt)
+		}
+	}
+
+	return m, nil
+}
+
+// parseSignCaddyfile sets up the paseto_sign handler from Caddyfile. Syntax:
+//
+//	paseto_sign [<matcher>] {
+//		key <key>
+//		key_password <password>
+//		key_rotation [<name>] {
+//			interval <duration>
+//			overlap <duration>
+//			check_interval <duration>
+//		}
+//		version <protocol version>
+//		purpose <protocol purpose>
+//		target <response|request>
+//		header <header name>
+//		audience <audience name>
+//		issuer <issuer name>
+//		lifetime <duration>
+//		max_body_size <size>
+//	}
+//
+//nolint:funlen // the length is acceptable
+func parseSignCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) { //nolint:lll,ireturn // must match httpcaddyfile.UnmarshalHandlerFunc
+	s := &PasetoSign{}
+
+	for h.Next() {
+		for h.NextBlock(0) {
+			opt := h.Val()
+			switch opt {
+			case "key":
+				if !h.AllArgs(&s.Key) {
+					return nil, h.Errf("key is empty")
+				}
+
+			case "key_password":
+				if !h.AllArgs(&s.KeyPassword) {
+					return nil, h.Errf("key password is empty")
+				}
+
+			case "key_rotation":
+				kr, err := parseKeyRotation(h)
+				if err != nil {
+					return nil, err
+				}
+				s.KeyRotation = kr
+
+			case "version":
+				var ver string
+				if !h.AllArgs(&ver) {
+					return nil, h.Errf("invalid version: %q", ver)
+				}
+				if !strings.HasPrefix(ver, "v") {
+					ver = fmt.Sprintf("v%s", ver)
+				}
+				s.Version = paseto.Version(ver)
+
+			case "purpose":
+				var purp string
+				if !h.AllArgs(&purp) {
+					return nil, h.Errf("invalid purpose: %q", purp)
+				}
+				s.Purpose = paseto.Purpose(purp)
+
+			case "target":
+				if !h.AllArgs(&s.Target) {
+					return nil, h.Errf("invalid target: expected a single value")
+				}
+
+			case "header":
+				if !h.AllArgs(&s.Header) {
+					return nil, h.Errf("invalid header: expected a single value")
+				}
+
+			case "audience":
+				if !h.AllArgs(&s.Audience) {
+					return nil, h.Errf("invalid audience: expected a single value")
+				}
+
+			case "issuer":
+				if !h.AllArgs(&s.Issuer) {
+					return nil, h.Errf("invalid issuer: expected a single value")
+				}
+
+			case "lifetime":
+				var lifetime string
+				if !h.AllArgs(&lifetime) {
+					return nil, h.Errf("invalid lifetime: %q", lifetime)
+				}
+				var err error
+				if s.Lifetime, err = time.ParseDuration(lifetime); err != nil {
+					return nil, h.Errf("invalid lifetime: %q", lifetime)
+				}
+
+			case "max_body_size":
+				var size string
+				if !h.AllArgs(&size) {
+					return nil, h.Errf("invalid max_body_size: %q", size)
+				}
+				n, err := humanize.ParseBytes(size)
+				if err != nil || n > math.MaxInt64 {
+					return nil, h.Errf("invalid max_body_size: %q", size)
+				}
+				s.MaxBodySize = int64(n)
+
+			default:
+				return nil, h.Errf("unrecognized option: %s", opt)
+			}
+		}
+	}
+
+	return s, nil
+}
+
+// parseClaimsCaddyfile sets up the paseto_claims handler from Caddyfile.
+// Syntax:
+//
+//	paseto_claims [<matcher>] [<claim name>...] {
+//		claims <claim name>...
+//		max_age <duration>
+//	}
+func parseClaimsCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) { //nolint:lll,ireturn // must match httpcaddyfile.UnmarshalHandlerFunc
+	c := &PasetoClaims{}
+
+	for h.Next() {
+		c.Claims = append(c.Claims, listArgs(h)...)
+		for h.NextBlock(0) {
+			opt := h.Val()
+			switch opt {
+			case "claims":
+				c.Claims = append(c.Claims, listArgs(h)...)
+
+			case "max_age":
+				var age string
+				if !h.AllArgs(&age) {
+					return nil, h.Errf("invalid max_age: %q", age)
+				}
+				var err error
+				if c.MaxAge, err = time.ParseDuration(age); err != nil {
+					return nil, h.Errf("invalid max_age: %q", age)
+				}
+
+			default:
+				return nil, h.Errf("unrecognized option: %s", opt)
+			}
+		}
+	}
+
+	return c, nil
+}
+
+// parseWellKnownCaddyfile sets up the paseto_well_known handler from
+// Caddyfile. It has no options. Syntax:
+//
+//	paseto_well_known
+func parseWellKnownCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) { //nolint:lll,ireturn // must match httpcaddyfile.UnmarshalHandlerFunc
+	for h.Next() {
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		if h.NextBlock(0) {
+			return nil, h.Errf("unrecognized option: %s", h.Val())
+		}
+	}
+
+	return PasetoWellKnown{}, nil
+}
+
+// parsePasetoKeysCaddyfile sets up the paseto_keys handler from Caddyfile. It
+// has no options. Syntax:
+//
+//	paseto_keys
+func parsePasetoKeysCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) { //nolint:lll,ireturn // must match httpcaddyfile.UnmarshalHandlerFunc
+	for h.Next() {
+		if h.NextArg() {
+			return nil, h.ArgErr()
+		}
+		if h.NextBlock(0) {
+			return nil, h.Errf("unrecognized option: %s", h.Val())
+		}
+	}
+
+	return PasetoKeys{}, nil
+}
+
+// parseLogoutCaddyfile sets up the paseto_logout handler from Caddyfile. All
+// pasetoauth key options are supported, e.g. key_file or key_rotation, not only
+// the ones listed here. Syntax:
+//
+//	paseto_logout [<matcher>] {
+//		issuer <name>
+//		key <key>
+//		keys <key>...
+//		key_url <url> [<interval>]
+//		version <protocol version>
+//		purpose <protocol purpose>
+//		allow_audiences <audience name>...
+//		allow_issuers <issuer name>...
+//		time_skew_tolerance <duration>
+//		max_token_age <duration>
+//		session_storage
+//	}
+//
+//nolint:gocognit // the complexity is acceptable
+func parseLogoutCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) { //nolint:lll,ireturn // must match httpcaddyfile.UnmarshalHandlerFunc
+	l := &PasetoLogout{}
+	p := &l.Verifier
+
+	for h.Next() {
+		for h.NextBlock(0) {
+			opt := h.Val()
+			switch opt {
+			case "issuer":
+				if !h.AllArgs(&p.Issuer) {
+					return nil, h.Errf("invalid issuer: expected a single name")
+				}
+
+			case "allow_audiences":
+				p.AllowAudiences = append(p.AllowAudiences, listArgs(h)...)
+
+			case "allow_issuers":
+				p.AllowIssuers = append(p.AllowIssuers, listArgs(h)...)
+
+			case "time_skew_tolerance", "max_token_age":
+				target := &p.TimeSkewTolerance
+				if opt == "max_token_age" {
+					target = &p.MaxTokenAge
+				}
+				var dur string
+				if !h.AllArgs(&dur) {
+					return nil, h.Errf("invalid %s: %q", opt, dur)
+				}
+				var err error
+				if *target, err = time.ParseDuration(dur); err != nil {
+					return nil, h.Errf("invalid %s: %q", opt, dur)
+				}
+
+			case "session_storage":
+				if h.NextArg() {
+					return nil, h.ArgErr()
+				}
+				l.SessionStorage = true
+
+			default:
+				if ok, err := parseKeyOption(h, opt, p); err != nil {
+					return nil, err
+				} else if !ok {
+					return nil, h.Errf("unrecognized option: %s", opt)
+				}
+			}
+		}
+	}
+
+	return l, nil
 }
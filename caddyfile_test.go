@@ -2,11 +2,12 @@ package caddypaseto
 
 import (
 	"testing"
+	"time"
 
+	"aidanwoods.dev/go-paseto"
 	"github.com/caddyserver/caddy/v2/caddyconfig"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
-	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -15,32 +16,364 @@ func TestParseCaddyfileOK(t *testing.T) {
 		Dispenser: caddyfile.NewTestDispenser(`
 	pasetoauth {
 		key "33e9c87f28d6384ee0a113ebe9f4ae5cc75a5c328d62245d5a3af4927ba4778f"
-		from_query access_token token _tok
+		keys 1930e37bda12ff798927482b7e4ef7b9c2a3c7f6a3acb08c7ea55a0ec5fb35cd
+		key_password {env.PASETO_KEY_PASSWORD}
+		key_passphrase {env.PASETO_PASSPHRASE} {env.PASETO_SALT} {
+			time 2
+			memory 19456
+			threads 1
+		}
+		key_master file /run/secrets/paseto-master.key
+		key_file /etc/caddy/paseto.key 1m
+		key_file_check content
+		key_file_sops {
+			extract ["paseto"]["key"]
+			timeout 10s
+		}
+		key_url https://id.example.com/paseto/keys 10m
+		key_url_timeout 5s
+		key_url_outage reject
+		key_url_pins k4.pid.yMgldRRLHBLkhfwTuNJ_KcR6zqgBv9yC2P-OFnKHpcM1
+		key_url_signature k4.public.ThRFH7FWHJWhAMcxSiRFqa9aOWnJ_mI4KrasYvZJD4s
+		key_rotation api {
+			interval 720h
+			overlap 48h
+			check_interval 30s
+		}
+		key_storage cluster 15s
+		key_aws paseto/verification-key {
+			region eu-west-1
+			version_stage AWSPENDING
+			endpoint https://vpce-0123.secretsmanager.eu-west-1.vpce.amazonaws.com
+			refresh_interval 10m
+			timeout 5s
+		}
+		key_gcp paseto-key {
+			project my-project
+			location europe-west1
+			version 3
+			refresh_interval 1h
+		}
+		admin_keys
+		key_failover key_url key_file,keys
+		key_not_after 1930e37bda12ff798927482b7e4ef7b9c2a3c7f6a3acb08c7ea55a0ec5fb35cd 2026-01-01
+		key_not_after k4.pid.yMgldRRLHBLkhfwTuNJ_KcR6zqgBv9yC2P-OFnKHpcM1 2026-06-30T12:00:00+02:00
+		stale_keys reject
+		require_kid
+		max_token_age 24h
+		issuer_key https://billing.internal {
+			key 1930e37bda12ff798927482b7e4ef7b9c2a3c7f6a3acb08c7ea55a0ec5fb35cd
+			version 3
+			purpose local
+		}
+		version_key 3 {
+			key k3.public.AgPBXcnux7zMh9E12IG_ryqlx0uiYHQzjrxOb_sLNGk_j3H7Ve3kj5Gjfrg6FU1OBg
+		}
+		purpose_key local {
+			key 707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f
+		}
+		issuer_policy https://partner.example.com {
+			time_skew_tolerance 5m
+			max_token_age 72h
+		}
+		from_query access_token,token
+		from_query _tok
 		from_header X-Api-Key
 		from_cookies user_session SESSID
-		user_claims uid user_id login username
-		meta_claims "IsAdmin -> is_admin" "gender"
+		from_form access_token
+		from_form_max_size 64KiB
+		from_body auth.token
+		from_body_max_size 256KiB
+		from_path /download/{token}
+		from_websocket_protocol paseto
+		from_basic_auth token x-access-token
+		from_forwarded_authorization 10.0.0.0/8 private_ranges
+		strip_token
+		max_candidates 4
+		max_token_length 4KiB
+		strip_path_token
+		token_sources header cookie query form body path
+		token_extraction first
+		disable_implicit_authorization
+		strict_bearer
+		authorization_schemes Bearer PASETO
+		require_authorization_scheme
+		source_networks header X-Api-Key private_ranges
+		source_networks header X-Api-Key 203.0.113.0/24
+		user_claims uid, user_id
+		user_claims login username
+		meta_claims "IsAdmin -> is_admin"
+		meta_claims gender
+		route_claim tenant.region required
+		cache_key_claims sub tier
+		log_claim_changes roles, profile.tier
+		redact_claims email phone
+		redact_mode mask
+		claim_mapper tenant tid
 		allow_issuers https://api.example.com
-		allow_audiences https://api.example.io https://learn.example.com
+		allow_audiences https://api.example.io, https://learn.example.com
+		audience_match all
+		audience_from_host
     allow_users testuser
+		deny_users mallory
+		deny_audiences https://legacy.example.com
+		deny_issuers https://old-idp.example.com
+		token_type access token_use
+		claim_values role admin editor
+		claim_values role viewer
+		claim_values plan.tier free pro
+		forbid_claims admin legacy.scope
+		require_claim env prod
+		require_claim tier gold
+		require_claim tier silver
+		allow_roles admin editor
+		allow_roles viewer
+		deny_roles suspended
+		roles_claim realm_access.roles
+		require_scopes GET read
+		require_scopes post,PUT write
+		require_scopes PUT admin
+		path_requirements {
+			/admin/* => scope admin
+			/billing/* claim plan.tier pro enterprise
+			/admin/* claim mfa true
+		}
+		deny_fingerprints 9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08
+		list_file allow_users /etc/caddy/users.txt
+		list_file deny_issuers /etc/caddy/denied-issuers.txt
+		list_file deny_fingerprints /etc/caddy/denied.txt
+		list_files_interval 1m
+		track_sessions
+		idle_timeout 15m
+		session_storage 2s
+		circuit_breaker {
+			threshold 3
+			cooldown 1m
+			fail_open
+		}
+		rate_limit rpm {
+			window 30s
+			default 60
+			tier gold 600
+		}
+		verify_pool {
+			workers 4
+			queue_depth 64
+		}
+		verify_budget {
+			max_time 50ms
+			max_operations 4
+		}
+		replay_verifications unsafe {
+			max_tokens 1000
+		}
+		session_binding __Host-sid sid_hash
+		signed_url method
+		http_signatures {
+			key_claim cnf
+			label sig1
+			components @method @target-uri content-digest
+			max_age 1m
+			max_body_size 1MiB
+		}
+		preflight https://app.example.com https://*.example.org
+		well_known
+		publish_keys /keys.json
+		cors_origins https://app.example.com
+		enforce off
+		maintenance {vars.maintenance} {
+			bypass_claim scope deploy
+			status 503
+			body "Down for maintenance"
+			content_type text/html
+		}
+		challenge_pages /etc/caddy/pages
 	}
 	`),
 	}
 	expectedPA := &PasetoAuth{
-		Key:            "33e9c87f28d6384ee0a113ebe9f4ae5cc75a5c328d62245d5a3af4927ba4778f",
-		FromQuery:      []string{"access_token", "token", "_tok"},
-		FromHeader:     []string{"X-Api-Key"},
-		FromCookies:    []string{"user_session", "SESSID"},
-		AllowAudiences: []string{"https://api.example.io", "https://learn.example.com"},
-		AllowIssuers:   []string{"https://api.example.com"},
-		AllowUsers:     []string{"testuser"},
-		UserClaims:     []string{"uid", "user_id", "login", "username"},
-		MetaClaims:     map[string]string{"IsAdmin": "is_admin", "gender": "gender"},
+		Key:             "33e9c87f28d6384ee0a113ebe9f4ae5cc75a5c328d62245d5a3af4927ba4778f",
+		Keys:            []string{"1930e37bda12ff798927482b7e4ef7b9c2a3c7f6a3acb08c7ea55a0ec5fb35cd"},
+		KeyPassword:     "{env.PASETO_KEY_PASSWORD}",
+		KeyFile:         "/etc/caddy/paseto.key",
+		KeyFileInterval: time.Minute,
+		KeyFileCheck:    "content",
+		KeyURL:          "https://id.example.com/paseto/keys",
+		KeyURLInterval:  10 * time.Minute,
+		KeyURLTimeout:   5 * time.Second,
+		KeyURLOutage:    "reject",
+		KeyURLPins:      []string{"k4.pid.yMgldRRLHBLkhfwTuNJ_KcR6zqgBv9yC2P-OFnKHpcM1"},
+		KeyURLSignature: &KeyURLSignature{RootKey: "k4.public.ThRFH7FWHJWhAMcxSiRFqa9aOWnJ_mI4KrasYvZJD4s"},
+		KeyRotation: &KeyRotation{
+			Name:          "api",
+			Interval:      720 * time.Hour,
+			Overlap:       48 * time.Hour,
+			CheckInterval: 30 * time.Second,
+		},
+		KeyStorage: &KeyStorage{Name: "cluster", CheckInterval: 15 * time.Second},
+		KeyAWS: &KeyAWS{
+			Region:          "eu-west-1",
+			SecretID:        "paseto/verification-key",
+			VersionStage:    "AWSPENDING",
+			Endpoint:        "https://vpce-0123.secretsmanager.eu-west-1.vpce.amazonaws.com",
+			RefreshInterval: 10 * time.Minute,
+			Timeout:         5 * time.Second,
+		},
+		KeyGCP: &KeyGCP{
+			Project:         "my-project",
+			Location:        "europe-west1",
+			Secret:          "paseto-key",
+			Version:         "3",
+			RefreshInterval: time.Hour,
+		},
+		AdminKeys:   true,
+		KeyFailover: []string{"key_url", "key_file", "keys"},
+		KeyNotAfter: map[string]time.Time{
+			"1930e37bda12ff798927482b7e4ef7b9c2a3c7f6a3acb08c7ea55a0ec5fb35cd": time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC),
+			"k4.pid.yMgldRRLHBLkhfwTuNJ_KcR6zqgBv9yC2P-OFnKHpcM1":              time.Date(2026, 6, 30, 10, 0, 0, 0, time.UTC),
+		},
+		StaleKeys:   "reject",
+		RequireKID:  true,
+		MaxTokenAge: 24 * time.Hour,
+		IssuerPolicies: map[string]*IssuerPolicy{
+			"https://partner.example.com": {TimeSkewTolerance: 5 * time.Minute, MaxTokenAge: 72 * time.Hour},
+		},
+		FromQuery:       []string{"access_token", "token", "_tok"},
+		FromHeader:      []string{"X-Api-Key"},
+		FromCookies:     []string{"user_session", "SESSID"},
+		FromForm:        []string{"access_token"},
+		FromFormMaxSize: 64 << 10,
+		FromBody:        []string{"auth.token"},
+		FromBodyMaxSize: 256 << 10,
+		FromPath:        []string{"/download/{token}"},
+		StripPathToken:  true,
+		TokenSources:    []string{"header", "cookie", "query", "form", "body", "path"},
+		TokenExtraction: "first",
+		StrictBearer:    true,
+		SourceNetworks:  map[string][]string{"header:X-Api-Key": {"private_ranges", "203.0.113.0/24"}},
+		AllowAudiences:  []string{"https://api.example.io", "https://learn.example.com"},
+		AudienceMatch:   "all",
+		AllowIssuers:    []string{"https://api.example.com"},
+		AllowUsers:      []string{"testuser"},
+		DenyUsers:       []string{"mallory"},
+		DenyAudiences:   []string{"https://legacy.example.com"},
+		DenyIssuers:     []string{"https://old-idp.example.com"},
+		TokenType:       "access",
+		TokenTypeClaim:  "token_use",
+		DenyFingerprints: []string{
+			"9f86d081884c7d659a2feaa0c55ad015a3bf4f1b2b0b822cd15d6c15b0f00a08",
+		},
+		ListFiles: map[string]string{
+			"allow_users":       "/etc/caddy/users.txt",
+			"deny_issuers":      "/etc/caddy/denied-issuers.txt",
+			"deny_fingerprints": "/etc/caddy/denied.txt",
+		},
+		ListFilesInterval:     time.Minute,
+		UserClaims:            []string{"uid", "user_id", "login", "username"},
+		MetaClaims:            map[string]string{"IsAdmin": "is_admin", "gender": "gender"},
+		RouteClaim:            "tenant.region",
+		RouteClaimRequired:    true,
+		CacheKeyClaims:        []string{"sub", "tier"},
+		LogClaimChanges:       []string{"roles", "profile.tier"},
+		RedactClaims:          []string{"email", "phone"},
+		RedactMode:            "mask",
+		ClaimMapperRaw:        []byte(`{"claim":"tid","mapper":"tenant"}`),
+		TrackSessions:         true,
+		IdleTimeout:           15 * time.Minute,
+		SessionStorage:        true,
+		SessionStorageTimeout: 2 * time.Second,
+		CircuitBreaker:        &CircuitBreaker{Threshold: 3, Cooldown: time.Minute, FailOpen: true},
+		RateLimit: &RateLimit{
+			Claim:   "rpm",
+			Window:  30 * time.Second,
+			Default: 60,
+			Tiers:   map[string]int{"gold": 600},
+		},
+		VerifyPool:     &VerifyPool{Workers: 4, QueueDepth: 64},
+		VerifyBudget:   &VerifyBudget{MaxTime: 50 * time.Millisecond, MaxOperations: 4},
+		SessionBinding: &SessionBinding{Cookie: "__Host-sid", Claim: "sid_hash"},
+		SignedURL:      &SignedURL{Bind: []string{"method"}},
+		HTTPSignatures: &HTTPSignatures{
+			KeyClaim:    "cnf",
+			Label:       "sig1",
+			Components:  []string{"@method", "@target-uri", "content-digest"},
+			MaxAge:      time.Minute,
+			MaxBodySize: 1 << 20,
+		},
+		Preflight:   &Preflight{Origins: []string{"https://app.example.com", "https://*.example.org"}},
+		WellKnown:   defaultWellKnownPath,
+		PublishKeys: "/keys.json",
+		CORSOrigins: []string{"https://app.example.com"},
+		MonitorOnly: true,
+		Maintenance: &Maintenance{
+			Enabled:     "{vars.maintenance}",
+			BypassClaim: "scope",
+			BypassValue: "deploy",
+			StatusCode:  503,
+			Body:        "Down for maintenance",
+			ContentType: "text/html",
+		},
+		KeyPassphrase: &KeyPassphrase{
+			Passphrase: "{env.PASETO_PASSPHRASE}",
+			Salt:       "{env.PASETO_SALT}",
+			Time:       2,
+			Memory:     19456,
+			Threads:    1,
+		},
+		KeyMaster: &KeyMaster{File: "/run/secrets/paseto-master.key"},
+		IssuerKeys: map[string]*Issuer{
+			"https://billing.internal": {
+				Key:     "1930e37bda12ff798927482b7e4ef7b9c2a3c7f6a3acb08c7ea55a0ec5fb35cd",
+				Version: "v3",
+				Purpose: "local",
+			},
+		},
+		VersionKeys: map[paseto.Version]*Issuer{
+			"v3": {Key: "k3.public.AgPBXcnux7zMh9E12IG_ryqlx0uiYHQzjrxOb_sLNGk_j3H7Ve3kj5Gjfrg6FU1OBg"},
+		},
+		ReplayVerifications:          &ReplayVerifications{Unsafe: true, MaxTokens: 1000},
+		DisableImplicitAuthorization: true,
+		AuthorizationSchemes:         []string{"Bearer", "PASETO"},
+		RequireAuthorizationScheme:   true,
+		AudienceFromHost:             true,
+		FromWebSocketProtocol:        []string{"paseto"},
+		FromBasicAuth:                []string{"token", "x-access-token"},
+		MaxCandidates:                4,
+		StripToken:                   true,
+		MaxTokenLength:               4 << 10,
+		FromForwardedAuthorization:   true,
+		PurposeKeys: map[paseto.Purpose]*Issuer{
+			"local": {Key: "707172737475767778797a7b7c7d7e7f808182838485868788898a8b8c8d8e8f"},
+		},
+		ChallengePages: &ChallengePages{Root: "/etc/caddy/pages"},
+		KeyFileSOPS:    &KeyFileSOPS{Extract: `["paseto"]["key"]`, Timeout: 10 * time.Second},
+		ClaimValues: map[string][]string{
+			"role":      {"admin", "editor", "viewer"},
+			"plan.tier": {"free", "pro"},
+		},
+		ForwardedAuthorizationProxies: []string{"10.0.0.0/8", "private_ranges"},
+		ForbidClaims:                  []string{"admin", "legacy.scope"},
+		RequireClaims: map[string][]string{
+			"env":  {"prod"},
+			"tier": {"gold", "silver"},
+		},
+		RequireScopes: map[string][]string{
+			"GET":  {"read"},
+			"POST": {"write"},
+			"PUT":  {"write", "admin"},
+		},
+		PathRequirements: []*PathRequirement{
+			{Path: "/admin/*", Scopes: []string{"admin"}, Claims: map[string][]string{"mfa": {"true"}}},
+			{Path: "/billing/*", Claims: map[string][]string{"plan.tier": {"pro", "enterprise"}}},
+		},
+		AllowRoles: []string{"admin", "editor", "viewer"},
+		DenyRoles:  []string{"suspended"},
+		RolesClaim: "realm_access.roles",
 	}
 
 	h, err := parseCaddyfile(helper)
 	assert.Nil(t, err)
-	auth, ok := h.(caddyauth.Authentication)
+	auth, ok := h.(*PasetoAuthHandler)
 	assert.True(t, ok)
 	jsonConfig, ok := auth.ProvidersRaw["paseto"]
 	assert.True(t, ok)
@@ -62,6 +395,116 @@ func TestParseCaddyfileErr(t *testing.T) {
 	`,
 			expectedErrMsg: "key is empty",
 		},
+		{
+			name: "invalid_key_not_after_time",
+			caddyfile: `
+	pasetoauth {
+		key_not_after k4.pid.abc next-year
+	}
+	`,
+			expectedErrMsg: `invalid key_not_after time: "next-year"`,
+		},
+		{
+			name: "duplicate_key_not_after",
+			caddyfile: `
+	pasetoauth {
+		key_not_after k4.pid.abc 2026-01-01
+		key_not_after k4.pid.abc 2027-01-01
+	}
+	`,
+			expectedErrMsg: "invalid key_not_after: duplicate key: k4.pid.abc",
+		},
+		{
+			name: "invalid_key_aws_refresh_interval",
+			caddyfile: `
+	pasetoauth {
+		key_aws paseto/key {
+			refresh_interval hourly
+		}
+	}
+	`,
+			expectedErrMsg: `invalid key_aws refresh_interval: "hourly"`,
+		},
+		{
+			name: "unknown_key_aws_option",
+			caddyfile: `
+	pasetoauth {
+		key_aws {
+			secret paseto/key
+		}
+	}
+	`,
+			expectedErrMsg: "unrecognized key_aws option: secret",
+		},
+		{
+			name: "unknown_key_gcp_option",
+			caddyfile: `
+	pasetoauth {
+		key_gcp paseto-key {
+			version_id 3
+		}
+	}
+	`,
+			expectedErrMsg: "unrecognized key_gcp option: version_id",
+		},
+		{
+			name: "unknown_claim_mapper",
+			caddyfile: `
+	pasetoauth {
+		claim_mapper ldap
+	}
+	`,
+			expectedErrMsg: "invalid claim_mapper: getting module named '" + claimMapperNamespace + ".ldap'",
+		},
+		{
+			name: "invalid_circuit_breaker_cooldown",
+			caddyfile: `
+	pasetoauth {
+		circuit_breaker {
+			cooldown soon
+		}
+	}
+	`,
+			expectedErrMsg: `invalid circuit_breaker cooldown: "soon"`,
+		},
+		{
+			name: "invalid_issuer",
+			caddyfile: `
+	pasetoauth {
+		issuer main partner
+	}
+	`,
+			expectedErrMsg: "invalid issuer: expected a single name",
+		},
+		{
+			name: "invalid_verify_pool_workers",
+			caddyfile: `
+	pasetoauth {
+		verify_pool {
+			workers many
+		}
+	}
+	`,
+			expectedErrMsg: `invalid verify_pool workers: "many"`,
+		},
+		{
+			name: "empty_keys",
+			caddyfile: `
+	pasetoauth {
+		keys
+	}
+	`,
+			expectedErrMsg: "keys are empty",
+		},
+		{
+			name: "invalid_key_file_interval",
+			caddyfile: `
+	pasetoauth {
+		key_file /etc/caddy/paseto.key soon
+	}
+	`,
+			expectedErrMsg: `invalid key_file interval: "soon"`,
+		},
 		{
 			name: "invalid_meta_claims-parse",
 			caddyfile: `
@@ -80,6 +523,154 @@ func TestParseCaddyfileErr(t *testing.T) {
 	`,
 			expectedErrMsg: "invalid meta_claims: duplicate claim",
 		},
+		{
+			name: "invalid_meta_claims-duplicate_repeated",
+			caddyfile: `
+	pasetoauth {
+		meta_claims IsAdmin->is_admin
+		meta_claims Gender->gender, IsAdmin->admin
+	}
+	`,
+			expectedErrMsg: "invalid meta_claims: duplicate claim",
+		},
+		{
+			name: "empty_keys_commas",
+			caddyfile: `
+	pasetoauth {
+		keys , ,
+	}
+	`,
+			expectedErrMsg: "keys are empty",
+		},
+		{
+			name: "invalid_rate_limit-no_claim",
+			caddyfile: `
+	pasetoauth {
+		rate_limit
+	}
+	`,
+			expectedErrMsg: "invalid rate_limit: expected a single claim name",
+		},
+		{
+			name: "invalid_rate_limit-tier",
+			caddyfile: `
+	pasetoauth {
+		rate_limit tier {
+			tier gold lots
+		}
+	}
+	`,
+			expectedErrMsg: `invalid rate_limit tier limit: "lots"`,
+		},
+		{
+			name: "invalid_maintenance-status",
+			caddyfile: `
+	pasetoauth {
+		maintenance {
+			status unavailable
+		}
+	}
+	`,
+			expectedErrMsg: `invalid maintenance status: "unavailable"`,
+		},
+		{
+			name: "invalid_issuer_policy-option",
+			caddyfile: `
+	pasetoauth {
+		issuer_policy https://partner.example.com {
+			allow_users alice
+		}
+	}
+	`,
+			expectedErrMsg: "unrecognized issuer_policy option: allow_users",
+		},
+		{
+			name: "invalid_issuer_policy-duplicate",
+			caddyfile: `
+	pasetoauth {
+		issuer_policy partner {
+			max_token_age 1h
+		}
+		issuer_policy partner {
+			max_token_age 2h
+		}
+	}
+	`,
+			expectedErrMsg: "invalid issuer_policy: duplicate issuer: partner",
+		},
+		{
+			name: "invalid_issuer_key-duplicate",
+			caddyfile: `
+	pasetoauth {
+		issuer_key partner {
+			key abc
+		}
+		issuer_key partner {
+			key def
+		}
+	}
+	`,
+			expectedErrMsg: "invalid issuer_key: duplicate issuer: partner",
+		},
+		{
+			name: "invalid_version_key-duplicate",
+			caddyfile: `
+	pasetoauth {
+		version_key 3 {
+			key abc
+		}
+		version_key v3 {
+			key def
+		}
+	}
+	`,
+			expectedErrMsg: "invalid version_key: duplicate version: v3",
+		},
+		{
+			name: "invalid_purpose_key-duplicate",
+			caddyfile: `
+	pasetoauth {
+		purpose_key local {
+			key abc
+		}
+		purpose_key local {
+			key def
+		}
+	}
+	`,
+			expectedErrMsg: "invalid purpose_key: duplicate purpose: local",
+		},
+		{
+			name: "invalid_replay_verifications-missing_unsafe",
+			caddyfile: `
+	pasetoauth {
+		replay_verifications {
+			max_tokens 10
+		}
+	}
+	`,
+			expectedErrMsg: "invalid replay_verifications: expected the 'unsafe' argument",
+		},
+		{
+			name: "invalid_http_signatures-option",
+			caddyfile: `
+	pasetoauth {
+		http_signatures {
+			algorithm rsa-pss-sha512
+		}
+	}
+	`,
+			expectedErrMsg: "unrecognized http_signatures option: algorithm",
+		},
+		{
+			name: "invalid_source_networks",
+			caddyfile: `
+	pasetoauth {
+		source_networks header X-Api-Key
+	}
+	`,
+			expectedErrMsg: "invalid source_networks: expected a source type, name and networks",
+		},
 		{
 			name: "unrecognized_option",
 			caddyfile: `
@@ -104,6 +695,133 @@ func TestParseCaddyfileErr(t *testing.T) {
 	}
 }
 
+func TestParseSignCaddyfile(t *testing.T) {
+	helper := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+	paseto_sign {
+		key "33e9c87f28d6384ee0a113ebe9f4ae5cc75a5c328d62245d5a3af4927ba4778f"
+		key_password {env.PASETO_KEY_PASSWORD}
+		version 4
+		purpose local
+		target request
+		header X-Webhook-Signature
+		audience https://hooks.example.com
+		issuer {host}
+		lifetime 1m
+		max_body_size 1MiB
+	}
+	`),
+	}
+	expected := &PasetoSign{
+		Key:         "33e9c87f28d6384ee0a113ebe9f4ae5cc75a5c328d62245d5a3af4927ba4778f",
+		KeyPassword: "{env.PASETO_KEY_PASSWORD}",
+		Version:     "v4",
+		Purpose:     "local",
+		Target:      "request",
+		Header:      "X-Webhook-Signature",
+		Audience:    "https://hooks.example.com",
+		Issuer:      "{host}",
+		Lifetime:    time.Minute,
+		MaxBodySize: 1 << 20,
+	}
+
+	h, err := parseSignCaddyfile(helper)
+	assert.Nil(t, err)
+	assert.Equal(t, expected, h)
+
+	helper = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+	paseto_sign {
+		max_body_size lots
+	}
+	`),
+	}
+	_, err = parseSignCaddyfile(helper)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `invalid max_body_size: "lots"`)
+
+	helper = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+	paseto_sign {
+		key_rotation {
+			interval 24h
+		}
+	}
+	`),
+	}
+	h, err = parseSignCaddyfile(helper)
+	assert.Nil(t, err)
+	assert.Equal(t, &PasetoSign{KeyRotation: &KeyRotation{Interval: 24 * time.Hour}}, h)
+
+	helper = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+	paseto_sign {
+		key_rotation {
+			interval weekly
+		}
+	}
+	`),
+	}
+	_, err = parseSignCaddyfile(helper)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), `invalid key_rotation interval: "weekly"`)
+}
+
+func TestParseClaimsCaddyfile(t *testing.T) {
+	helper := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+	paseto_claims name,roles {
+		claims profile.tier
+		claims tenant
+		max_age 5m
+	}
+	`),
+	}
+
+	h, err := parseClaimsCaddyfile(helper)
+	assert.Nil(t, err)
+	assert.Equal(t, &PasetoClaims{
+		Claims: []string{"name", "roles", "profile.tier", "tenant"},
+		MaxAge: 5 * time.Minute,
+	}, h)
+}
+
+func TestParseLogoutCaddyfile(t *testing.T) {
+	helper := httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+	paseto_logout {
+		key_url https://idp.example.com/keys 5m
+		allow_issuers https://idp.example.com
+		max_token_age 2m
+		session_storage
+	}
+	`),
+	}
+
+	h, err := parseLogoutCaddyfile(helper)
+	assert.Nil(t, err)
+	assert.Equal(t, &PasetoLogout{
+		Verifier: PasetoAuth{
+			KeyURL:         "https://idp.example.com/keys",
+			KeyURLInterval: 5 * time.Minute,
+			AllowIssuers:   []string{"https://idp.example.com"},
+			MaxTokenAge:    2 * time.Minute,
+		},
+		SessionStorage: true,
+	}, h)
+
+	helper = httpcaddyfile.Helper{
+		Dispenser: caddyfile.NewTestDispenser(`
+	paseto_logout {
+		from_query logout_token
+	}
+	`),
+	}
+	_, err = parseLogoutCaddyfile(helper)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "unrecognized option: from_query")
+}
+
 func TestParseMetaClaim(t *testing.T) {
 	tests := []struct {
 		Key         string
@@ -0,0 +1,213 @@
+package caddypaseto
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// The reasons of rejected requests, for which challenge pages can be served.
+const (
+	// challengeLogin is the reason of requests without a valid token.
+	challengeLogin = "login"
+	// challengeExpired is the reason of requests whose token expired.
+	challengeExpired = "expired"
+	// challengeForbidden is the reason of requests whose token is valid, but
+	// isn't allowed, e.g. because of its claims.
+	challengeForbidden = "forbidden"
+)
+
+// ChallengePages serves HTML pages to rejected requests, instead of the bare
+// 401 response, for user-facing sites. The pages are Go HTML templates, chosen
+// by the reason of the rejection and the Accept-Language header of the request.
+//
+// The templates are named after the reason, and optionally a language tag:
+// "<reason>[.<language>].html", e.g. "expired.html" or "expired.de.html". The
+// reasons are:
+//
+//   - login: the request has no valid token. The status code is 401.
+//   - expired: the token has expired. The status code is 401.
+//   - forbidden: the token is valid, but isn't allowed, e.g. because of its
+//     claims. The status code is 403.
+//
+// Each reason with pages must have a page without a language, which is served
+// when none of the languages of the request are available. Reasons without
+// pages get the default response.
+//
+// The templates can use these fields:
+//
+//   - {{.Reason}}: the reason of the rejection.
+//   - {{.Language}}: the language tag of the page, empty for the page without a
+//     language.
+//   - {{.Claims}}: the claims of the rejected token, e.g. {{.Claims.sub}}. It's
+//     empty for the login reason.
+//
+// And the placeholder function, that returns the value of a placeholder of
+// the request, e.g. {{placeholder "http.request.uri"}}.
+type ChallengePages struct {
+	// Root is the directory of the templates.
+	Root string `json:"root"`
+
+	pages map[string]*challengePage
+}
+
+// challengePage is the templates of a reason.
+type challengePage struct {
+	// languages are the languages of the templates. The first one is
+	// language.Und, i.e. the template without a language.
+	languages []language.Tag
+	templates []*template.Template
+	matcher   language.Matcher
+}
+
+// challengeData is the data of the challenge page templates.
+type challengeData struct {
+	Reason   string
+	Language string
+	Claims   map[string]any
+}
+
+func (cp *ChallengePages) provision() error {
+	if cp.Root == "" {
+		return fmt.Errorf("invalid challenge_pages: root is empty")
+	}
+	entries, err := os.ReadDir(cp.Root)
+	if err != nil {
+		return fmt.Errorf("invalid challenge_pages: %w", err)
+	}
+
+	cp.pages = make(map[string]*challengePage)
+	langTemplates := make(map[string][]*template.Template)
+	langs := make(map[string][]language.Tag)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || filepath.Ext(name) != ".html" {
+			continue
+		}
+		reason, lang, _ := strings.Cut(strings.TrimSuffix(name, ".html"), ".")
+		if reason != challengeLogin && reason != challengeExpired && reason != challengeForbidden {
+			return fmt.Errorf("invalid challenge page '%s': unknown reason: '%s'", name, reason)
+		}
+		tmpl, parseErr := parseChallengeTemplate(filepath.Join(cp.Root, name))
+		if parseErr != nil {
+			return fmt.Errorf("invalid challenge page '%s': %w", name, parseErr)
+		}
+		if lang == "" {
+			page := &challengePage{}
+			page.languages = append(page.languages, language.Und)
+			page.templates = append(page.templates, tmpl)
+			cp.pages[reason] = page
+			continue
+		}
+		tag, tagErr := language.Parse(lang)
+		if tagErr != nil {
+			return fmt.Errorf("invalid challenge page '%s': invalid language: '%s'", name, lang)
+		}
+		langs[reason] = append(langs[reason], tag)
+		langTemplates[reason] = append(langTemplates[reason], tmpl)
+	}
+
+	for reason, tags := range langs {
+		page, ok := cp.pages[reason]
+		if !ok {
+			return fmt.Errorf("invalid challenge_pages: missing the %s page without a language: '%s.html'",
+				reason, reason)
+		}
+		page.languages = append(page.languages, tags...)
+		page.templates = append(page.templates, langTemplates[reason]...)
+	}
+	for _, page := range cp.pages {
+		page.matcher = language.NewMatcher(page.languages)
+	}
+
+	return nil
+}
+
+func parseChallengeTemplate(path string) (*template.Template, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // The path is from the configuration.
+	if err != nil {
+		return nil, fmt.Errorf("failed reading template: %w", err)
+	}
+	// The placeholder function is replaced with the one of the request.
+	tmpl, err := template.New(filepath.Base(path)).
+		Funcs(template.FuncMap{"placeholder": func(string) string { return "" }}).
+		Parse(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed parsing template: %w", err)
+	}
+
+	return tmpl, nil
+}
+
+// challengeReason returns the reason of the rejection of a request, from the
+// last token that was verified, but rejected, if any.
+func challengeReason(rejected *xpaseto.Token, now time.Time, skew time.Duration) string {
+	if rejected == nil {
+		return challengeLogin
+	}
+	if exp, err := rejected.GetExpiration(); err == nil && now.After(exp.Add(skew)) {
+		return challengeExpired
+	}
+	return challengeForbidden
+}
+
+// serve writes the challenge page of the reason, in the language of the
+// request. It returns false if there's no page for the reason, or the page
+// couldn't be rendered, so that the default response is sent.
+func (cp *ChallengePages) serve(
+	w http.ResponseWriter, r *http.Request, reason string, claims map[string]any, logger *slog.Logger,
+) bool {
+	page, ok := cp.pages[reason]
+	if !ok {
+		return false
+	}
+
+	accepted, _, _ := language.ParseAcceptLanguage(r.Header.Get("Accept-Language"))
+	_, idx, conf := page.matcher.Match(accepted...)
+	if conf == language.No {
+		idx = 0
+	}
+	data := challengeData{Reason: reason, Claims: claims}
+	if idx > 0 {
+		data.Language = page.languages[idx].String()
+	}
+
+	repl := getReplacer(r)
+	tmpl, err := page.templates[idx].Clone()
+	if err != nil {
+		logger.Error("failed rendering challenge page", "reason", reason, "error", err.Error())
+		return false
+	}
+	tmpl.Funcs(template.FuncMap{"placeholder": func(name string) string {
+		return repl.ReplaceAll("{"+name+"}", "")
+	}})
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, data); err != nil {
+		logger.Error("failed rendering challenge page", "reason", reason, "error", err.Error())
+		return false
+	}
+
+	status := http.StatusUnauthorized
+	if reason == challengeForbidden {
+		status = http.StatusForbidden
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Add("Vary", "Accept-Language")
+	if data.Language != "" {
+		w.Header().Set("Content-Language", data.Language)
+	}
+	writeRejection(w, status, buf.String())
+
+	return true
+}
@@ -0,0 +1,151 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func writeChallengePages(t *testing.T, pages map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, content := range pages {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600))
+	}
+	return dir
+}
+
+func TestPasetoAuth_AuthenticateChallengePages(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	dir := writeChallengePages(t, map[string]string{
+		"login.html":     `login {{placeholder "http.request.uri.path"}}`,
+		"login.de.html":  `anmelden {{.Language}}`,
+		"expired.html":   `expired {{.Claims.sub}}`,
+		"forbidden.html": `forbidden {{.Reason}} {{.Claims.sub}}`,
+	})
+
+	auth := &PasetoAuth{
+		Key:            key.Public().ExportHex(),
+		AllowAudiences: []string{"api"},
+		FromQuery:      []string{"token"},
+		ChallengePages: &ChallengePages{Root: dir},
+		logger:         slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	newToken := func(aud string, exp time.Time) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(exp.Add(-2 * time.Hour))
+		token.SetNotBefore(exp.Add(-2 * time.Hour))
+		token.SetExpiration(exp)
+		token.SetAudience(aud)
+		token.SetSubject("user123")
+		return token.V4Sign(key, nil)
+	}
+
+	tests := []struct {
+		name       string
+		query      string
+		acceptLang string
+		expStatus  int
+		expBody    string
+		expLang    string
+	}{
+		{name: "ok/login", expStatus: http.StatusUnauthorized, expBody: "login /app"},
+		{
+			name: "ok/login_language", acceptLang: "fr;q=0.9, de-CH",
+			expStatus: http.StatusUnauthorized, expBody: "anmelden de", expLang: "de",
+		},
+		{
+			name: "ok/login_other_language", acceptLang: "fr",
+			expStatus: http.StatusUnauthorized, expBody: "login /app",
+		},
+		{
+			name: "ok/login_invalid_token", query: "?token=v4.public.invalid",
+			expStatus: http.StatusUnauthorized, expBody: "login /app",
+		},
+		{
+			name: "ok/expired", query: "?token=" + newToken("api", time.Now().Add(-time.Hour)),
+			expStatus: http.StatusUnauthorized, expBody: "expired user123",
+		},
+		{
+			name: "ok/forbidden", query: "?token=" + newToken("other", time.Now().Add(time.Hour)),
+			expStatus: http.StatusForbidden, expBody: "forbidden forbidden user123",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/app"+tt.query, nil)
+			if tt.acceptLang != "" {
+				req.Header.Set("Accept-Language", tt.acceptLang)
+			}
+			caddyhttp.NewTestReplacer(req)
+			w := httptest.NewRecorder()
+			_, authenticated, err := auth.Authenticate(w, req)
+			require.NoError(t, err)
+			assert.False(t, authenticated)
+			assert.Equal(t, tt.expStatus, w.Code)
+			assert.Equal(t, tt.expBody, w.Body.String())
+			assert.Equal(t, "text/html; charset=utf-8", w.Header().Get("Content-Type"))
+			assert.Equal(t, tt.expLang, w.Header().Get("Content-Language"))
+			assert.Equal(t, "Accept-Language", w.Header().Get("Vary"))
+		})
+	}
+}
+
+func TestChallengePages_Provision(t *testing.T) {
+	tests := []struct {
+		name   string
+		pages  map[string]string
+		expErr string
+	}{
+		{
+			name:  "ok/partial",
+			pages: map[string]string{"login.html": "login", "style.css": "body {}"},
+		},
+		{
+			name:   "err/unknown_reason",
+			pages:  map[string]string{"denied.html": "denied"},
+			expErr: "invalid challenge page 'denied.html': unknown reason: 'denied'",
+		},
+		{
+			name:   "err/invalid_language",
+			pages:  map[string]string{"login.html": "login", "login.not_a_tag!.html": "login"},
+			expErr: "invalid challenge page 'login.not_a_tag!.html': invalid language: 'not_a_tag!'",
+		},
+		{
+			name:   "err/missing_fallback",
+			pages:  map[string]string{"expired.de.html": "abgelaufen"},
+			expErr: "invalid challenge_pages: missing the expired page without a language: 'expired.html'",
+		},
+		{
+			name:   "err/invalid_template",
+			pages:  map[string]string{"login.html": "{{.Reason"},
+			expErr: "invalid challenge page 'login.html': failed parsing template",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cp := &ChallengePages{Root: writeChallengePages(t, tt.pages)}
+			err := cp.provision()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
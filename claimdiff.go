@@ -0,0 +1,185 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// claimHistoryTTL is how long the claims of a user's latest token are kept
+// after the user was last seen. It's longer than typical token lifetimes, so
+// that renewals with a refresh token after the access token expired are still
+// compared.
+const claimHistoryTTL = 24 * time.Hour
+
+// claimEntry holds the tracked claims of the latest token of a user.
+type claimEntry struct {
+	issuedAt time.Time
+	lastSeen time.Time
+	claims   map[string]any
+}
+
+// claimHistory keeps the tracked claims of the latest token of each user, so
+// that changes between successive tokens can be logged.
+type claimHistory struct {
+	mu        sync.Mutex
+	entries   map[string]*claimEntry
+	lastSweep time.Time
+}
+
+// sharedClaimHistory is the claim history shared by all module instances, so
+// that changes are detected consistently across sites and config reloads.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var sharedClaimHistory = newClaimHistory()
+
+func newClaimHistory() *claimHistory {
+	return &claimHistory{entries: make(map[string]*claimEntry)}
+}
+
+// swap stores the claims of a token issued at issuedAt, and returns the claims
+// of the previous token of the key. It returns false if there's no previous
+// token, or if the token isn't newer than the stored one, in which case the
+// stored claims are kept.
+func (h *claimHistory) swap(key string, issuedAt time.Time, claims map[string]any, now time.Time) (
+	map[string]any, bool,
+) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.sweep(now)
+
+	entry, ok := h.entries[key]
+	if !ok {
+		h.entries[key] = &claimEntry{issuedAt: issuedAt, lastSeen: now, claims: claims}
+		return nil, false
+	}
+	entry.lastSeen = now
+	if !issuedAt.After(entry.issuedAt) {
+		return nil, false
+	}
+
+	prev := entry.claims
+	entry.issuedAt, entry.claims = issuedAt, claims
+
+	return prev, true
+}
+
+// sweep removes the entries of users that weren't seen for claimHistoryTTL,
+// at most once per minute.
+func (h *claimHistory) sweep(now time.Time) {
+	if now.Sub(h.lastSweep) < time.Minute {
+		return
+	}
+	for key, entry := range h.entries {
+		if now.Sub(entry.lastSeen) > claimHistoryTTL {
+			delete(h.entries, key)
+		}
+	}
+	h.lastSweep = now
+}
+
+// logClaimChanges logs the changes of the tracked claims between the previous
+// token of the user and this one, e.g. roles granted by a token renewal.
+// Tokens without an "iat" claim are ignored, since their order can't be
+// determined.
+func (p *PasetoAuth) logClaimChanges(token *xpaseto.Token, userID string, now time.Time, logger *slog.Logger) {
+	if len(p.LogClaimChanges) == 0 {
+		return
+	}
+	issuedAt, err := token.GetIssuedAt()
+	if err != nil {
+		return
+	}
+
+	claims := make(map[string]any, len(p.LogClaimChanges))
+	for _, name := range p.LogClaimChanges {
+		if val, ok := getClaim(token.ClaimsRaw(), name); ok {
+			claims[name] = p.redact(name, val)
+		}
+	}
+
+	// Sites tracking different claims must not compare each other's entries.
+	key := userID + "\x00" + strings.Join(p.LogClaimChanges, ",")
+	prev, ok := p.claimHistory.swap(key, issuedAt, claims, now)
+	if !ok {
+		return
+	}
+	if changes := diffClaims(p.LogClaimChanges, prev, claims); len(changes) > 0 {
+		logger.Info("user claims changed since the previous token", changes...)
+	}
+}
+
+// diffClaims returns a log attribute group for each of the named claims whose
+// value differs between the old and new claims. Elements added to or removed
+// from list claims are logged as "added" and "removed", and other values as
+// "old" and "new", which are omitted if the claim is missing.
+func diffClaims(names []string, oldClaims, newClaims map[string]any) []any {
+	var changes []any
+	for _, name := range names {
+		oldVal, hadOld := oldClaims[name]
+		newVal, hasNew := newClaims[name]
+		if hadOld == hasNew && stringify(oldVal) == stringify(newVal) {
+			continue
+		}
+
+		oldList, oldIsList := oldVal.([]any)
+		newList, newIsList := newVal.([]any)
+		if (oldIsList || !hadOld) && (newIsList || !hasNew) {
+			added, removed := diffLists(oldList, newList)
+			var attrs []any
+			if len(added) > 0 {
+				attrs = append(attrs, "added", added)
+			}
+			if len(removed) > 0 {
+				attrs = append(attrs, "removed", removed)
+			}
+			if len(attrs) > 0 {
+				changes = append(changes, slog.Group(name, attrs...))
+			}
+			continue
+		}
+
+		var attrs []any
+		if hadOld {
+			attrs = append(attrs, "old", oldVal)
+		}
+		if hasNew {
+			attrs = append(attrs, "new", newVal)
+		}
+		changes = append(changes, slog.Group(name, attrs...))
+	}
+
+	return changes
+}
+
+// diffLists returns the elements of newList that aren't in oldList, and the
+// elements of oldList that aren't in newList, compared by their string values.
+func diffLists(oldList, newList []any) ([]string, []string) {
+	oldVals := make([]string, 0, len(oldList))
+	for _, val := range oldList {
+		oldVals = append(oldVals, stringify(val))
+	}
+	newVals := make([]string, 0, len(newList))
+	for _, val := range newList {
+		newVals = append(newVals, stringify(val))
+	}
+
+	var added, removed []string
+	for _, val := range newVals {
+		if !slices.Contains(oldVals, val) && !slices.Contains(added, val) {
+			added = append(added, val)
+		}
+	}
+	for _, val := range oldVals {
+		if !slices.Contains(newVals, val) && !slices.Contains(removed, val) {
+			removed = append(removed, val)
+		}
+	}
+
+	return added, removed
+}
@@ -0,0 +1,128 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateLogClaimChanges(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:             v4PrivateKey.Public().ExportHex(),
+		FromQuery:       []string{"token"},
+		LogClaimChanges: []string{"roles", "profile.tier", "email"},
+		claimHistory:    newClaimHistory(),
+		logger:          slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	issuedAt := time.Now().Add(-time.Hour)
+	authenticate := func(iat time.Time, claims map[string]any) {
+		t.Helper()
+		token := paseto.NewToken()
+		token.SetIssuedAt(iat)
+		token.SetNotBefore(iat)
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		for key, val := range claims {
+			require.NoError(t, token.Set(key, val))
+		}
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+	}
+	changes := func() []testutil.TestLogRecord {
+		var records []testutil.TestLogRecord
+		for _, record := range logHandler.Records() {
+			if record.Message == "user claims changed since the previous token" {
+				records = append(records, record)
+			}
+		}
+		return records
+	}
+
+	first := map[string]any{
+		"roles":   []string{"dev", "viewer"},
+		"profile": map[string]any{"tier": "free"},
+		"email":   "user@example.com",
+	}
+	authenticate(issuedAt, first)
+	assert.Empty(t, changes())
+
+	// The same token, or a token with unchanged claims, isn't logged.
+	authenticate(issuedAt, first)
+	authenticate(issuedAt.Add(time.Minute), first)
+	assert.Empty(t, changes())
+
+	authenticate(issuedAt.Add(2*time.Minute), map[string]any{
+		"roles":   []string{"viewer", "admin"},
+		"profile": map[string]any{"tier": "gold"},
+	})
+	records := changes()
+	require.Len(t, records, 1)
+	assert.Equal(t, slog.LevelInfo, records[0].Level)
+
+	attrs := make(map[string]any)
+	for _, attr := range records[0].Attrs {
+		attrs[attr.Key] = attr.Value
+	}
+	assert.Equal(t, "user123", attrs["user_id"])
+	assert.Equal(t, map[string]any{"added": []string{"admin"}, "removed": []string{"dev"}}, attrs["roles"])
+	assert.Equal(t, map[string]any{"old": "free", "new": "gold"}, attrs["profile.tier"])
+	assert.Equal(t, map[string]any{"old": "user@example.com"}, attrs["email"])
+
+	// An older token still in use doesn't replace the latest claims.
+	authenticate(issuedAt, first)
+	assert.Len(t, changes(), 1)
+}
+
+func TestDiffClaims(t *testing.T) {
+	tests := []struct {
+		name       string
+		oldClaims  map[string]any
+		newClaims  map[string]any
+		expChanges []any
+	}{
+		{
+			name:      "ok/unchanged",
+			oldClaims: map[string]any{"roles": []any{"a", "b"}, "tier": "gold"},
+			newClaims: map[string]any{"roles": []any{"b", "a"}, "tier": "gold"},
+		},
+		{
+			name:       "ok/list_added",
+			oldClaims:  map[string]any{},
+			newClaims:  map[string]any{"roles": []any{"a", "a"}},
+			expChanges: []any{slog.Group("roles", "added", []string{"a"})},
+		},
+		{
+			name:       "ok/scalar_to_list",
+			oldClaims:  map[string]any{"roles": "a"},
+			newClaims:  map[string]any{"roles": []any{"a", "b"}},
+			expChanges: []any{slog.Group("roles", "old", "a", "new", []any{"a", "b"})},
+		},
+		{
+			name:       "ok/tier_added",
+			oldClaims:  map[string]any{},
+			newClaims:  map[string]any{"tier": "gold"},
+			expChanges: []any{slog.Group("tier", "new", "gold")},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expChanges, diffClaims([]string{"roles", "tier"}, tt.oldClaims, tt.newClaims))
+		})
+	}
+}
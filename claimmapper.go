@@ -0,0 +1,90 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+)
+
+// claimMapperNamespace is the module namespace of claim mappers.
+const claimMapperNamespace = "http.authentication.providers.paseto.claim_mappers"
+
+// ClaimMapper derives the user ID and metadata from the claims of a verified
+// token. It's implemented by guest modules in the
+// "http.authentication.providers.paseto.claim_mappers" namespace, for identity
+// models that can't be expressed with user_claims and meta_claims, e.g.
+// composite tenant IDs, or legacy IDs that must be looked up.
+//
+// MapClaims is called concurrently, only after the token was verified, and
+// before the allow_users, session and rate limit checks. An empty user ID or an
+// error rejects the token. The returned metadata is added to the metadata from
+// meta_claims, and overrides it.
+type ClaimMapper interface {
+	MapClaims(r *http.Request, claims map[string]any) (userID string, metadata map[string]string, err error)
+}
+
+// mappedUser is the user derived from the claims of a verified token.
+type mappedUser struct {
+	// claim is the name of the claim the ID was read from, or empty if the ID
+	// was derived by the claim mapper.
+	claim    string
+	id       string
+	metadata map[string]string
+	// route is the value of the route claim, if it's configured.
+	route string
+}
+
+// mapUser derives the user from the token claims, either with the claim
+// mapper, or with the user claims if no claim mapper is configured.
+func (p *PasetoAuth) mapUser(r *http.Request, claims map[string]any) (mappedUser, error) {
+	if p.claimMapper == nil {
+		claimName, userID := getUserID(claims, p.userClaims)
+		return mappedUser{claim: claimName, id: userID}, nil
+	}
+
+	userID, metadata, err := p.claimMapper.MapClaims(r, claims)
+	if err != nil {
+		return mappedUser{}, fmt.Errorf("failed mapping claims: %w", err)
+	}
+
+	return mappedUser{id: userID, metadata: metadata}, nil
+}
+
+// loadClaimMapper loads the claim mapper guest module, if it's configured.
+func (p *PasetoAuth) loadClaimMapper(ctx caddy.Context) error {
+	if p.ClaimMapperRaw == nil {
+		return nil
+	}
+
+	mod, err := ctx.LoadModule(p, "ClaimMapperRaw")
+	if err != nil {
+		return fmt.Errorf("failed loading claim mapper: %w", err)
+	}
+	mapper, ok := mod.(ClaimMapper)
+	if !ok {
+		return fmt.Errorf("invalid claim mapper: module %T doesn't implement ClaimMapper", mod)
+	}
+	p.claimMapper = mapper
+
+	return nil
+}
+
+// parseClaimMapper parses the claim_mapper option, which is the name of the
+// claim mapper module, followed by its own Caddyfile tokens.
+func parseClaimMapper(h httpcaddyfile.Helper) ([]byte, error) {
+	if !h.NextArg() {
+		return nil, h.Errf("invalid claim_mapper: expected a module name")
+	}
+	name := h.Val()
+
+	unm, err := caddyfile.UnmarshalModule(h.Dispenser, claimMapperNamespace+"."+name)
+	if err != nil {
+		return nil, fmt.Errorf("invalid claim_mapper: %w", err)
+	}
+
+	return caddyconfig.JSONModuleObject(unm, "mapper", name, nil), nil
+}
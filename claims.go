@@ -0,0 +1,107 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(PasetoClaims{})
+}
+
+// claimsVarKey is the key of the request variable that contains the claims of
+// the authenticated token.
+const claimsVarKey = "paseto.claims"
+
+// PasetoClaims is an HTTP handler that responds with a display-safe subset of
+// the claims of the token authenticated by pasetoauth, and its expiration time,
+// as JSON. It allows frontend applications to bootstrap their UI state without
+// parsing tokens.
+//
+// The response is cacheable by the client until the token expires.
+type PasetoClaims struct {
+	// Claims defines the list of token claim names to include in the response.
+	// Nested claim paths are supported with dot notation. Claims that aren't
+	// present in the token are omitted.
+	Claims []string `json:"claims"`
+
+	// MaxAge is the maximum amount of time the response can be cached by the
+	// client. By default, it can be cached until the token expires.
+	MaxAge time.Duration `json:"max_age"`
+}
+
+var (
+	_ caddy.Validator             = (*PasetoClaims)(nil)
+	_ caddyhttp.MiddlewareHandler = (*PasetoClaims)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (PasetoClaims) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.paseto_claims",
+		New: func() caddy.Module { return new(PasetoClaims) },
+	}
+}
+
+// Validate validates that the module has a usable config.
+func (c *PasetoClaims) Validate() error {
+	if len(c.Claims) == 0 {
+		return fmt.Errorf("claims are empty")
+	}
+	if c.MaxAge < 0 {
+		return fmt.Errorf("invalid max age: '%s'", c.MaxAge)
+	}
+
+	return nil
+}
+
+// claimsSnapshot is the response body of PasetoClaims.
+type claimsSnapshot struct {
+	Claims    map[string]any `json:"claims"`
+	ExpiresAt *time.Time     `json:"expires_at"`
+}
+
+// ServeHTTP responds with the claims of the authenticated token. It doesn't
+// call the next handler.
+func (c *PasetoClaims) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	claims, ok := caddyhttp.GetVar(r.Context(), claimsVarKey).(map[string]any)
+	if !ok {
+		return caddyhttp.Error(http.StatusUnauthorized, fmt.Errorf("request is not authenticated with a token"))
+	}
+
+	snapshot := claimsSnapshot{Claims: make(map[string]any)}
+	for _, name := range c.Claims {
+		if val, found := getClaim(claims, name); found {
+			snapshot.Claims[name] = val
+		}
+	}
+
+	now := time.Now()
+	maxAge := c.MaxAge
+	if exp, err := time.Parse(time.RFC3339, stringify(claims["exp"])); err == nil {
+		snapshot.ExpiresAt = &exp
+		if remaining := exp.Sub(now); maxAge == 0 || remaining < maxAge {
+			maxAge = max(0, remaining)
+		}
+	}
+
+	body, err := json.Marshal(snapshot)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, fmt.Errorf("failed encoding claims: %w", err))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(maxAge.Seconds())))
+	w.Header().Add("Vary", "Authorization, Cookie")
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(body)
+
+	//nolint:wrapcheck // the write error is returned as is
+	return err
+}
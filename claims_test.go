@@ -0,0 +1,95 @@
+package caddypaseto
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoClaims_ServeHTTP(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	exp := time.Now().Add(time.Hour).Truncate(time.Second)
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(exp)
+	token.SetSubject("user123")
+	token.SetString("name", "Alice")
+	token.SetString("email", "alice@example.com")
+	require.NoError(t, token.Set("profile", map[string]any{"tier": "gold"}))
+	require.NoError(t, token.Set("roles", []string{"admin", "dev"}))
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	auth := &PasetoAuth{
+		Key:        v4PublicKey.ExportHex(),
+		FromHeader: []string{"X-Token"},
+		logger:     slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	handler := &PasetoClaims{Claims: []string{"name", "roles", "profile.tier", "missing"}}
+	require.NoError(t, handler.Validate())
+
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]any))
+		return req.WithContext(ctx)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		req := newRequest()
+		req.Header.Set("X-Token", tokenStr)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, handler.ServeHTTP(rec, req, nil))
+
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Regexp(t, `^private, max-age=3\d{3}$`, rec.Header().Get("Cache-Control"))
+
+		var snapshot claimsSnapshot
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &snapshot))
+		assert.Equal(t, map[string]any{
+			"name":         "Alice",
+			"roles":        []any{"admin", "dev"},
+			"profile.tier": "gold",
+		}, snapshot.Claims)
+		require.NotNil(t, snapshot.ExpiresAt)
+		assert.True(t, exp.Equal(*snapshot.ExpiresAt))
+	})
+
+	t.Run("ok/max_age", func(t *testing.T) {
+		req := newRequest()
+		req.Header.Set("X-Token", tokenStr)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+
+		rec := httptest.NewRecorder()
+		h := &PasetoClaims{Claims: []string{"name"}, MaxAge: time.Minute}
+		require.NoError(t, h.ServeHTTP(rec, req, nil))
+		assert.Equal(t, "private, max-age=60", rec.Header().Get("Cache-Control"))
+	})
+
+	t.Run("err/unauthenticated", func(t *testing.T) {
+		err := handler.ServeHTTP(httptest.NewRecorder(), newRequest(), nil)
+		var handlerErr caddyhttp.HandlerError
+		require.ErrorAs(t, err, &handlerErr)
+		assert.Equal(t, http.StatusUnauthorized, handlerErr.StatusCode)
+	})
+}
@@ -0,0 +1,102 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Preflight configures the handling of CORS preflight requests. Browsers don't
+// attach credentials to preflight requests, so they would otherwise always fail
+// authentication, and break CORS for protected resources.
+type Preflight struct {
+	// Origins restricts the origins whose preflight requests are allowed through
+	// without authentication. An origin can contain a single "*" wildcard in the
+	// host, e.g. "https://*.example.com", and the value "*" matches any origin.
+	// If empty, preflight requests from any origin are allowed.
+	Origins []string `json:"origins"`
+}
+
+func (pf *Preflight) provision() error {
+	if err := normOrigins(pf.Origins); err != nil {
+		return fmt.Errorf("invalid preflight: %w", err)
+	}
+
+	return nil
+}
+
+// allows reports whether the request is a CORS preflight request from an
+// allowed origin.
+func (pf *Preflight) allows(r *http.Request) bool {
+	if !isPreflight(r) {
+		return false
+	}
+	if len(pf.Origins) == 0 {
+		return true
+	}
+
+	origin := strings.ToLower(r.Header.Get("Origin"))
+	return slices.ContainsFunc(pf.Origins, func(allowed string) bool {
+		return matchOrigin(allowed, origin)
+	})
+}
+
+// setCORSHints sets the CORS response headers that allow the client to read the
+// response, if the request is a cross-origin request from one of the origins.
+func setCORSHints(w http.ResponseWriter, r *http.Request, origins []string) {
+	origin := r.Header.Get("Origin")
+	if origin == "" || len(origins) == 0 {
+		return
+	}
+
+	lowerOrigin := strings.ToLower(origin)
+	if !slices.ContainsFunc(origins, func(allowed string) bool {
+		return matchOrigin(allowed, lowerOrigin)
+	}) {
+		return
+	}
+
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	w.Header().Set("Access-Control-Allow-Credentials", "true")
+	w.Header().Add("Vary", "Origin")
+}
+
+// normOrigins validates and lowercases the origin patterns in place.
+func normOrigins(origins []string) error {
+	for i, origin := range origins {
+		norm := strings.ToLower(strings.TrimSpace(origin))
+		if norm == "" || strings.Count(norm, "*") > 1 {
+			return fmt.Errorf("invalid origin: '%s'", origin)
+		}
+		origins[i] = norm
+	}
+
+	return nil
+}
+
+// isPreflight reports whether the request is a CORS preflight request.
+func isPreflight(r *http.Request) bool {
+	return r.Method == http.MethodOptions &&
+		r.Header.Get("Origin") != "" &&
+		r.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// matchOrigin reports whether the origin matches the allowed origin pattern.
+// Both values must be lowercase.
+func matchOrigin(allowed, origin string) bool {
+	if allowed == "*" || allowed == origin {
+		return true
+	}
+
+	prefix, suffix, found := strings.Cut(allowed, "*")
+	if !found || len(origin) < len(prefix)+len(suffix) {
+		return false
+	}
+
+	// The wildcard must match at least one character, and not span past the
+	// host, e.g. "https://*.example.com" mustn't match "https://evil.com/.example.com".
+	wild := origin[len(prefix) : len(origin)-len(suffix)]
+	return strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) &&
+		wild != "" && !strings.ContainsAny(wild, "/:")
+}
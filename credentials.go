@@ -0,0 +1,86 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+)
+
+const (
+	// credentialsDirEnv is the environment variable that systemd sets to the
+	// directory of the service credentials, see systemd.exec(5).
+	credentialsDirEnv = "CREDENTIALS_DIRECTORY"
+	// dockerSecretsDir is the directory where Docker mounts secrets.
+	dockerSecretsDir = "/run/secrets"
+)
+
+// Permission bits that credential files must not have. systemd credentials are
+// only readable by the service, but Docker mounts secrets with mode 0444 by
+// default, so only write access is rejected for them.
+const (
+	credentialPermMask   fs.FileMode = 0o027
+	dockerSecretPermMask fs.FileMode = 0o022
+)
+
+// findCredential returns the path of the named credential, which is looked up
+// in the systemd credentials directory first, and then in the Docker secrets
+// directory. The file must not be writable by the group or others, and
+// systemd credentials must not be readable by others either.
+func findCredential(name string) (string, error) {
+	if name == "" || name != filepath.Base(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid key credential '%s': must be a file name", name)
+	}
+
+	var dirs []string
+	if dir := os.Getenv(credentialsDirEnv); dir != "" {
+		dirs = append(dirs, dir)
+	}
+	dirs = append(dirs, dockerSecretsDir)
+
+	for _, dir := range dirs {
+		path := filepath.Join(dir, name)
+		info, err := os.Stat(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return "", fmt.Errorf("failed reading key credential: %w", err)
+		}
+		mask := credentialPermMask
+		if dir == dockerSecretsDir {
+			mask = dockerSecretPermMask
+		}
+		if err = checkCredentialMode(path, info, mask); err != nil {
+			return "", err
+		}
+
+		return path, nil
+	}
+
+	return "", fmt.Errorf("key credential '%s' not found in $%s or %s", name, credentialsDirEnv, dockerSecretsDir)
+}
+
+// checkCredentialMode checks that the credential is a regular file without any
+// of the permission bits of mask.
+func checkCredentialMode(path string, info fs.FileInfo, mask fs.FileMode) error {
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("invalid key credential '%s': not a regular file", path)
+	}
+	// Windows doesn't support Unix permission bits.
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	perm := info.Mode().Perm()
+	switch {
+	case perm&mask&0o022 != 0:
+		return fmt.Errorf("invalid key credential '%s': permissions %#o are too open; "+
+			"it must not be writable by the group or others, e.g. 0400", path, perm)
+	case perm&mask != 0:
+		return fmt.Errorf("invalid key credential '%s': permissions %#o are too open; "+
+			"it must not be writable by the group or others, nor readable by others, e.g. 0400", path, perm)
+	}
+
+	return nil
+}
@@ -0,0 +1,111 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestFindCredential(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(credentialsDirEnv, dir)
+
+	writeCredential := func(name string, mode os.FileMode) string {
+		path := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(path, []byte("secret"), mode))
+		require.NoError(t, os.Chmod(path, mode))
+		return path
+	}
+	okPath := writeCredential("ok.key", 0o400)
+	groupPath := writeCredential("group.key", 0o440)
+	writeCredential("open.key", 0o644)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "dir.key"), 0o700))
+
+	tests := []struct {
+		name    string
+		expPath string
+		expErr  string
+	}{
+		{name: "ok.key", expPath: okPath},
+		{name: "group.key", expPath: groupPath},
+		{name: "open.key", expErr: "permissions 0644 are too open"},
+		{name: "dir.key", expErr: "not a regular file"},
+		{name: "missing.key", expErr: "key credential 'missing.key' not found in $CREDENTIALS_DIRECTORY or /run/secrets"},
+		{name: "../ok.key", expErr: "invalid key credential '../ok.key': must be a file name"},
+		{name: "..", expErr: "invalid key credential '..': must be a file name"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path, err := findCredential(tt.name)
+			if tt.expErr != "" {
+				require.ErrorContains(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expPath, path)
+		})
+	}
+}
+
+func TestCheckCredentialMode(t *testing.T) {
+	dir := t.TempDir()
+
+	tests := []struct {
+		name   string
+		mode   os.FileMode
+		mask   os.FileMode
+		expErr string
+	}{
+		{name: "ok/credential", mode: 0o400, mask: credentialPermMask},
+		{name: "ok/docker_default", mode: 0o444, mask: dockerSecretPermMask},
+		{name: "ok/docker_restricted", mode: 0o400, mask: dockerSecretPermMask},
+		{name: "err/credential_world_readable", mode: 0o444, mask: credentialPermMask, expErr: "nor readable by others"},
+		{name: "err/docker_group_writable", mode: 0o464, mask: dockerSecretPermMask, expErr: "permissions 0464"},
+		{name: "err/docker_world_writable", mode: 0o446, mask: dockerSecretPermMask, expErr: "permissions 0446"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, filepath.Base(tt.name))
+			require.NoError(t, os.WriteFile(path, []byte("secret"), tt.mode))
+			require.NoError(t, os.Chmod(path, tt.mode))
+			info, err := os.Stat(path)
+			require.NoError(t, err)
+
+			err = checkCredentialMode(path, info, tt.mask)
+			if tt.expErr != "" {
+				require.ErrorContains(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateKeyCredential(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv(credentialsDirEnv, dir)
+
+	key := paseto.NewV4AsymmetricSecretKey().Public()
+	path := filepath.Join(dir, "paseto.key")
+	require.NoError(t, os.WriteFile(path, []byte(key.ExportHex()), 0o400))
+
+	auth := &PasetoAuth{
+		KeyCredential: "paseto.key",
+		logger:        slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	assert.Equal(t, path, auth.KeyFile)
+	assert.Len(t, auth.keys.current().keys, 1)
+
+	auth = &PasetoAuth{KeyCredential: "paseto.key", KeyFile: path}
+	require.ErrorContains(t, auth.Validate(), "key_credential can't be used with key_file")
+}
@@ -0,0 +1,87 @@
+package caddypaseto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// tokenFingerprint returns the fingerprint of the token, i.e. the hex encoded
+// SHA-256 digest of the full token string.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// parseFingerprint validates and normalizes a token fingerprint.
+func parseFingerprint(fp string) (string, error) {
+	fp = strings.ToLower(strings.TrimSpace(fp))
+	if len(fp) != 2*sha256.Size {
+		return "", fmt.Errorf("invalid fingerprint '%s': expected %d hex characters", fp, 2*sha256.Size)
+	}
+	if _, err := hex.DecodeString(fp); err != nil {
+		return "", fmt.Errorf("invalid fingerprint '%s': %w", fp, err)
+	}
+	return fp, nil
+}
+
+// fingerprintSet is a concurrency-safe set of token fingerprints.
+type fingerprintSet struct {
+	mu  sync.RWMutex
+	fps map[string]struct{}
+}
+
+func newFingerprintSet() *fingerprintSet {
+	return &fingerprintSet{fps: make(map[string]struct{})}
+}
+
+// sharedDenylist is the list of denied token fingerprints managed via the admin
+// API, and shared by all module instances. It's not persisted.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var sharedDenylist = newFingerprintSet()
+
+func (s *fingerprintSet) add(fps ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, fp := range fps {
+		s.fps[fp] = struct{}{}
+	}
+}
+
+// remove removes the fingerprints from the set, and returns the amount of
+// fingerprints that were removed.
+func (s *fingerprintSet) remove(fps ...string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var count int
+	for _, fp := range fps {
+		if _, ok := s.fps[fp]; ok {
+			delete(s.fps, fp)
+			count++
+		}
+	}
+	return count
+}
+
+func (s *fingerprintSet) contains(fp string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.fps[fp]
+	return ok
+}
+
+// list returns the sorted fingerprints in the set.
+func (s *fingerprintSet) list() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	fps := make([]string, 0, len(s.fps))
+	for fp := range s.fps {
+		fps = append(fps, fp)
+	}
+	slices.Sort(fps)
+	return fps
+}
@@ -0,0 +1,321 @@
+package caddypaseto
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+func init() {
+	caddycmd.RegisterCommand(caddycmd.Command{
+		Name:  "paseto",
+		Short: "Commands of the caddy-paseto module",
+		CobraFunc: func(cmd *cobra.Command) {
+			cmd.AddCommand(newFixturesCommand())
+			cmd.AddCommand(newWrapKeyCommand())
+		},
+	})
+}
+
+// fixturesManifestFile is the name of the manifest of the fixtures directory.
+const fixturesManifestFile = "manifest.json"
+
+// fixturesConfig configures the generated fixtures.
+type fixturesConfig struct {
+	Version  paseto.Version
+	Purpose  paseto.Purpose
+	Issuer   string
+	Audience string
+	Subject  string
+	Lifetime time.Duration
+	// KeyID sets the PASERK ID of the key in the "kid" field of the token
+	// footers.
+	KeyID bool
+}
+
+// fixturesManifest describes the generated keys and tokens, so that test suites
+// can load them without hardcoding file names.
+type fixturesManifest struct {
+	Version     paseto.Version `json:"version"`
+	Purpose     paseto.Purpose `json:"purpose"`
+	Issuer      string         `json:"issuer"`
+	Audience    string         `json:"audience"`
+	Subject     string         `json:"subject"`
+	GeneratedAt time.Time      `json:"generated_at"`
+	Keys        fixtureKeys    `json:"keys"`
+	Tokens      []fixtureToken `json:"tokens"`
+}
+
+// fixtureKeys lists the key files, relative to the fixtures directory.
+type fixtureKeys struct {
+	// Secret is the private key that signs the tokens, or the symmetric key
+	// that encrypts them.
+	Secret string `json:"secret"`
+	// Verify is the key to configure in pasetoauth, i.e. the public key, or
+	// the symmetric key.
+	Verify string `json:"verify"`
+	// ID is the PASERK ID of the verification key.
+	ID string `json:"id"`
+}
+
+// fixtureToken is a generated token, and whether pasetoauth should accept it,
+// when configured with the verification key, issuer and audience.
+type fixtureToken struct {
+	Name        string `json:"name"`
+	File        string `json:"file"`
+	Valid       bool   `json:"valid"`
+	Description string `json:"description"`
+}
+
+func newFixturesCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "fixtures [--output <dir>] [--version <version>] [--purpose <purpose>] [--kid]",
+		Short: "Generates keys and tokens for integration tests",
+		Long: `
+Generates a key, and a set of tokens for integration, end-to-end and load tests:
+a valid token, and tokens that are expected to be rejected, because they're
+expired, for the wrong audience, tampered with, or of the wrong protocol version.
+
+The key files are written to the keys directory, the tokens to the tokens
+directory, one per file, and manifest.json lists all of them, along with
+whether each token is valid. The verification key can be configured with
+'key_file', and the issuer and audience with 'allow_issuers' and
+'allow_audiences'.
+
+The keys are newly generated each time, so the fixtures must never be used in
+production.
+`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdFixtures),
+	}
+	cmd.Flags().StringP("output", "o", "paseto-fixtures", "The directory the fixtures are written to")
+	cmd.Flags().String("version", "4", "The protocol version of the key and tokens")
+	cmd.Flags().String("purpose", string(paseto.Public), "The protocol purpose of the key and tokens")
+	cmd.Flags().String("issuer", "https://issuer.example.com", "The issuer of the tokens")
+	cmd.Flags().String("audience", "https://api.example.com", "The audience of the tokens")
+	cmd.Flags().String("subject", "user123", "The subject of the tokens")
+	cmd.Flags().Duration("lifetime", 24*time.Hour, "The lifetime of the valid token")
+	cmd.Flags().Bool("kid", false, "Set the key ID in the token footers")
+
+	return cmd
+}
+
+func cmdFixtures(fl caddycmd.Flags) (int, error) {
+	ver := fl.String("version")
+	if !strings.HasPrefix(ver, "v") {
+		ver = "v" + ver
+	}
+	cfg := fixturesConfig{
+		Version:  paseto.Version(ver),
+		Purpose:  paseto.Purpose(fl.String("purpose")),
+		Issuer:   fl.String("issuer"),
+		Audience: fl.String("audience"),
+		Subject:  fl.String("subject"),
+		Lifetime: fl.Duration("lifetime"),
+		KeyID:    fl.Bool("kid"),
+	}
+
+	dir := fl.String("output")
+	manifest, err := writeFixtures(dir, cfg, time.Now())
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Printf("Wrote %d tokens to %s\n", len(manifest.Tokens), dir)
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// writeFixtures generates a key and the tokens, and writes them to dir, along
+// with their manifest.
+func writeFixtures(dir string, cfg fixturesConfig, now time.Time) (*fixturesManifest, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	key, err := xpaseto.NewKey(cfg.Version, cfg.Purpose, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating key: %w", err)
+	}
+	verifyKey := key
+	if cfg.Purpose == paseto.Public {
+		verifyKey = key.Public()
+	}
+	kid, err := paserkID(verifyKey, cfg.Version, cfg.Purpose)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &fixturesManifest{
+		Version:     cfg.Version,
+		Purpose:     cfg.Purpose,
+		Issuer:      cfg.Issuer,
+		Audience:    cfg.Audience,
+		Subject:     cfg.Subject,
+		GeneratedAt: now.UTC(),
+		Keys:        fixtureKeys{Secret: filepath.Join("keys", "secret.key"), ID: kid},
+	}
+	files := map[string]string{manifest.Keys.Secret: key.ExportHex()}
+	if cfg.Purpose == paseto.Public {
+		manifest.Keys.Verify = filepath.Join("keys", "public.key")
+		files[manifest.Keys.Verify] = verifyKey.ExportHex()
+	} else {
+		manifest.Keys.Verify = manifest.Keys.Secret
+	}
+
+	for _, fx := range fixtureTokens(cfg, now) {
+		tokenStr, genErr := cfg.generate(fx, key, kid)
+		if genErr != nil {
+			return nil, fmt.Errorf("failed generating token '%s': %w", fx.name, genErr)
+		}
+		file := filepath.Join("tokens", fx.name+".token")
+		files[file] = tokenStr
+		manifest.Tokens = append(manifest.Tokens, fixtureToken{
+			Name: fx.name, File: file, Valid: fx.valid, Description: fx.desc,
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding manifest: %w", err)
+	}
+	files[fixturesManifestFile] = string(data)
+
+	for _, sub := range []string{"keys", "tokens"} {
+		if err = os.MkdirAll(filepath.Join(dir, sub), 0o750); err != nil {
+			return nil, fmt.Errorf("failed creating fixtures directory: %w", err)
+		}
+	}
+	for name, content := range files {
+		if err = os.WriteFile(filepath.Join(dir, name), []byte(content+"\n"), 0o600); err != nil {
+			return nil, fmt.Errorf("failed writing fixture: %w", err)
+		}
+	}
+
+	return manifest, nil
+}
+
+func (cfg fixturesConfig) validate() error {
+	switch {
+	case !slices.Contains([]paseto.Version{paseto.Version2, paseto.Version3, paseto.Version4}, cfg.Version):
+		return fmt.Errorf("invalid version: '%s'", cfg.Version)
+	case !slices.Contains([]paseto.Purpose{paseto.Local, paseto.Public}, cfg.Purpose):
+		return fmt.Errorf("invalid purpose: '%s'", cfg.Purpose)
+	case cfg.Audience == "":
+		return errors.New("invalid audience: the wrong audience token requires an audience")
+	case cfg.Lifetime <= 0:
+		return fmt.Errorf("invalid lifetime: '%s'", cfg.Lifetime)
+	}
+	return nil
+}
+
+// fixtureSpec describes how a fixture token is generated.
+type fixtureSpec struct {
+	name      string
+	desc      string
+	valid     bool
+	issuedAt  time.Time
+	expiresAt time.Time
+	audience  string
+	// tamper modifies the payload after the token is signed or encrypted.
+	tamper bool
+	// otherVersion generates the token with a key of another protocol version.
+	otherVersion bool
+}
+
+// fixtureTokens returns the specs of the generated tokens.
+func fixtureTokens(cfg fixturesConfig, now time.Time) []fixtureSpec {
+	valid := fixtureSpec{
+		name: "valid", desc: "valid token", valid: true,
+		issuedAt: now, expiresAt: now.Add(cfg.Lifetime), audience: cfg.Audience,
+	}
+	expired, wrongAud, tampered, wrongVer := valid, valid, valid, valid
+
+	expired.name, expired.desc, expired.valid = "expired", "token that expired an hour ago", false
+	expired.issuedAt, expired.expiresAt = now.Add(-2*time.Hour), now.Add(-time.Hour)
+	wrongAud.name, wrongAud.desc, wrongAud.valid = "wrong_audience", "token for another audience", false
+	wrongAud.audience = "wrong." + cfg.Audience
+	tampered.name, tampered.desc, tampered.valid = "tampered", "valid token with a modified payload", false
+	tampered.tamper = true
+	wrongVer.name, wrongVer.desc, wrongVer.valid = "wrong_version", "token of another protocol version", false
+	wrongVer.otherVersion = true
+
+	return []fixtureSpec{valid, expired, wrongAud, tampered, wrongVer}
+}
+
+// generate returns the token of the spec, signed or encrypted with key, or with
+// a new key of another version.
+func (cfg fixturesConfig) generate(fx fixtureSpec, key *xpaseto.Key, kid string) (string, error) {
+	claims := []xpaseto.Claim{
+		xpaseto.ClaimIssuedAt(fx.issuedAt),
+		xpaseto.ClaimNotBefore(fx.issuedAt),
+		xpaseto.ClaimExpiration(fx.expiresAt),
+		xpaseto.ClaimAudience(fx.audience),
+		xpaseto.ClaimSubject(cfg.Subject),
+	}
+	if cfg.Issuer != "" {
+		claims = append(claims, xpaseto.ClaimIssuer(cfg.Issuer))
+	}
+	token, err := xpaseto.NewToken(func() time.Time { return fx.issuedAt }, claims...)
+	if err != nil {
+		return "", fmt.Errorf("failed creating token: %w", err)
+	}
+	if cfg.KeyID {
+		token.SetFooter([]byte(`{"kid":"` + kid + `"}`))
+	}
+
+	if fx.otherVersion {
+		ver := paseto.Version4
+		if cfg.Version == paseto.Version4 {
+			ver = paseto.Version3
+		}
+		if key, err = xpaseto.NewKey(ver, cfg.Purpose, nil); err != nil {
+			return "", fmt.Errorf("failed generating key: %w", err)
+		}
+	}
+
+	var out string
+	if cfg.Purpose == paseto.Local {
+		out, err = key.Encrypt(token)
+	} else {
+		out, err = key.Sign(token)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed signing token: %w", err)
+	}
+
+	if fx.tamper {
+		return tamperToken(out)
+	}
+	return out, nil
+}
+
+// tamperToken flips a bit in the middle of the payload of the token, so that
+// its signature or authentication tag doesn't match anymore. The payload is
+// decoded first, since changing the last base64 character might not change
+// the decoded bytes.
+func tamperToken(tokenStr string) (string, error) {
+	parts := strings.Split(tokenStr, ".")
+	if len(parts) < 3 {
+		return "", errors.New("failed tampering with token: invalid token format")
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("failed tampering with token: %w", err)
+	}
+	body[len(body)/2] ^= 0x01
+	parts[2] = base64.RawURLEncoding.EncodeToString(body)
+
+	return strings.Join(parts, "."), nil
+}
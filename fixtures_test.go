@@ -0,0 +1,108 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestWriteFixtures(t *testing.T) {
+	protocols := []struct {
+		version paseto.Version
+		purpose paseto.Purpose
+	}{
+		{paseto.Version4, paseto.Public},
+		{paseto.Version4, paseto.Local},
+		{paseto.Version3, paseto.Public},
+		{paseto.Version2, paseto.Local},
+	}
+
+	for _, proto := range protocols {
+		t.Run("ok/"+string(proto.version)+"_"+string(proto.purpose), func(t *testing.T) {
+			dir := t.TempDir()
+			cfg := fixturesConfig{
+				Version:  proto.version,
+				Purpose:  proto.purpose,
+				Issuer:   "https://issuer.example.com",
+				Audience: "https://api.example.com",
+				Subject:  "user123",
+				Lifetime: time.Hour,
+				KeyID:    true,
+			}
+			_, err := writeFixtures(dir, cfg, time.Now())
+			require.NoError(t, err)
+
+			data, err := os.ReadFile(filepath.Join(dir, fixturesManifestFile))
+			require.NoError(t, err)
+			var manifest fixturesManifest
+			require.NoError(t, json.Unmarshal(data, &manifest))
+			require.Len(t, manifest.Tokens, 5)
+
+			auth := &PasetoAuth{
+				KeyFile:        filepath.Join(dir, manifest.Keys.Verify),
+				Version:        manifest.Version,
+				Purpose:        manifest.Purpose,
+				RequireKID:     true,
+				AllowIssuers:   []string{manifest.Issuer},
+				AllowAudiences: []string{manifest.Audience},
+				FromQuery:      []string{"token"},
+				logger:         slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+			assert.Contains(t, auth.keys.current().byID, manifest.Keys.ID)
+
+			for _, fx := range manifest.Tokens {
+				tokenStr, readErr := os.ReadFile(filepath.Join(dir, fx.File))
+				require.NoError(t, readErr)
+				req := httptest.NewRequest(http.MethodGet, "/?token="+strings.TrimSpace(string(tokenStr)), nil)
+				user, authenticated, authErr := auth.Authenticate(httptest.NewRecorder(), req)
+				require.NoError(t, authErr)
+				assert.Equal(t, fx.Valid, authenticated, fx.Name)
+				if fx.Valid {
+					assert.Equal(t, manifest.Subject, user.ID)
+				}
+			}
+		})
+	}
+
+	tests := []struct {
+		name   string
+		cfg    fixturesConfig
+		expErr string
+	}{
+		{
+			name:   "err/version",
+			cfg:    fixturesConfig{Version: "v5", Purpose: paseto.Public, Audience: "api", Lifetime: time.Hour},
+			expErr: "invalid version: 'v5'",
+		},
+		{
+			name:   "err/purpose",
+			cfg:    fixturesConfig{Version: paseto.Version4, Purpose: "secret", Audience: "api", Lifetime: time.Hour},
+			expErr: "invalid purpose: 'secret'",
+		},
+		{
+			name:   "err/audience",
+			cfg:    fixturesConfig{Version: paseto.Version4, Purpose: paseto.Public, Lifetime: time.Hour},
+			expErr: "invalid audience",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := writeFixtures(t.TempDir(), tt.cfg, time.Now())
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
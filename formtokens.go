@@ -0,0 +1,133 @@
+package caddypaseto
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"slices"
+)
+
+// defaultFromFormMaxSize is the default maximum size of form bodies that are
+// read for tokens.
+const defaultFromFormMaxSize = 1 << 20
+
+// errBodyTooLarge is returned when a request body is larger than the maximum
+// size that is read for tokens.
+var errBodyTooLarge = errors.New("request body is too large")
+
+// formTokens returns the values of the form fields with the names, in the
+// order of the names. Only the bodies of POST, PUT and PATCH requests with
+// the application/x-www-form-urlencoded or multipart/form-data content type
+// are read, and at most FromFormMaxSize bytes of them. The body is restored
+// afterwards, so that the next handlers still see all of it. File fields are
+// ignored.
+func (p *PasetoAuth) formTokens(r *http.Request, names []string) []string {
+	tokens := make([]string, 0)
+	if len(names) == 0 || !hasTokenBody(r) {
+		return tokens
+	}
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || (mediaType != "application/x-www-form-urlencoded" && mediaType != "multipart/form-data") {
+		return tokens
+	}
+
+	body, err := readRestoredBody(r, p.FromFormMaxSize)
+	if err != nil {
+		p.logger.Warn("ignoring form token fields", "error", err.Error(),
+			"from_form_max_size", p.FromFormMaxSize)
+		return tokens
+	}
+
+	var values url.Values
+	if mediaType == "multipart/form-data" {
+		values, err = multipartFields(body, params["boundary"], names)
+	} else {
+		values, err = url.ParseQuery(string(body))
+	}
+	if err != nil {
+		p.logger.Warn("ignoring form token fields", "error", "invalid form: "+err.Error())
+		return tokens
+	}
+	for _, name := range names {
+		if token := values.Get(name); token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+
+	return tokens
+}
+
+// validateMaxSize applies the default to the maximum body size, or returns an
+// error if it's negative.
+func validateMaxSize(size *int64, def int64, opt string) error {
+	if *size < 0 {
+		return fmt.Errorf("invalid %s: '%d'", opt, *size)
+	} else if *size == 0 {
+		*size = def
+	}
+	return nil
+}
+
+// hasTokenBody reports whether the request is a POST, PUT or PATCH request
+// with a body, which can contain tokens.
+func hasTokenBody(r *http.Request) bool {
+	return r.Body != nil && r.Body != http.NoBody &&
+		slices.Contains([]string{http.MethodPost, http.MethodPut, http.MethodPatch}, r.Method)
+}
+
+// readRestoredBody reads at most maxSize bytes of the request body, and
+// replaces the body with one that returns the same data again, followed by
+// the unread rest, if any. It returns errBodyTooLarge if the body is larger
+// than maxSize.
+func readRestoredBody(r *http.Request, maxSize int64) ([]byte, error) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	r.Body = &restoredBody{Reader: io.MultiReader(bytes.NewReader(body), r.Body), Closer: r.Body}
+	if err != nil {
+		return nil, fmt.Errorf("failed reading request body: %w", err)
+	}
+	if int64(len(body)) > maxSize {
+		return nil, errBodyTooLarge
+	}
+
+	return body, nil
+}
+
+// restoredBody is a request body that returns the already read data before
+// the rest of the original body, and closes the original body.
+type restoredBody struct {
+	io.Reader
+	io.Closer
+}
+
+// multipartFields returns the values of the non-file fields of the multipart
+// body whose names are one of the names.
+func multipartFields(body []byte, boundary string, names []string) (url.Values, error) {
+	if boundary == "" {
+		return nil, errors.New("missing multipart boundary")
+	}
+
+	values := make(url.Values)
+	mr := multipart.NewReader(bytes.NewReader(body), boundary)
+	for {
+		part, err := mr.NextPart()
+		if errors.Is(err, io.EOF) {
+			return values, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed reading multipart body: %w", err)
+		}
+		name := part.FormName()
+		if part.FileName() != "" || !slices.Contains(names, name) {
+			continue
+		}
+		value, err := io.ReadAll(part)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading multipart field '%s': %w", name, err)
+		}
+		values.Add(name, string(value))
+	}
+}
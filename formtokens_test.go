@@ -0,0 +1,129 @@
+package caddypaseto
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateFromForm(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(key, nil)
+
+	auth := &PasetoAuth{
+		Key:             key.Public().ExportHex(),
+		FromForm:        []string{"access_token"},
+		FromFormMaxSize: 1 << 10,
+		logger:          slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	urlencoded := url.Values{"comment": {"hello"}, "access_token": {tokenStr}}.Encode()
+	var multipartBody bytes.Buffer
+	mw := multipart.NewWriter(&multipartBody)
+	fw, err := mw.CreateFormFile("access_token", "token.txt")
+	require.NoError(t, err)
+	_, _ = fw.Write([]byte("not a token field"))
+	require.NoError(t, mw.WriteField("access_token", tokenStr))
+	require.NoError(t, mw.Close())
+
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		expAuth     bool
+	}{
+		{
+			name:        "ok/urlencoded",
+			method:      http.MethodPost,
+			contentType: "application/x-www-form-urlencoded",
+			body:        urlencoded,
+			expAuth:     true,
+		},
+		{
+			name:        "ok/multipart",
+			method:      http.MethodPost,
+			contentType: mw.FormDataContentType(),
+			body:        multipartBody.String(),
+			expAuth:     true,
+		},
+		{
+			name:        "err/get",
+			method:      http.MethodGet,
+			contentType: "application/x-www-form-urlencoded",
+			body:        urlencoded,
+		},
+		{
+			name:        "err/json",
+			method:      http.MethodPost,
+			contentType: "application/json",
+			body:        urlencoded,
+		},
+		{
+			name:        "err/too_large",
+			method:      http.MethodPost,
+			contentType: "application/x-www-form-urlencoded",
+			body:        urlencoded + "&padding=" + strings.Repeat("a", 1<<10),
+		},
+		{
+			name:        "err/no_boundary",
+			method:      http.MethodPost,
+			contentType: "multipart/form-data",
+			body:        multipartBody.String(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", tt.contentType)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+
+			// The next handlers still see the whole body.
+			body, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, tt.body, string(body))
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateFromForm(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	auth := &PasetoAuth{Key: key, FromFormMaxSize: 1 << 10, logger: slog.New(testutil.NewTestLogHandler())}
+	require.ErrorContains(t, auth.Validate(), "from_form_max_size requires from_form")
+
+	auth = &PasetoAuth{
+		Key: key, FromForm: []string{"access_token"}, FromFormMaxSize: -1,
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, auth.Validate(), "invalid from_form_max_size: '-1'")
+
+	auth = &PasetoAuth{Key: key, FromForm: []string{"access_token"}, logger: slog.New(testutil.NewTestLogHandler())}
+	require.NoError(t, auth.Validate())
+	assert.Equal(t, int64(defaultFromFormMaxSize), auth.FromFormMaxSize)
+}
@@ -0,0 +1,68 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// forwardedAuthorizationHeader is the header that gateways in front of Caddy
+// set to the Authorization header they consumed.
+const forwardedAuthorizationHeader = "X-Forwarded-Authorization"
+
+// validateForwardedAuthorization parses ForwardedAuthorizationProxies.
+func (p *PasetoAuth) validateForwardedAuthorization() error {
+	if len(p.ForwardedAuthorizationProxies) == 0 {
+		return nil
+	}
+
+	var err error
+	if p.proxyNetworks, err = parseNetworks(p.ForwardedAuthorizationProxies); err != nil {
+		return fmt.Errorf("invalid forwarded_authorization_proxies: %w", err)
+	}
+	return nil
+}
+
+// forwardedTokens returns the tokens of the X-Forwarded-Authorization header,
+// if the request was sent by a trusted proxy. Its values are handled like the
+// ones of the Authorization header.
+func (p *PasetoAuth) forwardedTokens(r *http.Request, names []string) []string {
+	values := r.Header.Values(forwardedAuthorizationHeader)
+	if len(names) == 0 || len(values) == 0 {
+		return nil
+	}
+	if !p.trustedForwarder(r) {
+		p.logger.Warn("ignoring "+forwardedAuthorizationHeader+" header of a request that wasn't sent by a trusted proxy",
+			"remote_addr", r.RemoteAddr)
+		return nil
+	}
+	return p.authorizationTokens(forwardedAuthorizationHeader, values)
+}
+
+// trustedForwarder reports whether the direct peer of the request is a proxy
+// that X-Forwarded-Authorization is accepted from, i.e. one in
+// ForwardedAuthorizationProxies if it's set, or else one of the server's
+// trusted proxies.
+func (p *PasetoAuth) trustedForwarder(r *http.Request) bool {
+	if len(p.proxyNetworks) == 0 {
+		trusted, _ := caddyhttp.GetVar(r.Context(), caddyhttp.TrustedProxyVarKey).(bool)
+		return trusted
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return false
+	}
+	ip = ip.WithZone("").Unmap()
+	return slices.ContainsFunc(p.proxyNetworks, func(prefix netip.Prefix) bool {
+		return prefix.Contains(ip)
+	})
+}
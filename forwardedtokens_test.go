@@ -0,0 +1,95 @@
+package caddypaseto
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_ForwardedTokens(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name         string
+		proxies      []string
+		remoteAddr   string
+		trustedProxy bool
+		header       string
+		exp          []string
+	}{
+		{
+			name:         "ok/trusted_proxy",
+			remoteAddr:   "203.0.113.10:1234",
+			trustedProxy: true,
+			header:       "Bearer fwd-token",
+			exp:          []string{"fwd-token"},
+		},
+		{
+			name:       "ok/proxy_network",
+			proxies:    []string{"private_ranges"},
+			remoteAddr: "10.1.2.3:1234",
+			header:     "fwd-token",
+			exp:        []string{"fwd-token"},
+		},
+		{
+			name:       "err/untrusted_proxy",
+			remoteAddr: "203.0.113.10:1234",
+			header:     "Bearer fwd-token",
+		},
+		{
+			name:         "err/outside_proxy_network",
+			proxies:      []string{"10.0.0.0/8"},
+			remoteAddr:   "203.0.113.10:1234",
+			trustedProxy: true,
+			header:       "Bearer fwd-token",
+		},
+		{
+			name:         "err/other_scheme",
+			remoteAddr:   "203.0.113.10:1234",
+			trustedProxy: true,
+			header:       "Basic dXNlcjpwYXNz",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:                           key,
+				FromForwardedAuthorization:    true,
+				ForwardedAuthorizationProxies: tt.proxies,
+				logger:                        slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			req.Header.Set("X-Forwarded-Authorization", tt.header)
+			ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, map[string]any{
+				caddyhttp.TrustedProxyVarKey: tt.trustedProxy,
+			})
+			req = req.WithContext(ctx)
+			if tt.exp == nil {
+				assert.Empty(t, auth.candidateTokens(req))
+				return
+			}
+			assert.Equal(t, tt.exp, auth.candidateTokens(req))
+		})
+	}
+
+	auth := &PasetoAuth{
+		Key:                           key,
+		ForwardedAuthorizationProxies: []string{"10.0.0.0/8"},
+		logger:                        slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, auth.Validate(),
+		"forwarded_authorization_proxies requires from_forwarded_authorization")
+}
@@ -0,0 +1,304 @@
+package caddypaseto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyGCP configures verification keys that are fetched from Google Secret
+// Manager, so that the config doesn't contain the keys in plaintext. The
+// payload of the secret version is a key document, which is a single key, or a
+// JSON object with a "keys" array, as with KeyURL. It's fetched when the module
+// is provisioned, which fails if it can't be fetched, and then in the
+// background every RefreshInterval. The requests are authorized with an access
+// token of the service account of the metadata server, i.e. of the workload
+// identity on GKE, or of the attached service account on Compute Engine and
+// Cloud Run.
+type KeyGCP struct {
+	// Project is the ID or number of the project of the secret. The default is
+	// $GOOGLE_CLOUD_PROJECT.
+	Project string `json:"project,omitempty"`
+
+	// Location is the location of a regional secret, e.g. "europe-west1". By
+	// default, the secret is global.
+	Location string `json:"location,omitempty"`
+
+	// Secret is the ID of the secret.
+	Secret string `json:"secret,omitempty"`
+
+	// Version pins the secret version by its number or alias. The default is
+	// "latest", i.e. the latest enabled version, so that new versions are
+	// picked up by the next refresh.
+	Version string `json:"version,omitempty"`
+
+	// Endpoint is the URL of the Secret Manager API, e.g. of a Private Service
+	// Connect endpoint. It must be an HTTPS URL, or an HTTP URL of a loopback
+	// host. The default is the global or regional endpoint of the secret.
+	Endpoint string `json:"endpoint,omitempty"`
+
+	// RefreshInterval is how often the secret version is fetched. The default
+	// is 5m.
+	RefreshInterval time.Duration `json:"refresh_interval,omitempty"`
+
+	// Timeout is the timeout of a refresh, including the access token request.
+	// The default is 10s.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+// gcpNamePattern matches the project, location, secret and version names.
+const gcpNamePattern = `^[A-Za-z0-9_-]+$`
+
+// Environment variables of the Google Cloud configuration, as used by the
+// Google Cloud client libraries.
+const (
+	gcpProjectEnv      = "GOOGLE_CLOUD_PROJECT"
+	gcpMetadataHostEnv = "GCE_METADATA_HOST"
+)
+
+// gcpMetadataHost is the default host of the metadata server.
+const gcpMetadataHost = "metadata.google.internal"
+
+func (kg *KeyGCP) provision() error {
+	if kg.Project == "" {
+		kg.Project = os.Getenv(gcpProjectEnv)
+	}
+	if kg.Version == "" {
+		kg.Version = "latest"
+	}
+	var errs []error
+	if kg.Project == "" {
+		errs = append(errs, fmt.Errorf("invalid key_gcp: no project, set project or $%s", gcpProjectEnv))
+	}
+	if kg.Secret == "" {
+		errs = append(errs, errors.New("invalid key_gcp: no secret"))
+	}
+	namePattern := regexp.MustCompile(gcpNamePattern)
+	for _, name := range []struct{ opt, val string }{
+		{"project", kg.Project}, {"location", kg.Location}, {"secret", kg.Secret}, {"version", kg.Version},
+	} {
+		if name.val != "" && !namePattern.MatchString(name.val) {
+			errs = append(errs, fmt.Errorf("invalid key_gcp %s: '%s'", name.opt, name.val))
+		}
+	}
+
+	if kg.RefreshInterval < 0 {
+		errs = append(errs, fmt.Errorf("invalid key_gcp refresh_interval: '%s'", kg.RefreshInterval))
+	} else if kg.RefreshInterval == 0 {
+		kg.RefreshInterval = 5 * time.Minute
+	}
+	if kg.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid key_gcp timeout: '%s'", kg.Timeout))
+	} else if kg.Timeout == 0 {
+		kg.Timeout = 10 * time.Second
+	}
+
+	return errors.Join(errs...)
+}
+
+// name returns the resource name of the secret version, e.g.
+// "projects/<project>/secrets/<secret>/versions/latest".
+func (kg *KeyGCP) name() string {
+	name := "projects/" + kg.Project
+	if kg.Location != "" {
+		name += "/locations/" + kg.Location
+	}
+	return name + "/secrets/" + kg.Secret + "/versions/" + kg.Version
+}
+
+// newSecretKeys returns the key document of the secret version.
+func (kg *KeyGCP) newSecretKeys() (*secretKeys, error) {
+	if err := kg.provision(); err != nil {
+		return nil, err
+	}
+	endpoint := kg.Endpoint
+	if endpoint == "" {
+		endpoint = "https://secretmanager.googleapis.com"
+		if kg.Location != "" {
+			endpoint = "https://secretmanager." + kg.Location + ".rep.googleapis.com"
+		}
+	}
+	u, err := parseSecretEndpoint(keySourceGCP, endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	accessURL := strings.TrimSuffix(u.String(), "/") + "/v1/" + kg.name() + ":access"
+	client := &http.Client{}
+	tokens := &gcpTokenProvider{client: &http.Client{}}
+	get := func(ctx context.Context) ([]byte, error) { return accessSecretVersion(ctx, client, tokens, accessURL) }
+
+	return &secretKeys{desc: keySourceGCP, interval: kg.RefreshInterval, timeout: kg.Timeout, get: get}, nil
+}
+
+func (p *PasetoAuth) refreshKeyGCP() {
+	keys, changed, err := p.keys.gcp.fetch(p.moduleContext())
+	if err == nil && changed {
+		err = p.updateKeys(func(s *keySources) {
+			s.gcp = keys
+			s.setFailed(keySourceGCP, false)
+		})
+		if err != nil {
+			p.keys.gcp.reset()
+		}
+	}
+	if err != nil {
+		p.logger.Warn(err.Error(), "key_gcp", p.KeyGCP.name())
+		if !errors.Is(err, context.Canceled) {
+			p.keySourceFailed(keySourceGCP)
+		}
+		return
+	}
+	if !changed {
+		return
+	}
+	p.logger.Info("reloaded key_gcp keys", "key_gcp", p.KeyGCP.name(), "keys", len(keys))
+}
+
+// accessSecretVersion returns the payload of the secret version, with the
+// Secret Manager AccessSecretVersion API. The payload is checked against its
+// CRC32C checksum.
+func accessSecretVersion(
+	ctx context.Context, client *http.Client, tokens *gcpTokenProvider, accessURL string,
+) ([]byte, error) {
+	token, err := tokens.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, accessURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed creating request: %w", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed accessing secret version: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := readSecretResponse(resp, func(status int, body []byte) error {
+		return fmt.Errorf("failed accessing secret version: %w", gcpAPIError(status, body))
+	})
+	if err != nil {
+		return nil, err
+	}
+	var out struct {
+		Payload struct {
+			Data       []byte  `json:"data"`
+			DataCRC32C *string `json:"dataCrc32c"`
+		} `json:"payload"`
+	}
+	if err = json.Unmarshal(data, &out); err != nil {
+		return nil, fmt.Errorf("invalid secret version: %w", err)
+	}
+	if sum := out.Payload.DataCRC32C; sum != nil {
+		want, parseErr := strconv.ParseUint(*sum, 10, 32)
+		if parseErr != nil {
+			return nil, fmt.Errorf("invalid secret version checksum: '%s'", *sum)
+		}
+		if gcpChecksum(out.Payload.Data) != uint32(want) {
+			return nil, errors.New("secret version payload doesn't match its checksum")
+		}
+	}
+
+	return out.Payload.Data, nil
+}
+
+// gcpAPIError returns the error of a Google API error response, e.g.
+// `{"error":{"code":404,"message":"...","status":"NOT_FOUND"}}`.
+func gcpAPIError(status int, body []byte) error {
+	var apiErr struct {
+		Error struct {
+			Message string `json:"message"`
+			Status  string `json:"status"`
+		} `json:"error"`
+	}
+	if json.Unmarshal(body, &apiErr) != nil || apiErr.Error.Status == "" {
+		return fmt.Errorf("unexpected status %d", status)
+	}
+	if apiErr.Error.Message == "" {
+		return fmt.Errorf("unexpected status %d: %s", status, apiErr.Error.Status)
+	}
+
+	return fmt.Errorf("unexpected status %d: %s: %s", status, apiErr.Error.Status, apiErr.Error.Message)
+}
+
+// gcpTokenExpiryWindow is how long before they expire access tokens are
+// renewed.
+const gcpTokenExpiryWindow = 5 * time.Minute
+
+// gcpTokenProvider returns the access tokens of the default service account of
+// the metadata server, which are cached until shortly before they expire.
+type gcpTokenProvider struct {
+	client *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// get returns an access token of the metadata server at $GCE_METADATA_HOST, or
+// else at metadata.google.internal.
+func (tp *gcpTokenProvider) get(ctx context.Context) (string, error) {
+	tp.mu.Lock()
+	defer tp.mu.Unlock()
+	if tp.token != "" && time.Now().Add(gcpTokenExpiryWindow).Before(tp.expires) {
+		return tp.token, nil
+	}
+
+	host := os.Getenv(gcpMetadataHostEnv)
+	if host == "" {
+		host = gcpMetadataHost
+	}
+	tokenURL := (&url.URL{
+		Scheme: "http", Host: host, Path: "/computeMetadata/v1/instance/service-accounts/default/token",
+	}).String()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenURL, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed getting access token: %w", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	resp, err := tp.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed getting access token: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	data, err := readSecretResponse(resp, func(status int, _ []byte) error {
+		return fmt.Errorf("unexpected status %d", status)
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed getting access token: %w", err)
+	}
+	var out struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err = json.Unmarshal(data, &out); err != nil {
+		return "", fmt.Errorf("invalid access token: %w", err)
+	}
+	if out.AccessToken == "" {
+		return "", errors.New("invalid access token: token is empty")
+	}
+	tp.token, tp.expires = out.AccessToken, time.Now().Add(time.Duration(out.ExpiresIn)*time.Second)
+
+	return tp.token, nil
+}
+
+// gcpChecksum returns the CRC32C checksum of the data, as in the dataCrc32c
+// field of the secret versions.
+func gcpChecksum(data []byte) uint32 {
+	return crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli))
+}
@@ -0,0 +1,251 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+// newFakeGCP returns a fake metadata server and Secret Manager API, which
+// responds to the access requests of the secret versions with their payloads,
+// and counts the access token requests. The metadata server is used via
+// $GCE_METADATA_HOST.
+func newFakeGCP(t *testing.T, versions func(name string) (string, bool)) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var tokenRequests atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+			if r.Header.Get("Metadata-Flavor") != "Google" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			tokenRequests.Add(1)
+			_, _ = w.Write([]byte(`{"access_token":"ya29.token","expires_in":3599,"token_type":"Bearer"}`))
+			return
+		}
+
+		status, out := http.StatusUnauthorized, any(map[string]any{"error": map[string]any{
+			"code": 401, "message": "Request had invalid authentication credentials.", "status": "UNAUTHENTICATED",
+		}})
+		if r.Header.Get("Authorization") == "Bearer ya29.token" {
+			name, _ := strings.CutPrefix(r.URL.Path, "/v1/")
+			name, _ = strings.CutSuffix(name, ":access")
+			if payload, ok := versions(name); ok {
+				status, out = http.StatusOK, map[string]any{"name": name, "payload": map[string]any{
+					"data": []byte(payload), "dataCrc32c": strconv.FormatUint(uint64(gcpChecksum([]byte(payload))), 10),
+				}}
+			} else {
+				status, out = http.StatusNotFound, map[string]any{"error": map[string]any{
+					"code": 404, "message": "Secret [" + name + "] not found or has no versions.", "status": "NOT_FOUND",
+				}}
+			}
+		}
+		w.WriteHeader(status)
+		require.NoError(t, json.NewEncoder(w).Encode(out))
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv(gcpMetadataHostEnv, srv.Listener.Addr().String())
+
+	return srv, &tokenRequests
+}
+
+func TestPasetoAuth_AuthenticateKeyGCP(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+	var latest atomic.Pointer[string]
+	setLatest := func(doc string) { latest.Store(&doc) }
+	setLatest(oldKey.Public().ExportHex())
+	srv, tokenRequests := newFakeGCP(t, func(name string) (string, bool) {
+		switch name {
+		case "projects/my-project/secrets/paseto-key/versions/latest":
+			return *latest.Load(), true
+		case "projects/my-project/locations/europe-west1/secrets/paseto-key/versions/3":
+			return oldKey.Public().ExportHex(), true
+		}
+		return "", false
+	})
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		KeyGCP: &KeyGCP{
+			Project: "my-project", Secret: "paseto-key", Endpoint: srv.URL, RefreshInterval: time.Millisecond,
+		},
+		FromQuery: []string{"token"},
+		logger:    slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+	assert.Equal(t, "latest", auth.KeyGCP.Version)
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	authenticate := func(auth *PasetoAuth, key paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+	assert.True(t, authenticate(auth, oldKey))
+	assert.False(t, authenticate(auth, newKey))
+
+	// A new latest version is picked up by a refresh, with the cached access
+	// token.
+	setLatest(`{"keys": ["` + newKey.Public().ExportHex() + `"]}`)
+	assert.Eventually(t, func() bool { return authenticate(auth, newKey) }, 5*time.Second, 10*time.Millisecond)
+	assert.False(t, authenticate(auth, oldKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "reloaded key_gcp keys"))
+	assert.Equal(t, int32(1), tokenRequests.Load())
+
+	// A pinned version of a regional secret.
+	pinned := &PasetoAuth{
+		KeyGCP: &KeyGCP{
+			Project: "my-project", Location: "europe-west1", Secret: "paseto-key", Version: "3", Endpoint: srv.URL,
+		},
+		FromQuery: []string{"token"},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, pinned.Validate())
+	assert.True(t, authenticate(pinned, oldKey))
+	assert.False(t, authenticate(pinned, newKey))
+}
+
+func TestAccessSecretVersion(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/computeMetadata/v1/instance/service-accounts/default/token" {
+			_, _ = w.Write([]byte(`{"access_token":"ya29.token","expires_in":3599}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/corrupted:access":
+			_, _ = w.Write([]byte(`{"payload":{"data":"a2V5","dataCrc32c":"1"}}`))
+		case "/v1/unchecked:access":
+			_, _ = w.Write([]byte(`{"payload":{"data":"a2V5"}}`))
+		default:
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"error":{"code":403,"message":"Permission denied.","status":"PERMISSION_DENIED"}}`))
+		}
+	}))
+	t.Cleanup(srv.Close)
+	t.Setenv(gcpMetadataHostEnv, srv.Listener.Addr().String())
+	tokens := &gcpTokenProvider{client: srv.Client()}
+
+	data, err := accessSecretVersion(t.Context(), srv.Client(), tokens, srv.URL+"/v1/unchecked:access")
+	require.NoError(t, err)
+	assert.Equal(t, "key", string(data))
+
+	_, err = accessSecretVersion(t.Context(), srv.Client(), tokens, srv.URL+"/v1/corrupted:access")
+	require.EqualError(t, err, "secret version payload doesn't match its checksum")
+
+	_, err = accessSecretVersion(t.Context(), srv.Client(), tokens, srv.URL+"/v1/denied:access")
+	require.EqualError(t, err, "failed accessing secret version: unexpected status 403: PERMISSION_DENIED: "+
+		"Permission denied.")
+
+	t.Setenv(gcpMetadataHostEnv, "127.0.0.1:1")
+	_, err = (&gcpTokenProvider{client: srv.Client()}).get(t.Context())
+	require.ErrorContains(t, err, "failed getting access token: ")
+}
+
+func TestPasetoAuth_ValidateKeyGCP(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	srv, _ := newFakeGCP(t, func(name string) (string, bool) {
+		return key, name == "projects/my-project/secrets/paseto-key/versions/latest"
+	})
+
+	tests := []struct {
+		name    string
+		config  PasetoAuth
+		project string
+		expErr  string
+	}{
+		{
+			name:    "ok/project_env",
+			config:  PasetoAuth{KeyGCP: &KeyGCP{Secret: "paseto-key", Endpoint: srv.URL}},
+			project: "my-project",
+		},
+		{
+			name: "ok/failover",
+			config: PasetoAuth{
+				KeyGCP:      &KeyGCP{Project: "my-project", Secret: "missing", Endpoint: srv.URL},
+				Keys:        []string{key},
+				KeyFailover: []string{keySourceGCP, keySourceKeys},
+			},
+		},
+		{
+			name:   "err/missing_secret",
+			config: PasetoAuth{KeyGCP: &KeyGCP{Project: "my-project", Secret: "missing", Endpoint: srv.URL}},
+			expErr: "failed fetching key_gcp keys: failed accessing secret version: unexpected status 404: " +
+				"NOT_FOUND: Secret [projects/my-project/secrets/missing/versions/latest] not found or has no versions.",
+		},
+		{
+			name:   "err/no_project",
+			config: PasetoAuth{KeyGCP: &KeyGCP{Secret: "paseto-key"}},
+			expErr: "invalid key_gcp: no project, set project or $GOOGLE_CLOUD_PROJECT",
+		},
+		{
+			name:   "err/no_secret",
+			config: PasetoAuth{KeyGCP: &KeyGCP{Project: "my-project"}},
+			expErr: "invalid key_gcp: no secret",
+		},
+		{
+			name:   "err/invalid_secret",
+			config: PasetoAuth{KeyGCP: &KeyGCP{Project: "my-project", Secret: "paseto/key"}},
+			expErr: "invalid key_gcp secret: 'paseto/key'",
+		},
+		{
+			name:   "err/invalid_version",
+			config: PasetoAuth{KeyGCP: &KeyGCP{Project: "my-project", Secret: "paseto-key", Version: "3/../4"}},
+			expErr: "invalid key_gcp version: '3/../4'",
+		},
+		{
+			name: "err/negative_timeout",
+			config: PasetoAuth{KeyGCP: &KeyGCP{
+				Project: "my-project", Secret: "paseto-key", Timeout: -time.Second,
+			}},
+			expErr: "invalid key_gcp timeout: '-1s'",
+		},
+		{
+			name: "err/http_endpoint",
+			config: PasetoAuth{KeyGCP: &KeyGCP{
+				Project: "my-project", Secret: "paseto-key", Endpoint: "http://secretmanager.example",
+			}},
+			expErr: "invalid key_gcp endpoint 'http://secretmanager.example': must be an HTTPS URL, or an HTTP URL " +
+				"of a loopback host",
+		},
+		{
+			name: "err/issuer",
+			config: PasetoAuth{
+				Issuer: "idp",
+				KeyGCP: &KeyGCP{Project: "my-project", Secret: "paseto-key", Endpoint: srv.URL},
+			},
+			expErr: "issuer can't be used with key options, version or purpose",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv(gcpProjectEnv, tt.project)
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
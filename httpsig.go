@@ -0,0 +1,353 @@
+package caddypaseto
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// HTTPSignatures configures verification of HTTP Message Signatures (RFC 9421)
+// made with a key bound to the token. The token carries the public key of the
+// client, usually an ephemeral one, and the client signs each request with the
+// corresponding private key. This provides request-level integrity on top of
+// bearer authentication, since a stolen token can't be used without the key.
+//
+// Only the "ed25519" algorithm is supported.
+type HTTPSignatures struct {
+	// KeyClaim is the name of the token claim that contains the public key, as
+	// an Ed25519 JSON Web Key (RFC 8037). If the claim value contains a "jwk"
+	// member, as in the RFC 7800 confirmation claim, that is used as the key.
+	// The default is "cnf".
+	KeyClaim string `json:"key_claim"`
+
+	// Label is the label of the signature to verify. By default, the first
+	// signature in the Signature-Input header is verified.
+	Label string `json:"label"`
+
+	// Components is a list of component identifiers that must be covered by the
+	// signature, e.g. "@method" or "content-digest". If "content-digest" is
+	// covered, the Content-Digest header (RFC 9530) is verified against the
+	// request body. The default is "@method" and "@target-uri".
+	Components []string `json:"components"`
+
+	// MaxAge is the maximum age of the signature, as determined by its
+	// "created" parameter, which is required. The default is 5m.
+	MaxAge time.Duration `json:"max_age"`
+
+	// MaxBodySize is the maximum size of request bodies in bytes that will be
+	// read to verify the Content-Digest header. The default is 10MiB.
+	MaxBodySize int64 `json:"max_body_size"`
+}
+
+func (hs *HTTPSignatures) provision() error {
+	if hs.KeyClaim == "" {
+		hs.KeyClaim = "cnf"
+	}
+	if len(hs.Components) == 0 {
+		hs.Components = []string{"@method", "@target-uri"}
+	}
+	for i, comp := range hs.Components {
+		hs.Components[i] = strings.ToLower(comp)
+		if _, err := httpSigComponent(hs.Components[i], nil); err != nil {
+			return fmt.Errorf("invalid http_signatures component: '%s'", comp)
+		}
+	}
+	if hs.MaxAge < 0 {
+		return fmt.Errorf("invalid http_signatures max age: '%s'", hs.MaxAge)
+	}
+	if hs.MaxAge == 0 {
+		hs.MaxAge = 5 * time.Minute
+	}
+	if hs.MaxBodySize == 0 {
+		hs.MaxBodySize = 10 << 20
+	}
+
+	return nil
+}
+
+// verify verifies the signature of the request with the key in the token
+// claims. tolerance is the allowed clock skew of the signature times.
+func (hs *HTTPSignatures) verify(
+	r *http.Request, claims map[string]any, now time.Time, tolerance time.Duration,
+) error {
+	key, err := httpSigKey(claims[hs.KeyClaim])
+	if err != nil {
+		return fmt.Errorf("invalid signature key claim '%s': %w", hs.KeyClaim, err)
+	}
+
+	label, input, sig, err := hs.signature(r)
+	if err != nil {
+		return err
+	}
+
+	covered := make([]string, 0, len(input.items))
+	for _, item := range input.items {
+		comp, ok := item.value.(string)
+		if !ok || len(item.params) > 0 {
+			return fmt.Errorf("unsupported signature component: %s", serializeSFBareItem(item.value))
+		}
+		covered = append(covered, comp)
+	}
+	for _, comp := range hs.Components {
+		if !slices.Contains(covered, comp) {
+			return fmt.Errorf("signature '%s' doesn't cover required component '%s'", label, comp)
+		}
+	}
+
+	if err = hs.checkParams(input.params, now, tolerance); err != nil {
+		return fmt.Errorf("invalid signature '%s': %w", label, err)
+	}
+
+	base, err := httpSigBase(r, covered, input)
+	if err != nil {
+		return err
+	}
+	if !ed25519.Verify(key, []byte(base), sig) {
+		return fmt.Errorf("invalid signature '%s': verification failed", label)
+	}
+
+	if slices.Contains(covered, "content-digest") {
+		if err = hs.verifyContentDigest(r); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// signature returns the label, input and value of the signature to verify.
+func (hs *HTTPSignatures) signature(r *http.Request) (string, sfInnerList, []byte, error) {
+	inputs, err := parseSFDictionary(strings.Join(r.Header.Values("Signature-Input"), ", "))
+	if err != nil {
+		return "", sfInnerList{}, nil, fmt.Errorf("invalid Signature-Input header: %w", err)
+	}
+	sigs, err := parseSFDictionary(strings.Join(r.Header.Values("Signature"), ", "))
+	if err != nil {
+		return "", sfInnerList{}, nil, fmt.Errorf("invalid Signature header: %w", err)
+	}
+	if len(inputs) == 0 {
+		return "", sfInnerList{}, nil, fmt.Errorf("request is not signed")
+	}
+
+	label := hs.Label
+	if label == "" {
+		label = inputs[0].name
+	}
+
+	idx := sfMemberIndex(inputs, label)
+	if idx < 0 {
+		return "", sfInnerList{}, nil, fmt.Errorf("signature '%s' not found", label)
+	}
+	input, ok := inputs[idx].value.(sfInnerList)
+	if !ok {
+		return "", sfInnerList{}, nil, fmt.Errorf("invalid Signature-Input header: '%s' is not an inner list", label)
+	}
+
+	idx = sfMemberIndex(sigs, label)
+	if idx < 0 {
+		return "", sfInnerList{}, nil, fmt.Errorf("signature '%s' not found", label)
+	}
+	item, ok := sigs[idx].value.(sfItem)
+	if !ok {
+		return "", sfInnerList{}, nil, fmt.Errorf("invalid Signature header: '%s' is not an item", label)
+	}
+	sig, ok := item.value.([]byte)
+	if !ok {
+		return "", sfInnerList{}, nil, fmt.Errorf("invalid Signature header: '%s' is not a byte sequence", label)
+	}
+
+	return label, input, sig, nil
+}
+
+// checkParams checks the algorithm and times of the signature parameters.
+func (hs *HTTPSignatures) checkParams(params []sfParam, now time.Time, tolerance time.Duration) error {
+	var hasCreated bool
+	for _, param := range params {
+		switch param.name {
+		case "alg":
+			if alg, _ := param.value.(string); alg != "ed25519" {
+				return fmt.Errorf("unsupported algorithm: %s", serializeSFBareItem(param.value))
+			}
+		case "created":
+			created, ok := param.value.(int64)
+			if !ok {
+				return fmt.Errorf("invalid created parameter")
+			}
+			createdAt := time.Unix(created, 0)
+			if createdAt.After(now.Add(tolerance)) {
+				return fmt.Errorf("signature was created in the future")
+			}
+			if now.Sub(createdAt) > hs.MaxAge+tolerance {
+				return fmt.Errorf("signature exceeds the maximum age of %s", hs.MaxAge)
+			}
+			hasCreated = true
+		case "expires":
+			expires, ok := param.value.(int64)
+			if !ok {
+				return fmt.Errorf("invalid expires parameter")
+			}
+			if now.After(time.Unix(expires, 0).Add(tolerance)) {
+				return fmt.Errorf("signature has expired")
+			}
+		}
+	}
+	if !hasCreated {
+		return fmt.Errorf("created parameter is required")
+	}
+
+	return nil
+}
+
+// verifyContentDigest verifies that the Content-Digest header matches the
+// request body. At least one of the sha-256 and sha-512 digests must be
+// present, and all supported digests must match.
+func (hs *HTTPSignatures) verifyContentDigest(r *http.Request) error {
+	digests, err := parseSFDictionary(strings.Join(r.Header.Values("Content-Digest"), ", "))
+	if err != nil {
+		return fmt.Errorf("invalid Content-Digest header: %w", err)
+	}
+
+	body, err := readRestoredBody(r, hs.MaxBodySize)
+	if errors.Is(err, errBodyTooLarge) {
+		return fmt.Errorf("request body is too large to verify its digest")
+	} else if err != nil {
+		return err
+	}
+
+	var verified bool
+	for _, digest := range digests {
+		var sum []byte
+		switch digest.name {
+		case "sha-256":
+			s := sha256.Sum256(body)
+			sum = s[:]
+		case "sha-512":
+			s := sha512.Sum512(body)
+			sum = s[:]
+		default:
+			continue
+		}
+		item, _ := digest.value.(sfItem)
+		want, _ := item.value.([]byte)
+		if subtle.ConstantTimeCompare(sum, want) != 1 {
+			return fmt.Errorf("content digest %s doesn't match the request body", digest.name)
+		}
+		verified = true
+	}
+	if !verified {
+		return fmt.Errorf("no supported digest in Content-Digest header")
+	}
+
+	return nil
+}
+
+// httpSigKey returns the Ed25519 public key in the claim value.
+func httpSigKey(claimValue any) (ed25519.PublicKey, error) {
+	jwk, ok := claimValue.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a JSON Web Key")
+	}
+	if nested, ok := jwk["jwk"].(map[string]any); ok {
+		jwk = nested
+	}
+
+	if kty, _ := jwk["kty"].(string); kty != "OKP" {
+		return nil, fmt.Errorf("unsupported key type: '%v'", jwk["kty"])
+	}
+	if crv, _ := jwk["crv"].(string); crv != "Ed25519" {
+		return nil, fmt.Errorf("unsupported curve: '%v'", jwk["crv"])
+	}
+	x, _ := jwk["x"].(string)
+	key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(x, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key: %w", err)
+	}
+	if len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid public key length: %d", len(key))
+	}
+
+	return ed25519.PublicKey(key), nil
+}
+
+// httpSigBase returns the signature base of the request (RFC 9421 Section 2.5).
+func httpSigBase(r *http.Request, covered []string, input sfInnerList) (string, error) {
+	var sb strings.Builder
+	for _, comp := range covered {
+		val, err := httpSigComponent(comp, r)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "%q: %s\n", comp, val)
+	}
+	fmt.Fprintf(&sb, "\"@signature-params\": %s", input.serialize())
+
+	return sb.String(), nil
+}
+
+// httpSigComponent returns the value of the signature component in the
+// request. If r is nil, it only checks that the component is supported.
+func httpSigComponent(comp string, r *http.Request) (string, error) {
+	if !strings.HasPrefix(comp, "@") {
+		if comp == "" || comp != strings.ToLower(comp) {
+			return "", fmt.Errorf("invalid signature component: '%s'", comp)
+		}
+		if r == nil {
+			return "", nil
+		}
+		if comp == "host" {
+			// Go removes the Host header from the request headers.
+			return r.Host, nil
+		}
+		values := r.Header.Values(comp)
+		if len(values) == 0 {
+			return "", fmt.Errorf("signature component '%s' is missing from the request", comp)
+		}
+		trimmed := make([]string, 0, len(values))
+		for _, val := range values {
+			trimmed = append(trimmed, strings.TrimSpace(val))
+		}
+		return strings.Join(trimmed, ", "), nil
+	}
+
+	switch comp {
+	case "@method", "@target-uri", "@authority", "@scheme", "@request-target", "@path", "@query":
+	default:
+		return "", fmt.Errorf("unsupported signature component: '%s'", comp)
+	}
+	if r == nil {
+		return "", nil
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	switch comp {
+	case "@method":
+		return r.Method, nil
+	case "@target-uri":
+		return scheme + "://" + strings.ToLower(r.Host) + r.URL.RequestURI(), nil
+	case "@authority":
+		return strings.ToLower(r.Host), nil
+	case "@scheme":
+		return scheme, nil
+	case "@request-target":
+		return r.URL.RequestURI(), nil
+	case "@path":
+		if path := r.URL.EscapedPath(); path != "" {
+			return path, nil
+		}
+		return "/", nil
+	default: // @query
+		return "?" + r.URL.RawQuery, nil
+	}
+}
@@ -0,0 +1,204 @@
+package caddypaseto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateHTTPSignatures(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	require.NoError(t, token.Set("cnf", map[string]any{
+		"jwk": map[string]any{
+			"kty": "OKP",
+			"crv": "Ed25519",
+			"x":   base64.RawURLEncoding.EncodeToString(clientPub),
+		},
+	}))
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	auth := &PasetoAuth{
+		Key:        v4PublicKey.ExportHex(),
+		FromHeader: []string{"X-Token"},
+		HTTPSignatures: &HTTPSignatures{
+			Components: []string{"@method", "@target-uri", "content-digest"},
+		},
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	const body = `{"amount":100}`
+	digest := sha256.Sum256([]byte(body))
+	contentDigest := "sha-256=:" + base64.StdEncoding.EncodeToString(digest[:]) + ":"
+
+	newRequest := func(key ed25519.PrivateKey, created time.Time, reqBody string) *http.Request {
+		req := httptest.NewRequest(http.MethodPost, "https://api.example.com/pay?x=1", strings.NewReader(reqBody))
+		req.Header.Set("X-Token", tokenStr)
+		req.Header.Set("Content-Digest", contentDigest)
+
+		params := fmt.Sprintf(`("@method" "@target-uri" "content-digest");created=%d;alg="ed25519"`, created.Unix())
+		base := "\"@method\": POST\n" +
+			"\"@target-uri\": https://api.example.com/pay?x=1\n" +
+			"\"content-digest\": " + contentDigest + "\n" +
+			"\"@signature-params\": " + params
+		sig := ed25519.Sign(key, []byte(base))
+
+		req.Header.Set("Signature-Input", "sig1="+params)
+		req.Header.Set("Signature", "sig1=:"+base64.StdEncoding.EncodeToString(sig)+":")
+		return req
+	}
+
+	tests := []struct {
+		name       string
+		req        *http.Request
+		expectAuth bool
+	}{
+		{
+			name:       "ok",
+			req:        newRequest(clientPriv, time.Now(), body),
+			expectAuth: true,
+		},
+		{
+			name: "err/unsigned",
+			req: func() *http.Request {
+				req := httptest.NewRequest(http.MethodPost, "https://api.example.com/pay?x=1", strings.NewReader(body))
+				req.Header.Set("X-Token", tokenStr)
+				return req
+			}(),
+		},
+		{
+			name: "err/wrong_key",
+			req:  newRequest(otherPriv, time.Now(), body),
+		},
+		{
+			name: "err/too_old",
+			req:  newRequest(clientPriv, time.Now().Add(-time.Hour), body),
+		},
+		{
+			name: "err/body_mismatch",
+			req:  newRequest(clientPriv, time.Now(), `{"amount":1000000}`),
+		},
+		{
+			name: "err/tampered_target",
+			req: func() *http.Request {
+				req := newRequest(clientPriv, time.Now(), body)
+				req.URL.RawQuery = "x=2"
+				return req
+			}(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), tt.req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectAuth, authenticated)
+		})
+	}
+}
+
+func TestParseSFDictionary(t *testing.T) {
+	members, err := parseSFDictionary(
+		`sig1=("@method" "@authority" "content-type";sf);created=1618884473;keyid="test-key";tag=abc, ` +
+			`sig2=:dGVzdA==:;bin, flag`)
+	require.NoError(t, err)
+	require.Len(t, members, 3)
+
+	input, ok := members[0].value.(sfInnerList)
+	require.True(t, ok)
+	assert.Equal(t, "sig1", members[0].name)
+	assert.Equal(t,
+		`("@method" "@authority" "content-type";sf);created=1618884473;keyid="test-key";tag=abc`,
+		input.serialize())
+
+	sig, ok := members[1].value.(sfItem)
+	require.True(t, ok)
+	assert.Equal(t, []byte("test"), sig.value)
+	assert.Equal(t, []sfParam{{name: "bin", value: true}}, sig.params)
+
+	flag, ok := members[2].value.(sfItem)
+	require.True(t, ok)
+	assert.Equal(t, true, flag.value)
+
+	for _, invalid := range []string{`sig1=("@method"`, `sig1=1.5`, `Sig1=?1`, `sig1=?1,`, `sig1="\x"`} {
+		_, err = parseSFDictionary(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+// closeRecorder is a request body that records whether it was closed.
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestHTTPSignatures_VerifyContentDigestBody(t *testing.T) {
+	const body = `{"amount":100}`
+	digest := sha256.Sum256([]byte(body))
+
+	tests := []struct {
+		name        string
+		maxBodySize int64
+		expErr      string
+	}{
+		{name: "ok", maxBodySize: 1 << 10},
+		{name: "err/too_large", maxBodySize: 4, expErr: "request body is too large to verify its digest"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			orig := &closeRecorder{Reader: strings.NewReader(body)}
+			req := httptest.NewRequest(http.MethodPost, "/", nil)
+			req.Body = orig
+			req.Header.Set("Content-Digest", "sha-256=:"+base64.StdEncoding.EncodeToString(digest[:])+":")
+
+			hs := &HTTPSignatures{MaxBodySize: tt.maxBodySize}
+			err := hs.verifyContentDigest(req)
+			if tt.expErr != "" {
+				require.ErrorContains(t, err, tt.expErr)
+			} else {
+				require.NoError(t, err)
+			}
+
+			// The next handlers still see the whole body, and closing it
+			// closes the original body.
+			read, err := io.ReadAll(req.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(read))
+			require.NoError(t, req.Body.Close())
+			assert.True(t, orig.closed)
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package caddypaseto
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// errNoIssuerKey is returned for tokens that can't be verified with the keys of
+// any issuer in IssuerKeys, if no other keys are configured.
+var errNoIssuerKey = errors.New("token doesn't match the keys of any issuer in issuer_keys")
+
+// newIssuerKeyProviders returns the providers that own the keys of IssuerKeys,
+// by issuer.
+func (p *PasetoAuth) newIssuerKeyProviders() map[string]*PasetoAuth {
+	providers := make(map[string]*PasetoAuth, len(p.IssuerKeys))
+	for iss, cfg := range p.IssuerKeys {
+		providers[iss] = cfg.provider()
+	}
+	return providers
+}
+
+// provisionIssuerKeys sets up the providers of IssuerKeys.
+func (p *PasetoAuth) provisionIssuerKeys(ctx caddy.Context) error {
+	p.issuerKeys = p.newIssuerKeyProviders()
+	for _, iss := range slices.Sorted(maps.Keys(p.issuerKeys)) {
+		if err := p.issuerKeys[iss].Provision(ctx); err != nil {
+			return fmt.Errorf("invalid issuer_keys '%s': %w", iss, err)
+		}
+	}
+	return nil
+}
+
+// validateIssuerKeys loads the keys of IssuerKeys.
+func (p *PasetoAuth) validateIssuerKeys() error {
+	if p.issuerKeys == nil {
+		p.issuerKeys = p.newIssuerKeyProviders()
+	}
+
+	var errs []error
+	for _, iss := range slices.Sorted(maps.Keys(p.issuerKeys)) {
+		if cfg := p.IssuerKeys[iss]; cfg != nil && cfg.sharesSettings() {
+			errs = append(errs, fmt.Errorf("invalid issuer_keys '%s': allow_audiences, allow_issuers, "+
+				"time_skew_tolerance and max_token_age can only be used with issuers of the paseto app", iss))
+			continue
+		}
+		fed := p.issuerKeys[iss]
+		fed.logger = p.logger.With("issuer_key", iss)
+		fed.metrics = p.metrics
+		if err := fed.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid issuer_keys '%s': %w", iss, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// tokenIssuerKeys returns the issuer of IssuerKeys whose keys verify or decrypt
+// the token, and its provider. It's the issuer with the key whose PASERK ID is
+// in the token footer, or for public tokens, the issuer in the unverified "iss"
+// claim. It returns nil if there's no such issuer, so that the token is
+// verified with the other keys.
+func (p *PasetoAuth) tokenIssuerKeys(tokenStr string) (string, *PasetoAuth) {
+	if kid := tokenKeyID(tokenStr); kid != "" {
+		for iss, fed := range p.issuerKeys {
+			if _, ok := fed.keys.current().byID[kid]; ok {
+				return iss, fed
+			}
+		}
+	}
+
+	iss := unverifiedIssuer(tokenStr)
+	if fed, ok := p.issuerKeys[iss]; ok {
+		return iss, fed
+	}
+
+	return "", nil
+}
+
+// parseIssuerToken parses and verifies the token with the keys of the issuer,
+// and checks that it was issued by it.
+func (p *PasetoAuth) parseIssuerToken(iss, tokenStr string, budget *verifyBudget) (*xpaseto.Token, error) {
+	token, err := p.parseToken(tokenStr, budget)
+	if err != nil {
+		return nil, err
+	}
+	if got, _ := token.GetIssuer(); got != iss {
+		return nil, fmt.Errorf("token issuer '%s' doesn't match the issuer of the key '%s'", got, iss)
+	}
+
+	return token, nil
+}
+
+// unverifiedIssuer returns the "iss" claim of a public token, without verifying
+// the token. Since the claims of local tokens are encrypted, it returns an empty
+// string for them.
+func unverifiedIssuer(tokenStr string) string {
+	proto, err := xpaseto.TokenProtocol(tokenStr)
+	if err != nil || proto.Purpose() != paseto.Public {
+		return ""
+	}
+	parts := strings.Split(tokenStr, ".")
+	if len(parts) < 3 {
+		return ""
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return ""
+	}
+
+	// The message is followed by an Ed25519 signature in v2 and v4, and by
+	// a P-384 signature in v3.
+	sigSize := 64
+	if proto.Version() == paseto.Version3 {
+		sigSize = 96
+	}
+	if len(body) <= sigSize {
+		return ""
+	}
+
+	var claims struct {
+		Issuer string `json:"iss"`
+	}
+	if err = json.Unmarshal(body[:len(body)-sigSize], &claims); err != nil {
+		return ""
+	}
+
+	return claims.Issuer
+}
@@ -0,0 +1,163 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+func TestPasetoAuth_AuthenticateIssuerKeys(t *testing.T) {
+	mainKey := paseto.NewV4AsymmetricSecretKey()
+	billingKey := paseto.NewV4AsymmetricSecretKey()
+	reportsKey := paseto.NewV4SymmetricKey()
+
+	xkey, err := loadKey(reportsKey.ExportHex(), "", paseto.Version4, paseto.Local, xpaseto.KeyTypeSymmetric)
+	require.NoError(t, err)
+	reportsKeyID, err := paserkID(xkey, paseto.Version4, paseto.Local)
+	require.NoError(t, err)
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key: mainKey.Public().ExportHex(),
+		IssuerKeys: map[string]*Issuer{
+			"https://billing.internal": {Key: billingKey.Public().ExportHex()},
+			"https://reports.internal": {Key: reportsKey.ExportHex(), Purpose: paseto.Local},
+		},
+		FromQuery: []string{"token"},
+		logger:    slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	newToken := func(iss string) paseto.Token {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		if iss != "" {
+			token.SetIssuer(iss)
+		}
+		return token
+	}
+	reportsFooter := []byte(`{"kid":"` + reportsKeyID + `"}`)
+
+	tests := []struct {
+		name     string
+		tokenStr string
+		expAuth  bool
+		expWarn  string
+	}{
+		{
+			name:     "ok/main_key",
+			tokenStr: func() string { tk := newToken(""); return tk.V4Sign(mainKey, nil) }(),
+			expAuth:  true,
+		},
+		{
+			name:     "ok/issuer_claim",
+			tokenStr: func() string { tk := newToken("https://billing.internal"); return tk.V4Sign(billingKey, nil) }(),
+			expAuth:  true,
+		},
+		{
+			name: "ok/footer_key_id",
+			tokenStr: func() string {
+				tk := newToken("https://reports.internal")
+				tk.SetFooter(reportsFooter)
+				return tk.V4Encrypt(reportsKey, nil)
+			}(),
+			expAuth: true,
+		},
+		{
+			name:     "err/issuer_claim_other_key",
+			tokenStr: func() string { tk := newToken("https://billing.internal"); return tk.V4Sign(mainKey, nil) }(),
+			expWarn:  "bad signature",
+		},
+		{
+			name: "err/footer_key_id_other_issuer",
+			tokenStr: func() string {
+				tk := newToken("https://billing.internal")
+				tk.SetFooter(reportsFooter)
+				return tk.V4Encrypt(reportsKey, nil)
+			}(),
+			expWarn: "token issuer 'https://billing.internal' doesn't match the issuer of the key " +
+				"'https://reports.internal'",
+		},
+		{
+			name:     "err/unknown_issuer",
+			tokenStr: func() string { tk := newToken("https://unknown.internal"); return tk.V4Sign(billingKey, nil) }(),
+			expWarn:  "bad signature",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler.Clear()
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.tokenStr, nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+			if tt.expWarn != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expWarn))
+			}
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateIssuerKeys(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "ok/no_other_keys",
+			config: PasetoAuth{IssuerKeys: map[string]*Issuer{"https://billing.internal": {Key: key}}},
+		},
+		{
+			name:   "err/empty_key",
+			config: PasetoAuth{IssuerKeys: map[string]*Issuer{"https://billing.internal": {}}},
+			expErr: "invalid issuer_keys 'https://billing.internal': key is empty",
+		},
+		{
+			name: "err/invalid_version",
+			config: PasetoAuth{
+				Key:        key,
+				IssuerKeys: map[string]*Issuer{"https://billing.internal": {Key: key, Version: "v5"}},
+			},
+			expErr: "invalid issuer_keys 'https://billing.internal': invalid version: 'v5'",
+		},
+		{
+			name: "err/shared_settings",
+			config: PasetoAuth{
+				IssuerKeys: map[string]*Issuer{"https://billing.internal": {Key: key, MaxTokenAge: time.Hour}},
+			},
+			expErr: "invalid issuer_keys 'https://billing.internal': allow_audiences, allow_issuers, " +
+				"time_skew_tolerance and max_token_age can only be used with issuers of the paseto app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
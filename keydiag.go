@@ -0,0 +1,188 @@
+package caddypaseto
+
+import (
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// loadKey loads a key with the specified version, purpose and type. The
+// password is only used for password-wrapped PASERK keys. If that fails, the
+// returned error describes the likely misconfiguration, and how to fix it, if
+// it can be determined.
+func loadKey(
+	data, password string, ver paseto.Version, purpose paseto.Purpose, kt xpaseto.KeyType,
+) (*xpaseto.Key, error) {
+	if strings.TrimSpace(data) == "" {
+		return nil, fmt.Errorf("key is empty")
+	}
+
+	if trimmed := strings.TrimSpace(data); isPASERK(trimmed) {
+		var err error
+		if isKeyWrapped(trimmed) {
+			return nil, fmt.Errorf("PASERK key is wrapped with a master key, which is not set; set `key_master`")
+		}
+		if isPasswordWrapped(trimmed) {
+			if trimmed, err = unwrapPASERK(trimmed, password); err != nil {
+				return nil, err
+			}
+		}
+		if data, err = decodePASERK(trimmed, ver, kt); err != nil {
+			return nil, err
+		}
+	} else if block := pkixBlock(trimmed); block != nil {
+		var err error
+		if data, err = decodePKIX(block, ver, kt); err != nil {
+			return nil, err
+		}
+	} else if isSSHKey(trimmed) {
+		var err error
+		if data, err = decodeSSHKey(trimmed, ver, kt); err != nil {
+			return nil, err
+		}
+	}
+
+	key, err := xpaseto.LoadKey([]byte(data), ver, purpose, kt)
+	if err == nil {
+		return key, nil
+	}
+
+	if hint := diagnoseKey(data, ver, purpose, kt); hint != "" {
+		return nil, fmt.Errorf("%w: %s", err, hint)
+	}
+
+	//nolint:wrapcheck // the xpaseto error is descriptive enough
+	return nil, err
+}
+
+// keyKind is a possible interpretation of key data.
+type keyKind struct {
+	version paseto.Version
+	purpose paseto.Purpose
+	typ     xpaseto.KeyType
+}
+
+//nolint:gochecknoglobals // Deliberate cache.
+var keyKinds = func() []keyKind {
+	var kinds []keyKind
+	for _, ver := range []paseto.Version{paseto.Version4, paseto.Version3, paseto.Version2} {
+		kinds = append(kinds,
+			keyKind{ver, paseto.Public, xpaseto.KeyTypePublic},
+			keyKind{ver, paseto.Public, xpaseto.KeyTypePrivate},
+			keyKind{ver, paseto.Local, xpaseto.KeyTypeSymmetric},
+		)
+	}
+	return kinds
+}()
+
+// diagnoseKey returns a hint about why the key data couldn't be loaded with the
+// specified version, purpose and type, or an empty string if the key data
+// isn't a valid key of any kind.
+func diagnoseKey(data string, ver paseto.Version, purpose paseto.Purpose, kt xpaseto.KeyType) string {
+	if _, err := decodeKey(data); err != nil {
+		return "the key must be hex, PEM or PASERK encoded"
+	}
+
+	// Prefer interpretations with the configured version, since different
+	// versions can have keys of the same size.
+	var sameVersion, otherVersions []keyKind
+	for _, kind := range keyKinds {
+		if _, err := xpaseto.LoadKey([]byte(data), kind.version, kind.purpose, kind.typ); err != nil {
+			continue
+		}
+		if kind.version == ver {
+			sameVersion = append(sameVersion, kind)
+		} else if !containsVersion(otherVersions, kind.version) {
+			otherVersions = append(otherVersions, kind)
+		}
+	}
+
+	if len(sameVersion) > 0 {
+		return keyKindHint(data, sameVersion[0], purpose, kt)
+	}
+	if len(otherVersions) > 0 {
+		versions := make([]string, 0, len(otherVersions))
+		for _, kind := range otherVersions {
+			versions = append(versions, strings.TrimPrefix(string(kind.version), "v"))
+		}
+		return fmt.Sprintf("the key appears to be a %s key of a different protocol version; set `version %s`",
+			strings.ToLower(otherVersions[0].typ.Long()), strings.Join(versions, "` or `version "))
+	}
+
+	return ""
+}
+
+func keyKindHint(data string, found keyKind, purpose paseto.Purpose, kt xpaseto.KeyType) string {
+	desc := fmt.Sprintf("the key appears to be a %s %s", found.version, strings.ToLower(found.typ.Long()))
+	switch {
+	case found.purpose != purpose && purpose == paseto.Local:
+		return fmt.Sprintf("%s, but purpose local requires a symmetric key; "+
+			"set `purpose public` if the tokens are signed, or use the shared symmetric key", desc)
+	case found.purpose != purpose:
+		return fmt.Sprintf("%s, but purpose public requires an asymmetric key; "+
+			"set `purpose local` if the tokens are encrypted", desc)
+	case kt == xpaseto.KeyTypePublic && found.typ == xpaseto.KeyTypePrivate:
+		hint := fmt.Sprintf("%s, but a public key is required to verify tokens; "+
+			"never configure the private key of the issuer", desc)
+		if pub := publicKeyHex(data, found.version); pub != "" {
+			hint += fmt.Sprintf(", use its public key instead: %s", pub)
+		}
+		return hint
+	case kt == xpaseto.KeyTypePrivate && found.typ == xpaseto.KeyTypePublic:
+		return fmt.Sprintf("%s, but a private key is required to sign tokens", desc)
+	}
+
+	return desc
+}
+
+func containsVersion(kinds []keyKind, ver paseto.Version) bool {
+	for _, kind := range kinds {
+		if kind.version == ver {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeKey decodes PEM or hex encoded key data.
+func decodeKey(data string) ([]byte, error) {
+	if block, _ := pem.Decode([]byte(data)); block != nil {
+		return block.Bytes, nil
+	}
+	decoded, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding hex data: %w", err)
+	}
+	return decoded, nil
+}
+
+// publicKeyHex returns the hex encoded public key of the private key data, or
+// an empty string if it's not a valid private key.
+func publicKeyHex(data string, ver paseto.Version) string {
+	decoded, err := decodeKey(data)
+	if err != nil {
+		return ""
+	}
+
+	switch ver {
+	case paseto.Version2:
+		if key, keyErr := paseto.NewV2AsymmetricSecretKeyFromBytes(decoded); keyErr == nil {
+			return key.Public().ExportHex()
+		}
+	case paseto.Version3:
+		if key, keyErr := paseto.NewV3AsymmetricSecretKeyFromBytes(decoded); keyErr == nil {
+			return key.Public().ExportHex()
+		}
+	case paseto.Version4:
+		if key, keyErr := paseto.NewV4AsymmetricSecretKeyFromBytes(decoded); keyErr == nil {
+			return key.Public().ExportHex()
+		}
+	}
+
+	return ""
+}
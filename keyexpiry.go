@@ -0,0 +1,140 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// Values of PasetoAuth.StaleKeys.
+const (
+	staleKeysWarn   = "warn"
+	staleKeysReject = "reject"
+)
+
+// staleKey is a key with a not_after time.
+type staleKey struct {
+	id       string
+	notAfter time.Time
+	// warned is set once the stale key was logged, so that it's logged once
+	// per key set, rather than for every token.
+	warned atomic.Bool
+}
+
+// keyType returns the type of the verification keys for the purpose.
+func (p *PasetoAuth) keyType() xpaseto.KeyType {
+	return verificationKeyType(p.Purpose)
+}
+
+// resolveKeyNotAfter maps the PASERK IDs of the keys in KeyNotAfter to their
+// not_after times. Keys specified by value are loaded to compute their ID.
+func (p *PasetoAuth) resolveKeyNotAfter() error {
+	if len(p.KeyNotAfter) == 0 {
+		return nil
+	}
+
+	switch p.StaleKeys {
+	case "":
+		p.StaleKeys = staleKeysWarn
+	case staleKeysWarn, staleKeysReject:
+	default:
+		return fmt.Errorf("invalid stale_keys: '%s'", p.StaleKeys)
+	}
+
+	p.keyNotAfter = make(map[string]time.Time, len(p.KeyNotAfter))
+	for ref, notAfter := range p.KeyNotAfter {
+		id, err := p.resolveKeyRef(ref, "key_not_after")
+		if err != nil {
+			return err
+		}
+		p.keyNotAfter[id] = notAfter
+	}
+
+	return nil
+}
+
+// resolveKeyRef returns the PASERK ID of a key specified by its ID, or by
+// value, in which case it's loaded to compute the ID. opt is the name of the
+// option used in errors.
+func (p *PasetoAuth) resolveKeyRef(ref, opt string) (string, error) {
+	idType := "pid"
+	if p.Purpose == paseto.Local {
+		idType = "lid"
+	}
+	idHeader := "k" + string(p.Version)[1:] + "." + idType + "."
+
+	switch {
+	case strings.HasPrefix(ref, idHeader):
+		return ref, nil
+	case isPASERKID(ref):
+		return "", fmt.Errorf("invalid %s: key ID '%s' doesn't match version %s and purpose %s; "+
+			"expected a '%s' ID", opt, ref, string(p.Version)[1:], p.Purpose, idHeader)
+	}
+
+	key, err := loadKey(ref, p.KeyPassword, p.Version, p.Purpose, p.keyType())
+	if err != nil {
+		return "", fmt.Errorf("invalid %s key: %w", opt, err)
+	}
+	return paserkID(key, p.Version, p.Purpose)
+}
+
+// isPASERKID reports whether the data looks like a PASERK key ID, e.g.
+// "k4.pid.<id>".
+func isPASERKID(data string) bool {
+	parts := strings.SplitN(data, ".", 3)
+	return len(parts) == 3 && isPASERK(data) && (parts[1] == "pid" || parts[1] == "lid")
+}
+
+// staleKeys returns the keys of the set that have a not_after time.
+func (p *PasetoAuth) staleKeys(set *keySet) map[*xpaseto.Key]*staleKey {
+	if len(p.keyNotAfter) == 0 {
+		return nil
+	}
+
+	stale := make(map[*xpaseto.Key]*staleKey)
+	for id, key := range set.byID {
+		if notAfter, ok := p.keyNotAfter[id]; ok {
+			stale[key] = &staleKey{id: id, notAfter: notAfter}
+		}
+	}
+
+	return stale
+}
+
+// checkStaleKeys logs the keys of the set that are past their not_after time,
+// or returns an error if stale keys are rejected.
+func (p *PasetoAuth) checkStaleKeys(set *keySet, now time.Time) error {
+	var errs []error
+	for _, key := range set.keys {
+		sk, ok := set.stale[key]
+		if !ok || now.Before(sk.notAfter) {
+			continue
+		}
+		if p.StaleKeys == staleKeysReject {
+			errs = append(errs, fmt.Errorf("key %s is past its not_after time %s; rotate the key",
+				sk.id, sk.notAfter.Format(time.RFC3339)))
+			continue
+		}
+		p.logger.Warn("key is past its not_after time, it should be rotated", "kid", sk.id, "not_after", sk.notAfter)
+		sk.warned.Store(true)
+	}
+
+	return errors.Join(errs...)
+}
+
+// warnStaleKey logs that a token was verified with a key that is past its
+// not_after time, once per key set.
+func (p *PasetoAuth) warnStaleKey(set *keySet, key *xpaseto.Key) {
+	sk, ok := set.stale[key]
+	if !ok || time.Now().Before(sk.notAfter) || sk.warned.Swap(true) {
+		return
+	}
+	p.logger.Warn("token verified with a key past its not_after time, it should be rotated",
+		"kid", sk.id, "not_after", sk.notAfter)
+}
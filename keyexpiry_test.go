@@ -0,0 +1,214 @@
+package caddypaseto
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+func TestPasetoAuth_ValidateKeyNotAfter(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey().Public()
+	newKey := paseto.NewV4AsymmetricSecretKey().Public()
+	oldID := testKeyID(t, oldKey.ExportHex())
+	past := time.Now().Add(-time.Hour)
+	future := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		config   PasetoAuth
+		expErr   string
+		expStale bool
+	}{
+		{
+			name: "ok/not_stale",
+			config: PasetoAuth{
+				Keys:        []string{newKey.ExportHex(), oldKey.ExportHex()},
+				KeyNotAfter: map[string]time.Time{oldID: future},
+				StaleKeys:   staleKeysReject,
+			},
+		},
+		{
+			name: "ok/stale_by_id",
+			config: PasetoAuth{
+				Keys:        []string{newKey.ExportHex(), oldKey.ExportHex()},
+				KeyNotAfter: map[string]time.Time{oldID: past},
+			},
+			expStale: true,
+		},
+		{
+			name: "ok/stale_by_value",
+			config: PasetoAuth{
+				Keys: []string{newKey.ExportHex(), oldKey.ExportHex()},
+				KeyNotAfter: map[string]time.Time{
+					"k4.public." + base64.RawURLEncoding.EncodeToString(oldKey.ExportBytes()): past,
+				},
+			},
+			expStale: true,
+		},
+		{
+			name: "ok/unknown_id",
+			config: PasetoAuth{
+				Key:         newKey.ExportHex(),
+				KeyNotAfter: map[string]time.Time{oldID: past},
+				StaleKeys:   staleKeysReject,
+			},
+		},
+		{
+			name: "err/stale_rejected",
+			config: PasetoAuth{
+				Keys:        []string{newKey.ExportHex(), oldKey.ExportHex()},
+				KeyNotAfter: map[string]time.Time{oldID: past},
+				StaleKeys:   staleKeysReject,
+			},
+			expErr: "key " + oldID + " is past its not_after time",
+		},
+		{
+			name: "err/id_version_mismatch",
+			config: PasetoAuth{
+				Key:         newKey.ExportHex(),
+				KeyNotAfter: map[string]time.Time{"k3.pid.abc": past},
+			},
+			expErr: "invalid key_not_after: key ID 'k3.pid.abc' doesn't match version 4 and purpose public; " +
+				"expected a 'k4.pid.' ID",
+		},
+		{
+			name: "err/invalid_key",
+			config: PasetoAuth{
+				Key:         newKey.ExportHex(),
+				KeyNotAfter: map[string]time.Time{"abc": past},
+			},
+			expErr: "invalid key_not_after key",
+		},
+		{
+			name: "err/invalid_stale_keys",
+			config: PasetoAuth{
+				Key:         newKey.ExportHex(),
+				KeyNotAfter: map[string]time.Time{oldID: past},
+				StaleKeys:   "ignore",
+			},
+			expErr: "invalid stale_keys: 'ignore'",
+		},
+		{
+			name: "err/stale_keys_without_key_not_after",
+			config: PasetoAuth{
+				Key:       newKey.ExportHex(),
+				StaleKeys: staleKeysWarn,
+			},
+			expErr: "stale_keys requires key_not_after",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler := testutil.NewTestLogHandler()
+			tt.config.logger = slog.New(logHandler)
+			err := tt.config.Validate()
+			if tt.expErr != "" {
+				require.ErrorContains(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expStale,
+				logHandler.HasRecord(slog.LevelWarn, "key is past its not_after time, it should be rotated"))
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateStaleKey(t *testing.T) {
+	privateKey := paseto.NewV4AsymmetricSecretKey()
+	keyHex := privateKey.Public().ExportHex()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:         keyHex,
+		FromQuery:   []string{"token"},
+		KeyNotAfter: map[string]time.Time{testKeyID(t, keyHex): time.Now().Add(time.Hour)},
+		logger:      slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(privateKey, nil)
+
+	authenticate := func() {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		assert.True(t, authenticated)
+	}
+
+	const staleMsg = "token verified with a key past its not_after time, it should be rotated"
+	authenticate()
+	assert.False(t, logHandler.HasRecord(slog.LevelWarn, staleMsg))
+
+	// The key becomes stale while it's in use.
+	for _, sk := range auth.keys.current().stale {
+		sk.notAfter = time.Now().Add(-time.Second)
+	}
+
+	authenticate()
+	authenticate()
+	var count int
+	for _, record := range logHandler.Records() {
+		if record.Message == staleMsg {
+			count++
+		}
+	}
+	assert.Equal(t, 1, count)
+}
+
+func TestPasetoAuth_AuthenticateStaleKeyFile(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	newKey := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	keyPath := filepath.Join(t.TempDir(), "paseto.key")
+	require.NoError(t, os.WriteFile(keyPath, []byte(newKey), 0o600))
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		KeyFile:         keyPath,
+		KeyFileInterval: time.Nanosecond,
+		KeyNotAfter:     map[string]time.Time{testKeyID(t, oldKey): time.Now().Add(-time.Hour)},
+		StaleKeys:       staleKeysReject,
+		logger:          slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	// Rolling back to a stale key is rejected, and the current key is kept.
+	modTime := time.Now().Add(time.Second)
+	require.NoError(t, os.WriteFile(keyPath, []byte(oldKey), 0o600))
+	require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+	auth.refreshKeys()
+
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "is past its not_after time"))
+	keys := auth.keys.current().keys
+	require.Len(t, keys, 1)
+	assert.Equal(t, newKey, keys[0].ExportHex())
+}
+
+// testKeyID returns the PASERK ID of the v4 public key.
+func testKeyID(t *testing.T, keyHex string) string {
+	t.Helper()
+	key, err := loadKey(keyHex, "", paseto.Version4, paseto.Public, xpaseto.KeyTypePublic)
+	require.NoError(t, err)
+	id, err := paserkID(key, paseto.Version4, paseto.Public)
+	require.NoError(t, err)
+	return id
+}
@@ -0,0 +1,137 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Names of the key sources, used in KeyFailover, logs and metric labels.
+const (
+	keySourceKey      = "key"
+	keySourceFile     = "key_file"
+	keySourceURL      = "key_url"
+	keySourceRotation = "key_rotation"
+	keySourceStorage  = "key_storage"
+	keySourceAWS      = "key_aws"
+	keySourceGCP      = "key_gcp"
+	keySourceKeys     = "keys"
+)
+
+// validateKeyFailover checks that KeyFailover lists at least two configured key
+// sources, each at most once.
+func (p *PasetoAuth) validateKeyFailover() error {
+	if len(p.KeyFailover) == 0 {
+		return nil
+	}
+	if len(p.KeyFailover) < 2 {
+		return errors.New("invalid key_failover: expected at least two key sources")
+	}
+
+	configured := map[string]bool{
+		keySourceKey:      p.Key != "",
+		keySourceFile:     p.KeyFile != "",
+		keySourceURL:      p.KeyURL != "",
+		keySourceRotation: p.KeyRotation != nil,
+		keySourceStorage:  p.KeyStorage != nil,
+		keySourceAWS:      p.KeyAWS != nil,
+		keySourceGCP:      p.KeyGCP != nil,
+		keySourceKeys:     len(p.Keys) > 0,
+	}
+	for i, name := range p.KeyFailover {
+		set, ok := configured[name]
+		switch {
+		case !ok:
+			return fmt.Errorf("invalid key_failover: unknown key source '%s'", name)
+		case !set:
+			return fmt.Errorf("invalid key_failover: key source '%s' is not configured", name)
+		case slices.Contains(p.KeyFailover[:i], name):
+			return fmt.Errorf("invalid key_failover: duplicate key source '%s'", name)
+		}
+	}
+
+	return nil
+}
+
+// setFailed marks the key source as failed or recovered.
+func (s *keySources) setFailed(name string, failed bool) {
+	s.failed = slices.DeleteFunc(slices.Clone(s.failed), func(n string) bool { return n == name })
+	if failed {
+		s.failed = append(s.failed, name)
+	}
+}
+
+// activeKeySource returns the first KeyFailover source that hasn't failed. If
+// all of them failed, the current active source is kept, since its last valid
+// keys are better than none.
+func (p *PasetoAuth) activeKeySource(src keySources) string {
+	for _, name := range p.KeyFailover {
+		if !slices.Contains(src.failed, name) {
+			return name
+		}
+	}
+	return src.active
+}
+
+// usesKeySource reports whether the keys of the source are loaded, i.e. if it's
+// not a KeyFailover source, or if it's the active one.
+func (p *PasetoAuth) usesKeySource(src keySources, name string) bool {
+	return !slices.Contains(p.KeyFailover, name) || src.active == name
+}
+
+// keySourceFailed marks a KeyFailover source as failed after a refresh error,
+// which fails over to the next source, if it was the active one. The source is
+// reset, so that its keys are loaded again, and it's marked as recovered, once
+// it can be refreshed, even if it hasn't changed.
+func (p *PasetoAuth) keySourceFailed(name string) {
+	if !slices.Contains(p.KeyFailover, name) {
+		return
+	}
+
+	switch name {
+	case keySourceFile:
+		p.keys.file.reset()
+	case keySourceURL:
+		p.keys.remote.reset()
+	case keySourceRotation:
+		p.keys.rotation.reset()
+	case keySourceStorage:
+		p.keys.stored.reset()
+	case keySourceAWS:
+		p.keys.aws.reset()
+	case keySourceGCP:
+		p.keys.gcp.reset()
+	}
+	if err := p.updateKeys(func(s *keySources) { s.setFailed(name, true) }); err != nil {
+		p.logger.Error(err.Error(), "key_source", name)
+	}
+}
+
+// switchKeySource logs and records a change of the active KeyFailover source.
+func (p *PasetoAuth) switchKeySource(from, to string) {
+	if from == to {
+		return
+	}
+	p.metrics.setKeySourceActive(from, to)
+
+	switch {
+	case from == "":
+		p.logger.Info("using key source", "key_source", to)
+	case slices.Index(p.KeyFailover, to) > slices.Index(p.KeyFailover, from):
+		p.logger.Warn("key source failed, failing over to the next key source", "from", from, "to", to)
+	default:
+		p.logger.Info("key source recovered, switching back to it", "from", from, "to", to)
+	}
+}
+
+// releaseKeySource removes the active KeyFailover source from the metrics, once
+// the keys are no longer used.
+func (p *PasetoAuth) releaseKeySource() {
+	if p.keys == nil {
+		return
+	}
+	p.keys.mu.Lock()
+	defer p.keys.mu.Unlock()
+	p.metrics.setKeySourceActive(p.keys.sources.active, "")
+	p.keys.sources.active = ""
+}
@@ -0,0 +1,166 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateKeyFailover(t *testing.T) {
+	fileKey := paseto.NewV4AsymmetricSecretKey()
+	fallbackKey := paseto.NewV4AsymmetricSecretKey()
+
+	keyPath := filepath.Join(t.TempDir(), "paseto.key")
+	writeKey := func() {
+		require.NoError(t, os.WriteFile(keyPath, []byte(fileKey.Public().ExportHex()), 0o600))
+	}
+	writeKey()
+
+	reg := prometheus.NewPedanticRegistry()
+	m, err := newMetrics(reg)
+	require.NoError(t, err)
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		KeyFile:         keyPath,
+		KeyFileInterval: time.Nanosecond,
+		Keys:            []string{fallbackKey.Public().ExportHex()},
+		KeyFailover:     []string{keySourceFile, keySourceKeys},
+		FromQuery:       []string{"token"},
+		metrics:         m,
+		logger:          slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	authenticate := func(key paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	// Only the keys of the first source are used.
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "using key source"))
+	assert.True(t, authenticate(fileKey))
+	assert.False(t, authenticate(fallbackKey))
+	assert.Equal(t, map[string]float64{keySourceFile: 1}, gatherKeySources(t, reg))
+
+	// A failed refresh fails over to the next source.
+	require.NoError(t, os.Remove(keyPath))
+	assert.True(t, authenticate(fallbackKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "key source failed, failing over to the next key source"))
+	assert.False(t, authenticate(fileKey))
+	assert.Equal(t, map[string]float64{keySourceFile: 0, keySourceKeys: 1}, gatherKeySources(t, reg))
+
+	// The first source is used again once it recovers, even if its key
+	// didn't change.
+	writeKey()
+	assert.True(t, authenticate(fileKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "key source recovered, switching back to it"))
+	assert.False(t, authenticate(fallbackKey))
+	assert.Equal(t, map[string]float64{keySourceFile: 1, keySourceKeys: 0}, gatherKeySources(t, reg))
+
+	require.NoError(t, auth.Cleanup())
+	assert.Equal(t, map[string]float64{keySourceFile: 0, keySourceKeys: 0}, gatherKeySources(t, reg))
+}
+
+func TestPasetoAuth_ValidateKeyFailover(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	missingPath := filepath.Join(t.TempDir(), "missing.key")
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name: "ok/unavailable_source",
+			config: PasetoAuth{
+				KeyFile: missingPath, Keys: []string{key},
+				KeyFailover: []string{keySourceFile, keySourceKeys},
+			},
+		},
+		{
+			name:   "err/single_source",
+			config: PasetoAuth{Keys: []string{key}, KeyFailover: []string{keySourceKeys}},
+			expErr: "invalid key_failover: expected at least two key sources",
+		},
+		{
+			name: "err/unknown_source",
+			config: PasetoAuth{
+				Key: key, Keys: []string{key},
+				KeyFailover: []string{keySourceKey, "key_env"},
+			},
+			expErr: "invalid key_failover: unknown key source 'key_env'",
+		},
+		{
+			name:   "err/unconfigured_source",
+			config: PasetoAuth{Key: key, KeyFailover: []string{keySourceKey, keySourceKeys}},
+			expErr: "invalid key_failover: key source 'keys' is not configured",
+		},
+		{
+			name: "err/duplicate_source",
+			config: PasetoAuth{
+				Key: key, Keys: []string{key},
+				KeyFailover: []string{keySourceKey, keySourceKeys, keySourceKey},
+			},
+			expErr: "invalid key_failover: duplicate key source 'key'",
+		},
+		{
+			name: "err/all_unavailable",
+			config: PasetoAuth{
+				Key: key, KeyFile: missingPath, KeyURL: "http://127.0.0.1:1/keys",
+				KeyFailover: []string{keySourceFile, keySourceURL},
+			},
+			expErr: "all key_failover sources failed",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				assert.Equal(t, keySourceKeys, tt.config.keys.sources.active)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
+
+func gatherKeySources(t *testing.T, reg *prometheus.Registry) map[string]float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	sources := make(map[string]float64)
+	for _, family := range families {
+		if family.GetName() != metricsNamespace+"_key_sources_active" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			sources[metric.GetLabel()[0].GetValue()] = metric.GetGauge().GetValue()
+		}
+	}
+
+	return sources
+}
@@ -0,0 +1,44 @@
+package caddypaseto
+
+import (
+	"fmt"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// resolveKeyURLPins records the PASERK IDs of the keys in KeyURLPins. Keys
+// specified by value are loaded to compute their ID.
+func (p *PasetoAuth) resolveKeyURLPins() error {
+	if len(p.KeyURLPins) == 0 {
+		return nil
+	}
+
+	p.keyURLPins = make(map[string]bool, len(p.KeyURLPins))
+	for _, ref := range p.KeyURLPins {
+		id, err := p.resolveKeyRef(ref, "key_url_pins")
+		if err != nil {
+			return err
+		}
+		p.keyURLPins[id] = true
+	}
+
+	return nil
+}
+
+// checkKeyURLPin returns an error if keys from the key URL are pinned, and the
+// key isn't one of them, so that a compromised key server can't add its own
+// verification keys.
+func (p *PasetoAuth) checkKeyURLPin(key *xpaseto.Key) error {
+	if len(p.keyURLPins) == 0 {
+		return nil
+	}
+	id, err := paserkID(key, p.Version, p.Purpose)
+	if err != nil {
+		return err
+	}
+	if !p.keyURLPins[id] {
+		return fmt.Errorf("key %s is not pinned by key_url_pins", id)
+	}
+
+	return nil
+}
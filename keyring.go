@@ -0,0 +1,921 @@
+package caddypaseto
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// keySet is an immutable set of verification keys.
+type keySet struct {
+	// keys in the order they're tried.
+	keys []*xpaseto.Key
+	// byID maps the PASERK IDs to the keys.
+	byID map[string]*xpaseto.Key
+	// stale holds the keys with a not_after time, see staleKey.
+	stale map[*xpaseto.Key]*staleKey
+}
+
+func newKeySet(keys []*xpaseto.Key, ver paseto.Version, purpose paseto.Purpose) (*keySet, error) {
+	set := &keySet{keys: keys, byID: make(map[string]*xpaseto.Key, len(keys))}
+	for _, key := range keys {
+		kid, err := paserkID(key, ver, purpose)
+		if err != nil {
+			return nil, err
+		}
+		set.byID[kid] = key
+	}
+
+	return set, nil
+}
+
+// keySources is the last valid data of the dynamic key sources.
+type keySources struct {
+	file    string
+	remote  []string
+	rotated []string
+	stored  []string
+	aws     []string
+	gcp     []string
+	admin   adminKeySet
+	// failed holds the KeyFailover sources whose last refresh failed, and
+	// active is the KeyFailover source whose keys are used.
+	failed []string
+	active string
+}
+
+// keyRing holds the current key set, which is replaced atomically when any of
+// the dynamic key sources change.
+type keyRing struct {
+	set      atomic.Pointer[keySet]
+	file     *keyFile
+	remote   *keyURL
+	rotation *keyRotator
+	stored   *storedKeys
+	aws      *secretKeys
+	gcp      *secretKeys
+	// adminGen is the generation of the admin API keys in the key set.
+	adminGen atomic.Uint64
+	// published is the published keys document of the key set, see
+	// PublishKeys.
+	published atomic.Pointer[publishedKeysCache]
+
+	// mu serializes updates of the key set.
+	mu      sync.Mutex
+	sources keySources
+}
+
+func (kr *keyRing) current() *keySet {
+	return kr.set.Load()
+}
+
+// resolveKeyPlaceholders replaces the global placeholders in the key sources,
+// e.g. `{env.PASETO_KEY}`. Unknown placeholders, and placeholders that
+// evaluate to an empty value, e.g. unset environment variables, are errors.
+func (p *PasetoAuth) resolveKeyPlaceholders(repl *caddy.Replacer) error {
+	var err error
+	if p.Key, err = resolveKey(repl, "key", p.Key); err != nil {
+		return err
+	}
+	for i := range p.Keys {
+		if p.Keys[i], err = resolveKey(repl, fmt.Sprintf("keys[%d]", i), p.Keys[i]); err != nil {
+			return err
+		}
+	}
+	if p.KeyFile, err = resolveKey(repl, "key file", p.KeyFile); err != nil {
+		return err
+	}
+	if p.KeyCredential, err = resolveKey(repl, "key credential", p.KeyCredential); err != nil {
+		return err
+	}
+	if p.KeyURL, err = resolveKey(repl, "key URL", p.KeyURL); err != nil {
+		return err
+	}
+	if p.KeyPassword, err = resolveKey(repl, "key password", p.KeyPassword); err != nil {
+		return err
+	}
+	if kp := p.KeyPassphrase; kp != nil {
+		if kp.Passphrase, err = resolveKey(repl, "key passphrase", kp.Passphrase); err != nil {
+			return err
+		}
+		if kp.Salt, err = resolveKey(repl, "key passphrase salt", kp.Salt); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func resolveKey(repl *caddy.Replacer, name, value string) (string, error) {
+	resolved, err := repl.ReplaceOrErr(value, true, true)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %w", name, err)
+	}
+	return resolved, nil
+}
+
+// provisionKeys loads the initial key set.
+func (p *PasetoAuth) provisionKeys() error {
+	if p.KeyCredential != "" && p.KeyFile == "" {
+		path, err := findCredential(p.KeyCredential)
+		if err != nil {
+			return err
+		}
+		p.KeyFile = path
+	}
+	if p.KeyPassphrase != nil && p.Key == "" {
+		var err error
+		if p.Key, err = p.KeyPassphrase.provision(p.Version, p.Purpose); err != nil {
+			return err
+		}
+	}
+	if p.KeyMaster != nil {
+		if err := p.unwrapKeys(); err != nil {
+			return err
+		}
+	}
+
+	if p.Key == "" && p.KeyFile == "" && p.KeyURL == "" && p.KeyRotation == nil && p.KeyStorage == nil &&
+		p.KeyAWS == nil && p.KeyGCP == nil && len(p.Keys) == 0 && len(p.IssuerKeys) == 0 {
+		return fmt.Errorf("key is empty")
+	}
+	if err := p.resolveKeyNotAfter(); err != nil {
+		return err
+	}
+	if err := p.resolveKeyURLPins(); err != nil {
+		return err
+	}
+	if err := p.validateKeyFailover(); err != nil {
+		return err
+	}
+
+	p.keys = &keyRing{}
+	var (
+		src keySources
+		err error
+	)
+	// The config can be loaded while a KeyFailover source is unavailable, as
+	// long as one of them can be loaded.
+	tolerate := func(name string, srcErr error) error {
+		if srcErr == nil || !slices.Contains(p.KeyFailover, name) {
+			return srcErr
+		}
+		p.logger.Warn(srcErr.Error(), "key_source", name)
+		src.setFailed(name, true)
+		return nil
+	}
+	if p.KeyFile != "" {
+		if p.KeyFileInterval < 0 {
+			return fmt.Errorf("invalid key file interval: '%s'", p.KeyFileInterval)
+		} else if p.KeyFileInterval == 0 {
+			p.KeyFileInterval = 30 * time.Second
+		}
+		switch p.KeyFileCheck {
+		case "":
+			p.KeyFileCheck = keyFileCheckModTime
+		case keyFileCheckModTime, keyFileCheckContent:
+		default:
+			return fmt.Errorf("invalid key file check: '%s'", p.KeyFileCheck)
+		}
+		p.keys.file = &keyFile{desc: "key file", path: p.KeyFile, interval: p.KeyFileInterval, check: p.KeyFileCheck}
+		if p.KeyFileSOPS != nil {
+			if err = p.KeyFileSOPS.provision(); err != nil {
+				return err
+			}
+			p.keys.file.decrypt = func(path string) ([]byte, error) {
+				return p.KeyFileSOPS.decrypt(p.moduleContext(), path)
+			}
+		}
+
+		src.file, _, err = p.keys.file.poll(time.Now())
+		if err = tolerate(keySourceFile, err); err != nil {
+			return err
+		}
+	}
+
+	if p.KeyURL != "" {
+		if p.keys.remote, err = p.newKeyURL(); err != nil {
+			return err
+		}
+		src.remote, _, err = p.keys.remote.fetch(p.moduleContext())
+		if err = tolerate(keySourceURL, err); err != nil {
+			return err
+		}
+	}
+
+	if p.KeyRotation != nil {
+		p.keys.rotation, err = newKeyRotator(p.KeyRotation, p.storage, p.Version, p.Purpose, p.logger)
+		if err != nil {
+			return err
+		}
+		src.rotated, _, err = p.keys.rotation.sync(p.moduleContext(), time.Now())
+		if err = tolerate(keySourceRotation, err); err != nil {
+			return err
+		}
+	}
+
+	if p.KeyStorage != nil {
+		if p.keys.stored, err = newStoredKeys(p.KeyStorage, p.storage, p.Version, p.Purpose); err != nil {
+			return err
+		}
+		src.stored, _, err = p.keys.stored.poll(p.moduleContext())
+		if err = tolerate(keySourceStorage, err); err != nil {
+			return err
+		}
+	}
+
+	if p.KeyAWS != nil {
+		if p.keys.aws, err = p.KeyAWS.newSecretKeys(); err != nil {
+			return err
+		}
+		src.aws, _, err = p.keys.aws.fetch(p.moduleContext())
+		if err = tolerate(keySourceAWS, err); err != nil {
+			return err
+		}
+	}
+
+	if p.KeyGCP != nil {
+		if p.keys.gcp, err = p.KeyGCP.newSecretKeys(); err != nil {
+			return err
+		}
+		src.gcp, _, err = p.keys.gcp.fetch(p.moduleContext())
+		if err = tolerate(keySourceGCP, err); err != nil {
+			return err
+		}
+	}
+	if len(p.KeyFailover) > 0 && len(src.failed) == len(p.KeyFailover) {
+		return errors.New("all key_failover sources failed")
+	}
+
+	var adminGen uint64
+	if p.AdminKeys {
+		if p.adminKeys == nil {
+			p.adminKeys = sharedAdminKeys
+		}
+		src.admin, adminGen = p.adminKeys.get(p.Version, p.Purpose)
+	}
+	if err = p.updateKeys(func(s *keySources) { *s = src }); err != nil {
+		return err
+	}
+	p.keys.adminGen.Store(adminGen)
+
+	return nil
+}
+
+// updateKeys applies the update to the key sources, and replaces the key set
+// if the resulting keys are valid.
+func (p *PasetoAuth) updateKeys(update func(*keySources)) error {
+	p.keys.mu.Lock()
+	defer p.keys.mu.Unlock()
+
+	src := p.keys.sources
+	update(&src)
+	src.active = p.activeKeySource(src)
+	set, err := p.loadKeys(src)
+	if err != nil {
+		return err
+	}
+	if err = p.checkStaleKeys(set, time.Now()); err != nil {
+		return err
+	}
+	p.switchKeySource(p.keys.sources.active, src.active)
+	p.keys.sources = src
+	p.keys.set.Store(set)
+
+	return nil
+}
+
+// refreshKeys replaces the key set if any of the dynamic key sources changed.
+// The key URL is fetched in the background, so the request isn't delayed. If
+// the new keys are invalid, the current key set is kept.
+func (p *PasetoAuth) refreshKeys() {
+	// The keys of an issuer are refreshed by the provider of the issuer.
+	if p.issuer != nil {
+		p.issuer.refreshKeys()
+		return
+	}
+
+	// Keys added via the admin API are applied synchronously, so that an
+	// emergency rotation takes effect with the next request.
+	if p.adminKeys != nil && p.adminKeys.generation() != p.keys.adminGen.Load() {
+		p.refreshAdminKeys()
+	}
+	now := time.Now()
+	if p.keys.file != nil {
+		p.refreshKeyFile(now)
+	}
+	if p.keys.remote != nil && p.keys.remote.due(now) {
+		go p.refreshKeyURL()
+	}
+	if p.keys.rotation != nil && p.keys.rotation.due(now) {
+		go p.refreshKeyRotation()
+	}
+	if p.keys.stored != nil && p.keys.stored.due(now) {
+		go p.refreshKeyStorage()
+	}
+	if p.keys.aws != nil && p.keys.aws.due(now) {
+		go p.refreshKeyAWS()
+	}
+	if p.keys.gcp != nil && p.keys.gcp.due(now) {
+		go p.refreshKeyGCP()
+	}
+}
+
+// expediteKeyURL refreshes the keys from the key URL early, after a token with
+// an unknown key ID was seen.
+func (p *PasetoAuth) expediteKeyURL() {
+	if p.keys.remote == nil || !p.keys.remote.expedite(time.Now()) {
+		return
+	}
+	p.refreshKeys()
+}
+
+func (p *PasetoAuth) refreshKeyFile(now time.Time) {
+	data, changed, err := p.keys.file.poll(now)
+	if err != nil {
+		p.logger.Warn(err.Error(), "path", p.KeyFile)
+		p.keySourceFailed(keySourceFile)
+		return
+	}
+	if !changed {
+		return
+	}
+
+	err = p.updateKeys(func(s *keySources) {
+		s.file = data
+		s.setFailed(keySourceFile, false)
+	})
+	if err != nil {
+		p.keys.file.reset()
+		p.logger.Warn(err.Error(), "path", p.KeyFile)
+		p.keySourceFailed(keySourceFile)
+		return
+	}
+	p.logger.Info("reloaded key file", "path", p.KeyFile)
+}
+
+func (p *PasetoAuth) refreshKeyURL() {
+	keys, changed, err := p.keys.remote.fetch(p.moduleContext())
+	if err == nil && changed {
+		err = p.updateKeys(func(s *keySources) {
+			s.remote = keys
+			s.setFailed(keySourceURL, false)
+		})
+		if err != nil {
+			p.keys.remote.reset()
+		}
+	}
+	p.keys.remote.breaker.record(err, time.Now())
+	if err != nil {
+		p.keyURLFailed(err)
+		if !errors.Is(err, context.Canceled) {
+			p.keySourceFailed(keySourceURL)
+		}
+		return
+	}
+	if !changed {
+		return
+	}
+	p.logger.Info("reloaded keys from URL", "url", p.KeyURL)
+}
+
+// keyURLFailed keeps or drops the key URL keys after a failed refresh,
+// depending on KeyURLOutage.
+func (p *PasetoAuth) keyURLFailed(err error) {
+	failures, nextFetch := p.keys.remote.retry()
+	logger := p.logger.With("url", p.KeyURL, "key_url_outage", p.KeyURLOutage,
+		"failures", failures, "next_fetch", nextFetch)
+	if p.KeyURLOutage != keyURLOutageReject || errors.Is(err, context.Canceled) {
+		logger.Warn(err.Error())
+		return
+	}
+
+	// The document validators are cleared, so that the keys are loaded again
+	// once the document can be fetched, even if it hasn't changed.
+	p.keys.remote.reset()
+	var dropped bool
+	dropErr := p.updateKeys(func(s *keySources) {
+		dropped = len(s.remote) > 0
+		s.remote = nil
+	})
+	switch {
+	case dropErr != nil:
+		logger.Error(err.Error()+"; failed dropping the key URL keys", "error", dropErr)
+	case dropped:
+		logger.Error(err.Error() + "; rejecting tokens of the key URL keys until the keys are fetched again")
+	default:
+		logger.Warn(err.Error())
+	}
+}
+
+func (p *PasetoAuth) refreshKeyRotation() {
+	keys, changed, err := p.keys.rotation.sync(p.moduleContext(), time.Now())
+	if err == nil && changed {
+		err = p.updateKeys(func(s *keySources) {
+			s.rotated = keys
+			s.setFailed(keySourceRotation, false)
+		})
+		if err != nil {
+			p.keys.rotation.reset()
+		}
+	}
+	if err != nil {
+		p.logger.Warn(err.Error(), "key_rotation", p.KeyRotation.Name)
+		p.keySourceFailed(keySourceRotation)
+		return
+	}
+	if !changed {
+		return
+	}
+	p.logger.Info("reloaded rotated keys", "key_rotation", p.KeyRotation.Name)
+}
+
+// loadKeys loads the admin API keys, Key, the key in the key file, the keys
+// from the key URL, the rotated keys, the stored keys, the KeyAWS keys, the
+// KeyGCP keys, and Keys, in that order.
+// If the admin API keys replace the configured keys, only they are loaded. Of
+// the KeyFailover sources, only the keys of the active one are loaded.
+func (p *PasetoAuth) loadKeys(src keySources) (*keySet, error) {
+	keyType := p.keyType()
+
+	keys := make([]*xpaseto.Key, 0, len(src.admin.keys)+len(p.Keys)+len(src.remote)+len(src.rotated)+len(src.stored)+
+		len(src.aws)+len(src.gcp)+2)
+	for i, data := range src.admin.keys {
+		key, err := loadKey(data, "", p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid admin API keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	if src.admin.replace {
+		return p.newKeySet(keys)
+	}
+
+	// Key and Keys are loaded even if they're not used, so that invalid keys
+	// are reported before a failover to them.
+	if p.Key != "" {
+		key, err := loadKey(p.Key, p.KeyPassword, p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, err
+		}
+		if p.usesKeySource(src, keySourceKey) {
+			keys = append(keys, key)
+		}
+	}
+	if p.KeyFile != "" && p.usesKeySource(src, keySourceFile) {
+		key, err := loadKey(strings.TrimSpace(src.file), p.KeyPassword, p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key file: %w", err)
+		}
+		keys = append(keys, key)
+	}
+	for i, data := range src.remote {
+		if !p.usesKeySource(src, keySourceURL) {
+			break
+		}
+		key, err := loadKey(data, p.KeyPassword, p.Version, p.Purpose, keyType)
+		if err == nil {
+			err = p.checkKeyURLPin(key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid key URL keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	for i, data := range src.rotated {
+		if !p.usesKeySource(src, keySourceRotation) {
+			break
+		}
+		key, err := loadKey(data, "", p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rotated keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	for i, data := range src.stored {
+		if !p.usesKeySource(src, keySourceStorage) {
+			break
+		}
+		key, err := loadKey(data, "", p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid stored keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	for i, data := range src.aws {
+		if !p.usesKeySource(src, keySourceAWS) {
+			break
+		}
+		key, err := loadKey(data, p.KeyPassword, p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key_aws keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	for i, data := range src.gcp {
+		if !p.usesKeySource(src, keySourceGCP) {
+			break
+		}
+		key, err := loadKey(data, p.KeyPassword, p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key_gcp keys[%d]: %w", i, err)
+		}
+		keys = append(keys, key)
+	}
+	for i, data := range p.Keys {
+		key, err := loadKey(data, p.KeyPassword, p.Version, p.Purpose, keyType)
+		if err != nil {
+			return nil, fmt.Errorf("invalid keys[%d]: %w", i, err)
+		}
+		if p.usesKeySource(src, keySourceKeys) {
+			keys = append(keys, key)
+		}
+	}
+
+	return p.newKeySet(keys)
+}
+
+// newKeySet returns the key set of the keys, once they passed the self-test.
+func (p *PasetoAuth) newKeySet(keys []*xpaseto.Key) (*keySet, error) {
+	set, err := newKeySet(keys, p.Version, p.Purpose)
+	if err != nil {
+		return nil, err
+	}
+	for id, key := range set.byID {
+		if err = selfTestKey(key, p.Version, p.Purpose); err != nil {
+			return nil, fmt.Errorf("invalid key %s: %w", id, err)
+		}
+	}
+	set.stale = p.staleKeys(set)
+
+	return set, nil
+}
+
+// Key file check modes.
+const (
+	keyFileCheckModTime = "mtime"
+	keyFileCheckContent = "content"
+)
+
+// keyFile is a key file that's polled for changes. It's also used for other
+// polled files, e.g. list files.
+type keyFile struct {
+	// desc describes the file in errors, e.g. "key file".
+	desc     string
+	path     string
+	interval time.Duration
+	check    string
+	// decrypt returns the decrypted contents of the file, if it's encrypted.
+	decrypt func(path string) ([]byte, error)
+
+	mu        sync.Mutex
+	nextCheck time.Time
+	modTime   time.Time
+	size      int64
+	digest    [sha256.Size]byte
+}
+
+// poll reads the file if it changed since the last successful read, and the
+// check interval has elapsed. It returns false if the file didn't change. It
+// doesn't block if another goroutine is already polling the file.
+//
+// Depending on the check mode, changes are detected either by comparing the
+// modification time and size of the file, or by reading the file and comparing
+// the digest of its contents, in case the file system doesn't report accurate
+// modification times.
+func (kf *keyFile) poll(now time.Time) (string, bool, error) {
+	if !kf.mu.TryLock() {
+		return "", false, nil
+	}
+	defer kf.mu.Unlock()
+
+	if now.Before(kf.nextCheck) {
+		return "", false, nil
+	}
+	kf.nextCheck = now.Add(kf.interval)
+
+	if kf.check == keyFileCheckContent {
+		return kf.pollContent()
+	}
+
+	info, err := os.Stat(kf.path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed reading %s: %w", kf.desc, err)
+	}
+	if info.ModTime().Equal(kf.modTime) && info.Size() == kf.size {
+		return "", false, nil
+	}
+
+	data, err := os.ReadFile(kf.path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed reading %s: %w", kf.desc, err)
+	}
+	if data, err = kf.decrypted(data); err != nil {
+		return "", false, err
+	}
+	kf.modTime, kf.size = info.ModTime(), info.Size()
+
+	return string(data), true, nil
+}
+
+func (kf *keyFile) pollContent() (string, bool, error) {
+	data, err := os.ReadFile(kf.path)
+	if err != nil {
+		return "", false, fmt.Errorf("failed reading %s: %w", kf.desc, err)
+	}
+	digest := sha256.Sum256(data)
+	if digest == kf.digest {
+		return "", false, nil
+	}
+	if data, err = kf.decrypted(data); err != nil {
+		return "", false, err
+	}
+	kf.digest = digest
+
+	return string(data), true, nil
+}
+
+// decrypted returns the decrypted contents of the file, if it's encrypted, or
+// else data. The change of the file is only recorded once it's decrypted, so
+// that a failed decryption is retried on the next poll.
+func (kf *keyFile) decrypted(data []byte) ([]byte, error) {
+	if kf.decrypt == nil {
+		return data, nil
+	}
+	return kf.decrypt(kf.path)
+}
+
+// reset makes the next poll read the file, even if it hasn't changed. It's used
+// when the file contents are invalid, e.g. if it was read while being written.
+func (kf *keyFile) reset() {
+	kf.mu.Lock()
+	defer kf.mu.Unlock()
+	kf.modTime, kf.size, kf.digest = time.Time{}, 0, [sha256.Size]byte{}
+}
+
+// maxKeyDocumentSize is the maximum size of the key URL response body.
+const maxKeyDocumentSize = 1 << 20
+
+// Values of PasetoAuth.KeyURLOutage.
+const (
+	keyURLOutageKeep   = "keep"
+	keyURLOutageReject = "reject"
+)
+
+// keyURLMinInterval is the minimum time between fetches of the key URL that
+// are made early because of a token with an unknown key ID, and the first
+// retry delay after a failed fetch.
+const keyURLMinInterval = 10 * time.Second
+
+// keyURL is a remote key document that's fetched periodically. The document is
+// either a single key, or a JSON object with a "keys" array.
+type keyURL struct {
+	url         string
+	interval    time.Duration
+	minInterval time.Duration
+	timeout     time.Duration
+	client      *http.Client
+	breaker     *breaker
+	// rootKey and signatureURL are set if the document must be signed, see
+	// KeyURLSignature.
+	rootKey      ed25519.PublicKey
+	signatureURL string
+
+	mu           sync.Mutex
+	nextCheck    time.Time
+	lastFetch    time.Time
+	fetching     bool
+	failures     int
+	etag         string
+	lastModified string
+}
+
+func (p *PasetoAuth) newKeyURL() (*keyURL, error) {
+	u, err := url.Parse(p.KeyURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key URL: %w", err)
+	}
+	if u.Scheme != "https" && (u.Scheme != "http" || !isLoopback(u.Hostname())) {
+		return nil, fmt.Errorf("invalid key URL '%s': must be an HTTPS URL, or an HTTP URL of a loopback host", p.KeyURL)
+	}
+
+	if p.KeyURLInterval < 0 {
+		return nil, fmt.Errorf("invalid key URL interval: '%s'", p.KeyURLInterval)
+	} else if p.KeyURLInterval == 0 {
+		p.KeyURLInterval = 5 * time.Minute
+	}
+	switch p.KeyURLOutage {
+	case "":
+		p.KeyURLOutage = keyURLOutageKeep
+	case keyURLOutageKeep, keyURLOutageReject:
+	default:
+		return nil, fmt.Errorf("invalid key_url_outage: '%s'", p.KeyURLOutage)
+	}
+	if p.KeyURLTimeout < 0 {
+		return nil, fmt.Errorf("invalid key URL timeout: '%s'", p.KeyURLTimeout)
+	} else if p.KeyURLTimeout == 0 {
+		p.KeyURLTimeout = 10 * time.Second
+	}
+
+	ku := &keyURL{
+		url:         p.KeyURL,
+		interval:    p.KeyURLInterval,
+		minInterval: min(keyURLMinInterval, p.KeyURLInterval),
+		timeout:     p.KeyURLTimeout,
+		client:      &http.Client{},
+		breaker:     newBreaker(backendKeyURL, p.CircuitBreaker, p.metrics),
+	}
+	if p.KeyURLSignature != nil {
+		if ku.rootKey, ku.signatureURL, err = p.KeyURLSignature.provision(u); err != nil {
+			return nil, err
+		}
+	}
+
+	return ku, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// due reports whether the document should be fetched, and if so, marks it as
+// being fetched, so that only one fetch is in progress at a time. It's not due
+// while the circuit breaker is open.
+func (ku *keyURL) due(now time.Time) bool {
+	ku.mu.Lock()
+	defer ku.mu.Unlock()
+	if ku.fetching || now.Before(ku.nextCheck) || !ku.breaker.allow(now) {
+		return false
+	}
+	ku.fetching = true
+	return true
+}
+
+// expedite moves the next check up to minInterval after the last fetch, and
+// reports whether the document is due now. It's used when a token has an
+// unknown key ID, which likely means that the keys were rotated. Fetching
+// early is cheap, since unchanged documents aren't downloaded again. After a
+// failed fetch, the backoff is kept, so that tokens can't make a failing key
+// server be fetched more often.
+func (ku *keyURL) expedite(now time.Time) bool {
+	ku.mu.Lock()
+	defer ku.mu.Unlock()
+	if next := ku.lastFetch.Add(ku.minInterval); ku.failures == 0 && next.Before(ku.nextCheck) {
+		ku.nextCheck = next
+	}
+	return !now.Before(ku.nextCheck)
+}
+
+// fetch fetches the key document, and returns its keys. It returns false if the
+// document hasn't changed since the last successful fetch, as determined by
+// the ETag and Last-Modified response headers.
+func (ku *keyURL) fetch(ctx context.Context) ([]string, bool, error) {
+	keys, changed, err := ku.download(ctx)
+
+	ku.mu.Lock()
+	defer ku.mu.Unlock()
+	ku.fetching = false
+	ku.lastFetch = time.Now()
+	switch {
+	case err == nil:
+		ku.failures = 0
+	case !errors.Is(err, context.Canceled):
+		ku.failures++
+	}
+	ku.nextCheck = ku.lastFetch.Add(ku.delay())
+
+	return keys, changed, err
+}
+
+// delay returns the time until the next fetch, which is the interval, or
+// after consecutive failures, an exponential backoff that starts at
+// minInterval and is capped at the interval. Up to 20% of it is subtracted at
+// random, so that instances started at the same time don't fetch in lockstep.
+func (ku *keyURL) delay() time.Duration {
+	d := ku.interval
+	if ku.failures > 0 {
+		d = min(d, ku.minInterval<<min(ku.failures-1, 20))
+	}
+	//nolint:gosec // the jitter doesn't need a secure random source
+	return d - rand.N(d/5+1)
+}
+
+// retry returns the amount of consecutive failed fetches, and the time of the
+// next fetch.
+func (ku *keyURL) retry() (int, time.Time) {
+	ku.mu.Lock()
+	defer ku.mu.Unlock()
+	return ku.failures, ku.nextCheck
+}
+
+func (ku *keyURL) download(ctx context.Context) ([]string, bool, error) {
+	ku.mu.Lock()
+	etag, lastModified := ku.etag, ku.lastModified
+	ku.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, ku.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ku.url, nil)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed fetching keys: %w", err)
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
+	resp, err := ku.client.Do(req)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed fetching keys: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return nil, false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, false, fmt.Errorf("failed fetching keys: unexpected status %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyDocumentSize+1))
+	if err != nil {
+		return nil, false, fmt.Errorf("failed fetching keys: %w", err)
+	}
+	if len(body) > maxKeyDocumentSize {
+		return nil, false, errors.New("failed fetching keys: response is too large")
+	}
+	// No key of the document is trusted before its signature is verified.
+	if ku.rootKey != nil {
+		if err = ku.verifySignature(ctx, body); err != nil {
+			return nil, false, err
+		}
+	}
+	keys, err := parseKeyDocument(body)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ku.mu.Lock()
+	ku.etag, ku.lastModified = resp.Header.Get("ETag"), resp.Header.Get("Last-Modified")
+	ku.mu.Unlock()
+
+	return keys, true, nil
+}
+
+// reset makes the next fetch ignore the cached document validators. It's used
+// when the document keys are invalid.
+func (ku *keyURL) reset() {
+	ku.mu.Lock()
+	defer ku.mu.Unlock()
+	ku.etag, ku.lastModified = "", ""
+}
+
+// parseKeyDocument parses a key document, which is either a single key, or a
+// JSON object with a "keys" array, e.g. `{"keys": ["k4.public.<key>"]}`.
+func parseKeyDocument(body []byte) ([]string, error) {
+	data := strings.TrimSpace(string(body))
+	if !strings.HasPrefix(data, "{") {
+		if data == "" {
+			return nil, errors.New("invalid key document: document is empty")
+		}
+		return []string{data}, nil
+	}
+
+	var doc struct {
+		Keys []string `json:"keys"`
+	}
+	if err := json.Unmarshal([]byte(data), &doc); err != nil {
+		return nil, fmt.Errorf("invalid key document: %w", err)
+	}
+	if len(doc.Keys) == 0 {
+		return nil, errors.New("invalid key document: keys are empty")
+	}
+
+	return doc.Keys, nil
+}
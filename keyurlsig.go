@@ -0,0 +1,115 @@
+package caddypaseto
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+)
+
+// maxKeyURLSignatureSize is the maximum size of a key document signature
+// response. A base64 encoded Ed25519 signature is 88 bytes.
+const maxKeyURLSignatureSize = 1 << 10
+
+// KeyURLSignature requires the KeyURL document to be signed with a pinned root
+// key, so that the keys it contains are only trusted if the document was
+// signed by the owner of the root key, even if the key server, or the
+// connection to it, is compromised. The signature is an Ed25519 signature over
+// the exact bytes of the document, served base64 encoded at URL. It's fetched
+// along with each changed document, and a document whose signature is missing
+// or invalid is rejected like a failed refresh, before any of its keys is
+// loaded.
+type KeyURLSignature struct {
+	// RootKey is the Ed25519 public key that signs the document, as a
+	// "k4.public" or "k2.public" PASERK key, or in hex. It's independent of the
+	// version of the tokens, and should be kept offline, e.g. by the team that
+	// distributes the keys.
+	RootKey string `json:"root_key"`
+
+	// URL is the HTTPS URL of the detached signature of the document. The
+	// default is the KeyURL, with a ".sig" suffix appended to the path. Plain
+	// HTTP is only allowed for loopback hosts.
+	URL string `json:"url,omitempty"`
+}
+
+// provision loads the root key, and returns it along with the signature URL.
+func (ks *KeyURLSignature) provision(keyURL *url.URL) (ed25519.PublicKey, string, error) {
+	ver := paseto.Version4
+	if strings.HasPrefix(ks.RootKey, "k2.") {
+		ver = paseto.Version2
+	}
+	key, err := loadKey(ks.RootKey, "", ver, paseto.Public, verificationKeyType(paseto.Public))
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid key_url_signature root key: %w", err)
+	}
+
+	sigURL := ks.URL
+	if sigURL == "" {
+		u := *keyURL
+		u.Path += ".sig"
+		u.RawPath = ""
+		sigURL = u.String()
+	}
+	u, err := url.Parse(sigURL)
+	if err != nil {
+		return nil, "", fmt.Errorf("invalid key_url_signature URL: %w", err)
+	}
+	if u.Scheme != "https" && (u.Scheme != "http" || !isLoopback(u.Hostname())) {
+		return nil, "", fmt.Errorf(
+			"invalid key_url_signature URL '%s': must be an HTTPS URL, or an HTTP URL of a loopback host", sigURL)
+	}
+
+	return ed25519.PublicKey(key.ExportBytes()), sigURL, nil
+}
+
+// verifySignature fetches the detached signature of the document, and returns
+// an error if it wasn't signed by the root key.
+func (ku *keyURL) verifySignature(ctx context.Context, doc []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ku.signatureURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed fetching key document signature: %w", err)
+	}
+	resp, err := ku.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed fetching key document signature: %w", err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed fetching key document signature: unexpected status %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxKeyURLSignatureSize+1))
+	if err != nil {
+		return fmt.Errorf("failed fetching key document signature: %w", err)
+	}
+	if len(body) > maxKeyURLSignatureSize {
+		return errors.New("failed fetching key document signature: response is too large")
+	}
+
+	sig, err := decodeSignature(strings.TrimSpace(string(body)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return errors.New("invalid key document signature: expected a base64 encoded Ed25519 signature")
+	}
+	if !ed25519.Verify(ku.rootKey, doc, sig) {
+		return errors.New("invalid key document signature: the document isn't signed by the root key")
+	}
+
+	return nil
+}
+
+// decodeSignature decodes a signature with any of the base64 encodings, with
+// or without padding.
+func decodeSignature(data string) ([]byte, error) {
+	data = strings.TrimRight(data, "=")
+	if strings.ContainsAny(data, "-_") {
+		return base64.RawURLEncoding.DecodeString(data) //nolint:wrapcheck // the caller reports the error
+	}
+	return base64.RawStdEncoding.DecodeString(data) //nolint:wrapcheck // the caller reports the error
+}
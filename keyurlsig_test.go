@@ -0,0 +1,151 @@
+package caddypaseto
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateKeyURLSignature(t *testing.T) {
+	rootPub, rootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	_, otherRootKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	key := paseto.NewV4AsymmetricSecretKey()
+	rogueKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	type signedDoc struct{ doc, sig string }
+	var current atomic.Pointer[signedDoc]
+	setDoc := func(k paseto.V4AsymmetricSecretKey, signer ed25519.PrivateKey) {
+		doc := `{"keys": ["` + k.Public().ExportHex() + `"]}`
+		sig := base64.StdEncoding.EncodeToString(ed25519.Sign(signer, []byte(doc)))
+		current.Store(&signedDoc{doc: doc, sig: sig})
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(current.Load().doc))
+	})
+	mux.HandleFunc("/keys.sig", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(current.Load().sig + "\n"))
+	})
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+
+	newAuth := func(logHandler slog.Handler, sig *KeyURLSignature) *PasetoAuth {
+		return &PasetoAuth{
+			KeyURL:          srv.URL + "/keys",
+			KeyURLSignature: sig,
+			FromQuery:       []string{"token"},
+			logger:          slog.New(logHandler),
+		}
+	}
+	rootPASERK := "k4.public." + base64.RawURLEncoding.EncodeToString(rootPub)
+
+	// A document signed by another key fails to load.
+	setDoc(key, otherRootKey)
+	require.ErrorContains(t, newAuth(testutil.NewTestLogHandler(), &KeyURLSignature{RootKey: rootPASERK}).Validate(),
+		"invalid key document signature: the document isn't signed by the root key")
+
+	// A missing signature fails to load.
+	require.ErrorContains(t, newAuth(testutil.NewTestLogHandler(), &KeyURLSignature{
+		RootKey: rootPASERK, URL: srv.URL + "/missing.sig",
+	}).Validate(), "failed fetching key document signature: unexpected status 404")
+
+	setDoc(key, rootKey)
+	logHandler := testutil.NewTestLogHandler()
+	auth := newAuth(logHandler, &KeyURLSignature{RootKey: hex.EncodeToString(rootPub)})
+	require.NoError(t, auth.Validate())
+
+	authenticate := func(k paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(k, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+	assert.True(t, authenticate(key))
+
+	// A document that isn't signed by the root key is rejected, and the keys
+	// of the last signed document are kept.
+	setDoc(rogueKey, otherRootKey)
+	auth.refreshKeyURL()
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "the document isn't signed by the root key"))
+	assert.False(t, authenticate(rogueKey))
+	assert.True(t, authenticate(key))
+}
+
+func TestKeyURLSignature_Provision(t *testing.T) {
+	rootPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	rootHex := hex.EncodeToString(rootPub)
+
+	tests := []struct {
+		name   string
+		keyURL string
+		sig    KeyURLSignature
+		expURL string
+		expErr string
+	}{
+		{
+			name:   "ok/default_url",
+			keyURL: "https://id.example.com/paseto/keys?v=1",
+			sig:    KeyURLSignature{RootKey: rootHex},
+			expURL: "https://id.example.com/paseto/keys.sig?v=1",
+		},
+		{
+			name:   "ok/k2",
+			keyURL: "https://id.example.com/keys",
+			sig: KeyURLSignature{
+				RootKey: "k2.public." + base64.RawURLEncoding.EncodeToString(rootPub),
+				URL:     "https://cdn.example.com/keys.sig",
+			},
+			expURL: "https://cdn.example.com/keys.sig",
+		},
+		{
+			name:   "err/root_key",
+			keyURL: "https://id.example.com/keys",
+			sig:    KeyURLSignature{RootKey: "k4.public.abc"},
+			expErr: "invalid key_url_signature root key",
+		},
+		{
+			name:   "err/http",
+			keyURL: "https://id.example.com/keys",
+			sig:    KeyURLSignature{RootKey: rootHex, URL: "http://cdn.example.com/keys.sig"},
+			expErr: "invalid key_url_signature URL 'http://cdn.example.com/keys.sig': must be an HTTPS URL",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyURL, err := url.Parse(tt.keyURL)
+			require.NoError(t, err)
+			rootKey, sigURL, err := tt.sig.provision(keyURL)
+			if tt.expErr != "" {
+				require.ErrorContains(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expURL, sigURL)
+			assert.Equal(t, rootPub, rootKey)
+		})
+	}
+}
@@ -0,0 +1,315 @@
+package l4paseto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/mholt/caddy-l4/layer4"
+
+	caddypaseto "go.hackfix.me/caddy-paseto"
+)
+
+// Config is the configuration of the tokens of the connections, which is
+// shared by the matcher and the handler.
+type Config struct {
+	// Auth is the key and rule configuration of the tokens, with the options
+	// of the http.authentication.providers.paseto module. The options that
+	// only apply to HTTP requests are ignored, e.g. the token sources, or are
+	// rejected, e.g. http_signatures.
+	Auth *caddypaseto.PasetoAuth `json:"auth,omitempty"`
+
+	// Source is where the token is read from: "preface", a first line of
+	// "PASETO <token>", terminated by "\n" or "\r\n", or "proxy_protocol", a
+	// TLV of a PROXY protocol v2 header of one of the TrustedProxies. The
+	// default is "preface".
+	Source string `json:"source,omitempty"`
+
+	// TrustedProxies are the IP ranges, in CIDR notation, or "private_ranges"
+	// for all private IP ranges, of the proxies that are allowed to send a
+	// PROXY protocol header. It's required with the proxy_protocol source.
+	// Connections of other peers are rejected, so that clients can't spoof
+	// their address with a header of their own.
+	TrustedProxies []string `json:"trusted_proxies,omitempty"`
+
+	// TLVType is the type of the PROXY protocol v2 TLV of the token. The
+	// default is 0xE0, the first type of the custom range.
+	TLVType uint8 `json:"tlv_type,omitempty"`
+
+	// Timeout is how long reading the token may take, so that idle
+	// connections don't hold the route. The default is 5s.
+	Timeout time.Duration `json:"timeout,omitempty"`
+
+	trustedProxies []netip.Prefix
+}
+
+// Sources of the token.
+const (
+	sourcePreface       = "preface"
+	sourceProxyProtocol = "proxy_protocol"
+)
+
+// prefacePrefix is the start of the preface line, before the token.
+const prefacePrefix = "PASETO "
+
+// proxyV2Signature is the start of a PROXY protocol v2 header.
+const proxyV2Signature = "\r\n\r\n\x00\r\nQUIT\n"
+
+// proxyV2CustomTLVType is the first TLV type of the custom range of the PROXY
+// protocol v2.
+const proxyV2CustomTLVType = 0xE0
+
+// errNoToken is returned when the connection doesn't start with a token of the
+// config source.
+var errNoToken = errors.New("connection has no token")
+
+// errUntrustedProxy is returned when a connection of a peer that isn't one of
+// the trusted proxies uses the proxy_protocol source.
+var errUntrustedProxy = errors.New("connection isn't from a trusted proxy")
+
+func (c *Config) provision(ctx caddy.Context) error {
+	if c.Auth == nil {
+		return errors.New("no auth config")
+	}
+	switch c.Source {
+	case "":
+		c.Source = sourcePreface
+	case sourcePreface, sourceProxyProtocol:
+	default:
+		return fmt.Errorf("invalid source: '%s', must be '%s' or '%s'", c.Source, sourcePreface,
+			sourceProxyProtocol)
+	}
+	if c.Source == sourceProxyProtocol && len(c.TrustedProxies) == 0 {
+		return errors.New("no trusted_proxies, required with the proxy_protocol source")
+	}
+	for _, rng := range c.TrustedProxies {
+		var ranges []string
+		if rng == "private_ranges" {
+			ranges = caddyhttp.PrivateRangesCIDR()
+		} else {
+			ranges = []string{rng}
+		}
+		for _, cidr := range ranges {
+			prefix, err := caddyhttp.CIDRExpressionToPrefix(cidr)
+			if err != nil {
+				return fmt.Errorf("invalid trusted_proxies: %w", err)
+			}
+			c.trustedProxies = append(c.trustedProxies, prefix)
+		}
+	}
+	if c.TLVType == 0 {
+		c.TLVType = proxyV2CustomTLVType
+	}
+	if c.Timeout < 0 {
+		return fmt.Errorf("invalid timeout: '%s'", c.Timeout)
+	} else if c.Timeout == 0 {
+		c.Timeout = 5 * time.Second
+	}
+
+	var errs []error
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"http_signatures", c.Auth.HTTPSignatures != nil},
+		{"path_requirements", len(c.Auth.PathRequirements) > 0},
+		{"session_binding", c.Auth.SessionBinding != nil},
+		{"signed_url", c.Auth.SignedURL != nil},
+	} {
+		if opt.set {
+			errs = append(errs, fmt.Errorf("auth option %s can't be used with connections", opt.name))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return err
+	}
+
+	if err := c.Auth.Provision(ctx); err != nil {
+		return fmt.Errorf("failed provisioning auth: %w", err)
+	}
+	if err := c.Auth.Validate(); err != nil {
+		return fmt.Errorf("invalid auth: %w", err)
+	}
+
+	return nil
+}
+
+// cleanup releases the resources of the auth config, if it was provisioned.
+func (c *Config) cleanup() error {
+	if c.Auth == nil {
+		return nil
+	}
+	return c.Auth.Cleanup() //nolint:wrapcheck // Never fails.
+}
+
+// connToken is a token that was read from a connection.
+type connToken struct {
+	token string
+	// source is the source address of the PROXY protocol header, if any.
+	source net.Addr
+}
+
+// readToken reads the token from the start of the connection, within the
+// config timeout.
+func (c *Config) readToken(cx *layer4.Connection) (connToken, error) {
+	if err := cx.SetReadDeadline(time.Now().Add(c.Timeout)); err != nil {
+		return connToken{}, fmt.Errorf("failed setting read deadline: %w", err)
+	}
+	defer func() { _ = cx.SetReadDeadline(time.Time{}) }()
+
+	if c.Source == sourceProxyProtocol {
+		if !c.trustsPeer(cx.RemoteAddr()) {
+			return connToken{}, errUntrustedProxy
+		}
+		return readProxyToken(cx, c.TLVType)
+	}
+	token, err := readPrefaceToken(cx, c.Auth.MaxTokenLength)
+	return connToken{token: token}, err
+}
+
+// trustsPeer returns true if the address is in the trusted proxy ranges.
+func (c *Config) trustsPeer(addr net.Addr) bool {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return false
+	}
+	ip := addrPort.Addr().Unmap()
+	return slices.ContainsFunc(c.trustedProxies, func(prefix netip.Prefix) bool { return prefix.Contains(ip) })
+}
+
+// authenticate authenticates the user of the token, and sets the placeholders
+// of the user, as the authentication handler of the http app does.
+func (c *Config) authenticate(cx *layer4.Connection, ct connToken) (bool, error) {
+	remote := cx.RemoteAddr()
+	if ct.source != nil {
+		remote = ct.source
+	}
+	user, authenticated, err := c.Auth.AuthenticateToken(cx.Context, remote.String(), ct.token)
+	if err != nil || !authenticated {
+		return false, err //nolint:wrapcheck // Already has context.
+	}
+	setUserPlaceholders(cx, user)
+	cx.SetVar(authenticatedVarKey, ct.token)
+
+	return true, nil
+}
+
+// authenticatedVarKey is the connection variable of the token that was
+// authenticated, so that the handler doesn't authenticate the token a matcher
+// already authenticated again, which would count it twice, e.g. against the
+// rate limits.
+const authenticatedVarKey = "l4paseto.authenticated"
+
+// authenticated returns true if the token of the connection was already
+// authenticated.
+func authenticated(cx *layer4.Connection, ct connToken) bool {
+	token, ok := cx.GetVar(authenticatedVarKey).(string)
+	return ok && token == ct.token
+}
+
+// setUserPlaceholders sets the l4.paseto.user.id placeholder, and a
+// l4.paseto.user.<key> placeholder for each metadata key of the user.
+func setUserPlaceholders(cx *layer4.Connection, user caddyauth.User) {
+	repl, ok := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+	if !ok {
+		return
+	}
+	repl.Set("l4.paseto.user.id", user.ID)
+	for key, value := range user.Metadata {
+		repl.Set("l4.paseto.user."+key, value)
+	}
+}
+
+// readPrefaceToken reads the token of the preface line. The line is read one
+// byte at a time, so that the data after it is left for the next handler.
+func readPrefaceToken(r io.Reader, maxTokenLength int64) (string, error) {
+	prefix := make([]byte, len(prefacePrefix))
+	if _, err := io.ReadFull(r, prefix); err != nil || string(prefix) != prefacePrefix {
+		return "", errNoToken
+	}
+
+	// The token and the line terminator.
+	var line []byte
+	b := make([]byte, 1)
+	for int64(len(line)) <= maxTokenLength+1 {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", fmt.Errorf("failed reading preface: %w", err)
+		}
+		if b[0] == '\n' {
+			return strings.TrimSuffix(string(line), "\r"), nil
+		}
+		line = append(line, b[0])
+	}
+
+	return "", fmt.Errorf("preface exceeds the maximum token length of %d", maxTokenLength)
+}
+
+// readProxyToken reads a PROXY protocol v2 header, and returns the value of its
+// TLV of the type, and its source address.
+func readProxyToken(r io.Reader, tlvType uint8) (connToken, error) {
+	header := make([]byte, len(proxyV2Signature)+4)
+	if _, err := io.ReadFull(r, header); err != nil || !bytes.HasPrefix(header, []byte(proxyV2Signature)) {
+		return connToken{}, errNoToken
+	}
+	verCmd, family := header[12], header[13]
+	if verCmd>>4 != 2 {
+		return connToken{}, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return connToken{}, fmt.Errorf("failed reading PROXY protocol header: %w", err)
+	}
+
+	// The address block of the address family, which is followed by the TLVs.
+	var ct connToken
+	var addrLen int
+	switch family >> 4 {
+	case 0x1:
+		addrLen = 12
+		if len(body) >= addrLen {
+			ct.source = &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}
+		}
+	case 0x2:
+		addrLen = 36
+		if len(body) >= addrLen {
+			ct.source = &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}
+		}
+	case 0x3:
+		addrLen = 216
+	}
+	if len(body) < addrLen {
+		return connToken{}, errors.New("invalid PROXY protocol header: address block is truncated")
+	}
+	// The addresses of LOCAL commands, e.g. health checks of the proxy, are
+	// ignored.
+	if verCmd&0xF != 0x1 {
+		ct.source = nil
+	}
+
+	for tlvs := body[addrLen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return connToken{}, errors.New("invalid PROXY protocol header: TLV is truncated")
+		}
+		typ, length := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+length {
+			return connToken{}, errors.New("invalid PROXY protocol header: TLV is truncated")
+		}
+		if typ == tlvType {
+			ct.token = string(tlvs[3 : 3+length])
+			return ct, nil
+		}
+		tlvs = tlvs[3+length:]
+	}
+
+	return connToken{}, errNoToken
+}
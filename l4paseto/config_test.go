@@ -0,0 +1,285 @@
+package l4paseto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMain(m *testing.M) {
+	// The loggers of the module contexts need a loaded config.
+	err := caddy.Load([]byte(`{
+		"admin": {"disabled": true, "config": {"persist": false}},
+		"logging": {"logs": {"default": {"level": "ERROR"}}}
+	}`), true)
+	if err != nil {
+		panic(err)
+	}
+	code := m.Run()
+	_ = caddy.Stop()
+	os.Exit(code)
+}
+
+// provisionModule loads the module with the JSON config, as Caddy does, so that
+// it's provisioned with a module context.
+func provisionModule(t *testing.T, id string, config any) (any, error) {
+	t.Helper()
+	ctx, cancel := caddy.NewContext(caddy.ActiveContext())
+	t.Cleanup(cancel)
+	raw, err := json.Marshal(config)
+	require.NoError(t, err)
+
+	return ctx.LoadModuleByID(id, raw) //nolint:wrapcheck // Test helper.
+}
+
+// testConfig returns the JSON config of a module that verifies the tokens of
+// the key.
+func testConfig(key paseto.V4AsymmetricSecretKey, source string) map[string]any {
+	return map[string]any{
+		"auth":            map[string]any{"keys": []string{key.Public().ExportHex()}},
+		"source":          source,
+		"trusted_proxies": []string{"10.0.0.0/8"},
+	}
+}
+
+// newTestToken returns a token of the user, signed with the key.
+func newTestToken(key paseto.V4AsymmetricSecretKey, user string) string {
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject(user)
+	return token.V4Sign(key, nil)
+}
+
+// Remote addresses of the test connections.
+const (
+	trustedProxyAddr = "10.0.0.2:5000"
+	clientAddr       = "203.0.113.9:5000"
+)
+
+// remoteConn is a connection with a remote address.
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *remoteConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// newTestConn returns a layer4 connection from the remote address, whose client
+// writes the data, and closes the connection.
+func newTestConn(t *testing.T, remote string, data []byte) *layer4.Connection {
+	t.Helper()
+	server, client := net.Pipe()
+	t.Cleanup(func() {
+		_ = server.Close()
+		_ = client.Close()
+	})
+	go func() {
+		_, _ = client.Write(data)
+		_ = client.Close()
+	}()
+
+	return layer4.WrapConnection(&remoteConn{Conn: server, remote: net.TCPAddrFromAddrPort(
+		netip.MustParseAddrPort(remote))}, &bytes.Buffer{}, zap.NewNop())
+}
+
+// proxyHeader returns a PROXY protocol v2 header of a TCP over IPv4
+// connection from 192.0.2.1:4242 with the TLVs.
+func proxyHeader(cmd byte, tlvs map[byte]string) []byte {
+	body := append(net.IPv4(192, 0, 2, 1).To4(), net.IPv4(198, 51, 100, 1).To4()...)
+	body = binary.BigEndian.AppendUint16(body, 4242)
+	body = binary.BigEndian.AppendUint16(body, 443)
+	for typ, value := range tlvs {
+		body = append(body, typ)
+		body = binary.BigEndian.AppendUint16(body, uint16(len(value)))
+		body = append(body, value...)
+	}
+
+	header := append([]byte(proxyV2Signature), 0x20|cmd, 0x11)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(body)))
+	return append(header, body...)
+}
+
+func TestReadPrefaceToken(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expToken string
+		expErr   string
+	}{
+		{name: "ok/lf", data: "PASETO v4.public.token\nhello", expToken: "v4.public.token"},
+		{name: "ok/crlf", data: "PASETO v4.public.token\r\nhello", expToken: "v4.public.token"},
+		{name: "err/no_preface", data: "SSH-2.0-OpenSSH_9.6\r\n", expErr: errNoToken.Error()},
+		{name: "err/short", data: "PASE", expErr: errNoToken.Error()},
+		{name: "err/unterminated", data: "PASETO v4.public.token", expErr: "failed reading preface: EOF"},
+		{
+			name:   "err/too_long",
+			data:   "PASETO " + strings.Repeat("a", 32) + "\n",
+			expErr: "preface exceeds the maximum token length of 16",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, err := readPrefaceToken(strings.NewReader(tt.data), 16)
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expToken, token)
+		})
+	}
+}
+
+func TestReadProxyToken(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      []byte
+		expToken  string
+		expSource string
+		expErr    string
+	}{
+		{
+			name:      "ok/proxy",
+			data:      proxyHeader(0x1, map[byte]string{proxyV2CustomTLVType: "v4.public.token"}),
+			expToken:  "v4.public.token",
+			expSource: "192.0.2.1:4242",
+		},
+		{
+			name:     "ok/local",
+			data:     proxyHeader(0x0, map[byte]string{proxyV2CustomTLVType: "v4.public.token"}),
+			expToken: "v4.public.token",
+		},
+		{
+			name:   "err/no_tlv",
+			data:   proxyHeader(0x1, map[byte]string{0x01: "h2"}),
+			expErr: errNoToken.Error(),
+		},
+		{
+			name:   "err/no_header",
+			data:   []byte("PASETO v4.public.token\n........"),
+			expErr: errNoToken.Error(),
+		},
+		{
+			name:   "err/truncated_tlv",
+			data:   proxyHeader(0x1, map[byte]string{proxyV2CustomTLVType: "v4.public.token"})[:32],
+			expErr: "failed reading PROXY protocol header: unexpected EOF",
+		},
+		{
+			name:   "err/version",
+			data:   append([]byte(proxyV2Signature), 0x11, 0x11, 0, 0),
+			expErr: "unsupported PROXY protocol version 1",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ct, err := readProxyToken(bytes.NewReader(tt.data), proxyV2CustomTLVType)
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expToken, ct.token)
+			if tt.expSource == "" {
+				assert.Nil(t, ct.source)
+			} else {
+				assert.Equal(t, tt.expSource, ct.source.String())
+			}
+		})
+	}
+}
+
+func TestConfig_Provision(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	auth := testConfig(key, "")["auth"]
+	tests := []struct {
+		name   string
+		config map[string]any
+		expErr string
+	}{
+		{
+			name:   "ok/preface",
+			config: testConfig(key, ""),
+		},
+		{
+			name: "ok/proxy_protocol",
+			config: map[string]any{
+				"auth": auth, "source": "proxy_protocol", "trusted_proxies": []string{"private_ranges"},
+				"tlv_type": 0xE1, "timeout": time.Second,
+			},
+		},
+		{
+			name:   "err/no_trusted_proxies",
+			config: map[string]any{"auth": auth, "source": "proxy_protocol"},
+			expErr: "no trusted_proxies, required with the proxy_protocol source",
+		},
+		{
+			name: "err/trusted_proxies",
+			config: map[string]any{
+				"auth": auth, "source": "proxy_protocol", "trusted_proxies": []string{"10.0.0.0/33"},
+			},
+			expErr: "invalid trusted_proxies: ",
+		},
+		{
+			name:   "err/no_auth",
+			config: map[string]any{},
+			expErr: "no auth config",
+		},
+		{
+			name:   "err/source",
+			config: map[string]any{"auth": auth, "source": "header"},
+			expErr: "invalid source: 'header', must be 'preface' or 'proxy_protocol'",
+		},
+		{
+			name:   "err/timeout",
+			config: map[string]any{"auth": auth, "timeout": -time.Second},
+			expErr: "invalid timeout: '-1s'",
+		},
+		{
+			name: "err/http_options",
+			config: map[string]any{"auth": map[string]any{
+				"keys":            []string{key.Public().ExportHex()},
+				"http_signatures": map[string]any{},
+				"signed_url":      map[string]any{},
+			}},
+			expErr: "auth option http_signatures can't be used with connections\n" +
+				"auth option signed_url can't be used with connections",
+		},
+		{
+			name:   "err/auth",
+			config: map[string]any{"auth": map[string]any{}},
+			expErr: "invalid auth: ",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, id := range []string{"layer4.matchers.paseto", "layer4.handlers.paseto"} {
+			t.Run(tt.name+"/"+id, func(t *testing.T) {
+				_, err := provisionModule(t, id, tt.config)
+				if tt.expErr == "" {
+					require.NoError(t, err)
+					return
+				}
+				require.ErrorContains(t, err, tt.expErr)
+			})
+		}
+	}
+}
@@ -0,0 +1,6 @@
+// Package l4paseto contains modules of the layer4 app of caddy-l4, which
+// authenticate raw TCP connections using PASETO, with the key and rule
+// configuration of the caddy-paseto HTTP authentication provider. It's a
+// separate package, so that only Caddy builds that import it include the
+// layer4 app.
+package l4paseto
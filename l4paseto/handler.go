@@ -0,0 +1,89 @@
+package l4paseto
+
+import (
+	"errors"
+	"net"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+)
+
+func init() {
+	caddy.RegisterModule(Handler{})
+}
+
+// Handler authenticates the connections with the token they start with, which
+// it consumes, so that the backend only receives the data after it. The
+// connections that don't authenticate a user are closed. With the
+// proxy_protocol source, the PROXY protocol header is consumed as well, and
+// its source address becomes the remote address of the connection, as with
+// the proxy_protocol handler.
+//
+// If a paseto matcher of the route already authenticated the token, the
+// handler only consumes it, so that the token is authenticated once, e.g. for
+// the rate limits and the sessions. The matcher and the handler of a route
+// should then have the same auth config.
+type Handler struct {
+	Config
+}
+
+// Interface guards.
+var (
+	_ caddy.Provisioner  = (*Handler)(nil)
+	_ caddy.CleanerUpper = (*Handler)(nil)
+	_ layer4.NextHandler = (*Handler)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (Handler) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.handlers.paseto",
+		New: func() caddy.Module { return new(Handler) },
+	}
+}
+
+// Provision sets up the handler.
+func (h *Handler) Provision(ctx caddy.Context) error {
+	return h.provision(ctx)
+}
+
+// Cleanup releases the resources of the auth config, once the handler is
+// unloaded.
+func (h *Handler) Cleanup() error {
+	return h.cleanup()
+}
+
+// Handle authenticates the connection, and passes it to the next handler
+// without the token.
+func (h *Handler) Handle(cx *layer4.Connection, next layer4.Handler) error {
+	ct, err := h.readToken(cx)
+	if err != nil {
+		return err
+	}
+	if !authenticated(cx, ct) {
+		ok, authErr := h.authenticate(cx, ct)
+		if authErr != nil {
+			return authErr
+		}
+		if !ok {
+			return errors.New("connection isn't authenticated")
+		}
+	}
+
+	if ct.source != nil {
+		cx = cx.Wrap(&proxiedConn{Conn: cx.Conn, remote: ct.source})
+	}
+	return next.Handle(cx) //nolint:wrapcheck // Errors of the next handlers.
+}
+
+// proxiedConn is a connection with the source address of its PROXY protocol
+// header as the remote address.
+type proxiedConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+// RemoteAddr returns the source address of the PROXY protocol header.
+func (c *proxiedConn) RemoteAddr() net.Addr {
+	return c.remote
+}
@@ -0,0 +1,145 @@
+package l4paseto
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/mholt/caddy-l4/layer4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHandler returns a provisioned handler that verifies the tokens of the key.
+func newTestHandler(t *testing.T, key paseto.V4AsymmetricSecretKey, source string) *Handler {
+	t.Helper()
+	mod, err := provisionModule(t, "layer4.handlers.paseto", testConfig(key, source))
+	require.NoError(t, err)
+	m, ok := mod.(*Handler)
+	require.True(t, ok)
+
+	return m
+}
+
+func TestHandler_Handle(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	otherKey := paseto.NewV4AsymmetricSecretKey()
+	preface := newTestHandler(t, key, sourcePreface)
+	proxy := newTestHandler(t, key, sourceProxyProtocol)
+
+	tests := []struct {
+		name      string
+		handler   *Handler
+		remote    string
+		data      []byte
+		expRemote string
+		expErr    string
+	}{
+		{
+			name:      "ok/preface",
+			handler:   preface,
+			data:      []byte("PASETO " + newTestToken(key, "user123") + "\nhello"),
+			expRemote: clientAddr,
+		},
+		{
+			name:    "ok/proxy_protocol",
+			handler: proxy,
+			remote:  trustedProxyAddr,
+			data: append(proxyHeader(0x1, map[byte]string{proxyV2CustomTLVType: newTestToken(key, "user123")}),
+				"hello"...),
+			expRemote: "192.0.2.1:4242",
+		},
+		{
+			name:    "err/other_key",
+			handler: preface,
+			data:    []byte("PASETO " + newTestToken(otherKey, "user123") + "\nhello"),
+			expErr:  "connection isn't authenticated",
+		},
+		{
+			// A client that sends a PROXY protocol header of its own can't
+			// spoof its address.
+			name:    "err/untrusted_proxy",
+			handler: proxy,
+			data: append(proxyHeader(0x1, map[byte]string{proxyV2CustomTLVType: newTestToken(key, "user123")}),
+				"hello"...),
+			expErr: "connection isn't from a trusted proxy",
+		},
+		{
+			name:    "err/no_token",
+			handler: preface,
+			data:    []byte("hello"),
+			expErr:  "connection has no token",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := tt.remote
+			if remote == "" {
+				remote = clientAddr
+			}
+			cx := newTestConn(t, remote, tt.data)
+			var handled bool
+			err := tt.handler.Handle(cx, layer4.HandlerFunc(func(cx *layer4.Connection) error {
+				handled = true
+				assert.Equal(t, tt.expRemote, cx.RemoteAddr().String())
+				data := make([]byte, len("hello"))
+				_, err := io.ReadFull(cx, data)
+				require.NoError(t, err)
+				assert.Equal(t, "hello", string(data))
+				return nil
+			}))
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				assert.False(t, handled)
+				return
+			}
+			require.NoError(t, err)
+			assert.True(t, handled)
+		})
+	}
+}
+
+func TestHandler_HandleMatched(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	config := testConfig(key, sourcePreface)
+	config["auth"] = map[string]any{
+		"keys":       []string{key.Public().ExportHex()},
+		"rate_limit": map[string]any{"claim": "rpm"},
+	}
+	mod, err := provisionModule(t, "layer4.matchers.paseto", config)
+	require.NoError(t, err)
+	matcher, ok := mod.(*MatchPaseto)
+	require.True(t, ok)
+	mod, err = provisionModule(t, "layer4.handlers.paseto", config)
+	require.NoError(t, err)
+	handler, ok := mod.(*Handler)
+	require.True(t, ok)
+
+	// The token allows a single connection, so it must only be authenticated
+	// once by the matcher and the handler.
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("matched-user")
+	require.NoError(t, token.Set("rpm", 1))
+	cx := newTestConn(t, clientAddr, []byte("PASETO "+token.V4Sign(key, nil)+"\nhello"))
+
+	matched, err := layer4.MatcherSet{matcher}.Match(cx)
+	require.NoError(t, err)
+	require.True(t, matched)
+
+	var handled bool
+	err = handler.Handle(cx, layer4.HandlerFunc(func(cx *layer4.Connection) error {
+		handled = true
+		data := make([]byte, len("hello"))
+		_, err := io.ReadFull(cx, data)
+		require.NoError(t, err)
+		assert.Equal(t, "hello", string(data))
+		return nil
+	}))
+	require.NoError(t, err)
+	assert.True(t, handled)
+}
@@ -0,0 +1,61 @@
+package l4paseto
+
+import (
+	"errors"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(MatchPaseto{})
+}
+
+// MatchPaseto matches connections that start with a token which authenticates
+// a user. The connection is rewound after matching, so the token is still read
+// by the next matcher or handler, e.g. the paseto handler, which consumes it
+// without authenticating it again.
+type MatchPaseto struct {
+	Config
+}
+
+// Interface guards.
+var (
+	_ caddy.Provisioner  = (*MatchPaseto)(nil)
+	_ caddy.CleanerUpper = (*MatchPaseto)(nil)
+	_ layer4.ConnMatcher = (*MatchPaseto)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (MatchPaseto) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "layer4.matchers.paseto",
+		New: func() caddy.Module { return new(MatchPaseto) },
+	}
+}
+
+// Provision sets up the matcher.
+func (m *MatchPaseto) Provision(ctx caddy.Context) error {
+	return m.provision(ctx)
+}
+
+// Cleanup releases the resources of the auth config, once the matcher is
+// unloaded.
+func (m *MatchPaseto) Cleanup() error {
+	return m.cleanup()
+}
+
+// Match returns true if the connection starts with a token which authenticates
+// a user.
+func (m *MatchPaseto) Match(cx *layer4.Connection) (bool, error) {
+	ct, err := m.readToken(cx)
+	if err != nil {
+		if !errors.Is(err, errNoToken) {
+			cx.Logger.Debug("failed reading token", zap.Error(err))
+		}
+		return false, nil
+	}
+
+	return m.authenticate(cx, ct)
+}
@@ -0,0 +1,92 @@
+package l4paseto
+
+import (
+	"testing"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/mholt/caddy-l4/layer4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestMatcher returns a provisioned matcher that verifies the tokens of the key.
+func newTestMatcher(t *testing.T, key paseto.V4AsymmetricSecretKey, source string) *MatchPaseto {
+	t.Helper()
+	mod, err := provisionModule(t, "layer4.matchers.paseto", testConfig(key, source))
+	require.NoError(t, err)
+	m, ok := mod.(*MatchPaseto)
+	require.True(t, ok)
+
+	return m
+}
+
+func TestMatchPaseto_Match(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	otherKey := paseto.NewV4AsymmetricSecretKey()
+	preface := newTestMatcher(t, key, "")
+	proxy := newTestMatcher(t, key, sourceProxyProtocol)
+
+	tests := []struct {
+		name    string
+		matcher *MatchPaseto
+		remote  string
+		data    []byte
+		expUser string
+	}{
+		{
+			name:    "ok/preface",
+			matcher: preface,
+			data:    []byte("PASETO " + newTestToken(key, "user123") + "\r\nhello"),
+			expUser: "user123",
+		},
+		{
+			name:    "ok/proxy_protocol",
+			matcher: proxy,
+			remote:  trustedProxyAddr,
+			data: proxyHeader(0x1, map[byte]string{
+				0x01: "h2", proxyV2CustomTLVType: newTestToken(key, "user123"),
+			}),
+			expUser: "user123",
+		},
+		{
+			name:    "err/other_key",
+			matcher: preface,
+			data:    []byte("PASETO " + newTestToken(otherKey, "user123") + "\r\nhello"),
+		},
+		{
+			name:    "err/other_protocol",
+			matcher: preface,
+			data:    []byte("SSH-2.0-OpenSSH_9.6\r\n"),
+		},
+		{
+			name:    "err/no_tlv",
+			matcher: proxy,
+			remote:  trustedProxyAddr,
+			data:    proxyHeader(0x1, nil),
+		},
+		{
+			name:    "err/untrusted_proxy",
+			matcher: proxy,
+			data:    proxyHeader(0x1, map[byte]string{proxyV2CustomTLVType: newTestToken(key, "user123")}),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			remote := tt.remote
+			if remote == "" {
+				remote = clientAddr
+			}
+			cx := newTestConn(t, remote, tt.data)
+			matched, err := tt.matcher.Match(cx)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expUser != "", matched)
+
+			repl, ok := cx.Context.Value(layer4.ReplacerCtxKey).(*caddy.Replacer)
+			require.True(t, ok)
+			user, _ := repl.GetString("l4.paseto.user.id")
+			assert.Equal(t, tt.expUser, user)
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// Names of the lists that can be loaded from ListFiles.
+const (
+	listAllowUsers       = "allow_users"
+	listAllowAudiences   = "allow_audiences"
+	listAllowIssuers     = "allow_issuers"
+	listDenyFingerprints = "deny_fingerprints"
+	listDenyUsers        = "deny_users"
+	listDenyAudiences    = "deny_audiences"
+	listDenyIssuers      = "deny_issuers"
+)
+
+// allowList is an allow list, which is enforced if it's configured, or loaded
+// from a list file, even if it's empty.
+type allowList struct {
+	values   []string
+	enforced bool
+	// templated is set if any value contains placeholders, which are resolved
+	// per request.
+	templated bool
+	// patterns are the compiled regular expressions of the values with the
+	// patternPrefix, if the list supports them.
+	patterns []*regexp.Regexp
+}
+
+// patternPrefix is the prefix of allow list values that are regular
+// expressions.
+const patternPrefix = "~"
+
+// compilePatterns compiles the values of the list with the patternPrefix. The
+// patterns are anchored, so that they must match the whole value, since an
+// unanchored pattern, e.g. for "https://idp-x.corp.internal", would also allow
+// values that merely contain a match, e.g. "https://idp-x.corp.internal.evil".
+func (l *allowList) compilePatterns() error {
+	for _, val := range l.values {
+		expr, ok := strings.CutPrefix(val, patternPrefix)
+		if !ok {
+			continue
+		}
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid pattern '%s': %w", expr, err)
+		}
+		l.patterns = append(l.patterns, re)
+	}
+	return nil
+}
+
+// matches returns true if the value is in the list, or matches one of its
+// patterns. Values with the patternPrefix never match literally.
+func (l allowList) matches(val string) bool {
+	if !strings.HasPrefix(val, patternPrefix) && slices.Contains(l.values, val) {
+		return true
+	}
+	return slices.ContainsFunc(l.patterns, func(re *regexp.Regexp) bool { return re.MatchString(val) })
+}
+
+func newAllowList(configured, loaded []string, file bool) allowList {
+	values := slices.Concat(configured, loaded)
+	return allowList{
+		values:    values,
+		enforced:  len(configured) > 0 || file,
+		templated: slices.ContainsFunc(values, hasPlaceholder),
+	}
+}
+
+// resolve returns the values with their placeholders replaced. Values that
+// resolve to an empty string are dropped, so that they don't match tokens with
+// an empty claim.
+func (l allowList) resolve(repl *caddy.Replacer) []string {
+	if !l.templated || repl == nil {
+		return l.values
+	}
+	values := make([]string, 0, len(l.values))
+	for _, val := range l.values {
+		if val = repl.ReplaceAll(val, ""); val != "" {
+			values = append(values, val)
+		}
+	}
+	return values
+}
+
+// hasPlaceholder returns true if the value contains a Caddy placeholder.
+func hasPlaceholder(val string) bool {
+	start := strings.IndexByte(val, '{')
+	return start >= 0 && strings.IndexByte(val[start:], '}') > 1
+}
+
+// listSet is a snapshot of the allow and deny lists, with the configured values
+// and the values of the list files.
+type listSet struct {
+	users     allowList
+	audiences allowList
+	issuers   allowList
+	denied    *fingerprintSet
+	// denyUsers, denyAudiences and denyIssuers are checked before the allow
+	// lists.
+	denyUsers     []string
+	denyAudiences []string
+	denyIssuers   []string
+	// policy is the encoded token policy document with the lists, if
+	// WellKnown is enabled.
+	policy []byte
+}
+
+// listStore holds the current lists, and the list files they're loaded from.
+type listStore struct {
+	files map[string]*keyFile
+	set   atomic.Pointer[listSet]
+
+	// mu serializes reloads, and protects loaded, i.e. the last valid values of
+	// each list file.
+	mu     sync.Mutex
+	loaded map[string][]string
+}
+
+func (s *listStore) current() *listSet {
+	return s.set.Load()
+}
+
+// provisionLists loads the list files, and the initial lists.
+func (p *PasetoAuth) provisionLists() error {
+	p.lists = &listStore{files: make(map[string]*keyFile), loaded: make(map[string][]string)}
+	if p.ListFilesInterval < 0 {
+		return fmt.Errorf("invalid list_files_interval: '%s'", p.ListFilesInterval)
+	} else if p.ListFilesInterval == 0 {
+		p.ListFilesInterval = 30 * time.Second
+	}
+
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(p.ListFiles)) {
+		path := p.ListFiles[name]
+		switch {
+		case !slices.Contains([]string{listAllowUsers, listAllowAudiences, listAllowIssuers, listDenyFingerprints,
+			listDenyUsers, listDenyAudiences, listDenyIssuers}, name):
+			errs = append(errs, fmt.Errorf("invalid list_files: unknown list '%s'", name))
+			continue
+		case path == "":
+			errs = append(errs, fmt.Errorf("invalid list_files: empty path of list '%s'", name))
+			continue
+		}
+
+		lf := &keyFile{desc: name + " file", path: path, interval: p.ListFilesInterval, check: keyFileCheckModTime}
+		data, _, err := lf.poll(time.Now())
+		if err == nil {
+			p.lists.loaded[name], err = parseListFile(name, data)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid list_files: %w", err))
+			continue
+		}
+		p.lists.files[name] = lf
+	}
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+
+	set, err := p.newListSet(p.lists.loaded)
+	if err != nil {
+		return err
+	}
+	p.lists.set.Store(set)
+
+	return nil
+}
+
+// newListSet returns the lists with the configured values, and the values
+// loaded from the list files.
+func (p *PasetoAuth) newListSet(loaded map[string][]string) (*listSet, error) {
+	set := &listSet{
+		users:     newAllowList(p.AllowUsers, loaded[listAllowUsers], p.ListFiles[listAllowUsers] != ""),
+		audiences: newAllowList(p.AllowAudiences, loaded[listAllowAudiences], p.ListFiles[listAllowAudiences] != ""),
+		issuers:   newAllowList(p.AllowIssuers, loaded[listAllowIssuers], p.ListFiles[listAllowIssuers] != ""),
+		denied:    newFingerprintSet(),
+
+		denyUsers:     slices.Concat(p.DenyUsers, loaded[listDenyUsers]),
+		denyAudiences: slices.Concat(p.DenyAudiences, loaded[listDenyAudiences]),
+		denyIssuers:   slices.Concat(p.DenyIssuers, loaded[listDenyIssuers]),
+	}
+
+	var errs []error
+	if err := set.issuers.compilePatterns(); err != nil {
+		errs = append(errs, fmt.Errorf("invalid allow_issuers: %w", err))
+	}
+	for _, fp := range p.DenyFingerprints {
+		parsed, err := parseFingerprint(fp)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid deny_fingerprints: %w", err))
+			continue
+		}
+		set.denied.add(parsed)
+	}
+	set.denied.add(loaded[listDenyFingerprints]...)
+
+	return set, errors.Join(errs...)
+}
+
+// parseListFile returns the values of a list file, one per line. Empty lines
+// and lines starting with '#' are ignored. Fingerprints are validated and
+// normalized.
+func parseListFile(name, data string) ([]string, error) {
+	var vals []string
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if name == listDenyFingerprints {
+			fp, err := parseFingerprint(line)
+			if err != nil {
+				return nil, fmt.Errorf("%s file line %d: %w", name, i+1, err)
+			}
+			line = fp
+		}
+		vals = append(vals, line)
+	}
+
+	return vals, nil
+}
+
+// refreshLists reloads the list files that changed. If a file can't be read,
+// or is invalid, its last valid values are kept.
+func (p *PasetoAuth) refreshLists() {
+	now := time.Now()
+	for name, lf := range p.lists.files {
+		data, changed, err := lf.poll(now)
+		if err == nil && changed {
+			var vals []string
+			if vals, err = parseListFile(name, data); err == nil {
+				err = p.updateList(name, vals)
+			}
+			if err != nil {
+				lf.reset()
+			}
+		}
+		if err != nil {
+			p.logger.Warn(err.Error(), "list", name, "path", lf.path)
+			continue
+		}
+		if changed {
+			p.logger.Info("reloaded list file", "list", name, "path", lf.path)
+		}
+	}
+}
+
+// updateList replaces the values of a list file, and the lists.
+func (p *PasetoAuth) updateList(name string, vals []string) error {
+	p.lists.mu.Lock()
+	defer p.lists.mu.Unlock()
+
+	loaded := maps.Clone(p.lists.loaded)
+	loaded[name] = vals
+	set, err := p.newListSet(loaded)
+	if err != nil {
+		return err
+	}
+	if p.WellKnown != "" {
+		if set.policy, err = p.newTokenPolicy(set); err != nil {
+			return err
+		}
+	}
+	p.lists.loaded = loaded
+	p.lists.set.Store(set)
+
+	return nil
+}
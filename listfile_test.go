@@ -0,0 +1,144 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateListFiles(t *testing.T) {
+	privateKey := paseto.NewV4AsymmetricSecretKey()
+
+	dir := t.TempDir()
+	usersPath := filepath.Join(dir, "users.txt")
+	deniedPath := filepath.Join(dir, "denied.txt")
+	audiencesPath := filepath.Join(dir, "audiences.txt")
+	modTime := time.Now()
+	writeList := func(path, data string) {
+		require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(path, modTime, modTime))
+	}
+	writeList(usersPath, "# Allowed users\nalice\n\n")
+	writeList(deniedPath, "")
+	writeList(audiencesPath, "https://api.example.com\n")
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key: privateKey.Public().ExportHex(),
+		ListFiles: map[string]string{
+			listAllowUsers:       usersPath,
+			listDenyFingerprints: deniedPath,
+			listAllowAudiences:   audiencesPath,
+		},
+		ListFilesInterval: time.Nanosecond,
+		WellKnown:         "/.well-known/paseto",
+		AllowUsers:        []string{"carol"},
+		logger:            slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	newToken := func(sub string) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject(sub)
+		token.SetAudience("https://api.example.com")
+		return token.V4Sign(privateKey, nil)
+	}
+	authenticate := func(tokenStr string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tokenStr)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+	policyAudiences := func() []string {
+		var policy tokenPolicy
+		require.NoError(t, json.Unmarshal(auth.lists.current().policy, &policy))
+		return policy.Audiences
+	}
+
+	aliceToken, bobToken := newToken("alice"), newToken("bob")
+	assert.True(t, authenticate(aliceToken))
+	assert.True(t, authenticate(newToken("carol")))
+	assert.False(t, authenticate(bobToken))
+	assert.Equal(t, []string{"https://api.example.com"}, policyAudiences())
+
+	// Changed files are reloaded without a config reload.
+	writeList(usersPath, "alice\nbob\n")
+	writeList(deniedPath, tokenFingerprint(aliceToken)+"\n")
+	writeList(audiencesPath, "https://api.example.com\nhttps://learn.example.com\n")
+	assert.True(t, authenticate(bobToken))
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "reloaded list file"))
+	assert.False(t, authenticate(aliceToken))
+	assert.Equal(t, []string{"https://api.example.com", "https://learn.example.com"}, policyAudiences())
+
+	// An invalid file keeps the last valid values.
+	writeList(deniedPath, "not-a-fingerprint\n")
+	assert.False(t, authenticate(aliceToken))
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "deny_fingerprints file line 1: invalid fingerprint"))
+
+	// An empty allow list file is still enforced.
+	writeList(usersPath, "")
+	assert.False(t, authenticate(bobToken))
+	assert.True(t, authenticate(newToken("carol")))
+}
+
+func TestPasetoAuth_ValidateListFiles(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	dir := t.TempDir()
+	invalidPath := filepath.Join(dir, "denied.txt")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("# Denied tokens\nabc\n"), 0o600))
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/unknown_list",
+			config: PasetoAuth{Key: key, ListFiles: map[string]string{"allow_tenants": invalidPath}},
+			expErr: "invalid list_files: unknown list 'allow_tenants'",
+		},
+		{
+			name:   "err/empty_path",
+			config: PasetoAuth{Key: key, ListFiles: map[string]string{listAllowUsers: ""}},
+			expErr: "invalid list_files: empty path of list 'allow_users'",
+		},
+		{
+			name:   "err/missing_file",
+			config: PasetoAuth{Key: key, ListFiles: map[string]string{listAllowUsers: filepath.Join(dir, "missing.txt")}},
+			expErr: "invalid list_files: failed reading allow_users file",
+		},
+		{
+			name:   "err/invalid_fingerprint",
+			config: PasetoAuth{Key: key, ListFiles: map[string]string{listDenyFingerprints: invalidPath}},
+			expErr: "invalid list_files: deny_fingerprints file line 2: invalid fingerprint 'abc'",
+		},
+		{
+			name:   "err/negative_interval",
+			config: PasetoAuth{Key: key, ListFilesInterval: -time.Second},
+			expErr: "invalid list_files_interval: '-1s'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			require.ErrorContains(t, tt.config.Validate(), tt.expErr)
+		})
+	}
+}
@@ -0,0 +1,283 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+func init() {
+	caddy.RegisterModule(PasetoLogout{})
+}
+
+// backchannelLogoutEvent is the member of the "events" claim that identifies a
+// logout token, as defined by OpenID Connect Back-Channel Logout.
+const backchannelLogoutEvent = "http://schemas.openid.net/event/backchannel-logout"
+
+// maxLogoutRequestSize is the maximum size of logout request bodies in bytes.
+const maxLogoutRequestSize = 64 << 10
+
+// PasetoLogout is an HTTP handler that accepts back-channel logout requests
+// from the identity provider, and revokes the tracked sessions of the logged
+// out user, so that IdP-initiated logouts take effect immediately.
+//
+// The identity provider POSTs a PASETO logout token in the "logout_token" form
+// value, similar to OpenID Connect Back-Channel Logout. The token must contain
+// an "events" claim with a "http://schemas.openid.net/event/backchannel-logout"
+// member, the "iss", "jti" and "exp" claims, and a "sub" and/or "sid" claim.
+// The sessions of tokens of the same issuer whose user ID matches "sub", and
+// whose "jti" matches "sid", are revoked. Sessions are only tracked by
+// pasetoauth providers with TrackSessions enabled. Each logout token is only
+// accepted once, by its "jti", until it expires.
+type PasetoLogout struct {
+	// Verifier configures how logout tokens are verified, i.e. the keys of the
+	// identity provider, either directly or with an issuer of the paseto app,
+	// the protocol version and purpose, the allowed issuers and audiences, and
+	// the time validation. Only the options that verify tokens apply.
+	Verifier PasetoAuth `json:"verifier"`
+
+	// SessionStorage revokes the sessions in the Caddy storage module as well,
+	// for pasetoauth providers that track sessions with SessionStorage.
+	SessionStorage bool `json:"session_storage,omitempty"`
+
+	sessions   sessionStore
+	usedTokens *usedLogoutTokens
+	storage    certmagic.Storage
+}
+
+var (
+	_ caddy.Provisioner           = (*PasetoLogout)(nil)
+	_ caddy.Validator             = (*PasetoLogout)(nil)
+	_ caddy.CleanerUpper          = (*PasetoLogout)(nil)
+	_ caddyhttp.MiddlewareHandler = (*PasetoLogout)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (PasetoLogout) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.paseto_logout",
+		New: func() caddy.Module { return new(PasetoLogout) },
+	}
+}
+
+// Provision sets up the module.
+func (l *PasetoLogout) Provision(ctx caddy.Context) error {
+	if l.SessionStorage {
+		l.storage = ctx.Storage()
+	}
+	return l.Verifier.Provision(ctx)
+}
+
+// Validate validates that the module has a usable config, and initializes
+// defaults and internal values.
+func (l *PasetoLogout) Validate() error {
+	if err := l.Verifier.Validate(); err != nil {
+		return fmt.Errorf("invalid verifier: %w", err)
+	}
+	if l.sessions == nil {
+		l.sessions = sharedSessions
+	}
+	if l.usedTokens == nil {
+		l.usedTokens = sharedUsedLogoutTokens
+	}
+	return nil
+}
+
+// Cleanup releases the resources of the module, once it's unloaded.
+func (l *PasetoLogout) Cleanup() error {
+	return l.Verifier.Cleanup()
+}
+
+// ServeHTTP verifies the logout token of the request, and revokes the sessions
+// it selects. It doesn't call the next handler.
+func (l *PasetoLogout) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		return caddyhttp.Error(http.StatusMethodNotAllowed, fmt.Errorf("method not allowed: %s", r.Method))
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxLogoutRequestSize)
+	tokenStr := r.PostFormValue("logout_token")
+	if tokenStr == "" {
+		return caddyhttp.Error(http.StatusBadRequest, errors.New("logout token is missing"))
+	}
+	logger := l.Verifier.logger.With("token", maskToken(tokenStr))
+
+	now := time.Now()
+	filter, err := l.verifyLogoutToken(tokenStr, getReplacer(r), now)
+	if err != nil {
+		logger.Warn(err.Error())
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+
+	var count int
+	for _, store := range l.sessionStores() {
+		n, revokeErr := store.Revoke(r.Context(), filter, now)
+		if revokeErr != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, revokeErr)
+		}
+		count += n
+	}
+	logger.Info("revoked sessions by back-channel logout",
+		"issuer", filter.Issuer, "subject", filter.Subject, "session_id", filter.ID, "revoked", count)
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+
+	return nil
+}
+
+// verifyLogoutToken verifies the logout token, and returns the filter of the
+// sessions it logs out.
+func (l *PasetoLogout) verifyLogoutToken(
+	tokenStr string, repl *caddy.Replacer, now time.Time,
+) (sessionFilter, error) {
+	p := &l.Verifier
+	token, err := p.parseToken(tokenStr, nil)
+	if err != nil {
+		return sessionFilter{}, fmt.Errorf("invalid logout token: %w", err)
+	}
+	rules := p.extraRules(repl)
+	skew, maxAge := p.timePolicy(token)
+	if maxAge > 0 {
+		rules = append(rules, notOlderThan(now, maxAge, skew))
+	}
+	if err = token.Validate(func() time.Time { return now }, skew, rules...); err != nil {
+		return sessionFilter{}, fmt.Errorf("invalid logout token: %w", err)
+	}
+
+	filter, err := logoutFilter(token)
+	if err != nil {
+		return sessionFilter{}, err
+	}
+	if err = l.useLogoutToken(token, skew, now); err != nil {
+		return sessionFilter{}, err
+	}
+
+	return filter, nil
+}
+
+// useLogoutToken records the use of the logout token by its issuer and "jti"
+// claim, until it expires with the time skew tolerance, and returns an error if
+// it was already used.
+func (l *PasetoLogout) useLogoutToken(token *xpaseto.Token, skew time.Duration, now time.Time) error {
+	jti, err := logoutClaim(token.ClaimsRaw(), "jti")
+	if err != nil {
+		return err
+	}
+	if jti == "" {
+		return errors.New("logout token is missing the jti claim")
+	}
+	exp, err := token.GetExpiration()
+	if err != nil {
+		return errors.New("logout token is missing the exp claim")
+	}
+	iss, _ := token.GetIssuer()
+	if !l.usedTokens.use(fmt.Sprintf("%q/%q", iss, jti), exp.Add(skew), now) {
+		return errors.New("logout token was already used")
+	}
+
+	return nil
+}
+
+// logoutFilter returns the filter of the sessions logged out by the token, from
+// its "iss", "sub" and "sid" claims.
+func logoutFilter(token *xpaseto.Token) (sessionFilter, error) {
+	claims := token.ClaimsRaw()
+	events, _ := claims["events"].(map[string]any)
+	if _, ok := events[backchannelLogoutEvent]; !ok {
+		return sessionFilter{}, errors.New("logout token is missing the back-channel logout event")
+	}
+
+	var filter sessionFilter
+	var err error
+	if filter.Issuer, err = logoutClaim(claims, "iss"); err != nil {
+		return sessionFilter{}, err
+	}
+	if filter.Issuer == "" {
+		return sessionFilter{}, errors.New("logout token is missing the iss claim")
+	}
+	if filter.Subject, err = logoutClaim(claims, "sub"); err != nil {
+		return sessionFilter{}, err
+	}
+	if filter.ID, err = logoutClaim(claims, "sid"); err != nil {
+		return sessionFilter{}, err
+	}
+	if filter.empty() {
+		return sessionFilter{}, errors.New("logout token has neither a subject nor a session ID")
+	}
+
+	return filter, nil
+}
+
+// logoutClaim returns the value of an optional string claim of a logout token.
+func logoutClaim(claims map[string]any, name string) (string, error) {
+	raw, found := claims[name]
+	if !found {
+		return "", nil
+	}
+	val, ok := raw.(string)
+	if !ok {
+		return "", fmt.Errorf("invalid logout token claim '%s': expected a string", name)
+	}
+	return val, nil
+}
+
+// sessionStores returns the stores of tracked sessions: the in-memory store
+// shared by all handlers, and the one in the Caddy storage, if enabled.
+func (l *PasetoLogout) sessionStores() []sessionStore {
+	stores := []sessionStore{l.sessions}
+	if l.storage != nil {
+		stores = append(stores, newStorageSessionStore(l.storage))
+	}
+	return stores
+}
+
+// usedLogoutTokens records the used logout tokens until they expire, so that
+// they can't be replayed.
+type usedLogoutTokens struct {
+	mu        sync.Mutex
+	expiries  map[string]time.Time
+	lastSweep time.Time
+}
+
+// sharedUsedLogoutTokens is the record of used logout tokens shared by all
+// module instances, so that tokens can't be replayed after config reloads.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var sharedUsedLogoutTokens = newUsedLogoutTokens()
+
+func newUsedLogoutTokens() *usedLogoutTokens {
+	return &usedLogoutTokens{expiries: make(map[string]time.Time)}
+}
+
+// use records the use of the token with the key, which expires at expiresAt,
+// and returns false if it was already used.
+func (u *usedLogoutTokens) use(key string, expiresAt, now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	if now.Sub(u.lastSweep) >= sessionSweepInterval {
+		for k, exp := range u.expiries {
+			if !now.Before(exp) {
+				delete(u.expiries, k)
+			}
+		}
+		u.lastSweep = now
+	}
+
+	if exp, ok := u.expiries[key]; ok && now.Before(exp) {
+		return false
+	}
+	u.expiries[key] = expiresAt
+
+	return true
+}
@@ -0,0 +1,226 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoLogout_ServeHTTP(t *testing.T) {
+	appKey, idpKey := paseto.NewV4AsymmetricSecretKey(), paseto.NewV4AsymmetricSecretKey()
+	store := newMemorySessionStore()
+	logHandler := testutil.NewTestLogHandler()
+
+	auth := &PasetoAuth{
+		Key:           appKey.Public().ExportHex(),
+		FromQuery:     []string{"token"},
+		TrackSessions: true,
+		sessions:      store,
+		logger:        slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	logout := &PasetoLogout{
+		Verifier: PasetoAuth{
+			Key:          idpKey.Public().ExportHex(),
+			AllowIssuers: []string{"https://idp.example.com"},
+			logger:       slog.New(logHandler),
+		},
+		sessions:   store,
+		usedTokens: newUsedLogoutTokens(),
+	}
+	require.NoError(t, logout.Validate())
+
+	newSessionToken := func(iss, sub, jti string) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetIssuer(iss)
+		token.SetSubject(sub)
+		token.SetJti(jti)
+		return token.V4Sign(appKey, nil)
+	}
+	authenticate := func(tokenStr string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+	var logoutTokens int
+	newLogoutToken := func(claims map[string]any, key paseto.V4AsymmetricSecretKey) string {
+		logoutTokens++
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(2 * time.Minute))
+		token.SetIssuer("https://idp.example.com")
+		token.SetJti(fmt.Sprintf("logout%d", logoutTokens))
+		for name, val := range claims {
+			require.NoError(t, token.Set(name, val))
+		}
+		return token.V4Sign(key, nil)
+	}
+	logoutEvent := map[string]any{backchannelLogoutEvent: map[string]any{}}
+	postLogout := func(tokenStr string) error {
+		form := url.Values{"logout_token": {tokenStr}}
+		req := httptest.NewRequest(http.MethodPost, "/logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		err := logout.ServeHTTP(rec, req, nil)
+		if err == nil {
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+		}
+		return err
+	}
+	assertStatus := func(err error, status int) {
+		var handlerErr caddyhttp.HandlerError
+		require.ErrorAs(t, err, &handlerErr)
+		assert.Equal(t, status, handlerErr.StatusCode)
+	}
+
+	const idp, otherIdP = "https://idp.example.com", "https://other.example.com"
+	aliceToken1, aliceToken2 := newSessionToken(idp, "alice", "session1"), newSessionToken(idp, "alice", "session2")
+	bobToken := newSessionToken(idp, "bob", "session3")
+	// A session of the same user ID, issued by another identity provider.
+	otherAliceToken := newSessionToken(otherIdP, "alice", "session4")
+	for _, tokenStr := range []string{aliceToken1, aliceToken2, bobToken, otherAliceToken} {
+		require.True(t, authenticate(tokenStr))
+	}
+
+	t.Run("ok/session_id", func(t *testing.T) {
+		require.NoError(t, postLogout(newLogoutToken(map[string]any{"events": logoutEvent, "sid": "session1"}, idpKey)))
+		assert.True(t, logHandler.HasRecord(slog.LevelInfo, "revoked sessions by back-channel logout"))
+		assert.False(t, authenticate(aliceToken1))
+		assert.True(t, authenticate(aliceToken2))
+	})
+
+	t.Run("ok/subject", func(t *testing.T) {
+		require.NoError(t, postLogout(newLogoutToken(map[string]any{"events": logoutEvent, "sub": "alice"}, idpKey)))
+		assert.False(t, authenticate(aliceToken2))
+		assert.True(t, authenticate(bobToken))
+		assert.True(t, authenticate(otherAliceToken))
+	})
+
+	t.Run("err/replayed", func(t *testing.T) {
+		tokenStr := newLogoutToken(map[string]any{"events": logoutEvent, "sid": "unknown"}, idpKey)
+		require.NoError(t, postLogout(tokenStr))
+		err := postLogout(tokenStr)
+		require.ErrorContains(t, err, "logout token was already used")
+		assertStatus(err, http.StatusBadRequest)
+	})
+
+	t.Run("err/method", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/logout", nil)
+		assertStatus(logout.ServeHTTP(httptest.NewRecorder(), req, nil), http.StatusMethodNotAllowed)
+	})
+
+	tests := []struct {
+		name     string
+		tokenStr string
+		expErr   string
+	}{
+		{
+			name:   "err/missing_token",
+			expErr: "logout token is missing",
+		},
+		{
+			name:     "err/invalid_key",
+			tokenStr: newLogoutToken(map[string]any{"events": logoutEvent, "sub": "bob"}, appKey),
+			expErr:   "invalid logout token: failed parsing token: bad signature",
+		},
+		{
+			name: "err/invalid_issuer",
+			tokenStr: newLogoutToken(map[string]any{
+				"events": logoutEvent, "sub": "bob", "iss": "https://evil.example.com",
+			}, idpKey),
+			expErr: "invalid logout token",
+		},
+		{
+			name:     "err/missing_event",
+			tokenStr: newLogoutToken(map[string]any{"sub": "bob"}, idpKey),
+			expErr:   "logout token is missing the back-channel logout event",
+		},
+		{
+			name:     "err/missing_subject_and_session",
+			tokenStr: newLogoutToken(map[string]any{"events": logoutEvent}, idpKey),
+			expErr:   "logout token has neither a subject nor a session ID",
+		},
+		{
+			name:     "err/missing_jti",
+			tokenStr: newLogoutToken(map[string]any{"events": logoutEvent, "sub": "bob", "jti": ""}, idpKey),
+			expErr:   "logout token is missing the jti claim",
+		},
+		{
+			name:     "err/invalid_session_id",
+			tokenStr: newLogoutToken(map[string]any{"events": logoutEvent, "sid": 123}, idpKey),
+			expErr:   "invalid logout token claim 'sid': expected a string",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := postLogout(tt.tokenStr)
+			require.ErrorContains(t, err, tt.expErr)
+			assertStatus(err, http.StatusBadRequest)
+		})
+	}
+	assert.True(t, authenticate(bobToken))
+}
+
+func TestLogoutFilter(t *testing.T) {
+	logoutEvent := map[string]any{backchannelLogoutEvent: map[string]any{}}
+	tests := []struct {
+		name      string
+		claims    map[string]any
+		expFilter sessionFilter
+		expErr    string
+	}{
+		{
+			name:      "ok/subject",
+			claims:    map[string]any{"events": logoutEvent, "iss": "https://idp.example.com", "sub": "alice"},
+			expFilter: sessionFilter{Issuer: "https://idp.example.com", Subject: "alice"},
+		},
+		{
+			name:   "err/missing_issuer",
+			claims: map[string]any{"events": logoutEvent, "sub": "alice"},
+			expErr: "logout token is missing the iss claim",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			for name, val := range tt.claims {
+				require.NoError(t, token.Set(name, val))
+			}
+			filter, err := logoutFilter(&xpaseto.Token{Token: &token})
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expFilter, filter)
+		})
+	}
+}
+
+func TestPasetoLogout_Validate(t *testing.T) {
+	logout := &PasetoLogout{Verifier: PasetoAuth{logger: slog.New(testutil.NewTestLogHandler())}}
+	require.ErrorContains(t, logout.Validate(), "invalid verifier: ")
+}
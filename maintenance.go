@@ -0,0 +1,94 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Maintenance configures a maintenance mode, during which only tokens
+// carrying a bypass claim are allowed through.
+type Maintenance struct {
+	// Enabled is the maintenance flag. It's evaluated per request, so it can
+	// contain placeholders, such as `{env.MAINTENANCE}` or `{vars.maintenance}`.
+	// Maintenance mode is active if the resulting value is a true boolean
+	// value, e.g. "true", "1" or "on".
+	//
+	// Maintenance mode can also be toggled at runtime for all handlers via the
+	// `/paseto/maintenance` admin API endpoint.
+	Enabled string `json:"enabled"`
+
+	// BypassClaim is the name of the claim that allows a token through during
+	// maintenance. The default is "maint".
+	BypassClaim string `json:"bypass_claim"`
+
+	// BypassValue is the value the bypass claim must have. If the claim value is
+	// an array, any of its elements must match. The default is "true".
+	BypassValue string `json:"bypass_value"`
+
+	// StatusCode is the HTTP status code of the response sent to all other
+	// requests. The default is 503.
+	StatusCode int `json:"status_code"`
+
+	// Body is the body of the response sent to all other requests.
+	Body string `json:"body"`
+
+	// ContentType is the content type of Body. The default is "text/plain;
+	// charset=utf-8".
+	ContentType string `json:"content_type"`
+}
+
+// maintenanceToggle is the maintenance mode state set via the admin API.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var maintenanceToggle atomic.Bool
+
+func (m *Maintenance) provision() error {
+	if m.BypassClaim == "" {
+		m.BypassClaim = "maint"
+	}
+	if m.BypassValue == "" {
+		m.BypassValue = "true"
+	}
+	if m.StatusCode == 0 {
+		m.StatusCode = http.StatusServiceUnavailable
+	} else if m.StatusCode < 100 || m.StatusCode > 999 {
+		return fmt.Errorf("invalid maintenance status code: %d", m.StatusCode)
+	}
+	if m.ContentType == "" {
+		m.ContentType = "text/plain; charset=utf-8"
+	}
+
+	return nil
+}
+
+// active reports whether maintenance mode is active for the request.
+func (m *Maintenance) active(r *http.Request) bool {
+	if maintenanceToggle.Load() {
+		return true
+	}
+
+	enabled := strings.TrimSpace(getReplacer(r).ReplaceAll(m.Enabled, ""))
+	active, err := strconv.ParseBool(enabled)
+	if err != nil {
+		return slices.Contains([]string{"on", "yes"}, strings.ToLower(enabled))
+	}
+
+	return active
+}
+
+// bypass reports whether the token claims allow the request through during
+// maintenance.
+func (m *Maintenance) bypass(claims map[string]any) bool {
+	val, ok := claims[m.BypassClaim]
+	return ok && claimHasValue(val, m.BypassValue)
+}
+
+// reject writes the maintenance response.
+func (m *Maintenance) reject(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", m.ContentType)
+	writeRejection(w, m.StatusCode, m.Body)
+}
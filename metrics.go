@@ -0,0 +1,217 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "caddy_paseto"
+
+// metrics contains the Prometheus collectors of the module.
+type metrics struct {
+	tokenRemainingLifetime *prometheus.HistogramVec
+	authentications        *prometheus.CounterVec
+	breakersOpen           *prometheus.GaugeVec
+	breakerTrips           *prometheus.CounterVec
+	verificationsShed      prometheus.Counter
+	unenforcedRejections   prometheus.Counter
+	keySourcesActive       *prometheus.GaugeVec
+	replayedVerifications  prometheus.Counter
+}
+
+// newMetrics creates the module collectors, and registers them in reg.
+// Collectors that are already registered by another module instance are
+// reused, so that all instances within a config report the same metrics.
+func newMetrics(reg prometheus.Registerer) (*metrics, error) {
+	remainingLifetime, err := registerCollector(reg, prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "token_remaining_lifetime_seconds",
+		Help:      "Histogram of the remaining lifetime of successfully verified tokens.",
+		Buckets: []float64{
+			10, 30, 60, 5 * 60, 15 * 60, 30 * 60, 60 * 60, 6 * 60 * 60,
+			12 * 60 * 60, 24 * 60 * 60, 7 * 24 * 60 * 60,
+		},
+	}, []string{"tenant"}))
+	if err != nil {
+		return nil, err
+	}
+
+	authentications, err := registerCollector(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "authentications_total",
+		Help:      "Total number of authenticated and rejected requests, by tenant.",
+	}, []string{"tenant", "result"}))
+	if err != nil {
+		return nil, err
+	}
+
+	breakersOpen, err := registerCollector(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breakers_open",
+		Help:      "Number of open circuit breakers of remote backends.",
+	}, []string{"backend"}))
+	if err != nil {
+		return nil, err
+	}
+
+	breakerTrips, err := registerCollector(reg, prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "circuit_breaker_trips_total",
+		Help:      "Total number of times circuit breakers of remote backends opened.",
+	}, []string{"backend"}))
+	if err != nil {
+		return nil, err
+	}
+
+	verificationsShed, err := registerCollector(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "verifications_shed_total",
+		Help:      "Total number of requests rejected because the token verification queue was full.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	unenforcedRejections, err := registerCollector(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "unenforced_rejections_total",
+		Help:      "Total number of requests that would have been rejected, but were allowed because enforcement is off.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	keySourcesActive, err := registerCollector(reg, prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "key_sources_active",
+		Help:      "Number of key sets whose active key_failover source is the labeled one.",
+	}, []string{"source"}))
+	if err != nil {
+		return nil, err
+	}
+
+	replayedVerifications, err := registerCollector(reg, prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "replayed_verifications_total",
+		Help:      "Total number of token verifications replayed from a recorded outcome, for load tests.",
+	}))
+	if err != nil {
+		return nil, err
+	}
+
+	return &metrics{
+		tokenRemainingLifetime: remainingLifetime,
+		authentications:        authentications,
+		breakersOpen:           breakersOpen,
+		breakerTrips:           breakerTrips,
+		verificationsShed:      verificationsShed,
+		unenforcedRejections:   unenforcedRejections,
+		keySourcesActive:       keySourcesActive,
+		replayedVerifications:  replayedVerifications,
+	}, nil
+}
+
+// observeRemainingLifetime records the time left until the token of the tenant
+// expires.
+func (m *metrics) observeRemainingLifetime(tenant string, exp, now time.Time) {
+	if m == nil {
+		return
+	}
+	m.tokenRemainingLifetime.WithLabelValues(tenant).Observe(exp.Sub(now).Seconds())
+}
+
+// incAuthentications records that a request of the tenant was authenticated or
+// rejected. The tenant is empty if it's unknown.
+func (m *metrics) incAuthentications(tenant string, authenticated bool) {
+	if m == nil {
+		return
+	}
+	result := "rejected"
+	if authenticated {
+		result = "authenticated"
+	}
+	m.authentications.WithLabelValues(tenant, result).Inc()
+}
+
+// setBreakerOpen records that a circuit breaker of the backend opened or
+// closed.
+func (m *metrics) setBreakerOpen(backend string, open bool) {
+	if m == nil {
+		return
+	}
+	if open {
+		m.breakersOpen.WithLabelValues(backend).Inc()
+	} else {
+		m.breakersOpen.WithLabelValues(backend).Dec()
+	}
+}
+
+// incBreakerTrips records that a circuit breaker of the backend opened, either
+// after consecutive failures, or after a failed trial call.
+func (m *metrics) incBreakerTrips(backend string) {
+	if m == nil {
+		return
+	}
+	m.breakerTrips.WithLabelValues(backend).Inc()
+}
+
+// incVerificationsShed records that a request was rejected, because the
+// verification queue was full.
+func (m *metrics) incVerificationsShed() {
+	if m == nil {
+		return
+	}
+	m.verificationsShed.Inc()
+}
+
+// incUnenforcedRejections records that a request would have been rejected, but
+// was allowed because enforcement is off.
+func (m *metrics) incUnenforcedRejections() {
+	if m == nil {
+		return
+	}
+	m.unenforcedRejections.Inc()
+}
+
+// setKeySourceActive records that a key set switched its active key source.
+// Either source can be empty, when the key set starts or stops using one.
+func (m *metrics) setKeySourceActive(from, to string) {
+	if m == nil {
+		return
+	}
+	if from != "" {
+		m.keySourcesActive.WithLabelValues(from).Dec()
+	}
+	if to != "" {
+		m.keySourcesActive.WithLabelValues(to).Inc()
+	}
+}
+
+// incReplayedVerifications records that a token verification was replayed from
+// its recorded outcome.
+func (m *metrics) incReplayedVerifications() {
+	if m == nil {
+		return
+	}
+	m.replayedVerifications.Inc()
+}
+
+func registerCollector[T prometheus.Collector](reg prometheus.Registerer, c T) (T, error) {
+	err := reg.Register(c)
+	if err == nil {
+		return c, nil
+	}
+
+	var are prometheus.AlreadyRegisteredError
+	if errors.As(err, &are) {
+		if existing, ok := are.ExistingCollector.(T); ok {
+			return existing, nil
+		}
+	}
+
+	var zero T
+	return zero, fmt.Errorf("failed registering metrics collector: %w", err)
+}
@@ -0,0 +1,86 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestMetrics_RemainingLifetime(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(20 * time.Minute))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	reg := prometheus.NewPedanticRegistry()
+
+	// Multiple instances within the same config share the same collectors.
+	auths := make([]*PasetoAuth, 2)
+	for i := range auths {
+		m, err := newMetrics(reg)
+		require.NoError(t, err)
+		auths[i] = &PasetoAuth{
+			Key:       v4PublicKey.ExportHex(),
+			FromQuery: []string{"token"},
+			metrics:   m,
+			logger:    slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, auths[i].Validate())
+	}
+	assert.Same(t, auths[0].metrics.tokenRemainingLifetime, auths[1].metrics.tokenRemainingLifetime)
+
+	for _, auth := range auths {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+	}
+
+	// Failed authentications are not recorded.
+	req := httptest.NewRequest(http.MethodGet, "/?token=invalid", nil)
+	_, authenticated, err := auths[0].Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	require.False(t, authenticated)
+
+	hist := gatherHistogram(t, reg, "caddy_paseto_token_remaining_lifetime_seconds")
+	assert.Equal(t, uint64(2), hist.GetSampleCount())
+	for _, bucket := range hist.GetBucket() {
+		switch {
+		case bucket.GetUpperBound() < 15*60:
+			assert.Zero(t, bucket.GetCumulativeCount())
+		case bucket.GetUpperBound() >= 30*60:
+			assert.Equal(t, uint64(2), bucket.GetCumulativeCount())
+		}
+	}
+}
+
+func gatherHistogram(t *testing.T, reg *prometheus.Registry, name string) *dto.Histogram {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	for _, family := range families {
+		if family.GetName() == name {
+			require.Len(t, family.GetMetric(), 1)
+			return family.GetMetric()[0].GetHistogram()
+		}
+	}
+	require.Failf(t, "metric not found", "metric %s not found", name)
+
+	return nil
+}
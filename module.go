@@ -1,15 +1,24 @@
 package caddypaseto
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"maps"
+	"math"
 	"net/http"
+	"net/netip"
 	"slices"
+	"strconv"
+	"strings"
 	"time"
 
 	"aidanwoods.dev/go-paseto"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/caddyserver/certmagic"
 
 	"go.hackfix.me/paseto-cli/xpaseto"
 )
@@ -20,11 +29,225 @@ func init() {
 
 // PasetoAuth implements PASETO authentication.
 type PasetoAuth struct {
+	// Issuer is the name of an issuer of the paseto app, whose keys, version
+	// and purpose are used instead of the key options of this provider. This
+	// allows multiple sites to share the keys of the same issuer, and a single
+	// key refresh loop. It can't be combined with the key options, version or
+	// purpose. The allowed audiences and issuers, the time skew tolerance and
+	// the maximum token age of the issuer are used if they aren't set here.
+	Issuer string `json:"issuer,omitempty"`
+
+	// IssuerKeys verifies or decrypts the tokens of multiple trusted issuers,
+	// each with its own keys, version and purpose. The key is the value of the
+	// "iss" claim, and the value configures the keys like an issuer of the
+	// paseto app. E.g.:
+	//
+	//     {"https://billing.internal": {"key": "k4.public.<key>"}}
+	//
+	// The keys of a token are chosen by the PASERK ID in its footer, or for
+	// public tokens, by its "iss" claim, which must match the issuer of the
+	// keys. Tokens that don't match an issuer are verified with the other key
+	// options, which are optional if IssuerKeys is set.
+	IssuerKeys map[string]*Issuer `json:"issuer_keys,omitempty"`
+
+	// VersionKeys verifies or decrypts tokens of other protocol versions than
+	// Version, each with its own keys, so that issuers can be migrated from one
+	// version to another without a flag day. The key is the protocol version,
+	// and the value configures the keys like an issuer of the paseto app. The
+	// purpose is the purpose of this provider, unless it's set. E.g.:
+	//
+	//     {"v3": {"key": "k3.public.<key>"}}
+	//
+	// The keys of a token are chosen by the version in its prefix, e.g.
+	// "v3.public.". Tokens of Version are verified with the other key options.
+	VersionKeys map[paseto.Version]*Issuer `json:"version_keys,omitempty"`
+
+	// PurposeKeys verifies or decrypts tokens of the other protocol purpose
+	// than Purpose with their own keys, so that local and public tokens can be
+	// accepted at once, e.g. from legacy issuers of local tokens. The key is the
+	// purpose, and the value configures the keys like an issuer of the paseto
+	// app. The version is the version of this provider, unless it's set. E.g.:
+	//
+	//     {"local": {"key": "k4.local.<key>"}}
+	//
+	// The keys of a token are chosen by the purpose in its prefix, e.g.
+	// "v4.local.", if its version is Version. Tokens of Purpose are verified
+	// with the other key options.
+	PurposeKeys map[paseto.Purpose]*Issuer `json:"purpose_keys,omitempty"`
+
 	// Key is the key used to verify or decrypt PASETO tokens.
 	// It must be the public key if `purpose` is 'public', or the symmetric key if
-	// `purpose` is 'local'. It can be specified as either a hex or PEM encoded string.
+	// `purpose` is 'local'. It can be specified as a hex, PEM or PASERK encoded
+	// string.
+	//
+	// Key, Keys, KeyPassword, KeyFile, KeyCredential and KeyURL can contain
+	// global placeholders, e.g. `{env.PASETO_KEY}` or
+	// `{file./run/secrets/paseto.key}`, which are resolved when the module is
+	// provisioned, so that keys don't have to be stored in the config.
 	Key string `json:"key"`
 
+	// Keys defines additional keys used to verify or decrypt PASETO tokens, with
+	// the same requirements as Key. Tokens are verified with Key first, and then
+	// with each of these keys in order, until one succeeds. This allows tokens
+	// issued with either the old or new key to be accepted while keys are being
+	// rotated.
+	//
+	// If the token footer is a JSON object with a "kid" field containing the
+	// PASERK ID of one of the keys, e.g. `{"kid": "k4.pid.<id>"}`, only that key
+	// is used, and tokens with an unknown key ID are rejected.
+	Keys []string `json:"keys"`
+
+	// RequireKID rejects tokens whose footer doesn't contain the "kid" field,
+	// instead of trying each key in order. Combined with the rejection of
+	// unknown key IDs, only tokens that identify one of the configured keys
+	// are accepted, which prevents accepting tokens of a key that was only
+	// meant to be tried during a rotation. It applies to the keys of
+	// IssuerKeys as well.
+	RequireKID bool `json:"require_kid,omitempty"`
+
+	// KeyPassword is the password of the password-wrapped PASERK keys, e.g.
+	// "k3.local-pw.<data>", in any of the key sources. It should be set with
+	// a placeholder, e.g. `{env.PASETO_KEY_PASSWORD}`, so that the password
+	// isn't stored in the config either. Only version 3 keys are supported.
+	KeyPassword string `json:"key_password,omitempty"`
+
+	// KeyPassphrase derives Key from a passphrase with Argon2id, instead of
+	// specifying it directly. It can only be used with the 'v4' version and the
+	// 'local' purpose. See KeyPassphrase.
+	KeyPassphrase *KeyPassphrase `json:"key_passphrase,omitempty"`
+
+	// KeyMaster is the master key that unwraps the keys in Key and Keys that
+	// are wrapped with PASERK PIE, e.g. "k4.local-wrap.pie.<data>", so that
+	// the config doesn't contain the keys in plaintext. See KeyMaster.
+	KeyMaster *KeyMaster `json:"key_master,omitempty"`
+
+	// KeyFile is the path of a file that contains a key used to verify or
+	// decrypt PASETO tokens, with the same requirements as Key. The file is
+	// checked for changes every KeyFileInterval, and the new key replaces the
+	// previous one without a config reload, so keys can be rotated on disk.
+	// If the new key is invalid, e.g. because the file is being written, the
+	// previous key is kept until the next check. The key is tried after Key.
+	KeyFile string `json:"key_file"`
+
+	// KeyCredential is the name of a systemd credential or Docker secret that
+	// contains the key, which is used as KeyFile. It's looked up in the
+	// directory named by $CREDENTIALS_DIRECTORY first, and then in
+	// /run/secrets. The file must not be writable by the group or others, and
+	// systemd credentials must not be readable by others either, while Docker
+	// secrets may have the default mode 0444. It can't be combined with KeyFile.
+	KeyCredential string `json:"key_credential,omitempty"`
+
+	// KeyFileInterval is how often KeyFile is checked for changes. The default
+	// is 30s.
+	KeyFileInterval time.Duration `json:"key_file_interval"`
+
+	// KeyFileCheck is how changes of KeyFile are detected. It can either be
+	// 'mtime', to compare the modification time and size of the file, or
+	// 'content', to read the file and compare its contents on every check. The
+	// latter is useful on network file systems, or with secret agents that
+	// don't update the modification time. The default is 'mtime'.
+	KeyFileCheck string `json:"key_file_check"`
+
+	// KeyFileSOPS decrypts KeyFile, or the KeyCredential file, with SOPS, so
+	// that the key is never stored in plaintext on disk. See KeyFileSOPS.
+	KeyFileSOPS *KeyFileSOPS `json:"key_file_sops,omitempty"`
+
+	// KeyURL is the HTTPS URL of a document that contains keys used to verify
+	// or decrypt PASETO tokens, with the same requirements as Key. The document
+	// is either a single key, or a JSON object with a "keys" array, e.g.
+	// `{"keys": ["k4.public.<key>"]}`. It's fetched when the module is
+	// provisioned, which fails if the keys can't be fetched, and then in the
+	// background every KeyURLInterval, with a random jitter. Failed fetches are
+	// retried with an exponential backoff, starting at 10s and capped at
+	// KeyURLInterval. If a later fetch fails, or the keys are invalid, the
+	// previous keys are kept or dropped, depending on KeyURLOutage. The ETag
+	// and Last-Modified response headers are used to avoid reloading unchanged
+	// documents, and a token with an unknown key ID makes the document be
+	// fetched early, at most every 10s, so that rotated keys are picked up
+	// promptly. Plain HTTP is only allowed for loopback hosts. The keys are
+	// tried after the KeyFile key, and before Keys.
+	KeyURL string `json:"key_url"`
+
+	// KeyURLInterval is how often KeyURL is fetched. The default is 5m.
+	KeyURLInterval time.Duration `json:"key_url_interval"`
+
+	// KeyURLTimeout is the timeout of KeyURL requests. The default is 10s.
+	KeyURLTimeout time.Duration `json:"key_url_timeout"`
+
+	// KeyURLOutage is what happens to the KeyURL keys when a refresh fails,
+	// e.g. because the key server is unreachable. It can either be 'keep', to
+	// keep verifying tokens with the last valid keys (fail open), or 'reject',
+	// to drop the keys, and reject their tokens, until a refresh succeeds
+	// (fail closed). The default is 'keep'.
+	KeyURLOutage string `json:"key_url_outage,omitempty"`
+
+	// KeyURLPins restricts the KeyURL keys to the listed keys, specified by
+	// PASERK ID or by value, so that a compromised key server can't inject its
+	// own verification keys. A document with a key that isn't pinned is
+	// rejected like a failed refresh. The pins must be updated before the key
+	// server publishes a new key.
+	KeyURLPins []string `json:"key_url_pins,omitempty"`
+
+	// KeyURLSignature requires the KeyURL document to have a detached
+	// signature by a pinned root key, which is verified before any key of the
+	// document is trusted, so that keys can be distributed automatically
+	// without trusting the key server. See KeyURLSignature.
+	KeyURLSignature *KeyURLSignature `json:"key_url_signature,omitempty"`
+
+	// KeyRotation enables keys that are generated and rotated on a schedule,
+	// and shared via the Caddy storage module. The storage is checked for new
+	// keys in the background, and the keys are tried after the KeyURL keys,
+	// and before Keys. The tokens are expected to be issued by paseto_sign
+	// handlers with the same key rotation.
+	KeyRotation *KeyRotation `json:"key_rotation,omitempty"`
+
+	// KeyStorage enables verification keys that are stored in the Caddy
+	// storage module via the `/paseto/keys` admin API endpoint, so that all
+	// instances of a cluster that use the same storage converge on the same
+	// keys. The storage is polled for changes in the background, and the keys
+	// are tried after the rotated keys, and before Keys.
+	KeyStorage *KeyStorage `json:"key_storage,omitempty"`
+
+	// KeyAWS enables verification keys that are fetched from AWS Secrets
+	// Manager, or decrypted with AWS KMS, so that the config doesn't contain
+	// the keys in plaintext. The keys are refreshed in the background, and are
+	// tried after the stored keys, and before Keys. See KeyAWS.
+	KeyAWS *KeyAWS `json:"key_aws,omitempty"`
+
+	// KeyGCP enables verification keys that are fetched from Google Secret
+	// Manager, with the workload identity of the metadata server. The keys are
+	// refreshed in the background, and are tried after the KeyAWS keys, and
+	// before Keys. See KeyGCP.
+	KeyGCP *KeyGCP `json:"key_gcp,omitempty"`
+
+	// AdminKeys enables keys managed at runtime via the `/paseto/keys` admin
+	// API endpoint, without a config reload, e.g. for an emergency rotation.
+	// The keys of the configured version and purpose are tried before the
+	// other keys, or replace them, and take effect with the next request. They
+	// aren't persisted, and are shared by all handlers that enable them.
+	AdminKeys bool `json:"admin_keys,omitempty"`
+
+	// KeyFailover lists key sources in priority order, of "key", "key_file",
+	// "key_url", "key_rotation", "key_storage", "key_aws", "key_gcp" and
+	// "keys", which are used exclusively rather than all at once. Only the keys
+	// of the first source that can be loaded are used. If its refresh fails,
+	// the next one is used, until it can be refreshed again. Sources that
+	// aren't listed are always used.
+	KeyFailover []string `json:"key_failover,omitempty"`
+
+	// KeyNotAfter maps keys to the time after which they're past their intended
+	// lifetime, and should have been rotated. Keys are identified by their
+	// PASERK ID, e.g. "k4.pid.<id>", or by their value, and can come from any
+	// key source. Stale keys are logged, or rejected, depending on StaleKeys.
+	KeyNotAfter map[string]time.Time `json:"key_not_after,omitempty"`
+
+	// StaleKeys is how keys past their KeyNotAfter time are handled when they
+	// are loaded. It can either be 'warn', to log a warning, or 'reject', to
+	// fail validation, and ignore key file and key URL updates that include
+	// them. Tokens verified with a stale key are logged once per key in both
+	// modes, but are not rejected. The default is 'warn'.
+	StaleKeys string `json:"stale_keys,omitempty"`
+
 	// Purpose is the PASETO protocol purpose. It can either be 'local' for
 	// shared-key (symmetric) encryption, or 'public' for public-key (asymmetric)
 	// signing. The default is 'public'.
@@ -38,6 +261,20 @@ type PasetoAuth struct {
 	// between systems. The default is 30s.
 	TimeSkewTolerance time.Duration `json:"time_skew_tolerance"`
 
+	// MaxTokenAge is the maximum amount of time since the token was issued, as
+	// determined by the "iat" claim. Older tokens are rejected, even if they
+	// haven't expired. If 0, the token age is not limited.
+	MaxTokenAge time.Duration `json:"max_token_age"`
+
+	// IssuerPolicies overrides TimeSkewTolerance and MaxTokenAge for tokens of
+	// specific issuers. The key is the value of the "iss" claim. E.g.:
+	//
+	//     {"https://partner.example.com": {"time_skew_tolerance": 300000000000}}
+	//
+	// This allows lenience for third-party issuers with known clock problems,
+	// while validating first-party tokens strictly.
+	IssuerPolicies map[string]*IssuerPolicy `json:"issuer_policies"`
+
 	// FromQuery defines a list of HTTP request query string parameter names
 	// tokens should be retrieved from.
 	//
@@ -45,17 +282,160 @@ type PasetoAuth struct {
 	// treated as candidate tokens, and each one will be verified until a valid
 	// one is reached.
 	//
-	// Priority: from_query > from_header > from_cookies.
+	// Priority: from_query > from_header > from_cookies > from_form >
+	// from_body > from_path > from_websocket_protocol > from_basic_auth >
+	// from_forwarded_authorization, unless TokenSources is set.
 	FromQuery []string `json:"from_query"`
 
 	// FromHeader works like FromQuery, but defines a list of HTTP header names
-	// tokens should be retrieved from.
+	// tokens should be retrieved from. The names can contain placeholders,
+	// which are replaced per request.
 	FromHeader []string `json:"from_header"`
 
 	// FromCookie works like FromQuery, but defines a list of HTTP cookie names
-	// tokens should be retrieved from.
+	// tokens should be retrieved from. The names can contain placeholders,
+	// which are replaced per request, e.g. "sess_{http.request.host}".
 	FromCookies []string `json:"from_cookies"`
 
+	// FromForm works like FromQuery, but defines a list of form field names
+	// tokens should be retrieved from, for clients that can only send tokens
+	// in an HTML form. The fields are read from the bodies of POST, PUT and
+	// PATCH requests with the application/x-www-form-urlencoded or
+	// multipart/form-data content type. The body is restored after reading, so
+	// that the next handlers still see all of it.
+	FromForm []string `json:"from_form,omitempty"`
+
+	// FromFormMaxSize is the maximum size of form bodies in bytes that are read
+	// for FromForm fields. Larger forms are ignored as token sources, but still
+	// passed to the next handlers. The default is 1MiB.
+	FromFormMaxSize int64 `json:"from_form_max_size,omitempty"`
+
+	// FromBody works like FromQuery, but defines a list of paths of JSON body
+	// values tokens should be retrieved from, for API clients that can't set
+	// headers. Nested values can be queried with dot notation, e.g.
+	// "auth.token". The values are read from the bodies of POST, PUT and PATCH
+	// requests with the application/json content type, or a "+json" suffixed
+	// one, and must be strings. The body is restored after reading, so that the
+	// next handlers still see all of it.
+	FromBody []string `json:"from_body,omitempty"`
+
+	// FromBodyMaxSize is the maximum size of JSON bodies in bytes that are read
+	// for FromBody values. Larger bodies are ignored as token sources, but
+	// still passed to the next handlers. The default is 1MiB.
+	FromBodyMaxSize int64 `json:"from_body_max_size,omitempty"`
+
+	// FromPath works like FromQuery, but defines a list of URL path patterns
+	// with a "{token}" segment tokens should be retrieved from, e.g.
+	// "/download/{token}", for links that embed a token. A pattern matches the
+	// leading segments of the request path, and a "*" segment matches any
+	// segment.
+	FromPath []string `json:"from_path,omitempty"`
+
+	// StripPathToken removes the token segment from the request path, if the
+	// request was authenticated with a FromPath token, so that the token isn't
+	// passed to the next handlers, e.g. "/download/<token>/file.zip" is
+	// proxied as "/download/file.zip".
+	StripPathToken bool `json:"strip_path_token,omitempty"`
+
+	// StripToken removes the token from the query string parameters, headers
+	// and cookies it was retrieved from, including the Authorization header,
+	// once the request is authenticated, so that the token isn't passed to the
+	// next handlers, e.g. the upstream. Other values of the sources are kept.
+	// Form and body tokens aren't removed, and path tokens are removed with
+	// StripPathToken.
+	StripToken bool `json:"strip_token,omitempty"`
+
+	// FromWebSocketProtocol works like FromQuery, but defines a list of marker
+	// subprotocols of the Sec-WebSocket-Protocol header of WebSocket upgrade
+	// requests, since browsers can't set the Authorization header of WebSocket
+	// requests. The token is the subprotocol that follows the marker, e.g.
+	// "Sec-WebSocket-Protocol: chat, paseto, v4.public.<...>". Once the request
+	// is authenticated, the marker and the token are removed from the header,
+	// and the marker is accepted on the response if no other subprotocols
+	// remain.
+	FromWebSocketProtocol []string `json:"from_websocket_protocol,omitempty"`
+
+	// FromBasicAuth works like FromQuery, but defines a list of user names of
+	// HTTP Basic Authorization headers, whose password is the token, for CLI
+	// tools and webhook senders that only support Basic authentication, e.g.
+	// "https://token:<token>@example.com". "*" matches any user name.
+	FromBasicAuth []string `json:"from_basic_auth,omitempty"`
+
+	// FromForwardedAuthorization retrieves tokens from the
+	// X-Forwarded-Authorization header, which gateways in front of Caddy set
+	// to the Authorization header they consumed. Its values are handled like
+	// the ones of the Authorization header, e.g. the Bearer scheme is removed.
+	// The header is only used if the request was sent by a trusted proxy, see
+	// ForwardedAuthorizationProxies.
+	FromForwardedAuthorization bool `json:"from_forwarded_authorization,omitempty"`
+
+	// ForwardedAuthorizationProxies is a list of IP ranges in CIDR notation, or
+	// "private_ranges", of the proxies that X-Forwarded-Authorization is
+	// accepted from. The direct peer of the request must be within one of the
+	// ranges. By default, it must be one of the server's trusted_proxies.
+	ForwardedAuthorizationProxies []string `json:"forwarded_authorization_proxies,omitempty"`
+
+	// TokenSources is the priority of the token source types, i.e. "query",
+	// "header", "cookie", "form", "body", "path", "websocket", "basic" and
+	// "forwarded", e.g. ["header", "cookie", "query"]. All types with
+	// configured sources must be listed. The implicit Authorization header
+	// source is always tried last. The default is the priority of the
+	// FromQuery to FromForwardedAuthorization options.
+	TokenSources []string `json:"token_sources,omitempty"`
+
+	// TokenExtraction is either 'all', to try the candidate tokens of all
+	// sources, until a valid one is found, or 'first', to only try the first
+	// candidate token found, in order of priority. With 'first', a request
+	// with an invalid token in a higher priority source is rejected, even if
+	// it has a valid token in another source. The default is 'all'.
+	TokenExtraction string `json:"token_extraction,omitempty"`
+
+	// MaxCandidates is the maximum amount of candidate tokens of a request,
+	// from all sources. Further candidates are ignored, and the later sources
+	// aren't read, so that a single request can't cause dozens of signature
+	// verifications. The default is 10.
+	MaxCandidates int `json:"max_candidates,omitempty"`
+
+	// MaxTokenLength is the maximum length of a token in bytes. Longer
+	// candidate tokens are ignored before they're parsed. The default is 8KiB.
+	MaxTokenLength int64 `json:"max_token_length,omitempty"`
+
+	// DisableImplicitAuthorization disables the implicit Authorization header
+	// token source, which is otherwise tried after all configured sources, so
+	// that tokens are only taken from the configured sources. The Authorization
+	// header can still be listed in FromHeader.
+	DisableImplicitAuthorization bool `json:"disable_implicit_authorization,omitempty"`
+
+	// StrictBearer requires the Authorization header to be exactly "Bearer"
+	// followed by a single space and the token, as defined by RFC 6750, without
+	// other parameters or surrounding whitespace. Requests with multiple
+	// Authorization headers are rejected as well. Headers that don't match are
+	// ignored, instead of being normalized. It doesn't apply to other headers.
+	StrictBearer bool `json:"strict_bearer,omitempty"`
+
+	// AuthorizationSchemes are the accepted schemes of the Authorization
+	// header, compared case-insensitively, e.g. ["Bearer", "PASETO", "Token"].
+	// Authorization headers with other schemes are ignored. The default is
+	// ["Bearer"]. It can't be used with StrictBearer.
+	AuthorizationSchemes []string `json:"authorization_schemes,omitempty"`
+
+	// RequireAuthorizationScheme ignores Authorization headers without a
+	// scheme, i.e. bare tokens, which are accepted by default.
+	RequireAuthorizationScheme bool `json:"require_authorization_scheme,omitempty"`
+
+	// SourceNetworks restricts token sources to client networks. The key is
+	// a token source in the form `<type>:<name>`, where type is one of "query",
+	// "header" or "cookie", and the value is a list of CIDR ranges or IP
+	// addresses. The special value "private_ranges" can be used to match all
+	// private IP ranges. Tokens from a restricted source are ignored if the
+	// client IP address is not within any of the networks. E.g.:
+	//
+	//     {"header:X-Internal-Token": ["private_ranges"]}
+	//
+	// The client IP address is determined by Caddy, so the server's
+	// `trusted_proxies` configuration is taken into account.
+	SourceNetworks map[string][]string `json:"source_networks"`
+
 	// UserClaims defines a list of token claim names from which to extract the ID
 	// of the authenticated user.
 	//
@@ -68,6 +448,15 @@ type PasetoAuth struct {
 	// payload: `{ "username": "eva" }`.
 	//
 	// If no non-empty values are found, the request fails authentication.
+	//
+	// Each name can be followed by a transform of the claim value, with syntax
+	// `<claim>:<transform>`, where transform is one of "lowercase", "uppercase",
+	// "strip-prefix=<prefix>" or "strip-suffix=<suffix>". The transform is only
+	// applied if that claim supplies the ID. For example, the value
+	// `email:lowercase sub:strip-prefix=auth0|` normalizes the user ID to
+	// "eva@example.com" for `{ "email": "Eva@Example.com" }` and to "123" for
+	// `{ "sub": "auth0|123" }`. A claim whose value is empty after the transform
+	// is skipped.
 	UserClaims []string `json:"user_claims"`
 
 	// MetaClaims defines a map to populate {http.auth.user.*} metadata placeholders.
@@ -97,16 +486,87 @@ type PasetoAuth struct {
 	//     meta_claims "user_info.role -> role"
 	MetaClaims map[string]string `json:"meta_claims"`
 
+	// RouteClaim is the name of a claim, e.g. "region" or "shard", whose value
+	// is set in the `{http.vars.paseto.route}` variable when the token is
+	// authenticated, so that reverse_proxy upstreams can be selected per tenant,
+	// e.g. with `reverse_proxy {vars.paseto.route}.internal:8080`. Nested claim
+	// paths are supported with dot notation. Tokens whose route claim value
+	// contains characters other than letters, digits, '-', '_' and '.' are
+	// rejected.
+	RouteClaim string `json:"route_claim,omitempty"`
+
+	// RouteClaimRequired rejects tokens without the route claim, instead of
+	// leaving the variable empty, so that requests aren't silently routed to
+	// a default upstream.
+	RouteClaimRequired bool `json:"route_claim_required,omitempty"`
+
+	// ClaimMapperRaw is the claim mapper module, which derives the user ID and
+	// metadata from the claims of verified tokens with custom logic, instead
+	// of UserClaims. The metadata it returns is added to the MetaClaims
+	// placeholders. See ClaimMapper.
+	ClaimMapperRaw json.RawMessage `json:"claim_mapper,omitempty" caddy:"namespace=http.authentication.providers.paseto.claim_mappers inline_key=mapper"` //nolint:lll // struct tag
+
+	// CacheKeyClaims defines a list of token claim names from which to derive
+	// the `{http.auth.user.cache_key}` placeholder. Its value is the hex encoded
+	// SHA-256 digest of the claim values, so it can be used by caching modules to
+	// key per-user or per-tier variants, without exposing the raw identifiers in
+	// cache keys. Nested claim paths are supported with dot notation, and missing
+	// claims are treated as empty values. E.g.:
+	//
+	//     cache_key_claims sub tier
+	CacheKeyClaims []string `json:"cache_key_claims"`
+
+	// LogClaimChanges defines a list of token claim names, e.g. roles or tier,
+	// whose changes between successive tokens of the same user are logged, so
+	// that privilege changes made by token renewals can be reviewed. Tokens are
+	// ordered by their "iat" claim, and list claims are logged as the elements
+	// added and removed. Nested claim paths are supported with dot notation.
+	LogClaimChanges []string `json:"log_claim_changes,omitempty"`
+
+	// RedactClaims defines a list of token claim names, e.g. email or phone,
+	// whose values are redacted wherever the module logs them, i.e. in the
+	// user ID of log entries, if it's read from one of the claims, and in the
+	// LogClaimChanges entries. Nested claim paths are supported with dot
+	// notation.
+	RedactClaims []string `json:"redact_claims,omitempty"`
+
+	// RedactMode is how the values of RedactClaims are redacted. It can either
+	// be 'hash', to log a truncated SHA-256 digest of the value, which still
+	// correlates the entries of the same value, or 'mask', to log a fixed
+	// placeholder. The default is 'hash'.
+	RedactMode string `json:"redact_mode,omitempty"`
+
 	// AllowAudiences defines a list of allowed audiences. If non-empty, the "aud"
 	// claim must exist in the token payload and its value must be specified here
 	// for verification to succeed. Otherwise, the "aud" claim is not required,
-	// and any value will be allowed.
+	// and any value will be allowed. The values can contain placeholders, e.g.
+	// `https://{http.request.host}/api`, which are resolved per request, so
+	// that a single provider binds tokens to the audience of each site it
+	// serves. A "*" matches one or more characters other than "/", ":", "?",
+	// "#" and "@", e.g. `https://*.example.com` matches the audiences of all
+	// subdomains.
 	AllowAudiences []string `json:"allow_audiences"`
 
+	// AudienceFromHost requires the "aud" claim to match the host of the
+	// request, either bare, e.g. `app.example.com`, or with the scheme of the
+	// request, e.g. `https://app.example.com`, so that a single configuration
+	// serves many sites without listing their audiences. The host is compared
+	// exactly, without wildcards. If AllowAudiences is also set, the audiences
+	// of either are allowed.
+	AudienceFromHost bool `json:"audience_from_host,omitempty"`
+
+	// AudienceMatch defines how tokens with an array "aud" claim are matched
+	// against AllowAudiences. It can either be 'any', which requires any of the
+	// elements to be allowed, or 'all', which requires all of them to be
+	// allowed. The default is 'any'.
+	AudienceMatch string `json:"audience_match"`
+
 	// AllowIssuers defines a list of allowed issuers. If non-empty, the "iss"
 	// claim must exist in the token payload and its value must be specified here
 	// for verification to succeed. Otherwise, the "iss" claim is not required,
-	// and any value will be allowed.
+	// and any value will be allowed. Values prefixed with "~" are regular
+	// expressions, e.g. `~https://idp-[a-z]+\.corp\.internal`, which must
+	// match the whole issuer.
 	AllowIssuers []string `json:"allow_issuers"`
 
 	// AllowUsers defines a list of allowed users. If non-empty, and the user
@@ -114,13 +574,244 @@ type PasetoAuth struct {
 	// verification. Otherwise, all users will be allowed.
 	AllowUsers []string `json:"allow_users"`
 
-	// The parsed and decoded key, if validation succeeds.
-	key    *xpaseto.Key
-	logger *slog.Logger
+	// DenyUsers, DenyAudiences and DenyIssuers define lists of denied users,
+	// audiences and issuers, which are checked before the allow lists, so that
+	// compromised users or deprecated issuers can be blocked immediately,
+	// without rewriting the allow lists. Tokens with a denied value, or for
+	// array audiences, with any denied element, are rejected. The values are
+	// matched exactly.
+	DenyUsers     []string `json:"deny_users,omitempty"`
+	DenyAudiences []string `json:"deny_audiences,omitempty"`
+	DenyIssuers   []string `json:"deny_issuers,omitempty"`
+
+	// ListFiles maps list options, i.e. "allow_users", "allow_audiences",
+	// "allow_issuers", "deny_users", "deny_audiences", "deny_issuers" and
+	// "deny_fingerprints", to files with one value per
+	// line, which are added to the configured values. Empty lines and lines
+	// starting with '#' are ignored. An allow list with a file is enforced even
+	// if it's empty. The files are reloaded when they change, so that large or
+	// frequently changing lists can be managed without config reloads. If a
+	// file can't be read, or is invalid, its last valid values are kept.
+	ListFiles map[string]string `json:"list_files,omitempty"`
+
+	// ListFilesInterval is how often ListFiles are checked for changes. The
+	// default is 30s.
+	ListFilesInterval time.Duration `json:"list_files_interval,omitempty"`
+
+	// TokenType is the required value of the TokenTypeClaim claim. If set,
+	// tokens without the claim, or with a different value, are rejected. This
+	// separates token types issued with the same key, e.g. requiring "access"
+	// on API routes prevents refresh tokens from being replayed as access
+	// tokens.
+	TokenType string `json:"token_type"`
+
+	// TokenTypeClaim is the name of the claim that contains the token type.
+	// The default is "typ".
+	TokenTypeClaim string `json:"token_type_claim"`
+
+	// ClaimValues maps enum-like claims, e.g. role, to the set of values they
+	// can have. Tokens whose claim has another value, or for array claims,
+	// contains another value, are rejected, and the unexpected value is logged,
+	// so that a new value introduced by an issuer-side bug doesn't silently
+	// flow into authorization decisions downstream. Tokens without the claim
+	// aren't rejected. Nested claim paths are supported with dot notation.
+	ClaimValues map[string][]string `json:"claim_values,omitempty"`
+
+	// ForbidClaims is a list of claims that tokens must not have, e.g. a
+	// deprecated "admin" flag, whatever their value, so that changes to the
+	// issuer contract can be enforced before every issuer is updated. Nested
+	// claim paths are supported with dot notation.
+	ForbidClaims []string `json:"forbid_claims,omitempty"`
+
+	// RequireClaims maps claims to the values they must have, e.g.
+	// {"env": ["prod"], "tier": ["gold", "silver"]}. Tokens without the claim,
+	// or whose claim has none of the values, are rejected. For array claims,
+	// one of the elements must have one of the values. Nested claim paths are
+	// supported with dot notation.
+	RequireClaims map[string][]string `json:"require_claims,omitempty"`
+
+	// RequireScopes maps HTTP methods to the scopes that tokens must have in
+	// their "scope" claim, which is either a space-delimited string or an
+	// array of strings, e.g. {"GET": ["read"], "POST": ["write"]}. All the
+	// scopes of the method are required. HEAD requests require the scopes of
+	// GET, unless HEAD is listed. Methods that aren't listed require the scopes
+	// of "*", or no scopes if "*" isn't listed either.
+	RequireScopes map[string][]string `json:"require_scopes,omitempty"`
+
+	// AllowRoles and DenyRoles define lists of allowed and denied roles of the
+	// RolesClaim claim, so that role-based access can be enforced without
+	// mapping the claim to metadata and matching it downstream. If AllowRoles
+	// is non-empty, tokens must have the claim with any of the roles. Tokens
+	// with any of the DenyRoles are rejected, which is checked first. The
+	// claim can either be a string with a single role, or an array of strings.
+	AllowRoles []string `json:"allow_roles,omitempty"`
+	DenyRoles  []string `json:"deny_roles,omitempty"`
+
+	// RolesClaim is the name of the claim that contains the roles of
+	// AllowRoles and DenyRoles. Nested claim paths are supported with dot
+	// notation, e.g. "realm_access.roles". The default is 'roles'.
+	RolesClaim string `json:"roles_claim,omitempty"`
+
+	// PathRequirements requires tokens of requests to some paths to have
+	// scopes or claim values, in addition to the requirements of all requests,
+	// e.g. the "admin" scope for "/admin/*", so that a single handler protects
+	// a whole API with varied requirements. See PathRequirement.
+	PathRequirements []*PathRequirement `json:"path_requirements,omitempty"`
+
+	// RateLimit enables per-user request rate enforcement based on a quota or
+	// tier claim in the token payload. Requests that exceed the limit are
+	// rejected with a 429 status.
+	RateLimit *RateLimit `json:"rate_limit"`
+
+	// VerifyPool bounds the amount of concurrent token verifications. Requests
+	// that would exceed its queue depth are rejected with a 503 status. By
+	// default, verifications aren't bounded. See VerifyPool.
+	VerifyPool *VerifyPool `json:"verify_pool,omitempty"`
+
+	// ReplayVerifications replays the recorded verification outcome of tokens
+	// that were already verified, for load tests that measure the cost of the
+	// pipeline without the cryptography. It must never be enabled in
+	// production. See ReplayVerifications.
+	ReplayVerifications *ReplayVerifications `json:"replay_verifications,omitempty"`
+
+	// VerifyBudget bounds the verification time and attempts per request,
+	// after which the remaining candidate tokens are skipped. By default, the
+	// verification work of a request isn't bounded. See VerifyBudget.
+	VerifyBudget *VerifyBudget `json:"verify_budget,omitempty"`
+
+	// TrackSessions enables tracking of sessions by the "jti" claim. Tracked
+	// sessions can be listed and revoked via the `/paseto/sessions` admin API
+	// endpoints. Tokens without a "jti" claim are not tracked.
+	TrackSessions bool `json:"track_sessions"`
+
+	// IdleTimeout is the maximum amount of time a tracked session can be unused.
+	// Tokens of sessions that were idle for longer are rejected, even if they
+	// haven't expired. Setting it enables TrackSessions.
+	IdleTimeout time.Duration `json:"idle_timeout"`
+
+	// SessionStorage stores tracked sessions in the Caddy storage module, instead
+	// of in memory, so that they're shared by all Caddy instances that use the
+	// same storage. Setting it enables TrackSessions.
+	SessionStorage bool `json:"session_storage"`
+
+	// SessionStorageTimeout is the maximum duration of session tracking
+	// operations during authentication, in addition to the deadline of the
+	// request, so that a hung storage backend doesn't stall requests. Requests
+	// whose session can't be tracked in time fail with an error. It applies to
+	// the in-memory sessions of TrackSessions as well as to SessionStorage, and
+	// is ignored with a warning if sessions aren't tracked. The default is 5s.
+	SessionStorageTimeout time.Duration `json:"session_storage_timeout,omitempty"`
+
+	// CircuitBreaker configures the circuit breakers of the key URL and the
+	// session storage, and whether requests fail open when the session storage
+	// is unavailable. Circuit breakers are always enabled, with the default
+	// settings if this is not set. See CircuitBreaker.
+	CircuitBreaker *CircuitBreaker `json:"circuit_breaker,omitempty"`
+
+	// DenyFingerprints defines a list of token fingerprints, i.e. hex encoded
+	// SHA-256 digests of the full token string, that are rejected. This allows
+	// killing a specific leaked token, when it can't be revoked by other means.
+	// Fingerprints can also be denied at runtime via the `/paseto/denylist`
+	// admin API endpoint.
+	DenyFingerprints []string `json:"deny_fingerprints"`
+
+	// HTTPSignatures enables verification of HTTP Message Signatures (RFC 9421)
+	// made with a public key carried by the token. Requests without a valid
+	// signature fail authentication.
+	HTTPSignatures *HTTPSignatures `json:"http_signatures"`
+
+	// SessionBinding requires tokens to be sent with the session cookie whose
+	// digest is in a token claim, so that a stolen token can't be used without
+	// the cookie. See SessionBinding.
+	SessionBinding *SessionBinding `json:"session_binding,omitempty"`
+
+	// SignedURL requires tokens to be bound to the request URL with claims, so
+	// that short-lived links, e.g. for downloads, can't be used with other
+	// URLs. See SignedURL.
+	SignedURL *SignedURL `json:"signed_url,omitempty"`
+
+	// Maintenance enables a maintenance mode, during which only tokens carrying
+	// a bypass claim are allowed through, and all other requests receive a 503
+	// response.
+	Maintenance *Maintenance `json:"maintenance"`
+
+	// ChallengePages serves localized HTML pages to rejected requests, instead
+	// of the bare 401 response, for user-facing sites. See ChallengePages.
+	ChallengePages *ChallengePages `json:"challenge_pages,omitempty"`
+
+	// Preflight allows CORS preflight requests through without authentication,
+	// optionally only from specific origins. A preflight request is an OPTIONS
+	// request with the Origin and Access-Control-Request-Method headers. The
+	// user ID of such requests is empty.
+	Preflight *Preflight `json:"preflight"`
+
+	// WellKnown is the path of the token policy document, served by the
+	// paseto_well_known handler, e.g. "/.well-known/paseto-auth". GET and HEAD
+	// requests to the path are allowed through without authentication, and the
+	// user ID of such requests is empty. The document describes the accepted
+	// protocol, claims and token sources, but no keys.
+	WellKnown string `json:"well_known,omitempty"`
+
+	// PublishKeys is the path of the public keys document, served by the
+	// paseto_keys handler, e.g. "/.well-known/paseto-keys". GET and HEAD
+	// requests to the path are allowed through without authentication, and the
+	// user ID of such requests is empty. The document lists the current
+	// verification keys as PASERK keys, so that client services can discover
+	// them, e.g. with key_url. It requires the public purpose, since local keys
+	// are secret. The keys of issuer_keys, version_keys and purpose_keys aren't
+	// published.
+	PublishKeys string `json:"publish_keys,omitempty"`
+
+	// CORSOrigins defines a list of origins whose cross-origin requests receive
+	// the Access-Control-Allow-Origin and Access-Control-Allow-Credentials
+	// headers when they fail authentication, so that browser clients can read
+	// the 401 response instead of getting an opaque CORS failure. Origins can
+	// contain wildcards, as in Preflight.
+	CORSOrigins []string `json:"cors_origins"`
+
+	// MonitorOnly disables enforcement: tokens are still extracted, verified,
+	// logged and counted in the metrics, but requests are never rejected.
+	// Requests that would have been rejected are allowed with an empty user ID,
+	// and nothing is written to the response. This allows observing the effect
+	// of the configuration in front of an existing application, before
+	// enforcing it.
+	MonitorOnly bool `json:"monitor_only,omitempty"`
+
+	// The parsed and decoded keys, if validation succeeds.
+	keys           *keyRing
+	keyNotAfter    map[string]time.Time
+	keyURLPins     map[string]bool
+	issuer         *PasetoAuth
+	issuerKeys     map[string]*PasetoAuth
+	versionKeys    map[paseto.Version]*PasetoAuth
+	purposeKeys    map[paseto.Purpose]*PasetoAuth
+	userClaims     []userClaim
+	claimMapper    ClaimMapper
+	sourceNetworks map[string][]netip.Prefix
+	pathPatterns   []pathPattern
+	proxyNetworks  []netip.Prefix
+	tokenSources   []string
+	lists          *listStore
+	denylist       *fingerprintSet
+	adminKeys      *adminKeyStore
+	counters       counterStore
+	sessions       sessionStore
+	storage        certmagic.Storage
+	claimHistory   *claimHistory
+	sessionBreaker *breaker
+	verifyPool     *verifyPool
+	verifyReplay   *verifyReplay
+	tenantLoggers  map[string]*slog.Logger
+	metrics        *metrics
+	logger         *slog.Logger
+	// ctx is canceled when the module is unloaded, which stops background
+	// operations, e.g. key fetches.
+	ctx context.Context
 }
 
 var (
 	_ caddy.Provisioner       = (*PasetoAuth)(nil)
+	_ caddy.CleanerUpper      = (*PasetoAuth)(nil)
 	_ caddy.Validator         = (*PasetoAuth)(nil)
 	_ caddyauth.Authenticator = (*PasetoAuth)(nil)
 )
@@ -135,102 +826,1010 @@ func (PasetoAuth) CaddyModule() caddy.ModuleInfo {
 
 // Provision sets up the module.
 func (p *PasetoAuth) Provision(ctx caddy.Context) error {
+	p.ctx = ctx
 	p.logger = ctx.Slogger()
+
+	if err := p.resolveKeyPlaceholders(caddy.NewReplacer()); err != nil {
+		return err
+	}
+
+	if err := p.loadIssuer(ctx); err != nil {
+		return err
+	}
+
+	if err := p.provisionIssuerKeys(ctx); err != nil {
+		return err
+	}
+
+	if err := p.provisionProtocolKeys(ctx); err != nil {
+		return err
+	}
+	p.provisionTenantLoggers(ctx)
+
+	if err := p.loadClaimMapper(ctx); err != nil {
+		return err
+	}
+
+	if p.SessionStorage {
+		p.sessions = newStorageSessionStore(ctx.Storage())
+	}
+	if p.KeyRotation != nil || p.KeyStorage != nil {
+		p.storage = ctx.Storage()
+	}
+
+	if reg := ctx.GetMetricsRegistry(); reg != nil {
+		var err error
+		if p.metrics, err = newMetrics(reg); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// Cleanup releases the resources of the module, once it's unloaded. The keys of
+// an issuer are released by the paseto app.
+func (p *PasetoAuth) Cleanup() error {
+	if p.Issuer == "" {
+		p.releaseKeySource()
+	}
+	for _, fed := range p.issuerKeys {
+		fed.releaseKeySource()
+	}
+	for _, vp := range p.versionKeys {
+		vp.releaseKeySource()
+	}
+	for _, pp := range p.purposeKeys {
+		pp.releaseKeySource()
+	}
+	return nil
+}
+
+// moduleContext returns the context of the module lifetime, or a background
+// context if the module wasn't provisioned, e.g. in tests.
+func (p *PasetoAuth) moduleContext() context.Context {
+	if p.ctx == nil {
+		return context.Background()
+	}
+	return p.ctx
+}
+
 // Validate validates that the module has a usable config, and initializes
-// defaults and internal values.
+// defaults and internal values. All configuration problems are returned as
+// a single joined error, so that they can be fixed at once.
 func (p *PasetoAuth) Validate() error {
+	p.useIssuerSettings()
+
+	// Conflicts are checked before defaults are applied, so that only options
+	// that were set explicitly are reported.
+	errs := p.validateConflicts()
+
+	protoErr := p.validateProtocol()
+	errs = append(errs, protoErr)
+	errs = append(errs, p.validateClaims()...)
+	errs = append(errs, p.validateRequests()...)
+	errs = append(errs, p.validateSessions()...)
+
+	// The keys can only be loaded with a valid version and purpose.
+	switch {
+	case p.Issuer != "":
+		errs = append(errs, p.useIssuerKeys())
+	case protoErr == nil:
+		errs = append(errs, p.provisionKeys())
+	}
+	errs = append(errs, p.validateIssuerKeys())
+	errs = append(errs, p.validateProtocolKeys())
+
+	// The token policy can't be encoded if the lists are invalid, which is
+	// already reported.
+	if set := p.lists.current(); p.WellKnown != "" && set != nil {
+		var err error
+		set.policy, err = p.newTokenPolicy(set)
+		errs = append(errs, err)
+	}
+
+	return errors.Join(errs...)
+}
+
+// validateConflicts checks for options that were set without the options they
+// depend on, or together with options they conflict with.
+func (p *PasetoAuth) validateConflicts() []error {
+	var errs []error
+	requires := func(set bool, opt, required string) {
+		if set {
+			errs = append(errs, fmt.Errorf("%s requires %s", opt, required))
+		}
+	}
+
+	requires(p.TokenTypeClaim != "" && p.TokenType == "", "token_type_claim", "token_type")
+	requires(p.RolesClaim != "" && len(p.AllowRoles) == 0 && len(p.DenyRoles) == 0,
+		"roles_claim", "allow_roles or deny_roles")
+	requires(p.FromFormMaxSize != 0 && len(p.FromForm) == 0, "from_form_max_size", "from_form")
+	requires(p.FromBodyMaxSize != 0 && len(p.FromBody) == 0, "from_body_max_size", "from_body")
+	requires(p.StripPathToken && len(p.FromPath) == 0, "strip_path_token", "from_path")
+	requires(len(p.ForwardedAuthorizationProxies) > 0 && !p.FromForwardedAuthorization,
+		"forwarded_authorization_proxies", "from_forwarded_authorization")
+	if p.StrictBearer && (len(p.AuthorizationSchemes) > 0 || p.RequireAuthorizationScheme) {
+		errs = append(errs, errors.New("authorization_schemes can't be used with strict_bearer"))
+	}
+	requires(p.AudienceMatch != "" && len(p.AllowAudiences) == 0 && p.ListFiles[listAllowAudiences] == "" &&
+		!p.AudienceFromHost, "audience_match", "allow_audiences or audience_from_host")
+	keyFile := p.KeyFile != "" || p.KeyCredential != ""
+	requires(p.KeyFileInterval != 0 && !keyFile, "key_file_interval", "key_file")
+	requires(p.KeyFileCheck != "" && !keyFile, "key_file_check", "key_file")
+	requires(p.KeyFileSOPS != nil && !keyFile, "key_file_sops", "key_file")
+	if p.KeyFile != "" && p.KeyCredential != "" {
+		errs = append(errs, fmt.Errorf("key_credential can't be used with key_file"))
+	}
+	if p.Key != "" && p.KeyPassphrase != nil {
+		errs = append(errs, fmt.Errorf("key_passphrase can't be used with key"))
+	}
+	requires(p.KeyURLInterval != 0 && p.KeyURL == "", "key_url_interval", "key_url")
+	requires(p.KeyURLTimeout != 0 && p.KeyURL == "", "key_url_timeout", "key_url")
+	requires(p.KeyURLOutage != "" && p.KeyURL == "", "key_url_outage", "key_url")
+	requires(len(p.KeyURLPins) > 0 && p.KeyURL == "", "key_url_pins", "key_url")
+	requires(p.KeyURLSignature != nil && p.KeyURL == "", "key_url_signature", "key_url")
+	requires(p.StaleKeys != "" && len(p.KeyNotAfter) == 0, "stale_keys", "key_not_after")
+	requires(p.RouteClaimRequired && p.RouteClaim == "", "route_claim_required", "route_claim")
+	requires(p.RedactMode != "" && len(p.RedactClaims) == 0, "redact_mode", "redact_claims")
+	requires(p.CircuitBreaker != nil && p.CircuitBreaker.FailOpen &&
+		!p.TrackSessions && !p.SessionStorage && p.IdleTimeout == 0,
+		"circuit_breaker fail_open", "track_sessions")
+	if p.Issuer != "" && (p.Key != "" || len(p.Keys) > 0 || p.KeyPassword != "" || p.KeyPassphrase != nil ||
+		p.KeyMaster != nil || keyFile || p.KeyURL != "" || p.KeyURLOutage != "" || len(p.KeyURLPins) > 0 ||
+		p.KeyURLSignature != nil || p.KeyRotation != nil || p.KeyStorage != nil || p.KeyAWS != nil || p.KeyGCP != nil ||
+		p.AdminKeys || len(p.KeyFailover) > 0 || len(p.KeyNotAfter) > 0 || p.StaleKeys != "" || p.Version != "" || p.Purpose != "") {
+		errs = append(errs, fmt.Errorf("issuer can't be used with key options, version or purpose"))
+	}
+	if p.claimMapper != nil && len(p.UserClaims) > 0 {
+		errs = append(errs, fmt.Errorf("user_claims can't be used with claim_mapper"))
+	}
+
+	return errs
+}
+
+func (p *PasetoAuth) validateProtocol() error {
+	var errs []error
 	if p.Version == "" {
 		p.Version = paseto.Version4
 	} else if !slices.Contains([]paseto.Version{paseto.Version2, paseto.Version3, paseto.Version4}, p.Version) {
-		return fmt.Errorf("invalid version: '%s'", p.Version)
+		errs = append(errs, fmt.Errorf("invalid version: '%s'", p.Version))
 	}
 
 	if p.Purpose == "" {
 		p.Purpose = paseto.Public
 	} else if !slices.Contains([]paseto.Purpose{paseto.Local, paseto.Public}, p.Purpose) {
-		return fmt.Errorf("invalid purpose: '%s'", p.Purpose)
+		errs = append(errs, fmt.Errorf("invalid purpose: '%s'", p.Purpose))
 	}
 
 	if p.TimeSkewTolerance == 0 {
 		p.TimeSkewTolerance = 30 * time.Second
 	}
+	errs = append(errs, p.validatePolicies())
+
+	return errors.Join(errs...)
+}
+
+func (p *PasetoAuth) validateClaims() []error {
+	var errs []error
 
 	if len(p.UserClaims) == 0 {
 		p.UserClaims = []string{"sub"}
 	}
+	p.userClaims = make([]userClaim, 0, len(p.UserClaims))
+	for _, key := range p.UserClaims {
+		uc, err := parseUserClaim(key)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("invalid user_claims: %w", err))
+			continue
+		}
+		p.userClaims = append(p.userClaims, uc)
+	}
+
+	if p.TokenTypeClaim == "" {
+		p.TokenTypeClaim = "typ"
+	}
+
+	for _, claim := range slices.Sorted(maps.Keys(p.ClaimValues)) {
+		if len(p.ClaimValues[claim]) == 0 {
+			errs = append(errs, fmt.Errorf("invalid claim_values '%s': no values", claim))
+		}
+	}
+	for _, claim := range slices.Sorted(maps.Keys(p.RequireClaims)) {
+		if len(p.RequireClaims[claim]) == 0 {
+			errs = append(errs, fmt.Errorf("invalid require_claims '%s': no values", claim))
+		}
+	}
+	if slices.Contains(p.ForbidClaims, "") {
+		errs = append(errs, errors.New("invalid forbid_claims: empty claim name"))
+	}
+	errs = append(errs, p.validateRoles(), p.validateRequireScopes(), p.provisionPathRequirements())
+
+	if p.AudienceMatch == "" {
+		p.AudienceMatch = audienceMatchAny
+	} else if !slices.Contains([]string{audienceMatchAny, audienceMatchAll}, p.AudienceMatch) {
+		errs = append(errs, fmt.Errorf("invalid audience match: '%s'", p.AudienceMatch))
+	}
+
+	if len(p.CacheKeyClaims) > 0 {
+		for claim, placeholder := range p.MetaClaims {
+			if placeholder == cacheKeyPlaceholder {
+				errs = append(errs, fmt.Errorf(
+					"invalid meta_claims: placeholder of claim '%s' conflicts with the cache key", claim))
+			}
+		}
+	}
+
+	errs = append(errs, p.provisionLists())
+	if p.denylist == nil {
+		p.denylist = sharedDenylist
+	}
+	if len(p.LogClaimChanges) > 0 && p.claimHistory == nil {
+		p.claimHistory = sharedClaimHistory
+	}
+	errs = append(errs, p.validateRedaction())
+
+	return errs
+}
+
+// validateRequests validates the options that apply to requests, rather than
+// to tokens.
+func (p *PasetoAuth) validateRequests() []error {
+	var errs []error
 
 	var err error
-	p.key, err = xpaseto.LoadKey([]byte(p.Key), p.Version, p.Purpose, xpaseto.KeyTypePublic)
-	if err != nil {
-		//nolint:wrapcheck // the xpaseto error is descriptive enough
-		return err
+	if p.sourceNetworks, err = parseSourceNetworks(p.SourceNetworks); err != nil {
+		errs = append(errs, err)
 	}
+	errs = append(errs, p.validateTokenSources()...)
 
-	return nil
+	if p.RateLimit != nil {
+		if p.RateLimit.Claim == "" {
+			errs = append(errs, fmt.Errorf("invalid rate_limit: claim is empty"))
+		}
+		if p.RateLimit.Window < 0 {
+			errs = append(errs, fmt.Errorf("invalid rate_limit: negative window: '%s'", p.RateLimit.Window))
+		}
+		if p.RateLimit.Window == 0 {
+			p.RateLimit.Window = time.Minute
+		}
+		if p.counters == nil {
+			p.counters = sharedCounters
+		}
+	}
+
+	if p.VerifyPool != nil {
+		if err = p.VerifyPool.provision(); err != nil {
+			errs = append(errs, err)
+		} else if p.verifyPool == nil {
+			p.verifyPool = newVerifyPool(p.VerifyPool, p.metrics)
+		}
+	}
+	if p.VerifyBudget != nil {
+		errs = append(errs, p.VerifyBudget.provision())
+	}
+	if p.ReplayVerifications != nil {
+		if err = p.ReplayVerifications.provision(); err != nil {
+			errs = append(errs, err)
+		} else if p.verifyReplay == nil {
+			p.verifyReplay = newVerifyReplay(p.ReplayVerifications, p.metrics)
+			// The logger is only set if the module was provisioned.
+			if p.logger != nil {
+				p.logger.Warn("replaying token verification outcomes, this must only be used for load tests")
+			}
+		}
+	}
+
+	if p.HTTPSignatures != nil {
+		errs = append(errs, p.HTTPSignatures.provision())
+	}
+	if p.SessionBinding != nil {
+		errs = append(errs, p.SessionBinding.provision(p.FromCookies))
+	}
+	if p.SignedURL != nil {
+		errs = append(errs, p.SignedURL.provision())
+	}
+	if p.Maintenance != nil {
+		errs = append(errs, p.Maintenance.provision())
+	}
+	if p.ChallengePages != nil {
+		errs = append(errs, p.ChallengePages.provision())
+	}
+	if p.Preflight != nil {
+		errs = append(errs, p.Preflight.provision())
+	}
+	if err = normOrigins(p.CORSOrigins); err != nil {
+		errs = append(errs, fmt.Errorf("invalid cors_origins: %w", err))
+	}
+	if p.WellKnown != "" && !strings.HasPrefix(p.WellKnown, "/") {
+		errs = append(errs, fmt.Errorf("invalid well_known: path must start with '/': '%s'", p.WellKnown))
+	}
+	if p.PublishKeys != "" && !strings.HasPrefix(p.PublishKeys, "/") {
+		errs = append(errs, fmt.Errorf("invalid publish_keys: path must start with '/': '%s'", p.PublishKeys))
+	}
+	if p.PublishKeys != "" && p.Purpose == paseto.Local {
+		errs = append(errs, errors.New("publish_keys can't be used with the local purpose, since its keys are secret"))
+	}
+
+	return errs
+}
+
+func (p *PasetoAuth) validateSessions() []error {
+	var errs []error
+
+	if p.IdleTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid idle timeout: '%s'", p.IdleTimeout))
+	}
+	if p.IdleTimeout > 0 || p.SessionStorage {
+		p.TrackSessions = true
+	}
+	// A timeout without tracked sessions is harmless, so it's ignored rather
+	// than rejected, to keep such configs valid. The logger is only set if the
+	// module was provisioned.
+	if p.SessionStorageTimeout != 0 && !p.TrackSessions && p.logger != nil {
+		p.logger.Warn("ignoring session_storage_timeout, sessions aren't tracked",
+			"hint", "enable track_sessions or session_storage, or remove session_storage_timeout")
+	}
+	if p.SessionStorageTimeout < 0 {
+		errs = append(errs, fmt.Errorf("invalid session storage timeout: '%s'", p.SessionStorageTimeout))
+	} else if p.SessionStorageTimeout == 0 {
+		p.SessionStorageTimeout = 5 * time.Second
+	}
+	if p.TrackSessions && p.sessions == nil {
+		p.sessions = sharedSessions
+	}
+
+	if p.CircuitBreaker == nil {
+		p.CircuitBreaker = &CircuitBreaker{}
+	}
+	errs = append(errs, p.CircuitBreaker.provision())
+	if p.TrackSessions {
+		p.sessionBreaker = newBreaker(backendSessionStorage, p.CircuitBreaker, p.metrics)
+	}
+
+	return errs
 }
 
 // Authenticate extracts the token according to the module configuration, parses
 // and validates it, and authenticates the user of the request.
-func (p *PasetoAuth) Authenticate(_ http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
-	var candidates []string
-	candidates = append(candidates, getTokensFromQuery(r, p.FromQuery)...)
-	candidates = append(candidates, getTokensFromHeader(r, p.FromHeader)...)
-	candidates = append(candidates, getTokensFromCookies(r, p.FromCookies)...)
-	candidates = append(candidates, getTokensFromHeader(r, []string{"Authorization"})...)
-
-	extraValidRules := []paseto.Rule{}
-	if len(p.AllowAudiences) > 0 {
-		extraValidRules = append(extraValidRules, xpaseto.AllowAudiences(p.AllowAudiences))
+func (p *PasetoAuth) Authenticate(w http.ResponseWriter, r *http.Request) (caddyauth.User, bool, error) {
+	if p.allowsUnauthenticated(r) {
+		return caddyauth.User{}, true, nil
 	}
-	if len(p.AllowIssuers) > 0 {
-		extraValidRules = append(extraValidRules, xpaseto.AllowIssuers(p.AllowIssuers))
+
+	return p.enforce(w, r, p.candidateTokens)
+}
+
+// AuthenticateToken authenticates the user of a token that was read from a
+// connection, rather than from an HTTP request, e.g. by the layer4 matcher and
+// handler of the l4paseto package. The token is verified with the key and rule
+// configuration as the only candidate of a request from remoteAddr, with the
+// context, e.g. for its replacer and variables. The token sources are ignored.
+func (p *PasetoAuth) AuthenticateToken(
+	ctx context.Context, remoteAddr, tokenStr string,
+) (caddyauth.User, bool, error) {
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, "/", nil)
+	if err != nil {
+		return caddyauth.User{}, false, fmt.Errorf("failed creating request: %w", err)
 	}
+	r.RemoteAddr = remoteAddr
 
-	checked := make(map[string]struct{})
-	for _, candidateToken := range candidates {
-		tokenStr := normToken(candidateToken)
-		if _, ok := checked[tokenStr]; ok {
-			continue
+	return p.enforce(&discardResponseWriter{header: make(http.Header)}, r, func(*http.Request) []string {
+		tokenStr = normToken(tokenStr)
+		if int64(len(tokenStr)) > p.MaxTokenLength {
+			p.logger.Warn("ignoring token that exceeds the maximum length", "length", len(tokenStr),
+				"max_token_length", p.MaxTokenLength)
+			return nil
+		}
+		if tokenStr == "" {
+			return nil
 		}
+		return []string{tokenStr}
+	})
+}
+
+// enforce authenticates the user of the request with the candidate tokens, and
+// allows the request if it would be rejected, but enforcement is off.
+func (p *PasetoAuth) enforce(
+	w http.ResponseWriter, r *http.Request, extract func(*http.Request) []string,
+) (caddyauth.User, bool, error) {
+	if !p.MonitorOnly {
+		return p.authenticate(w, r, extract)
+	}
 
-		token, err := xpaseto.ParseToken(p.key, tokenStr)
-		checked[tokenStr] = struct{}{}
+	// Rejections must not be written to the response.
+	user, authenticated, err := p.authenticate(&discardResponseWriter{header: make(http.Header)}, r, extract)
+	if err == nil && authenticated {
+		return user, true, nil
+	}
+	if err != nil {
+		p.logger.Warn("allowing request that would fail, enforcement is off", "error", err.Error())
+	} else {
+		p.logger.Warn("allowing request that would be rejected, enforcement is off")
+	}
+	p.metrics.incUnenforcedRejections()
+
+	return caddyauth.User{}, true, nil
+}
+
+// authenticate authenticates the user of the request with the candidate tokens,
+// and enforces the module configuration.
+func (p *PasetoAuth) authenticate(
+	w http.ResponseWriter, r *http.Request, extract func(*http.Request) []string,
+) (caddyauth.User, bool, error) {
+	var timing authTiming
+	defer timing.setVars(r)
+
+	start := time.Now()
+	candidates := extract(r)
+	timing.extract = time.Since(start)
+	extraValidRules := p.requestRules(r)
+	maintenance := p.Maintenance != nil && p.Maintenance.active(r)
+	budget := p.newVerifyBudget()
+	// rejected is the last token that was verified, but rejected.
+	var rejected *xpaseto.Token
+
+	for i, tokenStr := range candidates {
+		if budget.skip(len(candidates)-i, p.logger) {
+			break
+		}
 		logger := p.logger.With("token", maskToken(tokenStr))
 
-		if err != nil {
-			logger.Warn(err.Error())
+		release, poolErr := p.verifyPool.acquire(r.Context())
+		if poolErr != nil {
+			return rejectShed(w, poolErr, logger)
+		}
+		token := p.parseCandidate(tokenStr, budget, &timing, logger)
+		release()
+		if token == nil {
 			continue
 		}
+		logger = p.tenantLogger(token).With("token", maskToken(tokenStr))
 
-		err = token.Validate(time.Now, p.TimeSkewTolerance, extraValidRules...)
-		if err != nil {
-			logger.Warn(err.Error())
+		now := time.Now()
+		mapped, verified := p.verifyToken(r, token, now, extraValidRules, logger)
+		timing.rules += time.Since(now)
+		if rejected = token; !verified {
 			continue
 		}
+		userID := mapped.id
+		logger = logger.With("user_id", p.logUserID(mapped))
 
-		claimName, userID := getUserID(token.ClaimsRaw(), p.UserClaims)
-		if userID == "" {
-			logger.Warn("user claim is empty", "user_claims", p.UserClaims)
-			continue
+		if p.TrackSessions {
+			active, err := p.checkSession(r.Context(), token, userID, now, logger)
+			if err != nil {
+				return caddyauth.User{}, false, err
+			}
+			if !active {
+				continue
+			}
 		}
 
-		if len(p.AllowUsers) > 0 && !slices.Contains(p.AllowUsers, userID) {
-			logger.Warn("user is not allowed", "user_id", userID)
+		if maintenance && !p.Maintenance.bypass(token.ClaimsRaw()) {
+			logger.Warn("user is not allowed during maintenance")
 			continue
 		}
 
-		user := caddyauth.User{
-			ID:       userID,
-			Metadata: getUserMetadata(token, p.MetaClaims),
+		if p.RateLimit != nil && !p.allowRate(w, token.ClaimsRaw(), userID) {
+			logger.Warn("user exceeded the request rate limit")
+			return caddyauth.User{}, false, nil
 		}
 
-		logger.Info("user authenticated", "user_claim", claimName, "user_id", userID)
+		user := p.newUser(token, mapped)
+		setRequestVars(r, token.ClaimsRaw(), mapped)
+		p.stripConsumedToken(w, r, tokenStr)
+		p.logClaimChanges(token, userID, now, logger)
+
+		p.recordAuthentication(token, now)
+
+		logger.Info("user authenticated", "user_claim", mapped.claim)
 
 		return user, true, nil
 	}
 
+	p.reject(w, r, maintenance, rejected)
+
+	return caddyauth.User{}, false, nil
+}
+
+// reject writes the response of a request that failed authentication, if it
+// isn't the default 401 response. rejected is the last token that was
+// verified, but rejected, if any.
+func (p *PasetoAuth) reject(w http.ResponseWriter, r *http.Request, maintenance bool, rejected *xpaseto.Token) {
+	p.recordRejection(rejected, time.Now())
+	setCORSHints(w, r, p.CORSOrigins)
+	switch {
+	case maintenance:
+		p.Maintenance.reject(w)
+	case p.ChallengePages != nil:
+		var claims map[string]any
+		skew := p.TimeSkewTolerance
+		if rejected != nil {
+			claims = rejected.ClaimsRaw()
+			skew, _ = p.timePolicy(rejected)
+		}
+		p.ChallengePages.serve(w, r, challengeReason(rejected, time.Now(), skew), claims, p.logger)
+	}
+}
+
+// allowsUnauthenticated reports whether the request is allowed through without
+// authentication, i.e. it's an allowed CORS preflight request, or a request for
+// the token policy document or the public keys document.
+func (p *PasetoAuth) allowsUnauthenticated(r *http.Request) bool {
+	if p.Preflight != nil && p.Preflight.allows(r) {
+		p.logger.Debug("allowing preflight request", "origin", r.Header.Get("Origin"))
+		return true
+	}
+
+	return p.allowsWellKnown(r) || p.allowsPublishedKeys(r)
+}
+
+// extraRules returns the validation rules of the allow lists and the token type,
+// in addition to the time rules applied by xpaseto. The list files are
+// refreshed first, so that the request uses the current lists. The placeholders
+// of the allowed audiences are resolved with the replacer of the request, which
+// also provides the host audiences of AudienceFromHost.
+func (p *PasetoAuth) extraRules(repl *caddy.Replacer) []paseto.Rule {
+	p.refreshLists()
+	lists := p.lists.current()
+
+	rules := []paseto.Rule{}
+	if len(lists.denyAudiences) > 0 {
+		rules = append(rules, denyAudiences(lists.denyAudiences))
+	}
+	if len(lists.denyIssuers) > 0 {
+		rules = append(rules, denyIssuers(lists.denyIssuers))
+	}
+	if lists.audiences.enforced || p.AudienceFromHost {
+		var hosts []string
+		if p.AudienceFromHost {
+			hosts = hostAudiences(repl)
+		}
+		rules = append(rules, allowAudiences(lists.audiences.resolve(repl), hosts, p.AudienceMatch))
+	}
+	if lists.issuers.enforced {
+		rules = append(rules, allowIssuers(lists.issuers))
+	}
+	if p.TokenType != "" {
+		rules = append(rules, requireTokenType(p.TokenTypeClaim, p.TokenType))
+	}
+	if len(p.ClaimValues) > 0 {
+		rules = append(rules, p.allowClaimValues())
+	}
+	if len(p.ForbidClaims) > 0 {
+		rules = append(rules, forbidClaims(p.ForbidClaims))
+	}
+	if len(p.RequireClaims) > 0 {
+		rules = append(rules, p.requireClaimValues(p.RequireClaims))
+	}
+	if len(p.DenyRoles) > 0 {
+		rules = append(rules, denyRoles(p.RolesClaim, p.DenyRoles))
+	}
+	if len(p.AllowRoles) > 0 {
+		rules = append(rules, allowRoles(p.RolesClaim, p.AllowRoles))
+	}
+	if scopes := p.requestScopes(repl); len(scopes) > 0 {
+		rules = append(rules, requireScopes(scopes))
+	}
+
+	return rules
+}
+
+// parseCandidate parses and verifies the candidate token, unless it's denied,
+// or replays its recorded outcome if ReplayVerifications is enabled. It returns
+// nil if the token is denied or invalid.
+func (p *PasetoAuth) parseCandidate(
+	tokenStr string, budget *verifyBudget, timing *authTiming, logger *slog.Logger,
+) *xpaseto.Token {
+	fp := tokenFingerprint(tokenStr)
+	if p.lists.current().denied.contains(fp) || p.denylist.contains(fp) {
+		logger.Warn("token is denied", "fingerprint", fp)
+		return nil
+	}
+
+	start := time.Now()
+	token, err := p.verifyReplay.verify(fp, func() (*xpaseto.Token, error) {
+		return p.parseToken(tokenStr, budget)
+	})
+	timing.verify += time.Since(start)
+	if errors.Is(err, xpaseto.ErrKeyTokenProtocolMismatch) {
+		p.logProtocolMismatch(logger, tokenStr)
+		return nil
+	} else if err != nil {
+		logger.Warn(err.Error())
+		return nil
+	}
+
+	return token
+}
+
+// rejectShed rejects a request whose token couldn't be verified, because the
+// verification queue was full, or the request was canceled while waiting.
+func rejectShed(w http.ResponseWriter, err error, logger *slog.Logger) (caddyauth.User, bool, error) {
+	if !errors.Is(err, errVerifyShed) {
+		return caddyauth.User{}, false, err
+	}
+
+	logger.Warn("rejecting request, the token verification queue is full")
+	w.Header().Set("Retry-After", "1")
+	writeRejection(w, http.StatusServiceUnavailable, "")
+
 	return caddyauth.User{}, false, nil
 }
+
+// parseToken parses and verifies the token with each of the configured keys in
+// order, and returns the first successful result. If all keys fail, the error
+// of the last key is returned. If the token footer contains the PASERK ID of
+// a key in its "kid" field, only that key is used, and if RequireKID is set,
+// tokens without one are rejected. Each key that is tried
+// spends the budget, and errVerifyBudget is returned once it's exhausted.
+// Tokens of an issuer in IssuerKeys are verified with the keys of the issuer,
+// and tokens of a version in VersionKeys, or of a purpose in PurposeKeys, with
+// the keys of their protocol.
+func (p *PasetoAuth) parseToken(tokenStr string, budget *verifyBudget) (*xpaseto.Token, error) {
+	kid := tokenKeyID(tokenStr)
+	if kid == "" && p.RequireKID {
+		return nil, errMissingKeyID
+	}
+	if iss, fed := p.tokenIssuerKeys(tokenStr); fed != nil {
+		return fed.parseIssuerToken(iss, tokenStr, budget)
+	}
+	if pp := p.tokenProtocolKeys(tokenStr); pp != nil {
+		return pp.parseToken(tokenStr, budget)
+	}
+
+	p.refreshKeys()
+	set := p.keys.current()
+
+	keys := set.keys
+	if kid != "" {
+		key, ok := set.byID[kid]
+		if !ok {
+			p.expediteKeyURL()
+			return nil, fmt.Errorf("unknown key ID '%s'", kid)
+		}
+		keys = []*xpaseto.Key{key}
+	}
+	if len(keys) == 0 {
+		return nil, errNoIssuerKey
+	}
+
+	var err error
+	for _, key := range keys {
+		if budget.exhausted() {
+			return nil, errVerifyBudget
+		}
+		start := time.Now()
+		var token *xpaseto.Token
+		token, err = xpaseto.ParseToken(key, tokenStr)
+		budget.spend(time.Since(start))
+		if err == nil {
+			p.warnStaleKey(set, key)
+			return token, nil
+		}
+		// All keys share the same protocol, so there's no point in trying others.
+		if errors.Is(err, xpaseto.ErrKeyTokenProtocolMismatch) {
+			break
+		}
+	}
+
+	//nolint:wrapcheck // the xpaseto error is descriptive enough
+	return nil, err
+}
+
+// logProtocolMismatch logs a token whose protocol doesn't match the configured
+// version and purpose, with a hint about the likely misconfiguration.
+func (p *PasetoAuth) logProtocolMismatch(logger *slog.Logger, tokenStr string) {
+	proto, err := xpaseto.TokenProtocol(tokenStr)
+	if err != nil {
+		logger.Warn(err.Error())
+		return
+	}
+
+	var hint string
+	switch {
+	case proto.Version() != p.Version:
+		hint = fmt.Sprintf("set `version %s` if such tokens are expected", strings.TrimPrefix(string(proto.Version()), "v"))
+	case proto.Purpose() == paseto.Local:
+		hint = "set `purpose local` and configure the symmetric key if such tokens are expected"
+	default:
+		hint = "set `purpose public` and configure the public key if such tokens are expected"
+	}
+
+	logger.Warn("token protocol doesn't match the configured version and purpose",
+		"token_protocol", strings.TrimSuffix(proto.Header(), "."),
+		"version", p.Version, "purpose", p.Purpose, "hint", hint)
+}
+
+// candidateTokens returns the normalized candidate tokens of the request from
+// all configured sources, in order of priority, without duplicates. The
+// implicit Authorization header source is tried last, unless it's disabled
+// with DisableImplicitAuthorization. If TokenExtraction
+// is "first", only the first candidate is returned, and the later sources
+// aren't read. Candidates longer than MaxTokenLength are ignored, and at most
+// MaxCandidates are returned.
+func (p *PasetoAuth) candidateTokens(r *http.Request) []string {
+	first := p.TokenExtraction == tokenExtractionFirst
+	var unique []string
+	add := func(candidates []string) bool {
+		for _, candidate := range candidates {
+			tokenStr := normToken(candidate)
+			switch {
+			case tokenStr == "":
+				continue
+			case int64(len(tokenStr)) > p.MaxTokenLength:
+				p.logger.Warn("ignoring token that exceeds the maximum length", "length", len(tokenStr),
+					"max_token_length", p.MaxTokenLength)
+				continue
+			case slices.Contains(unique, tokenStr):
+				continue
+			case len(unique) >= p.MaxCandidates:
+				p.logger.Warn("request has too many candidate tokens, ignoring the rest",
+					"max_candidates", p.MaxCandidates)
+				return true
+			}
+			unique = append(unique, tokenStr)
+			if first {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, typ := range p.tokenSources {
+		if add(p.sourceTokens(r, typ)) {
+			return unique
+		}
+	}
+	if !p.DisableImplicitAuthorization {
+		add(p.headerTokens(r, p.allowedSources(r, sourceHeader, []string{"Authorization"})))
+	}
+
+	return unique
+}
+
+// headerTokens returns the tokens of all values of the request headers with the
+// names, since some proxies duplicate headers. The values of Authorization
+// headers are handled by authorizationTokens.
+func (p *PasetoAuth) headerTokens(r *http.Request, names []string) []string {
+	tokens := make([]string, 0)
+	for _, name := range names {
+		values := r.Header.Values(name)
+		if http.CanonicalHeaderKey(name) == "Authorization" {
+			tokens = append(tokens, p.authorizationTokens(name, values)...)
+			continue
+		}
+		for _, token := range values {
+			if token != "" {
+				tokens = append(tokens, token)
+			}
+		}
+	}
+	return tokens
+}
+
+// authorizationTokens returns the tokens of the values of an Authorization
+// header, or a header with the same syntax. The scheme is removed, and values
+// that aren't in an accepted scheme are ignored. If StrictBearer is enabled,
+// the values are ignored unless there's a single one strictly in the Bearer
+// scheme.
+func (p *PasetoAuth) authorizationTokens(header string, values []string) []string {
+	if len(values) == 0 {
+		return nil
+	}
+	if p.StrictBearer {
+		token, ok := strictBearerToken(values)
+		if !ok {
+			p.logger.Warn("ignoring Authorization header that isn't strictly in the Bearer scheme", "header", header,
+				"hint", "send exactly one '"+header+": Bearer <token>' header")
+			return nil
+		}
+		return []string{token}
+	}
+
+	tokens := make([]string, 0, len(values))
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		token, ok := p.authorizationToken(value)
+		if !ok {
+			p.logger.Debug("ignoring Authorization header that isn't in an accepted scheme", "header", header,
+				"authorization_schemes", p.AuthorizationSchemes)
+			continue
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens
+}
+
+// authorizationToken returns the token of the Authorization header value, if
+// its scheme is one of AuthorizationSchemes, compared case-insensitively, or
+// if it has no scheme, unless RequireAuthorizationScheme is enabled.
+func (p *PasetoAuth) authorizationToken(value string) (string, bool) {
+	value = strings.TrimSpace(value)
+	scheme, token, found := strings.Cut(value, " ")
+	if !found {
+		return value, !p.RequireAuthorizationScheme
+	}
+	if !slices.ContainsFunc(p.AuthorizationSchemes, func(s string) bool { return strings.EqualFold(s, scheme) }) {
+		return "", false
+	}
+
+	return strings.TrimSpace(token), true
+}
+
+// verifyToken validates the token at the given time, and verifies the request
+// signature, if enabled. It returns the name of the user claim and the user ID,
+// or false if the token must be rejected.
+func (p *PasetoAuth) verifyToken(
+	r *http.Request, token *xpaseto.Token, now time.Time, extraRules []paseto.Rule, logger *slog.Logger,
+) (mappedUser, bool) {
+	skew, maxAge := p.timePolicy(token)
+	if maxAge > 0 {
+		extraRules = append(slices.Clip(extraRules), notOlderThan(now, maxAge, skew))
+	}
+	err := token.Validate(func() time.Time { return now }, skew, extraRules...)
+	if err != nil {
+		logger.Warn(err.Error())
+		return mappedUser{}, false
+	}
+
+	user, err := p.mapUser(r, token.ClaimsRaw())
+	if err != nil {
+		logger.Warn(err.Error())
+		return mappedUser{}, false
+	}
+	if user.id == "" {
+		if p.claimMapper != nil {
+			logger.Warn("claim mapper returned an empty user ID")
+		} else {
+			logger.Warn("user claim is empty", "user_claims", p.UserClaims)
+		}
+		return mappedUser{}, false
+	}
+	logger = logger.With("user_id", p.logUserID(user))
+
+	lists := p.lists.current()
+	if slices.Contains(lists.denyUsers, user.id) {
+		logger.Warn("user is denied")
+		return mappedUser{}, false
+	}
+	if users := lists.users; users.enforced && !slices.Contains(users.values, user.id) {
+		logger.Warn("user is not allowed")
+		return mappedUser{}, false
+	}
+
+	if p.HTTPSignatures != nil {
+		if err = p.HTTPSignatures.verify(r, token.ClaimsRaw(), now, skew); err != nil {
+			logger.Warn(err.Error())
+			return mappedUser{}, false
+		}
+	}
+
+	if p.SessionBinding != nil {
+		if err = p.SessionBinding.verify(r, token.ClaimsRaw()); err != nil {
+			logger.Warn(err.Error())
+			return mappedUser{}, false
+		}
+	}
+
+	if p.SignedURL != nil {
+		if err = p.SignedURL.verify(r, token.ClaimsRaw(), p.FromQuery); err != nil {
+			logger.Warn(err.Error())
+			return mappedUser{}, false
+		}
+	}
+
+	if p.RouteClaim != "" {
+		if user.route, err = p.routeValue(token.ClaimsRaw()); err != nil {
+			logger.Warn(err.Error())
+			return mappedUser{}, false
+		}
+	}
+
+	return user, true
+}
+
+// newUser returns the authenticated user with the metadata from the token.
+func (p *PasetoAuth) newUser(token *xpaseto.Token, mapped mappedUser) caddyauth.User {
+	user := caddyauth.User{
+		ID:       mapped.id,
+		Metadata: getUserMetadata(token, p.MetaClaims),
+	}
+	if len(mapped.metadata) > 0 {
+		if user.Metadata == nil {
+			user.Metadata = make(map[string]string, len(mapped.metadata))
+		}
+		maps.Copy(user.Metadata, mapped.metadata)
+	}
+	if len(p.CacheKeyClaims) > 0 {
+		if user.Metadata == nil {
+			user.Metadata = make(map[string]string)
+		}
+		user.Metadata[cacheKeyPlaceholder] = getCacheKey(token.ClaimsRaw(), p.CacheKeyClaims)
+	}
+
+	return user
+}
+
+// trackSession records the use of the token session, and returns the stored
+// session state. It returns false if the token doesn't have a "jti" claim.
+func (p *PasetoAuth) trackSession(
+	ctx context.Context, token *xpaseto.Token, userID string, now time.Time,
+) (Session, bool, error) {
+	jti, err := token.GetJti()
+	if err != nil || jti == "" {
+		return Session{}, false, nil
+	}
+
+	sess := Session{ID: jti, Subject: userID}
+	sess.Issuer, _ = token.GetIssuer()
+	sess.IssuedAt, _ = token.GetIssuedAt()
+	sess.ExpiresAt, _ = token.GetExpiration()
+
+	if !p.sessionBreaker.allow(now) {
+		return Session{}, false, fmt.Errorf("failed tracking session: %w", errBreakerOpen)
+	}
+	ctx, cancel := context.WithTimeout(ctx, p.SessionStorageTimeout)
+	defer cancel()
+	sess, err = p.sessions.Seen(ctx, sess, now, p.IdleTimeout)
+	p.sessionBreaker.record(err, time.Now())
+	if err != nil {
+		return Session{}, false, fmt.Errorf("failed tracking session: %w", err)
+	}
+
+	return sess, true, nil
+}
+
+// checkSession tracks the token session, and reports whether it's active, i.e.
+// it's neither revoked nor idle. Tokens without a "jti" claim are always active,
+// and so are all tokens if the session can't be tracked and the circuit
+// breaker fails open.
+func (p *PasetoAuth) checkSession(
+	ctx context.Context, token *xpaseto.Token, userID string, now time.Time, logger *slog.Logger,
+) (bool, error) {
+	sess, ok, err := p.trackSession(ctx, token, userID, now)
+	if err != nil {
+		if p.CircuitBreaker.FailOpen {
+			logger.Warn(err.Error(), "fail_open", true)
+			return true, nil
+		}
+		return false, err
+	}
+	if !ok {
+		return true, nil
+	}
+	if sess.Revoked {
+		logger.Warn("session is revoked", "jti", sess.ID)
+		return false, nil
+	}
+	if sess.Idle {
+		logger.Warn("session is idle", "jti", sess.ID)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// allowRate increments the request counter of the user, and reports whether
+// the request is within the user's limit. If it isn't, a 429 response is
+// written to w.
+func (p *PasetoAuth) allowRate(w http.ResponseWriter, claims map[string]any, userID string) bool {
+	limit, limited := p.RateLimit.limit(claims)
+	if !limited {
+		return true
+	}
+
+	now := time.Now()
+	count, reset := p.counters.Incr(p.RateLimit.counterKey(claims, userID), p.RateLimit.Window, now)
+	if count <= limit {
+		return true
+	}
+
+	retryAfter := int(math.Ceil(reset.Sub(now).Seconds()))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	writeRejection(w, http.StatusTooManyRequests, "")
+
+	return false
+}
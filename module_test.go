@@ -1,16 +1,38 @@
 package caddypaseto
 
 import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp/caddyauth"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
+	"go.hackfix.me/paseto-cli/xpaseto"
+
 	"go.hackfix.me/caddy-paseto/testutil"
 )
 
@@ -201,95 +223,2698 @@ func TestPasetoAuth_Authenticate(t *testing.T) {
 	}
 }
 
-func TestPasetoAuth_Validate(t *testing.T) {
+func TestPasetoAuth_AuthenticateRateLimit(t *testing.T) {
 	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
 	v4PublicKey := v4PrivateKey.Public()
-	v4SymmetricKey := paseto.NewV4SymmetricKey()
+
+	newTokenStr := func(sub string, claims map[string]any) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject(sub)
+		for k, v := range claims {
+			require.NoError(t, token.Set(k, v))
+		}
+		return token.V4Sign(v4PrivateKey, nil)
+	}
 
 	tests := []struct {
-		name   string
-		config PasetoAuth
-		expErr string
+		name      string
+		token     string
+		rateLimit RateLimit
+		expAuthed int
 	}{
 		{
-			name: "ok/valid_public_key_v4",
-			config: PasetoAuth{
-				Key:     v4PublicKey.ExportHex(),
-				Version: paseto.Version4,
-				Purpose: paseto.Public,
-			},
+			name:      "numeric_claim",
+			token:     newTokenStr("alice", map[string]any{"rpm": 2}),
+			rateLimit: RateLimit{Claim: "rpm"},
+			expAuthed: 2,
 		},
 		{
-			name: "ok/valid_symmetric_key_v4_local",
-			config: PasetoAuth{
-				Key:     v4SymmetricKey.ExportHex(),
-				Version: paseto.Version4,
-				Purpose: paseto.Local,
-			},
+			name:      "tier_claim",
+			token:     newTokenStr("bob", map[string]any{"tier": "silver"}),
+			rateLimit: RateLimit{Claim: "tier", Tiers: map[string]int{"silver": 3}},
+			expAuthed: 3,
 		},
 		{
-			name: "ok/defaults_applied",
-			config: PasetoAuth{
-				Key: v4PublicKey.ExportHex(),
-			},
+			name:      "default_limit",
+			token:     newTokenStr("carol", nil),
+			rateLimit: RateLimit{Claim: "rpm", Default: 1},
+			expAuthed: 1,
 		},
 		{
-			name: "err/invalid_version",
-			config: PasetoAuth{
-				Key:     v4PublicKey.ExportHex(),
-				Version: "v5",
-				Purpose: paseto.Public,
-			},
-			expErr: "invalid version: 'v5'",
+			name:      "unlimited",
+			token:     newTokenStr("dave", nil),
+			rateLimit: RateLimit{Claim: "rpm"},
+			expAuthed: 5,
 		},
 		{
-			name: "err/invalid_purpose",
-			config: PasetoAuth{
-				Key:     v4PublicKey.ExportHex(),
-				Version: paseto.Version4,
-				Purpose: "invalid",
-			},
-			expErr: "invalid purpose: 'invalid'",
+			name:      "unlimited_tier",
+			token:     newTokenStr("erin", map[string]any{"tier": "internal"}),
+			rateLimit: RateLimit{Claim: "tier", Tiers: map[string]int{"internal": 0}},
+			expAuthed: 5,
 		},
 		{
-			name: "err/invalid_key",
-			config: PasetoAuth{
-				Key:     "invalid-key",
-				Version: paseto.Version4,
-				Purpose: paseto.Public,
-			},
-			expErr: "invalid byte",
+			name:      "zero_claim",
+			token:     newTokenStr("frank", map[string]any{"rpm": 0}),
+			rateLimit: RateLimit{Claim: "rpm", Default: 100},
+			expAuthed: 0,
 		},
 		{
-			name: "err/empty_key",
-			config: PasetoAuth{
-				Version: paseto.Version4,
-				Purpose: paseto.Public,
-			},
-			expErr: "key length incorrect",
+			name:      "negative_claim",
+			token:     newTokenStr("grace", map[string]any{"rpm": -1}),
+			rateLimit: RateLimit{Claim: "rpm"},
+			expAuthed: 0,
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			err := tt.config.Validate()
+			auth := &PasetoAuth{
+				Key:       v4PublicKey.ExportHex(),
+				FromQuery: []string{"token"},
+				RateLimit: &tt.rateLimit,
+				counters:  newMemoryCounterStore(),
+				logger:    slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
 
-			if tt.expErr != "" {
-				require.Error(t, err)
-				assert.Contains(t, err.Error(), tt.expErr)
-				return
+			var authedCount int
+			for range 5 {
+				w := httptest.NewRecorder()
+				req := httptest.NewRequest(http.MethodGet, "/?token="+tt.token, nil)
+				_, authenticated, err := auth.Authenticate(w, req)
+				require.NoError(t, err)
+				if authenticated {
+					authedCount++
+				} else {
+					assert.Equal(t, http.StatusTooManyRequests, w.Code)
+					assert.NotEmpty(t, w.Header().Get("Retry-After"))
+				}
 			}
+			assert.Equal(t, tt.expAuthed, authedCount)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateRateLimitShared(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
 
+	newTokenStr := func(iss string) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetIssuer(iss)
+		token.SetSubject("alice")
+		require.NoError(t, token.Set("rpm", 1))
+		require.NoError(t, token.Set("quota", 1))
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	// The handlers share a counter store, as the module instances do.
+	counters := newMemoryCounterStore()
+	newAuth := func(claim string) *PasetoAuth {
+		auth := &PasetoAuth{
+			Key:       v4PrivateKey.Public().ExportHex(),
+			FromQuery: []string{"token"},
+			RateLimit: &RateLimit{Claim: claim},
+			counters:  counters,
+			logger:    slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, auth.Validate())
+		return auth
+	}
+	rpm, otherRPM, quota := newAuth("rpm"), newAuth("rpm"), newAuth("quota")
+
+	tests := []struct {
+		name    string
+		auth    *PasetoAuth
+		token   string
+		expAuth bool
+	}{
+		{name: "ok/first", auth: rpm, token: newTokenStr("site-a"), expAuth: true},
+		{name: "err/same_issuer_and_claim", auth: otherRPM, token: newTokenStr("site-a")},
+		{name: "ok/other_issuer", auth: rpm, token: newTokenStr("site-b"), expAuth: true},
+		{name: "ok/other_claim", auth: quota, token: newTokenStr("site-a"), expAuth: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.token, nil)
+			_, authenticated, err := tt.auth.Authenticate(w, req)
 			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+}
 
-			if tt.name == "ok/defaults_applied" {
-				assert.Equal(t, paseto.Version4, tt.config.Version)
-				assert.Equal(t, paseto.Public, tt.config.Purpose)
+func TestPasetoAuth_AuthenticateMonitorOnly(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	require.NoError(t, token.Set("rpm", 1))
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	reg := prometheus.NewPedanticRegistry()
+	m, err := newMetrics(reg)
+	require.NoError(t, err)
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:         v4PrivateKey.Public().ExportHex(),
+		FromQuery:   []string{"token"},
+		RateLimit:   &RateLimit{Claim: "rpm"},
+		MonitorOnly: true,
+		counters:    newMemoryCounterStore(),
+		metrics:     m,
+		logger:      slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name          string
+		query         string
+		expUserID     string
+		expRejections float64
+	}{
+		{name: "ok/valid_token", query: "?token=" + tokenStr, expUserID: "user123"},
+		{name: "ok/rate_limited", query: "?token=" + tokenStr, expRejections: 1},
+		{name: "ok/invalid_token", query: "?token=v4.public.invalid", expRejections: 2},
+		{name: "ok/missing_token", expRejections: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/"+tt.query, nil)
+			user, authenticated, err := auth.Authenticate(w, req)
+			require.NoError(t, err)
+			assert.True(t, authenticated)
+			assert.Equal(t, tt.expUserID, user.ID)
+
+			// Nothing is written to the response.
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Empty(t, w.Header())
+			assert.Empty(t, w.Body.String())
+			assert.Equal(t, tt.expRejections, gatherValue(t, reg, "caddy_paseto_unenforced_rejections_total"))
+		})
+	}
+
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "user exceeded the request rate limit"))
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "allowing request that would be rejected, enforcement is off"))
+}
+
+func TestPasetoAuth_AuthenticateToken(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:            v4PrivateKey.Public().ExportHex(),
+		FromQuery:      []string{"token"},
+		MaxTokenLength: int64(len(tokenStr)),
+		logger:         slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name      string
+		token     string
+		expUserID string
+	}{
+		{name: "ok/valid_token", token: tokenStr, expUserID: "user123"},
+		{name: "ok/surrounding_space", token: " " + tokenStr + " ", expUserID: "user123"},
+		{name: "err/invalid_token", token: "v4.public.invalid"},
+		{name: "err/too_long", token: tokenStr + "a"},
+		{name: "err/empty", token: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, authenticated, err := auth.AuthenticateToken(t.Context(), "192.0.2.1:4242", tt.token)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expUserID != "", authenticated)
+			assert.Equal(t, tt.expUserID, user.ID)
+		})
+	}
+
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "ignoring token that exceeds the maximum length"))
+}
+
+func TestPasetoAuth_AuthenticateCORSHints(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:         v4PrivateKey.Public().ExportHex(),
+		FromCookies: []string{"session"},
+		CORSOrigins: []string{"https://*.example.com"},
+		logger:      slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name      string
+		origin    string
+		expOrigin string
+	}{
+		{name: "ok/allowed", origin: "https://App.example.com", expOrigin: "https://App.example.com"},
+		{name: "ok/not_allowed", origin: "https://example.org"},
+		{name: "ok/same_origin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api", nil)
+			if tt.origin != "" {
+				req.Header.Set("Origin", tt.origin)
 			}
+			rec := httptest.NewRecorder()
+			_, authenticated, err := auth.Authenticate(rec, req)
+			require.NoError(t, err)
+			assert.False(t, authenticated)
 
-			assert.Equal(t, 30*time.Second, tt.config.TimeSkewTolerance)
-			assert.Equal(t, []string{"sub"}, tt.config.UserClaims)
-			assert.NotNil(t, tt.config.key)
+			assert.Equal(t, tt.expOrigin, rec.Header().Get("Access-Control-Allow-Origin"))
+			if tt.expOrigin != "" {
+				assert.Equal(t, "true", rec.Header().Get("Access-Control-Allow-Credentials"))
+				assert.Equal(t, "Origin", rec.Header().Get("Vary"))
+			} else {
+				assert.Empty(t, rec.Header())
+			}
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticatePreflight(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	newAuth := func(origins ...string) *PasetoAuth {
+		auth := &PasetoAuth{
+			Key:        v4PrivateKey.Public().ExportHex(),
+			FromHeader: []string{"Authorization"},
+			Preflight:  &Preflight{Origins: origins},
+			logger:     slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, auth.Validate())
+		return auth
+	}
+
+	newRequest := func(method, origin string) *http.Request {
+		req := httptest.NewRequest(method, "/api", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		return req
+	}
+
+	tests := []struct {
+		name    string
+		auth    *PasetoAuth
+		req     *http.Request
+		expAuth bool
+	}{
+		{
+			name:    "ok/any_origin",
+			auth:    newAuth(),
+			req:     newRequest(http.MethodOptions, "https://app.example.com"),
+			expAuth: true,
+		},
+		{
+			name:    "ok/exact_origin",
+			auth:    newAuth("https://App.example.com"),
+			req:     newRequest(http.MethodOptions, "https://app.example.com"),
+			expAuth: true,
+		},
+		{
+			name:    "ok/wildcard_origin",
+			auth:    newAuth("https://*.example.com"),
+			req:     newRequest(http.MethodOptions, "https://app.eu.example.com"),
+			expAuth: true,
+		},
+		{
+			name: "err/other_origin",
+			auth: newAuth("https://*.example.com"),
+			req:  newRequest(http.MethodOptions, "https://example.org"),
+		},
+		{
+			name: "err/wildcard_path",
+			auth: newAuth("https://*.example.com"),
+			req:  newRequest(http.MethodOptions, "https://evil.com/.example.com"),
+		},
+		{
+			name: "err/not_options",
+			auth: newAuth(),
+			req:  newRequest(http.MethodPost, "https://app.example.com"),
+		},
+		{
+			name: "err/not_preflight",
+			auth: newAuth(),
+			req:  httptest.NewRequest(http.MethodOptions, "/api", nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, authenticated, err := tt.auth.Authenticate(httptest.NewRecorder(), tt.req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateMaintenance(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	newTokenStr := func(claims map[string]any) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		for k, v := range claims {
+			require.NoError(t, token.Set(k, v))
+		}
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+	userTokenStr := newTokenStr(nil)
+	maintTokenStr := newTokenStr(map[string]any{"maint": true})
+	scopeTokenStr := newTokenStr(map[string]any{"scope": []string{"read", "deploy"}})
+
+	tests := []struct {
+		name        string
+		maintenance Maintenance
+		toggle      bool
+		env         string
+		token       string
+		expAuth     bool
+		expStatus   int
+		expBody     string
+	}{
+		{
+			name:        "ok/disabled",
+			maintenance: Maintenance{},
+			token:       userTokenStr,
+			expAuth:     true,
+		},
+		{
+			name:        "ok/bypass_claim",
+			maintenance: Maintenance{Enabled: "true"},
+			token:       maintTokenStr,
+			expAuth:     true,
+		},
+		{
+			name:        "ok/bypass_claim_array",
+			maintenance: Maintenance{Enabled: "on", BypassClaim: "scope", BypassValue: "deploy"},
+			token:       scopeTokenStr,
+			expAuth:     true,
+		},
+		{
+			name:        "err/enabled",
+			maintenance: Maintenance{Enabled: "true", Body: "Back soon!"},
+			token:       userTokenStr,
+			expStatus:   http.StatusServiceUnavailable,
+			expBody:     "Back soon!",
+		},
+		{
+			name:        "err/enabled_no_token",
+			maintenance: Maintenance{Enabled: "1"},
+			expStatus:   http.StatusServiceUnavailable,
+			expBody:     "Service Unavailable",
+		},
+		{
+			name:        "err/enabled_env",
+			maintenance: Maintenance{Enabled: "{env.CADDY_PASETO_TEST_MAINT}", StatusCode: http.StatusTeapot},
+			env:         "true",
+			token:       userTokenStr,
+			expStatus:   http.StatusTeapot,
+			expBody:     "I'm a teapot",
+		},
+		{
+			name:        "err/enabled_toggle",
+			maintenance: Maintenance{},
+			toggle:      true,
+			token:       userTokenStr,
+			expStatus:   http.StatusServiceUnavailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("CADDY_PASETO_TEST_MAINT", tt.env)
+			maintenanceToggle.Store(tt.toggle)
+			t.Cleanup(func() { maintenanceToggle.Store(false) })
+
+			auth := &PasetoAuth{
+				Key:         v4PublicKey.ExportHex(),
+				FromQuery:   []string{"token"},
+				Maintenance: &tt.maintenance,
+				logger:      slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.token, nil)
+			_, authenticated, err := auth.Authenticate(w, req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+
+			if !tt.expAuth {
+				assert.Equal(t, tt.expStatus, w.Code)
+				if tt.expBody != "" {
+					assert.Equal(t, tt.expBody, w.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateSessions(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	newTokenStr := func(jti string) string {
+		token := paseto.NewToken()
+		token.SetJti(jti)
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	ctx := context.Background()
+	store := newMemorySessionStore()
+	auth := &PasetoAuth{
+		Key:         v4PublicKey.ExportHex(),
+		FromQuery:   []string{"token"},
+		IdleTimeout: time.Hour,
+		sessions:    store,
+		logger:      slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	assert.True(t, auth.TrackSessions)
+
+	authenticate := func(tokenStr string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	t.Run("revoked", func(t *testing.T) {
+		tokenStr := newTokenStr("session123")
+		require.True(t, authenticate(tokenStr))
+		sessions, err := store.List(ctx, sessionFilter{ID: "session123"}, time.Now())
+		require.NoError(t, err)
+		require.Len(t, sessions, 1)
+		assert.Equal(t, "user123", sessions[0].Subject)
+		assert.False(t, sessions[0].LastSeen.IsZero())
+
+		n, err := store.Revoke(ctx, sessionFilter{ID: "session123"}, time.Now())
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+		assert.False(t, authenticate(tokenStr))
+	})
+
+	t.Run("idle", func(t *testing.T) {
+		tokenStr := newTokenStr("session456")
+		_, err := store.Seen(ctx, Session{
+			ID: "session456", Subject: "user123", ExpiresAt: time.Now().Add(time.Hour),
+		}, time.Now().Add(-2*time.Hour), 0)
+		require.NoError(t, err)
+		assert.False(t, authenticate(tokenStr))
+	})
+
+	t.Run("no_jti", func(t *testing.T) {
+		assert.True(t, authenticate(newTokenStr("")))
+	})
+}
+
+// hungSessionStore is a session store whose operations block until the
+// context is done, like a hung storage backend.
+type hungSessionStore struct {
+	sessionStore
+}
+
+func (hungSessionStore) Seen(ctx context.Context, _ Session, _ time.Time, _ time.Duration) (Session, error) {
+	<-ctx.Done()
+	return Session{}, ctx.Err()
+}
+
+func TestPasetoAuth_AuthenticateSessionStorageTimeout(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetJti("session123")
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	auth := &PasetoAuth{
+		Key:                   v4PrivateKey.Public().ExportHex(),
+		FromQuery:             []string{"token"},
+		TrackSessions:         true,
+		SessionStorageTimeout: 10 * time.Millisecond,
+		sessions:              hungSessionStore{},
+		logger:                slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	t.Run("err/timeout", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.False(t, authenticated)
+	})
+
+	t.Run("err/client_canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.ErrorIs(t, err, context.Canceled)
+		assert.False(t, authenticated)
+	})
+
+	t.Run("ok/untracked", func(t *testing.T) {
+		logHandler := testutil.NewTestLogHandler()
+		untracked := &PasetoAuth{
+			Key:                   v4PrivateKey.Public().ExportHex(),
+			SessionStorageTimeout: time.Second,
+			logger:                slog.New(logHandler),
+		}
+		require.NoError(t, untracked.Validate())
+		assert.True(t, logHandler.HasRecord(slog.LevelWarn, "ignoring session_storage_timeout, sessions aren't tracked"))
+	})
+
+	t.Run("ok/untracked_unprovisioned", func(t *testing.T) {
+		untracked := &PasetoAuth{
+			Key:                   v4PrivateKey.Public().ExportHex(),
+			SessionStorageTimeout: time.Second,
+		}
+		require.NoError(t, untracked.Validate())
+	})
+}
+
+func TestPasetoAuth_AuthenticateKeyRotation(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+	otherKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	auth := &PasetoAuth{
+		Key:       newKey.Public().ExportHex(),
+		Keys:      []string{oldKey.Public().ExportHex()},
+		FromQuery: []string{"token"},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name    string
+		key     paseto.V4AsymmetricSecretKey
+		expAuth bool
+	}{
+		{name: "ok/new_key", key: newKey, expAuth: true},
+		{name: "ok/old_key", key: oldKey, expAuth: true},
+		{name: "err/unknown_key", key: otherKey},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(tt.key, nil), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
 		})
 	}
 }
+
+func TestPasetoAuth_AuthenticateKeyFile(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+
+	keyPath := filepath.Join(t.TempDir(), "paseto.key")
+	modTime := time.Now()
+	writeKey := func(data string) {
+		require.NoError(t, os.WriteFile(keyPath, []byte(data), 0o600))
+		// Ensure the change is detected regardless of the mtime granularity.
+		modTime = modTime.Add(time.Second)
+		require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+	}
+	writeKey(oldKey.Public().ExportHex() + "\n")
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		KeyFile:         keyPath,
+		KeyFileInterval: time.Nanosecond,
+		FromQuery:       []string{"token"},
+		logger:          slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	authenticate := func(key paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	assert.True(t, authenticate(oldKey))
+	assert.False(t, authenticate(newKey))
+
+	writeKey(newKey.Public().ExportHex())
+	assert.True(t, authenticate(newKey))
+	assert.False(t, authenticate(oldKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "reloaded key file"))
+
+	// An invalid key, e.g. from a partial write, keeps the previous key.
+	writeKey(newKey.Public().ExportHex()[:10])
+	assert.True(t, authenticate(newKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "invalid key file"))
+
+	require.NoError(t, os.Remove(keyPath))
+	assert.True(t, authenticate(newKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "failed reading key file"))
+}
+
+func TestPasetoAuth_AuthenticateKeyFileCheck(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	// The new key has the same size and modification time as the old one, as
+	// can happen on network file systems, so it's only detected by the content.
+	tests := []struct {
+		name   string
+		check  string
+		expNew bool
+	}{
+		{name: "ok/mtime", check: "", expNew: false},
+		{name: "ok/content", check: "content", expNew: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			keyPath := filepath.Join(t.TempDir(), "paseto.key")
+			modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+			writeKey := func(key paseto.V4AsymmetricSecretKey) {
+				require.NoError(t, os.WriteFile(keyPath, []byte(key.Public().ExportHex()), 0o600))
+				require.NoError(t, os.Chtimes(keyPath, modTime, modTime))
+			}
+			writeKey(oldKey)
+
+			auth := &PasetoAuth{
+				KeyFile:         keyPath,
+				KeyFileInterval: time.Nanosecond,
+				KeyFileCheck:    tt.check,
+				FromQuery:       []string{"token"},
+				logger:          slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			authenticate := func(key paseto.V4AsymmetricSecretKey) bool {
+				req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+				_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+				require.NoError(t, err)
+				return authenticated
+			}
+
+			assert.True(t, authenticate(oldKey))
+			writeKey(newKey)
+			assert.Equal(t, tt.expNew, authenticate(newKey))
+			assert.Equal(t, !tt.expNew, authenticate(oldKey))
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateKeyURL(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+
+	paserk := func(key paseto.V4AsymmetricSecretKey) string {
+		return "k4.public." + base64.RawURLEncoding.EncodeToString(key.Public().ExportBytes())
+	}
+
+	var (
+		mu       sync.Mutex
+		doc      = `{"keys": ["` + paserk(oldKey) + `"]}`
+		etag     = `"1"`
+		requests int
+		cached   int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.Header.Get("If-None-Match") == etag {
+			cached++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		_, _ = w.Write([]byte(doc))
+	}))
+	t.Cleanup(srv.Close)
+
+	setDoc := func(newDoc, newETag string) {
+		mu.Lock()
+		defer mu.Unlock()
+		doc, etag = newDoc, newETag
+	}
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		KeyURL:         srv.URL + "/keys",
+		KeyURLInterval: time.Nanosecond,
+		FromQuery:      []string{"token"},
+		logger:         slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	authenticate := func(key paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	assert.True(t, authenticate(oldKey))
+	assert.False(t, authenticate(newKey))
+
+	// Unchanged documents aren't reloaded.
+	auth.refreshKeyURL()
+	mu.Lock()
+	assert.Positive(t, cached)
+	mu.Unlock()
+
+	// Keys are fetched in the background, so the new key is accepted eventually.
+	setDoc(`{"keys": ["`+paserk(newKey)+`", "`+paserk(oldKey)+`"]}`, `"2"`)
+	assert.Eventually(t, func() bool { return authenticate(newKey) }, 5*time.Second, 10*time.Millisecond)
+	assert.True(t, authenticate(oldKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "reloaded keys from URL"))
+
+	// Invalid documents keep the previous keys.
+	setDoc(`{"keys": []}`, `"3"`)
+	auth.refreshKeyURL()
+	assert.True(t, authenticate(newKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "invalid key document: keys are empty"))
+
+	// A single key document.
+	setDoc(newKey.Public().ExportHex(), `"4"`)
+	auth.refreshKeyURL()
+	assert.True(t, authenticate(newKey))
+	assert.False(t, authenticate(oldKey))
+
+	srv.Close()
+	auth.refreshKeyURL()
+	assert.True(t, authenticate(newKey))
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "failed fetching keys"))
+}
+
+func TestPasetoAuth_AuthenticateKeyURLUnknownKeyID(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+	modTime := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+
+	var (
+		mu       sync.Mutex
+		doc      = oldKey.Public().ExportHex()
+		requests int
+		cached   int
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if r.Header.Get("If-Modified-Since") == modTime {
+			cached++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Last-Modified", modTime)
+		_, _ = w.Write([]byte(doc))
+	}))
+	t.Cleanup(srv.Close)
+
+	auth := &PasetoAuth{
+		KeyURL:    srv.URL + "/keys",
+		FromQuery: []string{"token"},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	auth.keys.remote.minInterval = 0
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	newKID := testKeyID(t, newKey.Public().ExportHex())
+	token.SetFooter([]byte(`{"kid":"` + newKID + `"}`))
+	tokenStr := token.V4Sign(newKey, nil)
+
+	authenticate := func() bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	// An unknown key ID makes the document be fetched early, but unchanged
+	// documents aren't downloaded again.
+	assert.False(t, authenticate())
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return cached == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// The rotated key is picked up without waiting for the refresh interval.
+	mu.Lock()
+	doc = `{"keys": ["` + newKey.Public().ExportHex() + `", "` + oldKey.Public().ExportHex() + `"]}`
+	modTime = time.Now().UTC().Format(http.TimeFormat)
+	mu.Unlock()
+	assert.Eventually(t, authenticate, 5*time.Second, 10*time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Less(t, requests, 100)
+}
+
+func TestKeyURL_Backoff(t *testing.T) {
+	var down atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(paseto.NewV4AsymmetricSecretKey().Public().ExportHex()))
+	}))
+	t.Cleanup(srv.Close)
+
+	ku := &keyURL{
+		url:         srv.URL,
+		interval:    time.Minute,
+		minInterval: 10 * time.Second,
+		timeout:     time.Second,
+		client:      srv.Client(),
+	}
+	assertDelay := func(exp time.Duration) {
+		t.Helper()
+		failures, next := ku.retry()
+		delay := next.Sub(ku.lastFetch)
+		assert.LessOrEqual(t, delay, exp, "failures: %d", failures)
+		assert.GreaterOrEqual(t, delay, exp*4/5, "failures: %d", failures)
+	}
+
+	_, _, err := ku.fetch(t.Context())
+	require.NoError(t, err)
+	assertDelay(time.Minute)
+
+	down.Store(true)
+	for _, exp := range []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, time.Minute} {
+		_, _, err = ku.fetch(t.Context())
+		require.Error(t, err)
+		assertDelay(exp)
+	}
+
+	// Tokens with unknown key IDs don't shorten the backoff.
+	assert.False(t, ku.expedite(ku.lastFetch.Add(ku.minInterval)))
+
+	down.Store(false)
+	_, _, err = ku.fetch(t.Context())
+	require.NoError(t, err)
+	assertDelay(time.Minute)
+}
+
+func TestPasetoAuth_AuthenticateKeyURLOutage(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(key, nil)
+
+	tests := []struct {
+		name            string
+		outage          string
+		expAuthOutage   bool
+		expOutageRecord slog.Level
+	}{
+		{name: "ok/keep", outage: "", expAuthOutage: true, expOutageRecord: slog.LevelWarn},
+		{name: "ok/reject", outage: "reject", expAuthOutage: false, expOutageRecord: slog.LevelError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var down atomic.Bool
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if down.Load() {
+					w.WriteHeader(http.StatusServiceUnavailable)
+					return
+				}
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", `"v1"`)
+				_, _ = w.Write([]byte(key.Public().ExportHex()))
+			}))
+			t.Cleanup(srv.Close)
+
+			logHandler := testutil.NewTestLogHandler()
+			auth := &PasetoAuth{
+				KeyURL:       srv.URL,
+				KeyURLOutage: tt.outage,
+				FromQuery:    []string{"token"},
+				logger:       slog.New(logHandler),
+			}
+			require.NoError(t, auth.Validate())
+
+			authenticate := func() bool {
+				req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+				_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+				require.NoError(t, err)
+				return authenticated
+			}
+			require.True(t, authenticate())
+
+			down.Store(true)
+			auth.refreshKeyURL()
+			assert.Equal(t, tt.expAuthOutage, authenticate())
+			assert.True(t, logHandler.HasRecord(tt.expOutageRecord, "failed fetching keys: unexpected status 503"))
+
+			// The keys are loaded again once the server recovers, even though
+			// the document hasn't changed.
+			down.Store(false)
+			auth.refreshKeyURL()
+			assert.True(t, authenticate())
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateKeyURLPins(t *testing.T) {
+	idKey := paseto.NewV4AsymmetricSecretKey()
+	valueKey := paseto.NewV4AsymmetricSecretKey()
+	rogueKey := paseto.NewV4AsymmetricSecretKey()
+	pins := []string{testKeyID(t, idKey.Public().ExportHex()), valueKey.Public().ExportHex()}
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	var doc atomic.Pointer[string]
+	setDoc := func(keys ...paseto.V4AsymmetricSecretKey) {
+		hexKeys := make([]string, 0, len(keys))
+		for _, key := range keys {
+			hexKeys = append(hexKeys, `"`+key.Public().ExportHex()+`"`)
+		}
+		data := `{"keys": [` + strings.Join(hexKeys, ", ") + `]}`
+		doc.Store(&data)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(*doc.Load()))
+	}))
+	t.Cleanup(srv.Close)
+
+	newAuth := func(logHandler slog.Handler) *PasetoAuth {
+		return &PasetoAuth{
+			KeyURL:     srv.URL,
+			KeyURLPins: pins,
+			FromQuery:  []string{"token"},
+			logger:     slog.New(logHandler),
+		}
+	}
+
+	// A document with a key that isn't pinned fails to load.
+	setDoc(idKey, rogueKey)
+	require.ErrorContains(t, newAuth(testutil.NewTestLogHandler()).Validate(),
+		"invalid key URL keys[1]: key "+testKeyID(t, rogueKey.Public().ExportHex())+" is not pinned by key_url_pins")
+
+	setDoc(idKey, valueKey)
+	logHandler := testutil.NewTestLogHandler()
+	auth := newAuth(logHandler)
+	require.NoError(t, auth.Validate())
+
+	authenticate := func(key paseto.V4AsymmetricSecretKey) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+	assert.True(t, authenticate(idKey))
+	assert.True(t, authenticate(valueKey))
+
+	// A rogue key added by the key server is rejected, and the pinned keys
+	// are kept.
+	setDoc(valueKey, rogueKey)
+	auth.refreshKeyURL()
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "is not pinned by key_url_pins"))
+	assert.False(t, authenticate(rogueKey))
+	assert.True(t, authenticate(idKey))
+}
+
+func TestPasetoAuth_ValidateKeyURLPins(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/no_key_url",
+			config: PasetoAuth{Key: key, KeyURLPins: []string{key}},
+			expErr: "key_url_pins requires key_url",
+		},
+		{
+			name: "err/other_purpose",
+			config: PasetoAuth{
+				KeyURL:     "https://id.example.com/keys",
+				KeyURLPins: []string{"k4.lid.yMgldRRLHBLkhfwTuNJ_KcR6zqgBv9yC2P-OFnKHpcM1"},
+			},
+			expErr: "invalid key_url_pins: key ID 'k4.lid.yMgldRRLHBLkhfwTuNJ_KcR6zqgBv9yC2P-OFnKHpcM1' " +
+				"doesn't match version 4 and purpose public",
+		},
+		{
+			name:   "err/invalid_key",
+			config: PasetoAuth{KeyURL: "https://id.example.com/keys", KeyURLPins: []string{"invalid"}},
+			expErr: "invalid key_url_pins key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			require.ErrorContains(t, tt.config.Validate(), tt.expErr)
+		})
+	}
+}
+
+func init() {
+	caddy.RegisterModule(tenantClaimMapper{})
+}
+
+// tenantClaimMapper is a claim mapper that derives a composite user ID from
+// the tenant claim and the subject.
+type tenantClaimMapper struct {
+	Claim string `json:"claim"`
+}
+
+func (tenantClaimMapper) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  claimMapperNamespace + ".tenant",
+		New: func() caddy.Module { return new(tenantClaimMapper) },
+	}
+}
+
+func (m *tenantClaimMapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	d.Next()
+	if !d.AllArgs(&m.Claim) {
+		return d.ArgErr()
+	}
+	return nil
+}
+
+func (m *tenantClaimMapper) MapClaims(_ *http.Request, claims map[string]any) (string, map[string]string, error) {
+	tenant, _ := claims[m.Claim].(string)
+	sub, _ := claims["sub"].(string)
+	if tenant == "legacy" {
+		return "", nil, errors.New("legacy tenants are not supported")
+	}
+	if tenant == "" || sub == "" {
+		return "", nil, nil
+	}
+	return tenant + "/" + sub, map[string]string{"tenant": tenant, "role": "member"}, nil
+}
+
+func TestPasetoAuth_AuthenticateClaimMapper(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:         v4PrivateKey.Public().ExportHex(),
+		FromQuery:   []string{"token"},
+		MetaClaims:  map[string]string{"role": "role", "email": "email"},
+		claimMapper: &tenantClaimMapper{Claim: "tid"},
+		logger:      slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	newToken := func(tenant string) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("42")
+		token.SetString("role", "admin")
+		token.SetString("email", "eva@example.com")
+		if tenant != "" {
+			token.SetString("tid", tenant)
+		}
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	tests := []struct {
+		name    string
+		tenant  string
+		expUser caddyauth.User
+		expLog  string
+	}{
+		{
+			name:   "ok",
+			tenant: "acme",
+			expUser: caddyauth.User{
+				ID:       "acme/42",
+				Metadata: map[string]string{"tenant": "acme", "role": "member", "email": "eva@example.com"},
+			},
+		},
+		{
+			name:   "err/empty_user_id",
+			expLog: "claim mapper returned an empty user ID",
+		},
+		{
+			name:   "err/mapper_error",
+			tenant: "legacy",
+			expLog: "failed mapping claims: legacy tenants are not supported",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?token="+newToken(tt.tenant), nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+
+			if tt.expLog != "" {
+				assert.False(t, authenticated)
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expLog))
+				return
+			}
+
+			assert.True(t, authenticated)
+			assert.Equal(t, tt.expUser, user)
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateKeyURLTimeout(t *testing.T) {
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		<-done
+	}))
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { close(done) })
+
+	t.Run("err/timeout", func(t *testing.T) {
+		auth := &PasetoAuth{
+			KeyURL:        srv.URL,
+			KeyURLTimeout: 10 * time.Millisecond,
+			logger:        slog.New(testutil.NewTestLogHandler()),
+		}
+		err := auth.Validate()
+		require.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.Contains(t, err.Error(), "failed fetching keys")
+	})
+
+	t.Run("err/unloaded", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		auth := &PasetoAuth{
+			KeyURL: srv.URL,
+			ctx:    ctx,
+			logger: slog.New(testutil.NewTestLogHandler()),
+		}
+		require.ErrorIs(t, auth.Validate(), context.Canceled)
+	})
+}
+
+func TestPasetoAuth_AuthenticateKeyID(t *testing.T) {
+	oldKey := paseto.NewV4AsymmetricSecretKey()
+	newKey := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:       newKey.Public().ExportHex(),
+		Keys:      []string{oldKey.Public().ExportHex()},
+		FromQuery: []string{"token"},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	require.Len(t, auth.keys.current().byID, 2)
+
+	logHandler := testutil.NewTestLogHandler()
+	strictAuth := &PasetoAuth{
+		Key:        newKey.Public().ExportHex(),
+		Keys:       []string{oldKey.Public().ExportHex()},
+		RequireKID: true,
+		FromQuery:  []string{"token"},
+		logger:     slog.New(logHandler),
+	}
+	require.NoError(t, strictAuth.Validate())
+
+	kid := func(key paseto.V4AsymmetricSecretKey) string {
+		xkey, err := xpaseto.LoadKey([]byte(key.Public().ExportHex()), paseto.Version4, paseto.Public,
+			xpaseto.KeyTypePublic)
+		require.NoError(t, err)
+		id, err := paserkID(xkey, paseto.Version4, paseto.Public)
+		require.NoError(t, err)
+		assert.Regexp(t, `^k4\.pid\.[A-Za-z0-9_-]{44}$`, id)
+		return id
+	}
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	tests := []struct {
+		name    string
+		key     paseto.V4AsymmetricSecretKey
+		footer  string
+		strict  bool
+		expAuth bool
+	}{
+		{name: "ok/new_key", key: newKey, footer: `{"kid":"` + kid(newKey) + `"}`, expAuth: true},
+		{name: "ok/required_kid", key: oldKey, footer: `{"kid":"` + kid(oldKey) + `"}`, strict: true, expAuth: true},
+		{name: "err/required_no_kid", key: newKey, footer: `{"env":"prod"}`, strict: true},
+		{name: "err/required_no_footer", key: newKey, strict: true},
+		{name: "err/required_unknown_kid", key: newKey, footer: `{"kid":"k4.pid.unknown"}`, strict: true},
+		{name: "ok/old_key", key: oldKey, footer: `{"kid":"` + kid(oldKey) + `"}`, expAuth: true},
+		{name: "ok/no_kid", key: oldKey, footer: `{"env":"prod"}`, expAuth: true},
+		{name: "ok/non_json_footer", key: oldKey, footer: "footer", expAuth: true},
+		{name: "err/kid_of_other_key", key: oldKey, footer: `{"kid":"` + kid(newKey) + `"}`},
+		{name: "err/unknown_kid", key: oldKey, footer: `{"kid":"k4.pid.unknown"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token.SetFooter([]byte(tt.footer))
+			tokenStr := token.V4Sign(tt.key, nil)
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+			provider := auth
+			if tt.strict {
+				provider = strictAuth
+			}
+			logHandler.Clear()
+			_, authenticated, err := provider.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.strict && tt.footer == "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, "token footer doesn't contain a key ID"))
+			}
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateTokenType(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	newTokenStr := func(claims map[string]any) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		for name, val := range claims {
+			require.NoError(t, token.Set(name, val))
+		}
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	newAuth := func(typ, claim string) *PasetoAuth {
+		auth := &PasetoAuth{
+			Key:            v4PrivateKey.Public().ExportHex(),
+			FromQuery:      []string{"token"},
+			TokenType:      typ,
+			TokenTypeClaim: claim,
+			logger:         slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, auth.Validate())
+		return auth
+	}
+
+	tests := []struct {
+		name    string
+		auth    *PasetoAuth
+		claims  map[string]any
+		expAuth bool
+	}{
+		{name: "ok/access", auth: newAuth("access", ""), claims: map[string]any{"typ": "access"}, expAuth: true},
+		{name: "ok/refresh", auth: newAuth("refresh", ""), claims: map[string]any{"typ": "refresh"}, expAuth: true},
+		{
+			name:    "ok/custom_claim",
+			auth:    newAuth("access", "token_use"),
+			claims:  map[string]any{"token_use": "access"},
+			expAuth: true,
+		},
+		{name: "ok/not_required", auth: newAuth("", ""), claims: map[string]any{"typ": "refresh"}, expAuth: true},
+		{name: "err/refresh_as_access", auth: newAuth("access", ""), claims: map[string]any{"typ": "refresh"}},
+		{name: "err/missing", auth: newAuth("access", "")},
+		{name: "err/non_string", auth: newAuth("access", ""), claims: map[string]any{"typ": []string{"access"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?token="+newTokenStr(tt.claims), nil)
+			_, authenticated, err := tt.auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateClaimValues(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:       v4PrivateKey.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		ClaimValues: map[string][]string{
+			"role":      {"admin", "editor", "viewer"},
+			"plan.tier": {"free", "pro"},
+			"email":     {"eva@example.com"},
+		},
+		RedactClaims: []string{"email"},
+		logger:       slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		expAuth bool
+		expWarn string
+	}{
+		{name: "ok/value", claims: map[string]any{"role": "editor"}, expAuth: true},
+		{name: "ok/list", claims: map[string]any{"role": []string{"viewer", "admin"}}, expAuth: true},
+		{name: "ok/nested", claims: map[string]any{"plan": map[string]any{"tier": "pro"}}, expAuth: true},
+		{name: "ok/missing", expAuth: true},
+		{
+			name:    "err/unexpected_value",
+			claims:  map[string]any{"role": "superadmin"},
+			expWarn: "claim 'role' has an unexpected value: 'superadmin'",
+		},
+		{
+			name:    "err/unexpected_list_value",
+			claims:  map[string]any{"role": []string{"viewer", "owner"}},
+			expWarn: "claim 'role' has an unexpected value: 'owner'",
+		},
+		{
+			name:    "err/unexpected_nested_value",
+			claims:  map[string]any{"plan": map[string]any{"tier": "enterprise"}},
+			expWarn: "claim 'plan.tier' has an unexpected value: 'enterprise'",
+		},
+		{
+			name:    "err/redacted_value",
+			claims:  map[string]any{"email": "mallory@example.com"},
+			expWarn: "claim 'email' has an unexpected value: 'sha256:",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler.Clear()
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			for name, val := range tt.claims {
+				require.NoError(t, token.Set(name, val))
+			}
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expWarn != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expWarn))
+			}
+		})
+	}
+
+	auth = &PasetoAuth{
+		Key:         v4PrivateKey.Public().ExportHex(),
+		ClaimValues: map[string][]string{"role": {}},
+		logger:      slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, auth.Validate(), "invalid claim_values 'role': no values")
+}
+
+func TestPasetoAuth_AuthenticateForbidClaims(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:          v4PrivateKey.Public().ExportHex(),
+		FromQuery:    []string{"token"},
+		ForbidClaims: []string{"admin", "legacy.scope"},
+		logger:       slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		expAuth bool
+		expWarn string
+	}{
+		{name: "ok/none", claims: map[string]any{"role": "admin"}, expAuth: true},
+		{name: "ok/other_nested", claims: map[string]any{"legacy": map[string]any{"id": "1"}}, expAuth: true},
+		{name: "err/forbidden", claims: map[string]any{"admin": true}, expWarn: "token has forbidden claim 'admin'"},
+		{name: "err/false", claims: map[string]any{"admin": false}, expWarn: "token has forbidden claim 'admin'"},
+		{
+			name:    "err/nested",
+			claims:  map[string]any{"legacy": map[string]any{"scope": "all"}},
+			expWarn: "token has forbidden claim 'legacy.scope'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler.Clear()
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			for name, val := range tt.claims {
+				require.NoError(t, token.Set(name, val))
+			}
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expWarn != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expWarn))
+			}
+		})
+	}
+
+	auth = &PasetoAuth{
+		Key:          v4PrivateKey.Public().ExportHex(),
+		ForbidClaims: []string{""},
+		logger:       slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, auth.Validate(), "invalid forbid_claims: empty claim name")
+}
+
+func TestPasetoAuth_AuthenticateRequireClaims(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:       v4PrivateKey.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		RequireClaims: map[string][]string{
+			"env":       {"prod"},
+			"plan.tier": {"gold", "silver"},
+		},
+		logger: slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		expAuth bool
+		expWarn string
+	}{
+		{
+			name:    "ok",
+			claims:  map[string]any{"env": "prod", "plan": map[string]any{"tier": "silver"}},
+			expAuth: true,
+		},
+		{
+			name:    "ok/list",
+			claims:  map[string]any{"env": []string{"staging", "prod"}, "plan": map[string]any{"tier": "gold"}},
+			expAuth: true,
+		},
+		{
+			name:    "err/missing",
+			claims:  map[string]any{"env": "prod"},
+			expWarn: "required claim 'plan.tier' is missing",
+		},
+		{
+			name:    "err/other_value",
+			claims:  map[string]any{"env": "staging", "plan": map[string]any{"tier": "gold"}},
+			expWarn: "claim 'env' doesn't have a required value: 'staging'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler.Clear()
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			for name, val := range tt.claims {
+				require.NoError(t, token.Set(name, val))
+			}
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expWarn != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expWarn))
+			}
+		})
+	}
+
+	auth = &PasetoAuth{
+		Key:           v4PrivateKey.Public().ExportHex(),
+		RequireClaims: map[string][]string{"env": {}},
+		logger:        slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, auth.Validate(), "invalid require_claims 'env': no values")
+}
+
+func TestPasetoAuth_AuthenticateUserClaimTransforms(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:        v4PrivateKey.Public().ExportHex(),
+		FromQuery:  []string{"token"},
+		UserClaims: []string{"email:lowercase", "sub:strip-prefix=auth0|", "uid"},
+		logger:     slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name      string
+		claims    map[string]any
+		expUserID string
+	}{
+		{
+			name:      "ok/lowercase",
+			claims:    map[string]any{"email": "Eva@Example.com", "sub": "auth0|123"},
+			expUserID: "eva@example.com",
+		},
+		{name: "ok/strip_prefix", claims: map[string]any{"sub": "auth0|123"}, expUserID: "123"},
+		{name: "ok/no_prefix", claims: map[string]any{"sub": "google|123"}, expUserID: "google|123"},
+		{name: "ok/no_transform", claims: map[string]any{"sub": "auth0|", "uid": "Eva"}, expUserID: "Eva"},
+		{name: "err/empty_after_transform", claims: map[string]any{"sub": "auth0|"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			for name, val := range tt.claims {
+				require.NoError(t, token.Set(name, val))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expUserID != "", authenticated)
+			assert.Equal(t, tt.expUserID, user.ID)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateProtocolMismatch(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:       v4PrivateKey.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		logger:    slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	for _, tokenStr := range []string{
+		token.V4Encrypt(paseto.NewV4SymmetricKey(), nil),
+		token.V3Sign(paseto.NewV3AsymmetricSecretKey(), nil),
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		assert.False(t, authenticated)
+	}
+
+	logs := logHandler.String()
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "token protocol doesn't match"))
+	assert.Contains(t, logs, "set `purpose local`")
+	assert.Contains(t, logs, "set `version 3`")
+}
+
+func TestPasetoAuth_AuthenticateIssuerPolicies(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	newTokenStr := func(iss string, iat, nbf time.Time) string {
+		token := paseto.NewToken()
+		token.SetIssuer(iss)
+		token.SetIssuedAt(iat)
+		token.SetNotBefore(nbf)
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	auth := &PasetoAuth{
+		Key:               v4PublicKey.ExportHex(),
+		FromQuery:         []string{"token"},
+		TimeSkewTolerance: time.Second,
+		MaxTokenAge:       10 * time.Minute,
+		IssuerPolicies: map[string]*IssuerPolicy{
+			"partner": {TimeSkewTolerance: 5 * time.Minute, MaxTokenAge: 24 * time.Hour},
+		},
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	now := time.Now()
+	tests := []struct {
+		name       string
+		tokenStr   string
+		expectAuth bool
+	}{
+		{
+			name:       "ok/first_party",
+			tokenStr:   newTokenStr("first", now.Add(-time.Minute), now.Add(-time.Minute)),
+			expectAuth: true,
+		},
+		{
+			name:       "ok/partner_skew",
+			tokenStr:   newTokenStr("partner", now.Add(2*time.Minute), now.Add(2*time.Minute)),
+			expectAuth: true,
+		},
+		{
+			name:       "ok/partner_age",
+			tokenStr:   newTokenStr("partner", now.Add(-time.Hour), now.Add(-time.Hour)),
+			expectAuth: true,
+		},
+		{
+			name:     "err/first_party_skew",
+			tokenStr: newTokenStr("first", now.Add(2*time.Minute), now.Add(2*time.Minute)),
+		},
+		{
+			name:     "err/first_party_age",
+			tokenStr: newTokenStr("first", now.Add(-time.Hour), now.Add(-time.Hour)),
+		},
+		{
+			name:     "err/partner_age",
+			tokenStr: newTokenStr("partner", now.Add(-25*time.Hour), now.Add(-25*time.Hour)),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.tokenStr, nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateAudiences(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	newTokenStr := func(aud any) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		if aud != nil {
+			require.NoError(t, token.Set("aud", aud))
+		}
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	tests := []struct {
+		name       string
+		match      string
+		aud        any
+		expectAuth bool
+	}{
+		{name: "ok/string", aud: "api", expectAuth: true},
+		{name: "ok/any", aud: []string{"other", "api"}, expectAuth: true},
+		{name: "ok/all", match: "all", aud: []string{"web", "api"}, expectAuth: true},
+		{name: "err/string", aud: "other"},
+		{name: "err/any", aud: []string{"other", "more"}},
+		{name: "err/all", match: "all", aud: []string{"web", "other"}},
+		{name: "err/empty_array", aud: []string{}},
+		{name: "err/non_string", aud: []any{"api", 1}},
+		{name: "err/missing"},
+		{name: "ok/wildcard", aud: "https://eu.app.example.com", expectAuth: true},
+		{name: "ok/wildcard_all", match: "all", aud: []string{"api", "https://us.example.com"}, expectAuth: true},
+		{name: "err/wildcard_empty", aud: "https://.example.com"},
+		{name: "err/wildcard_path", aud: "https://evil.test/.example.com"},
+		{name: "err/wildcard_userinfo", aud: "https://evil.test@x.example.com"},
+		{name: "err/wildcard_suffix", aud: "https://app.example.com.evil.test"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:            v4PublicKey.ExportHex(),
+				FromQuery:      []string{"token"},
+				AllowAudiences: []string{"api", "web", "https://*.example.com"},
+				AudienceMatch:  tt.match,
+				logger:         slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+newTokenStr(tt.aud), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateIssuerPatterns(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:       v4PrivateKey.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		AllowIssuers: []string{
+			"https://id.example.com", `~https://idp-[a-z]+\.corp\.internal`, `~^https://sso\.example\.(com|net)$`,
+		},
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name       string
+		iss        string
+		expectAuth bool
+	}{
+		{name: "ok/exact", iss: "https://id.example.com", expectAuth: true},
+		{name: "ok/pattern", iss: "https://idp-billing.corp.internal", expectAuth: true},
+		{name: "err/pattern", iss: "https://idp-42.corp.internal"},
+		{name: "ok/explicit_anchors", iss: "https://sso.example.net", expectAuth: true},
+		{name: "err/suffix", iss: "https://idp-billing.corp.internal.evil.test"},
+		{name: "err/prefix", iss: "https://evil.test/https://idp-billing.corp.internal"},
+		{name: "err/alternation", iss: "https://sso.example.com.evil.test"},
+		{name: "err/literal_pattern", iss: `~https://idp-[a-z]+\.corp\.internal`},
+		{name: "err/missing"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			if tt.iss != "" {
+				token.SetIssuer(tt.iss)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectAuth, authenticated)
+		})
+	}
+
+	auth = &PasetoAuth{
+		Key:          v4PrivateKey.Public().ExportHex(),
+		AllowIssuers: []string{"~^https://idp-[a-z+$"},
+		logger:       slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, auth.Validate(), "invalid allow_issuers: invalid pattern '^https://idp-[a-z+$'")
+}
+
+func TestPasetoAuth_AuthenticateDenyLists(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:           v4PrivateKey.Public().ExportHex(),
+		FromQuery:     []string{"token"},
+		AllowUsers:    []string{"user123", "mallory"},
+		AllowIssuers:  []string{"~^https://id(-old)?\\.example\\.com$"},
+		DenyUsers:     []string{"mallory"},
+		DenyAudiences: []string{"https://legacy.example.com"},
+		DenyIssuers:   []string{"https://id-old.example.com"},
+		logger:        slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name       string
+		sub        string
+		iss        string
+		aud        any
+		expectAuth bool
+	}{
+		{name: "ok", sub: "user123", iss: "https://id.example.com", aud: "https://api.example.com", expectAuth: true},
+		{name: "ok/no_audience", sub: "user123", iss: "https://id.example.com", expectAuth: true},
+		{name: "err/user", sub: "mallory", iss: "https://id.example.com"},
+		{name: "err/issuer", sub: "user123", iss: "https://id-old.example.com"},
+		{name: "err/audience", sub: "user123", iss: "https://id.example.com", aud: "https://legacy.example.com"},
+		{
+			name: "err/audience_array",
+			sub:  "user123",
+			iss:  "https://id.example.com",
+			aud:  []string{"https://api.example.com", "https://legacy.example.com"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject(tt.sub)
+			token.SetIssuer(tt.iss)
+			if tt.aud != nil {
+				require.NoError(t, token.Set("aud", tt.aud))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateAudienceTemplates(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:            v4PrivateKey.Public().ExportHex(),
+		FromQuery:      []string{"token"},
+		AllowAudiences: []string{"https://{http.request.host}/api", "{http.request.header.X-Audience}"},
+		logger:         slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name       string
+		host       string
+		aud        string
+		expectAuth bool
+	}{
+		{name: "ok/host", host: "a.example.com", aud: "https://a.example.com/api", expectAuth: true},
+		{name: "err/other_host", host: "b.example.com", aud: "https://a.example.com/api"},
+		{name: "err/template", host: "a.example.com", aud: "https://{http.request.host}/api"},
+		// The empty header value isn't allowed.
+		{name: "err/empty_placeholder", host: "a.example.com", aud: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			token.SetAudience(tt.aud)
+
+			req := httptest.NewRequest(http.MethodGet, "https://"+tt.host+"/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			caddyhttp.NewTestReplacer(req)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateAudienceFromHost(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:              v4PrivateKey.Public().ExportHex(),
+		FromQuery:        []string{"token"},
+		AudienceFromHost: true,
+		logger:           slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name       string
+		url        string
+		aud        string
+		expectAuth bool
+	}{
+		{name: "ok/bare", url: "https://a.example.com/", aud: "a.example.com", expectAuth: true},
+		{name: "ok/scheme", url: "https://a.example.com/", aud: "https://a.example.com", expectAuth: true},
+		{name: "ok/port", url: "http://a.example.com:8080/", aud: "http://a.example.com", expectAuth: true},
+		{name: "err/other_host", url: "https://b.example.com/", aud: "https://a.example.com"},
+		{name: "err/other_scheme", url: "https://a.example.com/", aud: "http://a.example.com"},
+		{name: "err/path", url: "https://a.example.com/", aud: "https://a.example.com/api"},
+		{name: "err/wildcard_host", url: "https://*/", aud: "https://a.example.com"},
+		{name: "err/missing", url: "https://a.example.com/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			if tt.aud != "" {
+				token.SetAudience(tt.aud)
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.url+"?token="+token.V4Sign(v4PrivateKey, nil), nil)
+			caddyhttp.NewTestReplacer(req)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expectAuth, authenticated)
+		})
+	}
+
+	// The allowed audiences are accepted as well.
+	auth = &PasetoAuth{
+		Key:              v4PrivateKey.Public().ExportHex(),
+		FromQuery:        []string{"token"},
+		AllowAudiences:   []string{"https://api.example.com"},
+		AudienceFromHost: true,
+		logger:           slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	token.SetAudience("https://api.example.com")
+	req := httptest.NewRequest(http.MethodGet, "https://a.example.com/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+	caddyhttp.NewTestReplacer(req)
+	_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+}
+
+func TestPasetoAuth_AuthenticateCacheKey(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	newTokenStr := func(sub, tier string) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject(sub)
+		token.SetString("tier", tier)
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	auth := &PasetoAuth{
+		Key:            v4PublicKey.ExportHex(),
+		FromQuery:      []string{"token"},
+		CacheKeyClaims: []string{"sub", "tier"},
+		logger:         slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	cacheKey := func(tokenStr string) string {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+		return user.Metadata["cache_key"]
+	}
+
+	key := cacheKey(newTokenStr("user123", "gold"))
+	assert.Len(t, key, 64)
+	assert.NotContains(t, key, "user123")
+	assert.Equal(t, key, cacheKey(newTokenStr("user123", "gold")))
+	assert.NotEqual(t, key, cacheKey(newTokenStr("user123", "free")))
+	assert.NotEqual(t, cacheKey(newTokenStr("a,b", "c")), cacheKey(newTokenStr("a", "b,c")))
+}
+
+func TestPasetoAuth_AuthenticateSourceNetworks(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	auth := &PasetoAuth{
+		Key:         v4PublicKey.ExportHex(),
+		FromHeader:  []string{"X-Internal-Token"},
+		FromCookies: []string{"session"},
+		SourceNetworks: map[string][]string{
+			"header:x-internal-token": {"private_ranges"},
+			"cookie:session":          {"203.0.113.0/24", "2001:db8::1"},
+		},
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     string
+		cookie     string
+		expAuth    bool
+	}{
+		{name: "ok/header_private", remoteAddr: "10.1.2.3:1234", header: tokenStr, expAuth: true},
+		{name: "ok/header_private_ipv6", remoteAddr: "[fd00::1]:1234", header: tokenStr, expAuth: true},
+		{name: "ok/cookie_allowed", remoteAddr: "203.0.113.7:1234", cookie: tokenStr, expAuth: true},
+		{name: "ok/cookie_allowed_ipv6", remoteAddr: "[2001:db8::1]:1234", cookie: tokenStr, expAuth: true},
+		{name: "err/header_public", remoteAddr: "198.51.100.1:1234", header: tokenStr},
+		{name: "err/cookie_private", remoteAddr: "10.1.2.3:1234", cookie: tokenStr},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = tt.remoteAddr
+			if tt.header != "" {
+				req.Header.Set("X-Internal-Token", tt.header)
+			}
+			if tt.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "session", Value: tt.cookie})
+			}
+
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticateDuplicateCookies(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+	staleTokenStr := token.V4Sign(paseto.NewV4AsymmetricSecretKey(), nil)
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:         v4PrivateKey.Public().ExportHex(),
+		FromCookies: []string{"session"},
+		logger:      slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	// The stale cookie of the parent domain is sent first.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Cookie", "session="+staleTokenStr+"; session="+tokenStr)
+	user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+	assert.Equal(t, "user123", user.ID)
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "request has multiple cookies with the same name"))
+
+	logHandler.Clear()
+	req = httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(&http.Cookie{Name: "session", Value: tokenStr})
+	_, authenticated, err = auth.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+	assert.False(t, logHandler.HasRecord(slog.LevelWarn, "request has multiple cookies with the same name"))
+}
+
+func TestPasetoAuth_AuthenticateStrictBearer(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	tests := []struct {
+		name    string
+		headers map[string][]string
+		expAuth bool
+	}{
+		{name: "ok", headers: map[string][]string{"Authorization": {"Bearer " + tokenStr}}, expAuth: true},
+		{name: "ok/other_header", headers: map[string][]string{"X-Token": {" " + tokenStr}}, expAuth: true},
+		{name: "err/lowercase_scheme", headers: map[string][]string{"Authorization": {"bearer " + tokenStr}}},
+		{name: "err/no_scheme", headers: map[string][]string{"Authorization": {tokenStr}}},
+		{name: "err/double_space", headers: map[string][]string{"Authorization": {"Bearer  " + tokenStr}}},
+		{name: "err/trailing_space", headers: map[string][]string{"Authorization": {"Bearer " + tokenStr + " "}}},
+		{name: "err/parameters", headers: map[string][]string{"Authorization": {"Bearer " + tokenStr + ", realm=api"}}},
+		{
+			name:    "err/multiple_headers",
+			headers: map[string][]string{"Authorization": {"Bearer " + tokenStr, "Bearer " + tokenStr}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler := testutil.NewTestLogHandler()
+			auth := &PasetoAuth{
+				Key:          v4PrivateKey.Public().ExportHex(),
+				FromHeader:   []string{"X-Token"},
+				StrictBearer: true,
+				logger:       slog.New(logHandler),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for name, values := range tt.headers {
+				req.Header[name] = values
+			}
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			assert.Equal(t, !tt.expAuth, logHandler.HasRecord(slog.LevelWarn,
+				"ignoring Authorization header that isn't strictly in the Bearer scheme"))
+		})
+	}
+}
+
+func TestPasetoAuth_Validate(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+	v4PublicKey := v4PrivateKey.Public()
+	v4SymmetricKey := paseto.NewV4SymmetricKey()
+	v3PublicKey := paseto.NewV3AsymmetricSecretKey().Public()
+	v3SymmetricKey := paseto.NewV3SymmetricKey()
+	v3WrappedKey := wrapPASERKv3(t, "k3.local-pw.", v3SymmetricKey.ExportBytes(), "hunter2")
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name: "ok/valid_public_key_v4",
+			config: PasetoAuth{
+				Key:     v4PublicKey.ExportHex(),
+				Version: paseto.Version4,
+				Purpose: paseto.Public,
+			},
+		},
+		{
+			name: "ok/valid_symmetric_key_v4_local",
+			config: PasetoAuth{
+				Key:     v4SymmetricKey.ExportHex(),
+				Version: paseto.Version4,
+				Purpose: paseto.Local,
+			},
+		},
+		{
+			name: "ok/paserk_key",
+			config: PasetoAuth{
+				Key: "k4.public." + base64.RawURLEncoding.EncodeToString(v4PublicKey.ExportBytes()),
+			},
+		},
+		{
+			name: "ok/paserk_local_key",
+			config: PasetoAuth{
+				Key:     "k4.local." + base64.RawURLEncoding.EncodeToString(v4SymmetricKey.ExportBytes()),
+				Purpose: paseto.Local,
+			},
+		},
+		{
+			name: "ok/password_wrapped_key",
+			config: PasetoAuth{
+				Key:         v3WrappedKey,
+				KeyPassword: "hunter2",
+				Version:     paseto.Version3,
+				Purpose:     paseto.Local,
+			},
+		},
+		{
+			name: "ok/keys_only",
+			config: PasetoAuth{
+				Keys: []string{v4PublicKey.ExportHex()},
+			},
+		},
+		{
+			name: "ok/defaults_applied",
+			config: PasetoAuth{
+				Key: v4PublicKey.ExportHex(),
+			},
+		},
+		{
+			name: "err/invalid_version",
+			config: PasetoAuth{
+				Key:     v4PublicKey.ExportHex(),
+				Version: "v5",
+				Purpose: paseto.Public,
+			},
+			expErr: "invalid version: 'v5'",
+		},
+		{
+			name: "err/invalid_purpose",
+			config: PasetoAuth{
+				Key:     v4PublicKey.ExportHex(),
+				Version: paseto.Version4,
+				Purpose: "invalid",
+			},
+			expErr: "invalid purpose: 'invalid'",
+		},
+		{
+			name: "err/invalid_key",
+			config: PasetoAuth{
+				Key:     "invalid-key",
+				Version: paseto.Version4,
+				Purpose: paseto.Public,
+			},
+			expErr: "invalid byte",
+		},
+		{
+			name: "err/invalid_source_networks_source",
+			config: PasetoAuth{
+				Key:            v4PublicKey.ExportHex(),
+				SourceNetworks: map[string][]string{"uri:token": {"private_ranges"}},
+			},
+			expErr: "invalid source_networks: invalid source 'uri:token'",
+		},
+		{
+			name: "err/invalid_source_networks_range",
+			config: PasetoAuth{
+				Key:            v4PublicKey.ExportHex(),
+				SourceNetworks: map[string][]string{"query:token": {"10.0.0.0/33"}},
+			},
+			expErr: "invalid source_networks: parsing CIDR expression",
+		},
+		{
+			name: "err/invalid_deny_fingerprints",
+			config: PasetoAuth{
+				Key:              v4PublicKey.ExportHex(),
+				DenyFingerprints: []string{"not-a-fingerprint"},
+			},
+			expErr: "invalid deny_fingerprints: invalid fingerprint 'not-a-fingerprint'",
+		},
+		{
+			name: "err/invalid_audience_match",
+			config: PasetoAuth{
+				Key:           v4PublicKey.ExportHex(),
+				AudienceMatch: "some",
+			},
+			expErr: "invalid audience match: 'some'",
+		},
+		{
+			name: "err/negative_max_token_age",
+			config: PasetoAuth{
+				Key:         v4PublicKey.ExportHex(),
+				MaxTokenAge: -time.Minute,
+			},
+			expErr: "invalid max token age: '-1m0s'",
+		},
+		{
+			name: "err/invalid_issuer_policy",
+			config: PasetoAuth{
+				Key: v4PublicKey.ExportHex(),
+				IssuerPolicies: map[string]*IssuerPolicy{
+					"partner": {TimeSkewTolerance: -time.Minute},
+				},
+			},
+			expErr: "invalid issuer policy for 'partner': negative time skew tolerance: '-1m0s'",
+		},
+		{
+			name: "err/cache_key_placeholder_conflict",
+			config: PasetoAuth{
+				Key:            v4PublicKey.ExportHex(),
+				MetaClaims:     map[string]string{"ck": "cache_key"},
+				CacheKeyClaims: []string{"sub"},
+			},
+			expErr: "invalid meta_claims: placeholder of claim 'ck' conflicts with the cache key",
+		},
+		{
+			name: "err/empty_key",
+			config: PasetoAuth{
+				Version: paseto.Version4,
+				Purpose: paseto.Public,
+			},
+			expErr: "key is empty",
+		},
+		{
+			name: "err/invalid_keys",
+			config: PasetoAuth{
+				Key:  v4PublicKey.ExportHex(),
+				Keys: []string{v4SymmetricKey.ExportHex(), "invalid"},
+			},
+			expErr: "invalid keys[1]: failed decoding key data",
+		},
+		{
+			name: "err/invalid_user_claims",
+			config: PasetoAuth{
+				Key:        v4PublicKey.ExportHex(),
+				UserClaims: []string{"sub", "email:titlecase"},
+			},
+			expErr: `invalid user_claims: invalid transform "titlecase" in key "email:titlecase"`,
+		},
+		{
+			name: "err/invalid_preflight_origin",
+			config: PasetoAuth{
+				Key:       v4PublicKey.ExportHex(),
+				Preflight: &Preflight{Origins: []string{"https://*.*.example.com"}},
+			},
+			expErr: "invalid preflight: invalid origin: 'https://*.*.example.com'",
+		},
+		{
+			name: "err/invalid_cors_origins",
+			config: PasetoAuth{
+				Key:         v4PublicKey.ExportHex(),
+				CORSOrigins: []string{"https://app.example.com", " "},
+			},
+			expErr: "invalid cors_origins: invalid origin: ' '",
+		},
+		{
+			name: "err/missing_key_file",
+			config: PasetoAuth{
+				KeyFile: "/nonexistent/paseto.key",
+			},
+			expErr: "failed reading key file",
+		},
+		{
+			name: "err/invalid_key_file_check",
+			config: PasetoAuth{
+				KeyFile:      "/etc/caddy/paseto.key",
+				KeyFileCheck: "inotify",
+			},
+			expErr: "invalid key file check: 'inotify'",
+		},
+		{
+			name: "err/insecure_key_url",
+			config: PasetoAuth{
+				KeyURL: "http://id.example.com/keys",
+			},
+			expErr: "invalid key URL 'http://id.example.com/keys': must be an HTTPS URL",
+		},
+		{
+			name: "err/private_key",
+			config: PasetoAuth{
+				Key:     v4PrivateKey.ExportHex(),
+				Version: paseto.Version4,
+				Purpose: paseto.Public,
+			},
+			expErr: "use its public key instead: " + v4PublicKey.ExportHex(),
+		},
+		{
+			name: "err/symmetric_key_purpose_public",
+			config: PasetoAuth{
+				Key:     v3SymmetricKey.ExportHex(),
+				Version: paseto.Version3,
+				Purpose: paseto.Public,
+			},
+			expErr: "set `purpose local`",
+		},
+		{
+			name: "err/private_key_purpose_local",
+			config: PasetoAuth{
+				Key:     v4PrivateKey.ExportHex(),
+				Version: paseto.Version4,
+				Purpose: paseto.Local,
+			},
+			expErr: "set `purpose public`",
+		},
+		{
+			name: "err/version_mismatch",
+			config: PasetoAuth{
+				Key:     v3PublicKey.ExportHex(),
+				Version: paseto.Version4,
+				Purpose: paseto.Public,
+			},
+			expErr: "set `version 3`",
+		},
+		{
+			name: "err/paserk_version_mismatch",
+			config: PasetoAuth{
+				Key:     "k3.public.cHFyc3R1dnd4eXp7fH1-f4CBgoOEhYaHiImKi4yNjo8",
+				Version: paseto.Version4,
+				Purpose: paseto.Public,
+			},
+			expErr: "PASERK key is a version 3 key, but version 4 is configured; set `version 3`",
+		},
+		{
+			name: "err/paserk_unsupported_type",
+			config: PasetoAuth{
+				Key: "k4.seal.cHFyc3R1dnd4eXp7fH1-f4CBgoOEhYaHiImKi4yNjo8",
+			},
+			expErr: "unsupported PASERK key type 'seal'",
+		},
+		{
+			name: "err/paserk_secret_key",
+			config: PasetoAuth{
+				Key: "k4.secret." + base64.RawURLEncoding.EncodeToString(v4PrivateKey.ExportBytes()),
+			},
+			expErr: "PASERK key is a secret key, but a public key is required to verify tokens; " +
+				"never configure the secret key of the issuer, use its public key instead: k4.public." +
+				base64.RawURLEncoding.EncodeToString(v4PublicKey.ExportBytes()),
+		},
+		{
+			name: "err/password_wrapped_key_wrong_password",
+			config: PasetoAuth{
+				Key:         v3WrappedKey,
+				KeyPassword: "hunter3",
+				Version:     paseto.Version3,
+				Purpose:     paseto.Local,
+			},
+			expErr: "failed unwrapping PASERK key: the key password is wrong, or the key is corrupted",
+		},
+		{
+			name: "err/password_wrapped_key_empty_password",
+			config: PasetoAuth{
+				Key:     v3WrappedKey,
+				Version: paseto.Version3,
+				Purpose: paseto.Local,
+			},
+			expErr: "PASERK key is password-wrapped, but the key password is empty; set `key_password`",
+		},
+		{
+			name: "err/password_wrapped_key_unsupported_version",
+			config: PasetoAuth{
+				Key:         "k4.local-pw.cHFyc3R1dnd4eXp7fH1-f4CBgoOEhYaHiImKi4yNjo8",
+				KeyPassword: "hunter2",
+				Purpose:     paseto.Local,
+			},
+			expErr: "unsupported password-wrapped PASERK key version 'k4'",
+		},
+		{
+			name: "err/paserk_local_key_purpose_public",
+			config: PasetoAuth{
+				Key: "k4.local." + base64.RawURLEncoding.EncodeToString(v4SymmetricKey.ExportBytes()),
+			},
+			expErr: "PASERK key is a local key, but purpose public requires a public or secret key; " +
+				"set `purpose local`",
+		},
+		{
+			name: "err/paserk_public_key_purpose_local",
+			config: PasetoAuth{
+				Key:     "k4.public." + base64.RawURLEncoding.EncodeToString(v4PublicKey.ExportBytes()),
+				Purpose: paseto.Local,
+			},
+			expErr: "PASERK key is a public key, but purpose local requires a local key; set `purpose public`",
+		},
+		{
+			name: "err/token_type_claim_without_token_type",
+			config: PasetoAuth{
+				Key:            v4PublicKey.ExportHex(),
+				TokenTypeClaim: "kind",
+			},
+			expErr: "token_type_claim requires token_type",
+		},
+		{
+			name: "err/key_file_check_without_key_file",
+			config: PasetoAuth{
+				Key:          v4PublicKey.ExportHex(),
+				KeyFileCheck: keyFileCheckContent,
+			},
+			expErr: "key_file_check requires key_file",
+		},
+		{
+			name: "err/fail_open_without_sessions",
+			config: PasetoAuth{
+				Key:            v4PublicKey.ExportHex(),
+				CircuitBreaker: &CircuitBreaker{FailOpen: true},
+			},
+			expErr: "circuit_breaker fail_open requires track_sessions",
+		},
+		{
+			name: "err/user_claims_with_claim_mapper",
+			config: PasetoAuth{
+				Key:         v4PublicKey.ExportHex(),
+				UserClaims:  []string{"email"},
+				claimMapper: &tenantClaimMapper{},
+			},
+			expErr: "user_claims can't be used with claim_mapper",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.Validate()
+
+			if tt.expErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expErr)
+				return
+			}
+
+			require.NoError(t, err)
+
+			if tt.name == "ok/defaults_applied" {
+				assert.Equal(t, paseto.Version4, tt.config.Version)
+				assert.Equal(t, paseto.Public, tt.config.Purpose)
+			}
+
+			assert.Equal(t, 30*time.Second, tt.config.TimeSkewTolerance)
+			assert.Equal(t, []string{"sub"}, tt.config.UserClaims)
+			assert.NotEmpty(t, tt.config.keys.current().keys)
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateMultipleErrors(t *testing.T) {
+	auth := PasetoAuth{
+		Key:           paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		Purpose:       "secret",
+		AudienceMatch: "some",
+		IdleTimeout:   -time.Minute,
+		KeyURLTimeout: time.Second,
+		KeyURLOutage:  "reject",
+	}
+
+	err := auth.Validate()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "key_url_timeout requires key_url")
+	assert.Contains(t, err.Error(), "key_url_outage requires key_url")
+	assert.Contains(t, err.Error(), "invalid purpose: 'secret'")
+	assert.Contains(t, err.Error(), "invalid audience match: 'some'")
+	assert.Contains(t, err.Error(), "invalid idle timeout: '-1m0s'")
+}
+
+func TestPasetoAuth_ResolveKeyPlaceholders(t *testing.T) {
+	v4PublicKey := paseto.NewV4AsymmetricSecretKey().Public()
+	t.Setenv("PASETO_TEST_KEY", v4PublicKey.ExportHex())
+	t.Setenv("PASETO_TEST_EMPTY", "")
+
+	keyFile := filepath.Join(t.TempDir(), "paseto.key")
+	require.NoError(t, os.WriteFile(keyFile, []byte(v4PublicKey.ExportHex()+"\n"), 0o600))
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "ok/env",
+			config: PasetoAuth{Key: "{env.PASETO_TEST_KEY}"},
+		},
+		{
+			name:   "ok/file",
+			config: PasetoAuth{Keys: []string{"{file." + keyFile + "}"}},
+		},
+		{
+			name:   "err/unset_env",
+			config: PasetoAuth{Key: "{env.PASETO_TEST_EMPTY}"},
+			expErr: "invalid key: evaluated placeholder {env.PASETO_TEST_EMPTY} is empty",
+		},
+		{
+			name:   "err/unknown_placeholder",
+			config: PasetoAuth{Keys: []string{v4PublicKey.ExportHex(), "{http.request.header.Key}"}},
+			expErr: "invalid keys[1]: unrecognized placeholder {http.request.header.Key}",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.resolveKeyPlaceholders(caddy.NewReplacer())
+
+			if tt.expErr != "" {
+				require.Error(t, err)
+				assert.Equal(t, tt.expErr, err.Error())
+				return
+			}
+
+			require.NoError(t, err)
+			require.NoError(t, tt.config.Validate())
+			assert.Equal(t, v4PublicKey.ExportBytes(), tt.config.keys.current().keys[0].ExportBytes())
+		})
+	}
+}
+
+// wrapPASERKv3 wraps the key with the password, as specified by the PASERK
+// PBKW operation for version 3 keys.
+func wrapPASERKv3(t *testing.T, header string, key []byte, password string) string {
+	t.Helper()
+
+	const iterations = 1000
+	salt := make([]byte, pbkwV3SaltSize)
+	nonce := make([]byte, pbkwV3NonceSize)
+	_, err := rand.Read(salt)
+	require.NoError(t, err)
+	_, err = rand.Read(nonce)
+	require.NoError(t, err)
+
+	preKey, err := pbkdf2.Key(sha512.New384, password, salt, iterations, pbkwV3KeySize)
+	require.NoError(t, err)
+	encKey := sha512.Sum384(append([]byte{0xFF}, preKey...))
+	authKey := sha512.Sum384(append([]byte{0xFE}, preKey...))
+
+	block, err := aes.NewCipher(encKey[:pbkwV3KeySize])
+	require.NoError(t, err)
+	edk := make([]byte, len(key))
+	cipher.NewCTR(block, nonce).XORKeyStream(edk, key)
+
+	data := append(salt, binary.BigEndian.AppendUint32(nil, iterations)...)
+	data = append(data, nonce...)
+	data = append(data, edk...)
+	mac := hmac.New(sha512.New384, authKey[:])
+	mac.Write([]byte(header))
+	mac.Write(data)
+	data = mac.Sum(data)
+
+	return header + base64.RawURLEncoding.EncodeToString(data)
+}
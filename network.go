@@ -0,0 +1,149 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Token source types.
+const (
+	sourceQuery     = "query"
+	sourceHeader    = "header"
+	sourceCookie    = "cookie"
+	sourceForm      = "form"
+	sourceBody      = "body"
+	sourcePath      = "path"
+	sourceWebSocket = "websocket"
+	sourceBasicAuth = "basic"
+	sourceForwarded = "forwarded"
+)
+
+// tokenSourceTypes returns the token source types, in the default order of
+// priority.
+func tokenSourceTypes() []string {
+	return []string{sourceQuery, sourceHeader, sourceCookie, sourceForm, sourceBody, sourcePath, sourceWebSocket,
+		sourceBasicAuth, sourceForwarded}
+}
+
+// sourceKey returns the key that identifies a token source in SourceNetworks.
+func sourceKey(typ, name string) string {
+	if typ == sourceHeader {
+		name = http.CanonicalHeaderKey(name)
+	}
+	return typ + ":" + name
+}
+
+// parseSourceNetworks parses the source network configuration, and returns a
+// map of normalized token source keys to network prefixes.
+func parseSourceNetworks(sourceNetworks map[string][]string) (map[string][]netip.Prefix, error) {
+	if len(sourceNetworks) == 0 {
+		return nil, nil
+	}
+
+	parsed := make(map[string][]netip.Prefix, len(sourceNetworks))
+	for source, ranges := range sourceNetworks {
+		typ, name, ok := strings.Cut(source, ":")
+		if !ok || name == "" || !slices.Contains(tokenSourceTypes(), typ) {
+			return nil, fmt.Errorf("invalid source_networks: invalid source '%s'", source)
+		}
+		if len(ranges) == 0 {
+			return nil, fmt.Errorf("invalid source_networks: no networks for source '%s'", source)
+		}
+
+		prefixes, err := parseNetworks(ranges)
+		if err != nil {
+			return nil, fmt.Errorf("invalid source_networks: %w", err)
+		}
+
+		key := sourceKey(typ, name)
+		parsed[key] = append(parsed[key], prefixes...)
+	}
+
+	return parsed, nil
+}
+
+// parseNetworks parses the IP ranges in CIDR notation, or "private_ranges" for
+// all private IP ranges.
+func parseNetworks(ranges []string) ([]netip.Prefix, error) {
+	expanded := make([]string, 0, len(ranges))
+	for _, rng := range ranges {
+		if rng == "private_ranges" {
+			expanded = append(expanded, caddyhttp.PrivateRangesCIDR()...)
+		} else {
+			expanded = append(expanded, rng)
+		}
+	}
+
+	prefixes := make([]netip.Prefix, 0, len(expanded))
+	for _, rng := range expanded {
+		prefix, err := caddyhttp.CIDRExpressionToPrefix(rng)
+		if err != nil {
+			return nil, err //nolint:wrapcheck // the callers wrap the error
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// clientIP returns the IP address of the client, as determined by Caddy,
+// taking trusted proxies into account.
+func clientIP(r *http.Request) (netip.Addr, error) {
+	address, ok := caddyhttp.GetVar(r.Context(), caddyhttp.ClientIPVarKey).(string)
+	if !ok || address == "" {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		address = host
+	}
+
+	// Ignore any IPv6 zone.
+	address, _, _ = strings.Cut(address, "%")
+	ip, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Addr{}, fmt.Errorf("invalid client IP address: %w", err)
+	}
+
+	return ip.Unmap(), nil
+}
+
+// allowedSources returns the source names of the given type that the client of
+// the request is allowed to use.
+func (p *PasetoAuth) allowedSources(r *http.Request, typ string, names []string) []string {
+	if len(p.sourceNetworks) == 0 {
+		return names
+	}
+
+	var (
+		ip    netip.Addr
+		ipErr error
+		once  bool
+	)
+	allowed := make([]string, 0, len(names))
+	for _, name := range names {
+		prefixes, ok := p.sourceNetworks[sourceKey(typ, name)]
+		if !ok {
+			allowed = append(allowed, name)
+			continue
+		}
+
+		if !once {
+			ip, ipErr = clientIP(r)
+			once = true
+		}
+		if ipErr == nil && slices.ContainsFunc(prefixes, func(prefix netip.Prefix) bool {
+			return prefix.Contains(ip)
+		}) {
+			allowed = append(allowed, name)
+		}
+	}
+
+	return allowed
+}
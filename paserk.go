@@ -0,0 +1,153 @@
+package caddypaseto
+
+import (
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+	"golang.org/x/crypto/blake2b"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// paserkIDSize is the size in bytes of the digest in a PASERK key ID.
+const paserkIDSize = 33
+
+// paserkID returns the PASERK ID of the key, i.e. "k4.lid.<id>" for symmetric
+// keys, and "k4.pid.<id>" for public keys. See
+// https://github.com/paseto-standard/paserk/blob/master/operations/ID.md.
+func paserkID(key *xpaseto.Key, ver paseto.Version, purpose paseto.Purpose) (string, error) {
+	prefix := "k" + string(ver)[1:]
+	idType := "pid"
+	if purpose == paseto.Local {
+		idType = "lid"
+	}
+
+	header := prefix + "." + idType + "."
+	paserk := encodePASERK(key, ver, purpose)
+
+	var digest []byte
+	switch ver {
+	case paseto.Version3:
+		sum := sha512.Sum384([]byte(header + paserk))
+		digest = sum[:paserkIDSize]
+	default:
+		hash, err := blake2b.New(paserkIDSize, nil)
+		if err != nil {
+			return "", fmt.Errorf("failed creating BLAKE2b hash: %w", err)
+		}
+		hash.Write([]byte(header + paserk))
+		digest = hash.Sum(nil)
+	}
+
+	return header + base64.RawURLEncoding.EncodeToString(digest), nil
+}
+
+// encodePASERK returns the PASERK serialization of the verification key, i.e.
+// "k4.local.<key>" for symmetric keys, and "k4.public.<key>" for public keys.
+func encodePASERK(key *xpaseto.Key, ver paseto.Version, purpose paseto.Purpose) string {
+	typ := "public"
+	if purpose == paseto.Local {
+		typ = "local"
+	}
+	return "k" + string(ver)[1:] + "." + typ + "." + base64.RawURLEncoding.EncodeToString(key.ExportBytes())
+}
+
+// isPASERK reports whether the key data looks like a PASERK serialized key.
+func isPASERK(data string) bool {
+	return strings.HasPrefix(data, "k2.") || strings.HasPrefix(data, "k3.") || strings.HasPrefix(data, "k4.")
+}
+
+// paserkKeyTypes maps the supported PASERK types to key types.
+//
+//nolint:gochecknoglobals // Deliberate cache.
+var paserkKeyTypes = map[string]xpaseto.KeyType{
+	"local":  xpaseto.KeyTypeSymmetric,
+	"public": xpaseto.KeyTypePublic,
+	"secret": xpaseto.KeyTypePrivate,
+}
+
+// decodePASERK decodes a PASERK serialized key, e.g. "k4.public.<key>", and
+// returns its hex encoded key data. Only the "local", "public" and "secret"
+// types are supported, and the type must match the required key type.
+func decodePASERK(data string, ver paseto.Version, kt xpaseto.KeyType) (string, error) {
+	parts := strings.Split(data, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid PASERK key: expected 3 parts, got %d", len(parts))
+	}
+	if keyVer := parts[0][1:]; "v"+keyVer != string(ver) {
+		return "", fmt.Errorf("PASERK key is a version %s key, but version %s is configured; set `version %s`",
+			keyVer, string(ver)[1:], keyVer)
+	}
+	typ, ok := paserkKeyTypes[parts[1]]
+	if !ok {
+		return "", fmt.Errorf("unsupported PASERK key type '%s', expected local, public or secret", parts[1])
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid PASERK key: %w", err)
+	}
+	keyHex := hex.EncodeToString(raw)
+
+	if typ != kt {
+		return "", fmt.Errorf("PASERK key is a %s key, but %s", parts[1], paserkTypeHint(keyHex, ver, typ, kt))
+	}
+
+	return keyHex, nil
+}
+
+// paserkTypeHint describes the key type required instead of the found type,
+// and how to fix the configuration.
+func paserkTypeHint(keyHex string, ver paseto.Version, found, kt xpaseto.KeyType) string {
+	switch {
+	case kt == xpaseto.KeyTypeSymmetric:
+		return "purpose local requires a local key; " +
+			"set `purpose public` if the tokens are signed, or use the shared local key"
+	case found == xpaseto.KeyTypeSymmetric:
+		return "purpose public requires a public or secret key; set `purpose local` if the tokens are encrypted"
+	case kt == xpaseto.KeyTypePublic:
+		hint := "a public key is required to verify tokens; never configure the secret key of the issuer"
+		if pub := publicKeyHex(keyHex, ver); pub != "" {
+			pubBytes, _ := hex.DecodeString(pub)
+			hint += fmt.Sprintf(", use its public key instead: k%s.public.%s",
+				string(ver)[1:], base64.RawURLEncoding.EncodeToString(pubBytes))
+		}
+		return hint
+	default:
+		return "a secret key is required to sign tokens"
+	}
+}
+
+// errMissingKeyID is returned for tokens without a key ID in their footer, if
+// RequireKID is set.
+var errMissingKeyID = errors.New("token footer doesn't contain a key ID")
+
+// tokenKeyID returns the value of the "kid" field of the token footer, or an
+// empty string if the footer is empty, or is not a JSON object with a string
+// "kid" field. The footer is not authenticated at this point, so the key ID is
+// only used to select the verification key.
+func tokenKeyID(tokenStr string) string {
+	proto, err := xpaseto.TokenProtocol(tokenStr)
+	if err != nil {
+		return ""
+	}
+	footer, err := paseto.NewParser().UnsafeParseFooter(proto, tokenStr)
+	if err != nil || len(footer) == 0 || footer[0] != '{' {
+		return ""
+	}
+
+	var data struct {
+		KeyID string `json:"kid"`
+	}
+	if err = json.Unmarshal(footer, &data); err != nil {
+		return ""
+	}
+
+	return data.KeyID
+}
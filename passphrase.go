@@ -0,0 +1,73 @@
+package caddypaseto
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"aidanwoods.dev/go-paseto"
+	"golang.org/x/crypto/argon2"
+)
+
+// Default Argon2id parameters of KeyPassphrase, the second recommended option
+// of RFC 9106.
+const (
+	defaultPassphraseTime    = 3
+	defaultPassphraseMemory  = 64 * 1024
+	defaultPassphraseThreads = 4
+)
+
+// minPassphraseSaltSize is the minimum salt size in bytes allowed by Argon2.
+const minPassphraseSaltSize = 8
+
+// KeyPassphrase derives the v4 local symmetric key from a passphrase with
+// Argon2id, for tokens encrypted by issuers that derive their key the same way.
+// The key is derived once, when the module is provisioned, and is used as Key.
+// All parameters must match the ones of the issuer.
+type KeyPassphrase struct {
+	// Passphrase is the passphrase the key is derived from. It should be set
+	// with a placeholder, e.g. `{env.PASETO_PASSPHRASE}`, which is resolved
+	// when the module is provisioned.
+	Passphrase string `json:"passphrase"`
+
+	// Salt is the Argon2id salt, at least 8 bytes long. It can contain
+	// placeholders.
+	Salt string `json:"salt"`
+
+	// Time is the Argon2id amount of passes over the memory. The default is 3.
+	Time uint32 `json:"time,omitempty"`
+
+	// Memory is the Argon2id amount of memory in KiB. The default is 65536,
+	// i.e. 64MiB.
+	Memory uint32 `json:"memory,omitempty"`
+
+	// Threads is the Argon2id degree of parallelism. The default is 4.
+	Threads uint8 `json:"threads,omitempty"`
+}
+
+// provision checks the parameters, and returns the hex encoded key derived from
+// the passphrase.
+func (kp *KeyPassphrase) provision(ver paseto.Version, purpose paseto.Purpose) (string, error) {
+	switch {
+	case ver != paseto.Version4 || purpose != paseto.Local:
+		return "", fmt.Errorf("invalid key_passphrase: only v4 local keys can be derived, not %s %s", ver, purpose)
+	case kp.Passphrase == "":
+		return "", errors.New("invalid key_passphrase: passphrase is empty")
+	case len(kp.Salt) < minPassphraseSaltSize:
+		return "", fmt.Errorf("invalid key_passphrase: salt must be at least %d bytes long", minPassphraseSaltSize)
+	}
+
+	if kp.Time == 0 {
+		kp.Time = defaultPassphraseTime
+	}
+	if kp.Memory == 0 {
+		kp.Memory = defaultPassphraseMemory
+	}
+	if kp.Threads == 0 {
+		kp.Threads = defaultPassphraseThreads
+	}
+
+	key := argon2.IDKey([]byte(kp.Passphrase), []byte(kp.Salt), kp.Time, kp.Memory, kp.Threads, 32)
+
+	return hex.EncodeToString(key), nil
+}
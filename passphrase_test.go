@@ -0,0 +1,127 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/argon2"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateKeyPassphrase(t *testing.T) {
+	derived := argon2.IDKey([]byte("correct horse"), []byte("caddy-paseto"), 1, 1024, 1, 32)
+	key, err := paseto.V4SymmetricKeyFromBytes(derived)
+	require.NoError(t, err)
+
+	auth := &PasetoAuth{
+		KeyPassphrase: &KeyPassphrase{Passphrase: "correct horse", Salt: "caddy-paseto", Time: 1, Memory: 1024, Threads: 1},
+		Purpose:       paseto.Local,
+		FromQuery:     []string{"token"},
+		logger:        slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Encrypt(key, nil), nil)
+	user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+	assert.Equal(t, "user123", user.ID)
+
+	// A different salt derives a different key.
+	other := &PasetoAuth{
+		KeyPassphrase: &KeyPassphrase{Passphrase: "correct horse", Salt: "caddy-paseto2", Time: 1, Memory: 1024, Threads: 1},
+		Purpose:       paseto.Local,
+		FromQuery:     []string{"token"},
+		logger:        slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, other.Validate())
+	_, authenticated, err = other.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.False(t, authenticated)
+}
+
+func TestPasetoAuth_ValidateKeyPassphrase(t *testing.T) {
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name: "ok/defaults",
+			config: PasetoAuth{
+				KeyPassphrase: &KeyPassphrase{Passphrase: "correct horse", Salt: "caddy-paseto"},
+				Purpose:       paseto.Local,
+			},
+		},
+		{
+			name: "err/public",
+			config: PasetoAuth{
+				KeyPassphrase: &KeyPassphrase{Passphrase: "correct horse", Salt: "caddy-paseto"},
+			},
+			expErr: "invalid key_passphrase: only v4 local keys can be derived, not v4 public",
+		},
+		{
+			name: "err/version",
+			config: PasetoAuth{
+				KeyPassphrase: &KeyPassphrase{Passphrase: "correct horse", Salt: "caddy-paseto"},
+				Version:       paseto.Version3,
+				Purpose:       paseto.Local,
+			},
+			expErr: "invalid key_passphrase: only v4 local keys can be derived, not v3 local",
+		},
+		{
+			name: "err/empty_passphrase",
+			config: PasetoAuth{
+				KeyPassphrase: &KeyPassphrase{Salt: "caddy-paseto"},
+				Purpose:       paseto.Local,
+			},
+			expErr: "invalid key_passphrase: passphrase is empty",
+		},
+		{
+			name: "err/short_salt",
+			config: PasetoAuth{
+				KeyPassphrase: &KeyPassphrase{Passphrase: "correct horse", Salt: "caddy"},
+				Purpose:       paseto.Local,
+			},
+			expErr: "invalid key_passphrase: salt must be at least 8 bytes long",
+		},
+		{
+			name: "err/key",
+			config: PasetoAuth{
+				Key:           paseto.NewV4SymmetricKey().ExportHex(),
+				KeyPassphrase: &KeyPassphrase{Passphrase: "correct horse", Salt: "caddy-paseto"},
+				Purpose:       paseto.Local,
+			},
+			expErr: "key_passphrase can't be used with key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				assert.Equal(t, &KeyPassphrase{
+					Passphrase: "correct horse", Salt: "caddy-paseto",
+					Time: defaultPassphraseTime, Memory: defaultPassphraseMemory, Threads: defaultPassphraseThreads,
+				}, tt.config.KeyPassphrase)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
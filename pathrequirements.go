@@ -0,0 +1,98 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// PathRequirement requires tokens of requests whose path matches Path to have
+// scopes or claim values. All the requirements whose path matches apply.
+type PathRequirement struct {
+	// Path is a pattern of the Caddy path matcher, e.g. "/admin/*", "*.php"
+	// or "/api/*/export". It's matched case-insensitively, against the
+	// cleaned path, the same way as the path matcher of a route.
+	Path string `json:"path"`
+
+	// Scopes are the scopes that tokens must have in their "scope" claim, as
+	// with PasetoAuth.RequireScopes. All of them are required.
+	Scopes []string `json:"scopes,omitempty"`
+
+	// Claims maps claims to the values they must have, as with
+	// PasetoAuth.RequireClaims.
+	Claims map[string][]string `json:"claims,omitempty"`
+
+	matcher caddyhttp.MatchPath
+	rules   []paseto.Rule
+}
+
+// provisionPathRequirements validates the PathRequirements, and prepares their
+// path matchers and validation rules.
+func (p *PasetoAuth) provisionPathRequirements() error {
+	var errs []error
+	for _, pr := range p.PathRequirements {
+		if pr.Path == "" {
+			errs = append(errs, errors.New("invalid path_requirements: empty path"))
+			continue
+		}
+		if len(pr.Scopes) == 0 && len(pr.Claims) == 0 {
+			errs = append(errs, fmt.Errorf("invalid path_requirements '%s': no scopes or claims", pr.Path))
+			continue
+		}
+		for _, scope := range pr.Scopes {
+			if !validScope(scope) {
+				errs = append(errs, fmt.Errorf("invalid path_requirements '%s': invalid scope '%s'", pr.Path, scope))
+			}
+		}
+		for _, claim := range slices.Sorted(maps.Keys(pr.Claims)) {
+			if len(pr.Claims[claim]) == 0 {
+				errs = append(errs, fmt.Errorf("invalid path_requirements '%s': claim '%s' has no values",
+					pr.Path, claim))
+			}
+		}
+
+		pr.matcher = caddyhttp.MatchPath{pr.Path}
+		if err := pr.matcher.Provision(caddy.Context{}); err != nil {
+			errs = append(errs, fmt.Errorf("invalid path_requirements '%s': %w", pr.Path, err))
+		}
+		pr.rules = pr.rules[:0]
+		if len(pr.Scopes) > 0 {
+			pr.rules = append(pr.rules, pr.wrapRule(requireScopes(pr.Scopes)))
+		}
+		if len(pr.Claims) > 0 {
+			pr.rules = append(pr.rules, pr.wrapRule(p.requireClaimValues(pr.Claims)))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// requestRules returns the validation rules of the request, i.e. the rules of
+// extraRules, and the rules of the PathRequirements whose path matches.
+func (p *PasetoAuth) requestRules(r *http.Request) []paseto.Rule {
+	rules := p.extraRules(getReplacer(r))
+	for _, pr := range p.PathRequirements {
+		if pr.matcher.Match(r) {
+			rules = append(rules, pr.rules...)
+		}
+	}
+
+	return rules
+}
+
+// wrapRule adds the path of the requirement to the errors of the rule, so that
+// the logs show why a token that is valid elsewhere was rejected.
+func (pr *PathRequirement) wrapRule(rule paseto.Rule) paseto.Rule {
+	return func(token paseto.Token) error {
+		if err := rule(token); err != nil {
+			return fmt.Errorf("path requirement '%s': %w", pr.Path, err)
+		}
+		return nil
+	}
+}
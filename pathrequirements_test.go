@@ -0,0 +1,116 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticatePathRequirements(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:       key.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		PathRequirements: []*PathRequirement{
+			{Path: "/admin/*", Scopes: []string{"admin"}},
+			{Path: "/billing/*", Claims: map[string][]string{"plan.tier": {"pro", "enterprise"}}},
+			{Path: "/billing/refunds/*", Scopes: []string{"refunds"}},
+		},
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name    string
+		path    string
+		claims  map[string]any
+		expAuth bool
+	}{
+		{name: "ok/no_requirements", path: "/public", expAuth: true},
+		{name: "ok/scope", path: "/admin/users", claims: map[string]any{"scope": "read admin"}, expAuth: true},
+		{
+			name:    "ok/claim",
+			path:    "/billing/invoices",
+			claims:  map[string]any{"plan": map[string]any{"tier": "pro"}},
+			expAuth: true,
+		},
+		{
+			name:    "ok/all_matching",
+			path:    "/billing/refunds/42",
+			claims:  map[string]any{"plan": map[string]any{"tier": "pro"}, "scope": "refunds"},
+			expAuth: true,
+		},
+		{name: "err/scope", path: "/admin/users", claims: map[string]any{"scope": "read"}},
+		{name: "err/case_insensitive", path: "/ADMIN/users", claims: map[string]any{"scope": "read"}},
+		{name: "err/unclean", path: "//admin/./users", claims: map[string]any{"scope": "read"}},
+		{name: "err/claim", path: "/billing/invoices", claims: map[string]any{"plan": map[string]any{"tier": "free"}}},
+		{name: "err/all_matching", path: "/billing/refunds/42", claims: map[string]any{"scope": "refunds"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			for claim, val := range tt.claims {
+				require.NoError(t, token.Set(claim, val))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, tt.path+"?token="+token.V4Sign(key, nil), nil)
+			caddyhttp.NewTestReplacer(req)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_ValidatePathRequirements(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name   string
+		pr     *PathRequirement
+		expErr string
+	}{
+		{name: "err/empty_path", pr: &PathRequirement{Scopes: []string{"admin"}}, expErr: "empty path"},
+		{
+			name:   "err/no_requirements",
+			pr:     &PathRequirement{Path: "/admin/*"},
+			expErr: "invalid path_requirements '/admin/*': no scopes or claims",
+		},
+		{
+			name:   "err/invalid_scope",
+			pr:     &PathRequirement{Path: "/admin/*", Scopes: []string{""}},
+			expErr: "invalid path_requirements '/admin/*': invalid scope ''",
+		},
+		{
+			name:   "err/no_values",
+			pr:     &PathRequirement{Path: "/admin/*", Claims: map[string][]string{"role": nil}},
+			expErr: "invalid path_requirements '/admin/*': claim 'role' has no values",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:              key,
+				PathRequirements: []*PathRequirement{tt.pr},
+				logger:           slog.New(testutil.NewTestLogHandler()),
+			}
+			require.ErrorContains(t, auth.Validate(), tt.expErr)
+		})
+	}
+}
@@ -0,0 +1,129 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// pathTokenSegment is the segment of a FromPath pattern that contains the
+// token.
+const pathTokenSegment = "{token}"
+
+// pathPattern is a parsed FromPath pattern.
+type pathPattern struct {
+	raw string
+	// segments of the pattern, split on '/', including the empty segment
+	// before the leading '/'.
+	segments []string
+	// token is the index of the token segment.
+	token int
+}
+
+// parsePathPattern parses a FromPath pattern, e.g. "/download/{token}". The
+// pattern must start with '/', and contain exactly one "{token}" segment. A "*"
+// segment matches any segment.
+func parsePathPattern(pattern string) (pathPattern, error) {
+	if !strings.HasPrefix(pattern, "/") {
+		return pathPattern{}, fmt.Errorf("invalid from_path '%s': pattern must start with '/'", pattern)
+	}
+
+	pp := pathPattern{raw: pattern, segments: strings.Split(pattern, "/"), token: -1}
+	for i, seg := range pp.segments[1:] {
+		switch {
+		case seg == "":
+			return pathPattern{}, fmt.Errorf("invalid from_path '%s': pattern has an empty segment", pattern)
+		case seg == pathTokenSegment && pp.token != -1:
+			return pathPattern{}, fmt.Errorf("invalid from_path '%s': pattern has multiple %s segments",
+				pattern, pathTokenSegment)
+		case seg == pathTokenSegment:
+			pp.token = i + 1
+		case strings.ContainsAny(seg, "{}"):
+			return pathPattern{}, fmt.Errorf("invalid from_path '%s': invalid segment '%s'", pattern, seg)
+		}
+	}
+	if pp.token == -1 {
+		return pathPattern{}, fmt.Errorf("invalid from_path '%s': pattern has no %s segment",
+			pattern, pathTokenSegment)
+	}
+
+	return pp, nil
+}
+
+// match returns the path segments, if the leading segments of the path match
+// the pattern. Any segments may follow the matching ones.
+func (pp pathPattern) match(path string) ([]string, bool) {
+	segments := strings.Split(path, "/")
+	if len(segments) < len(pp.segments) {
+		return nil, false
+	}
+	for i, seg := range pp.segments {
+		switch seg {
+		case pathTokenSegment, "*":
+			if segments[i] == "" {
+				return nil, false
+			}
+		default:
+			if segments[i] != seg {
+				return nil, false
+			}
+		}
+	}
+
+	return segments, true
+}
+
+// parsePathPatterns parses the FromPath patterns.
+func (p *PasetoAuth) parsePathPatterns() error {
+	p.pathPatterns = make([]pathPattern, 0, len(p.FromPath))
+	var errs []error
+	for _, pattern := range p.FromPath {
+		pp, err := parsePathPattern(pattern)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		p.pathPatterns = append(p.pathPatterns, pp)
+	}
+
+	return errors.Join(errs...)
+}
+
+// pathTokens returns the token segments of the request path, of the FromPath
+// patterns in names.
+func (p *PasetoAuth) pathTokens(r *http.Request, names []string) []string {
+	tokens := make([]string, 0)
+	for _, pp := range p.pathPatterns {
+		if !slices.Contains(names, pp.raw) {
+			continue
+		}
+		if segments, ok := pp.match(r.URL.Path); ok {
+			tokens = append(tokens, segments[pp.token])
+		}
+	}
+	return tokens
+}
+
+// stripPathToken removes the segment that contains the token from the request
+// path, if StripPathToken is enabled, and the token was taken from the path,
+// so that the token isn't passed to the next handlers, e.g. the upstream. The
+// first matching pattern is stripped.
+func (p *PasetoAuth) stripPathToken(r *http.Request, tokenStr string) {
+	if !p.StripPathToken {
+		return
+	}
+	for _, pp := range p.pathPatterns {
+		segments, ok := pp.match(r.URL.Path)
+		if !ok || normToken(segments[pp.token]) != tokenStr {
+			continue
+		}
+		r.URL.Path = strings.Join(slices.Delete(segments, pp.token, pp.token+1), "/")
+		if r.URL.Path == "" {
+			r.URL.Path = "/"
+		}
+		r.URL.RawPath = ""
+		return
+	}
+}
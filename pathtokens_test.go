@@ -0,0 +1,124 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateFromPath(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(key, nil)
+
+	tests := []struct {
+		name    string
+		strip   bool
+		path    string
+		expAuth bool
+		expPath string
+	}{
+		{
+			name:    "ok/strip",
+			strip:   true,
+			path:    "/download/" + tokenStr + "/file.zip",
+			expAuth: true,
+			expPath: "/download/file.zip",
+		},
+		{
+			name:    "ok/no_strip",
+			path:    "/download/" + tokenStr + "/file.zip",
+			expAuth: true,
+			expPath: "/download/" + tokenStr + "/file.zip",
+		},
+		{
+			name:    "ok/wildcard",
+			strip:   true,
+			path:    "/share/42/" + tokenStr,
+			expAuth: true,
+			expPath: "/share/42",
+		},
+		{
+			name:    "err/other_path",
+			strip:   true,
+			path:    "/files/" + tokenStr,
+			expPath: "/files/" + tokenStr,
+		},
+		{
+			name:    "err/invalid_token",
+			strip:   true,
+			path:    "/download/v4.public.invalid/file.zip",
+			expPath: "/download/v4.public.invalid/file.zip",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:            key.Public().ExportHex(),
+				FromPath:       []string{"/download/{token}", "/share/*/{token}"},
+				StripPathToken: tt.strip,
+				logger:         slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+			assert.Equal(t, tt.expPath, req.URL.Path)
+		})
+	}
+}
+
+func TestParsePathPattern(t *testing.T) {
+	tests := []struct {
+		name     string
+		pattern  string
+		expToken int
+		expErr   string
+	}{
+		{name: "ok", pattern: "/download/{token}", expToken: 2},
+		{name: "ok/root", pattern: "/{token}", expToken: 1},
+		{name: "ok/wildcard", pattern: "/share/*/{token}/files", expToken: 3},
+		{name: "err/relative", pattern: "download/{token}", expErr: "pattern must start with '/'"},
+		{name: "err/no_token", pattern: "/download", expErr: "pattern has no {token} segment"},
+		{name: "err/multiple_tokens", pattern: "/{token}/{token}", expErr: "pattern has multiple {token} segments"},
+		{name: "err/empty_segment", pattern: "/download//{token}", expErr: "pattern has an empty segment"},
+		{name: "err/invalid_segment", pattern: "/download/t-{token}", expErr: "invalid segment 't-{token}'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pp, err := parsePathPattern(tt.pattern)
+			if tt.expErr != "" {
+				require.ErrorContains(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.expToken, pp.token)
+		})
+	}
+
+	auth := &PasetoAuth{
+		Key:            paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		StripPathToken: true,
+		logger:         slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, auth.Validate(), "strip_path_token requires from_path")
+}
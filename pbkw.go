@@ -0,0 +1,103 @@
+package caddypaseto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// Sizes of the password-wrapped v3 key components.
+const (
+	pbkwV3SaltSize  = 32
+	pbkwV3NonceSize = 16
+	pbkwV3TagSize   = sha512.Size384
+	pbkwV3KeySize   = 32
+)
+
+// isPasswordWrapped reports whether the PASERK key is password-wrapped, e.g.
+// "k3.local-pw.<data>".
+func isPasswordWrapped(data string) bool {
+	parts := strings.SplitN(data, ".", 3)
+	return len(parts) == 3 && strings.HasSuffix(parts[1], "-pw")
+}
+
+// unwrapPASERK decrypts a password-wrapped PASERK key, and returns the
+// unwrapped PASERK key, e.g. "k3.local.<key>" for "k3.local-pw.<data>". Only
+// version 3 keys are supported, since version 2 and 4 keys are wrapped with
+// Argon2id. See
+// https://github.com/paseto-standard/paserk/blob/master/operations/PBKW.md.
+func unwrapPASERK(data, password string) (string, error) {
+	parts := strings.Split(data, ".")
+	if len(parts) != 3 {
+		return "", fmt.Errorf("invalid PASERK key: expected 3 parts, got %d", len(parts))
+	}
+	typ := strings.TrimSuffix(parts[1], "-pw")
+	if typ != "local" && typ != "secret" {
+		return "", fmt.Errorf("unsupported PASERK key type '%s', expected local-pw or secret-pw", parts[1])
+	}
+	if parts[0] != "k3" {
+		return "", fmt.Errorf("unsupported password-wrapped PASERK key version '%s': "+
+			"only k3 keys are supported; unwrap the key, and set it with a placeholder instead", parts[0])
+	}
+	if password == "" {
+		return "", fmt.Errorf("PASERK key is password-wrapped, but the key password is empty; set `key_password`")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("invalid PASERK key: %w", err)
+	}
+	key, err := unwrapV3(parts[0]+"."+parts[1]+".", raw, password)
+	if err != nil {
+		return "", err
+	}
+
+	return parts[0] + "." + typ + "." + base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// unwrapV3 decrypts the wrapped key data, i.e. salt || iterations || nonce ||
+// encrypted key || tag, with a key derived from the password with
+// PBKDF2-SHA384.
+func unwrapV3(header string, data []byte, password string) ([]byte, error) {
+	if len(data) <= pbkwV3SaltSize+4+pbkwV3NonceSize+pbkwV3TagSize {
+		return nil, fmt.Errorf("invalid PASERK key: wrapped key is too short")
+	}
+	salt := data[:pbkwV3SaltSize]
+	iterations := binary.BigEndian.Uint32(data[pbkwV3SaltSize:])
+	nonce := data[pbkwV3SaltSize+4 : pbkwV3SaltSize+4+pbkwV3NonceSize]
+	edk := data[pbkwV3SaltSize+4+pbkwV3NonceSize : len(data)-pbkwV3TagSize]
+	tag := data[len(data)-pbkwV3TagSize:]
+	if iterations == 0 {
+		return nil, fmt.Errorf("invalid PASERK key: iteration count is 0")
+	}
+
+	//nolint:gosec // the iteration count fits in an int on all supported platforms
+	preKey, err := pbkdf2.Key(sha512.New384, password, salt, int(iterations), pbkwV3KeySize)
+	if err != nil {
+		return nil, fmt.Errorf("failed deriving the key: %w", err)
+	}
+	encKey := sha512.Sum384(append([]byte{0xFF}, preKey...))
+	authKey := sha512.Sum384(append([]byte{0xFE}, preKey...))
+
+	mac := hmac.New(sha512.New384, authKey[:])
+	mac.Write([]byte(header))
+	mac.Write(data[:len(data)-pbkwV3TagSize])
+	if !hmac.Equal(mac.Sum(nil), tag) {
+		return nil, fmt.Errorf("failed unwrapping PASERK key: the key password is wrong, or the key is corrupted")
+	}
+
+	block, err := aes.NewCipher(encKey[:pbkwV3KeySize])
+	if err != nil {
+		return nil, fmt.Errorf("failed unwrapping PASERK key: %w", err)
+	}
+	key := make([]byte, len(edk))
+	cipher.NewCTR(block, nonce).XORKeyStream(key, edk)
+
+	return key, nil
+}
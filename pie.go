@@ -0,0 +1,326 @@
+package caddypaseto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	caddycmd "github.com/caddyserver/caddy/v2/cmd"
+	"github.com/spf13/cobra"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// Sizes of the PIE-wrapped key components.
+const (
+	pieNonceSize   = 32
+	pieV4TagSize   = 32
+	pieV3TagSize   = sha512.Size384
+	pieEncKeySize  = 32
+	pieAuthKeySize = 32
+)
+
+// KeyMaster is the master key that unwraps the keys in Key and Keys that are
+// wrapped with it, e.g. "k4.local-wrap.pie.<data>", so that the config can be
+// shared or backed up without leaking the keys. The keys are unwrapped once,
+// when the module is provisioned. The master key is a local key of the
+// configured version, and is read from either an environment variable, or a
+// file. Keys are wrapped with the `caddy paseto wrap-key` command. See
+// https://github.com/paseto-standard/paserk/blob/master/operations/Wrap/pie.md.
+type KeyMaster struct {
+	// Env is the name of the environment variable that contains the master
+	// key.
+	Env string `json:"env,omitempty"`
+
+	// File is the path of the file that contains the master key.
+	File string `json:"file,omitempty"`
+}
+
+// load returns the raw master key of the version.
+func (km *KeyMaster) load(ver paseto.Version) ([]byte, error) {
+	var data string
+	switch {
+	case km.Env != "" && km.File != "":
+		return nil, errors.New("invalid key_master: env and file can't be used together")
+	case km.Env != "":
+		var ok bool
+		if data, ok = os.LookupEnv(km.Env); !ok || data == "" {
+			return nil, fmt.Errorf("invalid key_master: environment variable '%s' is not set", km.Env)
+		}
+	case km.File != "":
+		raw, err := os.ReadFile(km.File)
+		if err != nil {
+			return nil, fmt.Errorf("failed reading key_master file: %w", err)
+		}
+		data = string(raw)
+	default:
+		return nil, errors.New("invalid key_master: env or file is required")
+	}
+
+	key, err := loadKey(strings.TrimSpace(data), "", ver, paseto.Local, xpaseto.KeyTypeSymmetric)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key_master: %w", err)
+	}
+	raw, err := hex.DecodeString(key.ExportHex())
+	if err != nil {
+		return nil, fmt.Errorf("invalid key_master: %w", err)
+	}
+
+	return raw, nil
+}
+
+// unwrapKeys replaces the wrapped keys in Key and Keys with the keys unwrapped
+// with the master key.
+func (p *PasetoAuth) unwrapKeys() error {
+	wk, err := p.KeyMaster.load(p.Version)
+	if err != nil {
+		return err
+	}
+	if isKeyWrapped(p.Key) {
+		if p.Key, err = unwrapPIE(p.Key, wk); err != nil {
+			return fmt.Errorf("invalid key: %w", err)
+		}
+	}
+	for i, data := range p.Keys {
+		if !isKeyWrapped(data) {
+			continue
+		}
+		if p.Keys[i], err = unwrapPIE(data, wk); err != nil {
+			return fmt.Errorf("invalid keys[%d]: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// wrapKey wraps the local key of the version with the master key, and returns
+// the PIE-wrapped PASERK key, e.g. "k4.local-wrap.pie.<data>".
+func wrapKey(data string, ver paseto.Version, km *KeyMaster) (string, error) {
+	wk, err := km.load(ver)
+	if err != nil {
+		return "", err
+	}
+	key, err := loadKey(data, "", ver, paseto.Local, xpaseto.KeyTypeSymmetric)
+	if err != nil {
+		return "", fmt.Errorf("invalid key: %w", err)
+	}
+	raw, err := hex.DecodeString(key.ExportHex())
+	if err != nil {
+		return "", fmt.Errorf("invalid key: %w", err)
+	}
+
+	return wrapPIE(ver, "local", raw, wk, rand.Reader)
+}
+
+func newWrapKeyCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "wrap-key [--version <version>] --master-key-env <name> | --master-key-file <path>",
+		Short: "Wraps a local key with a master key",
+		Long: `
+Reads a local key from stdin, and writes it wrapped with the master key to
+stdout, as a PASERK PIE-wrapped key, e.g. "k4.local-wrap.pie.<data>". The
+wrapped key can be set as 'key' in the config, along with 'key_master', so that
+the config doesn't contain the key in plaintext.
+
+The master key is a local key of the same version, read from an environment
+variable, or a file.
+`,
+		RunE: caddycmd.WrapCommandFuncForCobra(cmdWrapKey),
+	}
+	cmd.Flags().String("version", "4", "The protocol version of the key")
+	cmd.Flags().String("master-key-env", "", "The environment variable that contains the master key")
+	cmd.Flags().String("master-key-file", "", "The file that contains the master key")
+
+	return cmd
+}
+
+func cmdWrapKey(fl caddycmd.Flags) (int, error) {
+	ver := fl.String("version")
+	if !strings.HasPrefix(ver, "v") {
+		ver = "v" + ver
+	}
+	data, err := io.ReadAll(io.LimitReader(os.Stdin, maxKeyDocumentSize))
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, fmt.Errorf("failed reading key: %w", err)
+	}
+
+	km := &KeyMaster{Env: fl.String("master-key-env"), File: fl.String("master-key-file")}
+	wrapped, err := wrapKey(string(data), paseto.Version(ver), km)
+	if err != nil {
+		return caddy.ExitCodeFailedStartup, err
+	}
+	fmt.Println(wrapped)
+
+	return caddy.ExitCodeSuccess, nil
+}
+
+// isKeyWrapped reports whether the PASERK key is wrapped with PIE, e.g.
+// "k4.local-wrap.pie.<data>".
+func isKeyWrapped(data string) bool {
+	parts := strings.Split(strings.TrimSpace(data), ".")
+	return len(parts) == 4 && isPASERK(data) && strings.HasSuffix(parts[1], "-wrap") && parts[2] == "pie"
+}
+
+// unwrapPIE decrypts a PIE-wrapped PASERK key with the wrapping key, and
+// returns the unwrapped PASERK key, e.g. "k4.local.<key>" for
+// "k4.local-wrap.pie.<data>".
+func unwrapPIE(data string, wk []byte) (string, error) {
+	parts := strings.Split(strings.TrimSpace(data), ".")
+	if len(parts) != 4 {
+		return "", fmt.Errorf("invalid PASERK key: expected 4 parts, got %d", len(parts))
+	}
+	typ := strings.TrimSuffix(parts[1], "-wrap")
+	if typ != "local" && typ != "secret" {
+		return "", fmt.Errorf("unsupported PASERK key type '%s', expected local-wrap or secret-wrap", parts[1])
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[3])
+	if err != nil {
+		return "", fmt.Errorf("invalid PASERK key: %w", err)
+	}
+
+	header := parts[0] + "." + parts[1] + ".pie."
+	tagSize := pieTagSize(parts[0])
+	if tagSize == 0 {
+		return "", fmt.Errorf("unsupported wrapped PASERK key version '%s'", parts[0])
+	}
+	if len(raw) <= tagSize+pieNonceSize {
+		return "", errors.New("invalid PASERK key: wrapped key is too short")
+	}
+	tag, nonce, edk := raw[:tagSize], raw[tagSize:tagSize+pieNonceSize], raw[tagSize+pieNonceSize:]
+
+	stream, mac, err := pieCipher(parts[0], wk, nonce)
+	if err != nil {
+		return "", fmt.Errorf("failed unwrapping PASERK key: %w", err)
+	}
+	if !hmac.Equal(pieTag(mac, header, nonce, edk), tag) {
+		return "", errors.New("failed unwrapping PASERK key: the master key is wrong, or the key is corrupted")
+	}
+	key := make([]byte, len(edk))
+	stream.XORKeyStream(key, edk)
+
+	return parts[0] + "." + typ + "." + base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// wrapPIE encrypts the raw key of the PASERK type, i.e. "local" or "secret",
+// with the wrapping key, and returns the PIE-wrapped PASERK key.
+func wrapPIE(ver paseto.Version, typ string, key, wk []byte, random io.Reader) (string, error) {
+	version := "k" + strings.TrimPrefix(string(ver), "v")
+	if pieTagSize(version) == 0 {
+		return "", fmt.Errorf("unsupported version for wrapping keys: '%s'", ver)
+	}
+	header := version + "." + typ + "-wrap.pie."
+	nonce := make([]byte, pieNonceSize)
+	if _, err := io.ReadFull(random, nonce); err != nil {
+		return "", fmt.Errorf("failed generating nonce: %w", err)
+	}
+
+	stream, mac, err := pieCipher(version, wk, nonce)
+	if err != nil {
+		return "", fmt.Errorf("failed wrapping key: %w", err)
+	}
+	edk := make([]byte, len(key))
+	stream.XORKeyStream(edk, key)
+	data := append(append(pieTag(mac, header, nonce, edk), nonce...), edk...)
+
+	return header + base64.RawURLEncoding.EncodeToString(data), nil
+}
+
+// pieTagSize returns the size of the authentication tag of the PASERK version,
+// or 0 if the version isn't supported.
+func pieTagSize(version string) int {
+	switch version {
+	case "k2", "k4":
+		return pieV4TagSize
+	case "k3":
+		return pieV3TagSize
+	default:
+		return 0
+	}
+}
+
+// pieCipher returns the key stream that encrypts and decrypts the key, and the
+// MAC of the authentication tag, derived from the wrapping key and the nonce:
+// XChaCha20 and BLAKE2b for v2 and v4, and AES-256-CTR and HMAC-SHA384 for v3.
+func pieCipher(version string, wk, nonce []byte) (cipher.Stream, hash.Hash, error) {
+	if version == "k3" {
+		encKey, encNonce := pieV3Keys(wk, nonce)
+		block, err := aes.NewCipher(encKey)
+		if err != nil {
+			return nil, nil, err //nolint:wrapcheck // wrapped by the caller
+		}
+		return cipher.NewCTR(block, encNonce), hmac.New(sha512.New384, pieV3AuthKey(wk, nonce)), nil
+	}
+
+	encKey, encNonce := pieV4Keys(wk, nonce)
+	stream, err := chacha20.NewUnauthenticatedCipher(encKey, encNonce)
+	if err != nil {
+		return nil, nil, err //nolint:wrapcheck // wrapped by the caller
+	}
+	return stream, pieV4Hash(pieV4AuthKey(wk, nonce), pieV4TagSize), nil
+}
+
+// pieTag returns the authentication tag of the header, nonce and encrypted key.
+func pieTag(mac hash.Hash, header string, nonce, edk []byte) []byte {
+	mac.Write([]byte(header))
+	mac.Write(nonce)
+	mac.Write(edk)
+	return mac.Sum(nil)
+}
+
+// pieV4Hash returns a keyed BLAKE2b hash of the size.
+func pieV4Hash(key []byte, size int) hash.Hash {
+	h, err := blake2b.New(size, key)
+	if err != nil {
+		// The size and key length are valid by construction.
+		panic(err)
+	}
+	return h
+}
+
+// pieV4Keys derives the XChaCha20 key and nonce of the v2 and v4 wrapping.
+func pieV4Keys(wk, nonce []byte) ([]byte, []byte) {
+	h := pieV4Hash(wk, pieEncKeySize+chacha20.NonceSizeX)
+	h.Write([]byte{0x80})
+	h.Write(nonce)
+	x := h.Sum(nil)
+	return x[:pieEncKeySize], x[pieEncKeySize:]
+}
+
+// pieV4AuthKey derives the BLAKE2b key of the v2 and v4 wrapping tag.
+func pieV4AuthKey(wk, nonce []byte) []byte {
+	h := pieV4Hash(wk, pieAuthKeySize)
+	h.Write([]byte{0x81})
+	h.Write(nonce)
+	return h.Sum(nil)
+}
+
+// pieV3Keys derives the AES-256-CTR key and nonce of the v3 wrapping.
+func pieV3Keys(wk, nonce []byte) ([]byte, []byte) {
+	mac := hmac.New(sha512.New384, wk)
+	mac.Write([]byte{0x80})
+	mac.Write(nonce)
+	x := mac.Sum(nil)
+	return x[:pieEncKeySize], x[pieEncKeySize:]
+}
+
+// pieV3AuthKey derives the HMAC-SHA384 key of the v3 wrapping tag.
+func pieV3AuthKey(wk, nonce []byte) []byte {
+	mac := hmac.New(sha512.New384, wk)
+	mac.Write([]byte{0x81})
+	mac.Write(nonce)
+	return mac.Sum(nil)[:pieAuthKeySize]
+}
@@ -0,0 +1,165 @@
+package caddypaseto
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestWrapPIE(t *testing.T) {
+	for _, ver := range []paseto.Version{paseto.Version2, paseto.Version3, paseto.Version4} {
+		t.Run(string(ver), func(t *testing.T) {
+			key, _ := hex.DecodeString(paseto.NewV4SymmetricKey().ExportHex())
+			wk, _ := hex.DecodeString(paseto.NewV4SymmetricKey().ExportHex())
+			otherWK, _ := hex.DecodeString(paseto.NewV4SymmetricKey().ExportHex())
+
+			wrapped, err := wrapPIE(ver, "local", key, wk, rand.Reader)
+			require.NoError(t, err)
+			prefix := "k" + string(ver)[1:] + ".local-wrap.pie."
+			assert.True(t, strings.HasPrefix(wrapped, prefix))
+			assert.True(t, isKeyWrapped(wrapped))
+
+			unwrapped, err := unwrapPIE(wrapped, wk)
+			require.NoError(t, err)
+			keyHex, err := decodePASERK(unwrapped, ver, verificationKeyType(paseto.Local))
+			require.NoError(t, err)
+			assert.Equal(t, hex.EncodeToString(key), keyHex)
+
+			_, err = unwrapPIE(wrapped, otherWK)
+			require.ErrorContains(t, err, "the master key is wrong, or the key is corrupted")
+
+			// The header is authenticated, so the key type can't be changed.
+			tampered := strings.Replace(wrapped, ".local-wrap.", ".secret-wrap.", 1)
+			_, err = unwrapPIE(tampered, wk)
+			require.ErrorContains(t, err, "the master key is wrong, or the key is corrupted")
+		})
+	}
+
+	assert.False(t, isKeyWrapped("k4.local.abc"))
+	assert.False(t, isKeyWrapped("k3.local-pw.abc"))
+	_, err := unwrapPIE("k4.local-wrap.pie.YWJj", make([]byte, 32))
+	require.ErrorContains(t, err, "wrapped key is too short")
+	_, err = unwrapPIE("k4.public-wrap.pie.YWJj", make([]byte, 32))
+	require.ErrorContains(t, err, "unsupported PASERK key type 'public-wrap'")
+}
+
+func TestPasetoAuth_AuthenticateKeyMaster(t *testing.T) {
+	masterKey := paseto.NewV4SymmetricKey()
+	masterKeyRaw, err := hex.DecodeString(masterKey.ExportHex())
+	require.NoError(t, err)
+	t.Setenv("PASETO_TEST_MASTER_KEY", "k4.local."+base64.RawURLEncoding.EncodeToString(masterKeyRaw))
+	masterFile := filepath.Join(t.TempDir(), "master.key")
+	require.NoError(t, os.WriteFile(masterFile, []byte(masterKey.ExportHex()+"\n"), 0o600))
+
+	key := paseto.NewV4SymmetricKey()
+	wrapped, err := wrapKey(key.ExportHex(), paseto.Version4, &KeyMaster{Env: "PASETO_TEST_MASTER_KEY"})
+	require.NoError(t, err)
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Encrypt(key, nil)
+
+	for _, km := range []*KeyMaster{{Env: "PASETO_TEST_MASTER_KEY"}, {File: masterFile}} {
+		auth := &PasetoAuth{
+			Purpose:   paseto.Local,
+			Keys:      []string{paseto.NewV4SymmetricKey().ExportHex(), wrapped},
+			KeyMaster: km,
+			FromQuery: []string{"token"},
+			logger:    slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, auth.Validate())
+		assert.False(t, isKeyWrapped(auth.Keys[1]))
+
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		assert.True(t, authenticated)
+		assert.Equal(t, "user123", user.ID)
+	}
+}
+
+func TestPasetoAuth_ValidateKeyMaster(t *testing.T) {
+	masterKey := paseto.NewV4SymmetricKey()
+	t.Setenv("PASETO_TEST_MASTER_KEY", masterKey.ExportHex())
+	t.Setenv("PASETO_TEST_OTHER_MASTER_KEY", paseto.NewV4SymmetricKey().ExportHex())
+	wrapped, err := wrapKey(paseto.NewV4SymmetricKey().ExportHex(), paseto.Version4,
+		&KeyMaster{Env: "PASETO_TEST_MASTER_KEY"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/no_key_master",
+			config: PasetoAuth{Key: wrapped, Purpose: paseto.Local},
+			expErr: "PASERK key is wrapped with a master key, which is not set; set `key_master`",
+		},
+		{
+			name: "err/wrong_master_key",
+			config: PasetoAuth{
+				Key: wrapped, Purpose: paseto.Local,
+				KeyMaster: &KeyMaster{Env: "PASETO_TEST_OTHER_MASTER_KEY"},
+			},
+			expErr: "invalid key: failed unwrapping PASERK key: the master key is wrong, or the key is corrupted",
+		},
+		{
+			name: "err/unset_env",
+			config: PasetoAuth{
+				Key: wrapped, Purpose: paseto.Local,
+				KeyMaster: &KeyMaster{Env: "PASETO_TEST_UNSET_MASTER_KEY"},
+			},
+			expErr: "invalid key_master: environment variable 'PASETO_TEST_UNSET_MASTER_KEY' is not set",
+		},
+		{
+			name: "err/missing_file",
+			config: PasetoAuth{
+				Key: wrapped, Purpose: paseto.Local,
+				KeyMaster: &KeyMaster{File: filepath.Join(t.TempDir(), "missing")},
+			},
+			expErr: "failed reading key_master file",
+		},
+		{
+			name: "err/env_and_file",
+			config: PasetoAuth{
+				Key: wrapped, Purpose: paseto.Local,
+				KeyMaster: &KeyMaster{Env: "PASETO_TEST_MASTER_KEY", File: "master.key"},
+			},
+			expErr: "invalid key_master: env and file can't be used together",
+		},
+		{
+			name: "err/version_mismatch",
+			config: PasetoAuth{
+				Key: wrapped, Purpose: paseto.Local, Version: paseto.Version3,
+				KeyMaster: &KeyMaster{Env: "PASETO_TEST_MASTER_KEY"},
+			},
+			expErr: "PASERK key is a version 4 key, but version 3 is configured",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
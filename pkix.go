@@ -0,0 +1,90 @@
+package caddypaseto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+
+	"aidanwoods.dev/go-paseto"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+const (
+	pemTypePublicKey   = "PUBLIC KEY"
+	pemTypeCertificate = "CERTIFICATE"
+)
+
+// pkixBlock returns the first PEM block of the key data if it's a PKIX public
+// key or an x509 certificate, or nil otherwise.
+func pkixBlock(data string) *pem.Block {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || (block.Type != pemTypePublicKey && block.Type != pemTypeCertificate) {
+		return nil
+	}
+	return block
+}
+
+// decodePKIX returns the hex encoded public key of a PKIX public key or x509
+// certificate PEM block. Ed25519 keys are supported for versions 2 and 4, and
+// ECDSA P-384 keys for version 3. Certificates are not verified, since only
+// their public key is used.
+func decodePKIX(block *pem.Block, ver paseto.Version, kt xpaseto.KeyType) (string, error) {
+	desc := "PKIX key"
+	var pub any
+	if block.Type == pemTypeCertificate {
+		desc = "certificate key"
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("invalid certificate: %w", err)
+		}
+		pub = cert.PublicKey
+	} else {
+		var err error
+		if pub, err = x509.ParsePKIXPublicKey(block.Bytes); err != nil {
+			return "", fmt.Errorf("invalid PKIX key: %w", err)
+		}
+	}
+
+	return publicKeyHexOf(desc, pub, ver, kt)
+}
+
+// publicKeyHexOf returns the hex encoded PASETO public key of a standard
+// library public key. desc describes the key in errors, e.g. "PKIX key".
+func publicKeyHexOf(desc string, pub any, ver paseto.Version, kt xpaseto.KeyType) (string, error) {
+	var keyHex string
+	switch key := pub.(type) {
+	case ed25519.PublicKey:
+		if ver == paseto.Version3 {
+			return "", fmt.Errorf("%s is an Ed25519 key, but version 3 requires a P-384 key; set `version 4`", desc)
+		}
+		keyHex = hex.EncodeToString(key)
+	case *ecdsa.PublicKey:
+		if key.Curve != elliptic.P384() {
+			return "", fmt.Errorf("%s is an ECDSA %s key, but only P-384 keys are supported",
+				desc, key.Curve.Params().Name)
+		}
+		if ver != paseto.Version3 {
+			return "", fmt.Errorf("%s is a P-384 key, but version %s requires an Ed25519 key; set `version 3`",
+				desc, string(ver)[1:])
+		}
+		v3Key, err := paseto.NewV3AsymmetricPublicKeyFromEcdsa(*key)
+		if err != nil {
+			return "", fmt.Errorf("invalid %s: %w", desc, err)
+		}
+		keyHex = v3Key.ExportHex()
+	default:
+		return "", fmt.Errorf("%s has unsupported type %T, expected Ed25519 or ECDSA P-384", desc, pub)
+	}
+
+	if kt != xpaseto.KeyTypePublic {
+		return "", fmt.Errorf("%s is a public key, but %s", desc,
+			paserkTypeHint(keyHex, ver, xpaseto.KeyTypePublic, kt))
+	}
+
+	return keyHex, nil
+}
@@ -0,0 +1,161 @@
+package caddypaseto
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticatePKIXKey(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	v4Key, err := paseto.NewV4AsymmetricSecretKeyFromEd25519(edPriv)
+	require.NoError(t, err)
+
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	v3Key, err := paseto.NewV3AsymmetricSecretKeyFromEcdsa(*ecPriv)
+	require.NoError(t, err)
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	tests := []struct {
+		name    string
+		key     string
+		version paseto.Version
+		token   string
+	}{
+		{
+			name:    "ok/ed25519_public_key",
+			key:     pkixPEM(t, edPub),
+			version: paseto.Version4,
+			token:   token.V4Sign(v4Key, nil),
+		},
+		{
+			name:    "ok/ed25519_certificate",
+			key:     certificatePEM(t, edPub, edPriv),
+			version: paseto.Version4,
+			token:   token.V4Sign(v4Key, nil),
+		},
+		{
+			name:    "ok/p384_public_key",
+			key:     pkixPEM(t, &ecPriv.PublicKey),
+			version: paseto.Version3,
+			token:   token.V3Sign(v3Key, nil),
+		},
+		{
+			name:    "ok/p384_certificate",
+			key:     certificatePEM(t, &ecPriv.PublicKey, ecPriv),
+			version: paseto.Version3,
+			token:   token.V3Sign(v3Key, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:       tt.key,
+				Version:   tt.version,
+				FromQuery: []string{"token"},
+				logger:    slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.token, nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.True(t, authenticated)
+			assert.Equal(t, "user123", user.ID)
+		})
+	}
+}
+
+func TestPasetoAuth_ValidatePKIXKey(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	p256Priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rsaPriv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/version_mismatch",
+			config: PasetoAuth{Key: pkixPEM(t, edPub), Version: paseto.Version3},
+			expErr: "PKIX key is an Ed25519 key, but version 3 requires a P-384 key; set `version 4`",
+		},
+		{
+			name:   "err/unsupported_curve",
+			config: PasetoAuth{Key: certificatePEM(t, &p256Priv.PublicKey, p256Priv), Version: paseto.Version3},
+			expErr: "certificate key is an ECDSA P-256 key, but only P-384 keys are supported",
+		},
+		{
+			name:   "err/unsupported_type",
+			config: PasetoAuth{Key: pkixPEM(t, &rsaPriv.PublicKey)},
+			expErr: "PKIX key has unsupported type *rsa.PublicKey, expected Ed25519 or ECDSA P-384",
+		},
+		{
+			name:   "err/purpose_local",
+			config: PasetoAuth{Key: certificatePEM(t, edPub, edPriv), Purpose: paseto.Local},
+			expErr: "certificate key is a public key, but purpose local requires a local key",
+		},
+		{
+			name:   "err/invalid_certificate",
+			config: PasetoAuth{Key: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("abc")}))},
+			expErr: "invalid certificate",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorContains(t, tt.config.Validate(), tt.expErr)
+		})
+	}
+}
+
+func pkixPEM(t *testing.T, pub any) string {
+	t.Helper()
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+}
+
+// certificatePEM returns a self-signed certificate for the public key.
+func certificatePEM(t *testing.T, pub any, priv crypto.Signer) string {
+	t.Helper()
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "issuer.example.com"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, pub, priv)
+	require.NoError(t, err)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
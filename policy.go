@@ -0,0 +1,314 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// IssuerPolicy overrides token time validation settings for tokens of a
+// specific issuer. Zero values inherit the settings of the handler.
+type IssuerPolicy struct {
+	// TimeSkewTolerance is the amount of time to allow token claim times (iat,
+	// nbf, exp) to be from the current system time.
+	TimeSkewTolerance time.Duration `json:"time_skew_tolerance"`
+
+	// MaxTokenAge is the maximum amount of time since the token was issued, as
+	// determined by the "iat" claim.
+	MaxTokenAge time.Duration `json:"max_token_age"`
+}
+
+// validatePolicies validates the time validation settings of the handler and
+// its issuer policies.
+func (p *PasetoAuth) validatePolicies() error {
+	if p.TimeSkewTolerance < 0 {
+		return fmt.Errorf("invalid time skew tolerance: '%s'", p.TimeSkewTolerance)
+	}
+	if p.MaxTokenAge < 0 {
+		return fmt.Errorf("invalid max token age: '%s'", p.MaxTokenAge)
+	}
+
+	for iss, policy := range p.IssuerPolicies {
+		if policy == nil {
+			return fmt.Errorf("invalid issuer policy for '%s': policy is empty", iss)
+		}
+		if policy.TimeSkewTolerance < 0 {
+			return fmt.Errorf("invalid issuer policy for '%s': negative time skew tolerance: '%s'",
+				iss, policy.TimeSkewTolerance)
+		}
+		if policy.MaxTokenAge < 0 {
+			return fmt.Errorf("invalid issuer policy for '%s': negative max token age: '%s'",
+				iss, policy.MaxTokenAge)
+		}
+	}
+
+	return nil
+}
+
+// timePolicy returns the time skew tolerance and maximum token age that apply
+// to the token, depending on its issuer.
+func (p *PasetoAuth) timePolicy(token *xpaseto.Token) (time.Duration, time.Duration) {
+	skew, maxAge := p.TimeSkewTolerance, p.MaxTokenAge
+
+	iss, err := token.GetIssuer()
+	if err != nil {
+		return skew, maxAge
+	}
+	if policy, ok := p.IssuerPolicies[iss]; ok {
+		if policy.TimeSkewTolerance > 0 {
+			skew = policy.TimeSkewTolerance
+		}
+		if policy.MaxTokenAge > 0 {
+			maxAge = policy.MaxTokenAge
+		}
+	}
+
+	return skew, maxAge
+}
+
+// notOlderThan checks that the token has a valid "iat" field, and that it was
+// issued at most maxAge before the given time.
+func notOlderThan(t time.Time, maxAge, tolerance time.Duration) paseto.Rule {
+	return func(token paseto.Token) error {
+		iat, err := token.GetIssuedAt()
+		if err != nil {
+			//nolint:wrapcheck // the paseto error is descriptive enough
+			return err
+		}
+
+		if t.Sub(iat) > maxAge+tolerance {
+			return fmt.Errorf("this token exceeds the maximum token age of %s", maxAge)
+		}
+
+		return nil
+	}
+}
+
+// Values of PasetoAuth.AudienceMatch.
+const (
+	audienceMatchAny = "any"
+	audienceMatchAll = "all"
+)
+
+// allowAudiences checks that the token has an "aud" claim that is allowed, i.e.
+// that matches one of the auds patterns, or equals one of the exact values. The
+// claim can either be a string, or an array of strings, in which case any or
+// all of its elements must be allowed, depending on match.
+func allowAudiences(auds, exact []string, match string) paseto.Rule {
+	return func(token paseto.Token) error {
+		var tokenAuds []string
+		switch val := token.Claims()["aud"].(type) {
+		case string:
+			tokenAuds = []string{val}
+		case []any:
+			for _, elem := range val {
+				aud, ok := elem.(string)
+				if !ok {
+					return fmt.Errorf("audience array contains a non-string value")
+				}
+				tokenAuds = append(tokenAuds, aud)
+			}
+		case nil:
+			return fmt.Errorf("audience is missing")
+		default:
+			return fmt.Errorf("audience is not a string or an array of strings")
+		}
+		if len(tokenAuds) == 0 {
+			return fmt.Errorf("audience is empty")
+		}
+
+		for _, aud := range tokenAuds {
+			allowed := slices.Contains(exact, aud) ||
+				slices.ContainsFunc(auds, func(pattern string) bool { return matchAudience(pattern, aud) })
+			if match == audienceMatchAny && allowed {
+				return nil
+			}
+			if match == audienceMatchAll && !allowed {
+				return fmt.Errorf("audience '%s' is not allowed", aud)
+			}
+		}
+		if match == audienceMatchAny {
+			return fmt.Errorf("audience '%s' is not allowed", strings.Join(tokenAuds, ","))
+		}
+
+		return nil
+	}
+}
+
+// hostAudiences returns the audiences that match the host of the request, for
+// PasetoAuth.AudienceFromHost: the bare host, and the host with the scheme of
+// the request. It returns nil if the request has no host.
+func hostAudiences(repl *caddy.Replacer) []string {
+	if repl == nil {
+		return nil
+	}
+	host := repl.ReplaceAll("{http.request.host}", "")
+	if host == "" {
+		return nil
+	}
+	return []string{host, repl.ReplaceAll("{http.request.scheme}", "") + "://" + host}
+}
+
+// denyAudiences checks that none of the audiences of the token are denied.
+// Tokens without an audience pass.
+func denyAudiences(auds []string) paseto.Rule {
+	return func(token paseto.Token) error {
+		var tokenAuds []any
+		switch val := token.Claims()["aud"].(type) {
+		case string:
+			tokenAuds = []any{val}
+		case []any:
+			tokenAuds = val
+		}
+		for _, elem := range tokenAuds {
+			if aud, _ := elem.(string); slices.Contains(auds, aud) {
+				return fmt.Errorf("audience '%s' is denied", aud)
+			}
+		}
+		return nil
+	}
+}
+
+// denyIssuers checks that the issuer of the token isn't denied. Tokens without
+// an issuer pass.
+func denyIssuers(issuers []string) paseto.Rule {
+	return func(token paseto.Token) error {
+		if iss, _ := token.Claims()["iss"].(string); slices.Contains(issuers, iss) {
+			return fmt.Errorf("issuer '%s' is denied", iss)
+		}
+		return nil
+	}
+}
+
+// allowIssuers checks that the token has an issuer, which is in the list, or
+// matches one of its patterns.
+func allowIssuers(issuers allowList) paseto.Rule {
+	return func(token paseto.Token) error {
+		iss, _ := token.Claims()["iss"].(string)
+		if iss == "" {
+			return errors.New("issuer is missing")
+		}
+		if !issuers.matches(iss) {
+			return fmt.Errorf("issuer '%s' is not allowed", iss)
+		}
+		return nil
+	}
+}
+
+// audienceWildcardStop are the characters that a wildcard of an audience
+// pattern doesn't match, so that it can't match other parts of a URL than
+// the ones it stands in for, e.g. "https://*.example.com" doesn't match
+// "https://evil.test/.example.com".
+const audienceWildcardStop = "/:?#@"
+
+// matchAudience reports whether the audience matches the pattern. A "*" in the
+// pattern matches one or more characters, except for the ones in
+// audienceWildcardStop.
+func matchAudience(pattern, aud string) bool {
+	prefix, rest, wildcard := strings.Cut(pattern, "*")
+	if !wildcard {
+		return pattern == aud
+	}
+	aud, ok := strings.CutPrefix(aud, prefix)
+	if !ok {
+		return false
+	}
+	for i, c := range aud {
+		if strings.ContainsRune(audienceWildcardStop, c) {
+			return false
+		}
+		if matchAudience(rest, aud[i+utf8.RuneLen(c):]) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireTokenType checks that the token type claim has the type value. This
+// prevents tokens of other types, e.g. refresh tokens, from being used as
+// access tokens.
+func requireTokenType(claim, typ string) paseto.Rule {
+	return func(token paseto.Token) error {
+		val, ok := token.Claims()[claim]
+		if !ok {
+			return fmt.Errorf("token type claim '%s' is missing", claim)
+		}
+		if tokenType, _ := val.(string); tokenType != typ {
+			return fmt.Errorf("token type '%s' is not '%s'", stringify(val), typ)
+		}
+		return nil
+	}
+}
+
+// forbidClaims checks that the token has none of the claims.
+func forbidClaims(claims []string) paseto.Rule {
+	return func(token paseto.Token) error {
+		for _, claim := range claims {
+			if _, ok := getClaim(token.Claims(), claim); ok {
+				return fmt.Errorf("token has forbidden claim '%s'", claim)
+			}
+		}
+		return nil
+	}
+}
+
+// requireClaimValues checks that the required claims, e.g. RequireClaims, have
+// one of their values. The actual value is redacted in the error, if the claim
+// is in RedactClaims.
+func (p *PasetoAuth) requireClaimValues(required map[string][]string) paseto.Rule {
+	claims := slices.Sorted(maps.Keys(required))
+	return func(token paseto.Token) error {
+		for _, claim := range claims {
+			val, ok := getClaim(token.Claims(), claim)
+			if !ok {
+				return fmt.Errorf("required claim '%s' is missing", claim)
+			}
+			elems, isList := val.([]any)
+			if !isList {
+				elems = []any{val}
+			}
+			if !slices.ContainsFunc(elems, func(elem any) bool {
+				return slices.Contains(required[claim], stringify(elem))
+			}) {
+				return fmt.Errorf("claim '%s' doesn't have a required value: '%s'", claim,
+					stringify(p.redact(claim, val)))
+			}
+		}
+		return nil
+	}
+}
+
+// allowClaimValues checks that the ClaimValues claims only have declared
+// values. The unexpected value is redacted in the error, if the claim is in
+// RedactClaims.
+func (p *PasetoAuth) allowClaimValues() paseto.Rule {
+	claims := slices.Sorted(maps.Keys(p.ClaimValues))
+	return func(token paseto.Token) error {
+		for _, claim := range claims {
+			val, ok := getClaim(token.Claims(), claim)
+			if !ok {
+				continue
+			}
+			elems, isList := val.([]any)
+			if !isList {
+				elems = []any{val}
+			}
+			for _, elem := range elems {
+				if !slices.Contains(p.ClaimValues[claim], stringify(elem)) {
+					return fmt.Errorf("claim '%s' has an unexpected value: '%s'", claim,
+						stringify(p.redact(claim, elem)))
+				}
+			}
+		}
+		return nil
+	}
+}
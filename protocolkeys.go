@@ -0,0 +1,138 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// protocolKeys are the keys of VersionKeys or PurposeKeys, for tokens whose
+// version or purpose differs from the one of the provider. K is the part of
+// the protocol that the keys are selected by.
+type protocolKeys[K paseto.Version | paseto.Purpose] struct {
+	// opt is the name of the option, for errors and logs.
+	opt string
+	// name is the name of the part of the protocol, for errors.
+	name string
+	// part returns the version or purpose of a provider.
+	part func(*PasetoAuth) *K
+}
+
+var (
+	versionKeys = protocolKeys[paseto.Version]{
+		opt: "version_keys", name: "version", part: func(p *PasetoAuth) *paseto.Version { return &p.Version },
+	}
+	purposeKeys = protocolKeys[paseto.Purpose]{
+		opt: "purpose_keys", name: "purpose", part: func(p *PasetoAuth) *paseto.Purpose { return &p.Purpose },
+	}
+)
+
+// newProviders returns the providers that own the keys of cfgs, by version or
+// purpose.
+func (pk protocolKeys[K]) newProviders(cfgs map[K]*Issuer) map[K]*PasetoAuth {
+	providers := make(map[K]*PasetoAuth, len(cfgs))
+	for k, cfg := range cfgs {
+		kp := cfg.provider()
+		if part := pk.part(kp); *part == "" {
+			*part = k
+		}
+		providers[k] = kp
+	}
+	return providers
+}
+
+// provision sets up the providers.
+func (pk protocolKeys[K]) provision(ctx caddy.Context, providers map[K]*PasetoAuth) error {
+	for _, k := range slices.Sorted(maps.Keys(providers)) {
+		if err := providers[k].Provision(ctx); err != nil {
+			return fmt.Errorf("invalid %s '%s': %w", pk.opt, k, err)
+		}
+	}
+	return nil
+}
+
+// validate loads the keys of the providers. It must be called after the
+// version and purpose of p are set, since the providers use the same version
+// and purpose, except for the one they're selected by, unless they set their
+// own.
+func (pk protocolKeys[K]) validate(p *PasetoAuth, cfgs map[K]*Issuer, providers map[K]*PasetoAuth) error {
+	var errs []error
+	for _, k := range slices.Sorted(maps.Keys(providers)) {
+		kp := providers[k]
+		switch {
+		case k == *pk.part(p):
+			errs = append(errs, fmt.Errorf("invalid %s '%s': the tokens of %s %s are verified with the "+
+				"other key options", pk.opt, k, pk.name, k))
+			continue
+		case *pk.part(kp) != k:
+			errs = append(errs, fmt.Errorf("invalid %s '%s': %s '%s' doesn't match", pk.opt, k, pk.name, *pk.part(kp)))
+			continue
+		case cfgs[k].sharesSettings():
+			errs = append(errs, fmt.Errorf("invalid %s '%s': allow_audiences, allow_issuers, "+
+				"time_skew_tolerance and max_token_age can only be used with issuers of the paseto app", pk.opt, k))
+			continue
+		}
+		if kp.Version == "" {
+			kp.Version = p.Version
+		}
+		if kp.Purpose == "" {
+			kp.Purpose = p.Purpose
+		}
+		kp.logger = p.logger.With(pk.opt, k)
+		kp.metrics = p.metrics
+		if err := kp.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("invalid %s '%s': %w", pk.opt, k, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// provisionProtocolKeys sets up the providers of VersionKeys and PurposeKeys.
+func (p *PasetoAuth) provisionProtocolKeys(ctx caddy.Context) error {
+	p.versionKeys = versionKeys.newProviders(p.VersionKeys)
+	p.purposeKeys = purposeKeys.newProviders(p.PurposeKeys)
+	if err := versionKeys.provision(ctx, p.versionKeys); err != nil {
+		return err
+	}
+	return purposeKeys.provision(ctx, p.purposeKeys)
+}
+
+// validateProtocolKeys loads the keys of VersionKeys and PurposeKeys.
+func (p *PasetoAuth) validateProtocolKeys() error {
+	if p.versionKeys == nil {
+		p.versionKeys = versionKeys.newProviders(p.VersionKeys)
+	}
+	if p.purposeKeys == nil {
+		p.purposeKeys = purposeKeys.newProviders(p.PurposeKeys)
+	}
+	return errors.Join(
+		versionKeys.validate(p, p.VersionKeys, p.versionKeys),
+		purposeKeys.validate(p, p.PurposeKeys, p.purposeKeys),
+	)
+}
+
+// tokenProtocolKeys returns the provider of VersionKeys for the version of the
+// token, if it's not the version of this provider, or else the provider of
+// PurposeKeys for its purpose, if it's not the purpose of this provider. It
+// returns nil if the token has the protocol of this provider, or there are no
+// keys for its protocol.
+func (p *PasetoAuth) tokenProtocolKeys(tokenStr string) *PasetoAuth {
+	proto, err := xpaseto.TokenProtocol(tokenStr)
+	switch {
+	case err != nil:
+		return nil
+	case proto.Version() != p.Version:
+		return p.versionKeys[proto.Version()]
+	case proto.Purpose() != p.Purpose:
+		return p.purposeKeys[proto.Purpose()]
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,260 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateVersionKeys(t *testing.T) {
+	v4Key := paseto.NewV4AsymmetricSecretKey()
+	v3Key := paseto.NewV3AsymmetricSecretKey()
+	v2Key := paseto.NewV2AsymmetricSecretKey()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:         v4Key.Public().ExportHex(),
+		VersionKeys: map[paseto.Version]*Issuer{paseto.Version3: {Key: v3Key.Public().ExportHex()}},
+		FromQuery:   []string{"token"},
+		logger:      slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	tests := []struct {
+		name     string
+		tokenStr string
+		expAuth  bool
+		expWarn  string
+	}{
+		{name: "ok/v4", tokenStr: token.V4Sign(v4Key, nil), expAuth: true},
+		{name: "ok/v3", tokenStr: token.V3Sign(v3Key, nil), expAuth: true},
+		{
+			name:     "err/v3_other_key",
+			tokenStr: token.V3Sign(paseto.NewV3AsymmetricSecretKey(), nil),
+			expWarn:  "bad signature",
+		},
+		{
+			name:     "err/v2",
+			tokenStr: token.V2Sign(v2Key),
+			expWarn:  "token protocol doesn't match the configured version and purpose",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler.Clear()
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.tokenStr, nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+			if tt.expWarn != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expWarn))
+			}
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateVersionKeys(t *testing.T) {
+	v4Key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	v3Key := paseto.NewV3AsymmetricSecretKey().Public().ExportHex()
+	v3LocalKey := paseto.NewV3SymmetricKey().ExportHex()
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name: "ok/local",
+			config: PasetoAuth{
+				Key:         paseto.NewV4SymmetricKey().ExportHex(),
+				Purpose:     paseto.Local,
+				VersionKeys: map[paseto.Version]*Issuer{paseto.Version3: {Key: v3LocalKey}},
+			},
+		},
+		{
+			name: "err/same_version",
+			config: PasetoAuth{
+				Key:         v4Key,
+				VersionKeys: map[paseto.Version]*Issuer{paseto.Version4: {Key: v4Key}},
+			},
+			expErr: "invalid version_keys 'v4': the tokens of version v4 are verified with the other key options",
+		},
+		{
+			name: "err/version_mismatch",
+			config: PasetoAuth{
+				Key:         v4Key,
+				VersionKeys: map[paseto.Version]*Issuer{paseto.Version3: {Key: v3Key, Version: paseto.Version2}},
+			},
+			expErr: "invalid version_keys 'v3': version 'v2' doesn't match",
+		},
+		{
+			name: "err/invalid_version",
+			config: PasetoAuth{
+				Key:         v4Key,
+				VersionKeys: map[paseto.Version]*Issuer{"v5": {Key: v3Key}},
+			},
+			expErr: "invalid version_keys 'v5': invalid version: 'v5'",
+		},
+		{
+			name: "err/key_mismatch",
+			config: PasetoAuth{
+				Key:         v4Key,
+				VersionKeys: map[paseto.Version]*Issuer{paseto.Version3: {Key: v3LocalKey}},
+			},
+			expErr: "invalid version_keys 'v3': ",
+		},
+		{
+			name: "err/shared_settings",
+			config: PasetoAuth{
+				Key:         v4Key,
+				VersionKeys: map[paseto.Version]*Issuer{paseto.Version3: {Key: v3Key, MaxTokenAge: time.Hour}},
+			},
+			expErr: "invalid version_keys 'v3': allow_audiences, allow_issuers, " +
+				"time_skew_tolerance and max_token_age can only be used with issuers of the paseto app",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
+
+func TestPasetoAuth_AuthenticatePurposeKeys(t *testing.T) {
+	publicKey := paseto.NewV4AsymmetricSecretKey()
+	localKey := paseto.NewV4SymmetricKey()
+	v3LocalKey := paseto.NewV3SymmetricKey()
+
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:         publicKey.Public().ExportHex(),
+		PurposeKeys: map[paseto.Purpose]*Issuer{paseto.Local: {Key: localKey.ExportHex()}},
+		VersionKeys: map[paseto.Version]*Issuer{
+			paseto.Version3: {Key: v3LocalKey.ExportHex(), Purpose: paseto.Local},
+		},
+		FromQuery: []string{"token"},
+		logger:    slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	tests := []struct {
+		name     string
+		tokenStr string
+		expAuth  bool
+		expWarn  string
+	}{
+		{name: "ok/public", tokenStr: token.V4Sign(publicKey, nil), expAuth: true},
+		{name: "ok/local", tokenStr: token.V4Encrypt(localKey, nil), expAuth: true},
+		{name: "ok/v3_local", tokenStr: token.V3Encrypt(v3LocalKey, nil), expAuth: true},
+		{
+			name:     "err/local_other_key",
+			tokenStr: token.V4Encrypt(paseto.NewV4SymmetricKey(), nil),
+			expWarn:  "bad message authentication code",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler.Clear()
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.tokenStr, nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+			if tt.expWarn != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expWarn))
+			}
+		})
+	}
+}
+
+func TestPasetoAuth_ValidatePurposeKeys(t *testing.T) {
+	publicKey := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	localKey := paseto.NewV4SymmetricKey().ExportHex()
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name: "ok/public",
+			config: PasetoAuth{
+				Key:         localKey,
+				Purpose:     paseto.Local,
+				PurposeKeys: map[paseto.Purpose]*Issuer{paseto.Public: {Key: publicKey}},
+			},
+		},
+		{
+			name: "err/same_purpose",
+			config: PasetoAuth{
+				Key:         publicKey,
+				PurposeKeys: map[paseto.Purpose]*Issuer{paseto.Public: {Key: publicKey}},
+			},
+			expErr: "invalid purpose_keys 'public': the tokens of purpose public are verified with the other key options",
+		},
+		{
+			name: "err/purpose_mismatch",
+			config: PasetoAuth{
+				Key:         publicKey,
+				PurposeKeys: map[paseto.Purpose]*Issuer{paseto.Local: {Key: localKey, Purpose: paseto.Public}},
+			},
+			expErr: "invalid purpose_keys 'local': purpose 'public' doesn't match",
+		},
+		{
+			name: "err/key_mismatch",
+			config: PasetoAuth{
+				Key: publicKey,
+				PurposeKeys: map[paseto.Purpose]*Issuer{
+					paseto.Local: {Key: paseto.NewV3AsymmetricSecretKey().Public().ExportHex()},
+				},
+			},
+			expErr: "invalid purpose_keys 'local': ",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
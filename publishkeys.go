@@ -0,0 +1,129 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(PasetoKeys{})
+}
+
+// publishedKeysVarKey is the key of the request variable that contains the
+// published keys document of the pasetoauth provider.
+const publishedKeysVarKey = "paseto.keys"
+
+// defaultPublishKeysPath is the default path of the published keys document.
+const defaultPublishKeysPath = "/.well-known/paseto-keys"
+
+// publishedKeys is the document of the public keys of a pasetoauth provider. It
+// has a "keys" array of PASERK keys, so that it can be used as the KeyURL of
+// another provider.
+type publishedKeys struct {
+	Version paseto.Version `json:"version"`
+	Purpose paseto.Purpose `json:"purpose"`
+	// Keys are the PASERK encoded public keys, e.g. "k4.public.<key>", in the
+	// order they're tried.
+	Keys []string `json:"keys"`
+	// IDs are the PASERK IDs of the keys, in the same order.
+	IDs []string `json:"ids"`
+}
+
+// publishedKeysCache is the encoded document of a key set.
+type publishedKeysCache struct {
+	set  *keySet
+	body []byte
+}
+
+// publishedKeysDocument returns the encoded document of the current keys. It's
+// encoded again only when the key set changes.
+func (p *PasetoAuth) publishedKeysDocument() ([]byte, error) {
+	p.refreshKeys()
+	set := p.keys.current()
+	if cached := p.keys.published.Load(); cached != nil && cached.set == set {
+		return cached.body, nil
+	}
+
+	doc := publishedKeys{
+		Version: p.Version,
+		Purpose: p.Purpose,
+		Keys:    make([]string, 0, len(set.keys)),
+		IDs:     make([]string, 0, len(set.keys)),
+	}
+	for _, key := range set.keys {
+		id, err := paserkID(key, p.Version, p.Purpose)
+		if err != nil {
+			return nil, err
+		}
+		doc.Keys = append(doc.Keys, encodePASERK(key, p.Version, p.Purpose))
+		doc.IDs = append(doc.IDs, id)
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding publish_keys document: %w", err)
+	}
+	p.keys.published.Store(&publishedKeysCache{set: set, body: body})
+
+	return body, nil
+}
+
+// allowsPublishedKeys reports whether the request is a request for the
+// published keys document, which doesn't require authentication. The document
+// is set in a request variable for PasetoKeys.
+func (p *PasetoAuth) allowsPublishedKeys(r *http.Request) bool {
+	if p.PublishKeys == "" || r.URL.Path != p.PublishKeys ||
+		(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	body, err := p.publishedKeysDocument()
+	if err != nil {
+		p.logger.Error(err.Error())
+		return false
+	}
+	caddyhttp.SetVar(r.Context(), publishedKeysVarKey, body)
+
+	return true
+}
+
+// PasetoKeys is an HTTP handler that responds with the public keys of the
+// pasetoauth provider that handled the request, if its PublishKeys option is
+// enabled, so that client services can discover the current verification keys
+// from Caddy itself. The document lists the keys as PASERK keys, along with
+// their PASERK IDs, and can be used as the key_url of another provider.
+type PasetoKeys struct{}
+
+var _ caddyhttp.MiddlewareHandler = (*PasetoKeys)(nil)
+
+// CaddyModule returns the Caddy module information.
+func (PasetoKeys) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.paseto_keys",
+		New: func() caddy.Module { return new(PasetoKeys) },
+	}
+}
+
+// ServeHTTP responds with the published keys document. It doesn't call the
+// next handler.
+func (PasetoKeys) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	body, ok := caddyhttp.GetVar(r.Context(), publishedKeysVarKey).([]byte)
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("pasetoauth publish_keys is not enabled for the request"))
+	}
+
+	// The cache lifetime is short, so that clients pick up rotated keys soon.
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(body)
+
+	//nolint:wrapcheck // the write error is returned as is
+	return err
+}
@@ -0,0 +1,131 @@
+package caddypaseto
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoKeys_ServeHTTP(t *testing.T) {
+	secretKey := paseto.NewV4AsymmetricSecretKey()
+	otherKey := paseto.NewV4AsymmetricSecretKey().Public()
+	auth := &PasetoAuth{
+		Keys:        []string{secretKey.Public().ExportHex(), otherKey.ExportHex()},
+		PublishKeys: defaultPublishKeysPath,
+		logger:      slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	newRequest := func(method, path string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]any))
+		return req.WithContext(ctx)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		req := newRequest(http.MethodGet, defaultPublishKeysPath)
+		user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+		assert.Empty(t, user.ID)
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, PasetoKeys{}.ServeHTTP(rec, req, nil))
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "public, max-age=60", rec.Header().Get("Cache-Control"))
+
+		var doc publishedKeys
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+		assert.Equal(t, paseto.Version4, doc.Version)
+		assert.Equal(t, paseto.Public, doc.Purpose)
+		assert.Equal(t, []string{
+			testKeyID(t, secretKey.Public().ExportHex()), testKeyID(t, otherKey.ExportHex()),
+		}, doc.IDs)
+		require.Len(t, doc.Keys, 2)
+		assert.Regexp(t, `^k4\.public\.`, doc.Keys[0])
+
+		// The document can be consumed by another provider, e.g. via key_url.
+		keys, err := parseKeyDocument(rec.Body.Bytes())
+		require.NoError(t, err)
+		consumer := &PasetoAuth{
+			Keys:      keys,
+			FromQuery: []string{"token"},
+			logger:    slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, consumer.Validate())
+
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		req = httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(secretKey, nil), nil)
+		user, authenticated, err = consumer.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		assert.True(t, authenticated)
+		assert.Equal(t, "user123", user.ID)
+	})
+
+	t.Run("ok/cached", func(t *testing.T) {
+		body, err := auth.publishedKeysDocument()
+		require.NoError(t, err)
+		cached, err := auth.publishedKeysDocument()
+		require.NoError(t, err)
+		assert.Same(t, &body[0], &cached[0])
+	})
+
+	t.Run("ok/head", func(t *testing.T) {
+		req := newRequest(http.MethodHead, defaultPublishKeysPath)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, PasetoKeys{}.ServeHTTP(rec, req, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Body.Bytes())
+	})
+
+	t.Run("err/method", func(t *testing.T) {
+		req := newRequest(http.MethodPost, defaultPublishKeysPath)
+		_, authenticated, _ := auth.Authenticate(httptest.NewRecorder(), req)
+		assert.False(t, authenticated)
+	})
+
+	t.Run("err/not_enabled", func(t *testing.T) {
+		err := PasetoKeys{}.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodGet, defaultPublishKeysPath), nil)
+		var handlerErr caddyhttp.HandlerError
+		require.ErrorAs(t, err, &handlerErr)
+		assert.Equal(t, http.StatusNotFound, handlerErr.StatusCode)
+	})
+
+	t.Run("err/invalid_path", func(t *testing.T) {
+		a := &PasetoAuth{
+			Key:         paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+			PublishKeys: "paseto-keys",
+			logger:      slog.New(testutil.NewTestLogHandler()),
+		}
+		require.ErrorContains(t, a.Validate(), "invalid publish_keys: path must start with '/'")
+	})
+
+	t.Run("err/local", func(t *testing.T) {
+		a := &PasetoAuth{
+			Key:         paseto.NewV4SymmetricKey().ExportHex(),
+			Purpose:     paseto.Local,
+			PublishKeys: defaultPublishKeysPath,
+			logger:      slog.New(testutil.NewTestLogHandler()),
+		}
+		require.ErrorContains(t, a.Validate(), "publish_keys can't be used with the local purpose")
+	})
+}
@@ -0,0 +1,131 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimit configures per-user request rate enforcement from a token claim.
+type RateLimit struct {
+	// Claim is the name of the token claim that contains the user's quota. If
+	// the claim value is a number, it's used as the maximum amount of requests
+	// allowed per Window, so that a quota of 0 or less denies all requests. If
+	// it's a string, it's treated as a tier name, and the limit is looked up in
+	// Tiers.
+	Claim string `json:"claim"`
+
+	// Window is the duration of the time window in which requests are counted.
+	// The default is 1m.
+	Window time.Duration `json:"window"`
+
+	// Default is the request limit applied when the token doesn't contain the
+	// quota claim, or when its tier isn't defined in Tiers. If 0, such requests
+	// aren't limited.
+	Default int `json:"default"`
+
+	// Tiers maps tier names to request limits. A limit of 0 doesn't limit the
+	// requests of the tier.
+	Tiers map[string]int `json:"tiers"`
+}
+
+// maxRateLimit is the ceiling of limits from claims, so that huge claim values,
+// e.g. 1e300, don't overflow when they're converted to int.
+const maxRateLimit = math.MaxInt32
+
+// limit returns the request limit for the given token claims, and false if the
+// request rate is not limited, i.e. if the limit of the tier, or the default
+// limit, is 0. Numeric claims are clamped to [0, maxRateLimit], so that a quota
+// of 0 or less denies all requests, and NaN or infinite values are ignored.
+func (rl *RateLimit) limit(claims map[string]any) (int, bool) {
+	switch val := claims[rl.Claim].(type) {
+	case float64:
+		if math.IsNaN(val) || math.IsInf(val, 0) {
+			return rl.Default, rl.Default != 0
+		}
+		return int(math.Min(math.Max(0, val), maxRateLimit)), true
+	case string:
+		if n, err := strconv.Atoi(val); err == nil {
+			return min(max(0, n), maxRateLimit), true
+		}
+		if n, ok := rl.Tiers[val]; ok {
+			return n, n != 0
+		}
+	}
+
+	return rl.Default, rl.Default != 0
+}
+
+// counterKey returns the key of the request counter of the user. The key is
+// namespaced by the token issuer and the quota claim, so that handlers of other
+// issuers or claims don't share the counters of a user ID. The counter store
+// namespaces it by the window.
+func (rl *RateLimit) counterKey(claims map[string]any, userID string) string {
+	iss, _ := claims["iss"].(string)
+	return fmt.Sprintf("%q/%q/%s", iss, rl.Claim, userID)
+}
+
+// counterStore counts events per key within fixed time windows.
+type counterStore interface {
+	// Incr increments the counter for key in the window that contains now, and
+	// returns the new count and the time the window resets.
+	Incr(key string, window time.Duration, now time.Time) (int, time.Time)
+}
+
+// sharedCounters is the counter store shared by all module instances, so that
+// request limits are enforced consistently across sites and config reloads,
+// for the handlers with the same issuer, claim and window.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var sharedCounters counterStore = newMemoryCounterStore()
+
+type counter struct {
+	count int
+	reset time.Time
+}
+
+// memoryCounterStore is an in-memory counterStore implementation.
+type memoryCounterStore struct {
+	mu        sync.Mutex
+	counters  map[string]*counter
+	lastSweep time.Time
+}
+
+var _ counterStore = (*memoryCounterStore)(nil)
+
+func newMemoryCounterStore() *memoryCounterStore {
+	return &memoryCounterStore{counters: make(map[string]*counter)}
+}
+
+// Incr implements the counterStore interface.
+func (s *memoryCounterStore) Incr(key string, window time.Duration, now time.Time) (int, time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.sweep(now, window)
+
+	key = fmt.Sprintf("%s/%s", window, key)
+	c, ok := s.counters[key]
+	if !ok || !now.Before(c.reset) {
+		c = &counter{reset: now.Truncate(window).Add(window)}
+		s.counters[key] = c
+	}
+	c.count++
+
+	return c.count, c.reset
+}
+
+// sweep removes expired counters, at most once per window.
+func (s *memoryCounterStore) sweep(now time.Time, window time.Duration) {
+	if now.Sub(s.lastSweep) < window {
+		return
+	}
+	for key, c := range s.counters {
+		if !now.Before(c.reset) {
+			delete(s.counters, key)
+		}
+	}
+	s.lastSweep = now
+}
@@ -0,0 +1,77 @@
+package caddypaseto
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryCounterStore(t *testing.T) {
+	store := newMemoryCounterStore()
+	now := time.Date(2025, 1, 1, 12, 0, 10, 0, time.UTC)
+
+	count, reset := store.Incr("alice", time.Minute, now)
+	assert.Equal(t, 1, count)
+	assert.Equal(t, time.Date(2025, 1, 1, 12, 1, 0, 0, time.UTC), reset)
+
+	count, _ = store.Incr("alice", time.Minute, now.Add(10*time.Second))
+	assert.Equal(t, 2, count)
+
+	count, _ = store.Incr("bob", time.Minute, now)
+	assert.Equal(t, 1, count)
+
+	count, _ = store.Incr("alice", time.Hour, now)
+	assert.Equal(t, 1, count)
+
+	// The window has passed, so the counter is reset, and the expired counter
+	// of bob is removed.
+	count, _ = store.Incr("alice", time.Minute, now.Add(time.Minute))
+	assert.Equal(t, 1, count)
+	assert.Len(t, store.counters, 2)
+}
+
+func TestRateLimitLimit(t *testing.T) {
+	rl := &RateLimit{
+		Claim:   "quota",
+		Default: 10,
+		Tiers:   map[string]int{"gold": 600, "free": 0},
+	}
+
+	tests := []struct {
+		name       string
+		claims     map[string]any
+		expLim     int
+		expLimited bool
+	}{
+		{"number", map[string]any{"quota": float64(100)}, 100, true},
+		{"zero_number", map[string]any{"quota": float64(0)}, 0, true},
+		{"negative_number", map[string]any{"quota": float64(-1)}, 0, true},
+		{"huge_number", map[string]any{"quota": 1e300}, math.MaxInt32, true},
+		{"huge_negative_number", map[string]any{"quota": -1e300}, 0, true},
+		{"nan", map[string]any{"quota": math.NaN()}, 10, true},
+		{"infinity", map[string]any{"quota": math.Inf(1)}, 10, true},
+		{"numeric_string", map[string]any{"quota": "50"}, 50, true},
+		{"zero_numeric_string", map[string]any{"quota": "0"}, 0, true},
+		{"negative_numeric_string", map[string]any{"quota": "-5"}, 0, true},
+		{"huge_numeric_string", map[string]any{"quota": "9223372036854775807"}, math.MaxInt32, true},
+		{"tier", map[string]any{"quota": "gold"}, 600, true},
+		{"unlimited_tier", map[string]any{"quota": "free"}, 0, false},
+		{"unknown_tier", map[string]any{"quota": "platinum"}, 10, true},
+		{"missing", map[string]any{}, 10, true},
+		{"invalid_type", map[string]any{"quota": true}, 10, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			limit, limited := rl.limit(tt.claims)
+			assert.Equal(t, tt.expLim, limit)
+			assert.Equal(t, tt.expLimited, limited)
+		})
+	}
+
+	// Without a default, requests without the claim aren't limited.
+	_, limited := (&RateLimit{Claim: "quota"}).limit(map[string]any{})
+	assert.False(t, limited)
+}
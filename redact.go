@@ -0,0 +1,66 @@
+package caddypaseto
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"slices"
+)
+
+// Values of PasetoAuth.RedactMode.
+const (
+	redactModeHash = "hash"
+	redactModeMask = "mask"
+)
+
+// redactedValue replaces the values of redacted claims in the mask mode.
+const redactedValue = "[REDACTED]"
+
+func (p *PasetoAuth) validateRedaction() error {
+	if len(p.RedactClaims) == 0 {
+		return nil
+	}
+
+	switch p.RedactMode {
+	case "":
+		p.RedactMode = redactModeHash
+	case redactModeHash, redactModeMask:
+	default:
+		return fmt.Errorf("invalid redact_mode: '%s'", p.RedactMode)
+	}
+
+	return nil
+}
+
+// redact returns the value of the claim as it should be logged. The values of
+// redacted claims are replaced with a truncated SHA-256 digest, which still
+// correlates the log entries of the same value, or with a fixed placeholder.
+// The elements of list claims are redacted individually, so that changes of
+// the list can still be logged.
+func (p *PasetoAuth) redact(claim string, val any) any {
+	if !slices.Contains(p.RedactClaims, claim) {
+		return val
+	}
+	if list, ok := val.([]any); ok {
+		redacted := make([]any, 0, len(list))
+		for _, elem := range list {
+			redacted = append(redacted, p.redact(claim, elem))
+		}
+		return redacted
+	}
+	if p.RedactMode == redactModeMask {
+		return redactedValue
+	}
+
+	digest := sha256.Sum256([]byte(stringify(val)))
+	return "sha256:" + hex.EncodeToString(digest[:8])
+}
+
+// logUserID returns the user ID as it should be logged. IDs derived by a claim
+// mapper aren't redacted, since they aren't the value of a single claim.
+func (p *PasetoAuth) logUserID(user mappedUser) any {
+	if user.claim == "" {
+		return user.id
+	}
+	return p.redact(user.claim, user.id)
+}
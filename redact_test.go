@@ -0,0 +1,115 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_Redact(t *testing.T) {
+	tests := []struct {
+		name   string
+		mode   string
+		claim  string
+		val    any
+		expVal any
+	}{
+		{name: "ok/not_redacted", claim: "sub", val: "user123", expVal: "user123"},
+		{name: "ok/hash", claim: "email", val: "user@example.com", expVal: "sha256:b4c9a289323b21a0"},
+		{name: "ok/hash_number", claim: "phone", val: 15551234567.0, expVal: "sha256:d6736136ea896c1b"},
+		{
+			name:   "ok/hash_list",
+			claim:  "email",
+			val:    []any{"user@example.com", "user@example.org"},
+			expVal: []any{"sha256:b4c9a289323b21a0", "sha256:d159ef624ed86697"},
+		},
+		{name: "ok/mask", mode: "mask", claim: "email", val: "user@example.com", expVal: "[REDACTED]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{RedactClaims: []string{"email", "phone"}, RedactMode: tt.mode}
+			require.NoError(t, auth.validateRedaction())
+			assert.Equal(t, tt.expVal, auth.redact(tt.claim, tt.val))
+		})
+	}
+
+	t.Run("err/invalid_mode", func(t *testing.T) {
+		auth := &PasetoAuth{RedactClaims: []string{"email"}, RedactMode: "drop"}
+		require.EqualError(t, auth.validateRedaction(), "invalid redact_mode: 'drop'")
+	})
+}
+
+func TestPasetoAuth_AuthenticateRedactClaims(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	newAuth := func(userClaim string) (*PasetoAuth, *testutil.TestLogHandler) {
+		t.Helper()
+		logHandler := testutil.NewTestLogHandler()
+		auth := &PasetoAuth{
+			Key:             v4PrivateKey.Public().ExportHex(),
+			FromQuery:       []string{"token"},
+			UserClaims:      []string{userClaim},
+			LogClaimChanges: []string{"email"},
+			RedactClaims:    []string{"email"},
+			claimHistory:    newClaimHistory(),
+			logger:          slog.New(logHandler),
+		}
+		require.NoError(t, auth.Validate())
+		return auth, logHandler
+	}
+	authenticate := func(auth *PasetoAuth, iat time.Time, email string) {
+		t.Helper()
+		token := paseto.NewToken()
+		token.SetIssuedAt(iat)
+		token.SetNotBefore(iat)
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		token.SetString("email", email)
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(v4PrivateKey, nil), nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+	}
+	attrs := func(logHandler *testutil.TestLogHandler, msg string) map[string]any {
+		t.Helper()
+		for _, record := range logHandler.Records() {
+			if record.Message != msg {
+				continue
+			}
+			attrs := make(map[string]any)
+			for _, attr := range record.Attrs {
+				attrs[attr.Key] = attr.Value
+			}
+			return attrs
+		}
+		require.Fail(t, "record not found", msg)
+		return nil
+	}
+
+	t.Run("ok/user_id", func(t *testing.T) {
+		auth, logHandler := newAuth("email")
+		authenticate(auth, time.Now(), "user@example.com")
+		assert.Equal(t, "sha256:b4c9a289323b21a0", attrs(logHandler, "user authenticated")["user_id"])
+	})
+
+	t.Run("ok/claim_changes", func(t *testing.T) {
+		auth, logHandler := newAuth("sub")
+		issuedAt := time.Now().Add(-time.Hour)
+		authenticate(auth, issuedAt, "user@example.com")
+		authenticate(auth, issuedAt.Add(time.Minute), "user@example.org")
+
+		changes := attrs(logHandler, "user claims changed since the previous token")
+		assert.Equal(t, "user123", changes["user_id"])
+		assert.Equal(t, map[string]any{"old": "sha256:b4c9a289323b21a0", "new": "sha256:d159ef624ed86697"},
+			changes["email"])
+	})
+}
@@ -0,0 +1,90 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// ReplayVerifications replays the recorded verification outcome of tokens,
+// instead of verifying them again with the keys, for load and capacity tests.
+// The first verification of each token is recorded, and later requests with the
+// same token reuse its outcome, i.e. the parsed token or the error, while the
+// token extraction, the claim rules, the placeholders and the rest of the
+// pipeline still run. This separates the cost of the cryptography from the
+// rest of the pipeline, e.g. with the verify timing placeholder.
+//
+// Replayed tokens aren't verified again, even if their key is removed, so this
+// must never be enabled in production. Unsafe must be set to acknowledge that.
+type ReplayVerifications struct {
+	// Unsafe must be true, to enable the replays explicitly.
+	Unsafe bool `json:"unsafe"`
+
+	// MaxTokens is the maximum amount of tokens whose outcome is recorded.
+	// Tokens beyond that are always verified. The default is 100000.
+	MaxTokens int `json:"max_tokens,omitempty"`
+}
+
+func (rv *ReplayVerifications) provision() error {
+	if !rv.Unsafe {
+		return errors.New("invalid replay_verifications: unsafe must be set to replay verification outcomes")
+	}
+	if rv.MaxTokens < 0 {
+		return fmt.Errorf("invalid replay_verifications: negative max tokens: %d", rv.MaxTokens)
+	} else if rv.MaxTokens == 0 {
+		rv.MaxTokens = 100000
+	}
+
+	return nil
+}
+
+// verifyOutcome is the recorded outcome of a token verification.
+type verifyOutcome struct {
+	token *xpaseto.Token
+	err   error
+}
+
+// verifyReplay records the verification outcomes of tokens by fingerprint. A
+// nil replay doesn't record anything.
+type verifyReplay struct {
+	max     int
+	metrics *metrics
+
+	mu       sync.RWMutex
+	outcomes map[string]verifyOutcome
+}
+
+func newVerifyReplay(cfg *ReplayVerifications, m *metrics) *verifyReplay {
+	return &verifyReplay{max: cfg.MaxTokens, metrics: m, outcomes: make(map[string]verifyOutcome)}
+}
+
+// verify returns the recorded outcome of the token with the fingerprint, or
+// records the outcome of verify. Budget exhaustions aren't recorded, since
+// they depend on the request.
+func (vr *verifyReplay) verify(fp string, verify func() (*xpaseto.Token, error)) (*xpaseto.Token, error) {
+	if vr == nil {
+		return verify()
+	}
+
+	vr.mu.RLock()
+	outcome, ok := vr.outcomes[fp]
+	vr.mu.RUnlock()
+	if ok {
+		vr.metrics.incReplayedVerifications()
+		return outcome.token, outcome.err
+	}
+
+	token, err := verify()
+	if errors.Is(err, errVerifyBudget) {
+		return token, err
+	}
+	vr.mu.Lock()
+	if len(vr.outcomes) < vr.max {
+		vr.outcomes[fp] = verifyOutcome{token: token, err: err}
+	}
+	vr.mu.Unlock()
+
+	return token, err
+}
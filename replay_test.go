@@ -0,0 +1,88 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateReplayVerifications(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+
+	reg := prometheus.NewPedanticRegistry()
+	m, err := newMetrics(reg)
+	require.NoError(t, err)
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key:                 key.Public().ExportHex(),
+		FromQuery:           []string{"token"},
+		AllowAudiences:      []string{"api"},
+		ReplayVerifications: &ReplayVerifications{Unsafe: true, MaxTokens: 2},
+		metrics:             m,
+		logger:              slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+	assert.True(t, logHandler.HasRecord(slog.LevelWarn, "replaying token verification outcomes"))
+
+	newTokenStr := func(aud string) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		token.SetAudience(aud)
+		return token.V4Sign(key, nil)
+	}
+	authenticate := func(tokenStr string) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, authErr := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, authErr)
+		return authenticated
+	}
+
+	validToken, otherAudToken := newTokenStr("api"), newTokenStr("other")
+	assert.True(t, authenticate(validToken))
+	assert.False(t, authenticate(otherAudToken))
+	assert.Equal(t, 0.0, gatherValue(t, reg, "caddy_paseto_replayed_verifications_total"))
+
+	// The outcomes are replayed, and the claim rules still apply.
+	assert.True(t, authenticate(validToken))
+	assert.False(t, authenticate(otherAudToken))
+	assert.Equal(t, 2.0, gatherValue(t, reg, "caddy_paseto_replayed_verifications_total"))
+
+	// Failed verifications are replayed as well.
+	invalidToken := newTokenStr("api")[:60] + "AAAA"
+	assert.False(t, authenticate(invalidToken))
+	assert.Len(t, auth.verifyReplay.outcomes, 2, "outcomes beyond max_tokens aren't recorded")
+
+	// Denied tokens are rejected before the outcome is replayed.
+	auth.denylist = newFingerprintSet()
+	auth.denylist.add(tokenFingerprint(validToken))
+	assert.False(t, authenticate(validToken))
+}
+
+func TestReplayVerifications_Provision(t *testing.T) {
+	require.ErrorContains(t, (&ReplayVerifications{}).provision(), "unsafe must be set")
+	require.ErrorContains(t, (&ReplayVerifications{Unsafe: true, MaxTokens: -1}).provision(), "negative max tokens")
+
+	rv := &ReplayVerifications{Unsafe: true}
+	require.NoError(t, rv.provision())
+	assert.Equal(t, 100000, rv.MaxTokens)
+}
+
+func TestPasetoAuth_ValidateReplayVerificationsUnprovisioned(t *testing.T) {
+	auth := &PasetoAuth{
+		Key:                 paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		ReplayVerifications: &ReplayVerifications{Unsafe: true},
+	}
+	require.NoError(t, auth.Validate())
+}
@@ -0,0 +1,89 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+
+	"aidanwoods.dev/go-paseto"
+)
+
+// defaultRolesClaim is the default claim of the roles of a token.
+const defaultRolesClaim = "roles"
+
+// validateRoles validates the AllowRoles and DenyRoles, and applies the default
+// RolesClaim.
+func (p *PasetoAuth) validateRoles() error {
+	if p.RolesClaim == "" {
+		p.RolesClaim = defaultRolesClaim
+	}
+	if slices.Contains(p.AllowRoles, "") {
+		return errors.New("invalid allow_roles: empty role")
+	}
+	if slices.Contains(p.DenyRoles, "") {
+		return errors.New("invalid deny_roles: empty role")
+	}
+
+	return nil
+}
+
+// tokenRoles returns the roles of the claim, which can either be a string with
+// a single role, or an array of strings. ok is false if the token doesn't have
+// the claim.
+func tokenRoles(claims map[string]any, claim string) (roles []string, ok bool, err error) {
+	val, ok := getClaim(claims, claim)
+	if !ok || val == nil {
+		return nil, false, nil
+	}
+	switch val := val.(type) {
+	case string:
+		return []string{val}, true, nil
+	case []any:
+		roles = make([]string, 0, len(val))
+		for _, elem := range val {
+			role, isString := elem.(string)
+			if !isString {
+				return nil, true, fmt.Errorf("roles claim '%s' contains a non-string value", claim)
+			}
+			roles = append(roles, role)
+		}
+		return roles, true, nil
+	default:
+		return nil, true, fmt.Errorf("roles claim '%s' is not a string or an array of strings", claim)
+	}
+}
+
+// denyRoles checks that the token has none of the roles. Tokens without the
+// claim pass, but tokens with an invalid claim are rejected, so that a denied
+// role can't be smuggled in a value that isn't understood.
+func denyRoles(claim string, roles []string) paseto.Rule {
+	return func(token paseto.Token) error {
+		have, _, err := tokenRoles(token.Claims(), claim)
+		if err != nil {
+			return err
+		}
+		for _, role := range have {
+			if slices.Contains(roles, role) {
+				return fmt.Errorf("role '%s' is denied", role)
+			}
+		}
+		return nil
+	}
+}
+
+// allowRoles checks that the token has any of the roles.
+func allowRoles(claim string, roles []string) paseto.Rule {
+	return func(token paseto.Token) error {
+		have, ok, err := tokenRoles(token.Claims(), claim)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("roles claim '%s' is missing", claim)
+		}
+		if !slices.ContainsFunc(have, func(role string) bool { return slices.Contains(roles, role) }) {
+			return errors.New("token has none of the allowed roles")
+		}
+		return nil
+	}
+}
@@ -0,0 +1,133 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateRoles(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+
+	tests := []struct {
+		name       string
+		allowRoles []string
+		denyRoles  []string
+		rolesClaim string
+		claims     map[string]any
+		expAuth    bool
+	}{
+		{
+			name:       "ok/string",
+			allowRoles: []string{"admin", "editor"},
+			claims:     map[string]any{"roles": "editor"},
+			expAuth:    true,
+		},
+		{
+			name:       "ok/array",
+			allowRoles: []string{"admin"},
+			claims:     map[string]any{"roles": []string{"viewer", "admin"}},
+			expAuth:    true,
+		},
+		{
+			name:       "ok/nested_claim",
+			allowRoles: []string{"admin"},
+			rolesClaim: "realm_access.roles",
+			claims:     map[string]any{"realm_access": map[string]any{"roles": []string{"admin"}}},
+			expAuth:    true,
+		},
+		{name: "ok/deny_missing", denyRoles: []string{"suspended"}, expAuth: true},
+		{
+			name:      "ok/deny_other",
+			denyRoles: []string{"suspended"},
+			claims:    map[string]any{"roles": []string{"viewer"}},
+			expAuth:   true,
+		},
+		{name: "err/not_allowed", allowRoles: []string{"admin"}, claims: map[string]any{"roles": "viewer"}},
+		{name: "err/missing", allowRoles: []string{"admin"}},
+		{name: "err/empty_array", allowRoles: []string{"admin"}, claims: map[string]any{"roles": []string{}}},
+		{name: "err/not_a_string", allowRoles: []string{"admin"}, claims: map[string]any{"roles": []any{"admin", 1}}},
+		{name: "err/invalid_type", denyRoles: []string{"suspended"}, claims: map[string]any{"roles": 42}},
+		{
+			name:       "err/denied",
+			allowRoles: []string{"admin"},
+			denyRoles:  []string{"suspended"},
+			claims:     map[string]any{"roles": []string{"admin", "suspended"}},
+		},
+		{
+			name:       "err/other_claim",
+			allowRoles: []string{"admin"},
+			rolesClaim: "groups",
+			claims:     map[string]any{"roles": "admin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:        key.Public().ExportHex(),
+				FromQuery:  []string{"token"},
+				AllowRoles: tt.allowRoles,
+				DenyRoles:  tt.denyRoles,
+				RolesClaim: tt.rolesClaim,
+				logger:     slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			for claim, val := range tt.claims {
+				require.NoError(t, token.Set(claim, val))
+			}
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(key, nil), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateRoles(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/roles_claim",
+			config: PasetoAuth{Key: key, RolesClaim: "groups"},
+			expErr: "roles_claim requires allow_roles or deny_roles",
+		},
+		{
+			name:   "err/empty_allow",
+			config: PasetoAuth{Key: key, AllowRoles: []string{"admin", ""}},
+			expErr: "invalid allow_roles: empty role",
+		},
+		{
+			name:   "err/empty_deny",
+			config: PasetoAuth{Key: key, DenyRoles: []string{""}},
+			expErr: "invalid deny_roles: empty role",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			require.ErrorContains(t, tt.config.Validate(), tt.expErr)
+		})
+	}
+}
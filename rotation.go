@@ -0,0 +1,319 @@
+package caddypaseto
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/certmagic"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// rotationStoragePrefix is the storage path prefix of rotated keys.
+const rotationStoragePrefix = "paseto/rotation"
+
+// KeyRotation configures keys that are generated and rotated automatically.
+// The keys are persisted in the Caddy storage module, so that all Caddy
+// instances that use the same storage agree on them, and only one of them
+// generates each new key. A new key is generated every Interval, and the key
+// it replaces remains valid for Overlap after the new key is activated, so
+// that tokens issued with it can still be verified.
+//
+// The stored keys are the private keys of the public purpose, or the symmetric
+// keys of the local purpose, so the storage must be protected accordingly.
+type KeyRotation struct {
+	// Name identifies the rotated keys in storage. The pasetoauth providers
+	// and paseto_sign handlers with the same name, version and purpose share
+	// the same keys. The default is "default".
+	Name string `json:"name,omitempty"`
+
+	// Interval is how often a new key is generated. The default is 168h.
+	Interval time.Duration `json:"interval,omitempty"`
+
+	// Overlap is how long the replaced key remains valid after the new key is
+	// activated. It should be longer than the lifetime of the tokens. The
+	// default is 24h.
+	Overlap time.Duration `json:"overlap,omitempty"`
+
+	// CheckInterval is how often the storage is checked for keys generated by
+	// other instances. A new key is activated, i.e. used to sign tokens,
+	// CheckInterval after it's generated, so that all instances accept it by
+	// then. The default is 1m.
+	CheckInterval time.Duration `json:"check_interval,omitempty"`
+}
+
+func (kr *KeyRotation) provision() error {
+	if kr.Name == "" {
+		kr.Name = "default"
+	} else if strings.ContainsAny(kr.Name, `/\`) {
+		return fmt.Errorf("invalid key_rotation name: '%s'", kr.Name)
+	}
+	if kr.Interval < 0 {
+		return fmt.Errorf("invalid key_rotation interval: '%s'", kr.Interval)
+	} else if kr.Interval == 0 {
+		kr.Interval = 7 * 24 * time.Hour
+	}
+	if kr.Overlap < 0 {
+		return fmt.Errorf("invalid key_rotation overlap: '%s'", kr.Overlap)
+	} else if kr.Overlap == 0 {
+		kr.Overlap = 24 * time.Hour
+	}
+	if kr.CheckInterval < 0 {
+		return fmt.Errorf("invalid key_rotation check_interval: '%s'", kr.CheckInterval)
+	} else if kr.CheckInterval == 0 {
+		kr.CheckInterval = time.Minute
+	}
+	if kr.CheckInterval >= kr.Interval {
+		return fmt.Errorf("invalid key_rotation: check_interval '%s' must be shorter than interval '%s'",
+			kr.CheckInterval, kr.Interval)
+	}
+
+	return nil
+}
+
+// rotatedKey is a stored key of a key rotation.
+type rotatedKey struct {
+	// Key is the hex encoded private or symmetric key.
+	Key      string    `json:"key"`
+	ActiveAt time.Time `json:"active_at"`
+}
+
+// rotationState is the stored document of a key rotation. The keys are
+// ordered from newest to oldest.
+type rotationState struct {
+	Keys []rotatedKey `json:"keys"`
+}
+
+// rotatedSigner is the cached signing key of a key rotation.
+type rotatedSigner struct {
+	activeAt time.Time
+	key      *xpaseto.Key
+}
+
+// keyRotator generates, stores and loads the keys of a key rotation.
+type keyRotator struct {
+	cfg     KeyRotation
+	storage certmagic.Storage
+	version paseto.Version
+	purpose paseto.Purpose
+	logger  *slog.Logger
+
+	state  atomic.Pointer[rotationState]
+	signer atomic.Pointer[rotatedSigner]
+
+	mu        sync.Mutex
+	nextCheck time.Time
+	syncing   bool
+	keys      []string
+}
+
+func newKeyRotator(
+	kr *KeyRotation, storage certmagic.Storage, ver paseto.Version, purpose paseto.Purpose, logger *slog.Logger,
+) (*keyRotator, error) {
+	if err := kr.provision(); err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		return nil, errors.New("key_rotation requires a storage module")
+	}
+
+	return &keyRotator{cfg: *kr, storage: storage, version: ver, purpose: purpose, logger: logger}, nil
+}
+
+// storageKey returns the storage key of the rotation document. The version
+// and purpose are part of the key, since keys can't be shared by different
+// protocols.
+func (r *keyRotator) storageKey() string {
+	return path.Join(rotationStoragePrefix, r.cfg.Name, string(r.version)+"."+string(r.purpose))
+}
+
+// due reports whether the storage should be checked, and if so, marks it as
+// being checked, so that only one check is in progress at a time.
+func (r *keyRotator) due(now time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.syncing || now.Before(r.nextCheck) {
+		return false
+	}
+	r.syncing = true
+	return true
+}
+
+// sync loads the stored keys, and generates a new key if the active key is due
+// for rotation. It returns the encoded verification keys, and false if they
+// haven't changed since the last sync.
+func (r *keyRotator) sync(ctx context.Context, now time.Time) ([]string, bool, error) {
+	defer func() {
+		r.mu.Lock()
+		r.syncing = false
+		r.nextCheck = time.Now().Add(r.cfg.CheckInterval)
+		r.mu.Unlock()
+	}()
+
+	state, err := r.load(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	if state.due(now, r.cfg.Interval) {
+		if state, err = r.rotate(ctx, now); err != nil {
+			return nil, false, err
+		}
+	}
+	state.prune(now, r.cfg.Overlap)
+	r.state.Store(state)
+
+	keys, err := r.verificationKeys(state)
+	if err != nil {
+		return nil, false, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if slices.Equal(keys, r.keys) {
+		return nil, false, nil
+	}
+	r.keys = keys
+
+	return keys, true, nil
+}
+
+// rotate generates a new key while holding the storage lock of the rotation,
+// unless another instance rotated the keys in the meantime.
+func (r *keyRotator) rotate(ctx context.Context, now time.Time) (*rotationState, error) {
+	lockKey := r.storageKey() + ".lock"
+	if err := r.storage.Lock(ctx, lockKey); err != nil {
+		return nil, fmt.Errorf("failed locking rotated keys: %w", err)
+	}
+	defer func() {
+		if err := r.storage.Unlock(context.WithoutCancel(ctx), lockKey); err != nil {
+			r.logger.Warn("failed unlocking rotated keys", "key_rotation", r.cfg.Name, "error", err)
+		}
+	}()
+
+	state, err := r.load(ctx)
+	if err != nil || !state.due(now, r.cfg.Interval) {
+		return state, err
+	}
+
+	key, err := xpaseto.NewKey(r.version, r.purpose, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed generating rotated key: %w", err)
+	}
+	// The first key is activated immediately, since there's no key to sign
+	// with in the meantime.
+	activeAt := now
+	if len(state.Keys) > 0 {
+		activeAt = now.Add(r.cfg.CheckInterval)
+	}
+	state.Keys = slices.Insert(state.Keys, 0, rotatedKey{Key: key.ExportHex(), ActiveAt: activeAt.UTC()})
+	state.prune(now, r.cfg.Overlap)
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding rotated keys: %w", err)
+	}
+	if err = r.storage.Store(ctx, r.storageKey(), data); err != nil {
+		return nil, fmt.Errorf("failed storing rotated keys: %w", err)
+	}
+	r.logger.Info("generated a new rotated key", "key_rotation", r.cfg.Name, "active_at", activeAt)
+
+	return state, nil
+}
+
+func (r *keyRotator) load(ctx context.Context) (*rotationState, error) {
+	data, err := r.storage.Load(ctx, r.storageKey())
+	if errors.Is(err, fs.ErrNotExist) {
+		return &rotationState{}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed loading rotated keys: %w", err)
+	}
+
+	var state rotationState
+	if err = json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed decoding rotated keys: %w", err)
+	}
+
+	return &state, nil
+}
+
+// verificationKeys returns the encoded keys that verify or decrypt the tokens
+// issued with the keys of the state.
+func (r *keyRotator) verificationKeys(state *rotationState) ([]string, error) {
+	keys := make([]string, 0, len(state.Keys))
+	for _, rk := range state.Keys {
+		if r.purpose == paseto.Local {
+			keys = append(keys, rk.Key)
+			continue
+		}
+		pub := publicKeyHex(rk.Key, r.version)
+		if pub == "" {
+			return nil, errors.New("invalid rotated keys: stored key is not a private key")
+		}
+		keys = append(keys, pub)
+	}
+
+	return keys, nil
+}
+
+// reset makes the next sync return the keys, even if they haven't changed.
+// It's used when the keys couldn't be applied.
+func (r *keyRotator) reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.keys = nil
+}
+
+// signingKey returns the active key, i.e. the newest key that was activated.
+func (r *keyRotator) signingKey(now time.Time) (*xpaseto.Key, error) {
+	state := r.state.Load()
+	if state == nil {
+		return nil, errors.New("rotated keys are not loaded")
+	}
+	idx := slices.IndexFunc(state.Keys, func(rk rotatedKey) bool { return !now.Before(rk.ActiveAt) })
+	if idx == -1 {
+		return nil, errors.New("no rotated key is active")
+	}
+
+	rk := state.Keys[idx]
+	if signer := r.signer.Load(); signer != nil && signer.activeAt.Equal(rk.ActiveAt) {
+		return signer.key, nil
+	}
+	keyType := xpaseto.KeyTypePrivate
+	if r.purpose == paseto.Local {
+		keyType = xpaseto.KeyTypeSymmetric
+	}
+	key, err := loadKey(rk.Key, "", r.version, r.purpose, keyType)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rotated key: %w", err)
+	}
+	r.signer.Store(&rotatedSigner{activeAt: rk.ActiveAt, key: key})
+
+	return key, nil
+}
+
+// due reports whether the active key should be rotated.
+func (s *rotationState) due(now time.Time, interval time.Duration) bool {
+	return len(s.Keys) == 0 || !now.Before(s.Keys[0].ActiveAt.Add(interval))
+}
+
+// prune removes the keys whose overlap window has ended, i.e. the keys that
+// were replaced by a key that has been active for longer than the overlap.
+func (s *rotationState) prune(now time.Time, overlap time.Duration) {
+	for i := 1; i < len(s.Keys); i++ {
+		if !now.Before(s.Keys[i-1].ActiveAt.Add(overlap)) {
+			s.Keys = s.Keys[:i]
+			return
+		}
+	}
+}
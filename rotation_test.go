@@ -0,0 +1,177 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+func TestKeyRotator_Sync(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	cfg := KeyRotation{Interval: time.Hour, Overlap: 10 * time.Minute, CheckInterval: time.Minute}
+	newRotator := func() *keyRotator {
+		t.Helper()
+		kr := cfg
+		r, err := newKeyRotator(&kr, storage, paseto.Version4, paseto.Public, slog.New(testutil.NewTestLogHandler()))
+		require.NoError(t, err)
+		return r
+	}
+	r1, r2 := newRotator(), newRotator()
+	now := time.Now()
+
+	// The first key is generated by the first instance, and activated
+	// immediately.
+	keys, changed, err := r1.sync(t.Context(), now)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	require.Len(t, keys, 1)
+	first := keys[0]
+
+	keys, changed, err = r2.sync(t.Context(), now)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{first}, keys)
+
+	_, changed, err = r1.sync(t.Context(), now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	firstSigner, err := r1.signingKey(now)
+	require.NoError(t, err)
+	assert.Equal(t, first, publicKeyHex(firstSigner.ExportHex(), paseto.Version4))
+
+	// The second instance rotates the key, and the previous key remains the
+	// active key until the new key is activated.
+	rotatedAt := now.Add(time.Hour)
+	keys, changed, err = r2.sync(t.Context(), rotatedAt)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	require.Len(t, keys, 2)
+	assert.Equal(t, first, keys[1])
+	second := keys[0]
+
+	keys, changed, err = r1.sync(t.Context(), rotatedAt)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{second, first}, keys)
+
+	signer, err := r1.signingKey(rotatedAt)
+	require.NoError(t, err)
+	assert.Equal(t, first, publicKeyHex(signer.ExportHex(), paseto.Version4))
+	signer, err = r1.signingKey(rotatedAt.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, second, publicKeyHex(signer.ExportHex(), paseto.Version4))
+
+	// The previous key is removed once the overlap window ends.
+	keys, changed, err = r1.sync(t.Context(), rotatedAt.Add(11*time.Minute))
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{second}, keys)
+}
+
+func TestPasetoAuth_AuthenticateRotatedKeys(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	logger := slog.New(testutil.NewTestLogHandler())
+
+	s := &PasetoSign{KeyRotation: &KeyRotation{}, storage: storage, logger: logger}
+	require.NoError(t, s.Validate())
+
+	auth := &PasetoAuth{
+		KeyRotation: &KeyRotation{},
+		FromQuery:   []string{"token"},
+		storage:     storage,
+		logger:      logger,
+	}
+	require.NoError(t, auth.Validate())
+
+	key, err := s.signingKey(time.Now())
+	require.NoError(t, err)
+	token, err := xpaseto.NewToken(time.Now,
+		xpaseto.ClaimIssuedAt(time.Now()),
+		xpaseto.ClaimNotBefore(time.Now()),
+		xpaseto.ClaimExpiration(time.Now().Add(time.Hour)),
+		xpaseto.ClaimSubject("user123"),
+	)
+	require.NoError(t, err)
+	tokenStr, err := key.Sign(token)
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+	user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+	assert.Equal(t, "user123", user.ID)
+}
+
+func TestPasetoAuth_ValidateKeyRotation(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	tests := []struct {
+		name    string
+		config  PasetoAuth
+		storage certmagic.Storage
+		expErr  string
+	}{
+		{
+			name:    "ok/local",
+			config:  PasetoAuth{KeyRotation: &KeyRotation{Name: "internal"}, Purpose: paseto.Local},
+			storage: storage,
+		},
+		{
+			name:   "err/no_storage",
+			config: PasetoAuth{KeyRotation: &KeyRotation{}},
+			expErr: "key_rotation requires a storage module",
+		},
+		{
+			name:    "err/invalid_name",
+			config:  PasetoAuth{KeyRotation: &KeyRotation{Name: "a/b"}},
+			storage: storage,
+			expErr:  "invalid key_rotation name: 'a/b'",
+		},
+		{
+			name:    "err/check_interval",
+			config:  PasetoAuth{KeyRotation: &KeyRotation{Interval: time.Minute, CheckInterval: time.Minute}},
+			storage: storage,
+			expErr:  "invalid key_rotation: check_interval '1m0s' must be shorter than interval '1m0s'",
+		},
+		{
+			name:    "err/negative_overlap",
+			config:  PasetoAuth{KeyRotation: &KeyRotation{Overlap: -time.Second}},
+			storage: storage,
+			expErr:  "invalid key_rotation overlap: '-1s'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.storage = tt.storage
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr != "" {
+				require.ErrorContains(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			require.Len(t, tt.config.keys.current().keys, 1)
+		})
+	}
+
+	t.Run("err/sign_key", func(t *testing.T) {
+		s := &PasetoSign{
+			Key:         paseto.NewV4AsymmetricSecretKey().ExportHex(),
+			KeyRotation: &KeyRotation{},
+			storage:     storage,
+		}
+		require.ErrorContains(t, s.Validate(), "key_rotation can't be used with key or key_password")
+	})
+}
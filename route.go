@@ -0,0 +1,49 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// routeVarKey is the key of the request variable that contains the value of
+// the route claim, i.e. {http.vars.paseto.route}.
+const routeVarKey = "paseto.route"
+
+// routeValue returns the value of the route claim. Since the value is meant to
+// be used in upstream addresses, only letters, digits, '-', '_' and '.' are
+// allowed. A missing or empty claim is an error only if the claim is required.
+func (p *PasetoAuth) routeValue(claims map[string]any) (string, error) {
+	val, _ := getClaim(claims, p.RouteClaim)
+	route := stringify(val)
+	if route == "" {
+		if p.RouteClaimRequired {
+			return "", fmt.Errorf("route claim '%s' is missing", p.RouteClaim)
+		}
+		return "", nil
+	}
+
+	for _, c := range route {
+		if !isRouteChar(c) {
+			return "", fmt.Errorf("route claim '%s' has an invalid value: %q", p.RouteClaim, route)
+		}
+	}
+
+	return route, nil
+}
+
+func isRouteChar(c rune) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' ||
+		c == '-' || c == '_' || c == '.'
+}
+
+// setRequestVars sets the request variables of the authenticated user, which
+// are available to the handlers that run after authentication, e.g. to
+// reverse_proxy upstreams.
+func setRequestVars(r *http.Request, claims map[string]any, user mappedUser) {
+	caddyhttp.SetVar(r.Context(), claimsVarKey, claims)
+	if user.route != "" {
+		caddyhttp.SetVar(r.Context(), routeVarKey, user.route)
+	}
+}
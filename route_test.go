@@ -0,0 +1,95 @@
+package caddypaseto
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateRouteClaim(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	newToken := func(claims map[string]any) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		for key, val := range claims {
+			require.NoError(t, token.Set(key, val))
+		}
+		return token.V4Sign(v4PrivateKey, nil)
+	}
+
+	tests := []struct {
+		name     string
+		claim    string
+		required bool
+		claims   map[string]any
+		expAuth  bool
+		expRoute any
+	}{
+		{
+			name:     "ok/claim",
+			claim:    "region",
+			claims:   map[string]any{"region": "eu-west-1"},
+			expAuth:  true,
+			expRoute: "eu-west-1",
+		},
+		{
+			name:     "ok/nested_claim",
+			claim:    "tenant.shard",
+			required: true,
+			claims:   map[string]any{"tenant": map[string]any{"shard": 7}},
+			expAuth:  true,
+			expRoute: "7",
+		},
+		{
+			name:    "ok/missing_claim",
+			claim:   "region",
+			expAuth: true,
+		},
+		{
+			name:     "err/missing_required_claim",
+			claim:    "region",
+			required: true,
+		},
+		{
+			name:   "err/invalid_value",
+			claim:  "region",
+			claims: map[string]any{"region": "evil.example.com:443/"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:                v4PrivateKey.Public().ExportHex(),
+				FromQuery:          []string{"token"},
+				RouteClaim:         tt.claim,
+				RouteClaimRequired: tt.required,
+				logger:             slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+newToken(tt.claims), nil)
+			ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]any))
+			req = req.WithContext(ctx)
+
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			assert.Equal(t, tt.expRoute, caddyhttp.GetVar(req.Context(), routeVarKey))
+		})
+	}
+}
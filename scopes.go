@@ -0,0 +1,113 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+)
+
+// scopeClaim is the claim of the scopes of a token, as in OAuth 2.0 (RFC 8693,
+// section 4.2).
+const scopeClaim = "scope"
+
+// scopeMethodAny is the RequireScopes key of the methods without their own
+// entry.
+const scopeMethodAny = "*"
+
+// validateRequireScopes validates the RequireScopes methods and scopes.
+func (p *PasetoAuth) validateRequireScopes() error {
+	var errs []error
+	for _, method := range slices.Sorted(maps.Keys(p.RequireScopes)) {
+		if method != scopeMethodAny && (method == "" || method != strings.ToUpper(method) ||
+			strings.ContainsAny(method, " \t,")) {
+			errs = append(errs, fmt.Errorf("invalid require_scopes: invalid method '%s'", method))
+			continue
+		}
+		scopes := p.RequireScopes[method]
+		if len(scopes) == 0 {
+			errs = append(errs, fmt.Errorf("invalid require_scopes '%s': no scopes", method))
+		}
+		for _, scope := range scopes {
+			if !validScope(scope) {
+				errs = append(errs, fmt.Errorf("invalid require_scopes '%s': invalid scope '%s'", method, scope))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// validScope returns true if the scope is non-empty and has no whitespace, so
+// that it can be in a space-delimited "scope" claim.
+func validScope(scope string) bool {
+	return scope != "" && !strings.ContainsAny(scope, " \t")
+}
+
+// requiredScopes returns the RequireScopes scopes of the method. HEAD requests
+// require the scopes of GET, unless HEAD has its own entry, since they return
+// the same headers. Methods without an entry require the scopes of "*", if any.
+func (p *PasetoAuth) requiredScopes(method string) []string {
+	if scopes, ok := p.RequireScopes[method]; ok {
+		return scopes
+	}
+	if method == http.MethodHead {
+		if scopes, ok := p.RequireScopes[http.MethodGet]; ok {
+			return scopes
+		}
+	}
+	return p.RequireScopes[scopeMethodAny]
+}
+
+// requestScopes returns the scopes that the request requires, with its method
+// from the replacer.
+func (p *PasetoAuth) requestScopes(repl *caddy.Replacer) []string {
+	if len(p.RequireScopes) == 0 || repl == nil {
+		return nil
+	}
+	return p.requiredScopes(repl.ReplaceAll("{http.request.method}", ""))
+}
+
+// tokenScopes returns the scopes of the "scope" claim, which can either be a
+// space-delimited string, or an array of strings.
+func tokenScopes(claims map[string]any) ([]string, error) {
+	switch val := claims[scopeClaim].(type) {
+	case string:
+		return strings.Fields(val), nil
+	case []any:
+		scopes := make([]string, 0, len(val))
+		for _, elem := range val {
+			scope, ok := elem.(string)
+			if !ok {
+				return nil, errors.New("scope array contains a non-string value")
+			}
+			scopes = append(scopes, scope)
+		}
+		return scopes, nil
+	case nil:
+		return nil, errors.New("scope is missing")
+	default:
+		return nil, errors.New("scope is not a string or an array of strings")
+	}
+}
+
+// requireScopes checks that the token has all the scopes.
+func requireScopes(scopes []string) paseto.Rule {
+	return func(token paseto.Token) error {
+		have, err := tokenScopes(token.Claims())
+		if err != nil {
+			return err
+		}
+		for _, scope := range scopes {
+			if !slices.Contains(have, scope) {
+				return fmt.Errorf("token is missing required scope '%s'", scope)
+			}
+		}
+		return nil
+	}
+}
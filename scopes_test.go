@@ -0,0 +1,116 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateRequireScopes(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+
+	auth := &PasetoAuth{
+		Key:       key.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		RequireScopes: map[string][]string{
+			"GET":    {"read"},
+			"POST":   {"write"},
+			"DELETE": {"write", "admin"},
+		},
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name    string
+		method  string
+		scope   any
+		expAuth bool
+	}{
+		{name: "ok/string", method: http.MethodGet, scope: "openid read", expAuth: true},
+		{name: "ok/array", method: http.MethodPost, scope: []string{"read", "write"}, expAuth: true},
+		{name: "ok/all", method: http.MethodDelete, scope: "admin write", expAuth: true},
+		{name: "ok/head", method: http.MethodHead, scope: "read", expAuth: true},
+		{name: "ok/unlisted", method: http.MethodPatch, expAuth: true},
+		{name: "err/missing_scope", method: http.MethodPost, scope: "read"},
+		{name: "err/partial", method: http.MethodDelete, scope: "write"},
+		{name: "err/head", method: http.MethodHead, scope: "write"},
+		{name: "err/prefix", method: http.MethodGet, scope: "reader"},
+		{name: "err/missing", method: http.MethodGet},
+		{name: "err/not_a_string", method: http.MethodGet, scope: []any{"read", 1}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token := paseto.NewToken()
+			token.SetIssuedAt(time.Now())
+			token.SetNotBefore(time.Now())
+			token.SetExpiration(time.Now().Add(time.Hour))
+			token.SetSubject("user123")
+			if tt.scope != nil {
+				require.NoError(t, token.Set("scope", tt.scope))
+			}
+
+			req := httptest.NewRequest(tt.method, "/?token="+token.V4Sign(key, nil), nil)
+			caddyhttp.NewTestReplacer(req)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+}
+
+func TestPasetoAuth_RequiredScopes(t *testing.T) {
+	auth := &PasetoAuth{
+		RequireScopes: map[string][]string{
+			"GET":  {"read"},
+			"HEAD": {"meta"},
+			"*":    {"write"},
+		},
+	}
+	assert.Equal(t, []string{"read"}, auth.requiredScopes(http.MethodGet))
+	assert.Equal(t, []string{"meta"}, auth.requiredScopes(http.MethodHead))
+	assert.Equal(t, []string{"write"}, auth.requiredScopes(http.MethodPut))
+
+	auth.RequireScopes = map[string][]string{"POST": {"write"}}
+	assert.Empty(t, auth.requiredScopes(http.MethodHead))
+}
+
+func TestPasetoAuth_ValidateRequireScopes(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name   string
+		scopes map[string][]string
+		expErr string
+	}{
+		{name: "err/lower_case", scopes: map[string][]string{"get": {"read"}}, expErr: "invalid method 'get'"},
+		{name: "err/empty_method", scopes: map[string][]string{"": {"read"}}, expErr: "invalid method ''"},
+		{name: "err/no_scopes", scopes: map[string][]string{"GET": {}}, expErr: "invalid require_scopes 'GET': no scopes"},
+		{
+			name:   "err/invalid_scope",
+			scopes: map[string][]string{"GET": {"read write"}},
+			expErr: "invalid require_scopes 'GET': invalid scope 'read write'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:           key,
+				RequireScopes: tt.scopes,
+				logger:        slog.New(testutil.NewTestLogHandler()),
+			}
+			require.ErrorContains(t, auth.Validate(), tt.expErr)
+		})
+	}
+}
@@ -0,0 +1,119 @@
+package caddypaseto
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// secretKeys is a key document that's stored in a cloud secret manager, e.g.
+// KeyAWS, and fetched periodically. The document is parsed with
+// parseKeyDocument.
+type secretKeys struct {
+	// desc describes the source in errors, e.g. "key_aws".
+	desc     string
+	interval time.Duration
+	timeout  time.Duration
+	// get returns the current document of the secret.
+	get func(ctx context.Context) ([]byte, error)
+
+	mu        sync.Mutex
+	nextCheck time.Time
+	fetching  bool
+	loaded    bool
+	digest    [sha256.Size]byte
+}
+
+// due reports whether the secret should be fetched, and if so, marks it as
+// being fetched, so that only one fetch is in progress at a time.
+func (sk *secretKeys) due(now time.Time) bool {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	if sk.fetching || now.Before(sk.nextCheck) {
+		return false
+	}
+	sk.fetching = true
+	return true
+}
+
+// fetch returns the keys of the secret, and false if the secret hasn't changed
+// since the last successful fetch, as determined by the digest of its
+// document.
+func (sk *secretKeys) fetch(ctx context.Context) ([]string, bool, error) {
+	defer func() {
+		sk.mu.Lock()
+		sk.fetching = false
+		sk.nextCheck = time.Now().Add(sk.interval)
+		sk.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(ctx, sk.timeout)
+	defer cancel()
+	data, err := sk.get(ctx)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed fetching %s keys: %w", sk.desc, err)
+	}
+	keys, err := parseKeyDocument(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("invalid %s keys: %w", sk.desc, err)
+	}
+
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	digest := sha256.Sum256(data)
+	if sk.loaded && digest == sk.digest {
+		return nil, false, nil
+	}
+	sk.loaded, sk.digest = true, digest
+
+	return keys, true, nil
+}
+
+// reset makes the next fetch return the keys, even if they haven't changed.
+// It's used when the keys couldn't be applied.
+func (sk *secretKeys) reset() {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	sk.loaded, sk.digest = false, [sha256.Size]byte{}
+}
+
+// parseSecretEndpoint parses the endpoint URL of a secret manager API, which
+// must be an HTTPS URL, or an HTTP URL of a loopback host, as with KeyURL.
+func parseSecretEndpoint(desc, endpoint string) (*url.URL, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s endpoint: %w", desc, err)
+	}
+	if u.Host == "" || (u.Scheme != "https" && (u.Scheme != "http" || !isLoopback(u.Hostname()))) {
+		return nil, fmt.Errorf("invalid %s endpoint '%s': must be an HTTPS URL, or an HTTP URL of a loopback host",
+			desc, endpoint)
+	}
+
+	return u, nil
+}
+
+// readSecretResponse returns the body of a successful response of a secret
+// manager API, which is at most maxKeyDocumentSize bytes, plus some room for
+// the encoding of the secret. The body of an error response is passed to
+// apiErr, which returns the error of the status and body.
+func readSecretResponse(resp *http.Response, apiErr func(status int, body []byte) error) ([]byte, error) {
+	const maxSize = 2*maxKeyDocumentSize + 1<<12
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed reading response: %w", err)
+	}
+	if len(body) > maxSize {
+		return nil, errors.New("response is too large")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, apiErr(resp.StatusCode, body)
+	}
+
+	return body, nil
+}
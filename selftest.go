@@ -0,0 +1,55 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// selfTestSubject is the subject of the tokens made by selfTestKey.
+const selfTestSubject = "caddy-paseto-self-test"
+
+// selfTestKey makes a round trip with the key, i.e. it encrypts and decrypts a
+// token with a symmetric key, or signs a token with a private key and verifies
+// it with its public key, so that an unusable key is reported when the config
+// is loaded, rather than by the first request. Public keys can't be tested
+// without their private key, so they're skipped.
+func selfTestKey(key *xpaseto.Key, ver paseto.Version, purpose paseto.Purpose) error {
+	if key.Type() == xpaseto.KeyTypePublic {
+		return nil
+	}
+
+	token, err := xpaseto.NewToken(time.Now, xpaseto.ClaimSubject(selfTestSubject))
+	if err != nil {
+		return fmt.Errorf("key self-test failed: %w", err)
+	}
+
+	var tokenStr string
+	verifyKey := key
+	if key.Type() == xpaseto.KeyTypeSymmetric {
+		tokenStr, err = key.Encrypt(token)
+	} else {
+		tokenStr, err = key.Sign(token)
+		if err == nil {
+			verifyKey, err = xpaseto.LoadKey([]byte(publicKeyHex(key.ExportHex(), ver)), ver, purpose,
+				xpaseto.KeyTypePublic)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("key self-test failed: %w", err)
+	}
+
+	parsed, err := xpaseto.ParseToken(verifyKey, tokenStr)
+	if err != nil {
+		return fmt.Errorf("key self-test failed: %w", err)
+	}
+	if sub, _ := parsed.ClaimsRaw()["sub"].(string); sub != selfTestSubject {
+		return errors.New("key self-test failed: the token claims changed in the round trip")
+	}
+
+	return nil
+}
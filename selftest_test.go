@@ -0,0 +1,67 @@
+package caddypaseto
+
+import (
+	"testing"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+func TestSelfTestKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		ver     paseto.Version
+		purpose paseto.Purpose
+		typ     xpaseto.KeyType
+		testVer paseto.Version
+		expErr  string
+	}{
+		{
+			name: "ok/v2_local", key: paseto.NewV2SymmetricKey().ExportHex(),
+			ver: paseto.Version2, purpose: paseto.Local, typ: xpaseto.KeyTypeSymmetric,
+		},
+		{
+			name: "ok/v3_private", key: paseto.NewV3AsymmetricSecretKey().ExportHex(),
+			ver: paseto.Version3, purpose: paseto.Public, typ: xpaseto.KeyTypePrivate,
+		},
+		{
+			name: "ok/v4_local", key: paseto.NewV4SymmetricKey().ExportHex(),
+			ver: paseto.Version4, purpose: paseto.Local, typ: xpaseto.KeyTypeSymmetric,
+		},
+		{
+			name: "ok/v4_private", key: paseto.NewV4AsymmetricSecretKey().ExportHex(),
+			ver: paseto.Version4, purpose: paseto.Public, typ: xpaseto.KeyTypePrivate,
+		},
+		{
+			name: "ok/v4_public_skipped", key: paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+			ver: paseto.Version4, purpose: paseto.Public, typ: xpaseto.KeyTypePublic,
+		},
+		{
+			// The v4 token can't be verified with the derived v2 public key.
+			name: "err/round_trip", key: paseto.NewV4AsymmetricSecretKey().ExportHex(),
+			ver: paseto.Version4, purpose: paseto.Public, typ: xpaseto.KeyTypePrivate, testVer: paseto.Version2,
+			expErr: "key self-test failed: " + xpaseto.ErrKeyTokenProtocolMismatch.Error(),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := xpaseto.LoadKey([]byte(tt.key), tt.ver, tt.purpose, tt.typ)
+			require.NoError(t, err)
+
+			testVer := tt.ver
+			if tt.testVer != "" {
+				testVer = tt.testVer
+			}
+			err = selfTestKey(key, testVer, tt.purpose)
+			if tt.expErr != "" {
+				require.EqualError(t, err, tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+		})
+	}
+}
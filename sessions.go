@@ -0,0 +1,335 @@
+package caddypaseto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// Session is a token session tracked by its "jti" claim.
+type Session struct {
+	ID        string    `json:"jti"`
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer,omitempty"`
+	IssuedAt  time.Time `json:"issued_at,omitzero"`
+	ExpiresAt time.Time `json:"expires_at"`
+	LastSeen  time.Time `json:"last_seen"`
+	Revoked   bool      `json:"revoked"`
+	// Idle is true if the session was unused for longer than the idle timeout.
+	Idle bool `json:"idle"`
+}
+
+// seen records that the session was used at the given time. If the session was
+// idle for longer than idleTimeout, it's marked as idle instead, and its last
+// seen time is left unchanged.
+func (s *Session) seen(now time.Time, idleTimeout time.Duration) {
+	if s.Revoked || s.Idle {
+		return
+	}
+	if idleTimeout > 0 && !s.LastSeen.IsZero() && now.Sub(s.LastSeen) > idleTimeout {
+		s.Idle = true
+		return
+	}
+	s.LastSeen = now
+}
+
+// sessionFilter selects sessions by subject and/or ID, and optionally by the
+// issuer of their token. Empty fields match any session.
+type sessionFilter struct {
+	Subject string `json:"subject"`
+	ID      string `json:"jti"`
+	Issuer  string `json:"issuer"`
+}
+
+func (f sessionFilter) empty() bool {
+	return f.Subject == "" && f.ID == ""
+}
+
+func (f sessionFilter) match(s *Session) bool {
+	return (f.Subject == "" || f.Subject == s.Subject) && (f.ID == "" || f.ID == s.ID) &&
+		(f.Issuer == "" || f.Issuer == s.Issuer)
+}
+
+// sessionStore keeps track of token sessions.
+type sessionStore interface {
+	// Seen records that the session was used at the given time, and returns the
+	// stored session state. If idleTimeout is non-zero, and the stored session
+	// was last seen longer than idleTimeout ago, the session is marked as idle.
+	Seen(ctx context.Context, sess Session, now time.Time, idleTimeout time.Duration) (Session, error)
+	// List returns all sessions that match the filter and haven't expired.
+	List(ctx context.Context, filter sessionFilter, now time.Time) ([]Session, error)
+	// Revoke marks all sessions that match the filter as revoked, and returns
+	// the amount of sessions that were revoked.
+	Revoke(ctx context.Context, filter sessionFilter, now time.Time) (int, error)
+}
+
+// sharedSessions is the session store shared by all module instances, so that
+// sessions are tracked consistently across sites and config reloads.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var sharedSessions sessionStore = newMemorySessionStore()
+
+// sortSessions sorts sessions by the time they were last seen, most recent
+// first.
+func sortSessions(sessions []Session) {
+	slices.SortFunc(sessions, func(a, b Session) int {
+		if c := b.LastSeen.Compare(a.LastSeen); c != 0 {
+			return c
+		}
+		return strings.Compare(a.ID, b.ID)
+	})
+}
+
+// memorySessionStore is an in-memory sessionStore implementation. Sessions are
+// removed after they expire.
+type memorySessionStore struct {
+	mu        sync.Mutex
+	sessions  map[string]*Session
+	lastSweep time.Time
+}
+
+// sessionSweepInterval is the minimum interval between removals of expired
+// sessions.
+const sessionSweepInterval = time.Minute
+
+var _ sessionStore = (*memorySessionStore)(nil)
+
+func newMemorySessionStore() *memorySessionStore {
+	return &memorySessionStore{sessions: make(map[string]*Session)}
+}
+
+// Seen implements the sessionStore interface.
+func (s *memorySessionStore) Seen(
+	_ context.Context, sess Session, now time.Time, idleTimeout time.Duration,
+) (Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(now)
+
+	stored, ok := s.sessions[sess.ID]
+	if !ok {
+		stored = &sess
+		s.sessions[sess.ID] = stored
+	}
+	stored.seen(now, idleTimeout)
+
+	return *stored, nil
+}
+
+// List implements the sessionStore interface.
+func (s *memorySessionStore) List(_ context.Context, filter sessionFilter, now time.Time) ([]Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(now)
+
+	sessions := make([]Session, 0)
+	for _, sess := range s.sessions {
+		if now.Before(sess.ExpiresAt) && filter.match(sess) {
+			sessions = append(sessions, *sess)
+		}
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+// Revoke implements the sessionStore interface.
+func (s *memorySessionStore) Revoke(_ context.Context, filter sessionFilter, now time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire(now)
+
+	var count int
+	for _, sess := range s.sessions {
+		if !sess.Revoked && filter.match(sess) {
+			sess.Revoked = true
+			count++
+		}
+	}
+
+	return count, nil
+}
+
+func (s *memorySessionStore) expire(now time.Time) {
+	if now.Sub(s.lastSweep) < sessionSweepInterval {
+		return
+	}
+	s.lastSweep = now
+
+	for id, sess := range s.sessions {
+		if !now.Before(sess.ExpiresAt) {
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// sessionStoragePrefix is the storage path prefix of session entries.
+const sessionStoragePrefix = "paseto/sessions"
+
+// storageSessionStore is a sessionStore implementation backed by a Caddy
+// storage module, so that sessions can be shared by all Caddy instances that
+// use the same storage. Sessions are stored as JSON documents, one per session,
+// and are removed when they're encountered after they expire.
+//
+// Concurrent updates of the same session are not synchronized, so the last
+// write wins. This is acceptable for last seen times, which are only
+// approximate.
+type storageSessionStore struct {
+	storage certmagic.Storage
+}
+
+var _ sessionStore = (*storageSessionStore)(nil)
+
+func newStorageSessionStore(storage certmagic.Storage) *storageSessionStore {
+	return &storageSessionStore{storage: storage}
+}
+
+// sessionStorageKey returns the storage key of a session. The ID is hashed,
+// since it can contain characters that are invalid in storage keys.
+func sessionStorageKey(id string) string {
+	sum := sha256.Sum256([]byte(id))
+	return path.Join(sessionStoragePrefix, hex.EncodeToString(sum[:]))
+}
+
+// Seen implements the sessionStore interface.
+func (s *storageSessionStore) Seen(
+	ctx context.Context, sess Session, now time.Time, idleTimeout time.Duration,
+) (Session, error) {
+	key := sessionStorageKey(sess.ID)
+	stored, err := s.load(ctx, key)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return Session{}, err
+	}
+	if stored == nil {
+		stored = &sess
+	}
+	stored.seen(now, idleTimeout)
+
+	if err = s.store(ctx, key, stored); err != nil {
+		return Session{}, err
+	}
+
+	return *stored, nil
+}
+
+// List implements the sessionStore interface.
+func (s *storageSessionStore) List(ctx context.Context, filter sessionFilter, now time.Time) ([]Session, error) {
+	sessions := make([]Session, 0)
+	err := s.walk(ctx, now, func(_ string, sess *Session) error {
+		if filter.match(sess) {
+			sessions = append(sessions, *sess)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sortSessions(sessions)
+
+	return sessions, nil
+}
+
+// Revoke implements the sessionStore interface.
+func (s *storageSessionStore) Revoke(ctx context.Context, filter sessionFilter, now time.Time) (int, error) {
+	if filter.ID != "" {
+		key := sessionStorageKey(filter.ID)
+		sess, err := s.load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if sess.Revoked || !filter.match(sess) {
+			return 0, nil
+		}
+		sess.Revoked = true
+		return 1, s.store(ctx, key, sess)
+	}
+
+	var count int
+	err := s.walk(ctx, now, func(key string, sess *Session) error {
+		if sess.Revoked || !filter.match(sess) {
+			return nil
+		}
+		sess.Revoked = true
+		if err := s.store(ctx, key, sess); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// walk calls fn for all stored sessions that haven't expired, and deletes the
+// ones that have.
+func (s *storageSessionStore) walk(ctx context.Context, now time.Time, fn func(string, *Session) error) error {
+	keys, err := s.storage.List(ctx, sessionStoragePrefix, false)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed listing sessions: %w", err)
+	}
+
+	for _, key := range keys {
+		var sess *Session
+		sess, err = s.load(ctx, key)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if !now.Before(sess.ExpiresAt) {
+			if err = s.storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return fmt.Errorf("failed deleting expired session: %w", err)
+			}
+			continue
+		}
+		if err = fn(key, sess); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (s *storageSessionStore) load(ctx context.Context, key string) (*Session, error) {
+	data, err := s.storage.Load(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("failed loading session: %w", err)
+	}
+
+	var sess Session
+	if err = json.Unmarshal(data, &sess); err != nil {
+		return nil, fmt.Errorf("failed decoding session: %w", err)
+	}
+
+	return &sess, nil
+}
+
+func (s *storageSessionStore) store(ctx context.Context, key string, sess *Session) error {
+	data, err := json.Marshal(sess)
+	if err != nil {
+		return fmt.Errorf("failed encoding session: %w", err)
+	}
+	if err = s.storage.Store(ctx, key, data); err != nil {
+		return fmt.Errorf("failed storing session: %w", err)
+	}
+
+	return nil
+}
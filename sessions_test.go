@@ -0,0 +1,88 @@
+package caddypaseto
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) sessionStore{
+		"memory": func(*testing.T) sessionStore {
+			return newMemorySessionStore()
+		},
+		"storage": func(t *testing.T) sessionStore {
+			return newStorageSessionStore(&certmagic.FileStorage{Path: t.TempDir()})
+		},
+	}
+
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			ctx := context.Background()
+			now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+
+			seen := func(id, sub string, exp, now time.Time, idle time.Duration) Session {
+				t.Helper()
+				sess, err := store.Seen(ctx, Session{ID: id, Subject: sub, ExpiresAt: exp}, now, idle)
+				require.NoError(t, err)
+				return sess
+			}
+			listIDs := func(filter sessionFilter, now time.Time) []string {
+				t.Helper()
+				sessions, err := store.List(ctx, filter, now)
+				require.NoError(t, err)
+				ids := []string{}
+				for _, sess := range sessions {
+					ids = append(ids, sess.ID)
+				}
+				return ids
+			}
+			revoke := func(filter sessionFilter) int {
+				t.Helper()
+				n, err := store.Revoke(ctx, filter, now)
+				require.NoError(t, err)
+				return n
+			}
+
+			sessA := seen("a", "alice", now.Add(time.Hour), now, 0)
+			assert.True(t, now.Equal(sessA.LastSeen))
+			seen("b", "alice", now.Add(time.Hour), now.Add(time.Second), 0)
+			seen("c", "bob", now.Add(2*time.Minute), now.Add(2*time.Second), 0)
+			sessA = seen("a", "alice", now.Add(time.Hour), now.Add(3*time.Second), 0)
+			assert.True(t, now.Add(3*time.Second).Equal(sessA.LastSeen))
+
+			assert.Equal(t, []string{"a", "c", "b"}, listIDs(sessionFilter{}, now))
+			assert.Equal(t, []string{"a", "b"}, listIDs(sessionFilter{Subject: "alice"}, now))
+			assert.Equal(t, []string{"c"}, listIDs(sessionFilter{ID: "c"}, now))
+			assert.Empty(t, listIDs(sessionFilter{Subject: "alice", ID: "c"}, now))
+
+			// Sessions can be selected by the issuer of their token.
+			const iss = "https://idp.example.com"
+			_, err := store.Seen(ctx, Session{ID: "d", Subject: "alice", Issuer: iss, ExpiresAt: now.Add(time.Hour)}, now, 0)
+			require.NoError(t, err)
+			assert.Equal(t, []string{"d"}, listIDs(sessionFilter{Issuer: iss}, now))
+			assert.Equal(t, 1, revoke(sessionFilter{Subject: "alice", Issuer: iss}))
+
+			assert.Equal(t, 2, revoke(sessionFilter{Subject: "alice"}))
+			assert.Equal(t, 0, revoke(sessionFilter{ID: "a"}))
+			assert.Equal(t, 0, revoke(sessionFilter{ID: "unknown"}))
+			assert.True(t, seen("a", "alice", now.Add(time.Hour), now, 0).Revoked)
+			assert.False(t, seen("c", "bob", now.Add(2*time.Minute), now, 0).Revoked)
+
+			// Sessions unused for longer than the idle timeout are marked as idle,
+			// and stay idle.
+			sessC := seen("c", "bob", now.Add(2*time.Minute), now.Add(40*time.Second), 30*time.Second)
+			assert.True(t, sessC.Idle)
+			assert.True(t, now.Equal(sessC.LastSeen))
+			assert.True(t, seen("c", "bob", now.Add(2*time.Minute), now.Add(41*time.Second), time.Hour).Idle)
+
+			// Expired sessions are not listed.
+			assert.Equal(t, []string{"a", "b", "d"}, listIDs(sessionFilter{}, now.Add(5*time.Minute)))
+		})
+	}
+}
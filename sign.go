@@ -0,0 +1,416 @@
+package caddypaseto
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/caddyserver/certmagic"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+func init() {
+	caddy.RegisterModule(PasetoSign{})
+}
+
+// Values of PasetoSign.Target.
+const (
+	signTargetResponse = "response"
+	signTargetRequest  = "request"
+)
+
+// PasetoSign is an HTTP handler that signs HTTP message bodies with a PASETO
+// token set in a header. The token contains a SHA-256 digest of the body, the
+// time it was signed, and the target audience, so that recipients can verify
+// the authenticity of the message using the same key infrastructure as
+// pasetoauth.
+//
+// It can sign either outgoing responses, or requests passed to the next
+// handler, e.g. webhook deliveries proxied with reverse_proxy. Responses are
+// buffered to be signed, except for streamed responses, i.e. server-sent
+// events and protocol upgrades, which are passed through unsigned.
+type PasetoSign struct {
+	// Key is the key used to sign or encrypt the tokens. It must be the private
+	// key if `purpose` is 'public', or the symmetric key if `purpose` is 'local'.
+	// It can be specified as a hex, PEM or PASERK encoded string, and can
+	// contain global placeholders, e.g. `{env.PASETO_SIGNING_KEY}`, which are
+	// resolved when the module is provisioned.
+	Key string `json:"key"`
+
+	// KeyPassword is the password of Key, if it's a password-wrapped PASERK
+	// key, e.g. "k3.secret-pw.<data>". It should be set with a placeholder,
+	// e.g. `{env.PASETO_KEY_PASSWORD}`, which is resolved when the module is
+	// provisioned.
+	KeyPassword string `json:"key_password,omitempty"`
+
+	// KeyRotation signs or encrypts the tokens with the active key of a key
+	// rotation, instead of Key. The storage is checked for new keys in the
+	// background. pasetoauth providers with the same key rotation verify or
+	// decrypt the tokens.
+	KeyRotation *KeyRotation `json:"key_rotation,omitempty"`
+
+	// Purpose is the PASETO protocol purpose. The default is 'public'.
+	Purpose paseto.Purpose `json:"purpose"`
+
+	// Version is the PASETO protocol version. The default is 4.
+	Version paseto.Version `json:"version"`
+
+	// Target is the HTTP message to sign. It can either be 'response' or
+	// 'request'. The default is 'response'.
+	Target string `json:"target"`
+
+	// Header is the name of the header the token is set in. The default is
+	// "Paseto-Signature".
+	Header string `json:"header"`
+
+	// Audience is the value of the "aud" claim, i.e. the intended recipient of
+	// the message. It can contain placeholders.
+	Audience string `json:"audience"`
+
+	// Issuer is the value of the "iss" claim. It can contain placeholders.
+	Issuer string `json:"issuer"`
+
+	// Lifetime is the duration for which the token is valid. The default is 5m.
+	Lifetime time.Duration `json:"lifetime"`
+
+	// MaxBodySize is the maximum size of bodies in bytes that will be signed.
+	// Larger requests are rejected with a 413 status, and larger responses are
+	// passed through unsigned, with a logged warning. The default is 10MiB.
+	MaxBodySize int64 `json:"max_body_size"`
+
+	key      *xpaseto.Key
+	rotation *keyRotator
+	storage  certmagic.Storage
+	logger   *slog.Logger
+	ctx      context.Context
+}
+
+var (
+	_ caddy.Provisioner           = (*PasetoSign)(nil)
+	_ caddy.Validator             = (*PasetoSign)(nil)
+	_ caddyhttp.MiddlewareHandler = (*PasetoSign)(nil)
+)
+
+// CaddyModule returns the Caddy module information.
+func (PasetoSign) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.paseto_sign",
+		New: func() caddy.Module { return new(PasetoSign) },
+	}
+}
+
+// Provision sets up the module.
+func (s *PasetoSign) Provision(ctx caddy.Context) error {
+	s.ctx = ctx
+	s.logger = ctx.Slogger()
+	if s.KeyRotation != nil {
+		s.storage = ctx.Storage()
+	}
+
+	repl := caddy.NewReplacer()
+	var err error
+	if s.Key, err = resolveKey(repl, "key", s.Key); err != nil {
+		return err
+	}
+	s.KeyPassword, err = resolveKey(repl, "key password", s.KeyPassword)
+	return err
+}
+
+// Validate validates that the module has a usable config, and initializes
+// defaults and internal values.
+func (s *PasetoSign) Validate() error {
+	if s.Version == "" {
+		s.Version = paseto.Version4
+	} else if !slices.Contains([]paseto.Version{paseto.Version2, paseto.Version3, paseto.Version4}, s.Version) {
+		return fmt.Errorf("invalid version: '%s'", s.Version)
+	}
+
+	if s.Purpose == "" {
+		s.Purpose = paseto.Public
+	} else if !slices.Contains([]paseto.Purpose{paseto.Local, paseto.Public}, s.Purpose) {
+		return fmt.Errorf("invalid purpose: '%s'", s.Purpose)
+	}
+
+	if s.Target == "" {
+		s.Target = signTargetResponse
+	} else if !slices.Contains([]string{signTargetResponse, signTargetRequest}, s.Target) {
+		return fmt.Errorf("invalid target: '%s'", s.Target)
+	}
+
+	if s.Header == "" {
+		s.Header = "Paseto-Signature"
+	}
+
+	if s.Lifetime == 0 {
+		s.Lifetime = 5 * time.Minute
+	}
+
+	if s.MaxBodySize == 0 {
+		s.MaxBodySize = 10 << 20
+	}
+
+	if s.KeyRotation != nil {
+		return s.provisionKeyRotation()
+	}
+
+	keyType := xpaseto.KeyTypePrivate
+	if s.Purpose == paseto.Local {
+		keyType = xpaseto.KeyTypeSymmetric
+	}
+
+	var err error
+	if s.key, err = loadKey(s.Key, s.KeyPassword, s.Version, s.Purpose, keyType); err != nil {
+		return err
+	}
+
+	return selfTestKey(s.key, s.Version, s.Purpose)
+}
+
+// provisionKeyRotation loads the rotated keys, generating the first key if
+// there are none.
+func (s *PasetoSign) provisionKeyRotation() error {
+	if s.Key != "" || s.KeyPassword != "" {
+		return fmt.Errorf("key_rotation can't be used with key or key_password")
+	}
+	var err error
+	if s.rotation, err = newKeyRotator(s.KeyRotation, s.storage, s.Version, s.Purpose, s.logger); err != nil {
+		return err
+	}
+	_, _, err = s.rotation.sync(s.moduleContext(), time.Now())
+
+	return err
+}
+
+// signingKey returns the key used to sign or encrypt the tokens, and checks
+// the storage for new rotated keys in the background.
+func (s *PasetoSign) signingKey(now time.Time) (*xpaseto.Key, error) {
+	if s.rotation == nil {
+		return s.key, nil
+	}
+	if s.rotation.due(now) {
+		go func() {
+			if _, _, err := s.rotation.sync(s.moduleContext(), time.Now()); err != nil {
+				s.logger.Warn(err.Error(), "key_rotation", s.KeyRotation.Name)
+			}
+		}()
+	}
+
+	return s.rotation.signingKey(now)
+}
+
+// moduleContext returns the context of the module lifetime, or a background
+// context if the module wasn't provisioned, e.g. in tests.
+func (s *PasetoSign) moduleContext() context.Context {
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// ServeHTTP signs the request or response body, depending on the target.
+func (s *PasetoSign) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	repl := getReplacer(r)
+
+	if s.Target == signTargetRequest {
+		body, err := io.ReadAll(io.LimitReader(r.Body, s.MaxBodySize+1))
+		if err != nil {
+			return caddyhttp.Error(http.StatusBadRequest, fmt.Errorf("failed reading request body: %w", err))
+		}
+		if int64(len(body)) > s.MaxBodySize {
+			return caddyhttp.Error(http.StatusRequestEntityTooLarge, fmt.Errorf("request body is too large"))
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		token, err := s.sign(body, repl)
+		if err != nil {
+			return caddyhttp.Error(http.StatusInternalServerError, err)
+		}
+		r.Header.Set(s.Header, token)
+
+		//nolint:wrapcheck // handler errors are propagated as is
+		return next.ServeHTTP(w, r)
+	}
+
+	rec := &signRecorder{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		maxSize:               s.MaxBodySize,
+	}
+	if err := next.ServeHTTP(rec, r); err != nil {
+		//nolint:wrapcheck // handler errors are propagated as is
+		return err
+	}
+	if rec.overflowed {
+		s.logger.Warn("response body exceeds max_body_size, passed through unsigned",
+			"max_body_size", s.MaxBodySize, "uri", r.RequestURI)
+	}
+	if rec.stream {
+		return nil
+	}
+
+	token, err := s.sign(rec.buf.Bytes(), repl)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	rec.Header().Set(s.Header, token)
+
+	//nolint:wrapcheck // handler errors are propagated as is
+	return rec.writeResponse()
+}
+
+// signRecorder buffers a response, up to maxSize bytes, so that it can be
+// signed. Server-sent events, protocol upgrades, and responses larger than
+// maxSize are streamed to the client instead.
+type signRecorder struct {
+	*caddyhttp.ResponseWriterWrapper
+	buf     bytes.Buffer
+	maxSize int64
+	status  int
+	// stream is true if the response is passed through unsigned.
+	stream bool
+	// overflowed is true if the response is streamed because it's larger
+	// than maxSize.
+	overflowed bool
+}
+
+// WriteHeader records the status of the response, or writes it if the response
+// is streamed. Informational responses are always written.
+func (rec *signRecorder) WriteHeader(status int) {
+	if rec.status != 0 {
+		return
+	}
+	if status < http.StatusOK {
+		if status == http.StatusSwitchingProtocols {
+			rec.status = status
+			rec.stream = true
+		}
+		rec.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	rec.status = status
+
+	mediaType, _, _ := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	size, err := strconv.ParseInt(rec.Header().Get("Content-Length"), 10, 64)
+	switch {
+	case mediaType == "text/event-stream":
+		_ = rec.startStream()
+	case err == nil && size > rec.maxSize:
+		rec.overflowed = true
+		_ = rec.startStream()
+	}
+}
+
+// Write buffers the data, or writes it if the response is streamed.
+func (rec *signRecorder) Write(data []byte) (int, error) {
+	rec.WriteHeader(http.StatusOK)
+	if !rec.stream && int64(rec.buf.Len()+len(data)) > rec.maxSize {
+		rec.overflowed = true
+		if err := rec.startStream(); err != nil {
+			return 0, err
+		}
+	}
+	if rec.stream {
+		//nolint:wrapcheck // errors of the client connection are propagated as is
+		return rec.ResponseWriterWrapper.Write(data)
+	}
+
+	//nolint:wrapcheck // bytes.Buffer doesn't return errors
+	return rec.buf.Write(data)
+}
+
+// ReadFrom reads the data with Write, so that it's buffered, and not passed to
+// the wrapped ResponseWriter.
+func (rec *signRecorder) ReadFrom(r io.Reader) (int64, error) {
+	//nolint:wrapcheck // errors are propagated as is
+	return io.Copy(struct{ io.Writer }{rec}, r)
+}
+
+// FlushError flushes the response if it's streamed. Flushes of buffered
+// responses are suppressed, as by Caddy's response recorder.
+func (rec *signRecorder) FlushError() error {
+	if !rec.stream {
+		return nil
+	}
+
+	//nolint:wrapcheck // errors of the client connection are propagated as is
+	return http.NewResponseController(rec.ResponseWriterWrapper).Flush()
+}
+
+// startStream writes the header and the buffered data, so that the rest of the
+// response is passed through.
+func (rec *signRecorder) startStream() error {
+	rec.stream = true
+	rec.ResponseWriterWrapper.WriteHeader(rec.status)
+	if rec.buf.Len() == 0 {
+		return nil
+	}
+	_, err := rec.ResponseWriterWrapper.Write(rec.buf.Bytes())
+	rec.buf.Reset()
+
+	//nolint:wrapcheck // errors of the client connection are propagated as is
+	return err
+}
+
+// writeResponse writes the buffered response.
+func (rec *signRecorder) writeResponse() error {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	rec.ResponseWriterWrapper.WriteHeader(rec.status)
+	_, err := rec.ResponseWriterWrapper.Write(rec.buf.Bytes())
+
+	//nolint:wrapcheck // errors of the client connection are propagated as is
+	return err
+}
+
+// sign returns a token with the digest of body, and the configured claims.
+func (s *PasetoSign) sign(body []byte, repl *caddy.Replacer) (string, error) {
+	digest := sha256.Sum256(body)
+	now := time.Now()
+	claims := []xpaseto.Claim{
+		xpaseto.ClaimIssuedAt(now),
+		xpaseto.ClaimNotBefore(now),
+		xpaseto.ClaimExpiration(now.Add(s.Lifetime)),
+		xpaseto.NewClaim("body_sha256", "Body SHA-256", base64.RawURLEncoding.EncodeToString(digest[:])),
+	}
+	if aud := repl.ReplaceAll(s.Audience, ""); aud != "" {
+		claims = append(claims, xpaseto.ClaimAudience(aud))
+	}
+	if iss := repl.ReplaceAll(s.Issuer, ""); iss != "" {
+		claims = append(claims, xpaseto.ClaimIssuer(iss))
+	}
+
+	token, err := xpaseto.NewToken(func() time.Time { return now }, claims...)
+	if err != nil {
+		return "", fmt.Errorf("failed creating token: %w", err)
+	}
+
+	key, err := s.signingKey(now)
+	if err != nil {
+		return "", err
+	}
+
+	var out string
+	if s.Purpose == paseto.Local {
+		out, err = key.Encrypt(token)
+	} else {
+		out, err = key.Sign(token)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed signing token: %w", err)
+	}
+
+	return out, nil
+}
@@ -0,0 +1,273 @@
+package caddypaseto
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoSign_ServeHTTP(t *testing.T) {
+	privateKey := paseto.NewV4AsymmetricSecretKey()
+	publicKey := privateKey.Public()
+
+	body := `{"event":"deploy"}`
+	digest := sha256.Sum256([]byte(body))
+	expDigest := base64.RawURLEncoding.EncodeToString(digest[:])
+
+	parse := func(t *testing.T, tokenStr string) *paseto.Token {
+		t.Helper()
+		parser := paseto.NewParser()
+		parser.AddRule(paseto.ForAudience("https://hooks.example.com"))
+		token, err := parser.ParseV4Public(publicKey, tokenStr, nil)
+		require.NoError(t, err)
+		return token
+	}
+
+	t.Run("ok/response", func(t *testing.T) {
+		s := &PasetoSign{
+			Key:      privateKey.ExportHex(),
+			Audience: "https://hooks.example.com",
+		}
+		require.NoError(t, s.Validate())
+
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			w.Header().Set("Content-Type", "application/json")
+			_, err := io.WriteString(w, body)
+			return err
+		})
+
+		rec := httptest.NewRecorder()
+		err := s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil), next)
+		require.NoError(t, err)
+		assert.Equal(t, body, rec.Body.String())
+
+		token := parse(t, rec.Header().Get("Paseto-Signature"))
+		gotDigest, err := token.GetString("body_sha256")
+		require.NoError(t, err)
+		assert.Equal(t, expDigest, gotDigest)
+
+		exp, err := token.GetExpiration()
+		require.NoError(t, err)
+		assert.WithinDuration(t, time.Now().Add(5*time.Minute), exp, time.Minute)
+	})
+
+	t.Run("ok/response_too_large", func(t *testing.T) {
+		logHandler := testutil.NewTestLogHandler()
+		s := &PasetoSign{
+			Key:         privateKey.ExportHex(),
+			MaxBodySize: 8,
+			logger:      slog.New(logHandler),
+		}
+		require.NoError(t, s.Validate())
+
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			// The body is written in parts, so that it exceeds the limit once
+			// part of it is buffered.
+			for _, part := range []string{body[:6], body[6:]} {
+				if _, err := io.WriteString(w, part); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+
+		rec := httptest.NewRecorder()
+		err := s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil), next)
+		require.NoError(t, err)
+		assert.Equal(t, body, rec.Body.String())
+		assert.Empty(t, rec.Header().Get("Paseto-Signature"))
+		assert.True(t, logHandler.HasRecord(slog.LevelWarn, "response body exceeds max_body_size, passed through unsigned"))
+	})
+
+	t.Run("ok/response_content_length_too_large", func(t *testing.T) {
+		logHandler := testutil.NewTestLogHandler()
+		s := &PasetoSign{
+			Key:         privateKey.ExportHex(),
+			MaxBodySize: 8,
+			logger:      slog.New(logHandler),
+		}
+		require.NoError(t, s.Validate())
+
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+			w.WriteHeader(http.StatusCreated)
+			_, err := io.WriteString(w, body)
+			return err
+		})
+
+		rec := httptest.NewRecorder()
+		err := s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil), next)
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusCreated, rec.Code)
+		assert.Equal(t, body, rec.Body.String())
+		assert.Empty(t, rec.Header().Get("Paseto-Signature"))
+		assert.True(t, logHandler.HasRecord(slog.LevelWarn, "response body exceeds max_body_size, passed through unsigned"))
+	})
+
+	t.Run("ok/event_stream", func(t *testing.T) {
+		logHandler := testutil.NewTestLogHandler()
+		s := &PasetoSign{
+			Key:    privateKey.ExportHex(),
+			logger: slog.New(logHandler),
+		}
+		require.NoError(t, s.Validate())
+
+		rec := httptest.NewRecorder()
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			w.Header().Set("Content-Type", "text/event-stream")
+			if _, err := io.WriteString(w, "data: 1\n\n"); err != nil {
+				return err
+			}
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				return err
+			}
+			// The event is sent before the response ends.
+			assert.Equal(t, "data: 1\n\n", rec.Body.String())
+			assert.True(t, rec.Flushed)
+			return nil
+		})
+
+		err := s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil), next)
+		require.NoError(t, err)
+		assert.Empty(t, rec.Header().Get("Paseto-Signature"))
+		assert.False(t, logHandler.HasRecord(slog.LevelWarn, "response body exceeds max_body_size, passed through unsigned"))
+	})
+
+	t.Run("ok/response_flushed", func(t *testing.T) {
+		s := &PasetoSign{Key: privateKey.ExportHex()}
+		require.NoError(t, s.Validate())
+
+		rec := httptest.NewRecorder()
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) error {
+			// Flushes of buffered responses, e.g. by reverse_proxy, are
+			// suppressed, so that the response is still signed.
+			if _, err := io.WriteString(w, body); err != nil {
+				return err
+			}
+			if err := http.NewResponseController(w).Flush(); err != nil {
+				return err
+			}
+			assert.False(t, rec.Flushed)
+			return nil
+		})
+
+		err := s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil), next)
+		require.NoError(t, err)
+		assert.Equal(t, body, rec.Body.String())
+		assert.NotEmpty(t, rec.Header().Get("Paseto-Signature"))
+	})
+
+	t.Run("ok/request", func(t *testing.T) {
+		s := &PasetoSign{
+			Key:      privateKey.ExportHex(),
+			Target:   signTargetRequest,
+			Header:   "X-Signature",
+			Audience: "https://hooks.example.com",
+		}
+		require.NoError(t, s.Validate())
+
+		var gotBody, gotToken string
+		next := caddyhttp.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) error {
+			data, err := io.ReadAll(r.Body)
+			gotBody = string(data)
+			gotToken = r.Header.Get("X-Signature")
+			return err
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		err := s.ServeHTTP(httptest.NewRecorder(), req, next)
+		require.NoError(t, err)
+		assert.Equal(t, body, gotBody)
+
+		token := parse(t, gotToken)
+		gotDigest, err := token.GetString("body_sha256")
+		require.NoError(t, err)
+		assert.Equal(t, expDigest, gotDigest)
+	})
+
+	t.Run("err/request_too_large", func(t *testing.T) {
+		s := &PasetoSign{
+			Key:         privateKey.ExportHex(),
+			Target:      signTargetRequest,
+			MaxBodySize: 4,
+		}
+		require.NoError(t, s.Validate())
+
+		next := caddyhttp.HandlerFunc(func(http.ResponseWriter, *http.Request) error {
+			t.Fatal("next handler called")
+			return nil
+		})
+
+		req := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+		err := s.ServeHTTP(httptest.NewRecorder(), req, next)
+		var handlerErr caddyhttp.HandlerError
+		require.ErrorAs(t, err, &handlerErr)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, handlerErr.StatusCode)
+	})
+}
+
+func TestPasetoSign_Validate(t *testing.T) {
+	privateKey := paseto.NewV4AsymmetricSecretKey()
+
+	tests := []struct {
+		name   string
+		sign   *PasetoSign
+		expErr string
+	}{
+		{
+			name: "ok/defaults",
+			sign: &PasetoSign{Key: privateKey.ExportHex()},
+		},
+		{
+			name: "ok/local",
+			sign: &PasetoSign{Key: paseto.NewV4SymmetricKey().ExportHex(), Purpose: paseto.Local},
+		},
+		{
+			name: "ok/paserk_secret_key",
+			sign: &PasetoSign{Key: "k4.secret." + base64.RawURLEncoding.EncodeToString(privateKey.ExportBytes())},
+		},
+		{
+			name:   "err/public_key",
+			sign:   &PasetoSign{Key: privateKey.Public().ExportHex()},
+			expErr: "failed loading key data",
+		},
+		{
+			name:   "err/paserk_public_key",
+			sign:   &PasetoSign{Key: "k4.public." + base64.RawURLEncoding.EncodeToString(privateKey.Public().ExportBytes())},
+			expErr: "PASERK key is a public key, but a secret key is required to sign tokens",
+		},
+		{
+			name:   "err/target",
+			sign:   &PasetoSign{Key: privateKey.ExportHex(), Target: "both"},
+			expErr: "invalid target: 'both'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.sign.Validate()
+			if tt.expErr != "" {
+				require.Error(t, err)
+				assert.Contains(t, err.Error(), tt.expErr)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, signTargetResponse, tt.sign.Target)
+			assert.Equal(t, "Paseto-Signature", tt.sign.Header)
+		})
+	}
+}
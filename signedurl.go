@@ -0,0 +1,128 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+)
+
+// Request components of the SignedURL mode, which are also the names of the
+// claims they're bound with.
+const (
+	signedURLPath   = "path"
+	signedURLMethod = "method"
+	signedURLQuery  = "query"
+)
+
+// SignedURL binds tokens to the URL of the request, for short-lived links, e.g.
+// downloads. The token carries the request path, and optionally the method and
+// query string, in claims, so that it can't be used with other URLs.
+type SignedURL struct {
+	// Bind is the list of request components that the token is bound to, i.e.
+	// "path", "method" and "query". Tokens must have a claim with the same
+	// name for each of them:
+	//
+	//   - path: the request path, e.g. "/files/report.pdf". A value ending in
+	//     "*" matches all paths with its prefix, e.g. "/files/*". The request
+	//     path is cleaned before it's matched.
+	//   - method: the request method, or an array of methods.
+	//   - query: the query string, without the token parameters of FromQuery.
+	//     The parameters are compared regardless of their order.
+	//
+	// The path is always bound, and the default is ["path"].
+	Bind []string `json:"bind,omitempty"`
+}
+
+func (su *SignedURL) provision() error {
+	if !slices.Contains(su.Bind, signedURLPath) {
+		su.Bind = append([]string{signedURLPath}, su.Bind...)
+	}
+	for _, component := range su.Bind {
+		if !slices.Contains([]string{signedURLPath, signedURLMethod, signedURLQuery}, component) {
+			return fmt.Errorf("invalid signed_url: unknown request component '%s'", component)
+		}
+	}
+
+	return nil
+}
+
+// verify checks that the request URL matches the URL claims of the token.
+// tokenParams are the query string parameters that can carry the token.
+func (su *SignedURL) verify(r *http.Request, claims map[string]any, tokenParams []string) error {
+	for _, component := range su.Bind {
+		claim, ok := claims[component]
+		if !ok {
+			return fmt.Errorf("token is not bound to a URL: missing %s claim", component)
+		}
+
+		var match bool
+		switch component {
+		case signedURLPath:
+			match = matchSignedPath(claim, r.URL.Path)
+		case signedURLMethod:
+			match = matchSignedMethod(claim, r.Method)
+		case signedURLQuery:
+			match = matchSignedQuery(claim, r.URL.Query(), tokenParams)
+		}
+		if !match {
+			return fmt.Errorf("request %s doesn't match the token", component)
+		}
+	}
+
+	return nil
+}
+
+// matchSignedPath reports whether the request path matches the path claim. The
+// request path is cleaned first, since Caddy doesn't clean it, and the next
+// handlers resolve dot segments, so that e.g. "/files/../admin" can't match a
+// "/files/*" claim.
+func matchSignedPath(claim any, reqPath string) bool {
+	want, _ := claim.(string)
+	reqPath = cleanRequestPath(reqPath)
+	if prefix, ok := strings.CutSuffix(want, "*"); ok {
+		return strings.HasPrefix(reqPath, prefix)
+	}
+	return want != "" && want == reqPath
+}
+
+// cleanRequestPath returns the request path with its dot segments resolved,
+// and its duplicate slashes merged, keeping a trailing slash.
+func cleanRequestPath(reqPath string) string {
+	cleaned := path.Clean("/" + reqPath)
+	if strings.HasSuffix(reqPath, "/") && cleaned != "/" {
+		cleaned += "/"
+	}
+	return cleaned
+}
+
+func matchSignedMethod(claim any, method string) bool {
+	switch want := claim.(type) {
+	case string:
+		return strings.EqualFold(want, method)
+	case []any:
+		return slices.ContainsFunc(want, func(val any) bool {
+			m, _ := val.(string)
+			return strings.EqualFold(m, method)
+		})
+	}
+	return false
+}
+
+func matchSignedQuery(claim any, query url.Values, tokenParams []string) bool {
+	raw, ok := claim.(string)
+	if !ok {
+		return false
+	}
+	want, err := url.ParseQuery(strings.TrimPrefix(raw, "?"))
+	if err != nil {
+		return false
+	}
+	for _, name := range tokenParams {
+		query.Del(name)
+	}
+	// Encode sorts the parameters by name.
+	return want.Encode() == query.Encode()
+}
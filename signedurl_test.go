@@ -0,0 +1,163 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_SignedURL(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	newToken := func(claims map[string]any) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Minute))
+		token.SetSubject("user123")
+		for name, val := range claims {
+			require.NoError(t, token.Set(name, val))
+		}
+		return token.V4Sign(key, nil)
+	}
+
+	auth := &PasetoAuth{
+		Key:       key.Public().ExportHex(),
+		FromQuery: []string{"token"},
+		SignedURL: &SignedURL{Bind: []string{"method", "query"}},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	assert.Equal(t, []string{"path", "method", "query"}, auth.SignedURL.Bind)
+
+	claims := map[string]any{"path": "/files/report.pdf", "method": "GET", "query": "size=large&format=pdf"}
+	prefixClaims := map[string]any{"path": "/files/*", "method": []string{"GET", "HEAD"}, "query": ""}
+
+	tests := []struct {
+		name    string
+		claims  map[string]any
+		method  string
+		target  string
+		expAuth bool
+	}{
+		{
+			name:    "ok",
+			claims:  claims,
+			method:  http.MethodGet,
+			target:  "/files/report.pdf?format=pdf&size=large",
+			expAuth: true,
+		},
+		{
+			name:    "ok/prefix",
+			claims:  prefixClaims,
+			method:  http.MethodHead,
+			target:  "/files/2024/summary.pdf",
+			expAuth: true,
+		},
+		{
+			name:   "err/other_path",
+			claims: claims,
+			method: http.MethodGet,
+			target: "/files/other.pdf?format=pdf&size=large",
+		},
+		{
+			name:   "err/other_method",
+			claims: claims,
+			method: http.MethodPost,
+			target: "/files/report.pdf?format=pdf&size=large",
+		},
+		{
+			name:   "err/other_query",
+			claims: claims,
+			method: http.MethodGet,
+			target: "/files/report.pdf?format=pdf&size=small",
+		},
+		{
+			name:   "err/outside_prefix",
+			claims: prefixClaims,
+			method: http.MethodGet,
+			target: "/private/summary.pdf",
+		},
+		{
+			name:    "ok/dot_segments",
+			claims:  claims,
+			method:  http.MethodGet,
+			target:  "/files/2024/../report.pdf?format=pdf&size=large",
+			expAuth: true,
+		},
+		{
+			name:   "err/traversal",
+			claims: prefixClaims,
+			method: http.MethodGet,
+			target: "/files/../admin/secret",
+		},
+		{
+			name:   "err/encoded_traversal",
+			claims: prefixClaims,
+			method: http.MethodGet,
+			target: "/files/%2e%2e/admin/secret",
+		},
+		{
+			name:   "err/double_slash_traversal",
+			claims: prefixClaims,
+			method: http.MethodGet,
+			target: "/files//..//admin/secret",
+		},
+		{
+			name:   "err/missing_claim",
+			claims: map[string]any{"path": "/files/report.pdf"},
+			method: http.MethodGet,
+			target: "/files/report.pdf",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			target, err := url.Parse(tt.target)
+			require.NoError(t, err)
+			query := target.Query()
+			query.Add("token", newToken(tt.claims))
+			target.RawQuery = query.Encode()
+
+			req := httptest.NewRequest(tt.method, target.String(), nil)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+
+	invalid := &PasetoAuth{
+		Key:       key.Public().ExportHex(),
+		SignedURL: &SignedURL{Bind: []string{"host"}},
+		logger:    slog.New(testutil.NewTestLogHandler()),
+	}
+	require.ErrorContains(t, invalid.Validate(), "invalid signed_url: unknown request component 'host'")
+}
+
+func TestCleanRequestPath(t *testing.T) {
+	tests := []struct {
+		path string
+		exp  string
+	}{
+		{path: "/files/report.pdf", exp: "/files/report.pdf"},
+		{path: "/files/", exp: "/files/"},
+		{path: "/files/../admin/", exp: "/admin/"},
+		{path: "/files//./report.pdf", exp: "/files/report.pdf"},
+		{path: "/../../etc/passwd", exp: "/etc/passwd"},
+		{path: "", exp: "/"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			assert.Equal(t, tt.exp, cleanRequestPath(tt.path))
+		})
+	}
+}
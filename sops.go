@@ -0,0 +1,69 @@
+package caddypaseto
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// KeyFileSOPS decrypts KeyFile with SOPS (https://getsops.io), so that the key
+// is never stored in plaintext on disk. The file is decrypted by running
+// `sops --decrypt` when the module is provisioned, and whenever the file
+// changes, with the same environment as Caddy, so the age identities or the
+// cloud KMS credentials are configured as for sops itself, e.g. with
+// $SOPS_AGE_KEY_FILE. The decrypted key is only kept in memory.
+type KeyFileSOPS struct {
+	// Extract is the path of the key in the decrypted document, in the syntax
+	// of the sops --extract flag, e.g. `["paseto"]["key"]`. By default, the
+	// whole decrypted file is the key, as with files encrypted with
+	// `sops --encrypt --input-type binary`.
+	Extract string `json:"extract,omitempty"`
+
+	// Command is the path of the sops binary. The default is "sops", which is
+	// looked up in $PATH.
+	Command string `json:"command,omitempty"`
+
+	// Timeout is the maximum duration of the decryption, which can include
+	// remote KMS calls. The default is 30s.
+	Timeout time.Duration `json:"timeout,omitempty"`
+}
+
+func (ks *KeyFileSOPS) provision() error {
+	if ks.Command == "" {
+		ks.Command = "sops"
+	}
+	if ks.Timeout < 0 {
+		return fmt.Errorf("invalid key_file_sops: negative timeout: '%s'", ks.Timeout)
+	} else if ks.Timeout == 0 {
+		ks.Timeout = 30 * time.Second
+	}
+
+	return nil
+}
+
+// decrypt returns the decrypted contents of the file at path.
+func (ks *KeyFileSOPS) decrypt(ctx context.Context, path string) ([]byte, error) {
+	args := []string{"--decrypt"}
+	if ks.Extract != "" {
+		args = append(args, "--extract", ks.Extract)
+	}
+	args = append(args, path)
+
+	ctx, cancel := context.WithTimeout(ctx, ks.Timeout)
+	defer cancel()
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, ks.Command, args...) //nolint:gosec // The command is from the configuration.
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("failed decrypting key file with sops: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("failed decrypting key file with sops: %w", err)
+	}
+
+	return out, nil
+}
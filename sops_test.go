@@ -0,0 +1,130 @@
+package caddypaseto
+
+import (
+	"encoding/base64"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+// writeFakeSOPS writes a script that stands in for sops: it records its
+// arguments, and "decrypts" the file in its last argument by decoding it from
+// base64.
+func writeFakeSOPS(t *testing.T, dir string) (string, string) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake sops command is a shell script")
+	}
+
+	argsPath := filepath.Join(dir, "sops.args")
+	script := "#!/bin/sh\n" +
+		`echo "$@" > '` + argsPath + "'\n" +
+		`for last; do :; done` + "\n" +
+		`if ! base64 -d "$last" 2>/dev/null; then echo "Error: sops metadata not found" >&2; exit 1; fi` + "\n"
+	path := filepath.Join(dir, "sops")
+	require.NoError(t, os.WriteFile(path, []byte(script), 0o700)) //nolint:gosec // The script must be executable.
+
+	return path, argsPath
+}
+
+func TestPasetoAuth_KeyFileSOPS(t *testing.T) {
+	dir := t.TempDir()
+	command, argsPath := writeFakeSOPS(t, dir)
+
+	key := paseto.NewV4AsymmetricSecretKey()
+	keyPath := filepath.Join(dir, "paseto.key.enc")
+	encrypt := func(k paseto.V4AsymmetricSecretKey) {
+		data := base64.StdEncoding.EncodeToString([]byte(k.Public().ExportHex()))
+		require.NoError(t, os.WriteFile(keyPath, []byte(data), 0o600))
+	}
+	encrypt(key)
+
+	auth := &PasetoAuth{
+		KeyFile:         keyPath,
+		KeyFileCheck:    keyFileCheckContent,
+		KeyFileInterval: time.Millisecond,
+		KeyFileSOPS:     &KeyFileSOPS{Command: command, Extract: `["paseto"]["key"]`},
+		FromQuery:       []string{"token"},
+		logger:          slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+	assert.Equal(t, 30*time.Second, auth.KeyFileSOPS.Timeout)
+
+	args, err := os.ReadFile(argsPath)
+	require.NoError(t, err)
+	assert.Equal(t, `--decrypt --extract ["paseto"]["key"] `+keyPath+"\n", string(args))
+
+	authenticate := func(k paseto.V4AsymmetricSecretKey) bool {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		req := httptest.NewRequest(http.MethodGet, "/?token="+token.V4Sign(k, nil), nil)
+		_, authenticated, authErr := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, authErr)
+		return authenticated
+	}
+	assert.True(t, authenticate(key))
+
+	// The file is decrypted again when it changes.
+	newKey := paseto.NewV4AsymmetricSecretKey()
+	encrypt(newKey)
+	time.Sleep(5 * time.Millisecond)
+	assert.True(t, authenticate(newKey))
+	assert.False(t, authenticate(key))
+}
+
+func TestPasetoAuth_ValidateKeyFileSOPS(t *testing.T) {
+	dir := t.TempDir()
+	command, _ := writeFakeSOPS(t, dir)
+	plainPath := filepath.Join(dir, "paseto.key")
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	require.NoError(t, os.WriteFile(plainPath, []byte("k4.public."+key+"\n"), 0o600))
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/not_encrypted",
+			config: PasetoAuth{KeyFile: plainPath, KeyFileSOPS: &KeyFileSOPS{Command: command}},
+			expErr: "failed decrypting key file with sops: exit status 1: Error: sops metadata not found",
+		},
+		{
+			name:   "err/command_not_found",
+			config: PasetoAuth{KeyFile: plainPath, KeyFileSOPS: &KeyFileSOPS{Command: filepath.Join(dir, "missing")}},
+			expErr: "failed decrypting key file with sops",
+		},
+		{
+			name:   "err/negative_timeout",
+			config: PasetoAuth{KeyFile: plainPath, KeyFileSOPS: &KeyFileSOPS{Timeout: -time.Second}},
+			expErr: "invalid key_file_sops: negative timeout: '-1s'",
+		},
+		{
+			name:   "err/no_key_file",
+			config: PasetoAuth{Key: key, KeyFileSOPS: &KeyFileSOPS{}},
+			expErr: "key_file_sops requires key_file",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
@@ -0,0 +1,34 @@
+package caddypaseto
+
+import (
+	"fmt"
+	"strings"
+
+	"aidanwoods.dev/go-paseto"
+	"golang.org/x/crypto/ssh"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// isSSHKey reports whether the key data looks like an SSH public key in the
+// authorized_keys format, e.g. "ssh-ed25519 AAAA... user@host".
+func isSSHKey(data string) bool {
+	return strings.HasPrefix(data, ssh.KeyAlgoED25519+" ") || strings.HasPrefix(data, ssh.KeyAlgoECDSA384+" ")
+}
+
+// decodeSSHKey returns the hex encoded public key of an SSH public key in the
+// authorized_keys format. Ed25519 keys are supported for versions 2 and 4,
+// and ECDSA P-384 keys for version 3.
+func decodeSSHKey(data string, ver paseto.Version, kt xpaseto.KeyType) (string, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(data))
+	if err != nil {
+		return "", fmt.Errorf("invalid SSH key: %w", err)
+	}
+	cryptoKey, ok := key.(ssh.CryptoPublicKey)
+	if !ok {
+		return "", fmt.Errorf("SSH key has unsupported type %s, expected %s or %s",
+			key.Type(), ssh.KeyAlgoED25519, ssh.KeyAlgoECDSA384)
+	}
+
+	return publicKeyHexOf("SSH key", cryptoKey.CryptoPublicKey(), ver, kt)
+}
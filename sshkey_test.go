@@ -0,0 +1,128 @@
+package caddypaseto
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateSSHKey(t *testing.T) {
+	edPub, edPriv, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	v4Key, err := paseto.NewV4AsymmetricSecretKeyFromEd25519(edPriv)
+	require.NoError(t, err)
+
+	ecPriv, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	require.NoError(t, err)
+	v3Key, err := paseto.NewV3AsymmetricSecretKeyFromEcdsa(*ecPriv)
+	require.NoError(t, err)
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	tests := []struct {
+		name    string
+		key     string
+		version paseto.Version
+		token   string
+	}{
+		{
+			name:    "ok/ed25519",
+			key:     authorizedKey(t, edPub, ""),
+			version: paseto.Version4,
+			token:   token.V4Sign(v4Key, nil),
+		},
+		{
+			name:    "ok/ed25519_comment",
+			key:     authorizedKey(t, edPub, "alice@example.com"),
+			version: paseto.Version4,
+			token:   token.V4Sign(v4Key, nil),
+		},
+		{
+			name:    "ok/p384",
+			key:     authorizedKey(t, &ecPriv.PublicKey, ""),
+			version: paseto.Version3,
+			token:   token.V3Sign(v3Key, nil),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:       tt.key,
+				Version:   tt.version,
+				FromQuery: []string{"token"},
+				logger:    slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.token, nil)
+			user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.True(t, authenticated)
+			assert.Equal(t, "user123", user.ID)
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateSSHKey(t *testing.T) {
+	edPub, _, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/version_mismatch",
+			config: PasetoAuth{Key: authorizedKey(t, edPub, ""), Version: paseto.Version3},
+			expErr: "SSH key is an Ed25519 key, but version 3 requires a P-384 key; set `version 4`",
+		},
+		{
+			name:   "err/purpose_local",
+			config: PasetoAuth{Key: authorizedKey(t, edPub, ""), Purpose: paseto.Local},
+			expErr: "SSH key is a public key, but purpose local requires a local key",
+		},
+		{
+			name:   "err/invalid_key",
+			config: PasetoAuth{Key: "ssh-ed25519 AAAA!"},
+			expErr: "invalid SSH key",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.ErrorContains(t, tt.config.Validate(), tt.expErr)
+		})
+	}
+}
+
+// authorizedKey returns the public key in the authorized_keys format.
+func authorizedKey(t *testing.T, pub any, comment string) string {
+	t.Helper()
+	key, err := ssh.NewPublicKey(pub)
+	require.NoError(t, err)
+	line := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+	if comment != "" {
+		line += " " + comment
+	}
+	return line
+}
@@ -0,0 +1,245 @@
+package caddypaseto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/certmagic"
+)
+
+// storageKeysPrefix is the storage path prefix of stored keys.
+const storageKeysPrefix = "paseto/keys"
+
+// KeyStorage configures verification keys that are stored in the Caddy storage
+// module, so that all Caddy instances that use the same storage converge on the
+// same keys. The keys are stored via the `/paseto/keys` admin API endpoint of
+// any of the instances, and the storage is polled for changes, so they take
+// effect on all instances within CheckInterval. Unlike KeyRotation, only the
+// public or symmetric verification keys are stored.
+type KeyStorage struct {
+	// Name identifies the stored keys. The keys are stored per name, version
+	// and purpose, so the pasetoauth providers with the same name, version and
+	// purpose share the same keys. The default is "default".
+	Name string `json:"name,omitempty"`
+
+	// CheckInterval is how often the storage is checked for changes of the
+	// keys. The default is 1m.
+	CheckInterval time.Duration `json:"check_interval,omitempty"`
+}
+
+func (ks *KeyStorage) provision() error {
+	if ks.Name == "" {
+		ks.Name = "default"
+	} else if strings.ContainsAny(ks.Name, `/\`) {
+		return fmt.Errorf("invalid key_storage name: '%s'", ks.Name)
+	}
+	if ks.CheckInterval < 0 {
+		return fmt.Errorf("invalid key_storage check_interval: '%s'", ks.CheckInterval)
+	} else if ks.CheckInterval == 0 {
+		ks.CheckInterval = time.Minute
+	}
+
+	return nil
+}
+
+// storedKeysDocument is the stored document of the keys of a name, version and
+// purpose. It's a key document, so it's parsed with parseKeyDocument.
+type storedKeysDocument struct {
+	// Keys are the hex encoded verification keys.
+	Keys []string `json:"keys"`
+}
+
+// storedKeysPath returns the storage key of the stored keys of the name,
+// version and purpose.
+func storedKeysPath(name string, ver paseto.Version, purpose paseto.Purpose) string {
+	return path.Join(storageKeysPrefix, name, string(ver)+"."+string(purpose))
+}
+
+// loadStoredKeys returns the keys stored at the storage key, or no keys if none
+// are stored.
+func loadStoredKeys(ctx context.Context, storage certmagic.Storage, key string) ([]string, []byte, error) {
+	data, err := storage.Load(ctx, key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, fmt.Errorf("failed loading stored keys: %w", err)
+	}
+	keys, err := parseKeyDocument(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid stored keys: %w", err)
+	}
+
+	return keys, data, nil
+}
+
+// updateStoredKeys applies the update to the keys of the name, version and
+// purpose in the storage, while holding the storage lock of the keys, so that
+// concurrent updates via different instances aren't lost. The document is
+// deleted once no key is left. It returns the updated keys.
+func updateStoredKeys(
+	ctx context.Context, storage certmagic.Storage, name string, ver paseto.Version, purpose paseto.Purpose,
+	update func([]string) ([]string, error),
+) (keys []string, err error) {
+	key := storedKeysPath(name, ver, purpose)
+	lockKey := key + ".lock"
+	if err = storage.Lock(ctx, lockKey); err != nil {
+		return nil, fmt.Errorf("failed locking stored keys: %w", err)
+	}
+	defer func() {
+		if unlockErr := storage.Unlock(context.WithoutCancel(ctx), lockKey); unlockErr != nil && err == nil {
+			err = fmt.Errorf("failed unlocking stored keys: %w", unlockErr)
+		}
+	}()
+
+	if keys, _, err = loadStoredKeys(ctx, storage, key); err != nil {
+		return nil, err
+	}
+	if keys, err = update(slices.Clone(keys)); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		if err = storage.Delete(ctx, key); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("failed deleting stored keys: %w", err)
+		}
+		return nil, nil
+	}
+
+	data, err := json.Marshal(storedKeysDocument{Keys: keys})
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding stored keys: %w", err)
+	}
+	if err = storage.Store(ctx, key, data); err != nil {
+		return nil, fmt.Errorf("failed storing keys: %w", err)
+	}
+
+	return keys, nil
+}
+
+// storedKeys polls the keys of a KeyStorage for changes.
+type storedKeys struct {
+	cfg     KeyStorage
+	storage certmagic.Storage
+	key     string
+
+	mu        sync.Mutex
+	nextCheck time.Time
+	polling   bool
+	loaded    bool
+	modified  time.Time
+	size      int64
+	digest    [sha256.Size]byte
+}
+
+func newStoredKeys(
+	ks *KeyStorage, storage certmagic.Storage, ver paseto.Version, purpose paseto.Purpose,
+) (*storedKeys, error) {
+	if err := ks.provision(); err != nil {
+		return nil, err
+	}
+	if storage == nil {
+		return nil, errors.New("key_storage requires a storage module")
+	}
+
+	return &storedKeys{cfg: *ks, storage: storage, key: storedKeysPath(ks.Name, ver, purpose)}, nil
+}
+
+// due reports whether the storage should be checked, and if so, marks it as
+// being checked, so that only one check is in progress at a time.
+func (sk *storedKeys) due(now time.Time) bool {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	if sk.polling || now.Before(sk.nextCheck) {
+		return false
+	}
+	sk.polling = true
+	return true
+}
+
+// poll returns the stored keys, and false if they haven't changed since the
+// last successful poll. The modification time and size of the document are
+// checked first, so that an unchanged document isn't loaded again, unless the
+// storage doesn't report them. Otherwise, changes are detected by comparing
+// the digest of the document. No keys are returned if none are stored.
+func (sk *storedKeys) poll(ctx context.Context) ([]string, bool, error) {
+	sk.mu.Lock()
+	loaded, modified, size, digest := sk.loaded, sk.modified, sk.size, sk.digest
+	sk.mu.Unlock()
+	defer func() {
+		sk.mu.Lock()
+		sk.polling = false
+		sk.nextCheck = time.Now().Add(sk.cfg.CheckInterval)
+		sk.mu.Unlock()
+	}()
+
+	info, err := sk.storage.Stat(ctx, sk.key)
+	missing := errors.Is(err, fs.ErrNotExist)
+	switch {
+	case missing:
+		info = certmagic.KeyInfo{}
+	case err != nil:
+		return nil, false, fmt.Errorf("failed checking stored keys: %w", err)
+	case loaded && !info.Modified.IsZero() && info.Modified.Equal(modified) && info.Size == size:
+		return nil, false, nil
+	}
+
+	var (
+		keys []string
+		data []byte
+	)
+	if !missing {
+		if keys, data, err = loadStoredKeys(ctx, sk.storage, sk.key); err != nil {
+			return nil, false, err
+		}
+	}
+
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	sk.modified, sk.size = info.Modified, info.Size
+	newDigest := sha256.Sum256(data)
+	if loaded && newDigest == digest {
+		return nil, false, nil
+	}
+	sk.loaded, sk.digest = true, newDigest
+
+	return keys, true, nil
+}
+
+// reset makes the next poll return the keys, even if they haven't changed.
+// It's used when the keys couldn't be applied.
+func (sk *storedKeys) reset() {
+	sk.mu.Lock()
+	defer sk.mu.Unlock()
+	sk.loaded, sk.modified, sk.size, sk.digest = false, time.Time{}, 0, [sha256.Size]byte{}
+}
+
+func (p *PasetoAuth) refreshKeyStorage() {
+	keys, changed, err := p.keys.stored.poll(p.moduleContext())
+	if err == nil && changed {
+		err = p.updateKeys(func(s *keySources) {
+			s.stored = keys
+			s.setFailed(keySourceStorage, false)
+		})
+		if err != nil {
+			p.keys.stored.reset()
+		}
+	}
+	if err != nil {
+		p.logger.Warn(err.Error(), "key_storage", p.KeyStorage.Name)
+		p.keySourceFailed(keySourceStorage)
+		return
+	}
+	if !changed {
+		return
+	}
+	p.logger.Info("reloaded stored keys", "key_storage", p.KeyStorage.Name, "keys", len(keys))
+}
@@ -0,0 +1,195 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/certmagic"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestStoredKeys_Poll(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	sk, err := newStoredKeys(&KeyStorage{}, storage, paseto.Version4, paseto.Public)
+	require.NoError(t, err)
+	assert.Equal(t, "paseto/keys/default/v4.public", sk.key)
+
+	// No keys are stored yet.
+	keys, changed, err := sk.poll(t.Context())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Empty(t, keys)
+
+	_, changed, err = sk.poll(t.Context())
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	update := func(keys []string) ([]string, error) { return append(keys, key), nil }
+	stored, err := updateStoredKeys(t.Context(), storage, "default", paseto.Version4, paseto.Public, update)
+	require.NoError(t, err)
+	assert.Equal(t, []string{key}, stored)
+
+	keys, changed, err = sk.poll(t.Context())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{key}, keys)
+
+	_, changed, err = sk.poll(t.Context())
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	sk.reset()
+	keys, changed, err = sk.poll(t.Context())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, []string{key}, keys)
+
+	// The document is deleted once no key is left.
+	removeAll := func([]string) ([]string, error) { return nil, nil }
+	_, err = updateStoredKeys(t.Context(), storage, "default", paseto.Version4, paseto.Public, removeAll)
+	require.NoError(t, err)
+	assert.False(t, storage.Exists(t.Context(), sk.key))
+
+	keys, changed, err = sk.poll(t.Context())
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.Empty(t, keys)
+}
+
+func TestPasetoAuth_AuthenticateStoredKeys(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+	configKey := paseto.NewV4AsymmetricSecretKey()
+	storedKey := paseto.NewV4AsymmetricSecretKey()
+	storedKID := testKeyID(t, storedKey.Public().ExportHex())
+
+	// Two instances of a cluster that share the storage.
+	newAuth := func() *PasetoAuth {
+		auth := &PasetoAuth{
+			Key:        configKey.Public().ExportHex(),
+			KeyStorage: &KeyStorage{Name: "cluster", CheckInterval: time.Millisecond},
+			FromQuery:  []string{"token"},
+			storage:    storage,
+			logger:     slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, auth.Validate())
+		return auth
+	}
+	auths := []*PasetoAuth{newAuth(), newAuth()}
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(storedKey, nil)
+	authenticate := func(auth *PasetoAuth) bool {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		return authenticated
+	}
+
+	api := &AdminAPI{storage: storage}
+	keys := func(method, body string) (string, error) {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(method, "/paseto/keys", strings.NewReader(body))
+		err := api.handleKeys(w, req)
+		return w.Body.String(), err
+	}
+
+	for _, auth := range auths {
+		assert.False(t, authenticate(auth))
+	}
+
+	body, err := keys(http.MethodPost, `{"storage":"cluster","keys":["`+storedKey.Public().ExportHex()+`"]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{"version":"v4","purpose":"public","ids":["`+storedKID+`"],"replace":false}]`, body)
+	for _, auth := range auths {
+		assert.Eventually(t, func() bool { return authenticate(auth) }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	require.NoError(t, api.handleKeys(w, httptest.NewRequest(http.MethodGet, "/paseto/keys?storage=cluster", nil)))
+	assert.JSONEq(t, `[{"version":"v4","purpose":"public","ids":["`+storedKID+`"],"replace":false}]`, w.Body.String())
+	// The stored keys aren't listed with the keys in memory.
+	body, err = keys(http.MethodGet, "")
+	require.NoError(t, err)
+	assert.JSONEq(t, `[]`, body)
+
+	body, err = keys(http.MethodDelete, `{"storage":"cluster","ids":["`+storedKID+`"]}`)
+	require.NoError(t, err)
+	assert.JSONEq(t, `[]`, body)
+	for _, auth := range auths {
+		assert.Eventually(t, func() bool { return !authenticate(auth) }, 5*time.Second, 10*time.Millisecond)
+	}
+
+	_, err = keys(http.MethodPost, `{"storage":"a/b","keys":["`+storedKey.Public().ExportHex()+`"]}`)
+	require.ErrorContains(t, err, "invalid storage: 'a/b'")
+	_, err = (&AdminAPI{}).storedKeysStates(t.Context(), "cluster")
+	require.ErrorContains(t, err, "storage is not available")
+}
+
+func TestPasetoAuth_ValidateKeyStorage(t *testing.T) {
+	storage := &certmagic.FileStorage{Path: t.TempDir()}
+
+	tests := []struct {
+		name    string
+		config  PasetoAuth
+		storage certmagic.Storage
+		expErr  string
+	}{
+		{
+			name:    "ok/empty",
+			config:  PasetoAuth{KeyStorage: &KeyStorage{}},
+			storage: storage,
+		},
+		{
+			name: "ok/failover",
+			config: PasetoAuth{
+				KeyStorage:  &KeyStorage{},
+				Keys:        []string{paseto.NewV4AsymmetricSecretKey().Public().ExportHex()},
+				KeyFailover: []string{"key_storage", "keys"},
+			},
+			storage: storage,
+		},
+		{
+			name:    "err/invalid_name",
+			config:  PasetoAuth{KeyStorage: &KeyStorage{Name: "a/b"}},
+			storage: storage,
+			expErr:  "invalid key_storage name: 'a/b'",
+		},
+		{
+			name:    "err/negative_check_interval",
+			config:  PasetoAuth{KeyStorage: &KeyStorage{CheckInterval: -time.Second}},
+			storage: storage,
+			expErr:  "invalid key_storage check_interval: '-1s'",
+		},
+		{
+			name:   "err/no_storage",
+			config: PasetoAuth{KeyStorage: &KeyStorage{}},
+			expErr: "key_storage requires a storage module",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.storage = tt.storage
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			err := tt.config.Validate()
+			if tt.expErr == "" {
+				require.NoError(t, err)
+				return
+			}
+			require.ErrorContains(t, err, tt.expErr)
+		})
+	}
+}
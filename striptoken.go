@@ -0,0 +1,120 @@
+package caddypaseto
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// stripConsumedToken removes the token that authenticated the request from
+// the request, so that it isn't passed to the next handlers, e.g. the
+// upstream, if it's enabled for its source.
+func (p *PasetoAuth) stripConsumedToken(w http.ResponseWriter, r *http.Request, tokenStr string) {
+	p.stripPathToken(r, tokenStr)
+	p.stripWebSocketToken(w, r, tokenStr)
+	if p.StripToken {
+		stripQueryToken(r, p.FromQuery, tokenStr)
+		p.stripHeaderToken(r, tokenStr)
+		stripCookieToken(r, resolveSourceNames(r, p.FromCookies), tokenStr)
+	}
+}
+
+// stripQueryToken removes the query string parameters with the names whose
+// value is the token. Only the matching pairs are removed from the raw query
+// string, so that the order and encoding of the other parameters are kept, e.g.
+// for upstreams that verify request signatures.
+func stripQueryToken(r *http.Request, names []string, tokenStr string) {
+	pairs := strings.Split(r.URL.RawQuery, "&")
+	kept := slices.DeleteFunc(slices.Clone(pairs), func(pair string) bool {
+		rawName, rawValue, _ := strings.Cut(pair, "=")
+		name, nameErr := url.QueryUnescape(rawName)
+		value, valueErr := url.QueryUnescape(rawValue)
+		return nameErr == nil && valueErr == nil && slices.Contains(names, name) && normToken(value) == tokenStr
+	})
+	if len(kept) == len(pairs) {
+		return
+	}
+	r.URL.RawQuery = strings.Join(kept, "&")
+	r.RequestURI = r.URL.RequestURI()
+}
+
+// stripHeaderToken removes the values of the token source headers that are
+// the token, or contain it, e.g. "Authorization: Bearer <token>".
+func (p *PasetoAuth) stripHeaderToken(r *http.Request, tokenStr string) {
+	names := resolveSourceNames(r, p.FromHeader)
+	if !p.DisableImplicitAuthorization || len(p.FromBasicAuth) > 0 {
+		names = append(slices.Clip(names), "Authorization")
+	}
+	if p.FromForwardedAuthorization {
+		names = append(slices.Clip(names), forwardedAuthorizationHeader)
+	}
+
+	for _, name := range names {
+		name = http.CanonicalHeaderKey(name)
+		values := r.Header.Values(name)
+		kept := slices.DeleteFunc(slices.Clone(values), func(val string) bool {
+			if name == "Authorization" || name == forwardedAuthorizationHeader {
+				return p.authorizationHasToken(val, tokenStr)
+			}
+			return normToken(val) == tokenStr
+		})
+		if len(kept) == len(values) {
+			continue
+		}
+		r.Header.Del(name)
+		for _, val := range kept {
+			r.Header.Add(name, val)
+		}
+	}
+}
+
+// authorizationHasToken reports whether the Authorization header value
+// contains the token, in an accepted scheme, or as the password of the Basic
+// scheme.
+func (p *PasetoAuth) authorizationHasToken(value, tokenStr string) bool {
+	if token, ok := p.authorizationToken(value); ok && normToken(token) == tokenStr {
+		return true
+	}
+	if len(p.FromBasicAuth) == 0 {
+		return false
+	}
+	basic := &http.Request{Header: http.Header{"Authorization": {value}}}
+	_, password, ok := basic.BasicAuth()
+	return ok && normToken(password) == tokenStr
+}
+
+// stripCookieToken removes the cookies with the names whose value is the token
+// from the Cookie headers. Only the matching pairs are removed from the raw
+// headers, so that the other cookies are passed on as they were sent.
+func stripCookieToken(r *http.Request, names []string, tokenStr string) {
+	lines := r.Header.Values("Cookie")
+	keptLines := make([]string, 0, len(lines))
+	var changed bool
+	for _, line := range lines {
+		pairs := strings.Split(line, ";")
+		kept := slices.DeleteFunc(slices.Clone(pairs), func(pair string) bool {
+			name, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			value = strings.TrimSuffix(strings.TrimPrefix(value, `"`), `"`)
+			return slices.Contains(names, name) && normToken(value) == tokenStr
+		})
+		if len(kept) == len(pairs) {
+			keptLines = append(keptLines, line)
+			continue
+		}
+		changed = true
+		for i := range kept {
+			kept[i] = strings.TrimSpace(kept[i])
+		}
+		if len(kept) > 0 {
+			keptLines = append(keptLines, strings.Join(kept, "; "))
+		}
+	}
+	if !changed {
+		return
+	}
+	r.Header.Del("Cookie")
+	for _, line := range keptLines {
+		r.Header.Add("Cookie", line)
+	}
+}
@@ -0,0 +1,118 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_StripToken(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(key, nil)
+
+	auth := &PasetoAuth{
+		Key:           key.Public().ExportHex(),
+		FromQuery:     []string{"token"},
+		FromHeader:    []string{"X-Token"},
+		FromCookies:   []string{"session"},
+		FromBasicAuth: []string{"token"},
+		StripToken:    true,
+		logger:        slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name      string
+		setup     func(r *http.Request)
+		expURI    string
+		expHeader http.Header
+	}{
+		{
+			name:   "ok/query",
+			setup:  func(r *http.Request) { r.URL.RawQuery = "page=2&token=" + tokenStr; r.RequestURI = r.URL.RequestURI() },
+			expURI: "/api?page=2",
+		},
+		{
+			name: "ok/query_order_and_encoding",
+			setup: func(r *http.Request) {
+				r.URL.RawQuery = "z=1&token=" + tokenStr + "&a=%20b+c&sig=AB%2fcd&token=other&a=2"
+				r.RequestURI = r.URL.RequestURI()
+			},
+			expURI: "/api?z=1&a=%20b+c&sig=AB%2fcd&token=other&a=2",
+		},
+		{
+			name:   "ok/query_only_token",
+			setup:  func(r *http.Request) { r.URL.RawQuery = "token=" + tokenStr; r.RequestURI = r.URL.RequestURI() },
+			expURI: "/api",
+		},
+		{
+			name:      "ok/header",
+			setup:     func(r *http.Request) { r.Header.Add("X-Token", "other"); r.Header.Add("X-Token", tokenStr) },
+			expURI:    "/api",
+			expHeader: http.Header{"X-Token": {"other"}},
+		},
+		{
+			name:   "ok/authorization",
+			setup:  func(r *http.Request) { r.Header.Set("Authorization", "Bearer "+tokenStr) },
+			expURI: "/api",
+		},
+		{
+			name:   "ok/basic_auth",
+			setup:  func(r *http.Request) { r.SetBasicAuth("token", tokenStr) },
+			expURI: "/api",
+		},
+		{
+			name: "ok/cookie",
+			setup: func(r *http.Request) {
+				r.AddCookie(&http.Cookie{Name: "theme", Value: "dark"})
+				r.AddCookie(&http.Cookie{Name: "session", Value: tokenStr})
+			},
+			expURI:    "/api",
+			expHeader: http.Header{"Cookie": {"theme=dark"}},
+		},
+		{
+			name: "ok/cookie_raw_values",
+			setup: func(r *http.Request) {
+				r.Header.Add("Cookie", `z=1;session=`+tokenStr+`;  prefs="a b"; theme=dark`)
+				r.Header.Add("Cookie", "other=unchanged;  spacing=kept")
+			},
+			expURI:    "/api",
+			expHeader: http.Header{"Cookie": {`z=1; prefs="a b"; theme=dark`, "other=unchanged;  spacing=kept"}},
+		},
+		{
+			name:   "ok/cookie_quoted",
+			setup:  func(r *http.Request) { r.Header.Add("Cookie", `session="`+tokenStr+`"`) },
+			expURI: "/api",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/api", nil)
+			tt.setup(req)
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			require.True(t, authenticated)
+
+			assert.Equal(t, tt.expURI, req.URL.RequestURI())
+			assert.Equal(t, tt.expURI, req.RequestURI)
+			if tt.expHeader == nil {
+				tt.expHeader = http.Header{}
+			}
+			assert.Equal(t, tt.expHeader, req.Header)
+		})
+	}
+}
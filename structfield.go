@@ -0,0 +1,401 @@
+package caddypaseto
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// This file implements the subset of Structured Field Values for HTTP (RFC
+// 8941) needed to process the Signature-Input and Signature headers of HTTP
+// Message Signatures (RFC 9421). Decimals are not supported.
+
+// sfToken is a structured field token, which is serialized without quotes.
+type sfToken string
+
+// sfParam is a structured field parameter. The value is one of string,
+// sfToken, int64, bool or []byte.
+type sfParam struct {
+	name  string
+	value any
+}
+
+// sfItem is a structured field item with parameters.
+type sfItem struct {
+	value  any
+	params []sfParam
+}
+
+// sfInnerList is a structured field inner list with parameters.
+type sfInnerList struct {
+	items  []sfItem
+	params []sfParam
+}
+
+// sfMember is a structured field dictionary member. The value is either an
+// sfItem or an sfInnerList.
+type sfMember struct {
+	name  string
+	value any
+}
+
+// parseSFDictionary parses a structured field dictionary, and returns its
+// members in order.
+func parseSFDictionary(s string) ([]sfMember, error) {
+	p := &sfParser{s: strings.TrimLeft(s, " ")}
+	members := make([]sfMember, 0)
+	for !p.done() {
+		name, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+
+		var value any
+		if p.peek() == '=' {
+			p.i++
+			if value, err = p.parseItemOrInnerList(); err != nil {
+				return nil, err
+			}
+		} else {
+			var params []sfParam
+			if params, err = p.parseParams(); err != nil {
+				return nil, err
+			}
+			value = sfItem{value: true, params: params}
+		}
+
+		if idx := sfMemberIndex(members, name); idx >= 0 {
+			members[idx].value = value
+		} else {
+			members = append(members, sfMember{name: name, value: value})
+		}
+
+		p.skipOWS()
+		if p.done() {
+			break
+		}
+		if p.peek() != ',' {
+			return nil, fmt.Errorf("expected ',' at position %d", p.i)
+		}
+		p.i++
+		p.skipOWS()
+		if p.done() {
+			return nil, fmt.Errorf("trailing ',' in dictionary")
+		}
+	}
+
+	return members, nil
+}
+
+func sfMemberIndex(members []sfMember, name string) int {
+	for i, m := range members {
+		if m.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// serialize returns the structured field serialization of the inner list.
+func (l sfInnerList) serialize() string {
+	var sb strings.Builder
+	sb.WriteByte('(')
+	for i, item := range l.items {
+		if i > 0 {
+			sb.WriteByte(' ')
+		}
+		sb.WriteString(serializeSFBareItem(item.value))
+		sb.WriteString(serializeSFParams(item.params))
+	}
+	sb.WriteByte(')')
+	sb.WriteString(serializeSFParams(l.params))
+
+	return sb.String()
+}
+
+func serializeSFParams(params []sfParam) string {
+	var sb strings.Builder
+	for _, param := range params {
+		sb.WriteByte(';')
+		sb.WriteString(param.name)
+		if val, ok := param.value.(bool); ok && val {
+			continue
+		}
+		sb.WriteByte('=')
+		sb.WriteString(serializeSFBareItem(param.value))
+	}
+	return sb.String()
+}
+
+func serializeSFBareItem(value any) string {
+	switch val := value.(type) {
+	case string:
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(val) + `"`
+	case sfToken:
+		return string(val)
+	case int64:
+		return strconv.FormatInt(val, 10)
+	case bool:
+		if val {
+			return "?1"
+		}
+		return "?0"
+	case []byte:
+		return ":" + base64.StdEncoding.EncodeToString(val) + ":"
+	}
+	return ""
+}
+
+type sfParser struct {
+	s string
+	i int
+}
+
+func (p *sfParser) done() bool {
+	return p.i >= len(p.s)
+}
+
+func (p *sfParser) peek() byte {
+	if p.done() {
+		return 0
+	}
+	return p.s[p.i]
+}
+
+func (p *sfParser) skipOWS() {
+	for !p.done() && (p.s[p.i] == ' ' || p.s[p.i] == '\t') {
+		p.i++
+	}
+}
+
+func (p *sfParser) parseItemOrInnerList() (any, error) {
+	if p.peek() == '(' {
+		return p.parseInnerList()
+	}
+
+	value, err := p.parseBareItem()
+	if err != nil {
+		return nil, err
+	}
+	params, err := p.parseParams()
+	if err != nil {
+		return nil, err
+	}
+
+	return sfItem{value: value, params: params}, nil
+}
+
+func (p *sfParser) parseInnerList() (sfInnerList, error) {
+	p.i++ // (
+	var list sfInnerList
+	for {
+		for p.peek() == ' ' {
+			p.i++
+		}
+		if p.done() {
+			return sfInnerList{}, fmt.Errorf("unterminated inner list")
+		}
+		if p.peek() == ')' {
+			p.i++
+			break
+		}
+
+		value, err := p.parseBareItem()
+		if err != nil {
+			return sfInnerList{}, err
+		}
+		params, err := p.parseParams()
+		if err != nil {
+			return sfInnerList{}, err
+		}
+		list.items = append(list.items, sfItem{value: value, params: params})
+
+		if c := p.peek(); c != ' ' && c != ')' {
+			return sfInnerList{}, fmt.Errorf("expected ' ' or ')' at position %d", p.i)
+		}
+	}
+
+	var err error
+	if list.params, err = p.parseParams(); err != nil {
+		return sfInnerList{}, err
+	}
+
+	return list, nil
+}
+
+func (p *sfParser) parseParams() ([]sfParam, error) {
+	var params []sfParam
+	for p.peek() == ';' {
+		p.i++
+		p.skipOWS()
+		name, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+
+		var value any = true
+		if p.peek() == '=' {
+			p.i++
+			if value, err = p.parseBareItem(); err != nil {
+				return nil, err
+			}
+		}
+
+		param := sfParam{name: name, value: value}
+		if idx := sfParamIndex(params, name); idx >= 0 {
+			params[idx] = param
+		} else {
+			params = append(params, param)
+		}
+	}
+
+	return params, nil
+}
+
+func sfParamIndex(params []sfParam, name string) int {
+	for i, param := range params {
+		if param.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *sfParser) parseKey() (string, error) {
+	start := p.i
+	if c := p.peek(); !isLCAlpha(c) && c != '*' {
+		return "", fmt.Errorf("invalid key at position %d", p.i)
+	}
+	for !p.done() {
+		c := p.s[p.i]
+		if !isLCAlpha(c) && !isDigit(c) && !strings.ContainsRune("_-.*", rune(c)) {
+			break
+		}
+		p.i++
+	}
+	return p.s[start:p.i], nil
+}
+
+func (p *sfParser) parseBareItem() (any, error) {
+	c := p.peek()
+	switch {
+	case c == '"':
+		return p.parseString()
+	case c == ':':
+		return p.parseByteSequence()
+	case c == '?':
+		return p.parseBoolean()
+	case c == '-' || isDigit(c):
+		return p.parseInteger()
+	case isAlpha(c) || c == '*':
+		return p.parseToken(), nil
+	default:
+		return nil, fmt.Errorf("invalid item at position %d", p.i)
+	}
+}
+
+func (p *sfParser) parseString() (string, error) {
+	p.i++ // "
+	var sb strings.Builder
+	for !p.done() {
+		c := p.s[p.i]
+		p.i++
+		switch {
+		case c == '\\':
+			if p.done() || (p.s[p.i] != '"' && p.s[p.i] != '\\') {
+				return "", fmt.Errorf("invalid escape in string at position %d", p.i)
+			}
+			sb.WriteByte(p.s[p.i])
+			p.i++
+		case c == '"':
+			return sb.String(), nil
+		case c < 0x20 || c > 0x7e:
+			return "", fmt.Errorf("invalid character in string at position %d", p.i-1)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", fmt.Errorf("unterminated string")
+}
+
+func (p *sfParser) parseByteSequence() ([]byte, error) {
+	p.i++ // :
+	end := strings.IndexByte(p.s[p.i:], ':')
+	if end < 0 {
+		return nil, fmt.Errorf("unterminated byte sequence")
+	}
+	encoded := p.s[p.i : p.i+end]
+	p.i += end + 1
+
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		// Padding is optional when parsing.
+		if data, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(encoded, "=")); err != nil {
+			return nil, fmt.Errorf("invalid byte sequence: %w", err)
+		}
+	}
+
+	return data, nil
+}
+
+func (p *sfParser) parseBoolean() (bool, error) {
+	p.i++ // ?
+	switch p.peek() {
+	case '1':
+		p.i++
+		return true, nil
+	case '0':
+		p.i++
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean at position %d", p.i)
+}
+
+func (p *sfParser) parseInteger() (int64, error) {
+	start := p.i
+	if p.peek() == '-' {
+		p.i++
+	}
+	for !p.done() && isDigit(p.s[p.i]) {
+		p.i++
+	}
+	if p.peek() == '.' {
+		return 0, fmt.Errorf("decimals are not supported")
+	}
+
+	digits := p.s[start:p.i]
+	if len(strings.TrimPrefix(digits, "-")) > 15 {
+		return 0, fmt.Errorf("integer is too long: %s", digits)
+	}
+	n, err := strconv.ParseInt(digits, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid integer: %w", err)
+	}
+
+	return n, nil
+}
+
+func (p *sfParser) parseToken() sfToken {
+	start := p.i
+	for !p.done() && isTokenChar(p.s[p.i]) {
+		p.i++
+	}
+	return sfToken(p.s[start:p.i])
+}
+
+func isLCAlpha(c byte) bool {
+	return c >= 'a' && c <= 'z'
+}
+
+func isAlpha(c byte) bool {
+	return isLCAlpha(c) || (c >= 'A' && c <= 'Z')
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isTokenChar(c byte) bool {
+	return isAlpha(c) || isDigit(c) || strings.ContainsRune("!#$%&'*+-.^_`|~:/", rune(c))
+}
@@ -0,0 +1,163 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap/exp/zapslog"
+
+	"go.hackfix.me/paseto-cli/xpaseto"
+)
+
+// TenantStats are the authentication stats of a tenant, i.e. of an issuer of
+// issuer_keys, or of an issuer of the paseto app, since Caddy started.
+type TenantStats struct {
+	Tenant            string    `json:"tenant"`
+	Authenticated     uint64    `json:"authenticated"`
+	Rejected          uint64    `json:"rejected"`
+	LastAuthenticated time.Time `json:"last_authenticated,omitzero"`
+	LastRejected      time.Time `json:"last_rejected,omitzero"`
+}
+
+// tenantStatsStore records the authentication stats of tenants.
+type tenantStatsStore struct {
+	mu    sync.Mutex
+	stats map[string]*TenantStats
+}
+
+// sharedTenantStats are the stats of the tenants of all module instances, served
+// by the admin API. They're not persisted.
+//
+//nolint:gochecknoglobals // Deliberately shared state.
+var sharedTenantStats = &tenantStatsStore{stats: make(map[string]*TenantStats)}
+
+// record records an authentication or a rejection of a request of the tenant.
+func (s *tenantStatsStore) record(tenant string, authenticated bool, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.stats[tenant]
+	if !ok {
+		stats = &TenantStats{Tenant: tenant}
+		s.stats[tenant] = stats
+	}
+	if authenticated {
+		stats.Authenticated++
+		stats.LastAuthenticated = now
+	} else {
+		stats.Rejected++
+		stats.LastRejected = now
+	}
+}
+
+// list returns the stats of the tenants, sorted by tenant, or only the one of
+// tenant, if it's not empty.
+func (s *tenantStatsStore) list(tenant string) []TenantStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	list := make([]TenantStats, 0, len(s.stats))
+	for _, name := range slices.Sorted(maps.Keys(s.stats)) {
+		if tenant == "" || name == tenant {
+			list = append(list, *s.stats[name])
+		}
+	}
+	return list
+}
+
+// tenants returns the tenants of the provider: the issuers of IssuerKeys, and
+// the issuer of the paseto app whose keys it uses.
+func (p *PasetoAuth) tenants() []string {
+	tenants := slices.Sorted(maps.Keys(p.IssuerKeys))
+	if p.Issuer != "" && !slices.Contains(tenants, p.Issuer) {
+		tenants = append(tenants, p.Issuer)
+	}
+	return tenants
+}
+
+// tokenTenant returns the tenant of a verified token: its issuer, if it's an
+// issuer of IssuerKeys, since the tokens of those issuers are verified with
+// their own keys, or else the issuer of the paseto app whose keys the provider
+// uses. It's empty if the provider has no tenants.
+func (p *PasetoAuth) tokenTenant(token *xpaseto.Token) string {
+	if iss, err := token.GetIssuer(); err == nil {
+		if _, ok := p.IssuerKeys[iss]; ok {
+			return iss
+		}
+	}
+	return p.Issuer
+}
+
+// provisionTenantLoggers creates the loggers of the tenants. They're named
+// after the tenant, e.g. "http.authentication.providers.paseto.tenant.billing.internal"
+// for "https://billing.internal", so that the Caddy logging config can write
+// the logs of each tenant to its own sink.
+func (p *PasetoAuth) provisionTenantLoggers(ctx caddy.Context) {
+	p.tenantLoggers = make(map[string]*slog.Logger)
+	for _, tenant := range p.tenants() {
+		name := string(p.CaddyModule().ID) + ".tenant." + tenantLoggerName(tenant)
+		handler := zapslog.NewHandler(ctx.Logger().Core(), zapslog.WithName(name))
+		p.tenantLoggers[tenant] = slog.New(handler).With("tenant", tenant)
+	}
+}
+
+// tenantLogger returns the logger of the tenant of a verified token, or the
+// logger of the provider, if the token has no tenant.
+func (p *PasetoAuth) tenantLogger(token *xpaseto.Token) *slog.Logger {
+	tenant := p.tokenTenant(token)
+	if logger, ok := p.tenantLoggers[tenant]; ok {
+		return logger
+	}
+	if tenant != "" {
+		return p.logger.With("tenant", tenant)
+	}
+	return p.logger
+}
+
+// tenantLoggerName returns the tenant without the URL scheme, and with the
+// characters that aren't allowed in logger names replaced.
+func tenantLoggerName(tenant string) string {
+	if _, rest, ok := strings.Cut(tenant, "://"); ok {
+		tenant = rest
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '.', r == '-':
+			return r
+		default:
+			return '_'
+		}
+	}, strings.TrimSuffix(tenant, "/"))
+}
+
+// recordAuthentication records an authenticated request in the metrics and
+// stats of the tenant of the token.
+func (p *PasetoAuth) recordAuthentication(token *xpaseto.Token, now time.Time) {
+	tenant := p.tokenTenant(token)
+	if exp, err := token.GetExpiration(); err == nil {
+		p.metrics.observeRemainingLifetime(tenant, exp, now)
+	}
+	p.metrics.incAuthentications(tenant, true)
+	if tenant != "" {
+		sharedTenantStats.record(tenant, true, now)
+	}
+}
+
+// recordRejection records a rejected request in the metrics and stats of the
+// tenant of rejected, i.e. the last token that was verified, but rejected. The
+// tenant of requests without such a token is unknown.
+func (p *PasetoAuth) recordRejection(rejected *xpaseto.Token, now time.Time) {
+	var tenant string
+	if rejected != nil {
+		tenant = p.tokenTenant(rejected)
+	}
+	p.metrics.incAuthentications(tenant, false)
+	if tenant != "" {
+		sharedTenantStats.record(tenant, false, now)
+	}
+}
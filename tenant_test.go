@@ -0,0 +1,159 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateTenants(t *testing.T) {
+	origStats := sharedTenantStats
+	sharedTenantStats = &tenantStatsStore{stats: make(map[string]*TenantStats)}
+	t.Cleanup(func() { sharedTenantStats = origStats })
+
+	mainKey := paseto.NewV4AsymmetricSecretKey()
+	billingKey := paseto.NewV4AsymmetricSecretKey()
+	reportsKey := paseto.NewV4AsymmetricSecretKey()
+
+	reg := prometheus.NewPedanticRegistry()
+	m, err := newMetrics(reg)
+	require.NoError(t, err)
+	logHandler := testutil.NewTestLogHandler()
+	auth := &PasetoAuth{
+		Key: mainKey.Public().ExportHex(),
+		IssuerKeys: map[string]*Issuer{
+			"https://billing.internal": {Key: billingKey.Public().ExportHex()},
+			"https://reports.internal": {Key: reportsKey.Public().ExportHex()},
+		},
+		AllowAudiences: []string{"api"},
+		FromQuery:      []string{"token"},
+		metrics:        m,
+		logger:         slog.New(logHandler),
+	}
+	require.NoError(t, auth.Validate())
+
+	newToken := func(iss, aud string, key paseto.V4AsymmetricSecretKey) string {
+		token := paseto.NewToken()
+		token.SetIssuedAt(time.Now())
+		token.SetNotBefore(time.Now())
+		token.SetExpiration(time.Now().Add(time.Hour))
+		token.SetSubject("user123")
+		token.SetAudience(aud)
+		if iss != "" {
+			token.SetIssuer(iss)
+		}
+		return token.V4Sign(key, nil)
+	}
+
+	tests := []struct {
+		name     string
+		tokenStr string
+		expAuth  bool
+	}{
+		{name: "ok/billing", tokenStr: newToken("https://billing.internal", "api", billingKey), expAuth: true},
+		{name: "ok/billing_again", tokenStr: newToken("https://billing.internal", "api", billingKey), expAuth: true},
+		{name: "ok/reports", tokenStr: newToken("https://reports.internal", "api", reportsKey), expAuth: true},
+		{name: "ok/no_tenant", tokenStr: newToken("", "api", mainKey), expAuth: true},
+		{name: "err/billing_audience", tokenStr: newToken("https://billing.internal", "other", billingKey)},
+		{name: "err/reports_other_key", tokenStr: newToken("https://reports.internal", "api", billingKey)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/?token="+tt.tokenStr, nil)
+			_, authenticated, authErr := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, authErr)
+			assert.Equal(t, tt.expAuth, authenticated)
+		})
+	}
+
+	assert.True(t, logHandler.HasRecord(slog.LevelInfo, "user authenticated"))
+	counts := gatherAuthentications(t, reg)
+	assert.Equal(t, map[[2]string]float64{
+		{"https://billing.internal", "authenticated"}: 2,
+		{"https://billing.internal", "rejected"}:      1,
+		{"https://reports.internal", "authenticated"}: 1,
+		{"", "authenticated"}:                         1,
+		// The tenant of tokens that fail verification is unknown.
+		{"", "rejected"}: 1,
+	}, counts)
+
+	api := &AdminAPI{}
+	listTenants := func(query string) []TenantStats {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/paseto/tenants"+query, nil)
+		require.NoError(t, api.handleTenants(w, req))
+		var stats []TenantStats
+		require.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+		return stats
+	}
+
+	stats := listTenants("")
+	require.Len(t, stats, 2)
+	assert.Equal(t, "https://billing.internal", stats[0].Tenant)
+	assert.Equal(t, uint64(2), stats[0].Authenticated)
+	assert.Equal(t, uint64(1), stats[0].Rejected)
+	assert.False(t, stats[0].LastRejected.IsZero())
+	assert.Equal(t, "https://reports.internal", stats[1].Tenant)
+	assert.Zero(t, stats[1].Rejected)
+	assert.True(t, stats[1].LastRejected.IsZero())
+
+	stats = listTenants("?tenant=https://reports.internal")
+	require.Len(t, stats, 1)
+	assert.Equal(t, uint64(1), stats[0].Authenticated)
+}
+
+func gatherAuthentications(t *testing.T, reg *prometheus.Registry) map[[2]string]float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	require.NoError(t, err)
+	counts := make(map[[2]string]float64)
+	for _, family := range families {
+		if family.GetName() != "caddy_paseto_authentications_total" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			var key [2]string
+			for _, label := range metric.GetLabel() {
+				switch label.GetName() {
+				case "tenant":
+					key[0] = label.GetValue()
+				case "result":
+					key[1] = label.GetValue()
+				}
+			}
+			counts[key] = metric.GetCounter().GetValue()
+		}
+	}
+
+	return counts
+}
+
+func TestTenantLoggerName(t *testing.T) {
+	tests := []struct {
+		tenant string
+		exp    string
+	}{
+		{tenant: "https://billing.internal", exp: "billing.internal"},
+		{tenant: "https://auth.example.com/tenants/acme/", exp: "auth.example.com_tenants_acme"},
+		{tenant: "acme-corp", exp: "acme-corp"},
+		{tenant: "localhost:8443", exp: "localhost_8443"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.tenant, func(t *testing.T) {
+			assert.Equal(t, tt.exp, tenantLoggerName(tt.tenant))
+		})
+	}
+}
@@ -14,7 +14,7 @@ import (
 // TestLogHandler is a slog.Handler implementation for testing that captures
 // log records and allows inspection of their content.
 type TestLogHandler struct {
-	mu      sync.RWMutex
+	mu      *sync.RWMutex // shared with derived handlers, like records
 	records *[]TestLogRecord
 	attrs   []slog.Attr
 	groups  []string
@@ -39,6 +39,7 @@ type TestLogAttr struct {
 func NewTestLogHandler() *TestLogHandler {
 	records := make([]TestLogRecord, 0)
 	return &TestLogHandler{
+		mu:      &sync.RWMutex{},
 		records: &records,
 	}
 }
@@ -90,6 +91,7 @@ func (h *TestLogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
 	defer h.mu.RUnlock()
 
 	return &TestLogHandler{
+		mu:      h.mu,
 		records: h.records,
 		attrs:   append(slices.Clone(h.attrs), attrs...),
 		groups:  slices.Clone(h.groups),
@@ -106,6 +108,7 @@ func (h *TestLogHandler) WithGroup(name string) slog.Handler {
 	defer h.mu.RUnlock()
 
 	return &TestLogHandler{
+		mu:      h.mu,
 		records: h.records,
 		attrs:   slices.Clone(h.attrs),
 		groups:  append(slices.Clone(h.groups), name),
@@ -0,0 +1,37 @@
+package caddypaseto
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// Keys of the request variables that contain the durations of the
+// authentication stages, e.g. {http.vars.paseto.timing.verify}.
+const (
+	timingExtractVarKey = "paseto.timing.extract"
+	timingVerifyVarKey  = "paseto.timing.verify"
+	timingRulesVarKey   = "paseto.timing.rules"
+)
+
+// authTiming is the time spent in each stage of authenticating a request,
+// summed over all candidate tokens.
+type authTiming struct {
+	// extract is the time spent extracting the candidate tokens.
+	extract time.Duration
+	// verify is the time spent verifying or decrypting the tokens, excluding
+	// the time spent waiting for a verification worker.
+	verify time.Duration
+	// rules is the time spent validating the claims, mapping the user, and
+	// verifying the HTTP signature and session binding.
+	rules time.Duration
+}
+
+// setVars sets the request variables of the stage durations, so that they can
+// be included in access logs, e.g. with the log_append handler.
+func (t *authTiming) setVars(r *http.Request) {
+	caddyhttp.SetVar(r.Context(), timingExtractVarKey, t.extract)
+	caddyhttp.SetVar(r.Context(), timingVerifyVarKey, t.verify)
+	caddyhttp.SetVar(r.Context(), timingRulesVarKey, t.rules)
+}
@@ -0,0 +1,46 @@
+package caddypaseto
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateTiming(t *testing.T) {
+	privateKey := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	auth := &PasetoAuth{
+		Key:    privateKey.Public().ExportHex(),
+		logger: slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	vars := make(map[string]any)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req = req.WithContext(context.WithValue(req.Context(), caddyhttp.VarsCtxKey, vars))
+	req.Header.Set("Authorization", "Bearer "+token.V4Sign(privateKey, nil))
+
+	_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+	require.NoError(t, err)
+	assert.True(t, authenticated)
+
+	for _, key := range []string{timingExtractVarKey, timingVerifyVarKey, timingRulesVarKey} {
+		assert.IsType(t, time.Duration(0), vars[key], key)
+	}
+	assert.Positive(t, vars[timingVerifyVarKey])
+}
@@ -0,0 +1,179 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// TokenExtraction values.
+const (
+	tokenExtractionAll   = "all"
+	tokenExtractionFirst = "first"
+)
+
+// Default limits of the candidate tokens of a request.
+const (
+	defaultMaxCandidates  = 10
+	defaultMaxTokenLength = 8 << 10
+)
+
+// sourceNames returns the configured names of the token source type.
+func (p *PasetoAuth) sourceNames(typ string) []string {
+	switch typ {
+	case sourceQuery:
+		return p.FromQuery
+	case sourceHeader:
+		return p.FromHeader
+	case sourceCookie:
+		return p.FromCookies
+	case sourceForm:
+		return p.FromForm
+	case sourceBody:
+		return p.FromBody
+	case sourcePath:
+		return p.FromPath
+	case sourceWebSocket:
+		return p.FromWebSocketProtocol
+	case sourceBasicAuth:
+		return p.FromBasicAuth
+	case sourceForwarded:
+		if p.FromForwardedAuthorization {
+			return []string{forwardedAuthorizationHeader}
+		}
+	}
+	return nil
+}
+
+// validateTokenSources validates the token source options, and applies the
+// default priority of the token source types, the default candidate token
+// limits, and the default Authorization scheme.
+func (p *PasetoAuth) validateTokenSources() []error {
+	errs := []error{
+		validateMaxSize(&p.FromFormMaxSize, defaultFromFormMaxSize, "from_form_max_size"),
+		validateMaxSize(&p.FromBodyMaxSize, defaultFromBodyMaxSize, "from_body_max_size"),
+		p.parsePathPatterns(),
+		p.validateForwardedAuthorization(),
+	}
+	switch p.TokenExtraction {
+	case "":
+		p.TokenExtraction = tokenExtractionAll
+	case tokenExtractionAll, tokenExtractionFirst:
+	default:
+		errs = append(errs, fmt.Errorf("invalid token_extraction: '%s'", p.TokenExtraction))
+	}
+
+	switch {
+	case p.MaxCandidates < 0:
+		errs = append(errs, fmt.Errorf("invalid max_candidates: '%d'", p.MaxCandidates))
+	case p.MaxCandidates == 0:
+		p.MaxCandidates = defaultMaxCandidates
+	}
+	errs = append(errs, validateMaxSize(&p.MaxTokenLength, defaultMaxTokenLength, "max_token_length"))
+
+	if len(p.AuthorizationSchemes) == 0 {
+		p.AuthorizationSchemes = []string{"Bearer"}
+	}
+	for _, scheme := range p.AuthorizationSchemes {
+		if scheme == "" || strings.ContainsAny(scheme, " \t") {
+			errs = append(errs, fmt.Errorf("invalid authorization_schemes: '%s'", scheme))
+		}
+	}
+
+	types := tokenSourceTypes()
+	if p.DisableImplicitAuthorization && !slices.ContainsFunc(types, func(typ string) bool {
+		return len(p.sourceNames(typ)) > 0
+	}) {
+		errs = append(errs, errors.New("disable_implicit_authorization requires a configured token source"))
+	}
+	if len(p.TokenSources) == 0 {
+		p.tokenSources = types
+		return errs
+	}
+	for i, typ := range p.TokenSources {
+		switch {
+		case !slices.Contains(types, typ):
+			errs = append(errs, fmt.Errorf("invalid token_sources: unknown source type '%s'", typ))
+		case slices.Contains(p.TokenSources[:i], typ):
+			errs = append(errs, fmt.Errorf("invalid token_sources: duplicate source type '%s'", typ))
+		}
+	}
+	// Sources that aren't listed would be ignored, which is likely a mistake.
+	for _, typ := range types {
+		if len(p.sourceNames(typ)) > 0 && !slices.Contains(p.TokenSources, typ) {
+			errs = append(errs, fmt.Errorf("invalid token_sources: from_%s is configured, but '%s' isn't listed",
+				fromOptionSuffix(typ), typ))
+		}
+	}
+	p.tokenSources = p.TokenSources
+
+	return errs
+}
+
+// fromOptionSuffix returns the suffix of the from_* option of the token source
+// type, e.g. "cookies" for from_cookies.
+func fromOptionSuffix(typ string) string {
+	switch typ {
+	case sourceCookie:
+		return "cookies"
+	case sourceWebSocket:
+		return "websocket_protocol"
+	case sourceBasicAuth:
+		return "basic_auth"
+	case sourceForwarded:
+		return "forwarded_authorization"
+	}
+	return typ
+}
+
+// resolveSourceNames returns the source names with their placeholders replaced
+// with the values of the request, e.g. "sess_{http.request.host}". Names that
+// resolve to an empty string are dropped.
+func resolveSourceNames(r *http.Request, names []string) []string {
+	if !slices.ContainsFunc(names, hasPlaceholder) {
+		return names
+	}
+	repl := getReplacer(r)
+	resolved := make([]string, 0, len(names))
+	for _, name := range names {
+		if name = repl.ReplaceAll(name, ""); name != "" {
+			resolved = append(resolved, name)
+		}
+	}
+	return resolved
+}
+
+// sourceTokens returns the candidate tokens of the request from the sources of
+// the type, that the client is allowed to use.
+func (p *PasetoAuth) sourceTokens(r *http.Request, typ string) []string {
+	names := p.allowedSources(r, typ, p.sourceNames(typ))
+	switch typ {
+	case sourceQuery:
+		return getTokensFromQuery(r, names)
+	case sourceHeader:
+		return p.headerTokens(r, resolveSourceNames(r, names))
+	case sourceCookie:
+		tokens, duplicates := getTokensFromCookies(r, resolveSourceNames(r, names))
+		if len(duplicates) > 0 {
+			p.logger.Warn("request has multiple cookies with the same name, trying all of them", "cookies", duplicates,
+				"hint", "the cookies were likely set for different domains or paths, e.g. both example.com and "+
+					"app.example.com; clear the stale cookie, or use a __Host- prefixed cookie name")
+		}
+		return tokens
+	case sourceForm:
+		return p.formTokens(r, names)
+	case sourceBody:
+		return p.bodyTokens(r, names)
+	case sourcePath:
+		return p.pathTokens(r, names)
+	case sourceWebSocket:
+		return webSocketTokens(r, names)
+	case sourceBasicAuth:
+		return basicAuthTokens(r, names)
+	case sourceForwarded:
+		return p.forwardedTokens(r, names)
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_CandidateTokens(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+	newRequest := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/?token=query-token", nil)
+		req.Header.Set("X-Token", "header-token")
+		req.Header.Set("Authorization", "Bearer auth-token")
+		req.AddCookie(&http.Cookie{Name: "session", Value: "cookie-token"})
+		return req
+	}
+
+	tests := []struct {
+		name       string
+		sources    []string
+		extraction string
+		exp        []string
+	}{
+		{
+			name: "ok/default",
+			exp:  []string{"query-token", "header-token", "cookie-token", "auth-token"},
+		},
+		{
+			name:    "ok/order",
+			sources: []string{"cookie", "header", "query"},
+			exp:     []string{"cookie-token", "header-token", "query-token", "auth-token"},
+		},
+		{
+			name:       "ok/first",
+			sources:    []string{"header", "cookie", "query"},
+			extraction: tokenExtractionFirst,
+			exp:        []string{"header-token"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:             key,
+				FromQuery:       []string{"token"},
+				FromHeader:      []string{"X-Token"},
+				FromCookies:     []string{"session"},
+				TokenSources:    tt.sources,
+				TokenExtraction: tt.extraction,
+				logger:          slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+			assert.Equal(t, tt.exp, auth.candidateTokens(newRequest()))
+		})
+	}
+
+	t.Run("ok/first_authorization", func(t *testing.T) {
+		auth := &PasetoAuth{
+			Key:             key,
+			FromQuery:       []string{"token"},
+			TokenExtraction: tokenExtractionFirst,
+			logger:          slog.New(testutil.NewTestLogHandler()),
+		}
+		require.NoError(t, auth.Validate())
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer auth-token")
+		assert.Equal(t, []string{"auth-token"}, auth.candidateTokens(req))
+	})
+}
+
+func TestPasetoAuth_CandidateTokensNoImplicitAuthorization(t *testing.T) {
+	auth := &PasetoAuth{
+		Key:                          paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		FromHeader:                   []string{"X-Token"},
+		DisableImplicitAuthorization: true,
+		logger:                       slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("X-Token", "header-token")
+	req.Header.Set("Authorization", "Bearer auth-token")
+	assert.Equal(t, []string{"header-token"}, auth.candidateTokens(req))
+
+	// The Authorization header can still be listed explicitly.
+	auth.FromHeader = append(auth.FromHeader, "Authorization")
+	assert.Equal(t, []string{"header-token", "auth-token"}, auth.candidateTokens(req))
+}
+
+func TestPasetoAuth_CandidateTokensRepeatedValues(t *testing.T) {
+	auth := &PasetoAuth{
+		Key:        paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		FromQuery:  []string{"token"},
+		FromHeader: []string{"X-Token"},
+		logger:     slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	req := httptest.NewRequest(http.MethodGet, "/?token=query-1&token=&token=query-2&token=query-1", nil)
+	req.Header.Add("X-Token", "header-1")
+	req.Header.Add("X-Token", "header-2")
+	req.Header.Add("Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Add("Authorization", "Bearer auth-token")
+	assert.Equal(t, []string{"query-1", "query-2", "header-1", "header-2", "auth-token"}, auth.candidateTokens(req))
+}
+
+func TestPasetoAuth_CandidateTokensPlaceholders(t *testing.T) {
+	auth := &PasetoAuth{
+		Key:         paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		FromHeader:  []string{"X-{http.request.host.labels.2}-Token"},
+		FromCookies: []string{"sess_{http.request.host}", "{http.request.uri.query.missing}"},
+		logger:      slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	req := httptest.NewRequest(http.MethodGet, "http://app.example.com/", nil)
+	req.Header.Set("X-Example-Token", "other-token")
+	req.Header.Set("X-App-Token", "header-token")
+	req.AddCookie(&http.Cookie{Name: "sess_app.example.com", Value: "cookie-token"})
+	req.AddCookie(&http.Cookie{Name: "sess_example.com", Value: "other-token"})
+	caddyhttp.NewTestReplacer(req)
+	assert.Equal(t, []string{"header-token", "cookie-token"}, auth.candidateTokens(req))
+}
+
+func TestPasetoAuth_CandidateTokensLimits(t *testing.T) {
+	auth := &PasetoAuth{
+		Key:            paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		FromQuery:      []string{"token"},
+		MaxCandidates:  2,
+		MaxTokenLength: 8,
+		logger:         slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	req := httptest.NewRequest(http.MethodGet, "/?token=too-long-token&token=a&token=a&token=b&token=c", nil)
+	req.Header.Set("Authorization", "Bearer d")
+	assert.Equal(t, []string{"a", "b"}, auth.candidateTokens(req))
+}
+
+func TestPasetoAuth_AuthorizationSchemes(t *testing.T) {
+	tests := []struct {
+		name     string
+		schemes  []string
+		required bool
+		header   string
+		exp      []string
+	}{
+		{name: "ok/default_bearer", header: "bearer my-token", exp: []string{"my-token"}},
+		{name: "ok/bare", header: "my-token", exp: []string{"my-token"}},
+		{name: "ok/custom", schemes: []string{"Bearer", "PASETO"}, header: "Paseto  my-token", exp: []string{"my-token"}},
+		{name: "err/default_other_scheme", header: "Basic dXNlcjpwYXNz"},
+		{name: "err/unaccepted", schemes: []string{"PASETO"}, header: "Bearer my-token"},
+		{name: "err/bare_required", required: true, header: "my-token"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			auth := &PasetoAuth{
+				Key:                        paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+				AuthorizationSchemes:       tt.schemes,
+				RequireAuthorizationScheme: tt.required,
+				logger:                     slog.New(testutil.NewTestLogHandler()),
+			}
+			require.NoError(t, auth.Validate())
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", tt.header)
+			if tt.exp == nil {
+				assert.Empty(t, auth.candidateTokens(req))
+				return
+			}
+			assert.Equal(t, tt.exp, auth.candidateTokens(req))
+		})
+	}
+}
+
+func TestPasetoAuth_ValidateTokenSources(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey().Public().ExportHex()
+
+	tests := []struct {
+		name   string
+		config PasetoAuth
+		expErr string
+	}{
+		{
+			name:   "err/unknown",
+			config: PasetoAuth{Key: key, TokenSources: []string{"header", "url"}},
+			expErr: "invalid token_sources: unknown source type 'url'",
+		},
+		{
+			name:   "err/duplicate",
+			config: PasetoAuth{Key: key, TokenSources: []string{"header", "header"}},
+			expErr: "invalid token_sources: duplicate source type 'header'",
+		},
+		{
+			name:   "err/unlisted",
+			config: PasetoAuth{Key: key, FromCookies: []string{"session"}, TokenSources: []string{"header"}},
+			expErr: "invalid token_sources: from_cookies is configured, but 'cookie' isn't listed",
+		},
+		{
+			name:   "err/no_sources",
+			config: PasetoAuth{Key: key, DisableImplicitAuthorization: true},
+			expErr: "disable_implicit_authorization requires a configured token source",
+		},
+		{
+			name:   "err/schemes_strict_bearer",
+			config: PasetoAuth{Key: key, StrictBearer: true, AuthorizationSchemes: []string{"PASETO"}},
+			expErr: "authorization_schemes can't be used with strict_bearer",
+		},
+		{
+			name:   "err/invalid_scheme",
+			config: PasetoAuth{Key: key, AuthorizationSchemes: []string{"Bearer PASETO"}},
+			expErr: "invalid authorization_schemes: 'Bearer PASETO'",
+		},
+		{
+			name:   "err/max_candidates",
+			config: PasetoAuth{Key: key, MaxCandidates: -1},
+			expErr: "invalid max_candidates: '-1'",
+		},
+		{
+			name:   "err/max_token_length",
+			config: PasetoAuth{Key: key, MaxTokenLength: -1},
+			expErr: "invalid max_token_length: '-1'",
+		},
+		{
+			name:   "err/extraction",
+			config: PasetoAuth{Key: key, TokenExtraction: "last"},
+			expErr: "invalid token_extraction: 'last'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.config.logger = slog.New(testutil.NewTestLogHandler())
+			require.ErrorContains(t, tt.config.Validate(), tt.expErr)
+		})
+	}
+}
@@ -1,13 +1,18 @@
 package caddypaseto
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/caddyserver/caddy/v2"
+
 	"go.hackfix.me/paseto-cli/xpaseto"
 )
 
@@ -26,53 +31,142 @@ func normToken(token string) string {
 	return strings.TrimSpace(token)
 }
 
-func getTokensFromHeader(r *http.Request, names []string) []string {
-	tokens := make([]string, 0)
-	for _, key := range names {
-		token := r.Header.Get(key)
-		if token != "" {
-			tokens = append(tokens, token)
+// strictBearerToken returns the token of the Authorization header values, if
+// there's a single value with the "Bearer" scheme, a single space, and a token
+// in the b64token syntax of RFC 6750.
+func strictBearerToken(values []string) (string, bool) {
+	if len(values) != 1 {
+		return "", false
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok || token == "" {
+		return "", false
+	}
+
+	// b64token = 1*( ALPHA / DIGIT / "-" / "." / "_" / "~" / "+" / "/" ) *"="
+	body := strings.TrimRight(token, "=")
+	if body == "" {
+		return "", false
+	}
+	for _, c := range body {
+		if !isAlphaNum(c) && !strings.ContainsRune("-._~+/", c) {
+			return "", false
 		}
 	}
-	return tokens
+
+	return token, true
+}
+
+func isAlphaNum(c rune) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
 }
 
+// getTokensFromQuery returns all values of the query string parameters with the
+// names, in the order they were sent.
 func getTokensFromQuery(r *http.Request, names []string) []string {
 	tokens := make([]string, 0)
 	query := r.URL.Query()
 	for _, key := range names {
-		token := query.Get(key)
-		if token != "" {
-			tokens = append(tokens, token)
+		for _, token := range query[key] {
+			if token != "" {
+				tokens = append(tokens, token)
+			}
 		}
 	}
 	return tokens
 }
 
-func getTokensFromCookies(r *http.Request, names []string) []string {
+// getTokensFromCookies returns the values of all cookies with the names.
+// Browsers send multiple cookies with the same name if they were set for
+// different domains or paths, usually by mistake, and only one of them may be
+// valid, so all of them are returned, in the order they were sent. The names
+// of such duplicate cookies are returned as well.
+func getTokensFromCookies(r *http.Request, names []string) ([]string, []string) {
 	tokens := make([]string, 0)
+	var duplicates []string
 	for _, key := range names {
-		if ck, err := r.Cookie(key); err == nil && ck.Value != "" {
-			tokens = append(tokens, ck.Value)
+		var count int
+		for _, ck := range r.CookiesNamed(key) {
+			if ck.Value != "" {
+				tokens = append(tokens, ck.Value)
+				count++
+			}
+		}
+		if count > 1 {
+			duplicates = append(duplicates, key)
 		}
 	}
-	return tokens
+	return tokens, duplicates
 }
 
-func getUserID(claims map[string]any, names []string) (string, string) {
-	for _, name := range names {
-		if userClaim, ok := claims[name]; ok {
-			switch val := userClaim.(type) {
-			case string:
-				return name, val
-			case float64:
-				return name, strconv.FormatFloat(val, 'f', -1, 64)
-			}
+// userClaim is a user claim name with an optional transform of its value.
+type userClaim struct {
+	name      string
+	transform func(string) string
+}
+
+// parseUserClaim parses a user claim in the form `<claim>[:<transform>]`, where
+// transform is one of "lowercase", "uppercase", "strip-prefix=<prefix>" or
+// "strip-suffix=<suffix>". E.g. "sub:strip-prefix=auth0|".
+func parseUserClaim(key string) (userClaim, error) {
+	name, spec, found := strings.Cut(key, ":")
+	if name == "" {
+		return userClaim{}, fmt.Errorf("empty claim in key %q", key)
+	}
+	if !found {
+		return userClaim{name: name}, nil
+	}
+
+	transform, arg, hasArg := strings.Cut(spec, "=")
+	claim := userClaim{name: name}
+	switch {
+	case transform == "lowercase" && !hasArg:
+		claim.transform = strings.ToLower
+	case transform == "uppercase" && !hasArg:
+		claim.transform = strings.ToUpper
+	case transform == "strip-prefix" && arg != "":
+		claim.transform = func(val string) string { return strings.TrimPrefix(val, arg) }
+	case transform == "strip-suffix" && arg != "":
+		claim.transform = func(val string) string { return strings.TrimSuffix(val, arg) }
+	default:
+		return userClaim{}, fmt.Errorf("invalid transform %q in key %q", spec, key)
+	}
+
+	return claim, nil
+}
+
+// getUserID returns the name and the transformed value of the first user claim
+// with a non-empty value.
+func getUserID(claims map[string]any, userClaims []userClaim) (string, string) {
+	for _, uc := range userClaims {
+		var id string
+		switch val := claims[uc.name].(type) {
+		case string:
+			id = val
+		case float64:
+			id = strconv.FormatFloat(val, 'f', -1, 64)
+		}
+		if id != "" && uc.transform != nil {
+			id = uc.transform(id)
+		}
+		if id != "" {
+			return uc.name, id
 		}
 	}
 	return "", ""
 }
 
+// claimHasValue reports whether the claim value is equal to want. If the claim
+// value is an array, any of its elements must be equal to want.
+func claimHasValue(claimValue any, want string) bool {
+	if slice, ok := claimValue.([]any); ok {
+		return slices.ContainsFunc(slice, func(val any) bool {
+			return stringify(val) == want
+		})
+	}
+	return stringify(claimValue) == want
+}
+
 func getUserMetadata(token *xpaseto.Token, placeholdersMap map[string]string) map[string]string {
 	if len(placeholdersMap) == 0 {
 		return nil
@@ -81,12 +175,7 @@ func getUserMetadata(token *xpaseto.Token, placeholdersMap map[string]string) ma
 	claims := token.ClaimsRaw()
 	metadata := make(map[string]string)
 	for claimName, placeholder := range placeholdersMap {
-		claimValue, ok := claims[claimName]
-
-		// Query nested claims.
-		if !ok && strings.Contains(claimName, ".") {
-			claimValue, ok = queryNested(claims, strings.Split(claimName, "."))
-		}
+		claimValue, ok := getClaim(claims, claimName)
 		if !ok {
 			metadata[placeholder] = ""
 			continue
@@ -97,19 +186,51 @@ func getUserMetadata(token *xpaseto.Token, placeholdersMap map[string]string) ma
 	return metadata
 }
 
+// cacheKeyPlaceholder is the name of the user metadata value that contains the
+// cache key, i.e. {http.auth.user.cache_key}.
+const cacheKeyPlaceholder = "cache_key"
+
+// getCacheKey returns the hex encoded SHA-256 digest of the values of the named
+// claims. The values are JSON encoded before hashing, so that different values
+// can't produce the same input by containing delimiters.
+func getCacheKey(claims map[string]any, names []string) string {
+	values := make([]string, 0, len(names))
+	for _, name := range names {
+		claimValue, _ := getClaim(claims, name)
+		values = append(values, stringify(claimValue))
+	}
+
+	// Encoding a slice of strings can't fail.
+	data, _ := json.Marshal(values)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:])
+}
+
+// getClaim returns the value of the named claim. Nested claims can be queried
+// with dot notation.
+func getClaim(claims map[string]any, name string) (any, bool) {
+	claimValue, ok := claims[name]
+	if !ok && strings.Contains(name, ".") {
+		claimValue, ok = queryNested(claims, strings.Split(name, "."))
+	}
+	return claimValue, ok
+}
+
 func queryNested(claims map[string]any, path []string) (any, bool) {
 	var (
 		object = claims
 		ok     bool
 	)
-	for i := range len(path) {
+	for i := range len(path) - 1 {
 		if object, ok = object[path[i]].(map[string]any); !ok || object == nil {
 			return nil, false
 		}
 	}
 
 	lastKey := path[len(path)-1]
-	return object[lastKey], true
+	val, ok := object[lastKey]
+	return val, ok
 }
 
 func stringify(val any) string {
@@ -172,3 +293,43 @@ func parseMetaClaim(key string) (claim, placeholder string, err error) {
 	}
 	return
 }
+
+// writeRejection writes a response with the given status code and body. It's
+// used when a request must be rejected with a status other than the 401
+// returned by the authentication handler. PasetoAuthHandler doesn't return the
+// 401 error once the response is written.
+func writeRejection(w http.ResponseWriter, status int, body string) {
+	if body == "" {
+		body = http.StatusText(status)
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write([]byte(body))
+}
+
+// discardResponseWriter is a response writer that discards the response, but
+// keeps the headers, so that they can be inspected.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w *discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w *discardResponseWriter) WriteHeader(int) {}
+
+// getReplacer returns the replacer of the request, or a new one if the request
+// doesn't have one.
+func getReplacer(r *http.Request) *caddy.Replacer {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		return repl
+	}
+	return caddy.NewReplacer()
+}
@@ -0,0 +1,85 @@
+package caddypaseto
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+)
+
+// errVerifyBudget is returned instead of verifying a token when the
+// verification budget of the request is exhausted.
+var errVerifyBudget = errors.New("token verification budget is exhausted")
+
+// VerifyBudget bounds the verification work done for a single request, so that
+// a request with many candidate tokens, e.g. from several token sources, can't
+// add unbounded latency. Once the budget is exhausted, the remaining candidate
+// tokens are skipped, and the request fails authentication.
+type VerifyBudget struct {
+	// MaxTime is the maximum total time spent verifying or decrypting the
+	// tokens of a request, excluding the time spent waiting for a VerifyPool
+	// worker. It's checked before each attempt, so the last attempt can exceed
+	// it.
+	MaxTime time.Duration `json:"max_time,omitempty"`
+
+	// MaxOperations is the maximum amount of verification or decryption
+	// attempts of a request, i.e. of tokens tried with a key.
+	MaxOperations int `json:"max_operations,omitempty"`
+}
+
+func (vb *VerifyBudget) provision() error {
+	switch {
+	case vb.MaxTime < 0:
+		return fmt.Errorf("invalid verify_budget: negative max time: '%s'", vb.MaxTime)
+	case vb.MaxOperations < 0:
+		return fmt.Errorf("invalid verify_budget: negative max operations: %d", vb.MaxOperations)
+	case vb.MaxTime == 0 && vb.MaxOperations == 0:
+		return errors.New("invalid verify_budget: expected max_time or max_operations")
+	}
+
+	return nil
+}
+
+// verifyBudget is the verification work done for a request. A nil budget is
+// never exhausted.
+type verifyBudget struct {
+	cfg  *VerifyBudget
+	ops  int
+	used time.Duration
+}
+
+func (p *PasetoAuth) newVerifyBudget() *verifyBudget {
+	if p.VerifyBudget == nil {
+		return nil
+	}
+	return &verifyBudget{cfg: p.VerifyBudget}
+}
+
+// exhausted reports whether no more verification attempts can be made.
+func (b *verifyBudget) exhausted() bool {
+	if b == nil {
+		return false
+	}
+	return (b.cfg.MaxOperations > 0 && b.ops >= b.cfg.MaxOperations) ||
+		(b.cfg.MaxTime > 0 && b.used >= b.cfg.MaxTime)
+}
+
+// skip reports whether the remaining candidate tokens must be skipped, since the
+// budget is exhausted, and logs them if so.
+func (b *verifyBudget) skip(remaining int, logger *slog.Logger) bool {
+	if !b.exhausted() {
+		return false
+	}
+	logger.Warn(errVerifyBudget.Error()+", skipping the remaining tokens", "skipped", remaining,
+		"operations", b.ops, "time", b.used)
+	return true
+}
+
+// spend records a verification attempt that took d.
+func (b *verifyBudget) spend(d time.Duration) {
+	if b == nil {
+		return
+	}
+	b.ops++
+	b.used += d
+}
@@ -0,0 +1,105 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateVerifyBudget(t *testing.T) {
+	validKey := paseto.NewV4AsymmetricSecretKey()
+	otherKeys := []string{
+		paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+	}
+	unknownKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+
+	tests := []struct {
+		name      string
+		budget    *VerifyBudget
+		expAuth   bool
+		expWarn   string
+		expNoWarn string
+	}{
+		{
+			name:      "ok/no_budget",
+			expAuth:   true,
+			expNoWarn: "token verification budget is exhausted",
+		},
+		{
+			name:      "ok/within_budget",
+			budget:    &VerifyBudget{MaxOperations: 7, MaxTime: time.Minute},
+			expAuth:   true,
+			expNoWarn: "token verification budget is exhausted",
+		},
+		{
+			// The first invalid token is tried with all 3 keys, and the second
+			// one with a single key.
+			name:    "err/max_operations",
+			budget:  &VerifyBudget{MaxOperations: 4},
+			expWarn: "token verification budget is exhausted, skipping the remaining tokens",
+		},
+		{
+			name:    "err/max_time",
+			budget:  &VerifyBudget{MaxTime: time.Nanosecond},
+			expWarn: "token verification budget is exhausted, skipping the remaining tokens",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logHandler := testutil.NewTestLogHandler()
+			auth := &PasetoAuth{
+				Keys:         append([]string{validKey.Public().ExportHex()}, otherKeys...),
+				FromQuery:    []string{"token", "access_token"},
+				FromHeader:   []string{"Authorization"},
+				VerifyBudget: tt.budget,
+				logger:       slog.New(logHandler),
+			}
+			require.NoError(t, auth.Validate())
+
+			// Two invalid tokens in the query string are tried before the
+			// valid one in the header.
+			req := httptest.NewRequest(http.MethodGet,
+				"/?token="+token.V4Sign(unknownKey, nil)+"&access_token="+token.V4Sign(unknownKey, []byte("x")), nil)
+			req.Header.Set("Authorization", "Bearer "+token.V4Sign(validKey, nil))
+			_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expWarn != "" {
+				assert.True(t, logHandler.HasRecord(slog.LevelWarn, tt.expWarn))
+			}
+			if tt.expNoWarn != "" {
+				assert.False(t, logHandler.HasRecord(slog.LevelWarn, tt.expNoWarn))
+			}
+		})
+	}
+}
+
+func TestVerifyBudget_Provision(t *testing.T) {
+	cfg := &VerifyBudget{MaxOperations: 4}
+	require.NoError(t, cfg.provision())
+
+	cfg = &VerifyBudget{}
+	require.EqualError(t, cfg.provision(), "invalid verify_budget: expected max_time or max_operations")
+
+	cfg = &VerifyBudget{MaxTime: -time.Second}
+	require.EqualError(t, cfg.provision(), "invalid verify_budget: negative max time: '-1s'")
+
+	cfg = &VerifyBudget{MaxOperations: -1}
+	require.EqualError(t, cfg.provision(), "invalid verify_budget: negative max operations: -1")
+}
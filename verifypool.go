@@ -0,0 +1,85 @@
+package caddypaseto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime"
+)
+
+// errVerifyShed is returned instead of verifying a token when the verification
+// queue is full.
+var errVerifyShed = errors.New("token verification queue is full")
+
+// VerifyPool bounds the amount of token verifications that run concurrently.
+// Verifications beyond Workers wait in a queue, and requests that would exceed
+// QueueDepth are rejected with a 503 response, so that a flood of invalid
+// tokens can't consume every CPU core and starve other traffic.
+type VerifyPool struct {
+	// Workers is the maximum amount of concurrent verifications. The default is
+	// the amount of usable CPU cores.
+	Workers int `json:"workers,omitempty"`
+
+	// QueueDepth is the maximum amount of verifications that wait for a worker.
+	// The default is 8 times Workers.
+	QueueDepth int `json:"queue_depth,omitempty"`
+}
+
+func (vp *VerifyPool) provision() error {
+	if vp.Workers < 0 {
+		return fmt.Errorf("invalid verify_pool: negative workers: %d", vp.Workers)
+	} else if vp.Workers == 0 {
+		vp.Workers = runtime.GOMAXPROCS(0)
+	}
+	if vp.QueueDepth < 0 {
+		return fmt.Errorf("invalid verify_pool: negative queue depth: %d", vp.QueueDepth)
+	} else if vp.QueueDepth == 0 {
+		vp.QueueDepth = 8 * vp.Workers
+	}
+
+	return nil
+}
+
+// verifyPool limits concurrent verifications with two semaphores: admitted
+// holds the running and queued verifications, and running only the former. A
+// nil pool doesn't limit verifications.
+type verifyPool struct {
+	admitted chan struct{}
+	running  chan struct{}
+	metrics  *metrics
+}
+
+func newVerifyPool(cfg *VerifyPool, m *metrics) *verifyPool {
+	return &verifyPool{
+		admitted: make(chan struct{}, cfg.Workers+cfg.QueueDepth),
+		running:  make(chan struct{}, cfg.Workers),
+		metrics:  m,
+	}
+}
+
+// acquire waits for a worker, and returns a function that releases it. It
+// returns errVerifyShed without waiting if the queue is full, or the context
+// error if the context is done while waiting.
+func (vp *verifyPool) acquire(ctx context.Context) (func(), error) {
+	if vp == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case vp.admitted <- struct{}{}:
+	default:
+		vp.metrics.incVerificationsShed()
+		return nil, errVerifyShed
+	}
+
+	select {
+	case vp.running <- struct{}{}:
+		return func() {
+			<-vp.running
+			<-vp.admitted
+		}, nil
+	case <-ctx.Done():
+		<-vp.admitted
+		return nil, fmt.Errorf("failed waiting for a verification worker: %w", ctx.Err())
+	}
+}
@@ -0,0 +1,131 @@
+package caddypaseto
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestVerifyPool(t *testing.T) {
+	reg := prometheus.NewPedanticRegistry()
+	m, err := newMetrics(reg)
+	require.NoError(t, err)
+
+	cfg := &VerifyPool{Workers: 1, QueueDepth: 1}
+	require.NoError(t, cfg.provision())
+	vp := newVerifyPool(cfg, m)
+
+	release, err := vp.acquire(context.Background())
+	require.NoError(t, err)
+
+	// The second verification waits in the queue, until it's canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	queued := make(chan error)
+	go func() {
+		_, qErr := vp.acquire(ctx)
+		queued <- qErr
+	}()
+	assert.Eventually(t, func() bool { return len(vp.admitted) == 2 }, time.Second, time.Millisecond)
+
+	// The third one exceeds the queue depth.
+	_, err = vp.acquire(context.Background())
+	require.ErrorIs(t, err, errVerifyShed)
+	assert.Equal(t, 1.0, gatherValue(t, reg, "caddy_paseto_verifications_shed_total"))
+
+	cancel()
+	require.ErrorIs(t, <-queued, context.Canceled)
+
+	// Releasing the worker makes room for another verification.
+	release()
+	release, err = vp.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+	assert.Empty(t, vp.admitted)
+
+	// A nil pool doesn't limit verifications.
+	var nilPool *verifyPool
+	release, err = nilPool.acquire(context.Background())
+	require.NoError(t, err)
+	release()
+}
+
+func TestVerifyPool_Provision(t *testing.T) {
+	cfg := &VerifyPool{Workers: 2}
+	require.NoError(t, cfg.provision())
+	assert.Equal(t, 16, cfg.QueueDepth)
+
+	cfg = &VerifyPool{Workers: -1}
+	require.EqualError(t, cfg.provision(), "invalid verify_pool: negative workers: -1")
+
+	cfg = &VerifyPool{QueueDepth: -1}
+	require.EqualError(t, cfg.provision(), "invalid verify_pool: negative queue depth: -1")
+}
+
+func TestPasetoAuth_AuthenticateVerifyPool(t *testing.T) {
+	v4PrivateKey := paseto.NewV4AsymmetricSecretKey()
+
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(v4PrivateKey, nil)
+
+	auth := &PasetoAuth{
+		Key:        v4PrivateKey.Public().ExportHex(),
+		FromQuery:  []string{"token"},
+		VerifyPool: &VerifyPool{Workers: 1, QueueDepth: 1},
+		logger:     slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	t.Run("ok", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		assert.True(t, authenticated)
+		assert.Equal(t, "user123", user.ID)
+	})
+
+	t.Run("err/shed", func(t *testing.T) {
+		// Occupy the worker and the queue.
+		for range 2 {
+			auth.verifyPool.admitted <- struct{}{}
+		}
+		t.Cleanup(func() {
+			for range 2 {
+				<-auth.verifyPool.admitted
+			}
+		})
+
+		req := httptest.NewRequest(http.MethodGet, "/?token="+tokenStr, nil)
+		rec := httptest.NewRecorder()
+		_, authenticated, err := auth.Authenticate(rec, req)
+		require.NoError(t, err)
+		assert.False(t, authenticated)
+		assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+		assert.Equal(t, "1", rec.Header().Get("Retry-After"))
+	})
+
+	t.Run("err/canceled", func(t *testing.T) {
+		auth.verifyPool.running <- struct{}{}
+		t.Cleanup(func() { <-auth.verifyPool.running })
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		req := httptest.NewRequestWithContext(ctx, http.MethodGet, "/?token="+tokenStr, nil)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.ErrorIs(t, err, context.Canceled)
+		assert.False(t, authenticated)
+	})
+}
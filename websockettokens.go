@@ -0,0 +1,68 @@
+package caddypaseto
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// webSocketProtocolHeader is the header of the subprotocols that a WebSocket
+// client requests, and the one that the server accepted.
+const webSocketProtocolHeader = "Sec-WebSocket-Protocol"
+
+// webSocketProtocols returns the subprotocols that the client requested, in
+// order of preference, or nil if the request isn't a WebSocket upgrade request.
+func webSocketProtocols(r *http.Request) []string {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return nil
+	}
+	var protocols []string
+	for _, value := range r.Header.Values(webSocketProtocolHeader) {
+		for _, proto := range strings.Split(value, ",") {
+			if proto = strings.TrimSpace(proto); proto != "" {
+				protocols = append(protocols, proto)
+			}
+		}
+	}
+	return protocols
+}
+
+// webSocketTokens returns the subprotocols of the request that follow the
+// marker subprotocols in names.
+func webSocketTokens(r *http.Request, names []string) []string {
+	tokens := make([]string, 0)
+	protocols := webSocketProtocols(r)
+	for i := 0; i < len(protocols)-1; i++ {
+		if slices.Contains(names, protocols[i]) {
+			tokens = append(tokens, protocols[i+1])
+		}
+	}
+	return tokens
+}
+
+// stripWebSocketToken removes the marker and the token from the requested
+// subprotocols, if the token was taken from them, so that the token isn't
+// passed to the next handlers. If the client requested no other subprotocols,
+// the marker is accepted on the response, since browsers fail the connection
+// if none of the requested subprotocols is accepted. Otherwise, selecting one
+// of the remaining subprotocols is left to the next handlers, e.g. the
+// upstream.
+func (p *PasetoAuth) stripWebSocketToken(w http.ResponseWriter, r *http.Request, tokenStr string) {
+	if len(p.FromWebSocketProtocol) == 0 {
+		return
+	}
+	protocols := webSocketProtocols(r)
+	for i := 0; i < len(protocols)-1; i++ {
+		if !slices.Contains(p.FromWebSocketProtocol, protocols[i]) || normToken(protocols[i+1]) != tokenStr {
+			continue
+		}
+		marker := protocols[i]
+		if protocols = slices.Delete(protocols, i, i+2); len(protocols) == 0 {
+			r.Header.Del(webSocketProtocolHeader)
+			w.Header().Set(webSocketProtocolHeader, marker)
+		} else {
+			r.Header.Set(webSocketProtocolHeader, strings.Join(protocols, ", "))
+		}
+		return
+	}
+}
@@ -0,0 +1,95 @@
+package caddypaseto
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoAuth_AuthenticateFromWebSocketProtocol(t *testing.T) {
+	key := paseto.NewV4AsymmetricSecretKey()
+	token := paseto.NewToken()
+	token.SetIssuedAt(time.Now())
+	token.SetNotBefore(time.Now())
+	token.SetExpiration(time.Now().Add(time.Hour))
+	token.SetSubject("user123")
+	tokenStr := token.V4Sign(key, nil)
+
+	auth := &PasetoAuth{
+		Key:                   key.Public().ExportHex(),
+		FromWebSocketProtocol: []string{"paseto"},
+		logger:                slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	tests := []struct {
+		name        string
+		upgrade     string
+		protocols   []string
+		expAuth     bool
+		expRequest  []string
+		expResponse string
+	}{
+		{
+			name:        "ok/only_token",
+			upgrade:     "websocket",
+			protocols:   []string{"paseto, " + tokenStr},
+			expAuth:     true,
+			expResponse: "paseto",
+		},
+		{
+			name:       "ok/other_protocols",
+			upgrade:    "WebSocket",
+			protocols:  []string{"chat", "paseto, " + tokenStr + ", json"},
+			expAuth:    true,
+			expRequest: []string{"chat, json"},
+		},
+		{
+			name:       "err/no_marker",
+			upgrade:    "websocket",
+			protocols:  []string{tokenStr},
+			expRequest: []string{tokenStr},
+		},
+		{
+			name:       "err/marker_last",
+			upgrade:    "websocket",
+			protocols:  []string{tokenStr + ", paseto"},
+			expRequest: []string{tokenStr + ", paseto"},
+		},
+		{
+			name:       "err/not_upgrade",
+			protocols:  []string{"paseto, " + tokenStr},
+			expRequest: []string{"paseto, " + tokenStr},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+			if tt.upgrade != "" {
+				req.Header.Set("Connection", "Upgrade")
+				req.Header.Set("Upgrade", tt.upgrade)
+			}
+			for _, proto := range tt.protocols {
+				req.Header.Add("Sec-WebSocket-Protocol", proto)
+			}
+			rec := httptest.NewRecorder()
+			user, authenticated, err := auth.Authenticate(rec, req)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expAuth, authenticated)
+			if tt.expAuth {
+				assert.Equal(t, "user123", user.ID)
+			}
+			assert.Equal(t, tt.expRequest, req.Header.Values("Sec-WebSocket-Protocol"))
+			assert.Equal(t, tt.expResponse, rec.Header().Get("Sec-WebSocket-Protocol"))
+		})
+	}
+}
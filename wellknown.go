@@ -0,0 +1,201 @@
+package caddypaseto
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func init() {
+	caddy.RegisterModule(PasetoWellKnown{})
+}
+
+// wellKnownVarKey is the key of the request variable that contains the token
+// policy document of the pasetoauth provider.
+const wellKnownVarKey = "paseto.well_known"
+
+// defaultWellKnownPath is the default path of the token policy document.
+const defaultWellKnownPath = "/.well-known/paseto-auth"
+
+// tokenPolicy is the document that describes the tokens accepted by a
+// pasetoauth provider, so that clients can configure themselves against the
+// live configuration. It doesn't contain keys or other secrets.
+type tokenPolicy struct {
+	Version paseto.Version `json:"version"`
+	Purpose paseto.Purpose `json:"purpose"`
+	// RequiredClaims are the claims that every token must have.
+	RequiredClaims []string `json:"required_claims"`
+	// UserClaims are the claims the user ID is taken from, in order of
+	// priority. It's empty if a claim mapper is used.
+	UserClaims    []string `json:"user_claims,omitempty"`
+	Audiences     []string `json:"audiences,omitempty"`
+	AudienceMatch string   `json:"audience_match,omitempty"`
+	Issuers       []string `json:"issuers,omitempty"`
+	TokenType     string   `json:"token_type,omitempty"`
+	// AudienceFromHost is true if the audience must match the host of the
+	// request.
+	AudienceFromHost bool `json:"audience_from_host,omitempty"`
+	// Roles are the allowed roles of the RolesClaim claim.
+	Roles []string `json:"roles,omitempty"`
+	// RequiredScopes are the scopes that tokens must have, by HTTP method.
+	RequiredScopes map[string][]string `json:"required_scopes,omitempty"`
+	// PathRequirements are the additional requirements of tokens for some
+	// request paths.
+	PathRequirements []*PathRequirement `json:"path_requirements,omitempty"`
+	// ForbiddenClaims are the claims that tokens must not have.
+	ForbiddenClaims []string `json:"forbidden_claims,omitempty"`
+	// MaxTokenAge and TimeSkewTolerance are in seconds.
+	MaxTokenAge       int           `json:"max_token_age,omitempty"`
+	TimeSkewTolerance int           `json:"time_skew_tolerance"`
+	Delivery          tokenDelivery `json:"delivery"`
+	HTTPSignatures    bool          `json:"http_signatures,omitempty"`
+	// SessionCookie is the cookie that must be sent along with the token, see
+	// SessionBinding.
+	SessionCookie string `json:"session_cookie,omitempty"`
+}
+
+// tokenDelivery lists where tokens can be sent, in order of priority.
+type tokenDelivery struct {
+	// Order is the priority of the source types, if it's not the default.
+	Order   []string `json:"order,omitempty"`
+	Query   []string `json:"query,omitempty"`
+	Headers []string `json:"headers"`
+	Cookies []string `json:"cookies,omitempty"`
+	Form    []string `json:"form,omitempty"`
+	Body    []string `json:"body,omitempty"`
+	Path    []string `json:"path,omitempty"`
+	// WebSocketProtocol are the marker subprotocols of the token.
+	WebSocketProtocol []string `json:"websocket_protocol,omitempty"`
+	// BasicAuth are the user names of the Basic Authorization header, whose
+	// password is the token.
+	BasicAuth []string `json:"basic_auth,omitempty"`
+}
+
+// newTokenPolicy returns the encoded token policy document of the provider,
+// with the lists. It must be called after the defaults are applied.
+func (p *PasetoAuth) newTokenPolicy(lists *listSet) ([]byte, error) {
+	policy := tokenPolicy{
+		Version:           p.Version,
+		Purpose:           p.Purpose,
+		RequiredClaims:    []string{"exp", "iat", "nbf"},
+		Audiences:         lists.audiences.values,
+		Issuers:           lists.issuers.values,
+		TokenType:         p.TokenType,
+		RequiredScopes:    p.RequireScopes,
+		PathRequirements:  p.PathRequirements,
+		ForbiddenClaims:   p.ForbidClaims,
+		MaxTokenAge:       int(p.MaxTokenAge.Seconds()),
+		TimeSkewTolerance: int(p.TimeSkewTolerance.Seconds()),
+		Delivery: tokenDelivery{
+			Order:   p.TokenSources,
+			Query:   p.FromQuery,
+			Headers: slices.Clone(p.FromHeader),
+			Cookies: p.FromCookies,
+			Form:    p.FromForm,
+			Body:    p.FromBody,
+			Path:    p.FromPath,
+
+			WebSocketProtocol: p.FromWebSocketProtocol,
+			BasicAuth:         p.FromBasicAuth,
+		},
+		HTTPSignatures: p.HTTPSignatures != nil,
+	}
+	if !p.DisableImplicitAuthorization {
+		policy.Delivery.Headers = append(policy.Delivery.Headers, "Authorization")
+	}
+	if lists.audiences.enforced || p.AudienceFromHost {
+		policy.RequiredClaims = append(policy.RequiredClaims, "aud")
+		policy.AudienceMatch = p.AudienceMatch
+		policy.AudienceFromHost = p.AudienceFromHost
+	}
+	if lists.issuers.enforced {
+		policy.RequiredClaims = append(policy.RequiredClaims, "iss")
+	}
+	if p.TokenType != "" {
+		policy.RequiredClaims = append(policy.RequiredClaims, p.TokenTypeClaim)
+	}
+	if len(p.AllowRoles) > 0 {
+		policy.RequiredClaims = append(policy.RequiredClaims, p.RolesClaim)
+		policy.Roles = p.AllowRoles
+	}
+	policy.RequiredClaims = append(policy.RequiredClaims, slices.Sorted(maps.Keys(p.RequireClaims))...)
+	if p.SessionBinding != nil {
+		policy.RequiredClaims = append(policy.RequiredClaims, p.SessionBinding.Claim)
+		policy.SessionCookie = p.SessionBinding.Cookie
+	}
+	if p.SignedURL != nil {
+		policy.RequiredClaims = append(policy.RequiredClaims, p.SignedURL.Bind...)
+	}
+	if p.RouteClaimRequired {
+		policy.RequiredClaims = append(policy.RequiredClaims, p.RouteClaim)
+	}
+	if p.claimMapper == nil {
+		for _, uc := range p.userClaims {
+			policy.UserClaims = append(policy.UserClaims, uc.name)
+		}
+	}
+
+	body, err := json.Marshal(policy)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding well_known document: %w", err)
+	}
+
+	return body, nil
+}
+
+// allowsWellKnown reports whether the request is a request for the token
+// policy document, which doesn't require authentication. The document is set
+// in a request variable for PasetoWellKnown.
+func (p *PasetoAuth) allowsWellKnown(r *http.Request) bool {
+	if p.WellKnown == "" || r.URL.Path != p.WellKnown ||
+		(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		return false
+	}
+	caddyhttp.SetVar(r.Context(), wellKnownVarKey, p.lists.current().policy)
+
+	return true
+}
+
+// PasetoWellKnown is an HTTP handler that responds with the token policy
+// document of the pasetoauth provider that handled the request, if its
+// WellKnown option is enabled. The document describes the accepted protocol
+// version and purpose, the required claims, audiences, issuers, and where
+// tokens can be sent, so that client teams can configure their SDKs
+// programmatically.
+type PasetoWellKnown struct{}
+
+var _ caddyhttp.MiddlewareHandler = (*PasetoWellKnown)(nil)
+
+// CaddyModule returns the Caddy module information.
+func (PasetoWellKnown) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.paseto_well_known",
+		New: func() caddy.Module { return new(PasetoWellKnown) },
+	}
+}
+
+// ServeHTTP responds with the token policy document. It doesn't call the next
+// handler.
+func (PasetoWellKnown) ServeHTTP(w http.ResponseWriter, r *http.Request, _ caddyhttp.Handler) error {
+	body, ok := caddyhttp.GetVar(r.Context(), wellKnownVarKey).([]byte)
+	if !ok {
+		return caddyhttp.Error(http.StatusNotFound, fmt.Errorf("pasetoauth well_known is not enabled for the request"))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return nil
+	}
+	_, err := w.Write(body)
+
+	//nolint:wrapcheck // the write error is returned as is
+	return err
+}
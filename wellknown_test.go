@@ -0,0 +1,109 @@
+package caddypaseto
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"aidanwoods.dev/go-paseto"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"go.hackfix.me/caddy-paseto/testutil"
+)
+
+func TestPasetoWellKnown_ServeHTTP(t *testing.T) {
+	auth := &PasetoAuth{
+		Key:            paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+		AllowAudiences: []string{"api.example.com"},
+		AllowIssuers:   []string{"auth.example.com"},
+		FromHeader:     []string{"X-Token"},
+		FromCookies:    []string{"session"},
+		MaxTokenAge:    time.Hour,
+		WellKnown:      defaultWellKnownPath,
+		logger:         slog.New(testutil.NewTestLogHandler()),
+	}
+	require.NoError(t, auth.Validate())
+
+	newRequest := func(method, path string) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		ctx := context.WithValue(req.Context(), caddyhttp.VarsCtxKey, make(map[string]any))
+		return req.WithContext(ctx)
+	}
+
+	t.Run("ok", func(t *testing.T) {
+		req := newRequest(http.MethodGet, defaultWellKnownPath)
+		user, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+		assert.Empty(t, user.ID)
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, PasetoWellKnown{}.ServeHTTP(rec, req, nil))
+		assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+		assert.Equal(t, "public, max-age=300", rec.Header().Get("Cache-Control"))
+
+		var policy tokenPolicy
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &policy))
+		assert.Equal(t, tokenPolicy{
+			Version:           paseto.Version4,
+			Purpose:           paseto.Public,
+			RequiredClaims:    []string{"exp", "iat", "nbf", "aud", "iss"},
+			UserClaims:        []string{"sub"},
+			Audiences:         []string{"api.example.com"},
+			AudienceMatch:     audienceMatchAny,
+			Issuers:           []string{"auth.example.com"},
+			MaxTokenAge:       3600,
+			TimeSkewTolerance: 30,
+			Delivery: tokenDelivery{
+				Headers: []string{"X-Token", "Authorization"},
+				Cookies: []string{"session"},
+			},
+		}, policy)
+	})
+
+	t.Run("ok/head", func(t *testing.T) {
+		req := newRequest(http.MethodHead, defaultWellKnownPath)
+		_, authenticated, err := auth.Authenticate(httptest.NewRecorder(), req)
+		require.NoError(t, err)
+		require.True(t, authenticated)
+
+		rec := httptest.NewRecorder()
+		require.NoError(t, PasetoWellKnown{}.ServeHTTP(rec, req, nil))
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Empty(t, rec.Body.Bytes())
+	})
+
+	t.Run("err/method", func(t *testing.T) {
+		req := newRequest(http.MethodPost, defaultWellKnownPath)
+		_, authenticated, _ := auth.Authenticate(httptest.NewRecorder(), req)
+		assert.False(t, authenticated)
+	})
+
+	t.Run("err/other_path", func(t *testing.T) {
+		req := newRequest(http.MethodGet, "/api")
+		_, authenticated, _ := auth.Authenticate(httptest.NewRecorder(), req)
+		assert.False(t, authenticated)
+	})
+
+	t.Run("err/not_enabled", func(t *testing.T) {
+		err := PasetoWellKnown{}.ServeHTTP(httptest.NewRecorder(), newRequest(http.MethodGet, defaultWellKnownPath), nil)
+		var handlerErr caddyhttp.HandlerError
+		require.ErrorAs(t, err, &handlerErr)
+		assert.Equal(t, http.StatusNotFound, handlerErr.StatusCode)
+	})
+
+	t.Run("err/invalid_path", func(t *testing.T) {
+		a := &PasetoAuth{
+			Key:       paseto.NewV4AsymmetricSecretKey().Public().ExportHex(),
+			WellKnown: "paseto-auth",
+			logger:    slog.New(testutil.NewTestLogHandler()),
+		}
+		require.ErrorContains(t, a.Validate(), "invalid well_known: path must start with '/'")
+	})
+}